@@ -0,0 +1,180 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"database/sql"
+	"github.com/coocood/jas"
+	"net"
+	"sort"
+	"strings"
+)
+
+// ParseIP parses an address given by a client or read from a file,
+// ignoring surrounding whitespace and brackets, as in "[fc00::1]". It
+// returns the address in its canonical form of sixteen bytes, in
+// which it is stored and compared, so that every spelling of the same
+// address, such as "FF00::1" and "ff00:0:0::1", is the same node. If
+// the address is invalid, it returns nil.
+func ParseIP(s string) IP {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	return IP(net.ParseIP(s)).Canonical()
+}
+
+// Canonical returns the address in its form of sixteen bytes, in
+// which IPv4 addresses are mapped into IPv6, or nil if it is not a
+// valid address.
+func (ip IP) Canonical() IP {
+	return IP(net.IP(ip).To16())
+}
+
+// ParseSubnet parses a network in CIDR notation, such as
+// "fc00::/8". A single address is treated as a network containing
+// only that address.
+func ParseSubnet(s string) (*IPNet, error) {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	return (*IPNet)(ipnet), nil
+}
+
+// Range returns the first and last addresses in the network, in their
+// canonical forms, so that they can be compared with stored addresses.
+func (n *IPNet) Range() (first, last IP) {
+	ip := net.IP(n.IP).To16()
+	mask := n.Mask
+	if len(mask) == net.IPv4len {
+		// The mask of an IPv4 network applies to the last four bytes
+		// of its mapped address.
+		mask = make(net.IPMask, net.IPv6len)
+		for i := 0; i < net.IPv6len-net.IPv4len; i++ {
+			mask[i] = 0xff
+		}
+		copy(mask[net.IPv6len-net.IPv4len:], n.Mask)
+	}
+
+	first = make(IP, net.IPv6len)
+	last = make(IP, net.IPv6len)
+	for i := range ip {
+		first[i] = ip[i] & mask[i]
+		last[i] = ip[i] | ^mask[i]
+	}
+	return
+}
+
+// Overlaps reports whether the two networks share any addresses.
+func (n *IPNet) Overlaps(o *IPNet) bool {
+	first, last := n.Range()
+	oFirst, oLast := o.Range()
+	return bytes.Compare(first, oLast) <= 0 &&
+		bytes.Compare(oFirst, last) <= 0
+}
+
+// GetNodesInSubnet returns the nodes, both local and cached, whose
+// addresses are in the given network, and which are selected by the
+// filter, if it is not nil, in order of address. If several nodes have
+// the same address, only one is included, as in DumpNodes().
+func (db DB) GetNodesInSubnet(subnet *IPNet,
+	f *NodeFilter) (nodes []*Node, err error) {
+	// Stored addresses are canonical, so that every address in the
+	// network lies between its first and last, byte by byte.
+	first, last := subnet.Range()
+	local, localArgs := f.where(false, "address BETWEEN ? AND ?")
+	cached, cachedArgs := f.where(true, "address BETWEEN ? AND ?")
+	args := append([]interface{}{[]byte(first), []byte(last)}, localArgs...)
+	args = append(append(args, []byte(first), []byte(last)), cachedArgs...)
+	rows, err := db.Query(`
+SELECT address,owner,contact,details,pgp,lat,lon,status,0,"",neighborhood,
+map_id,created_at,updated_at
+FROM nodes
+`+local+`
+UNION SELECT address,owner,"",details,"",lat,lon,status,source,via,"",map_id,
+created_at,updated_at
+FROM nodes_cached
+`+cached+`;`, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	nodes = make([]*Node, 0)
+	for rows.Next() {
+		node := new(Node)
+		contact := sql.NullString{}
+		details := sql.NullString{}
+		neighborhood := sql.NullString{}
+		err = rows.Scan(&node.Addr, &node.OwnerName,
+			&contact, &details, &node.PGP,
+			&node.Latitude, &node.Longitude, &node.Status, &node.SourceID,
+			&node.Via, &neighborhood, &node.MapID,
+			&node.CreateTime, &node.UpdateTime)
+		if err != nil {
+			return
+		}
+		node.Contact = contact.String
+		node.Details = details.String
+		node.Neighborhood = neighborhood.String
+		nodes = append(nodes, node)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	nodes = collapseDuplicates(nodes)
+	sort.Sort(nodesByAddr(nodes))
+	return
+}
+
+// nodesByAddr sorts nodes by their addresses.
+type nodesByAddr []*Node
+
+func (n nodesByAddr) Len() int      { return len(n) }
+func (n nodesByAddr) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+func (n nodesByAddr) Less(i, j int) bool {
+	return bytes.Compare(n[i].Addr, n[j].Addr) < 0
+}
+
+// GetSubnet returns the nodes, both local and cached, whose addresses
+// are in the network given by `cidr`, such as "fc00::/8", in order of
+// address, so that router configurations can be generated for a part
+// of the address plan, and conflicts with it found. If `fields` is
+// given, each node has only those fields, and `source`,
+// `exclude_source`, `status`, `created_after`, and `updated_after`
+// select nodes as with FindNodeFilter.
+func (*Api) GetSubnet(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	subnet, err := ParseSubnet(ctx.RequireStringLen(1, 64, "cidr"))
+	if err != nil {
+		ctx.Error = jas.NewRequestError("cidrInvalid")
+		return
+	}
+	fields := FindNodeFields(ctx)
+	nodes, err := db.GetNodesInSubnet(subnet, FindNodeFilter(ctx))
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error getting nodes in %q: %s",
+			(*net.IPNet)(subnet), err)
+		return
+	}
+	ctx.Data = nodes
+	if fields != nil {
+		if ctx.Data, err = fields.Nodes(nodes); err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			apiLog.Request(ctx.Request).Err(err)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"database/sql"
+	"github.com/coocood/jas"
+	"net/http"
+	"time"
+)
+
+// DefaultReservationTime is the length of time for which an address
+// is reserved for a registrant, if Conf.AddressPlan.ReservationTime is
+// not set.
+const DefaultReservationTime = 24 * time.Hour
+
+var (
+	AddressPlanDisabledError = jas.NewRequestError("addressPlanDisabled")
+	AddressesExhaustedError  = newAPIError("addressesExhausted",
+		http.StatusConflict)
+	AddressReservedError = newAPIError("addressReserved",
+		http.StatusConflict)
+)
+
+// Reservation is an address which is held for a registrant for a time,
+// so that nobody else is given it before their node is added.
+type Reservation struct {
+	Addr    IP `json:"Address"`
+	Expires time.Time
+}
+
+// usedAddresses returns the set of addresses, as strings of their
+// bytes, which may not be allocated, because they are used by a node,
+// either local, cached, or waiting to be verified, or because they are
+// reserved.
+func (db DB) usedAddresses() (used map[string]bool, err error) {
+	rows, err := db.Query(`SELECT address FROM nodes
+UNION SELECT address FROM nodes_cached
+UNION SELECT address FROM nodes_verify_queue
+UNION SELECT address FROM address_reservations WHERE expires >= ?;`,
+		time.Now().Unix())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	used = make(map[string]bool)
+	for rows.Next() {
+		var addr []byte
+		if err = rows.Scan(&addr); err != nil {
+			return
+		}
+		used[string(IP(addr).Canonical())] = true
+	}
+	return used, rows.Err()
+}
+
+// nextIP returns the address which follows the given one.
+func nextIP(ip IP) IP {
+	next := make(IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// prevIP returns the address which precedes the given one.
+func prevIP(ip IP) IP {
+	prev := make(IP, len(ip))
+	copy(prev, ip)
+	for i := len(prev) - 1; i >= 0; i-- {
+		prev[i]--
+		if prev[i] != 0xff {
+			break
+		}
+	}
+	return prev
+}
+
+// NextFreeAddress returns the first address in Conf.AddressPlan.Ranges,
+// in the order in which they are configured, which is neither used nor
+// reserved. The first and last addresses of every range of more than
+// two addresses, which are those of the network and its broadcast, are
+// never allocated. If no range has a free address, it returns
+// AddressesExhaustedError.
+func (db DB) NextFreeAddress() (IP, error) {
+	if len(Conf.AddressPlan.Ranges) == 0 {
+		return nil, AddressPlanDisabledError
+	}
+	used, err := db.usedAddresses()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, subnet := range Conf.AddressPlan.Ranges {
+		first, last := subnet.Range()
+		if ones, bits := subnet.Mask.Size(); bits-ones > 1 {
+			first, last = nextIP(first), prevIP(last)
+		}
+		// Only as many addresses as are used can be skipped before
+		// a free one is found, so this ends quickly.
+		for ip := first; bytes.Compare(ip, last) <= 0; ip = nextIP(ip) {
+			if !used[string(ip)] {
+				return ip, nil
+			}
+			if bytes.Equal(ip, last) {
+				break
+			}
+		}
+	}
+	return nil, AddressesExhaustedError
+}
+
+// ReserveAddress reserves the next free address for the registrant
+// with the given email address, for Conf.AddressPlan.ReservationTime.
+// If they already hold a reservation, it is extended and returned
+// instead, so that asking again does not use up addresses.
+func (db DB) ReserveAddress(email string) (r *Reservation, err error) {
+	ttl := time.Duration(Conf.AddressPlan.ReservationTime)
+	if ttl <= 0 {
+		ttl = DefaultReservationTime
+	}
+	now := time.Now()
+	holder := HashEmail(email)
+
+	_, err = db.Exec(`DELETE FROM address_reservations
+WHERE expires < ?;`, now.Unix())
+	if err != nil {
+		return
+	}
+
+	r = &Reservation{Expires: now.Add(ttl)}
+	err = db.QueryRow(`SELECT address FROM address_reservations
+WHERE holder = ?;`, holder).Scan(&r.Addr)
+	if err == nil {
+		_, err = db.Exec(`UPDATE address_reservations
+SET expires = ?
+WHERE address = ?;`, r.Expires.Unix(), []byte(r.Addr))
+		return
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if r.Addr, err = db.NextFreeAddress(); err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`INSERT INTO address_reservations
+(address, holder, expires)
+VALUES(?, ?, ?);`, []byte(r.Addr), holder, r.Expires.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// CheckReservation returns AddressReservedError if the address is
+// reserved for a registrant other than the one with the given email
+// address.
+func (db DB) CheckReservation(addr IP, email string) error {
+	var holder string
+	err := db.QueryRow(`SELECT holder FROM address_reservations
+WHERE address = ? AND expires >= ?;`, []byte(addr),
+		time.Now().Unix()).Scan(&holder)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !EmailMatches(holder, email) {
+		return AddressReservedError
+	}
+	return nil
+}
+
+// GetNextAddress proposes the next free address in the address plan,
+// without reserving it. If no address plan is configured, the error is
+// "addressPlanDisabled", and if every address is used, it is
+// "addressesExhausted".
+func (*Api) GetNextAddress(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	ip, err := db.NextFreeAddress()
+	if err != nil {
+		ctx.Error = apiError(ctx.Request, err)
+		return
+	}
+	ctx.Data = ip
+}
+
+// PostReserveAddress reserves the next free address in the address
+// plan for the registrant with the given `email`, so that they can
+// configure their node before registering it with that address. If
+// they already hold a reservation, it is extended and returned.
+func (*Api) PostReserveAddress(ctx *jas.Context) {
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	db := Db.WithContext(ctx.Request.Context())
+	RequireToken(ctx)
+	email := ctx.RequireStringMatch(EmailRegexp, "email")
+
+	r, err := db.ReserveAddress(email)
+	if err != nil {
+		ctx.Error = apiError(ctx.Request, err)
+		return
+	}
+	ctx.Data = r
+}
@@ -0,0 +1,62 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// adminCommand is a subcommand of "nodeatlas admin", which acts on the
+// database once it is initialized, and then exits.
+type adminCommand struct {
+	// Usage describes the arguments of the command.
+	Usage string
+
+	// Run performs the command with the given arguments.
+	Run func(args []string) error
+}
+
+// adminCommands are the subcommands of "nodeatlas admin", by name.
+var adminCommands = map[string]adminCommand{
+	"merge": {
+		Usage: "merge <primary address> <secondary address>",
+		Run:   adminMerge,
+	},
+	"duplicates": {
+		Usage: "duplicates [radius in meters]",
+		Run:   adminDuplicates,
+	},
+}
+
+// adminUsage returns the usage of every admin command, one per line.
+func adminUsage() string {
+	usage := make([]string, 0, len(adminCommands))
+	for _, cmd := range adminCommands {
+		usage = append(usage, "  nodeatlas admin "+cmd.Usage)
+	}
+	sort.Strings(usage)
+	return strings.Join(usage, "\n")
+}
+
+// RunAdminCommand runs the admin command named by the first of the
+// given arguments, with the rest. If there is no such command, the
+// error describes the usage of every command.
+func RunAdminCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("no admin command given; usage:\n" +
+			adminUsage())
+	}
+	cmd, ok := adminCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown admin command %q; usage:\n%s",
+			args[0], adminUsage())
+	}
+	if err := cmd.Run(args[1:]); err != nil {
+		return fmt.Errorf("admin %s: %s", args[0], err)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"github.com/coocood/jas"
+	"math/rand"
+	"time"
+)
+
+// AdoptNode adds the given cached node as a local node, with the
+// owner email which it has been given, and removes the cached copy.
+// The adoption is recorded, so that the local node is always shown
+// in place of any later copies from the source map.
+func (db DB) AdoptNode(node *Node) (err error) {
+	source := node.SourceID
+	node.SourceID = 0
+	node.RetrieveTime = 0
+	node.Via = ""
+	if err = db.AddNode(node); err != nil {
+		return
+	}
+
+	_, err = db.Exec(`DELETE FROM adoptions
+WHERE address = ?;`, []byte(node.Addr))
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`INSERT INTO adoptions
+(address, source, adopted) VALUES(?, ?, ?);`,
+		[]byte(node.Addr), source, time.Now().Unix())
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`DELETE FROM nodes_cached
+WHERE address = ?;`, []byte(node.Addr))
+	InvalidateIndexes()
+	return
+}
+
+// Adopted returns the addresses of every node which has been adopted
+// and is still local.
+func (db DB) Adopted() (adopted map[string]bool, err error) {
+	rows, err := db.Query(`SELECT adoptions.address
+FROM adoptions
+INNER JOIN nodes ON adoptions.address = nodes.address;`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	adopted = make(map[string]bool)
+	for rows.Next() {
+		var addr []byte
+		if err = rows.Scan(&addr); err != nil {
+			return
+		}
+		adopted[string(addr)] = true
+	}
+	return adopted, rows.Err()
+}
+
+// PostAdopt adopts the cached node with the given `address` on this
+// map, so that it becomes a local node which can be edited here, with
+// the owner's `email`. Since maps never share the email addresses of
+// owners, the request must come from the node itself (or an admin),
+// and the email address is then verified as with PostNode. The node
+// keeps the details of the cached copy, and is shown in its place
+// from then on.
+func (*Api) PostAdopt(ctx *jas.Context) {
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	db := Db.WithContext(ctx.Request.Context())
+	RequireToken(ctx)
+
+	ip := ParseIP(ctx.RequireStringLen(0, 40, "address"))
+	if ip == nil {
+		ctx.Error = jas.NewRequestError("addressInvalid")
+		return
+	}
+	email := ctx.RequireStringMatch(EmailRegexp, "email")
+
+	node, err := db.GetNode(ip)
+	if err != nil {
+		ctx.Error = apiError(ctx.Request, err)
+		return
+	} else if node.SourceID == 0 {
+		ctx.Error = jas.NewRequestError("nodeNotCached")
+		return
+	}
+	if !IsNodeOwner(ctx.Request, ip) {
+		ctx.Error = jas.NewRequestError(
+			RemoteAddressDoesNotMatchError.Error())
+		return
+	}
+	node.OwnerEmail = email
+
+	// Cached nodes may belong to a map other than the main one, but
+	// they can only be adopted into those which are hosted here.
+	if len(node.MapID) > 0 && Conf.FindMap(node.MapID) == nil {
+		node.MapID = ""
+	}
+
+	if err = db.VerifyRegistrant(node); err != nil {
+		ctx.Error = apiError(ctx.Request, err)
+		return
+	}
+
+	if Conf.SMTP == nil {
+		ctx.Error = jas.NewInternalError(SMTPDisabledError)
+		apiLog.Request(ctx.Request).Err(SMTPDisabledError)
+		return
+	}
+
+	// As with new nodes, the node is queued until the email address
+	// is verified, unless verification is disabled.
+	if !Conf.SMTP.VerifyDisabled && !IsAdmin(ctx.Request) {
+		id := rand.Int63()
+
+		emailsent := true
+		if err := SendVerificationEmail(id, node.OwnerEmail,
+			ctx.Request); err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			apiLog.Request(ctx.Request).Err(err)
+			emailsent = false
+		}
+		if err := db.QueueNode(id, emailsent,
+			Conf.VerificationExpiration, node); err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			apiLog.Request(ctx.Request).Err(err)
+			return
+		}
+		if emailsent {
+			ctx.Data = "verification email sent"
+		} else {
+			ctx.Data = "verification email will be resent"
+		}
+		apiLog.Request(ctx.Request).Infof(
+			"Node %q adopted, waiting for verification", ip)
+		return
+	}
+
+	if err = db.AdoptNode(node); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Err(err)
+		return
+	}
+	AddNodeToRSS(node, time.Now())
+	ctx.Data = "node adopted"
+	apiLog.Request(ctx.Request).Infof("Node %q adopted\n", ip)
+}
@@ -0,0 +1,245 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/coocood/jas"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// DefaultAlertThreshold is the length of time that a node must be
+// down before an alert is sent, if Conf.Alerts.Threshold is not set.
+const DefaultAlertThreshold = time.Hour
+
+// alertClient is the HTTP client used to post alerts to
+// Conf.Alerts.WebhookURL.
+var alertClient = &http.Client{Timeout: 10 * time.Second}
+
+// alertThreshold returns Conf.Alerts.Threshold, or
+// DefaultAlertThreshold if it is not set.
+func alertThreshold() time.Duration {
+	if Conf.Alerts.Threshold > 0 {
+		return time.Duration(Conf.Alerts.Threshold)
+	}
+	return DefaultAlertThreshold
+}
+
+// DownSince returns the time at which the node with the given address
+// last stopped being pingable, according to its status history. If it
+// is pingable, or has never been, it returns the zero time.
+func (db DB) DownSince(addr IP) (since time.Time, err error) {
+	history, err := db.StatusHistory(addr)
+	if err != nil {
+		return
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Status&StatusPingable != 0 {
+			if i < len(history)-1 {
+				since = history[i+1].Time
+			}
+			return
+		}
+	}
+	return
+}
+
+// AlertState returns the time until which alerts for the node with
+// the given address are muted, and the down time for which an alert
+// was last sent. Both are zero if they have never been set.
+func (db DB) AlertState(addr IP) (muted, alerted time.Time, err error) {
+	var m, a int64
+	err = db.QueryRow(`SELECT muted,alerted
+FROM alerts
+WHERE address = ?;`, []byte(addr)).Scan(&m, &a)
+	if err == sql.ErrNoRows {
+		return muted, alerted, nil
+	} else if err != nil {
+		return
+	}
+	if m > 0 {
+		muted = time.Unix(m, 0)
+	}
+	if a > 0 {
+		alerted = time.Unix(a, 0)
+	}
+	return
+}
+
+// setAlertState replaces the alert state of the node with the given
+// address. See AlertState.
+func (db DB) setAlertState(addr IP, muted, alerted time.Time) (err error) {
+	var m, a int64
+	if !muted.IsZero() {
+		m = muted.Unix()
+	}
+	if !alerted.IsZero() {
+		a = alerted.Unix()
+	}
+	_, err = db.Exec(`DELETE FROM alerts
+WHERE address = ?;`, []byte(addr))
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`INSERT INTO alerts
+(address, muted, alerted)
+VALUES(?, ?, ?);`, []byte(addr), m, a)
+	return
+}
+
+// MuteAlerts mutes alerts for the node with the given address until
+// the given time. If it is the zero time, alerts are unmuted.
+func (db DB) MuteAlerts(addr IP, until time.Time) (err error) {
+	_, alerted, err := db.AlertState(addr)
+	if err != nil {
+		return
+	}
+	return db.setAlertState(addr, until, alerted)
+}
+
+// CheckAlerts sends an alert for each active local node which was
+// pingable before, but has been down for longer than the alert
+// threshold, unless alerts are muted for the node or the whole
+// instance, or an alert was already sent for the same outage. Errors
+// are logged.
+func CheckAlerts() {
+	if !Conf.Alerts.Enabled || Conf.Alerts.Muted {
+		return
+	}
+	nodes, err := Db.DumpLocal()
+	if err != nil {
+		dbLog.Errf("Error checking alerts: %s", err)
+		return
+	}
+
+	cutoff := time.Now().Add(-alertThreshold())
+	for _, node := range nodes {
+		if node.Status&StatusActive == 0 ||
+			node.Status&StatusPingable != 0 {
+			continue
+		}
+		since, err := Db.DownSince(node.Addr)
+		if err != nil {
+			dbLog.Errf("Error checking alerts of %q: %s", node.Addr, err)
+			continue
+		} else if since.IsZero() || since.After(cutoff) {
+			continue
+		}
+		muted, alerted, err := Db.AlertState(node.Addr)
+		if err != nil {
+			dbLog.Errf("Error checking alerts of %q: %s", node.Addr, err)
+			continue
+		} else if alerted.Equal(since) || muted.After(time.Now()) {
+			continue
+		}
+
+		// DumpLocal omits owner emails, so get the whole node.
+		if node, err = Db.GetNode(node.Addr); err == NodeNotFoundError {
+			continue
+		} else if err != nil {
+			dbLog.Errf("Error getting node to alert: %s", err)
+			continue
+		}
+		SendAlert(node, since)
+		FileTicket(node, since)
+		if err = Db.setAlertState(node.Addr, muted, since); err != nil {
+			dbLog.Errf("Error recording alert of %q: %s", node.Addr, err)
+		}
+	}
+}
+
+// SendAlert alerts the owner of the node by email, if
+// Conf.Alerts.EmailOwner is set, and posts to Conf.Alerts.WebhookURL,
+// if it is set, that the node has been down since the given
+// time. Errors are logged.
+func SendAlert(node *Node, since time.Time) {
+	link := NodePageURL(nil, node.Addr)
+	l.Noticef("Node %q has been down since %s\n", node.Addr, since)
+
+	if Conf.Alerts.EmailOwner && Conf.SMTP != nil &&
+		Db.NodeOwnerPreferences(node).Alerts {
+		e := &Email{
+			To:   node.OwnerEmail,
+			From: Conf.SMTP.EmailAddress,
+			Subject: Translations.Translate(Conf.DefaultLocale(),
+				"email.alert.subject", Conf.Name),
+		}
+		e.Data = map[string]interface{}{
+			"Address":      node.Addr.String(),
+			"Since":        since,
+			"Name":         Conf.Name,
+			"Link":         link,
+			"AdminContact": Conf.AdminContact,
+			"Boundary":     rand.Int31(),
+		}
+		if err := e.Queue("alert.txt"); err != nil {
+			mailLog.Errf("Error queueing alert to %q: %s", node.OwnerEmail,
+				err)
+		}
+	}
+
+	if len(Conf.Alerts.WebhookURL) > 0 {
+		// The payload is of the form accepted by Slack and
+		// Mattermost incoming webhooks.
+		body, _ := json.Marshal(map[string]string{
+			"text": fmt.Sprintf("Node %s (%s) has been down since %s: %s",
+				node.Addr, node.OwnerName, since.Format(time.RFC1123),
+				link),
+		})
+		resp, err := alertClient.Post(Conf.Alerts.WebhookURL,
+			"application/json", bytes.NewReader(body))
+		if err != nil {
+			l.Errf("Error posting alert of %q: %s", node.Addr, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			l.Errf("Error posting alert of %q: %s", node.Addr, resp.Status)
+		}
+	}
+}
+
+// PostMuteAlerts mutes alerts for the local node with the given
+// `address` until the RFC3339 time `until`. If `until` is not given,
+// alerts are unmuted. It requires a token, and must come from the
+// node's owner (see IsNodeOwner).
+func (*Api) PostMuteAlerts(ctx *jas.Context) {
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	db := Db.WithContext(ctx.Request.Context())
+	RequireToken(ctx)
+	node := RequireLocalNode(ctx)
+	if !IsNodeOwner(ctx.Request, node.Addr) {
+		ctx.Error = jas.NewRequestError(
+			RemoteAddressDoesNotMatchError.Error())
+		return
+	}
+
+	var until time.Time
+	if s, _ := ctx.FindString("until"); len(s) > 0 {
+		var err error
+		if until, err = time.Parse(time.RFC3339, s); err != nil {
+			ctx.Error = jas.NewRequestError("untilInvalid")
+			return
+		}
+	}
+	if err := db.MuteAlerts(node.Addr, until); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error muting alerts of %q: %s",
+			node.Addr, err)
+		return
+	}
+	if until.IsZero() {
+		ctx.Data = "unmuted"
+	} else {
+		ctx.Data = "muted"
+	}
+}
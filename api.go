@@ -14,6 +14,8 @@ import (
 	"net/http"
 	"path"
 	"regexp"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -30,8 +32,13 @@ var (
 // functions.
 type Api struct{}
 
+// tokenLifetime is the length of time for which a token from GetToken
+// is valid.
+const tokenLifetime = 5 * time.Minute
+
 var (
 	ActiveTokens = make(map[uint32]token)
+	tokensMutex  sync.Mutex
 )
 
 type token struct {
@@ -39,9 +46,9 @@ type token struct {
 	Issued time.Time
 }
 
-var (
-	ReadOnlyError = jas.NewRequestError("database in readonly mode")
-)
+// apiRouter is the JAS router of the API, which HandleNodeResource
+// passes requests on to.
+var apiRouter *jas.Router
 
 // RegisterAPI invokes http.Handle() with a JAS router using the
 // default net/http server. It will respond to any URL "<prefix>/api".
@@ -51,8 +58,9 @@ func RegisterAPI(prefix string) {
 	router.BasePath = path.Join("/", prefix)
 	// Disable automatic internal error logging.
 	router.InternalErrorLogger = nil
+	apiRouter = router
 
-	l.Debug("API paths:\n", router.HandledPaths(true))
+	apiLog.Debug("API paths:\n", router.HandledPaths(true))
 
 	// Seed the random number generator with the current Unix
 	// time. This is not random, but it should be Good Enough.
@@ -60,6 +68,41 @@ func RegisterAPI(prefix string) {
 
 	// Handle "<prefix>/api/". Note that it must begin and end with /.
 	http.Handle(path.Join("/", prefix, "api")+"/", router)
+
+	// Resources nested under the API, such as Stats, are served by
+	// their own routers, whose paths begin with "<prefix>/api".
+	statsRouter := jas.NewRouter(new(Stats))
+	statsRouter.BasePath = path.Join("/", prefix, "api")
+	statsRouter.InternalErrorLogger = nil
+	apiLog.Debug("Stats paths:\n", statsRouter.HandledPaths(true))
+	http.Handle(path.Join("/", prefix, "api", "stats")+"/", statsRouter)
+
+	reportsRouter := jas.NewRouter(new(Reports))
+	reportsRouter.BasePath = path.Join("/", prefix, "api")
+	reportsRouter.InternalErrorLogger = nil
+	apiLog.Debug("Reports paths:\n", reportsRouter.HandledPaths(true))
+	http.Handle(path.Join("/", prefix, "api", "reports")+"/", reportsRouter)
+
+	fedRouter := jas.NewRouter(new(Federation))
+	fedRouter.BasePath = path.Join("/", prefix, "api")
+	fedRouter.InternalErrorLogger = nil
+	apiLog.Debug("Federation paths:\n", fedRouter.HandledPaths(true))
+	http.Handle(path.Join("/", prefix, "api", "federation")+"/", fedRouter)
+
+	// Admin actions on the cache are served without JAS, because
+	// their paths are nested more deeply.
+	http.HandleFunc(path.Join("/", prefix, "api", "admin", "federation")+"/",
+		HandleAdminFederation)
+	http.HandleFunc(path.Join("/", prefix, "api", "admin", "jobs"),
+		HandleAdminJobs)
+	http.HandleFunc(path.Join("/", prefix, "api", "admin", "jobs")+"/",
+		HandleAdminJobs)
+	http.HandleFunc(path.Join("/", prefix, "api", "admin", "queue"),
+		HandleAdminQueue)
+	http.HandleFunc(path.Join("/", prefix, "api", "admin", "queue")+"/",
+		HandleAdminQueue)
+	http.HandleFunc(path.Join("/", prefix, "api", "admin", "perf"),
+		HandleAdminPerf)
 }
 
 // Get responds on the root API handler ("/api/") with 303 SeeOther
@@ -88,20 +131,38 @@ func (*Api) GetEcho(ctx *jas.Context) {
 // map name, total number of nodes, number available (pingable), etc.
 // (Not yet implemented.)
 func (*Api) GetStatus(ctx *jas.Context) {
-	localNodes := Db.LenNodes(false)
+	db := Db.WithContext(ctx.Request.Context())
+	localNodes := db.LenNodes(false)
 	ctx.Data = map[string]interface{}{
 		"Name":        Conf.Name,
 		"LocalNodes":  localNodes,
-		"CachedNodes": Db.LenNodes(true) - localNodes,
+		"CachedNodes": db.LenNodes(true) - localNodes,
 		"CachedMaps":  len(Conf.ChildMaps),
 	}
 }
 
 // GetToken generates a short random token and stores it in an
-// in-memory map with its generation time. (See CheckToken.)
+// in-memory map with its generation time, or in Redis, if it is
+// enabled, so that it can be checked by any instance. (See
+// CheckToken.)
 func (*Api) GetToken(ctx *jas.Context) {
 	tokenid := rand.Uint32()
+	if RedisEnabled() {
+		_, err := RedisDo("SET", redisKey("tokens", strconv.FormatUint(
+			uint64(tokenid), 10)), ctx.RemoteAddr,
+			"EX", int(tokenLifetime/time.Second))
+		if err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			apiLog.Request(ctx.Request).Errf("Error storing token in Redis: %s",
+				err)
+			return
+		}
+		ctx.Data = tokenid
+		return
+	}
+	tokensMutex.Lock()
 	ActiveTokens[tokenid] = token{ctx.RemoteAddr, time.Now()}
+	tokensMutex.Unlock()
 	ctx.Data = tokenid
 }
 
@@ -118,26 +179,33 @@ func (*Api) GetKey(ctx *jas.Context) {
 // it. If `?geojson` is set, then it returns it in geojson.Feature
 // form.
 func (*Api) GetNode(ctx *jas.Context) {
-	ip := IP(net.ParseIP(ctx.RequireStringLen(0, 40, "address")))
+	db := Db.WithContext(ctx.Request.Context())
+	ip := ParseIP(ctx.RequireStringLen(0, 40, "address"))
 	if ip == nil {
 		// If this is encountered, the address was incorrectly
 		// formatted.
 		ctx.Error = jas.NewRequestError("addressInvalid")
 		return
 	}
-	node, err := Db.GetNode(ip)
+	node, err := db.GetNode(ip)
 	if err != nil {
-		// If there has been a database error, log it and report the
-		// failure.
-		ctx.Error = jas.NewInternalError(err)
-		l.Err(err)
+		// If there are no matching nodes, report that, or if there
+		// has been a database error, log it and report the failure.
+		ctx.Error = apiError(ctx.Request, err)
 		return
 	}
-	if node == nil {
-		// If there are simply no matching nodes, set the error and
-		// return.
-		ctx.Error = jas.NewRequestError("No matching node")
-		return
+
+	// If the node is cached, report the map it originally comes
+	// from. The map it was retrieved via, if different, is part of
+	// the node itself.
+	if node.SourceID != 0 {
+		source, err := db.FindSourceMap(node.SourceID)
+		if err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			apiLog.Request(ctx.Request).Err(err)
+			return
+		}
+		ctx.Extra = map[string]interface{}{"source": source}
 	}
 
 	// We must invoke ParseForm() so that we can access ctx.Form.
@@ -149,6 +217,16 @@ func (*Api) GetNode(ctx *jas.Context) {
 		ctx.Data = node.Feature()
 		return
 	} else {
+		// Include the node's photos, if it is local.
+		if len(node.OwnerEmail) > 0 {
+			node.Photos, err = db.Photos(ip)
+			if err != nil {
+				ctx.Error = jas.NewInternalError(err)
+				apiLog.Request(ctx.Request).Err(err)
+				return
+			}
+		}
+
 		// Only after removing any sensitive data, though.
 		node.OwnerEmail = ""
 
@@ -157,6 +235,28 @@ func (*Api) GetNode(ctx *jas.Context) {
 	}
 }
 
+// GetShortlink returns the short link of the node with the given
+// `address`, creating it if necessary. The short link redirects to
+// the node's page, and is meant for printing on labels and flyers.
+func (*Api) GetShortlink(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	ip := ParseIP(ctx.RequireStringLen(0, 40, "address"))
+	if ip == nil {
+		ctx.Error = jas.NewRequestError("addressInvalid")
+		return
+	}
+	_, err := db.GetNode(ip)
+	if err != nil {
+		ctx.Error = apiError(ctx.Request, err)
+		return
+	}
+
+	ctx.Data, err = ShortURL(ctx.Request, ip)
+	if err != nil {
+		ctx.Error = apiError(ctx.Request, err)
+	}
+}
+
 // PostNode creates a *Node from the submitted form and queues it for
 // addition with a positive 64 bit integer as an ID.
 func (*Api) PostNode(ctx *jas.Context) {
@@ -166,47 +266,54 @@ func (*Api) PostNode(ctx *jas.Context) {
 		ctx.Error = ReadOnlyError
 		return
 	}
+	db := Db.WithContext(ctx.Request.Context())
 	var err error
 
 	// Require a token, because this is mildly sensitive.
 	RequireToken(ctx)
+	RequireNodeInput(ctx, NodeCreate)
 
 	// Initialize the node and retrieve fields.
 	node := new(Node)
 
-	ip := IP(net.ParseIP(ctx.RequireStringLen(0, 40, "address")))
-	if ip == nil {
+	// If no address is given, and there is an address plan, reserve
+	// the next free address for the registrant and use it.
+	var ip IP
+	if s, _ := ctx.FindString("address"); len(s) == 0 &&
+		len(Conf.AddressPlan.Ranges) > 0 {
+		r, err := db.ReserveAddress(
+			ctx.RequireStringMatch(EmailRegexp, "email"))
+		if err != nil {
+			ctx.Error = apiError(ctx.Request, err)
+			return
+		}
+		ip = r.Addr
+		ctx.Extra = map[string]interface{}{"address": ip}
+	} else if ip = ParseIP(ctx.RequireStringLen(0, 40, "address")); ip == nil {
 		// If the address is invalid, return that error.
 		ctx.Error = jas.NewRequestError("addressInvalid")
 		return
 	}
 	node.Addr = ip
-	node.Latitude = ctx.RequireFloat("latitude")
-	node.Longitude = ctx.RequireFloat("longitude")
+	if node.Latitude, node.Longitude, err = RequireLocation(ctx); err != nil {
+		return
+	}
 	node.OwnerName = html.EscapeString(ctx.RequireString("name"))
 	node.OwnerEmail = ctx.RequireStringMatch(EmailRegexp, "email")
 
+	// If a map is given, it must be one of Conf.Maps.
+	node.MapID, _ = ctx.FindString("map")
+	if len(node.MapID) > 0 && Conf.FindMap(node.MapID) == nil {
+		ctx.Error = jas.NewRequestError("mapInvalid")
+		return
+	}
+
 	node.Contact, _ = ctx.FindString("contact")
 	node.Contact = html.EscapeString(node.Contact)
 
 	node.Details, _ = ctx.FindString("details")
 	node.Details = html.EscapeString(node.Details)
 
-	// If Contact, Details, or OwnerName are too long to fit in
-	// the database, produce an error.
-	if len(node.Contact) > 255 {
-		ctx.Error = jas.NewRequestError("contactTooLong")
-		return
-	}
-	if len(node.Details) > 255 {
-		ctx.Error = jas.NewRequestError("detailsTooLong")
-		return
-	}
-	if len(node.OwnerName) > 255 {
-		ctx.Error = jas.NewRequestError("ownerNameTooLong")
-		return
-	}
-
 	// Validate the PGP ID, if given. It can be an lowercase hex
 	// string of length 0, 8, or 16.
 	pgpstr, _ := ctx.FindStringMatch(PGPRegexp, "pgp")
@@ -218,8 +325,8 @@ func (*Api) PostNode(ctx *jas.Context) {
 	node.Status = uint32(status)
 
 	// Ensure that the node is correct and usable.
-	if err = Db.VerifyRegistrant(node); err != nil {
-		ctx.Error = jas.NewRequestError(err.Error())
+	if err = db.VerifyRegistrant(node); err != nil {
+		ctx.Error = apiError(ctx.Request, err)
 		return
 	}
 
@@ -228,7 +335,7 @@ func (*Api) PostNode(ctx *jas.Context) {
 	// If SMTP is missing from the config, we cannot continue.
 	if Conf.SMTP == nil {
 		ctx.Error = jas.NewInternalError(SMTPDisabledError)
-		l.Err(SMTPDisabledError)
+		apiLog.Request(ctx.Request).Err(SMTPDisabledError)
 		return
 	}
 
@@ -238,13 +345,14 @@ func (*Api) PostNode(ctx *jas.Context) {
 		id := rand.Int63() // Pseudo-random positive int64
 
 		emailsent := true
-		if err := SendVerificationEmail(id, node.OwnerEmail); err != nil {
+		if err := SendVerificationEmail(id, node.OwnerEmail,
+			ctx.Request); err != nil {
 			// If the sending of the email fails, set the internal
 			// error and log it, then set a bool so that email can be
 			// resent. If email continues failing to send, it will
 			// eventually expire and be removed from the database.
 			ctx.Error = jas.NewInternalError(err)
-			l.Err(err)
+			apiLog.Request(ctx.Request).Err(err)
 			emailsent = false
 			// Note that we do *not* return here.
 		}
@@ -252,12 +360,12 @@ func (*Api) PostNode(ctx *jas.Context) {
 		// Once we have attempted to send the email, queue the node
 		// for verification. If the email has not been sent, it will
 		// be recorded in the database.
-		if err := Db.QueueNode(id, emailsent,
+		if err := db.QueueNode(id, emailsent,
 			Conf.VerificationExpiration, node); err != nil {
 			// If there is a database failure, report it as an
 			// internal error.
 			ctx.Error = jas.NewInternalError(err)
-			l.Err(err)
+			apiLog.Request(ctx.Request).Err(err)
 			return
 		}
 
@@ -266,18 +374,20 @@ func (*Api) PostNode(ctx *jas.Context) {
 		// email will be resent.
 		if emailsent {
 			ctx.Data = "verification email sent"
-			l.Infof("Node %q entered, waiting for verification", ip)
+			apiLog.Request(ctx.Request).Infof(
+				"Node %q entered, waiting for verification", ip)
 		} else {
 			ctx.Data = "verification email will be resent"
-			l.Infof("Node %q entered, verification email will be resent",
+			apiLog.Request(ctx.Request).Infof(
+				"Node %q entered, verification email will be resent",
 				ip)
 		}
 	} else {
-		err := Db.AddNode(node)
+		err := db.AddNode(node)
 		if err != nil {
 			// If there was an error, log it and report the failure.
 			ctx.Error = jas.NewInternalError(err)
-			l.Err(err)
+			apiLog.Request(ctx.Request).Err(err)
 			return
 		}
 
@@ -285,8 +395,32 @@ func (*Api) PostNode(ctx *jas.Context) {
 		AddNodeToRSS(node, time.Now())
 
 		ctx.Data = "node registered"
-		l.Infof("Node %q registered\n", ip)
+		apiLog.Request(ctx.Request).Infof("Node %q registered\n", ip)
+	}
+}
+
+// RequireLocation retrieves the coordinates of a node from the
+// request. If `street_address` is given, it is geocoded instead of
+// requiring `latitude` and `longitude`. If there is an error, it is
+// set as ctx.Error and returned.
+func RequireLocation(ctx *jas.Context) (lat, lon float64, err error) {
+	street, _ := ctx.FindString("street_address")
+	if len(street) == 0 {
+		return ctx.RequireFloat("latitude"), ctx.RequireFloat("longitude"), nil
+	}
+
+	lat, lon, err = Geocode(street)
+	switch err {
+	case nil:
+	case AddressNotFoundError:
+		ctx.Error = jas.NewRequestError("streetAddressNotFound")
+	case GeocoderDisabledError:
+		ctx.Error = jas.NewRequestError("geocodingDisabled")
+	default:
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error geocoding %q: %s", street, err)
 	}
+	return
 }
 
 // PostUpdateNode removes a Node of a given IP from the database and
@@ -294,105 +428,130 @@ func (*Api) PostNode(ctx *jas.Context) {
 // removing a Node from the database, then invoking PostNode() with
 // its information, with the exception that it does not send a
 // verification email, and requires that the request be sent by the
-// Node that is being update.
+// Node that is being update. If `version` is given, the node is only
+// updated if it is still at that version.
 func (*Api) PostUpdateNode(ctx *jas.Context) {
+	if updateNode(ctx, NodeUpdate) != nil {
+		// If we reach this point, all was successful.
+		ctx.Data = "successful"
+	}
+}
+
+// PostPatchNode changes only the fields of a local node which are
+// given, and leaves the others as they are, as PostUpdateNode does
+// otherwise. If `version` is not given, the node is only changed if
+// it has not been changed since it was retrieved here, so that
+// concurrent changes to other fields are not undone. It responds with
+// the node, including its new version.
+func (*Api) PostPatchNode(ctx *jas.Context) {
+	if node := updateNode(ctx, NodePatch); node != nil {
+		node.OwnerEmail = ""
+		ctx.Data = node
+	}
+}
+
+// updateNode changes the local node with the given `address`, as
+// PostUpdateNode and PostPatchNode do, and returns it. If it can't,
+// the error is set as ctx.Error, and it returns nil.
+func updateNode(ctx *jas.Context, input NodeInput) *Node {
 	if Db.ReadOnly {
 		// If the database is readonly, set that as the error and
 		// return.
 		ctx.Error = ReadOnlyError
-		return
+		return nil
 	}
+	db := Db.WithContext(ctx.Request.Context())
 	var err error
 
 	// Require a token, because this is a very sensitive endpoint.
 	RequireToken(ctx)
+	RequireNodeInput(ctx, input)
 
 	// Retrieve the given IP address, check that it's sane, and check
 	// that it exists in the *local* database.
-	ip := IP(net.ParseIP(ctx.RequireStringLen(0, 40, "address")))
+	ip := ParseIP(ctx.RequireStringLen(0, 40, "address"))
 	if ip == nil {
 		// If the address is invalid, return that error.
 		ctx.Error = jas.NewRequestError("addressInvalid")
-		return
+		return nil
 	}
 
-	node, err := Db.GetNode(ip)
+	node, err := db.GetLocalNode(ip)
 	if err != nil {
-		ctx.Error = jas.NewInternalError(err.Error())
-		return
-	}
-
-	if node == nil || len(node.OwnerEmail) == 0 {
-		ctx.Error = jas.NewRequestError("no matching local node")
-		return
+		ctx.Error = apiError(ctx.Request, err)
+		return nil
 	}
 
 	// Check to make sure that the Node is the one sending the
-	// address, or an admin. If not, return an error.
-	if !net.IP(ip).Equal(net.ParseIP(ctx.RemoteAddr)) &&
-		!IsAdmin(ctx.Request) {
+	// address, an admin, or the holder of its edit token. If not,
+	// return an error.
+	if !IsNodeOwner(ctx.Request, ip) {
 		ctx.Error = jas.NewRequestError(
 			RemoteAddressDoesNotMatchError.Error())
-		return
+		return nil
 	}
 
-	node.Addr = ip
-	node.Latitude = ctx.RequireFloat("latitude")
-	node.Longitude = ctx.RequireFloat("longitude")
-	node.OwnerName = html.EscapeString(ctx.RequireString("name"))
-	node.Contact, err = ctx.FindString("contact")
-	if err != nil {
-		ctx.Error = jas.NewRequestError("someError")
-		return
+	// Every field is replaced by an update, but only those which are
+	// given by a patch.
+	given := func(name string) bool {
+		_, ok := ctx.Form[name]
+		return ok || input != NodePatch
 	}
-	node.Contact = html.EscapeString(node.Contact)
-	node.Details, err = ctx.FindString("details")
-	if err != nil {
-		ctx.Error = jas.NewRequestError("someError")
-		return
-	}
-	node.Details = html.EscapeString(node.Details)
 
-	// If Contact, Details, or OwnerName are too long to fit in
-	// the database, produce an error.
-	if len(node.Contact) > 255 {
-		ctx.Error = jas.NewRequestError("contactTooLong")
-		return
+	node.Addr = ip
+	if given("latitude") || given("longitude") || given("street_address") {
+		node.Latitude, node.Longitude, err = RequireLocation(ctx)
+		if err != nil {
+			return nil
+		}
 	}
-	if len(node.Details) > 255 {
-		ctx.Error = jas.NewRequestError("detailsTooLong")
-		return
+	if given("name") {
+		node.OwnerName = html.EscapeString(ctx.RequireString("name"))
 	}
-	if len(node.OwnerName) > 255 {
-		ctx.Error = jas.NewRequestError("ownerNameTooLong")
-		return
+	if given("contact") {
+		node.Contact, _ = ctx.FindString("contact")
+		node.Contact = html.EscapeString(node.Contact)
+	}
+	if given("details") {
+		node.Details, _ = ctx.FindString("details")
+		node.Details = html.EscapeString(node.Details)
 	}
 
 	// Validate the PGP ID, if given. It can be an lowercase hex
 	// string of length 0, 8, or 16.
-	pgpstr, _ := ctx.FindStringMatch(PGPRegexp, "pgp")
-	if node.PGP, err = DecodePGPID([]byte(pgpstr)); err != nil {
-		ctx.Error = jas.NewRequestError("pgpInvalid")
-		return
+	if given("pgp") {
+		pgpstr, _ := ctx.FindStringMatch(PGPRegexp, "pgp")
+		if node.PGP, err = DecodePGPID([]byte(pgpstr)); err != nil {
+			ctx.Error = jas.NewRequestError("pgpInvalid")
+			return nil
+		}
+	}
+	if given("status") {
+		status, _ := ctx.FindPositiveInt("status")
+		node.Status = uint32(status)
 	}
-	status, _ := ctx.FindPositiveInt("status")
-	node.Status = uint32(status)
 
 	// Note that we do not perform a verification step here, or send
 	// an email. Because the Node was already verified once, we can
-	// assume that it remains usable.
+	// assume that it remains usable, except by the rules added by
+	// extensions.
+	if err = ValidateNode(node); err != nil {
+		ctx.Error = jas.NewRequestError(err.Error())
+		return nil
+	}
 
 	// Update the Node in the database, replacing the one of matching
-	// IP.
-	err = Db.UpdateNode(node)
-	if err != nil {
-		ctx.Error = jas.NewInternalError(err)
-		l.Errf("Error updating %q: %s", node.Addr, err)
-		return
+	// IP, unless it has changed since the version the client, or a
+	// patch, is based on.
+	version, _ := ctx.FindPositiveInt("version")
+	if version == 0 && input == NodePatch {
+		version = node.Version
 	}
-
-	// If we reach this point, all was successful.
-	ctx.Data = "successful"
+	if err = db.UpdateNode(node, version); err != nil {
+		ctx.Error = apiError(ctx.Request, err)
+		return nil
+	}
+	return node
 }
 
 // PostDeleteNode removes a node with the given address from the
@@ -405,6 +564,7 @@ func (*Api) PostDeleteNode(ctx *jas.Context) {
 		ctx.Error = ReadOnlyError
 		return
 	}
+	db := Db.WithContext(ctx.Request.Context())
 	var err error
 
 	// Require a token, because this is a very sensitive endpoint.
@@ -412,7 +572,7 @@ func (*Api) PostDeleteNode(ctx *jas.Context) {
 
 	// Retrieve the given IP address, check that it's sane, and check
 	// that it exists in the *local* database.
-	ip := IP(net.ParseIP(ctx.RequireStringLen(0, 40, "address")))
+	ip := ParseIP(ctx.RequireStringLen(0, 40, "address"))
 	if ip == nil {
 		// If the address is invalid, return that error.
 		ctx.Error = jas.NewRequestError("addressInvalid")
@@ -420,27 +580,60 @@ func (*Api) PostDeleteNode(ctx *jas.Context) {
 	}
 
 	// Check to make sure that the Node is the one sending the
-	// address, or an admin. If not, return an error.
-	if !net.IP(ip).Equal(net.ParseIP(ctx.RemoteAddr)) &&
-		!IsAdmin(ctx.Request) {
+	// address, an admin, or the holder of its edit token. If not,
+	// return an error.
+	if !IsNodeOwner(ctx.Request, ip) {
 		ctx.Error = jas.NewRequestError(
 			RemoteAddressDoesNotMatchError.Error())
 		return
 	}
 
-	// If all is well, then delete it.
-	err = Db.DeleteNode(ip)
-	if err == sql.ErrNoRows {
+	// If all is well, then delete it, keeping it in the audit log.
+	node, err := db.GetLocalNode(ip)
+	if err == nil {
+		err = db.DeleteNode(ip)
+	}
+	if err == LocalNodeNotFoundError {
 		// If there are no rows with that IP, explain that in the
 		// error.
-		//
-		// I'm not actually sure this can happen. (DuoNoxSol)
-		ctx.Error = jas.NewRequestError("no matching node")
+		ctx.Error = LocalNodeNotFoundError
 	} else if err != nil {
 		ctx.Error = jas.NewInternalError(err)
-		l.Errf("Error deleting node: %s\n")
+		apiLog.Request(ctx.Request).Errf("Error deleting node: %s\n", err)
 	} else {
-		l.Infof("Node %q deleted\n", ip)
+		apiLog.Request(ctx.Request).Infof("Node %q deleted\n", ip)
+		actor := auditEmail(node.OwnerEmail)
+		if IsAdmin(ctx.Request) {
+			actor = "admin"
+		}
+		db.AuditDeletion(node, actor)
+		RemoveNodePhotos(ip)
+		if err := db.RemoveEditToken(ip); err != nil {
+			apiLog.Request(ctx.Request).Errf(
+				"Error removing edit token of %q: %s", ip, err)
+		}
+		if err := db.RemoveHeartbeats(ip); err != nil {
+			apiLog.Request(ctx.Request).Errf(
+				"Error removing heartbeats of %q: %s", ip, err)
+		}
+		if err := db.ShelveEquipment(ip); err != nil {
+			apiLog.Request(ctx.Request).Errf(
+				"Error shelving equipment of %q: %s", ip, err)
+		}
+		if err := db.RemoveInterfaces(ip); err != nil {
+			apiLog.Request(ctx.Request).Errf(
+				"Error removing interfaces of %q: %s", ip, err)
+		}
+		if _, err := db.Exec(`DELETE FROM node_elevations
+WHERE address = ?;`, []byte(ip)); err != nil {
+			apiLog.Request(ctx.Request).Errf(
+				"Error removing elevation of %q: %s", ip, err)
+		}
+		if err := db.RemoveCoverage(ip); err != nil && err != sql.ErrNoRows {
+			apiLog.Request(ctx.Request).Errf(
+				"Error removing coverage of %q: %s", ip, err)
+		}
+		RunHooks(HookNodeDeleted, map[string]IP{"Address": ip})
 		ctx.Data = "deleted"
 	}
 }
@@ -448,8 +641,9 @@ func (*Api) PostDeleteNode(ctx *jas.Context) {
 // GetVerify moves a node from the verification queue to the normal
 // database, as identified by its long random ID.
 func (*Api) GetVerify(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
 	id := ctx.RequireInt("id")
-	ip, verifyerr, err := Db.VerifyQueuedNode(id, ctx.Request)
+	ip, verifyerr, err := db.VerifyQueuedNode(id, ctx.Request)
 	if verifyerr != nil {
 		// If there was an error inverification, there was no internal
 		// error, but the circumstances of the verification were
@@ -460,38 +654,91 @@ func (*Api) GetVerify(ctx *jas.Context) {
 		// If we encounter a ErrNoRows, then there was no node with
 		// that ID. Report it.
 		ctx.Error = jas.NewRequestError("invalid id")
-		l.Noticef("%q attempted to verify invalid ID\n", ctx.RemoteAddr)
+		apiLog.Request(ctx.Request).Noticef(
+			"%q attempted to verify invalid ID\n", ctx.RemoteAddr)
 		return
 	} else if err != nil {
 		// If we encounter any other database error, it is an internal
 		// error and needs to be logged.
 		ctx.Error = jas.NewInternalError(err)
-		l.Err(err)
+		apiLog.Request(ctx.Request).Err(err)
 		return
 	}
 	// If there was no error, inform the user that it was successful,
 	// and log it.
 	ctx.Data = "successful"
-	l.Infof("Node %q verified", ip)
+	apiLog.Request(ctx.Request).Infof("Node %q verified", ip)
 }
 
 // GetAll dumps the entire database of nodes, including cached
 // ones. If the form value `since` is supplied with a valid RFC3339
 // timestamp, only nodes updated or cached more recently than that
 // will be dumped. If 'geojson' is present, then the "data" field
-// contains the dump in GeoJSON compliant form.
+// contains the dump in GeoJSON compliant form. If `fields` is given,
+// each node has only those fields, as with FindNodeFields, and
+// `source`, `exclude_source`, `status`, `created_after`, and
+// `updated_after` select nodes as with FindNodeFilter. The number of
+// nodes with each status, as by StatusCounts, is given as `statuses`,
+// whether or not they are selected by `status`.
+//
+// The content hash of every node is given as `hash`, as by GetHash. If
+// the form value `hash` is the same, nothing has changed, and no nodes
+// are dumped.
+//
+// If `as_of` is given, as an RFC3339 timestamp or a date, the nodes are
+// dumped as they were at that time, as by NodesAsOf, instead, and
+// `since` and `hash` are ignored.
 func (*Api) GetAll(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
 	// We must invoke ParseForm() so that we can access ctx.Form.
 	ctx.ParseForm()
 
+	var asOf time.Time
+	var err error
+	if s := ctx.FormValue("as_of"); len(s) > 0 {
+		if asOf, err = parseTime("as_of", s); err != nil {
+			ctx.Error = apiError(ctx.Request, err)
+			return
+		}
+	}
+
+	// The hash is computed before the dump, so that it is never newer
+	// than the nodes it is given with. At worst, the nodes are newer,
+	// and are fetched again unnecessarily. Past nodes have no hash.
+	var hash string
+	if asOf.IsZero() {
+		if hash, _, err = Hash.Current(); err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			apiLog.Request(ctx.Request).Err(err)
+			return
+		}
+		if given, ok := ctx.Form["hash"]; ok && given[0] == hash {
+			ctx.Extra = map[string]interface{}{
+				"hash":    hash,
+				"changed": false,
+			}
+			return
+		}
+	}
+
 	// In order to access this at the end, we need to declare nodes
 	// here, so the results from the dump don't go out of scope.
 	var nodes []*Node
-	var err error
-
-	// If the form value "since" was supplied, we will be doing a dump
-	// based on update/retrieve time.
-	if tstring := ctx.FormValue("since"); len(tstring) > 0 {
+	filter := FindNodeFilter(ctx)
+
+	// Nodes are selected by their statuses only after the statuses
+	// are counted, so that the counts include those which are not
+	// selected.
+	counted := filter.WithoutStatuses()
+
+	// If the form value "as_of" was supplied, the nodes are
+	// reconstructed from their history. If "since" was, we will be
+	// doing a dump based on update/retrieve time. Deleted nodes are
+	// only reconstructed for administrators, because they are taken
+	// from the audit log.
+	if !asOf.IsZero() {
+		nodes, err = db.NodesAsOf(asOf, counted, IsAdmin(ctx.Request))
+	} else if tstring := ctx.FormValue("since"); len(tstring) > 0 {
 		var t time.Time
 		t, err = time.Parse(time.RFC3339, tstring)
 		if err != nil {
@@ -502,32 +749,215 @@ func (*Api) GetAll(ctx *jas.Context) {
 
 		// Now, perform the time-based dump. Errors will be handled
 		// outside the if block.
-		nodes, err = Db.DumpChanges(t)
+		nodes, err = db.DumpChanges(t, counted)
 	} else {
 		// If there was no "since," provide a simple full-database
 		// dump.
-		nodes, err = Db.DumpNodes()
+		nodes, err = db.DumpNodesMatching(counted)
 	}
 
 	// Handle any database errors here.
 	if err != nil {
 		ctx.Error = jas.NewInternalError(err)
-		l.Err(err)
+		apiLog.Request(ctx.Request).Err(err)
 		return
 	}
 
+	// If the form value 'map' is included, only include the nodes
+	// of that map. The main map is given by an empty value.
+	if ids, ok := ctx.Form["map"]; ok {
+		nodes = NodesInMap(nodes, ids[0])
+	}
+	statuses := StatusCounts(nodes)
+	nodes = filter.Filter(nodes)
+
 	// If the form value 'geojson' is included, dump in GeoJSON
 	// form. Otherwise, just dump with normal marhshalling.
+	fields := FindNodeFields(ctx)
+	extra := map[string]interface{}{"statuses": statuses}
+	if asOf.IsZero() {
+		extra["hash"] = hash
+	} else {
+		extra["as_of"] = asOf
+	}
+	if _, ok := ctx.Form["geojson"]; ok {
+		fc := FeatureCollectionNodes(nodes)
+		if fields != nil {
+			fields.FeatureCollection(fc)
+		}
+		ctx.Data = fc
+		ctx.Extra = extra
+	} else {
+		mappedNodes, err := db.CacheFormatNodes(nodes)
+		if err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			apiLog.Request(ctx.Request).Err(err)
+			return
+		}
+		sources, err := SourcesFreshness(mappedNodes)
+		if err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			apiLog.Request(ctx.Request).Err(err)
+			return
+		}
+		ctx.Data = mappedNodes
+		if fields != nil {
+			if ctx.Data, err = fields.SourceMaps(mappedNodes); err != nil {
+				ctx.Error = jas.NewInternalError(err)
+				apiLog.Request(ctx.Request).Err(err)
+				return
+			}
+		}
+		extra["sources"] = sources
+		ctx.Extra = extra
+	}
+}
+
+// GetBbox returns all nodes, both local and cached, within the
+// bounding box given by the form value `bbox`, which is of the form
+// "minLon,minLat,maxLon,maxLat". The nodes are given in the same
+// form as GetAll, including `?geojson`, `?fields`, and the filters of
+// FindNodeFilter, and with the same `statuses`.
+func (*Api) GetBbox(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	b, err := ParseBounds(ctx.RequireString("bbox"))
+	if err != nil {
+		ctx.Error = jas.NewRequestError("bboxInvalid")
+		return
+	}
+	filter := FindNodeFilter(ctx)
+
+	nodes, err := Index.Within(b)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Err(err)
+		return
+	}
+	statuses := StatusCounts(filter.WithoutStatuses().Filter(nodes))
+	nodes = filter.Filter(nodes)
+
+	ctx.ParseForm()
+	fields := FindNodeFields(ctx)
 	if _, ok := ctx.Form["geojson"]; ok {
-		ctx.Data = FeatureCollectionNodes(nodes)
+		fc := FeatureCollectionNodes(nodes)
+		if fields != nil {
+			fields.FeatureCollection(fc)
+		}
+		ctx.Data = fc
+		ctx.Extra = map[string]interface{}{"statuses": statuses}
 	} else {
-		mappedNodes, err := Db.CacheFormatNodes(nodes)
+		mappedNodes, err := db.CacheFormatNodes(nodes)
 		if err != nil {
 			ctx.Error = jas.NewInternalError(err)
-			l.Err(err)
+			apiLog.Request(ctx.Request).Err(err)
+			return
+		}
+		sources, err := SourcesFreshness(mappedNodes)
+		if err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			apiLog.Request(ctx.Request).Err(err)
 			return
 		}
 		ctx.Data = mappedNodes
+		if fields != nil {
+			if ctx.Data, err = fields.SourceMaps(mappedNodes); err != nil {
+				ctx.Error = jas.NewInternalError(err)
+				apiLog.Request(ctx.Request).Err(err)
+				return
+			}
+		}
+		ctx.Extra = map[string]interface{}{
+			"sources":  sources,
+			"statuses": statuses,
+		}
+	}
+}
+
+// GetNear returns the nodes, both local and cached, within `radius`
+// meters of the point given by `latitude` and `longitude`, closest
+// first, with their distance in meters. If `limit` is given, at most
+// that many nodes are returned. If `fields` is given, each node has
+// only those fields and its distance, and `source`, `exclude_source`,
+// `status`, `created_after`, and `updated_after` select nodes as with
+// FindNodeFilter.
+func (*Api) GetNear(ctx *jas.Context) {
+	lat := ctx.RequireFloat("latitude")
+	lon := ctx.RequireFloat("longitude")
+	radius := ctx.RequireFloat("radius")
+	if radius <= 0 {
+		ctx.Error = jas.NewRequestError("radiusInvalid")
+		return
+	}
+	limit, _ := ctx.FindPositiveInt("limit")
+	fields := FindNodeFields(ctx)
+	filter := FindNodeFilter(ctx)
+
+	near, err := Index.Near(lat, lon, radius, int(limit), filter)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Err(err)
+		return
+	}
+	ctx.Data = near
+	if fields != nil {
+		if ctx.Data, err = fields.NearNodes(near); err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			apiLog.Request(ctx.Request).Err(err)
+		}
+	}
+}
+
+// GetCluster groups the nodes within the bounding box given by `bbox`
+// into clusters appropriate for the Leaflet zoom level given by
+// `zoom`, using Conf.Map.ClusterRadius as the size of each cluster in
+// pixels. Clusters of a single node include that node.
+func (*Api) GetCluster(ctx *jas.Context) {
+	b, err := ParseBounds(ctx.RequireString("bbox"))
+	if err != nil {
+		ctx.Error = jas.NewRequestError("bboxInvalid")
+		return
+	}
+	zoom := ctx.RequireInt("zoom")
+	if zoom < 0 || zoom > 30 {
+		ctx.Error = jas.NewRequestError("zoomInvalid")
+		return
+	}
+
+	radius := Conf.Map.ClusterRadius
+	if radius <= 0 {
+		radius = 50
+	}
+
+	ctx.Data, err = Index.Clusters(b, int(zoom), radius)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Err(err)
+	}
+}
+
+// GetSearch performs a full-text search of the names, details,
+// contact information, and addresses of all nodes, both local and
+// cached, for the form value `q`. It returns up to `limit` (default
+// 20) results, most relevant first, each with its score and the byte
+// ranges of the matching words in each field.
+func (*Api) GetSearch(ctx *jas.Context) {
+	query := ctx.RequireStringLen(1, 255, "q")
+	limit, _ := ctx.FindPositiveInt("limit")
+	if limit == 0 {
+		limit = 20
+	}
+
+	// Addresses are indexed in their canonical form, so that they
+	// are found however they are written.
+	if ip := ParseIP(query); ip != nil {
+		query = ip.String()
+	}
+
+	var err error
+	ctx.Data, err = Searcher.Search(query, int(limit))
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Err(err)
 	}
 }
 
@@ -535,6 +965,7 @@ func (*Api) GetAll(ctx *jas.Context) {
 // the node with the given IP. It requires a correct and non-expired
 // CAPTCHA pair be given.
 func (*Api) PostMessage(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
 	// Because this is a somewhat sensitive endpoint, require a token.
 	RequireToken(ctx)
 
@@ -551,7 +982,7 @@ func (*Api) PostMessage(ctx *jas.Context) {
 
 	// Next, retrieve the IP of the node the user is attempting to
 	// contact.
-	ip := IP(net.ParseIP(ctx.RequireStringLen(0, 40, "address")))
+	ip := ParseIP(ctx.RequireStringLen(0, 40, "address"))
 	if ip == nil {
 		// If the address is invalid, return that error.
 		ctx.Error = jas.NewRequestError("addressInvalid")
@@ -564,16 +995,11 @@ func (*Api) PostMessage(ctx *jas.Context) {
 	message := ctx.RequireStringLen(0, 1000, "message")
 
 	// Retrieve the appropriate node from the database.
-	node, err := Db.GetNode(ip)
+	node, err := db.GetNode(ip)
 	if err != nil {
-		// If we encounter an error here, it was a database error.
-		ctx.Error = jas.NewInternalError(err)
-		l.Err("Error getting node %q: %s", ip, err)
-		return
-	} else if node == nil {
 		// If the IP wasn't found, explain that there was no node with
-		// that IP.
-		ctx.Error = jas.NewRequestError("address unknown")
+		// that IP. Otherwise, it was a database error.
+		ctx.Error = apiError(ctx.Request, err)
 		return
 	} else if len(node.OwnerEmail) == 0 {
 		// If there was no email on the node, that probably means that
@@ -584,16 +1010,16 @@ func (*Api) PostMessage(ctx *jas.Context) {
 
 	// Create and send an email. Log any errors.
 	e := &Email{
-		To:      node.OwnerEmail,
-		From:    Conf.SMTP.EmailAddress,
-		Subject: "Message via " + Conf.Name,
+		To:   node.OwnerEmail,
+		From: Conf.SMTP.EmailAddress,
+		Subject: Translations.Translate(Conf.DefaultLocale(),
+			"email.message.subject", Conf.Name),
 	}
 	e.Data = map[string]interface{}{
-		"ReplyTo": replyto,
-		"Message": template.HTML(message),
-		"Name":    Conf.Name,
-		"Link": template.HTML(Conf.Web.Hostname + Conf.Web.Prefix +
-			"/node/" + ip.String()),
+		"ReplyTo":      replyto,
+		"Message":      template.HTML(message),
+		"Name":         Conf.Name,
+		"Link":         template.HTML(NodePageURL(ctx.Request, ip)),
 		"AdminContact": Conf.AdminContact,
 
 		// Generate a random number for use as a boundary marker in the
@@ -604,23 +1030,24 @@ func (*Api) PostMessage(ctx *jas.Context) {
 	err = e.Send("message.txt")
 	if err != nil {
 		ctx.Error = jas.NewInternalError(err)
-		l.Errf("Error messaging %q from %q: %s",
+		apiLog.Request(ctx.Request).Errf("Error messaging %q from %q: %s",
 			node.OwnerEmail, replyto, err)
 		return
 	}
 
 	// Even if there is no error, log the to and from info, in case it
 	// is abusive or spam.
-	l.Noticef("IP %q sent a message to %q from %q",
+	apiLog.Request(ctx.Request).Noticef("IP %q sent a message to %q from %q",
 		ctx.Request.RemoteAddr, node.OwnerEmail, replyto)
 }
 
 func (*Api) GetChildMaps(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
 	var err error
-	ctx.Data, err = Db.DumpChildMaps()
+	ctx.Data, err = db.DumpChildMaps()
 	if err != nil {
 		ctx.Error = jas.NewInternalError(err)
-		l.Errf("Error dumping child maps: %s", err)
+		apiLog.Request(ctx.Request).Errf("Error dumping child maps: %s", err)
 	}
 	return
 }
@@ -635,23 +1062,73 @@ func RequireToken(ctx *jas.Context) {
 	}
 }
 
+// RequireAdmin panics with "notAdmin" if the request does not come
+// from an admin address. See IsAdmin.
+func RequireAdmin(ctx *jas.Context) {
+	if !IsAdmin(ctx.Request) {
+		panic(jas.NewRequestError("notAdmin"))
+	}
+}
+
+// RequireLocalNode uses the finder to retrieve the local node whose
+// address is given by the value named "address", and panics with
+// "addressInvalid" or "no matching local node" if there is none.
+func RequireLocalNode(ctx *jas.Context) *Node {
+	db := Db.WithContext(ctx.Request.Context())
+	ip := ParseIP(ctx.RequireStringLen(0, 40, "address"))
+	if ip == nil {
+		panic(jas.NewRequestError("addressInvalid"))
+	}
+	node, err := db.GetLocalNode(ip)
+	if err != nil {
+		panic(apiError(ctx.Request, err))
+	}
+	return node
+}
+
 // CheckToken ensures that a particular token is valid, meaning that
 // it is in the list, and has not expired. If so, it removes the token
 // and returns true. If the token is expired, it is removed, and the
 // function returns false.
 func CheckToken(IP string, token uint32) bool {
+	if RedisEnabled() {
+		return checkRedisToken(IP, token)
+	}
+	tokensMutex.Lock()
 	t, ok := ActiveTokens[token]
 	if ok {
 		delete(ActiveTokens, token)
 	}
+	tokensMutex.Unlock()
 
-	if !ok || time.Now().After(t.Issued.Add(time.Minute*5)) ||
+	if !ok || time.Now().After(t.Issued.Add(tokenLifetime)) ||
 		t.IP != IP {
 		return false
 	}
 	return true
 }
 
+// redisTokenScript removes the key KEYS[1] and returns its value, so
+// that a token can only be used once, even by several instances.
+const redisTokenScript = `
+local ip = redis.call("GET", KEYS[1])
+redis.call("DEL", KEYS[1])
+return ip
+`
+
+// checkRedisToken is CheckToken for tokens stored in Redis, which
+// expire on their own. Errors are logged, and the token is rejected.
+func checkRedisToken(IP string, token uint32) bool {
+	reply, err := RedisDo("EVAL", redisTokenScript, 1, redisKey("tokens",
+		strconv.FormatUint(uint64(token), 10)))
+	if err != nil {
+		apiLog.Errf("Error checking token in Redis: %s", err)
+		return false
+	}
+	ip, ok := reply.(string)
+	return ok && ip == IP
+}
+
 // IsAdmin is a small wrapper function to check if the given address
 // belongs to an admin, as specified in Conf.AdminAddresses.
 func IsAdmin(req *http.Request) bool {
@@ -0,0 +1,147 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/coocood/jas"
+	"time"
+)
+
+// AuditEntry is a record of a significant change to a local node,
+// such as a change of ownership.
+type AuditEntry struct {
+	Addr   IP `json:"Address"`
+	Time   time.Time
+	Action string
+
+	// Actor is the email address of the person who made the change,
+	// in the form given by auditEmail, "admin", or "system" if
+	// NodeAtlas made it itself.
+	Actor   string
+	Details string `json:",omitempty"`
+}
+
+// Audit records an entry in the audit log for the node with the given
+// address. Errors are logged, but otherwise ignored, so that a
+// failure to record does not prevent the change itself.
+func (db DB) Audit(addr IP, action, actor, details string) {
+	_, err := db.Exec(`INSERT INTO audit_log
+(address, time, action, actor, details)
+VALUES(?, ?, ?, ?, ?);`, []byte(addr), time.Now().Unix(), action, actor,
+		details)
+	if err != nil {
+		dbLog.Errf("Error recording %s of %q in audit log: %s",
+			action, addr, err)
+	}
+}
+
+// auditEmail returns the form in which the given email address is
+// recorded in the audit log, which is the form in which it would be
+// stored on a node, as given by SealEmail, so that the log does not
+// reveal addresses which are encrypted or hashed elsewhere.
+func auditEmail(email string) string {
+	stored, err := SealEmail(email)
+	if err != nil {
+		return HashEmail(email)
+	}
+	return stored
+}
+
+// AuditDeletion records the deletion of the given local node in the
+// audit log, with the node, without its owner's email address, as the
+// details, so that NodesAsOf can still give it for times before it was
+// deleted.
+func (db DB) AuditDeletion(node *Node, actor string) {
+	deleted := *node
+	deleted.OwnerEmail = ""
+	b, err := json.Marshal(&deleted)
+	if err != nil {
+		dbLog.Errf("Error recording deletion of %q in audit log: %s",
+			node.Addr, err)
+		return
+	}
+	db.Audit(node.Addr, "deleted", actor, string(b))
+}
+
+// AuditLog returns the audit log, newest first. If addr is not nil,
+// only the entries for that node are given.
+func (db DB) AuditLog(addr IP) (entries []*AuditEntry, err error) {
+	var rows *sql.Rows
+	if addr == nil {
+		rows, err = db.Query(`SELECT address,time,action,actor,details
+FROM audit_log
+ORDER BY time DESC;`)
+	} else {
+		rows, err = db.Query(`SELECT address,time,action,actor,details
+FROM audit_log
+WHERE address = ?
+ORDER BY time DESC;`, []byte(addr))
+	}
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	entries = make([]*AuditEntry, 0)
+	for rows.Next() {
+		e := new(AuditEntry)
+		var t int64
+		var details sql.NullString
+		err = rows.Scan(&e.Addr, &t, &e.Action, &e.Actor, &details)
+		if err != nil {
+			return
+		}
+		e.Time = time.Unix(t, 0)
+		e.Details = details.String
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// DeletionsSince returns the entries of the audit log for local nodes
+// which have been deleted at or after the given time, oldest first.
+func (db DB) DeletionsSince(since time.Time) (entries []*AuditEntry,
+	err error) {
+	rows, err := db.reader().Query(`SELECT address,time,actor
+FROM audit_log
+WHERE action = 'deleted' AND time >= ?
+ORDER BY time;`, since.Unix())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := &AuditEntry{Action: "deleted"}
+		var t int64
+		if err = rows.Scan(&e.Addr, &t, &e.Actor); err != nil {
+			return
+		}
+		e.Time = time.Unix(t, 0)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// GetAuditLog returns the audit log, newest first, or, if `address` is
+// given, the entries for that node. Only admins may see it.
+func (*Api) GetAuditLog(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	var addr IP
+	if s, _ := ctx.FindString("address"); len(s) > 0 {
+		if addr = ParseIP(s); addr == nil {
+			ctx.Error = jas.NewRequestError("addressInvalid")
+			return
+		}
+	}
+	var err error
+	ctx.Data, err = db.AuditLog(addr)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error getting audit log: %s", err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+var BencodeInvalidError = errors.New("bencode: invalid data")
+
+// Bencode encodes the value, which must be composed of strings,
+// integers, []interface{}, and map[string]interface{}, as used by the
+// cjdns admin API. Dictionary keys are sorted, as required.
+func Bencode(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := bencodeTo(buf, v)
+	return buf.Bytes(), err
+}
+
+func bencodeTo(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		buf.WriteString(strconv.Itoa(len(v)))
+		buf.WriteByte(':')
+		buf.WriteString(v)
+	case []byte:
+		return bencodeTo(buf, string(v))
+	case int:
+		return bencodeTo(buf, int64(v))
+	case int64:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatInt(v, 10))
+		buf.WriteByte('e')
+	case []interface{}:
+		buf.WriteByte('l')
+		for _, item := range v {
+			if err := bencodeTo(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, k := range keys {
+			bencodeTo(buf, k)
+			if err := bencodeTo(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("bencode: unsupported type %T", v)
+	}
+	return nil
+}
+
+// Bdecode decodes a single bencoded value. Strings are given as
+// string, integers as int64, lists as []interface{}, and dictionaries
+// as map[string]interface{}.
+func Bdecode(b []byte) (v interface{}, err error) {
+	v, rest, err := bdecode(b)
+	if err == nil && len(rest) > 0 {
+		err = BencodeInvalidError
+	}
+	return
+}
+
+func bdecode(b []byte) (v interface{}, rest []byte, err error) {
+	if len(b) == 0 {
+		return nil, nil, BencodeInvalidError
+	}
+	switch {
+	case b[0] == 'i':
+		end := bytes.IndexByte(b, 'e')
+		if end < 0 {
+			return nil, nil, BencodeInvalidError
+		}
+		n, err := strconv.ParseInt(string(b[1:end]), 10, 64)
+		if err != nil {
+			return nil, nil, BencodeInvalidError
+		}
+		return n, b[end+1:], nil
+	case b[0] == 'l':
+		list := make([]interface{}, 0)
+		b = b[1:]
+		for len(b) > 0 && b[0] != 'e' {
+			var item interface{}
+			if item, b, err = bdecode(b); err != nil {
+				return
+			}
+			list = append(list, item)
+		}
+		if len(b) == 0 {
+			return nil, nil, BencodeInvalidError
+		}
+		return list, b[1:], nil
+	case b[0] == 'd':
+		dict := make(map[string]interface{})
+		b = b[1:]
+		for len(b) > 0 && b[0] != 'e' {
+			var key, value interface{}
+			if key, b, err = bdecode(b); err != nil {
+				return
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, nil, BencodeInvalidError
+			}
+			if value, b, err = bdecode(b); err != nil {
+				return
+			}
+			dict[k] = value
+		}
+		if len(b) == 0 {
+			return nil, nil, BencodeInvalidError
+		}
+		return dict, b[1:], nil
+	case b[0] >= '0' && b[0] <= '9':
+		colon := bytes.IndexByte(b, ':')
+		if colon < 0 {
+			return nil, nil, BencodeInvalidError
+		}
+		n, err := strconv.Atoi(string(b[:colon]))
+		if err != nil || n < 0 || colon+1+n > len(b) {
+			return nil, nil, BencodeInvalidError
+		}
+		return string(b[colon+1 : colon+1+n]), b[colon+1+n:], nil
+	}
+	return nil, nil, BencodeInvalidError
+}
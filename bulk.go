@@ -0,0 +1,251 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"github.com/coocood/jas"
+	"html"
+	"strings"
+	"time"
+)
+
+// BulkFilter selects the local nodes which are changed by BulkEdit.
+// Every condition which is set must be met.
+type BulkFilter struct {
+	// StatusSet and StatusUnset are status flags which must all be
+	// set, or all be unset. For example, a StatusUnset of
+	// StatusActive selects planned nodes.
+	StatusSet, StatusUnset uint32
+
+	// Bounds, if not nil, contains every selected node.
+	Bounds *Bounds
+
+	// MapID, if not nil, is the map of every selected node.
+	MapID *string
+
+	// UpdatedBefore, if not zero, is the time before which every
+	// selected node was last added or edited in bulk.
+	UpdatedBefore time.Time
+}
+
+// BulkPatch is the change which BulkEdit makes to every selected node.
+// Fields which are nil are not changed.
+type BulkPatch struct {
+	// SetStatus and ClearStatus are status flags which are set, or
+	// cleared.
+	SetStatus, ClearStatus uint32
+
+	MapID, Contact, Details *string
+}
+
+// Apply changes the given node as described by the patch.
+func (p *BulkPatch) Apply(n *Node) {
+	n.Status = (n.Status | p.SetStatus) &^ p.ClearStatus
+	if p.MapID != nil {
+		n.MapID = *p.MapID
+	}
+	if p.Contact != nil {
+		n.Contact = *p.Contact
+	}
+	if p.Details != nil {
+		n.Details = *p.Details
+	}
+}
+
+// where returns the conditions of the filter as an SQL WHERE clause,
+// and its arguments.
+func (f *BulkFilter) where() (clause string, args []interface{}) {
+	conditions := []string{"(status & ?) = ?", "(status & ?) = 0"}
+	args = []interface{}{f.StatusSet, f.StatusSet, f.StatusUnset}
+	if f.Bounds != nil {
+		conditions = append(conditions,
+			"lat >= ? AND lat <= ? AND lon >= ? AND lon <= ?")
+		args = append(args, f.Bounds.MinLat, f.Bounds.MaxLat,
+			f.Bounds.MinLon, f.Bounds.MaxLon)
+	}
+	if f.MapID != nil {
+		conditions = append(conditions, "map_id = ?")
+		args = append(args, *f.MapID)
+	}
+	if !f.UpdatedBefore.IsZero() {
+		conditions = append(conditions, "updated < ?")
+		args = append(args, f.UpdatedBefore)
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// BulkEdit applies the patch to every local node which matches the
+// filter, in a single transaction, and returns the changed nodes. If
+// dryRun is true, nothing is changed, and the nodes are returned as
+// they would be.
+func (db DB) BulkEdit(f *BulkFilter, p *BulkPatch, dryRun bool) (nodes []*Node, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil || dryRun {
+			tx.Rollback()
+		}
+	}()
+
+	where, args := f.where()
+	rows, err := tx.Query(`
+SELECT address,owner,contact,details,pgp,lat,lon,status,neighborhood,map_id
+FROM nodes `+where+`;`, args...)
+	if err != nil {
+		return
+	}
+	nodes = make([]*Node, 0)
+	for rows.Next() {
+		node := new(Node)
+		contact := sql.NullString{}
+		details := sql.NullString{}
+		neighborhood := sql.NullString{}
+		err = rows.Scan(&node.Addr, &node.OwnerName,
+			&contact, &details, &node.PGP,
+			&node.Latitude, &node.Longitude, &node.Status,
+			&neighborhood, &node.MapID)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		node.Contact = contact.String
+		node.Details = details.String
+		node.Neighborhood = neighborhood.String
+		nodes = append(nodes, node)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	now := time.Now()
+	activated := make([]*Node, 0)
+	for _, node := range nodes {
+		status := node.Status
+		p.Apply(node)
+		if status&StatusActive == 0 && node.Status&StatusActive != 0 {
+			activated = append(activated, node)
+		}
+		if dryRun {
+			continue
+		}
+
+		_, err = tx.Exec(`UPDATE nodes
+SET contact = ?, details = ?, status = ?, map_id = ?, updated = ?,
+version = version + 1, updated_at = ?
+WHERE address = ?;`, node.Contact, node.Details, node.Status, node.MapID,
+			now, now.Unix(), []byte(node.Addr))
+		if err != nil {
+			return
+		}
+		if node.Status != status {
+			_, err = tx.Exec(`INSERT INTO status_history
+(address, status, changed)
+VALUES(?, ?, ?);`, []byte(node.Addr), node.Status, now.Unix())
+			if err != nil {
+				return
+			}
+		}
+	}
+	if dryRun {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+
+	InvalidateIndexes()
+	for _, node := range nodes {
+		PublishNodeEvent(node.Addr, "updated", publicNode(node))
+	}
+	go func() {
+		for _, node := range activated {
+			NotifyInterest(node)
+		}
+	}()
+	return
+}
+
+// PostBulkEdit changes every local node which matches a filter in the
+// same way, such as to retire every planned node which has not been
+// updated in a year. The filter is made of the `status` flags which
+// must be set, the `not_status` flags which must be unset, a `bbox`
+// of the form "minLon,minLat,maxLon,maxLat", a `map` ID, and an
+// `updated_before` date, of the form "2006-01-02". The change is made
+// of the `set_status` flags to set, the `clear_status` flags to clear,
+// and a new `set_map`, `set_contact`, or `set_details`. If `dry_run`
+// is "true", the nodes which would be changed are returned, but
+// nothing is changed. Only admins may edit nodes in bulk.
+func (*Api) PostBulkEdit(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+
+	f := new(BulkFilter)
+	status, _ := ctx.FindPositiveInt("status")
+	notStatus, _ := ctx.FindPositiveInt("not_status")
+	f.StatusSet, f.StatusUnset = uint32(status), uint32(notStatus)
+	if bbox, err := ctx.FindString("bbox"); err == nil {
+		b, err := ParseBounds(bbox)
+		if err != nil {
+			ctx.Error = jas.NewRequestError("bboxInvalid")
+			return
+		}
+		f.Bounds = &b
+	}
+	if mapID, err := ctx.FindString("map"); err == nil {
+		f.MapID = &mapID
+	}
+	if before, err := ctx.FindString("updated_before"); err == nil {
+		if f.UpdatedBefore, err = time.Parse("2006-01-02",
+			before); err != nil {
+			ctx.Error = jas.NewRequestError("updated_beforeInvalid")
+			return
+		}
+	}
+
+	p := new(BulkPatch)
+	setStatus, _ := ctx.FindPositiveInt("set_status")
+	clearStatus, _ := ctx.FindPositiveInt("clear_status")
+	p.SetStatus, p.ClearStatus = uint32(setStatus), uint32(clearStatus)
+	if mapID, err := ctx.FindString("set_map"); err == nil {
+		if len(mapID) > 0 && Conf.FindMap(mapID) == nil {
+			ctx.Error = jas.NewRequestError("mapInvalid")
+			return
+		}
+		p.MapID = &mapID
+	}
+	if contact, err := ctx.FindStringLen(0, 255, "set_contact"); err == nil {
+		contact = html.EscapeString(contact)
+		p.Contact = &contact
+	}
+	if details, err := ctx.FindStringLen(0, 255, "set_details"); err == nil {
+		details = html.EscapeString(details)
+		p.Details = &details
+	}
+	dryRun, _ := ctx.FindBool("dry_run")
+
+	nodes, err := db.BulkEdit(f, p, dryRun)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error editing nodes in bulk: %s", err)
+		return
+	}
+	if !dryRun {
+		for _, node := range nodes {
+			db.Audit(node.Addr, "bulk_edit", "admin", "")
+		}
+		apiLog.Request(ctx.Request).Noticef("%q edited %d nodes in bulk",
+			ctx.RemoteAddr,
+			len(nodes))
+	}
+	ctx.Data = nodes
+	ctx.Extra = map[string]interface{}{"dry_run": dryRun}
+}
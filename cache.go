@@ -4,9 +4,12 @@ package main
 // Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -18,76 +21,155 @@ type ChildMap struct {
 	Name, Hostname string
 }
 
+// cacheMutex prevents the cache from being updated by more than one
+// goroutine at a time.
+var cacheMutex sync.Mutex
+
 // UpdateMapCache updates the node cache intelligently using
 // Conf.ChildMaps. Any unknown map addresses are added to the database
-// automatically, and errors are logged.
-func UpdateMapCache() {
+// automatically, and errors are logged. If ctx is cancelled, the
+// update stops, and the cache may be left incomplete until the next.
+func UpdateMapCache(ctx context.Context) {
+	db := Db.WithContext(ctx)
+
+	// Child maps which registered themselves and were approved are
+	// treated as ChildMaps of the main map.
+	registered, err := db.ApprovedChildMaps()
+	if err != nil {
+		dbLog.Errf("Error listing registered child maps: %s", err)
+	}
+	addresses := append(registered, Conf.ChildMaps...)
+
 	// If there are no addresses to retrieve from, do nothing.
-	if len(Conf.ChildMaps) == 0 {
+	childMaps := len(addresses)
+	for _, m := range Conf.Maps {
+		childMaps += len(m.ChildMaps)
+	}
+	if childMaps == 0 {
 		return
 	}
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
 
 	// Because we are refreshing the entire cache, delete all cached
-	// nodes.
-	err := Db.ClearCache()
+	// nodes, and forget the duplicates among them.
+	ClearDuplicates()
+	err = db.ClearCache()
 	if err != nil {
-		l.Errf("Error clearing cache: %s", err)
+		fedLog.Errf("Error clearing cache: %s", err)
 		return
 	}
 
-	// Get a full database dump from all child maps and cache it.
-	err = GetAllFromChildMaps(Conf.ChildMaps)
+	// Get a full database dump from all child maps of the main map
+	// and of every SubMap, and cache it.
+	err = GetAllFromChildMaps(ctx, addresses, "")
 	if err != nil {
-		l.Errf("Error updating map cache: %s", err)
+		fedLog.Errf("Error updating map cache: %s", err)
+	}
+	for _, m := range Conf.Maps {
+		err = GetAllFromChildMaps(ctx, m.ChildMaps, m.ID)
+		if err != nil {
+			fedLog.Errf("Error updating map cache of %q: %s", m.ID, err)
+		}
 	}
+	RunHooks(HookFederationSynced, map[string]int{"ChildMaps": childMaps})
 }
 
+// CacheNode inserts the given node into the cache, or replaces the
+// node with the same address from the same source if there is one.
 func (db DB) CacheNode(node *Node) (err error) {
-	stmt, err := db.Prepare(`INSERT INTO nodes_cached
-(address, owner, details, lat, lon, status, expiration, updated)
-VALUES(?, ?, ?, ?, ?, ?, ?, ?)`)
-	if err != nil {
-		return
-	}
-
 	if node.RetrieveTime == 0 {
 		node.RetrieveTime = time.Now().Unix()
 	}
 
-	_, err = stmt.Exec(node.Addr, node.OwnerName, node.Details,
-		node.Latitude, node.Longitude, node.SourceID, node.Status,
-		node.RetrieveTime)
-	stmt.Close()
+	res, err := db.Exec(`UPDATE nodes_cached
+SET owner = ?, details = ?, lat = ?, lon = ?, status = ?, retrieved = ?,
+map_id = ?, via = ?, created_at = ?, updated_at = ?
+WHERE address = ? AND source = ?;`,
+		node.OwnerName, node.Details, node.Latitude, node.Longitude,
+		node.Status, node.RetrieveTime, node.MapID, node.Via,
+		node.CreateTime, node.UpdateTime, []byte(node.Addr), node.SourceID)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		_, err = db.Exec(`INSERT INTO nodes_cached
+(address, owner, details, lat, lon, status, source, retrieved, map_id,
+via, created_at, updated_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			[]byte(node.Addr), node.OwnerName, node.Details,
+			node.Latitude, node.Longitude, node.Status, node.SourceID,
+			node.RetrieveTime, node.MapID, node.Via,
+			node.CreateTime, node.UpdateTime)
+		if err != nil {
+			return
+		}
+	}
+	InvalidateIndexes()
 	return
 }
 
-func (db DB) CacheNodes(nodes []*Node) (err error) {
-	stmt, err := db.Prepare(`INSERT INTO nodes_cached
-(address, owner, details, lat, lon, status, source, retrieved)
-VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+// CacheNodes inserts the given nodes into the cache in a single
+// transaction, replacing any which are already cached with the same
+// address and source, so that the cache reflects the latest fetch
+// exactly. If there is an error, none are inserted. If the transaction
+// fails because the database is locked, it is retried, as with Retry.
+func (db DB) CacheNodes(nodes []*Node) error {
+	return db.Retry(func() error {
+		return db.cacheNodes(nodes)
+	})
+}
+
+func (db DB) cacheNodes(nodes []*Node) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	del, err := tx.Prepare(`DELETE FROM nodes_cached
+WHERE address = ? AND source = ?;`)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	defer del.Close()
+	stmt, err := tx.Prepare(`INSERT INTO nodes_cached
+(address, owner, details, lat, lon, status, source, retrieved, map_id,
+via, created_at, updated_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
+		tx.Rollback()
 		return
 	}
+	defer stmt.Close()
 
 	for _, node := range nodes {
 		if node.RetrieveTime == 0 {
 			node.RetrieveTime = time.Now().Unix()
 		}
 
-		_, err = stmt.Exec([]byte(node.Addr), node.OwnerName,
-			node.Details,
-			node.Latitude, node.Longitude,
-			node.Status, node.SourceID, node.RetrieveTime)
+		_, err = del.Exec([]byte(node.Addr), node.SourceID)
+		if err == nil {
+			_, err = stmt.Exec([]byte(node.Addr), node.OwnerName,
+				node.Details,
+				node.Latitude, node.Longitude,
+				node.Status, node.SourceID, node.RetrieveTime, node.MapID,
+				node.Via, node.CreateTime, node.UpdateTime)
+		}
 		if err != nil {
+			tx.Rollback()
 			return
 		}
 	}
-	stmt.Close()
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	InvalidateIndexes()
 	return
 }
 
 func (db DB) ClearCache() (err error) {
 	_, err = db.Exec(`DELETE FROM nodes_cached;`)
+	InvalidateIndexes()
 	return err
 }
 
@@ -227,10 +309,79 @@ func (db DB) CacheFormatNodes(nodes []*Node) (sourceMaps map[string][]*Node, err
 }
 
 // nodeDumpWrapper is a structure which wraps a response from /api/all
-// in which the Data field is a map[string][]*Node.
+// in which the Data field is a map[string][]*Node, and Sources gives
+// the freshness of each of its keys.
 type nodeDumpWrapper struct {
-	Data  map[string][]*Node `json:"data"`
-	Error interface{}        `json:"error"`
+	Data    map[string][]*Node          `json:"data"`
+	Sources map[string]*SourceFreshness `json:"sources"`
+	Error   interface{}                 `json:"error"`
+}
+
+// SourceFreshness describes how recently the nodes of a source were
+// retrieved from it.
+type SourceFreshness struct {
+	// Retrieved is the time at which the least recently retrieved
+	// node of the source was retrieved, or the current time for
+	// local nodes.
+	Retrieved time.Time
+
+	// Stale is true if the nodes were retrieved more than
+	// staleHeartbeats heartbeats ago, so that they are likely to be
+	// outdated.
+	Stale bool
+}
+
+// staleHeartbeats is the number of heartbeats after which cached nodes
+// are considered stale.
+const staleHeartbeats = 3
+
+// SourceRetrieved returns the time at which the least recently
+// retrieved cached node of each source was retrieved, keyed by the
+// hostname of the source.
+func (db DB) SourceRetrieved() (retrieved map[string]time.Time, err error) {
+	rows, err := db.Query(`SELECT cached_maps.hostname,
+MIN(nodes_cached.retrieved)
+FROM nodes_cached
+INNER JOIN cached_maps ON nodes_cached.source = cached_maps.id
+GROUP BY cached_maps.hostname;`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	retrieved = make(map[string]time.Time)
+	for rows.Next() {
+		var hostname string
+		var t int64
+		if err = rows.Scan(&hostname, &t); err != nil {
+			return
+		}
+		retrieved[hostname] = time.Unix(t, 0)
+	}
+	return retrieved, rows.Err()
+}
+
+// SourcesFreshness returns the freshness of every source in the given
+// nodes, as grouped by CacheFormatNodes.
+func SourcesFreshness(sourceMaps map[string][]*Node) (sources map[string]*SourceFreshness, err error) {
+	retrieved, err := Db.SourceRetrieved()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	staleAfter := staleHeartbeats * time.Duration(Conf.HeartbeatRate)
+	sources = make(map[string]*SourceFreshness, len(sourceMaps))
+	for source := range sourceMaps {
+		t, ok := retrieved[source]
+		if source == "local" || !ok {
+			t = now
+		}
+		sources[source] = &SourceFreshness{
+			Retrieved: t,
+			Stale:     now.Sub(t) > staleAfter,
+		}
+	}
+	return
 }
 
 type statusDumpWrapper struct {
@@ -240,13 +391,21 @@ type statusDumpWrapper struct {
 
 // GetAllFromChildMaps accepts a list of child map addresses to
 // retrieve nodes from. It does this concurrently, and puts any nodes
-// and newly discovered addresses in the local ID table.
-func GetAllFromChildMaps(addresses []string) (err error) {
+// and newly discovered addresses in the local ID table. The nodes are
+// cached as belonging to the map with the given ID. The requests and
+// queries are made within ctx.
+func GetAllFromChildMaps(ctx context.Context, addresses []string,
+	mapID string) (err error) {
+	if len(addresses) == 0 {
+		return
+	}
+	db := Db.WithContext(ctx)
+
 	// First off, initialize the slice into which we'll be appending
 	// all the nodes, and the souceToID map and mutex.
 	nodes := make([]*Node, 0)
 
-	sourceToID, err := Db.GetMapSourceToID()
+	sourceToID, err := db.GetMapSourceToID()
 	if err != nil {
 		return
 	}
@@ -266,7 +425,7 @@ func GetAllFromChildMaps(addresses []string) (err error) {
 	// nodes. Whenever appendNodesFromChildMap() finishes, it calls
 	// waiter.Done().
 	for _, address := range addresses {
-		go appendNodesFromChildMap(&nodes, address,
+		go appendNodesFromChildMap(ctx, &nodes, address,
 			&sourceToID, sourceMutex, nodesMutex, waiter)
 	}
 
@@ -275,21 +434,32 @@ func GetAllFromChildMaps(addresses []string) (err error) {
 	// waiting for.
 	waiter.Wait()
 
-	return Db.CacheNodes(nodes)
+	for _, node := range nodes {
+		node.MapID = mapID
+	}
+
+	// Keep only one node for each address, if several sources list
+	// the same one.
+	nodes, err = db.ResolveDuplicates(nodes, mapID)
+	if err != nil {
+		return
+	}
+	return db.CacheNodes(nodes)
 }
 
 // appendNodesFromChildMap is a helper function used by
 // GetAllFromChildMaps() which calls GetAllFromChildMap() and
 // thread-safely appends the result to the given slice. At the end of
 // the function, it calls wg.Done().
-func appendNodesFromChildMap(dst *[]*Node, address string,
+func appendNodesFromChildMap(ctx context.Context, dst *[]*Node,
+	address string,
 	sourceToID *map[string]int, sourceMutex *sync.RWMutex,
 	dstMutex *sync.Mutex, wg *sync.WaitGroup) {
 
 	// First, retrieve the nodes if possible. If there was an error,
 	// it will be logged, and if there were no nodes, we can stop
 	// here.
-	nodes := GetAllFromChildMap(address, sourceToID, sourceMutex)
+	nodes := GetAllFromChildMap(ctx, address, sourceToID, sourceMutex)
 	if nodes == nil {
 		wg.Done()
 		return
@@ -303,20 +473,43 @@ func appendNodesFromChildMap(dst *[]*Node, address string,
 	wg.Done()
 }
 
-func GetMapStatus(address string) (data map[string]interface{}) {
-	resp, err := http.Get(strings.TrimRight(address, "/") + "/api/status")
+// GetMapStatus retrieves /api/status of the map at the given address
+// within ctx. If it encounters an error, it logs it and returns nil.
+func GetMapStatus(ctx context.Context,
+	address string) (data map[string]interface{}) {
+	return getMapStatus(ctx, http.DefaultClient, address)
+}
+
+// getMapStatus retrieves the status of the map at the given address, as
+// GetMapStatus does, with the given client.
+func getMapStatus(ctx context.Context, client *http.Client,
+	address string) (data map[string]interface{}) {
+	flog := fedLog.With("source", address)
+	if requestID := requestIDFromContext(ctx); len(requestID) > 0 {
+		flog = flog.With("request", requestID)
+	}
+
+	// Maps which are federated by gRPC also serve their status as
+	// JSON.
+	address = strings.TrimPrefix(address, "grpc+")
+	req, err := newTracedRequest(ctx, strings.TrimRight(address, "/")+
+		"/api/status")
+	var resp *http.Response
+	if err == nil {
+		resp, err = client.Do(req)
+	}
 	if err != nil {
-		l.Errf("Querying status of %q produced: %s", address, err)
+		flog.Errf("Querying status of %q produced: %s", address, err)
 		return nil
 	}
 
 	var jresp statusDumpWrapper
 	err = json.NewDecoder(resp.Body).Decode(&jresp)
 	if err != nil {
-		l.Errf("Querying status of %q produced: %s", address, err)
+		flog.Errf("Querying status of %q produced: %s", address, err)
 		return nil
 	} else if jresp.Error != nil {
-		l.Errf("Querying status of %q produced remote error: %s",
+		flog.Errf("Querying status of %q produced remote error: %s",
 			address, jresp.Error)
 		return nil
 	}
@@ -324,33 +517,109 @@ func GetMapStatus(address string) (data map[string]interface{}) {
 	return
 }
 
+// FetchJSONNodes retrieves every node from /api/all of the map at the
+// given address, grouped by source, with the freshness of each source
+// if the map gives it. If since is not zero, only the nodes which have
+// changed since then are retrieved. The request is made within ctx,
+// and carries the ID of the request to which ctx belongs, if any.
+func FetchJSONNodes(ctx context.Context, address string,
+	since time.Time) (nodes map[string][]*Node,
+	sources map[string]*SourceFreshness, err error) {
+	return fetchJSONNodes(ctx, http.DefaultClient, address, since)
+}
+
+// fetchJSONNodes retrieves the nodes of the map at the given address, as
+// FetchJSONNodes does, with the given client.
+func fetchJSONNodes(ctx context.Context, client *http.Client,
+	address string, since time.Time) (nodes map[string][]*Node,
+	sources map[string]*SourceFreshness, err error) {
+	u := strings.TrimRight(address, "/") + "/api/all"
+	if !since.IsZero() {
+		u += "?since=" + url.QueryEscape(since.Format(time.RFC3339))
+	}
+	req, err := newTracedRequest(ctx, u)
+	if err != nil {
+		return
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	// Read the data into a the nodeDumpWrapper type, so that it
+	// decodes properly.
+	var jresp nodeDumpWrapper
+	err = json.NewDecoder(childMapBody(resp.Body)).Decode(&jresp)
+	if err != nil {
+		return
+	} else if jresp.Error != nil {
+		return nil, nil, fmt.Errorf("remote error: %v", jresp.Error)
+	}
+	return jresp.Data, jresp.Sources, nil
+}
+
 // GetAllFromChildMap retrieves a list of nodes from a single remote
 // address, and localizes them. If it encounters a remote address that
 // is not already known, it safely adds it to the sourceToID map. It
 // is safe for concurrent use. If it encounters an error, it will log
 // it and return nil.
-func GetAllFromChildMap(address string, sourceToID *map[string]int,
+func GetAllFromChildMap(ctx context.Context, address string,
+	sourceToID *map[string]int, sourceMutex *sync.RWMutex) (nodes []*Node) {
+	return GetChangesFromChildMap(ctx, address, time.Time{}, sourceToID,
+		sourceMutex)
+}
+
+// GetChangesFromChildMap is as GetAllFromChildMap, but if since is not
+// zero, it retrieves only the nodes which have changed since then,
+// always through /api/all.
+func GetChangesFromChildMap(ctx context.Context, address string,
+	since time.Time, sourceToID *map[string]int,
 	sourceMutex *sync.RWMutex) (nodes []*Node) {
-	// Query the node's status
-	mapStatus := GetMapStatus(address)
+	// Every fetch has a request ID, which the child map is given, so
+	// that its logs can be matched with these. If it is made on
+	// behalf of a request, it has the same ID.
+	requestID := requestIDFromContext(ctx)
+	if len(requestID) == 0 {
+		requestID = NewRequestID()
+		ctx = withRequestID(ctx, requestID)
+	}
+	db := Db.WithContext(ctx)
+	flog := fedLog.With("source", address).With("request", requestID)
+	start := time.Now()
 
-	// Try to get all nodes via the API.
-	resp, err := http.Get(strings.TrimRight(address, "/") + "/api/all")
+	// Never contact a child map which has been blocked, and load
+	// the filter for the sources which it lists.
+	filter, err := db.SourceFilter()
 	if err != nil {
-		l.Errf("Caching %q produced: %s", address, err)
+		flog.Errf("Error loading source filter: %s", err)
+		return nil
+	}
+	if filter.IsBlocked(address) {
+		flog.Warningf("Not caching blocked child map %q\n", address)
 		return nil
 	}
 
-	// Read the data into a the nodeDumpWrapper type, so that it
-	// decodes properly.
-	var jresp nodeDumpWrapper
-	err = json.NewDecoder(resp.Body).Decode(&jresp)
+	// Query the node's status
+	mapStatus := GetMapStatus(ctx, address)
+
+	// Try to get all nodes via the API, or via the federation
+	// service if the address is prefixed with "grpc+".
+	var data map[string][]*Node
+	var sources map[string]*SourceFreshness
+	if !since.IsZero() {
+		data, sources, err = FetchJSONNodes(ctx,
+			strings.TrimPrefix(address, "grpc+"), since)
+	} else if strings.HasPrefix(address, "grpc+") {
+		data, err = FetchGRPCNodes(ctx,
+			strings.TrimPrefix(address, "grpc+"))
+	} else {
+		data, sources, err = FetchJSONNodes(ctx, address, since)
+	}
+	latency := time.Since(start)
 	if err != nil {
-		l.Errf("Caching %q produced: %s", address, err)
-		return nil
-	} else if jresp.Error != nil {
-		l.Errf("Caching %q produced remote error: %s",
-			address, jresp.Error)
+		flog.Errf("Caching %q produced: %s", address, err)
+		db.RecordFetch(address, latency, 0, err)
 		return nil
 	}
 
@@ -362,13 +631,29 @@ func GetAllFromChildMap(address string, sourceToID *map[string]int,
 	// needless compares.
 	nodes = make([]*Node, 0)
 	var replacedLocal bool
-	for source, remoteNodes := range jresp.Data {
+	for source, remoteNodes := range data {
 		// If we come across "local", then replace it with the address
 		// we're retrieving from.
 		if !replacedLocal && source == "local" {
 			source = address
 		}
 
+		// Skip any other sources which are blocked, or which are not
+		// allowed in strict mode.
+		if source != address && !filter.IsAllowed(source) {
+			flog.Noticef("Ignoring %d nodes from disallowed source %q\n",
+				len(remoteNodes), source)
+			continue
+		}
+
+		// Discard any nodes which are invalid or beyond the limits.
+		var discarded int
+		remoteNodes, discarded = LimitChildMapNodes(remoteNodes)
+		if discarded > 0 {
+			flog.Warningf("Discarded %d nodes from source %q\n",
+				discarded, source)
+		}
+
 		// Get the name of the map from the status info
 		name, ok := mapStatus["name"].(string)
 		if !ok {
@@ -386,11 +671,12 @@ func GetAllFromChildMap(address string, sourceToID *map[string]int,
 			// map under the ID len(sourceToID), because that should
 			// be unique.
 			sourceMutex.Lock()
-			err := Db.AddNewMapSource(source, name)
+			err := db.AddNewMapSource(source, name)
 			if err != nil {
 				// Uh oh.
 				sourceMutex.Unlock()
-				l.Errf("Error while caching %q: %s", address, err)
+				flog.Errf("Error while caching %q: %s", address, err)
+				db.RecordFetch(address, latency, 0, err)
 				return
 			}
 
@@ -398,23 +684,44 @@ func GetAllFromChildMap(address string, sourceToID *map[string]int,
 			(*sourceToID)[source] = id
 			sourceMutex.Unlock()
 
-			l.Debugf("Discovered new source map %q, ID %d\n",
+			flog.Debugf("Discovered new source map %q, ID %d\n",
 				source, id)
 		} else {
-			err := Db.UpdateMapSourceData(address, name)
+			err := db.UpdateMapSourceData(address, name)
 			if err != nil {
-				l.Errf("Error while updating %q: %s", address, err)
+				flog.Errf("Error while updating %q: %s", address, err)
 			}
 		}
 
 		// Once the ID is set, proceed on to add it in all the
-		// remoteNodes.
+		// remoteNodes. Nodes which the child map itself cached keep
+		// the time at which it retrieved them, so that their
+		// freshness is not overstated, and record the child map as
+		// the one they came via, so that the original source and the
+		// immediate one are both known.
+		var retrieved int64
+		var via string
+		if source != address {
+			if f, ok := sources[source]; ok {
+				retrieved = f.Retrieved.Unix()
+			}
+			via = address
+		}
 		for _, n := range remoteNodes {
 			n.SourceID = id
+			n.RetrieveTime = retrieved
+			n.Via = via
 		}
 
 		// Finally, append remoteNodes to the slice we're returning.
 		nodes = append(nodes, remoteNodes...)
 	}
+	// Only some of the nodes are retrieved if there is a time, so
+	// the number of nodes cached from the map is not known.
+	count := len(nodes)
+	if !since.IsZero() {
+		count = -1
+	}
+	db.RecordFetch(address, latency, count, nil)
 	return
 }
@@ -23,7 +23,7 @@ func (CAPTCHAStore) Set(id string, digits []byte) {
 VALUES(?, ?, ?);`,
 		[]byte(id), digits, time.Now().Add(CAPTCHAGracePeriod))
 	if err != nil {
-		l.Err("Error registering CAPTCHA:", err)
+		dbLog.Err("Error registering CAPTCHA:", err)
 	}
 }
 
@@ -39,7 +39,7 @@ WHERE id = ? AND expiration > ?;`, bid, time.Now())
 		// If there are no rows, then the ID was not found.
 		return nil
 	} else if err != nil {
-		l.Err("Error retrieving CAPTCHA:", err)
+		dbLog.Err("Error retrieving CAPTCHA:", err)
 		return nil
 	}
 
@@ -49,7 +49,7 @@ WHERE id = ? AND expiration > ?;`, bid, time.Now())
 		_, err = Db.Exec(`DELETE FROM captcha
 WHERE id = ?;`, bid)
 		if err != nil {
-			l.Err("Error deleting CAPTCHA:", err)
+			dbLog.Err("Error deleting CAPTCHA:", err)
 		}
 	}
 	return
@@ -61,6 +61,6 @@ func ClearExpiredCAPTCHA() {
 	_, err := Db.Exec(`DELETE FROM captcha
 WHERE expiration <= ?;`, time.Now())
 	if err != nil {
-		l.Err("Error deleting expired CAPTCHAs:", err)
+		dbLog.Err("Error deleting expired CAPTCHAs:", err)
 	}
 }
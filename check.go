@@ -0,0 +1,143 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// CheckState is the state of a node in the convention of Nagios and
+// Icinga plugins, whose exit codes are the numeric values.
+type CheckState int
+
+const (
+	CheckOK CheckState = iota
+	CheckWarning
+	CheckCritical
+	CheckUnknown
+)
+
+// checkStates are the names of the states, which begin the first line
+// of a plugin's output.
+var checkStates = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+func (s CheckState) String() string {
+	if s < 0 || int(s) >= len(checkStates) {
+		return checkStates[CheckUnknown]
+	}
+	return checkStates[s]
+}
+
+// checkStatusCodes are the HTTP status codes with which each state is
+// served, so that check_http reports down nodes as critical without
+// matching the output.
+var checkStatusCodes = []int{
+	http.StatusOK,
+	http.StatusOK,
+	http.StatusServiceUnavailable,
+	http.StatusNotFound,
+}
+
+// CheckNode returns the state of the node with the given address, and
+// a line of plugin output describing it, including performance data.
+// Nodes which aren't active are a warning, and active nodes which
+// aren't pingable are critical.
+func CheckNode(addr IP) (state CheckState, output string, err error) {
+	node, err := Db.GetNode(addr)
+	if err == NodeNotFoundError {
+		return CheckUnknown, fmt.Sprintf("%s is not on the map", addr), nil
+	} else if err != nil {
+		return CheckUnknown, "", err
+	}
+	h, err := Db.GetHeartbeat(addr)
+	if err != nil {
+		return CheckUnknown, "", err
+	}
+
+	switch {
+	case node.Status&StatusActive == 0:
+		state = CheckWarning
+		output = fmt.Sprintf("%s is not active", addr)
+	case node.Status&StatusPingable == 0:
+		state = CheckCritical
+		output = fmt.Sprintf("%s is down", addr)
+		since, err := Db.DownSince(addr)
+		if err != nil {
+			return CheckUnknown, "", err
+		} else if !since.IsZero() {
+			output += " since " + since.Format(time.RFC3339)
+		}
+	default:
+		state = CheckOK
+		output = fmt.Sprintf("%s is up", addr)
+	}
+
+	// Performance data follows a pipe, as "label=value[unit]".
+	if h != nil && !h.Last.IsZero() {
+		output += fmt.Sprintf(" | heartbeat_age=%ds uptime=%ds clients=%d",
+			int64(time.Since(h.Last)/time.Second), h.Uptime, h.Clients)
+	}
+	return
+}
+
+// HandleCheck serves the state of the node given as `address` (or
+// `addr`) as plugin output, such as "OK - fc00::1 is up", for
+// check_http and similar plugins. Down nodes are served with 503
+// Service Unavailable, and unknown ones with 404 Not Found.
+func HandleCheck(w http.ResponseWriter, r *http.Request) {
+	s := r.FormValue("address")
+	if len(s) == 0 {
+		s = r.FormValue("addr")
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	addr := ParseIP(s)
+	if addr == nil {
+		w.WriteHeader(checkStatusCodes[CheckUnknown])
+		fmt.Fprintln(w, CheckUnknown.String()+" - addressInvalid")
+		return
+	}
+
+	state, output, err := CheckNode(addr)
+	if err != nil {
+		dbLog.Request(r).Errf("Error checking node %q: %s", addr, err)
+		state, output = CheckUnknown, "internal error"
+	}
+	w.WriteHeader(checkStatusCodes[state])
+	fmt.Fprintln(w, state.String()+" - "+output)
+}
+
+// RunCheck retrieves the output of HandleCheck from the given URL,
+// such as "http://atlas.example.org/api/check?address=fc00::1",
+// prints it, and exits with the code of its state, so that NodeAtlas
+// can be used as a Nagios or Icinga plugin.
+func RunCheck(url string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		fmt.Printf("%s - %s\n", CheckUnknown, err)
+		os.Exit(int(CheckUnknown))
+	}
+	defer resp.Body.Close()
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil && err != io.EOF {
+		fmt.Printf("%s - %s\n", CheckUnknown, err)
+		os.Exit(int(CheckUnknown))
+	}
+	line = strings.TrimSpace(line)
+	for i, name := range checkStates {
+		if strings.HasPrefix(line, name+" ") {
+			fmt.Println(line)
+			os.Exit(i)
+		}
+	}
+	fmt.Printf("%s - unexpected response: %s\n", CheckUnknown, resp.Status)
+	os.Exit(int(CheckUnknown))
+}
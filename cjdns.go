@@ -0,0 +1,289 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// cjdnsTimeout is the length of time to wait for each response from
+// the cjdns admin API.
+const cjdnsTimeout = 5 * time.Second
+
+// cjdnsBase32 is the alphabet of cjdns's base32 encoding of public
+// keys.
+const cjdnsBase32 = "0123456789bcdfghjklmnpqrstuvwxyz"
+
+var (
+	CjdnsKeyInvalidError      = errors.New("cjdns: invalid public key")
+	CjdnsResponseInvalidError = errors.New("cjdns: invalid response")
+)
+
+// CjdnsAdmin is a connection to the admin API of a cjdns router,
+// which is bencoded over UDP.
+type CjdnsAdmin struct {
+	conn     net.Conn
+	password string
+}
+
+// CjdnsPeer is a direct peer of a cjdns router.
+type CjdnsPeer struct {
+	Addr IP
+
+	// Established is true if the peering session is up.
+	Established bool
+}
+
+// DialCjdns connects to the cjdns admin API at the given address,
+// such as "127.0.0.1:11234".
+func DialCjdns(addr, password string) (c *CjdnsAdmin, err error) {
+	conn, err := net.DialTimeout("udp", addr, cjdnsTimeout)
+	if err != nil {
+		return
+	}
+	return &CjdnsAdmin{conn: conn, password: password}, nil
+}
+
+// Close closes the connection.
+func (c *CjdnsAdmin) Close() error {
+	return c.conn.Close()
+}
+
+// send sends a request and returns the response. If the response
+// contains an error, it is returned.
+func (c *CjdnsAdmin) send(msg map[string]interface{}) (resp map[string]interface{}, err error) {
+	b, err := Bencode(msg)
+	if err != nil {
+		return
+	}
+	c.conn.SetDeadline(time.Now().Add(cjdnsTimeout))
+	if _, err = c.conn.Write(b); err != nil {
+		return
+	}
+	buf := make([]byte, 1<<16)
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		return
+	}
+	v, err := Bdecode(buf[:n])
+	if err != nil {
+		return
+	}
+	resp, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, CjdnsResponseInvalidError
+	}
+	if e, ok := resp["error"].(string); ok && e != "none" {
+		return nil, errors.New("cjdns: " + e)
+	}
+	return
+}
+
+// Call invokes the admin function with the given arguments,
+// authenticating with the password, and returns the response.
+func (c *CjdnsAdmin) Call(function string, args map[string]interface{}) (resp map[string]interface{}, err error) {
+	resp, err = c.send(map[string]interface{}{"q": "cookie"})
+	if err != nil {
+		return
+	}
+	cookie, _ := resp["cookie"].(string)
+
+	// The request is first hashed with the password and cookie, then
+	// hashed again as a whole, including the first hash.
+	sum := sha256.Sum256([]byte(c.password + cookie))
+	msg := map[string]interface{}{
+		"q":      "auth",
+		"aq":     function,
+		"hash":   hex.EncodeToString(sum[:]),
+		"cookie": cookie,
+		"args":   args,
+	}
+	b, err := Bencode(msg)
+	if err != nil {
+		return
+	}
+	sum = sha256.Sum256(b)
+	msg["hash"] = hex.EncodeToString(sum[:])
+	return c.send(msg)
+}
+
+// Self returns the address of the cjdns router.
+func (c *CjdnsAdmin) Self() (addr IP, err error) {
+	resp, err := c.Call("Core_nodeInfo", map[string]interface{}{})
+	if err != nil {
+		return
+	}
+	s, _ := resp["myIp6"].(string)
+	if addr = ParseIP(s); addr == nil {
+		return nil, CjdnsResponseInvalidError
+	}
+	return
+}
+
+// Peers returns every peer of the cjdns router.
+func (c *CjdnsAdmin) Peers() (peers []*CjdnsPeer, err error) {
+	for page := int64(0); ; page++ {
+		resp, err := c.Call("InterfaceController_peerStats",
+			map[string]interface{}{"page": page})
+		if err != nil {
+			return nil, err
+		}
+		list, _ := resp["peers"].([]interface{})
+		for _, item := range list {
+			p, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			// Older versions give the key alone, and newer ones
+			// give it as part of a versioned path, such as
+			// "v19.0000.0000.0000.0013.<key>.k".
+			key, _ := p["publicKey"].(string)
+			if s, ok := p["addr"].(string); ok && len(key) == 0 {
+				if parts := strings.Split(s, "."); len(parts) >= 2 {
+					key = parts[len(parts)-2] + ".k"
+				}
+			}
+			addr, err := CjdnsKeyToIP(key)
+			if err != nil {
+				continue
+			}
+			state, _ := p["state"].(string)
+			peers = append(peers, &CjdnsPeer{
+				Addr:        addr,
+				Established: state == "ESTABLISHED",
+			})
+		}
+		if more, _ := resp["more"].(int64); more == 0 {
+			return peers, nil
+		}
+	}
+}
+
+// CjdnsKeyToIP derives the IPv6 address of a cjdns node from its
+// public key, such as "<52 characters>.k", which is the first 16 bytes
+// of the double SHA-512 hash of the key.
+func CjdnsKeyToIP(key string) (IP, error) {
+	if !strings.HasSuffix(key, ".k") {
+		return nil, CjdnsKeyInvalidError
+	}
+	key = strings.TrimSuffix(key, ".k")
+
+	// cjdns's base32 fills each byte from its least significant bit.
+	out := make([]byte, 0, 32)
+	var next, bits uint
+	for _, r := range key {
+		n := strings.IndexRune(cjdnsBase32, r)
+		if n < 0 {
+			return nil, CjdnsKeyInvalidError
+		}
+		next |= uint(n) << bits
+		bits += 5
+		if bits >= 8 {
+			out = append(out, byte(next))
+			bits -= 8
+			next >>= 8
+		}
+	}
+	if bits >= 5 || next != 0 || len(out) != 32 {
+		return nil, CjdnsKeyInvalidError
+	}
+
+	first := sha512.Sum512(out)
+	second := sha512.Sum512(first[:])
+	return IP(second[:16]), nil
+}
+
+// CollectCjdns connects to the cjdns admin API given in Conf.Cjdns,
+// if it is enabled, and imports the router's peers. Local nodes which
+// are peers are marked as pingable or not, depending on whether the
+// peering is established, and established peerings are recorded as
+// links from the router's node. If Conf.Cjdns.CreateNodes is set,
+// established peers which aren't on the map are added at the router's
+// location, owned by the admin, so that they can be moved later.
+// Errors are logged.
+func CollectCjdns() {
+	if !Conf.Cjdns.Enabled || Db.ReadOnly {
+		return
+	}
+	c, err := DialCjdns(Conf.Cjdns.Admin, Conf.Cjdns.Password)
+	if err != nil {
+		l.Errf("Error connecting to cjdns: %s", err)
+		return
+	}
+	defer c.Close()
+
+	self, err := c.Self()
+	if err != nil {
+		l.Errf("Error getting cjdns address: %s", err)
+		return
+	}
+	peers, err := c.Peers()
+	if err != nil {
+		l.Errf("Error getting cjdns peers: %s", err)
+		return
+	}
+	router, err := Db.GetLocalNode(self)
+	if err == LocalNodeNotFoundError {
+		l.Warningf("cjdns router %q is not a local node\n", self)
+		return
+	} else if err != nil {
+		dbLog.Errf("Error getting node %q: %s", self, err)
+		return
+	}
+
+	now := time.Now()
+	links := make([]*Link, 0, len(peers))
+	for _, p := range peers {
+		node, err := Db.GetLocalNode(p.Addr)
+		if err != nil && err != LocalNodeNotFoundError {
+			dbLog.Errf("Error getting node %q: %s", p.Addr, err)
+			continue
+		}
+		if err == LocalNodeNotFoundError {
+			if !p.Established || !Conf.Cjdns.CreateNodes ||
+				len(Conf.AdminContact.Email) == 0 {
+				continue
+			}
+			node = &Node{
+				Addr:       p.Addr,
+				OwnerName:  "cjdns peer",
+				OwnerEmail: Conf.AdminContact.Email,
+				Details:    "Discovered by cjdns",
+				Latitude:   router.Latitude,
+				Longitude:  router.Longitude,
+				Status:     StatusActive | StatusPingable,
+			}
+			if err = Db.AddNode(node); err != nil {
+				dbLog.Errf("Error adding cjdns peer %q: %s", p.Addr, err)
+				continue
+			}
+			l.Infof("Added cjdns peer %q\n", p.Addr)
+		}
+
+		status := node.Status &^ StatusPingable
+		if p.Established {
+			status |= StatusPingable
+			links = append(links, &Link{
+				Source:  self,
+				Target:  p.Addr,
+				Updated: now,
+			})
+		}
+		if status != node.Status {
+			if err = Db.SetStatus(p.Addr, status); err != nil {
+				dbLog.Errf("Error setting status of %q: %s", p.Addr, err)
+			}
+		}
+	}
+
+	if err = Db.ReplaceLinks("cjdns", self, links); err != nil {
+		dbLog.Errf("Error replacing cjdns links: %s", err)
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"github.com/coocood/jas"
+	"html"
+	"html/template"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// MaxCommentLength is the longest a comment may be, in bytes.
+const MaxCommentLength = 500
+
+// Comment states. Comments are unverified until the author follows
+// the link in their verification email, and are then either visible,
+// or pending until approved by an admin if Conf.Comments.Moderated is
+// set. Admins may hide comments at any time.
+const (
+	CommentUnverified = iota
+	CommentPending
+	CommentVisible
+	CommentHidden
+)
+
+// Comment is a short message left on a local node by a visitor, such
+// as "I can see this roof from my window."
+type Comment struct {
+	ID   int64
+	Addr IP `json:"Address"`
+
+	Author string
+
+	// Email is the author's email address. It is only given to
+	// admins.
+	Email string `json:",omitempty"`
+
+	Body    string
+	Created time.Time
+
+	// State is one of the Comment states. It is only given to
+	// admins.
+	State int `json:",omitempty"`
+}
+
+// AddComment inserts a comment. Unverified comments expire after the
+// given grace period.
+func (db DB) AddComment(c *Comment, grace Duration) (err error) {
+	_, err = db.Exec(`INSERT INTO comments
+(id, address, author, email, body, created, state, expiration)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?);`, c.ID, []byte(c.Addr), c.Author,
+		c.Email, c.Body, c.Created.Unix(), c.State,
+		c.Created.Add(time.Duration(grace)).Unix())
+	return
+}
+
+// GetComment returns the comment with the given ID. If there is none,
+// both return values are nil.
+func (db DB) GetComment(id int64) (c *Comment, err error) {
+	c = &Comment{ID: id}
+	var created int64
+	err = db.QueryRow(`SELECT address,author,email,body,created,state
+FROM comments
+WHERE id = ?;`, id).Scan(&c.Addr, &c.Author, &c.Email, &c.Body,
+		&created, &c.State)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	c.Created = time.Unix(created, 0)
+	return
+}
+
+// Comments returns the comments on the node with the given address,
+// oldest first. Unless all is true, only visible comments are given.
+func (db DB) Comments(addr IP, all bool) (comments []*Comment, err error) {
+	var rows *sql.Rows
+	if all {
+		rows, err = db.Query(`SELECT id,author,email,body,created,state
+FROM comments
+WHERE address = ?
+ORDER BY created;`, []byte(addr))
+	} else {
+		rows, err = db.Query(`SELECT id,author,email,body,created,state
+FROM comments
+WHERE address = ? AND state = ?
+ORDER BY created;`, []byte(addr), CommentVisible)
+	}
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	comments = make([]*Comment, 0)
+	for rows.Next() {
+		c := &Comment{Addr: addr}
+		var created int64
+		err = rows.Scan(&c.ID, &c.Author, &c.Email, &c.Body, &created,
+			&c.State)
+		if err != nil {
+			return
+		}
+		c.Created = time.Unix(created, 0)
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+// SetCommentState changes the state of the comment with the given
+// ID. If there is no such comment, it returns sql.ErrNoRows.
+func (db DB) SetCommentState(id int64, state int) (err error) {
+	res, err := db.Exec(`UPDATE comments
+SET state = ?
+WHERE id = ?;`, state, id)
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return
+}
+
+// DeleteComment removes the comment with the given ID.
+func (db DB) DeleteComment(id int64) (err error) {
+	_, err = db.Exec(`DELETE FROM comments
+WHERE id = ?;`, id)
+	return
+}
+
+// DeleteExpiredComments removes unverified comments whose
+// verification period has passed.
+func (db DB) DeleteExpiredComments() (err error) {
+	_, err = db.Exec(`DELETE FROM comments
+WHERE state = ? AND expiration <= ?;`, CommentUnverified,
+		time.Now().Unix())
+	return
+}
+
+// SendCommentVerificationEmail sends the author of the comment a link
+// with which to verify it.
+func SendCommentVerificationEmail(c *Comment, r *http.Request) (err error) {
+	locale := NegotiateLocale(r)
+	e := &Email{
+		To:   c.Email,
+		From: Conf.SMTP.EmailAddress,
+		Subject: Translations.Translate(locale,
+			"email.comment_verification.subject", Conf.Name),
+		Locale: locale,
+	}
+	e.Data = map[string]interface{}{
+		"Link":           BaseURL(r),
+		"Address":        c.Addr.String(),
+		"VerificationID": c.ID,
+		"Body":           template.HTML(c.Body), // escaped when added
+		"Boundary":       rand.Int31(),
+	}
+	return e.Send("comment_verification.txt")
+}
+
+// NotifyCommentOwner emails the owner of the node that the comment
+// was left on, if Conf.Comments.NotifyOwner is set. Errors are
+// logged.
+func NotifyCommentOwner(c *Comment, baseURL string) {
+	if !Conf.Comments.NotifyOwner || Conf.SMTP == nil {
+		return
+	}
+	node, err := Db.GetLocalNode(c.Addr)
+	if err == LocalNodeNotFoundError {
+		return
+	} else if err != nil {
+		dbLog.Errf("Error getting node %q: %s", c.Addr, err)
+		return
+	}
+	if !Db.NodeOwnerPreferences(node).Comments {
+		return
+	}
+
+	e := &Email{
+		To:   node.OwnerEmail,
+		From: Conf.SMTP.EmailAddress,
+		Subject: Translations.Translate(Conf.DefaultLocale(),
+			"email.comment.subject", Conf.Name),
+	}
+	e.Data = map[string]interface{}{
+		"Author":       template.HTML(c.Author),
+		"Body":         template.HTML(c.Body),
+		"Name":         Conf.Name,
+		"Link":         baseURL + "/node/" + c.Addr.String(),
+		"AdminContact": Conf.AdminContact,
+		"Boundary":     rand.Int31(),
+	}
+	if err = e.Queue("comment.txt"); err != nil {
+		mailLog.Errf("Error notifying %q of comment %d: %s",
+			node.OwnerEmail, c.ID, err)
+	}
+}
+
+// GetComments returns the visible comments on the node with the given
+// `address`, oldest first. Admins are given every comment, with its
+// author's email address and its state.
+func (*Api) GetComments(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	ip := ParseIP(ctx.RequireStringLen(0, 40, "address"))
+	if ip == nil {
+		ctx.Error = jas.NewRequestError("addressInvalid")
+		return
+	}
+
+	admin := IsAdmin(ctx.Request)
+	comments, err := db.Comments(ip, admin)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error getting comments on %q: %s",
+			ip, err)
+		return
+	}
+	if !admin {
+		for _, c := range comments {
+			c.Email = ""
+			c.State = 0
+		}
+	}
+	ctx.Data = comments
+}
+
+// PostComment leaves a comment on a local node. It requires a token,
+// a correct CAPTCHA pair, and the form values `address`, `name`,
+// `email`, and `comment`. The comment is not shown until its author
+// verifies it by the link emailed to them. Admins' comments are shown
+// immediately.
+func (*Api) PostComment(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	if !Conf.Comments.Enabled {
+		ctx.Error = jas.NewRequestError("commentsDisabled")
+		return
+	}
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	RequireToken(ctx)
+
+	admin := IsAdmin(ctx.Request)
+	if !admin {
+		if err := VerifyCAPTCHA(ctx.Request); err != nil {
+			ctx.Error = jas.NewRequestError(err.Error())
+			return
+		}
+	}
+
+	ip := ParseIP(ctx.RequireStringLen(0, 40, "address"))
+	if ip == nil {
+		ctx.Error = jas.NewRequestError("addressInvalid")
+		return
+	}
+	// The ID verifies the comment, and so must not be guessable.
+	id, err := newRandomID()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Err(err)
+		return
+	}
+	c := &Comment{
+		ID:      id,
+		Addr:    ip,
+		Author:  html.EscapeString(ctx.RequireStringLen(1, 255, "name")),
+		Email:   ctx.RequireStringMatch(EmailRegexp, "email"),
+		Body:    ctx.RequireStringLen(1, MaxCommentLength, "comment"),
+		Created: time.Now(),
+	}
+	c.Body = html.EscapeString(c.Body)
+
+	_, err = db.GetLocalNode(ip)
+	if err != nil {
+		ctx.Error = apiError(ctx.Request, err)
+		return
+	}
+
+	if admin {
+		c.State = CommentVisible
+	} else if Conf.SMTP == nil {
+		ctx.Error = jas.NewInternalError(SMTPDisabledError)
+		apiLog.Request(ctx.Request).Err(SMTPDisabledError)
+		return
+	}
+
+	if err = db.AddComment(c, Conf.VerificationExpiration); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error adding comment on %q: %s",
+			ip, err)
+		return
+	}
+
+	if admin {
+		ctx.Data = "successful"
+		apiLog.Request(ctx.Request).Infof("Admin %q commented on %q",
+			ctx.RemoteAddr, ip)
+		NotifyCommentOwner(c, PageURL(ctx.Request))
+		return
+	}
+	if err = SendCommentVerificationEmail(c, ctx.Request); err != nil {
+		// Without the email, the comment can never be verified, so
+		// remove it.
+		db.DeleteComment(c.ID)
+		ctx.Error = jas.NewInternalError(err)
+		mailLog.Request(ctx.Request).Errf(
+			"Error sending comment verification email: %s", err)
+		return
+	}
+	ctx.Data = "verification email sent"
+	apiLog.Request(ctx.Request).Infof(
+		"%q commented on %q, waiting for verification",
+		ctx.RemoteAddr, ip)
+}
+
+// GetVerifyComment verifies the comment with the given `id`, as
+// emailed to its author. It is then shown, or, if comments are
+// moderated, awaits an admin's approval.
+func (*Api) GetVerifyComment(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	id := ctx.RequireInt("id")
+	c, err := db.GetComment(id)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Err(err)
+		return
+	} else if c == nil || c.State != CommentUnverified {
+		ctx.Error = jas.NewRequestError("invalid id")
+		apiLog.Request(ctx.Request).Noticef(
+			"%q attempted to verify invalid comment ID\n",
+			ctx.RemoteAddr)
+		return
+	}
+
+	state := CommentVisible
+	if Conf.Comments.Moderated {
+		state = CommentPending
+	}
+	if err = db.SetCommentState(id, state); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Err(err)
+		return
+	}
+
+	if state == CommentPending {
+		ctx.Data = "awaiting moderation"
+	} else {
+		ctx.Data = "successful"
+		NotifyCommentOwner(c, PageURL(ctx.Request))
+	}
+	apiLog.Request(ctx.Request).Infof("Comment %d on %q verified", id, c.Addr)
+}
+
+// PostModerateComment applies the given `action` to the comment with
+// the given `id`. The action may be "approve", which shows the
+// comment, "hide", or "delete". Only admins may moderate comments.
+func (*Api) PostModerateComment(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+
+	id := ctx.RequireInt("id")
+	c, err := db.GetComment(id)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Err(err)
+		return
+	} else if c == nil {
+		ctx.Error = jas.NewRequestError("invalid id")
+		return
+	}
+
+	switch action := ctx.RequireString("action"); action {
+	case "approve":
+		err = db.SetCommentState(id, CommentVisible)
+		if err == nil && c.State == CommentPending {
+			// The owner has not yet been told of this comment.
+			NotifyCommentOwner(c, PageURL(ctx.Request))
+		}
+	case "hide":
+		err = db.SetCommentState(id, CommentHidden)
+	case "delete":
+		err = db.DeleteComment(id)
+	default:
+		ctx.Error = jas.NewRequestError("actionInvalid")
+		return
+	}
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Err(err)
+		return
+	}
+	ctx.Data = "successful"
+	apiLog.Request(ctx.Request).Infof("Admin %q moderated comment %d on %q",
+		ctx.RemoteAddr, id, c.Addr)
+}
@@ -6,9 +6,11 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"html/template"
 	"net"
 	"os"
+	"strconv"
 	"time"
 )
 
@@ -32,6 +34,20 @@ type Config struct {
 	}
 	
 
+	// Theme is the path to a directory laid out like the res
+	// directory, whose files replace the default files of the same
+	// name, such as "web/css/style.css" or "webpages/node.html". Any
+	// files it doesn't contain fall back to the defaults, so a theme
+	// only needs to contain the files it changes. The strings in its
+	// locale files are merged with the default ones.
+	Theme string
+
+	// Locale is the language tag of the default locale, such as
+	// "en", which is used for pages compiled at startup and when a
+	// client accepts none of the locales in "<res>/locales". If it is
+	// not set, DefaultLocale is used.
+	Locale string
+
 	// AdminAddresses is a slice of addresses which are considered
 	// fully authenticated. Connections originating from those
 	// addresses will not be required to verify or perform any sort of
@@ -58,9 +74,37 @@ type Config struct {
 		// Addr is the network protocol, interface, and port to which
 		// NodeAtlas should bind. For example, "tcp://0.0.0.0:8077"
 		// will bind globally to the 8077 TCP port, and
-		// "unix://nodeatlas.sock" will create a UNIX socket at
-		// nodeatlas.sock.
-		Addr string
+		// "unix://nodeatlas.sock" or "unix:/run/nodeatlas.sock" will
+		// create a UNIX socket at the given path. "tcp4://" and
+		// "tcp6://" can be used to bind to only IPv4 or IPv6.
+		//
+		// It may also be a list of such addresses, or of objects of
+		// the form {"Addr": "...", "Prefix": "...", "SocketMode":
+		// "0660"}, in order to listen on several addresses at
+		// once. See ListenAddr.
+		Addr ListenAddrs
+
+		// ReadTimeout, WriteTimeout, and IdleTimeout limit the time
+		// that the HTTP server will spend reading a request, writing
+		// a response, and waiting for the next request on a
+		// keep-alive connection, respectively. If they are not set,
+		// defaults are used. See DefaultReadTimeout and friends.
+		ReadTimeout, WriteTimeout, IdleTimeout Duration
+
+		// ShutdownTimeout is the longest that in-flight requests are
+		// waited for when shutting down, or when restarting on
+		// SIGHUP. If it is not set, DefaultShutdownTimeout is used.
+		ShutdownTimeout Duration
+
+		// MaxHeaderBytes is the maximum size of request headers. If
+		// it is zero, DefaultMaxHeaderBytes is used.
+		MaxHeaderBytes int
+
+		// MaxBodyBytes is the maximum size of request bodies, such as
+		// POSTed forms. Requests with larger bodies will fail to be
+		// read. If it is zero, DefaultMaxBodyBytes is used. Uploads
+		// of photos are limited by Photos.MaxBytes instead.
+		MaxBodyBytes int64
 
 		// DeproxyHeaderFields is a list of HTTP header fields that
 		// should be used instead of the connecting IP when verifying
@@ -69,6 +113,16 @@ type Config struct {
 		// "X-Real-IP".
 		DeproxyHeaderFields []string
 
+		// TrustedProxies is a list of addresses or CIDR-form networks
+		// of reverse proxies, such as "127.0.0.1" or "10.0.0.0/8". If
+		// it is set, DeproxyHeaderFields and X-Forwarded-Proto are
+		// only honored on requests which arrive from one of these
+		// addresses, and X-Forwarded-For defaults to being used as
+		// the client address. If it is not set, the header fields
+		// are trusted from any address. Requests which arrive on a
+		// UNIX socket are always trusted.
+		TrustedProxies []IPNet
+
 		// HeaderSnippet is a snippet of code which is inserted into
 		// the <head> of each page. For example, one could include a
 		// script tieing into Pikwik.
@@ -79,6 +133,23 @@ type Config struct {
 		// /about page.
 		AboutSnippet string
 
+		// Headless disables the web frontend, so that only the API,
+		// CAPTCHAs, and other resources under the API are served.
+		// This is for deployments in which the frontend is a
+		// separate application or an existing website. Email
+		// templates are still loaded, but the page templates and
+		// the static, node, verification, and short link handlers
+		// are not registered.
+		Headless bool
+
+		// FrontendURL is the base URL of the frontend, such as
+		// "https://example.org/map", under which the pages of nodes
+		// are linked from emails, feeds, and calendars, as
+		// "<FrontendURL>/node/<address>". If it is not set, the
+		// Hostname and Prefix are used. When Headless is set and it
+		// is not, verification links go to /api/verify instead.
+		FrontendURL string
+
 		// RSS is the structure which contains settings for the
 		// built-in RSS feed generator.
 		RSS struct {
@@ -92,8 +163,327 @@ type Config struct {
 	// nodes every heartbeat. Please note that these maps are trusted
 	// fully, and they could easily introduce false nodes to the
 	// database temporarily (until cleared by the CacheExpiration.
+	// Addresses prefixed with "grpc+", such as
+	// "grpc+https://example.org", are pulled through the gRPC-Web
+	// federation service rather than /api/all.
 	ChildMaps []string
 
+	// PushSecrets maps the addresses of child maps, as in ChildMaps,
+	// to the secrets with which they sign notifications of changes
+	// to their nodes. When a notification is received, the cache is
+	// updated immediately, rather than at the next heartbeat.
+	PushSecrets map[string]string
+
+	// ParentMaps is a list of maps which pull nodes from this one,
+	// and which should be notified soon after any local node
+	// changes. Notifications identify this map by Web.Hostname and
+	// Web.Prefix, which must match the parent's ChildMaps.
+	ParentMaps []ParentMap
+
+	// BlockedSources is a list of patterns of maps from which nodes
+	// are never cached, even if a child map lists them. Patterns
+	// match either the whole address or its host, as in
+	// "*.example.org". See SourceFilter.
+	BlockedSources []string
+
+	// AllowedSources is a list of patterns of maps from which nodes
+	// may be cached when StrictSources is set.
+	AllowedSources []string
+
+	// StrictSources, if true, causes only nodes from the child maps
+	// themselves and maps in AllowedSources to be cached, so that a
+	// compromised child map cannot introduce other sources.
+	StrictSources bool
+
+	// DuplicatePolicy decides which node is shown when nodes from
+	// several sources, such as a local node and a cached one, have
+	// the same address. It is "local" (the default) to prefer local
+	// nodes, and otherwise the most recently retrieved, or "newest"
+	// to prefer the most recently changed. Duplicates are listed for
+	// admins at /admin/federation.
+	DuplicatePolicy string
+
+	// ChildMapLimits are the checks applied to the nodes retrieved
+	// from each child map, so that a buggy or malicious map cannot
+	// flood the cache. Nodes with invalid addresses or coordinates
+	// are always discarded.
+	ChildMapLimits struct {
+		// MaxBytes is the largest response which is read from a
+		// child map. Larger responses are rejected entirely. If it
+		// is not set, DefaultChildMapMaxBytes is used.
+		MaxBytes int64
+
+		// MaxNodesPerSource is the largest number of nodes which
+		// are cached from any one source. Any more are discarded. If
+		// it is not set, DefaultChildMapMaxNodes is used.
+		MaxNodesPerSource int
+
+		// Bounds, if set, is the area outside of which cached nodes
+		// are discarded.
+		Bounds *Bounds
+	}
+
+	// Maps is a list of additional logical maps, such as for other
+	// cities, which are hosted by this instance. See SubMap.
+	Maps []SubMap
+
+	// MapID is the ID of the logical map which this configuration
+	// describes. It is empty for the main map, and set by ForMap.
+	MapID string `json:"-"`
+
+	// Photos is the structure which contains settings for photos
+	// attached to nodes by their owners. Uploads are disabled unless
+	// Storage is configured.
+	Photos struct {
+		// MaxBytes is the largest size of an uploaded photo. If it
+		// is not set, DefaultPhotoMaxBytes is used.
+		MaxBytes int64
+
+		// ThumbnailSize is the largest width and height of the
+		// generated thumbnails, in pixels. If it is not set,
+		// DefaultThumbnailSize is used.
+		ThumbnailSize int
+
+		// Storage is where photos and thumbnails are kept.
+		Storage StorageConfig
+	}
+
+	// Comments is the structure which contains settings for
+	// comments left on nodes by visitors, who must verify them by
+	// email.
+	Comments struct {
+		// Enabled allows comments to be left.
+		Enabled bool
+
+		// Moderated requires that an admin approve each comment
+		// after it is verified, before it is shown.
+		Moderated bool
+
+		// NotifyOwner emails the owner of a node when a comment on
+		// it is shown.
+		NotifyOwner bool
+	}
+
+	// Installs is the structure which contains settings for install
+	// scheduling.
+	Installs struct {
+		// FeedKey, if set, must be given as the `key` form value to
+		// access the iCalendar feed of installs, which reveals the
+		// locations and times of installs.
+		FeedKey string
+	}
+
+	// Heartbeats is the structure which contains settings for the
+	// heartbeats which local nodes may send to check in.
+	Heartbeats struct {
+		// Timeout is the length of time after its last heartbeat
+		// that a node is marked as down. If it is not set,
+		// DefaultHeartbeatTimeout is used.
+		Timeout Duration
+	}
+
+	// Alerts is the structure which contains settings for alerts
+	// about active local nodes which have gone down, such as by
+	// missing their heartbeats.
+	Alerts struct {
+		// Enabled turns on alerts.
+		Enabled bool
+
+		// Muted silences all alerts, such as during network-wide
+		// maintenance. Individual nodes can also be muted by their
+		// owners.
+		Muted bool
+
+		// Threshold is the length of time that a node must be down
+		// before an alert is sent. If it is not set,
+		// DefaultAlertThreshold is used.
+		Threshold Duration
+
+		// EmailOwner emails alerts to the owners of the nodes.
+		EmailOwner bool
+
+		// WebhookURL, if set, is sent each alert as a JSON object of
+		// the form {"text": "..."}, as accepted by Slack and
+		// Mattermost incoming webhooks.
+		WebhookURL string
+	}
+
+	// Hooks is the structure which contains settings for running
+	// external commands when events occur, such as when a node is
+	// created or goes down, so that NodeAtlas can be extended
+	// without changing it.
+	Hooks struct {
+		// Commands maps the names of events, such as
+		// "node.created", to the commands which are run when they
+		// occur, each as a list of the program and its arguments.
+		// Commands for "*" are run for every event. Each is given a
+		// JSON payload on its standard input.
+		Commands map[string][][]string
+
+		// Timeout is the length of time for which a command may run
+		// before it is killed. If it is not set, DefaultHookTimeout
+		// is used.
+		Timeout Duration
+
+		// Concurrency is the number of commands which may run at
+		// once. If it is not set, DefaultHookConcurrency is used.
+		Concurrency int
+	}
+
+	// Tickets is the structure which contains settings for filing
+	// tickets with an external service request system, such as an
+	// Open311 server or a building management system, whenever an
+	// alert is sent. The ID of the ticket is stored with the node,
+	// and no other is filed until it is closed.
+	Tickets struct {
+		// URL is the address to which tickets are sent. If it is not
+		// set, no tickets are filed.
+		URL string
+
+		// Method is the HTTP method with which tickets are filed. If
+		// it is not set, "POST" is used.
+		Method string
+
+		// Headers are added to every request to the ticket system,
+		// such as to give an API key.
+		Headers map[string]string
+
+		// ContentType is the type of Body. If it is not set,
+		// "application/x-www-form-urlencoded" is used.
+		ContentType string
+
+		// Body is a text/template of the body of the request which
+		// files a ticket. It is given the .Node, the time .Since
+		// which it has been down, the .Name of the instance, the
+		// .Link to the node's page, and a .Description of the
+		// problem. If it is not set, DefaultTicketBody is used.
+		Body string
+
+		// IDField is the path to the ID of the ticket in the JSON
+		// response, made of object keys and array indexes separated
+		// by dots. If it is not set, DefaultTicketIDField is used.
+		IDField string
+
+		// StatusURL is a text/template of the address from which the
+		// status of a ticket is retrieved every heartbeat, such as
+		// "https://311.example.org/requests/{{.ID}}.json". If it is
+		// not set, tickets are never closed.
+		StatusURL string
+
+		// StatusField is the path to the status of the ticket in the
+		// JSON response, as with IDField. If it is not set,
+		// DefaultTicketStatusField is used.
+		StatusField string
+
+		// ClosedStatuses are the statuses of tickets which are
+		// resolved. If none are set, only "closed" is.
+		ClosedStatuses []string
+	}
+
+	// SNMP is the structure which contains settings for polling
+	// designated local nodes, such as supernodes, for metrics. The
+	// nodes and their credentials are set by admins through the API.
+	SNMP struct {
+		// Enabled turns on polling, which is done at every
+		// heartbeat.
+		Enabled bool
+
+		// ClientsOID, if set, is the OID of the number of connected
+		// clients, which varies between vendors.
+		ClientsOID string
+
+		// Retention is the length of time for which metrics are
+		// kept. If it is not set, DefaultMetricsRetention is used.
+		Retention Duration
+	}
+
+	// Cjdns is the structure which contains settings for importing
+	// peers from the admin API of a cjdns router, which must be a
+	// local node, at every heartbeat.
+	Cjdns struct {
+		// Enabled turns on importing.
+		Enabled bool
+
+		// Admin is the address of the admin API, such as
+		// "127.0.0.1:11234", and Password is its password, as in
+		// cjdroute.conf.
+		Admin    string
+		Password string
+
+		// CreateNodes adds established peers which aren't on the map
+		// as new nodes at the router's location, owned by the
+		// AdminContact.
+		CreateNodes bool
+	}
+
+	// Topology is a list of sources of links between nodes, such as
+	// OLSR or batman-adv routers, which are read at every
+	// heartbeat. See TopologySource.
+	Topology []TopologySource
+
+	// MQTT is the structure which contains settings for publishing
+	// node events and metrics to an MQTT broker. Changes take effect
+	// only after a restart.
+	MQTT struct {
+		// Broker is the address of the broker, such as
+		// "127.0.0.1:1883". If it is empty, nothing is published.
+		Broker string
+
+		// TLS connects to the broker with TLS.
+		TLS bool
+
+		// Username and Password are optional credentials.
+		Username, Password string
+
+		// ClientID identifies NodeAtlas to the broker. If it is not
+		// set, DefaultMQTTClientID is used.
+		ClientID string
+
+		// TopicPrefix is prepended to every topic, as in
+		// "<prefix>/nodes/<address>/<event>". If it is not set,
+		// DefaultMQTTTopicPrefix is used.
+		TopicPrefix string
+	}
+
+	// Redis contains settings for keeping state which must be
+	// consistent across several instances of NodeAtlas behind a load
+	// balancer, such as rate limits and the tokens from /api/token, in
+	// Redis rather than in memory.
+	Redis struct {
+		// Address is the address of the Redis server, such as
+		// "127.0.0.1:6379". If it is empty, state is kept in memory.
+		Address string
+
+		// TLS connects to Redis with TLS.
+		TLS bool
+
+		// Password is used to authenticate, if it is set.
+		Password string
+
+		// DB is the number of the database to select.
+		DB int
+
+		// KeyPrefix is prepended to every key, so that several maps
+		// can share one Redis. If it is not set,
+		// DefaultRedisKeyPrefix is used.
+		KeyPrefix string
+	}
+
+	// Cluster contains settings for running several instances of
+	// NodeAtlas which share the database. Only the instance which
+	// holds the leader lease in the database runs the heartbeat
+	// tasks, such as polling child maps and probing nodes.
+	Cluster struct {
+		// InstanceID identifies this instance in the lease. If it is
+		// not set, the hostname and a random number are used.
+		InstanceID string
+
+		// Lease is the length of time for which the leader holds its
+		// lease without renewing it, after which another instance
+		// takes over. If it is not set, DefaultLeaderLease is used.
+		Lease Duration
+	}
+
 	// Database is the structure which contains the database driver
 	// name, such as "sqlite3" or "mysql", and the database resource,
 	// such as a path to .db file, or username, password, and name.
@@ -101,6 +491,60 @@ type Config struct {
 		DriverName string
 		Resource   string
 		ReadOnly   bool
+
+		// ReplicaResource, if set, is the resource of a read replica
+		// of the database, using the same driver, from which nodes
+		// are read to serve them, such as for /api/all, /api/node,
+		// and searches. Everything else, and every change, uses
+		// Resource. The replica may lag behind, so changes may take
+		// a moment to appear.
+		ReplicaResource string
+
+		// MaxOpenConns and MaxIdleConns limit the number of
+		// connections to the database which are open, and which are
+		// kept open while idle. If they are not set, the limits of
+		// database/sql are used, and a negative MaxIdleConns keeps
+		// none.
+		MaxOpenConns, MaxIdleConns int
+
+		// ConnMaxLifetime is the longest time for which a connection
+		// is reused. If it is not set, connections are reused
+		// forever.
+		ConnMaxLifetime Duration
+
+		// Retries is the number of times a modification of the
+		// database is retried if it fails because the database is
+		// locked or the connection was lost, and RetryBackoff is
+		// the length of time to wait before the first retry, which
+		// doubles with each one after. If they are not set,
+		// DefaultDatabaseRetries and DefaultDatabaseRetryBackoff are
+		// used, and a negative Retries disables retrying.
+		Retries      int
+		RetryBackoff Duration
+
+		// SlowQuery is the length of time after which a query is
+		// logged as slow, with its statement and rounded parameters.
+		// If it is not set, DefaultSlowQuery is used, and if it is
+		// negative, no queries are logged. Every query is timed
+		// regardless, and summarized at /api/admin/perf.
+		SlowQuery Duration
+
+		// SQLite contains settings which apply to every connection
+		// if DriverName is "sqlite3".
+		SQLite struct {
+			// JournalMode is the journal mode of the database, such
+			// as "WAL", which lets the API read while the cache is
+			// being written. If it is not set, it is not changed.
+			JournalMode string
+
+			// BusyTimeout is the length of time to wait for a locked
+			// database before failing with "database is locked". If
+			// it is not set, DefaultSQLiteBusyTimeout is used.
+			BusyTimeout Duration
+
+			// ForeignKeys enables the enforcement of foreign keys.
+			ForeignKeys bool
+		}
 	}
 
 	// HeartbeatRate is the amount of time to wait between performing
@@ -112,6 +556,46 @@ type Config struct {
 	// nodes before considering them outdated, and removing them.
 	CacheExpiration Duration
 
+	// Retention limits the length of time for which the audit log,
+	// the status history of nodes, and cached nodes are kept, so
+	// that the database does not grow without bound. Older entries
+	// are removed every heartbeat. If AuditLog or StatusHistory are
+	// not set, they are kept forever. If CachedNodes is not set,
+	// CacheExpiration is used.
+	Retention struct {
+		AuditLog, StatusHistory, CachedNodes Duration
+	}
+
+	// OpenData is the structure which contains settings for the
+	// scheduled export of an anonymized dataset of the local nodes,
+	// for researchers and open data portals. See OpenDataset.
+	OpenData struct {
+		// Interval is the length of time between exports, which are
+		// made at the first heartbeat after it has passed. If it is
+		// not set, the dataset is only exported by the "open_data"
+		// job.
+		Interval Duration
+
+		// Name is the name under which the dataset is stored. If it
+		// is not set, DefaultOpenDataName is used.
+		Name string
+
+		// Precision is the number of decimal places to which
+		// coordinates are rounded. If it is not set,
+		// DefaultOpenDataPrecision is used.
+		Precision int
+
+		// License is the name or URL of the license under which the
+		// dataset is published, such as "ODbL-1.0", and Attribution
+		// is the credit requested of those who use it. Both are
+		// included in the dataset.
+		License, Attribution string
+
+		// Storage is where the dataset is written, either a local
+		// directory or an S3 bucket.
+		Storage StorageConfig
+	}
+
 	// VerificationExpiration is the amount of time to allow users to
 	// verify nodes by email after initially placing them. See the
 	// documentation for time.ParseDuration for format information.
@@ -149,6 +633,20 @@ type Config struct {
 		ServerAddress string
 	}
 
+	// EmailStorage controls how the email addresses of node owners
+	// are stored, to limit what is exposed if the database is
+	// leaked. If Mode is "encrypted", they are encrypted with Key,
+	// or the contents of KeyFile if it is set, and only decrypted
+	// when mail is sent. If it is "hashed", only a keyed hash is
+	// stored, which can be matched against an address, but owners
+	// can no longer be sent mail. If it is "plain" or omitted, they
+	// are stored as given. Existing addresses are converted when
+	// NodeAtlas starts.
+	EmailStorage struct {
+		Mode         string
+		Key, KeyFile string
+	}
+
 	// Map contains the information used by NodeAtlas to power the
 	// Leaflet.js map.
 	Map struct {
@@ -162,6 +660,34 @@ type Config struct {
 		// Leaflet.js can use it.
 		Tileserver string
 
+		// TileCacheDir, if set, is the directory in which tiles
+		// fetched from the Tileserver by NodeAtlas itself, such as to
+		// render static map images, are stored, so that they are
+		// only fetched once. If it is not set, tiles are not cached.
+		TileCacheDir string
+
+		// TileProxy configures the tile proxy, which serves tiles at
+		// "/tiles/{z}/{x}/{y}.png" by fetching them from the
+		// Tileserver on the clients' behalf and storing them in
+		// TileCacheDir. This allows the map to work for clients
+		// which have no route to the Tileserver, such as those
+		// inside of the mesh.
+		TileProxy struct {
+			// Enabled causes the map to load tiles through the
+			// proxy, rather than from the Tileserver directly.
+			Enabled bool
+
+			// FetchRate is the maximum number of tiles per second
+			// which will be fetched from the Tileserver, to respect
+			// its usage policy. The default is 2.
+			FetchRate float64
+
+			// ClientRate is the maximum number of tiles per second
+			// which will be served to any one client. The default
+			// is 20.
+			ClientRate float64
+		}
+
 		// Center contains the coordinates on which to center the map.
 		Center struct {
 			Latitude, Longitude float64
@@ -188,6 +714,34 @@ type Config struct {
 		AddressType string
 	}
 
+	// Geocoder configures the geocoding service used to find the
+	// coordinates of street addresses given when registering nodes,
+	// and to find the neighborhoods of nodes. If it is omitted,
+	// geocoding is disabled.
+	Geocoder *struct {
+		// URL is the base URL of a Nominatim-compatible geocoder,
+		// such as "https://nominatim.openstreetmap.org".
+		URL string
+
+		// Email is sent with each request, as the usage policy of
+		// the public Nominatim servers asks, so that the
+		// administrator can be contacted about problems.
+		Email string
+
+		// Rate is the maximum number of requests per second which
+		// will be made to the geocoder. The default is 1.
+		Rate float64
+	}
+
+	// Elevation configures the service used to look up the ground
+	// elevations of nodes. If it is omitted, elevations are not
+	// looked up.
+	Elevation *struct {
+		// URL is the base URL of an Open-Elevation compatible
+		// service, such as "https://api.open-elevation.com".
+		URL string
+	}
+
 	// Verify contains the list of steps used to ensure that new nodes
 	// are valid when registered. They can be enabled or disabled
 	// according to one's needs.
@@ -205,6 +759,114 @@ type Config struct {
 		// address of the node that is being verified.
 		FromNode bool
 	}
+
+	// AddressPlan contains the ranges from which addresses are
+	// allocated to new nodes, so that registrants need not pick their
+	// own, and collide. If no ranges are set, addresses are not
+	// allocated.
+	AddressPlan struct {
+		// Ranges are the networks from which addresses are allocated,
+		// such as "10.70.0.0/16", in order. The first and last
+		// addresses of each are never allocated.
+		Ranges []*IPNet
+
+		// ReservationTime is the length of time for which an
+		// address is held for a registrant, after it is reserved,
+		// until their node is added. The default is 24 hours.
+		ReservationTime Duration
+	}
+
+	// Validation contains rules which new and updated local nodes
+	// must follow. Each rule which is broken is reported with an
+	// error naming its field, such as "contactRequired". See
+	// ValidateConfigured.
+	Validation struct {
+		// Bounds, if set, is the area outside of which nodes may
+		// not be placed, such as the city.
+		Bounds *Bounds
+
+		// Subnets, if any are set, are the networks one of which
+		// must contain the address of every node, such as
+		// "10.70.0.0/16" or "fc00::/8". Unlike Verify.Netmask, they
+		// are also checked when nodes are updated or imported.
+		Subnets []*IPNet
+
+		// Required are the optional fields which must not be empty,
+		// of "contact", "details", and "pgp".
+		Required []string
+
+		// Patterns maps the fields "name", "contact", "details", and
+		// "pgp" to regular expressions which they must match, if
+		// they are not empty.
+		Patterns map[string]string
+
+		// Strict, if true, rejects requests to create or update
+		// nodes which have fields other than those of NodeSchema,
+		// rather than ignoring them.
+		Strict bool
+	}
+
+	// Interest contains settings for interest points, where visitors
+	// would like a node.
+	Interest struct {
+		// NotifyDistance is the distance in meters within which
+		// the requesters of interest points are emailed when an
+		// active node appears. If it is not set,
+		// DefaultInterestDistance is used.
+		NotifyDistance float64
+	}
+
+	// Queue contains settings for the queue of background tasks, such
+	// as emails and notifications of parent maps, which are retried
+	// until they succeed.
+	Queue struct {
+		// Attempts is the number of times a task is attempted
+		// before it is moved to the dead-letter list. If it is not
+		// set, DefaultQueueAttempts is used.
+		Attempts int
+
+		// Backoff is the length of time to wait before a failed task
+		// is first retried. It doubles with each attempt, up to six
+		// hours. If it is not set, DefaultQueueBackoff is used.
+		Backoff Duration
+	}
+}
+
+// SubMap is an additional logical map hosted by the same instance of
+// NodeAtlas, which is served at "/<ID>/". It has its own nodes, child
+// maps, and map settings, but shares the database, administrators,
+// and all other configuration with the main map.
+type SubMap struct {
+	// ID identifies the map in URLs and in the database, such as
+	// "nyc". It must be made up of lowercase letters, digits, and
+	// dashes.
+	ID string
+
+	// Name is the name of the map, used in place of Config.Name.
+	Name string
+
+	// Center and Zoom are used in place of those in Config.Map.
+	Center struct {
+		Latitude, Longitude float64
+	}
+	Zoom int
+
+	// ChildMaps is a list of addresses from which to pull nodes for
+	// this map, as with Config.ChildMaps.
+	ChildMaps []string
+}
+
+// StorageConfig describes where uploaded files are stored. See
+// NewStorage.
+type StorageConfig struct {
+	// Dir is the local directory in which files are stored.
+	Dir string
+
+	// S3, if not nil, is a bucket of an S3-compatible service, such
+	// as Amazon S3 or MinIO, in which files are stored instead of
+	// Dir. This is useful if the local disk is not persistent, such
+	// as in a container.
+	S3 *S3Storage
 }
 
 // ReadConfig uses os and encoding/json to read a configuration from
@@ -255,6 +917,84 @@ func (d *Duration) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// ListenAddr is a single address on which the HTTP server listens.
+type ListenAddr struct {
+	// Addr is of the form "protocol://address", such as
+	// "tcp://0.0.0.0:8077", or "unix:/path/to/socket".
+	Addr string
+
+	// Prefix, if set, is stripped from the path of every request
+	// received on this listener before it is handled. This allows
+	// one listener to be placed behind a reverse proxy at a
+	// different path than the others.
+	Prefix string `json:",omitempty"`
+
+	// SocketMode is the permission mode given to UNIX sockets, such
+	// as "0660". If it is not set, sockets are made world-writable
+	// (0777), so that web servers can write to them.
+	SocketMode FileMode `json:",omitempty"`
+}
+
+// ListenAddrs is a list of ListenAddr which can be unmarshalled from
+// a single string, or a list containing strings and objects.
+type ListenAddrs []ListenAddr
+
+var InvalidListenAddrError = errors.New("listen address is invalid")
+
+func (addrs *ListenAddrs) UnmarshalJSON(b []byte) error {
+	// For compatibility with older configurations, accept a single
+	// string.
+	if b[0] == '"' {
+		var addr string
+		if err := json.Unmarshal(b, &addr); err != nil {
+			return err
+		}
+		*addrs = ListenAddrs{{Addr: addr}}
+		return nil
+	} else if b[0] != '[' {
+		return InvalidListenAddrError
+	}
+
+	// Otherwise, decode each element individually, because they may
+	// be either strings or objects.
+	var raw []json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	*addrs = make(ListenAddrs, len(raw))
+	for i, r := range raw {
+		if len(r) > 0 && r[0] == '"' {
+			if err := json.Unmarshal(r, &(*addrs)[i].Addr); err != nil {
+				return err
+			}
+		} else if err := json.Unmarshal(r, &(*addrs)[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileMode is a wrapper for os.FileMode which can be unmarshalled from
+// an octal string, such as "0660".
+type FileMode os.FileMode
+
+func (m FileMode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%#o", uint32(m)))
+}
+
+func (m *FileMode) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return err
+	}
+	*m = FileMode(mode)
+	return nil
+}
+
 // IPNet is a wrapper for net.IPNet which implements json.Unmarshaler.
 
 type IPNet net.IPNet
@@ -267,10 +1007,17 @@ func (n *IPNet) UnmarshalJSON(b []byte) error {
 		// and should return an error.
 		return InvalidIPNetError
 	}
-	_, ipnet, err := net.ParseCIDR(string(b[1 : len(b)-1]))
+	// If a single address is given, rather than a network, it is
+	// treated as a network containing only that address.
+	ipnet, err := ParseSubnet(string(b[1 : len(b)-1]))
 	if err != nil {
 		return err
 	}
-	*n = *(*IPNet)(ipnet)
+	*n = *ipnet
 	return nil
 }
+
+// Contains reports whether the network includes the given address.
+func (n *IPNet) Contains(ip net.IP) bool {
+	return (*net.IPNet)(n).Contains(ip)
+}
@@ -0,0 +1,243 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"github.com/coocood/jas"
+	"html"
+	"html/template"
+	"math/rand"
+	"time"
+)
+
+// ConnectionRequest is a request by a prospective member to connect
+// to an existing local node, such as by a rooftop link.
+type ConnectionRequest struct {
+	ID int64
+
+	// Target is the address of the node to which the member would
+	// like to connect. TargetLatitude and TargetLongitude are its
+	// location.
+	Target                          IP
+	TargetLatitude, TargetLongitude float64
+
+	// Name, Email, and Contact are the prospective member's name,
+	// email address, and any other contact information.
+	Name    string
+	Email   string
+	Contact string `json:",omitempty"`
+
+	// Latitude and Longitude are the prospective member's location.
+	Latitude, Longitude float64
+
+	Message string `json:",omitempty"`
+	Created time.Time
+
+	// Closed is true once the request has been dealt with.
+	Closed bool
+}
+
+// AddConnectionRequest records a connection request.
+func (db DB) AddConnectionRequest(c *ConnectionRequest) (err error) {
+	_, err = db.Exec(`INSERT INTO connection_requests
+(id, address, name, email, contact, lat, lon, message, created, closed)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`, c.ID, []byte(c.Target), c.Name,
+		c.Email, c.Contact, c.Latitude, c.Longitude, c.Message,
+		c.Created.Unix(), c.Closed)
+	return
+}
+
+// OpenConnectionRequests returns every connection request which has
+// not been closed, and whose target node still exists, oldest first.
+func (db DB) OpenConnectionRequests() (requests []*ConnectionRequest, err error) {
+	rows, err := db.Query(`SELECT
+r.id,r.address,nodes.lat,nodes.lon,r.name,r.email,r.contact,
+r.lat,r.lon,r.message,r.created
+FROM connection_requests AS r
+INNER JOIN nodes ON r.address = nodes.address
+WHERE r.closed = 0
+ORDER BY r.created;`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	requests = make([]*ConnectionRequest, 0)
+	for rows.Next() {
+		c := new(ConnectionRequest)
+		var contact, message sql.NullString
+		var created int64
+		err = rows.Scan(&c.ID, &c.Target, &c.TargetLatitude,
+			&c.TargetLongitude, &c.Name, &c.Email, &contact,
+			&c.Latitude, &c.Longitude, &message, &created)
+		if err != nil {
+			return
+		}
+		c.Contact = contact.String
+		c.Message = message.String
+		c.Created = time.Unix(created, 0)
+		requests = append(requests, c)
+	}
+	return requests, rows.Err()
+}
+
+// CloseConnectionRequest marks the connection request with the given
+// ID as closed. If there is no such request, it returns
+// sql.ErrNoRows.
+func (db DB) CloseConnectionRequest(id int64) (err error) {
+	res, err := db.Exec(`UPDATE connection_requests
+SET closed = 1
+WHERE id = ?;`, id)
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return
+}
+
+// PostConnect submits a request to connect to the local node with the
+// given `address`. It requires the prospective member's `name`,
+// `email`, and location, as for registering a node, and optionally
+// takes `contact` and a `message`. It requires a token and a correct
+// CAPTCHA pair. The node's owner is emailed the request, with the
+// member's address as the reply address, unless they would rather
+// only see requests at /my.
+func (*Api) PostConnect(ctx *jas.Context) {
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	db := Db.WithContext(ctx.Request.Context())
+	RequireToken(ctx)
+	if !IsAdmin(ctx.Request) {
+		if err := VerifyCAPTCHA(ctx.Request); err != nil {
+			ctx.Error = jas.NewRequestError(err.Error())
+			return
+		}
+	}
+	if Conf.SMTP == nil {
+		ctx.Error = jas.NewInternalError(SMTPDisabledError)
+		apiLog.Request(ctx.Request).Err(SMTPDisabledError)
+		return
+	}
+
+	ip := ParseIP(ctx.RequireStringLen(0, 40, "address"))
+	if ip == nil {
+		ctx.Error = jas.NewRequestError("addressInvalid")
+		return
+	}
+	id, err := newRandomID()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Err(err)
+		return
+	}
+	c := &ConnectionRequest{
+		ID:      id,
+		Target:  ip,
+		Name:    html.EscapeString(ctx.RequireStringLen(1, 255, "name")),
+		Email:   ctx.RequireStringMatch(EmailRegexp, "email"),
+		Created: time.Now(),
+	}
+	if c.Latitude, c.Longitude, err = RequireLocation(ctx); err != nil {
+		return
+	}
+	c.Contact, _ = ctx.FindStringLen(0, 255, "contact")
+	c.Contact = html.EscapeString(c.Contact)
+	c.Message, _ = ctx.FindStringLen(0, 1000, "message")
+	c.Message = html.EscapeString(c.Message)
+
+	node, err := db.GetLocalNode(ip)
+	if err != nil {
+		ctx.Error = apiError(ctx.Request, err)
+		return
+	}
+
+	if err = db.AddConnectionRequest(c); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error adding connection request: %s",
+			err)
+		return
+	}
+	if !db.NodeOwnerPreferences(node).Connections {
+		ctx.Data = "successful"
+		apiLog.Request(ctx.Request).Noticef(
+			"%q requested to connect to %q from %q, shown only at /my",
+			ctx.RemoteAddr, ip, c.Email)
+		return
+	}
+
+	e := &Email{
+		To:   node.OwnerEmail,
+		From: Conf.SMTP.EmailAddress,
+		Subject: Translations.Translate(Conf.DefaultLocale(),
+			"email.connect.subject", Conf.Name),
+	}
+	// The name, contact, and message were escaped above.
+	distance := Distance(c.Latitude, c.Longitude,
+		node.Latitude, node.Longitude)
+	e.Data = map[string]interface{}{
+		"ReplyTo":      c.Email,
+		"Requester":    template.HTML(c.Name),
+		"Contact":      template.HTML(c.Contact),
+		"Message":      template.HTML(c.Message),
+		"Distance":     distance,
+		"Name":         Conf.Name,
+		"Link":         NodePageURL(ctx.Request, ip),
+		"AdminContact": Conf.AdminContact,
+		"Boundary":     rand.Int31(),
+	}
+	if err = e.Queue("connect.txt"); err != nil {
+		// The request is still visible to admins, so don't remove
+		// it.
+		ctx.Error = jas.NewInternalError(err)
+		mailLog.Request(ctx.Request).Errf(
+			"Error sending connection request to %q: %s",
+			node.OwnerEmail, err)
+		return
+	}
+	ctx.Data = "successful"
+	apiLog.Request(ctx.Request).Noticef("%q requested to connect to %q from %q",
+		ctx.RemoteAddr, ip, c.Email)
+}
+
+// GetConnectionRequests returns every open connection request, with
+// the location of its target node, so that they can be shown on the
+// map. Only admins may see them.
+func (*Api) GetConnectionRequests(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	var err error
+	ctx.Data, err = db.OpenConnectionRequests()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf(
+			"Error getting connection requests: %s", err)
+	}
+}
+
+// PostCloseConnectionRequest closes the connection request with the
+// given `id`, such as once the link has been made. Only admins may
+// close requests.
+func (*Api) PostCloseConnectionRequest(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	id := ctx.RequireInt("id")
+	err := db.CloseConnectionRequest(id)
+	if err == sql.ErrNoRows {
+		ctx.Error = jas.NewRequestError("invalid id")
+	} else if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Err(err)
+	} else {
+		ctx.Data = "closed"
+	}
+}
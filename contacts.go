@@ -0,0 +1,198 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"database/sql"
+	"html"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ContactFilter selects the local nodes whose owners are exported by
+// HandleContactsExport. Every condition which is set must be met.
+type ContactFilter struct {
+	// StatusSet and StatusUnset are status flags which must all be
+	// set, or all be unset.
+	StatusSet, StatusUnset uint32
+
+	// Region, if not empty, is the name of the region in which every
+	// selected node is.
+	Region string
+
+	// MapID, if not nil, is the map of every selected node.
+	MapID *string
+}
+
+// OwnerContact is the owner of one or more local nodes, as exported as
+// a vCard.
+type OwnerContact struct {
+	Name, Email string
+
+	// Contact is the public contact information of the owner's
+	// first node, if it has any.
+	Contact string
+
+	Nodes []*Node
+}
+
+// OwnerContacts returns the owners of the local nodes which match the
+// filter, by their email addresses, ordered by name. Owners whose
+// email addresses are stored hashed cannot be contacted, and so are
+// left out.
+func (db DB) OwnerContacts(f *ContactFilter) (owners []*OwnerContact, err error) {
+	rows, err := db.Query(`SELECT address,owner,email,contact,lat,lon,status,
+map_id
+FROM nodes
+WHERE (status & ?) = ? AND (status & ?) = 0
+ORDER BY address;`, f.StatusSet, f.StatusSet, f.StatusUnset)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	byEmail := make(map[string]*OwnerContact)
+	owners = make([]*OwnerContact, 0)
+	for rows.Next() {
+		node := new(Node)
+		contact := sql.NullString{}
+		if err = rows.Scan(&node.Addr, &node.OwnerName, &node.OwnerEmail,
+			&contact, &node.Latitude, &node.Longitude, &node.Status,
+			&node.MapID); err != nil {
+			return
+		}
+		node.Contact = contact.String
+		if f.MapID != nil && node.MapID != *f.MapID {
+			continue
+		}
+		if len(f.Region) > 0 {
+			r := RegionOf(node.Latitude, node.Longitude)
+			if r == nil || !strings.EqualFold(r.Name, f.Region) {
+				continue
+			}
+		}
+
+		email, err := EmailRecipient(node.OwnerEmail)
+		if err != nil {
+			continue
+		}
+		key := strings.ToLower(email)
+		owner := byEmail[key]
+		if owner == nil {
+			owner = &OwnerContact{
+				Name:    html.UnescapeString(node.OwnerName),
+				Email:   email,
+				Contact: html.UnescapeString(node.Contact),
+			}
+			byEmail[key] = owner
+			owners = append(owners, owner)
+		}
+		owner.Nodes = append(owner.Nodes, node)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	sort.Sort(ownerContacts(owners))
+	return
+}
+
+// ownerContacts sorts OwnerContacts by name, and then email address.
+type ownerContacts []*OwnerContact
+
+func (o ownerContacts) Len() int      { return len(o) }
+func (o ownerContacts) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+func (o ownerContacts) Less(i, j int) bool {
+	a, b := strings.ToLower(o[i].Name), strings.ToLower(o[j].Name)
+	if a != b {
+		return a < b
+	}
+	return o[i].Email < o[j].Email
+}
+
+// writeVCard writes the owner as a vCard 3.0. Its note lists the
+// addresses and statuses of the owner's nodes, and its categories are
+// the names of their regions. Lines are escaped and folded in the same
+// way as those of iCalendar.
+func writeVCard(buf *bytes.Buffer, owner *OwnerContact) {
+	c := &ICalWriter{w: buf}
+	c.line("BEGIN", "VCARD")
+	c.line("VERSION", "3.0")
+	c.line("FN", icalEscaper.Replace(owner.Name))
+	c.line("N", icalEscaper.Replace(owner.Name)+";;;;")
+	c.line("EMAIL;TYPE=INTERNET", icalEscaper.Replace(owner.Email))
+
+	var notes, regions []string
+	seen := make(map[string]bool)
+	for _, node := range owner.Nodes {
+		notes = append(notes, node.Addr.String()+" ("+
+			strings.Join(StatusNames(node.Status), ", ")+")")
+		if r := RegionOf(node.Latitude, node.Longitude); r != nil &&
+			!seen[r.Name] {
+			seen[r.Name] = true
+			regions = append(regions, icalEscaper.Replace(r.Name))
+		}
+	}
+	if len(owner.Contact) > 0 {
+		notes = append(notes, "Contact: "+owner.Contact)
+	}
+	c.line("NOTE", icalEscaper.Replace(strings.Join(notes, "\n")))
+	if len(regions) > 0 {
+		c.line("CATEGORIES", strings.Join(regions, ","))
+	}
+	c.line("END", "VCARD")
+}
+
+// HandleContactsExport serves the owners of the local nodes as vCards,
+// so that they can be imported into an address book or mail client
+// to reach them about outages or events. The nodes are filtered by
+// the `status` flags which must be set, the `not_status` flags which
+// must be unset, the name of a `region`, and a `map` ID. Only admins
+// may export contacts.
+func HandleContactsExport(w http.ResponseWriter, r *http.Request) {
+	db := Db.WithContext(r.Context())
+	if !IsAdmin(r) {
+		http.Error(w, "notAdmin", http.StatusForbidden)
+		return
+	}
+
+	f := new(ContactFilter)
+	for _, flag := range []struct {
+		name   string
+		status *uint32
+	}{{"status", &f.StatusSet}, {"not_status", &f.StatusUnset}} {
+		if s := r.FormValue(flag.name); len(s) > 0 {
+			status, err := strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				http.Error(w, flag.name+"Invalid", http.StatusBadRequest)
+				return
+			}
+			*flag.status = uint32(status)
+		}
+	}
+	f.Region = r.FormValue("region")
+	if _, ok := r.Form["map"]; ok {
+		mapID := r.FormValue("map")
+		f.MapID = &mapID
+	}
+
+	owners, err := db.OwnerContacts(f)
+	if err != nil {
+		dbLog.Request(r).Errf("Error listing owner contacts: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	for _, owner := range owners {
+		writeVCard(buf, owner)
+	}
+	w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="contacts.vcf"`)
+	w.Write(buf.Bytes())
+}
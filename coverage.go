@@ -0,0 +1,341 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/coocood/jas"
+	"time"
+)
+
+const (
+	// DefaultCoverageRange is the distance in meters which radios are
+	// assumed to reach when coverage is estimated, if no `range` is
+	// given.
+	DefaultCoverageRange = 1000
+
+	// coverageArcStep is the number of degrees between the points of
+	// the arcs of estimated coverage.
+	coverageArcStep = 10
+)
+
+var (
+	NoRadiosError = errors.New("noRadios")
+)
+
+// Coverage is the area which a local node, usually a supernode, can
+// plausibly reach, so that prospective members can see whether their
+// roof is within it.
+type Coverage struct {
+	Addr IP `json:"Address"`
+
+	// Polygons is a list of polygons, each of which is a list of
+	// rings of [longitude, latitude] points, as in Region.
+	Polygons [][][][2]float64
+
+	// Source is "manual" if the coverage was drawn by an admin, or
+	// "estimated" if it was estimated from the node's radios.
+	Source  string
+	Updated time.Time
+
+	bounds Bounds
+}
+
+// Contains reports whether the given point is within the coverage.
+func (c *Coverage) Contains(lat, lon float64) bool {
+	return c.bounds.Contains(lat, lon) &&
+		polygonsContain(c.Polygons, lat, lon)
+}
+
+// Feature returns the coverage as a GeoJSON Feature with a
+// MultiPolygon geometry.
+func (c *Coverage) Feature() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "Feature",
+		"geometry": map[string]interface{}{
+			"type":        "MultiPolygon",
+			"coordinates": c.Polygons,
+		},
+		"properties": map[string]interface{}{
+			"Address": c.Addr,
+			"Source":  c.Source,
+			"Updated": c.Updated,
+		},
+	}
+}
+
+// ParseCoverageGeometry parses a GeoJSON Polygon or MultiPolygon
+// geometry, or a Feature with one, and checks that every ring is
+// closed, has at least four points, and lies on the globe.
+func ParseCoverageGeometry(data []byte) (polygons [][][][2]float64, err error) {
+	var geometry struct {
+		Type        string
+		Coordinates json.RawMessage
+		Geometry    *struct {
+			Type        string
+			Coordinates json.RawMessage
+		}
+	}
+	if err = json.Unmarshal(data, &geometry); err != nil {
+		return
+	}
+	typ, coordinates := geometry.Type, geometry.Coordinates
+	if typ == "Feature" && geometry.Geometry != nil {
+		typ = geometry.Geometry.Type
+		coordinates = geometry.Geometry.Coordinates
+	}
+	if polygons, err = parsePolygons(typ, coordinates); err != nil {
+		return
+	}
+
+	if len(polygons) == 0 {
+		return nil, errors.New("no polygons")
+	}
+	for _, polygon := range polygons {
+		if len(polygon) == 0 {
+			return nil, errors.New("polygon has no rings")
+		}
+		for _, ring := range polygon {
+			if len(ring) < 4 || ring[0] != ring[len(ring)-1] {
+				return nil, errors.New("ring is not closed")
+			}
+			for _, p := range ring {
+				if p[0] < -180 || p[0] > 180 || p[1] < -90 || p[1] > 90 {
+					return nil, errors.New("point is out of range")
+				}
+			}
+		}
+	}
+	return
+}
+
+// EstimateCoverage estimates the coverage of the node from its radio
+// interfaces, as a sector of the given range in meters for each
+// directional radio, in the direction it points, and a circle for each
+// other radio. If the node has no radios, it returns NoRadiosError.
+func EstimateCoverage(node *Node, interfaces []*Interface, meters float64) ([][][][2]float64, error) {
+	polygons := make([][][][2]float64, 0)
+	for _, i := range interfaces {
+		if i.Kind != "radio" {
+			continue
+		}
+
+		from, to := 0.0, 360.0
+		if i.Azimuth != nil {
+			width := i.Beamwidth
+			if width <= 0 {
+				width = DefaultBeamwidth
+			}
+			from, to = *i.Azimuth-width/2, *i.Azimuth+width/2
+		}
+
+		ring := make([][2]float64, 0)
+		if to-from < 360 {
+			ring = append(ring, [2]float64{node.Longitude, node.Latitude})
+		}
+		for bearing := from; ; bearing += coverageArcStep {
+			if bearing > to {
+				bearing = to
+			}
+			lat, lon := Destination(node.Latitude, node.Longitude,
+				bearing, meters)
+			ring = append(ring, [2]float64{lon, lat})
+			if bearing == to {
+				break
+			}
+		}
+		ring = append(ring, ring[0])
+		polygons = append(polygons, [][][2]float64{ring})
+	}
+	if len(polygons) == 0 {
+		return nil, NoRadiosError
+	}
+	return polygons, nil
+}
+
+// SaveCoverage inserts or replaces the coverage of a node.
+func (db DB) SaveCoverage(c *Coverage) (err error) {
+	geometry, err := json.Marshal(c.Polygons)
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`DELETE FROM coverage
+WHERE address = ?;`, []byte(c.Addr))
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`INSERT INTO coverage
+(address, geometry, source, updated)
+VALUES(?, ?, ?, ?);`, []byte(c.Addr), string(geometry), c.Source,
+		c.Updated.Unix())
+	return
+}
+
+// RemoveCoverage removes the coverage of the node with the given
+// address. If it has none, it returns sql.ErrNoRows.
+func (db DB) RemoveCoverage(addr IP) (err error) {
+	res, err := db.Exec(`DELETE FROM coverage
+WHERE address = ?;`, []byte(addr))
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return
+}
+
+// ListCoverage returns the coverage of every node, ordered by address.
+// Rows whose geometry can't be read are skipped and logged.
+func (db DB) ListCoverage() (coverage []*Coverage, err error) {
+	rows, err := db.Query(`SELECT address,geometry,source,updated
+FROM coverage
+ORDER BY address;`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	coverage = make([]*Coverage, 0)
+	for rows.Next() {
+		c := new(Coverage)
+		var geometry string
+		var updated int64
+		err = rows.Scan(&c.Addr, &geometry, &c.Source, &updated)
+		if err != nil {
+			return
+		}
+		if err := json.Unmarshal([]byte(geometry), &c.Polygons); err != nil {
+			dbLog.Errf("Error reading coverage of %q: %s", c.Addr, err)
+			continue
+		}
+		c.Updated = time.Unix(updated, 0)
+		c.bounds = polygonBounds(c.Polygons)
+		coverage = append(coverage, c)
+	}
+	return coverage, rows.Err()
+}
+
+// GetCoverage responds with the coverage of the local nodes as a
+// GeoJSON FeatureCollection. If a `latitude` and `longitude` are given,
+// only the coverage which contains that point is included, so that a
+// prospective member can see which nodes might reach their roof.
+func (*Api) GetCoverage(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	coverage, err := db.ListCoverage()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error listing coverage: %s", err)
+		return
+	}
+
+	lat, latErr := ctx.FindFloat("latitude")
+	lon, lonErr := ctx.FindFloat("longitude")
+	if (latErr == nil) != (lonErr == nil) {
+		ctx.Error = jas.NewRequestError("latitude and longitude are both required")
+		return
+	}
+
+	features := make([]interface{}, 0, len(coverage))
+	for _, c := range coverage {
+		if latErr == nil && !c.Contains(lat, lon) {
+			continue
+		}
+		features = append(features, c.Feature())
+	}
+	ctx.Data = map[string]interface{}{
+		"type":     "FeatureCollection",
+		"features": features,
+	}
+}
+
+// PostCoverage sets the coverage of the local node with the given
+// `address`, either to the GeoJSON Polygon or MultiPolygon given as
+// `geometry`, or, if `estimate` is given instead, to an estimate from
+// the node's radio interfaces, which reach `range` meters, or
+// DefaultCoverageRange. Only admins may set coverage.
+func (*Api) PostCoverage(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	node := RequireLocalNode(ctx)
+	c := &Coverage{Addr: node.Addr, Updated: time.Now()}
+
+	var err error
+	ctx.ParseForm()
+	if g, _ := ctx.FindString("geometry"); len(g) > 0 {
+		c.Source = "manual"
+		c.Polygons, err = ParseCoverageGeometry([]byte(g))
+		if err != nil {
+			ctx.Error = jas.NewRequestError("geometryInvalid")
+			return
+		}
+	} else if _, ok := ctx.Form["estimate"]; ok {
+		meters := float64(DefaultCoverageRange)
+		if r, err := ctx.FindFloat("range"); err == nil {
+			if r <= 0 {
+				ctx.Error = jas.NewRequestError("rangeInvalid")
+				return
+			}
+			meters = r
+		}
+		interfaces, err := db.ListInterfaces(node.Addr)
+		if err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			apiLog.Request(ctx.Request).Errf(
+				"Error listing interfaces of %q: %s", node.Addr, err)
+			return
+		}
+		c.Source = "estimated"
+		c.Polygons, err = EstimateCoverage(node, interfaces, meters)
+		if err == NoRadiosError {
+			ctx.Error = jas.NewRequestError(err.Error())
+			return
+		}
+	} else {
+		ctx.Error = jas.NewRequestError("geometryInvalid")
+		return
+	}
+	c.bounds = polygonBounds(c.Polygons)
+
+	if err = db.SaveCoverage(c); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error saving coverage of %q: %s",
+			node.Addr, err)
+		return
+	}
+	db.Audit(node.Addr, "coverage_set", "admin", c.Source)
+	ctx.Data = c.Feature()
+}
+
+// PostDeleteCoverage removes the coverage of the local node with the
+// given `address`. Only admins may remove coverage.
+func (*Api) PostDeleteCoverage(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	node := RequireLocalNode(ctx)
+
+	err := db.RemoveCoverage(node.Addr)
+	if err == sql.ErrNoRows {
+		ctx.Error = jas.NewRequestError("no matching coverage")
+		return
+	} else if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error removing coverage of %q: %s",
+			node.Addr, err)
+		return
+	}
+	ctx.Data = "deleted"
+}
@@ -0,0 +1,389 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"crypto/hmac"
+	"database/sql"
+	"html"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ownerLoginLimiter limits how often each address may ask for a login
+// link to /my, since each sends an email.
+var ownerLoginLimiter = NewSharedRateLimiter("owner_logins", 1.0/60, 3)
+
+// myMessages are the messages which /my may show after an action, by
+// the `done` value of its redirect.
+var myMessages = map[string]string{
+	"sent":        "my.sent",
+	"saved":       "my.saved",
+	"preferences": "my.preferences_saved",
+	"signed_out":  "my.signed_out",
+}
+
+// myPage is the data of the "my.html" template.
+type myPage struct {
+	Conf *Config
+
+	// Email is the address of the owner who is signed in, if any, and
+	// CSRF is the value which their forms must give.
+	Email, CSRF string
+
+	Nodes       []*myNode
+	Preferences OwnerPreferences
+	ReadOnly    bool
+
+	// Message and Error are the keys of the translations shown at the
+	// top of the page, and Detail is added to the error.
+	Message, Error, Detail string
+}
+
+// myNode is one of the nodes of the owner signed in to /my.
+type myNode struct {
+	*Node
+	Status []string
+	Active bool
+
+	// Name, Contact, and Details are those of the node, unescaped so
+	// that they can be edited.
+	Name, Contact, Details string
+
+	History  []StatusChange
+	Requests []*ConnectionRequest
+}
+
+// ownerCSRF returns the value which forms posted to /my must give as
+// `csrf`, so that other sites can't make changes on an owner's behalf.
+// It is derived from the session's token.
+func ownerCSRF(session string) string {
+	return sha256Hex([]byte("csrf:" + session))
+}
+
+// setOwnerCookie sets or, if session is empty, removes the session
+// cookie of /my. It is sent for every path, so that IsNodeOwner
+// accepts it in the API, too.
+func setOwnerCookie(w http.ResponseWriter, r *http.Request, session string) {
+	cookie := &http.Cookie{
+		Name:     OwnerSessionCookie,
+		Value:    session,
+		Path:     Conf.Web.Prefix + "/",
+		HttpOnly: true,
+		Secure:   r.URL.Scheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	}
+	if len(session) > 0 {
+		cookie.Expires = time.Now().Add(OwnerSessionLifetime)
+	} else {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// redirectMy redirects to /my, showing the message given by done, as
+// in myMessages.
+func redirectMy(w http.ResponseWriter, r *http.Request, done string) {
+	target := Conf.Web.Prefix + "/my"
+	if len(done) > 0 {
+		target += "?done=" + done
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// HandleMy serves the owner dashboard at /my, where owners can sign in
+// by an emailed link, rather than keeping track of an edit token for
+// each node. Once signed in, an owner sees every one of their local
+// nodes, of any status, with its status history and open connection
+// requests, and can edit them and choose which emails they receive.
+//
+// A GET with `login` uses up a login link and starts a session, which
+// is kept in a cookie. Forms are posted to /my with an `action` of
+// "login", which emails a link to the given `email`, or, once signed
+// in, "edit", "preferences", or "logout".
+func HandleMy(w http.ResponseWriter, r *http.Request) {
+	db := Db.WithContext(r.Context())
+	page := &myPage{Conf: Conf, ReadOnly: Db.ReadOnly}
+	status := http.StatusOK
+
+	var session string
+	if cookie, err := r.Cookie(OwnerSessionCookie); err == nil {
+		session = cookie.Value
+	}
+
+	if r.Method == "GET" {
+		if login := r.FormValue("login"); len(login) > 0 {
+			started, _, err := db.StartOwnerSession(login)
+			if err == nil {
+				setOwnerCookie(w, r, started)
+				redirectMy(w, r, "")
+				return
+			} else if err != sql.ErrNoRows {
+				dbLog.Request(r).Errf("Error starting owner session: %s", err)
+			}
+			page.Error = "my.error.link"
+			status = http.StatusBadRequest
+		}
+		page.Message = myMessages[r.FormValue("done")]
+	} else if r.Method == "POST" {
+		if action := r.FormValue("action"); action == "login" {
+			if err := requestOwnerLogin(r); err != nil {
+				page.Error = err.Error()
+				status = http.StatusBadRequest
+			} else {
+				redirectMy(w, r, "sent")
+				return
+			}
+		} else {
+			email := SignedInOwner(r)
+			if len(email) == 0 || !hmac.Equal([]byte(r.FormValue("csrf")),
+				[]byte(ownerCSRF(session))) {
+				http.Error(w, http.StatusText(http.StatusForbidden),
+					http.StatusForbidden)
+				return
+			}
+			done, err := ownerAction(r, action, email, session)
+			if err == nil {
+				if action == "logout" {
+					setOwnerCookie(w, r, "")
+				}
+				redirectMy(w, r, done)
+				return
+			}
+			page.Error = err.Error()
+			if v, ok := err.(myError); ok {
+				page.Error, page.Detail = v.key, v.detail
+			}
+			status = http.StatusBadRequest
+		}
+	} else {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	if page.Email = SignedInOwner(r); len(page.Email) > 0 {
+		page.CSRF = ownerCSRF(session)
+		if err := page.load(db); err != nil {
+			dbLog.Request(r).Errf("Error loading owner dashboard: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
+	}
+
+	lang := NegotiateLocale(r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", lang)
+	w.Header().Set("Cache-Control", "no-store")
+	for _, n := range page.Nodes {
+		n.Status = StatusText(Translations, lang, n.Node.Status)
+	}
+	w.WriteHeader(status)
+	if err := ExecuteLocalized(pages, w, "my.html", lang, page); err != nil {
+		l.Errf("Error executing owner dashboard template: %s", err)
+	}
+}
+
+// load fills the page with the nodes, status histories, connection
+// requests, and preferences of the owner who is signed in.
+func (page *myPage) load(db DB) (err error) {
+	nodes, err := db.OwnerNodes(page.Email)
+	if err != nil {
+		return
+	}
+	requests, err := db.OpenConnectionRequests()
+	if err != nil {
+		return
+	}
+	for _, node := range nodes {
+		n := &myNode{
+			Node:    node,
+			Active:  node.Status&StatusActive != 0,
+			Name:    html.UnescapeString(node.OwnerName),
+			Contact: html.UnescapeString(node.Contact),
+			Details: html.UnescapeString(node.Details),
+		}
+		if n.History, err = db.StatusHistory(node.Addr); err != nil {
+			return
+		}
+		for _, c := range requests {
+			if c.Target.String() == node.Addr.String() {
+				n.Requests = append(n.Requests, c)
+			}
+		}
+		// Never display the stored form of the owner's email address.
+		node.OwnerEmail = ""
+		page.Nodes = append(page.Nodes, n)
+	}
+	page.Preferences, err = db.OwnerPreferences(page.Email)
+	return
+}
+
+// myError is an error shown on /my, as the key of its translation,
+// with an untranslated detail, such as the error of a validator.
+type myError struct {
+	key, detail string
+}
+
+func (e myError) Error() string {
+	return e.key
+}
+
+// requestOwnerLogin emails a login link to /my to the `email` of the
+// request, if it owns any local nodes. The response is the same either
+// way, so that it can't be used to find out who owns nodes.
+func requestOwnerLogin(r *http.Request) error {
+	if Db.ReadOnly {
+		return myError{key: "my.error.read_only"}
+	}
+	email := strings.TrimSpace(r.FormValue("email"))
+	if !EmailRegexp.MatchString(email) {
+		return myError{key: "my.error.email"}
+	}
+	if !ownerLoginLimiter.Allow(r.RemoteAddr) {
+		return myError{key: "my.error.rate_limited"}
+	}
+	if Conf.SMTP == nil {
+		mailLog.Request(r).Err(SMTPDisabledError)
+		return myError{key: "my.error.internal"}
+	}
+
+	db := Db.WithContext(r.Context())
+	nodes, err := db.OwnerNodes(email)
+	if err != nil {
+		dbLog.Request(r).Errf("Error finding nodes of owner: %s", err)
+		return myError{key: "my.error.internal"}
+	} else if len(nodes) == 0 {
+		return nil
+	}
+	token, err := db.AddOwnerLogin(email)
+	if err != nil {
+		dbLog.Request(r).Errf("Error adding owner login: %s", err)
+		return myError{key: "my.error.internal"}
+	}
+
+	locale := NegotiateLocale(r)
+	e := &Email{
+		To:      email,
+		From:    Conf.SMTP.EmailAddress,
+		Subject: Translations.Translate(locale, "email.my_login.subject", Conf.Name),
+		Locale:  locale,
+	}
+	e.Data = map[string]interface{}{
+		"Name":       Conf.Name,
+		"Link":       BaseURL(r),
+		"Token":      token,
+		"Nodes":      len(nodes),
+		"Expiration": time.Duration(Conf.VerificationExpiration).String(),
+		"Boundary":   rand.Int31(),
+	}
+	if err = e.Queue("my_login.txt"); err != nil {
+		mailLog.Request(r).Errf("Error sending owner login link: %s", err)
+		return myError{key: "my.error.internal"}
+	}
+	return nil
+}
+
+// ownerAction performs one of the actions of a signed-in owner on /my,
+// and returns the message to show once it is done, as in myMessages.
+func ownerAction(r *http.Request, action, email, session string) (
+	done string, err error) {
+	db := Db.WithContext(r.Context())
+	switch action {
+	case "logout":
+		if err = db.EndOwnerSession(session); err != nil {
+			dbLog.Request(r).Errf("Error ending owner session: %s", err)
+			return "", myError{key: "my.error.internal"}
+		}
+		return "signed_out", nil
+	case "preferences":
+		if Db.ReadOnly {
+			return "", myError{key: "my.error.read_only"}
+		}
+		p := OwnerPreferences{
+			Alerts:      len(r.FormValue("alerts")) > 0,
+			Comments:    len(r.FormValue("comments")) > 0,
+			Connections: len(r.FormValue("connections")) > 0,
+		}
+		if err = db.SetOwnerPreferences(email, p); err != nil {
+			dbLog.Request(r).Errf("Error setting owner preferences: %s", err)
+			return "", myError{key: "my.error.internal"}
+		}
+		return "preferences", nil
+	case "edit":
+		return "saved", editOwnerNode(r, email)
+	}
+	return "", myError{key: "my.error.action"}
+}
+
+// editOwnerNode changes the `name`, `contact`, `details`, and whether
+// the node with the given `address` is `active`, as PostUpdateNode
+// does, if it belongs to the owner with the given email address.
+func editOwnerNode(r *http.Request, email string) error {
+	if Db.ReadOnly {
+		return myError{key: "my.error.read_only"}
+	}
+	db := Db.WithContext(r.Context())
+	ip := ParseIP(r.FormValue("address"))
+	if ip == nil {
+		return myError{key: "my.error.node"}
+	}
+	if ok, err := db.OwnsNode(ip, email); err != nil {
+		dbLog.Request(r).Errf("Error checking owner of %q: %s", ip, err)
+		return myError{key: "my.error.internal"}
+	} else if !ok {
+		return myError{key: "my.error.node"}
+	}
+	node, err := db.GetLocalNode(ip)
+	if err == LocalNodeNotFoundError {
+		return myError{key: "my.error.node"}
+	} else if err != nil {
+		dbLog.Request(r).Errf("Error getting node %q: %s", ip, err)
+		return myError{key: "my.error.internal"}
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	contact := strings.TrimSpace(r.FormValue("contact"))
+	details := r.FormValue("details")
+
+	// The fields are held to the same limits as through the API, which
+	// apply to them once they are escaped, as they are stored.
+	values := map[string]string{
+		"name":    name,
+		"contact": contact,
+		"details": details,
+	}
+	for _, f := range NodeSchema(NodeUpdate) {
+		if value, ok := values[f.Name]; ok {
+			if e := f.check(value, false); len(e) > 0 {
+				return myError{key: "my.error.invalid", detail: e}
+			}
+		}
+	}
+	node.OwnerName = html.EscapeString(name)
+	node.Contact = html.EscapeString(contact)
+	node.Details = html.EscapeString(details)
+	if len(r.FormValue("active")) > 0 {
+		node.Status |= StatusActive
+	} else {
+		node.Status &^= StatusActive
+	}
+	if err = ValidateNode(node); err != nil {
+		return myError{key: "my.error.invalid", detail: err.Error()}
+	}
+
+	version, _ := strconv.ParseInt(r.FormValue("version"), 10, 64)
+	if err = db.UpdateNode(node, version); err == VersionConflictError {
+		return myError{key: "my.error.conflict"}
+	} else if err != nil {
+		dbLog.Request(r).Errf("Error updating node %q: %s", ip, err)
+		return myError{key: "my.error.internal"}
+	}
+	dbLog.Request(r).Infof("Node %q updated by its owner at /my\n", ip)
+	return nil
+}
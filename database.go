@@ -5,6 +5,7 @@ package main
 
 import (
 	_ "code.google.com/p/go-sqlite/go1/sqlite3"
+	"context"
 	"database/sql"
 	"errors"
 	_ "github.com/go-sql-driver/mysql"
@@ -19,6 +20,64 @@ type DB struct {
 	*sql.DB
 	DriverName string
 	ReadOnly   bool
+
+	// Replica, if it is not nil, is a read replica of the database,
+	// from which nodes are read. See Conf.Database.ReplicaResource.
+	Replica *sql.DB
+
+	// ctx is the context of every query, as set by WithContext.
+	ctx context.Context
+}
+
+// reader returns a copy of the database which reads from the replica,
+// if there is one, for reads which may lag behind changes.
+func (db DB) reader() DB {
+	if db.Replica != nil {
+		db.DB = db.Replica
+	}
+	return db
+}
+
+// WithContext returns a copy of the database whose queries are
+// cancelled when ctx is, such as when the client of a request
+// disconnects. Every method of the copy uses ctx.
+func (db DB) WithContext(ctx context.Context) DB {
+	db.ctx = ctx
+	return db
+}
+
+// Context returns the context of the database's queries, which is
+// serverContext, cancelled when the server shuts down, unless another
+// was given to WithContext.
+func (db DB) Context() context.Context {
+	if db.ctx != nil {
+		return db.ctx
+	}
+	return serverContext
+}
+
+// Query executes a query which returns rows, as sql.DB.Query does, but
+// within the database's Context.
+func (db DB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.QueryContext(db.Context(), query, args...)
+}
+
+// QueryRow executes a query which returns at most one row, as
+// sql.DB.QueryRow does, but within the database's Context.
+func (db DB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRowContext(db.Context(), query, args...)
+}
+
+// Prepare creates a prepared statement, as sql.DB.Prepare does, but
+// within the database's Context.
+func (db DB) Prepare(query string) (*sql.Stmt, error) {
+	return db.DB.PrepareContext(db.Context(), query)
+}
+
+// Begin starts a transaction, as sql.DB.Begin does, which is rolled
+// back if the database's Context is cancelled before it is committed.
+func (db DB) Begin() (*sql.Tx, error) {
+	return db.DB.BeginTx(db.Context(), nil)
 }
 
 // InitializeTables issues the commands to create all tables and
@@ -26,7 +85,7 @@ type DB struct {
 // it encounters an error, it is returned.
 func (db DB) InitializeTables() (err error) {
 	// First, create the 'nodes' table.
-	_, err = db.Query(`CREATE TABLE IF NOT EXISTS nodes (
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS nodes (
 address BINARY(16) PRIMARY KEY,
 owner VARCHAR(255) NOT NULL,
 email VARCHAR(255) NOT NULL,
@@ -36,11 +95,39 @@ pgp BINARY(8),
 lat FLOAT NOT NULL,
 lon FLOAT NOT NULL,
 status INT NOT NULL,
-updated INT NOT NULL);`)
+updated INT NOT NULL,
+neighborhood VARCHAR(255),
+map_id VARCHAR(32) NOT NULL DEFAULT '',
+version INT NOT NULL DEFAULT 1,
+created_at INT NOT NULL DEFAULT 0,
+updated_at INT NOT NULL DEFAULT 0);`)
+	if err != nil {
+		return
+	}
+	// Add any columns which were introduced after the table was
+	// first created.
+	err = db.ensureColumn("nodes", "neighborhood", "VARCHAR(255)")
+	if err != nil {
+		return
+	}
+	err = db.ensureColumn("nodes", "map_id",
+		"VARCHAR(32) NOT NULL DEFAULT ''")
+	if err != nil {
+		return
+	}
+	err = db.ensureColumn("nodes", "version", "INT NOT NULL DEFAULT 1")
+	if err != nil {
+		return
+	}
+	err = db.ensureColumn("nodes", "created_at", "INT NOT NULL DEFAULT 0")
+	if err != nil {
+		return
+	}
+	err = db.ensureColumn("nodes", "updated_at", "INT NOT NULL DEFAULT 0")
 	if err != nil {
 		return
 	}
-	_, err = db.Query(`CREATE TABLE IF NOT EXISTS nodes_cached (
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS nodes_cached (
 address BINARY(16) PRIMARY KEY,
 owner VARCHAR(255) NOT NULL,
 details VARCHAR(255),
@@ -48,11 +135,42 @@ lat FLOAT NOT NULL,
 lon FLOAT NOT NULL,
 status INT NOT NULL,
 source INT NOT NULL,
-retrieved INT NOT NULL);`)
+retrieved INT NOT NULL,
+map_id VARCHAR(32) NOT NULL DEFAULT '',
+via VARCHAR(255) NOT NULL DEFAULT '',
+created_at INT NOT NULL DEFAULT 0,
+updated_at INT NOT NULL DEFAULT 0);`)
+	if err != nil {
+		return
+	}
+	err = db.ensureColumn("nodes_cached", "map_id",
+		"VARCHAR(32) NOT NULL DEFAULT ''")
+	if err != nil {
+		return
+	}
+	err = db.ensureColumn("nodes_cached", "via",
+		"VARCHAR(255) NOT NULL DEFAULT ''")
+	if err != nil {
+		return
+	}
+	err = db.ensureColumn("nodes_cached", "created_at",
+		"INT NOT NULL DEFAULT 0")
+	if err != nil {
+		return
+	}
+	err = db.ensureColumn("nodes_cached", "updated_at",
+		"INT NOT NULL DEFAULT 0")
 	if err != nil {
 		return
 	}
-	_, err = db.Query(`CREATE TABLE IF NOT EXISTS nodes_verify_queue (
+	// Each source may only have one node with each address, so that
+	// nodes can be replaced by later retrievals.
+	err = db.ensureUniqueIndex("nodes_cached_address_source",
+		"nodes_cached", "address, source")
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS nodes_verify_queue (
 id INT PRIMARY KEY,
 address BINARY(16) NOT NULL,
 owner VARCHAR(255) NOT NULL,
@@ -64,18 +182,29 @@ lat FLOAT NOT NULL,
 lon FLOAT NOT NULL,
 status INT NOT NULL,
 verifysent BOOL NOT NULL,
-expiration INT NOT NULL);`)
+expiration INT NOT NULL,
+map_id VARCHAR(32) NOT NULL DEFAULT '');`)
+	if err != nil {
+		return
+	}
+	err = db.ensureColumn("nodes_verify_queue", "map_id",
+		"VARCHAR(32) NOT NULL DEFAULT ''")
+	if err != nil {
+		return
+	}
+	err = db.ensureColumn("nodes_verify_queue", "source",
+		"INT NOT NULL DEFAULT 0")
 	if err != nil {
 		return
 	}
 	// <mysql> SQL? A standard? Hahahaha!
 	if db.DriverName == "mysql" {
-		_, err = db.Query(`CREATE TABLE IF NOT EXISTS cached_maps (
+		_, err = db.Exec(`CREATE TABLE IF NOT EXISTS cached_maps (
 id INTEGER PRIMARY KEY AUTO_INCREMENT,
 hostname VARCHAR(255) NOT NULL,
 name VARCHAR(255) NOT NULL);`)
 	} else {
-		_, err = db.Query(`CREATE TABLE IF NOT EXISTS cached_maps (
+		_, err = db.Exec(`CREATE TABLE IF NOT EXISTS cached_maps (
 id INTEGER PRIMARY KEY AUTOINCREMENT,
 hostname VARCHAR(255) NOT NULL,
 name VARCHAR(255) NOT NULL);`)
@@ -84,7 +213,413 @@ name VARCHAR(255) NOT NULL);`)
 		return
 	}
 
-	_, err = db.Query(`CREATE TABLE IF NOT EXISTS captcha (
+	// Child maps which register themselves are recorded in
+	// cached_maps, pending approval.
+	err = db.ensureColumn("cached_maps", "registration",
+		"INT NOT NULL DEFAULT 0")
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS status_history (
+address BINARY(16) NOT NULL,
+status INT NOT NULL,
+changed INT NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	// Nodes which were added before their times were recorded are
+	// given the times of their first and last changes of status,
+	// which are the best that is known.
+	_, err = db.Exec(`UPDATE nodes
+SET created_at = COALESCE((SELECT MIN(changed) FROM status_history
+	WHERE status_history.address = nodes.address), 0),
+updated_at = COALESCE((SELECT MAX(changed) FROM status_history
+	WHERE status_history.address = nodes.address), 0),
+version = version + 1
+WHERE created_at = 0;`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS short_links (
+id VARCHAR(16) PRIMARY KEY,
+address BINARY(16) NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS photos (
+id VARCHAR(32) PRIMARY KEY,
+address BINARY(16) NOT NULL,
+type VARCHAR(32) NOT NULL,
+caption VARCHAR(255),
+uploaded INT NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS comments (
+id BIGINT PRIMARY KEY,
+address BINARY(16) NOT NULL,
+author VARCHAR(255) NOT NULL,
+email VARCHAR(255) NOT NULL,
+body TEXT NOT NULL,
+created INT NOT NULL,
+state INT NOT NULL,
+expiration INT NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS connection_requests (
+id BIGINT PRIMARY KEY,
+address BINARY(16) NOT NULL,
+name VARCHAR(255) NOT NULL,
+email VARCHAR(255) NOT NULL,
+contact VARCHAR(255),
+lat FLOAT NOT NULL,
+lon FLOAT NOT NULL,
+message TEXT,
+created INT NOT NULL,
+closed BOOL NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS volunteer_availability (
+id BIGINT PRIMARY KEY,
+name VARCHAR(255) NOT NULL,
+email VARCHAR(255) NOT NULL,
+starts INT NOT NULL,
+ends INT NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS installs (
+id BIGINT PRIMARY KEY,
+address BINARY(16) NOT NULL,
+starts INT NOT NULL,
+ends INT NOT NULL,
+notes TEXT,
+created INT NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS install_invitees (
+id BIGINT PRIMARY KEY,
+install BIGINT NOT NULL,
+email VARCHAR(255) NOT NULL,
+confirmed BOOL NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS equipment (
+id BIGINT PRIMARY KEY,
+model VARCHAR(255) NOT NULL,
+mac VARCHAR(17),
+serial VARCHAR(255),
+purchased INT,
+org VARCHAR(255),
+address BINARY(16),
+notes TEXT);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS surveys (
+id BIGINT PRIMARY KEY,
+lat FLOAT NOT NULL,
+lon FLOAT NOT NULL,
+name VARCHAR(255),
+notes TEXT,
+visible TEXT,
+created INT NOT NULL,
+converted BINARY(16));`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS survey_photos (
+id VARCHAR(32) PRIMARY KEY,
+survey BIGINT NOT NULL,
+type VARCHAR(32) NOT NULL,
+caption VARCHAR(255),
+uploaded INT NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS interest_points (
+id BIGINT PRIMARY KEY,
+name VARCHAR(255),
+email VARCHAR(255) NOT NULL,
+lat FLOAT NOT NULL,
+lon FLOAT NOT NULL,
+created INT NOT NULL,
+notified BINARY(16));`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS interfaces (
+mac VARCHAR(17) PRIMARY KEY,
+address BINARY(16) NOT NULL,
+kind VARCHAR(8) NOT NULL,
+name VARCHAR(255),
+ip BINARY(16),
+band VARCHAR(255),
+ssid VARCHAR(255),
+mode VARCHAR(255),
+channel INT NOT NULL DEFAULT 0,
+azimuth FLOAT,
+beamwidth FLOAT NOT NULL DEFAULT 0);`)
+	if err != nil {
+		return
+	}
+	err = db.ensureColumn("interfaces", "channel", "INT NOT NULL DEFAULT 0")
+	if err != nil {
+		return
+	}
+	err = db.ensureColumn("interfaces", "azimuth", "FLOAT")
+	if err != nil {
+		return
+	}
+	err = db.ensureColumn("interfaces", "beamwidth",
+		"FLOAT NOT NULL DEFAULT 0")
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS coverage (
+address BINARY(16) PRIMARY KEY,
+geometry TEXT NOT NULL,
+source VARCHAR(16) NOT NULL,
+updated INT NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS edit_tokens (
+address BINARY(16) PRIMARY KEY,
+token BIGINT NOT NULL DEFAULT 0,
+hash VARCHAR(64) NOT NULL DEFAULT '');`)
+	if err != nil {
+		return
+	}
+	err = db.ensureColumn("edit_tokens", "hash",
+		"VARCHAR(64) NOT NULL DEFAULT ''")
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS transfers (
+id BIGINT PRIMARY KEY,
+address BINARY(16) NOT NULL,
+email VARCHAR(255) NOT NULL,
+owner VARCHAR(255),
+expiration INT NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS audit_log (
+address BINARY(16) NOT NULL,
+time INT NOT NULL,
+action VARCHAR(32) NOT NULL,
+actor VARCHAR(255) NOT NULL,
+details TEXT);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS node_heartbeats (
+address BINARY(16) PRIMARY KEY,
+secret BIGINT NOT NULL DEFAULT 0,
+last INT NOT NULL,
+uptime BIGINT,
+firmware VARCHAR(255),
+clients INT,
+key_hash VARCHAR(64) NOT NULL DEFAULT '');`)
+	if err != nil {
+		return
+	}
+	err = db.ensureColumn("node_heartbeats", "key_hash",
+		"VARCHAR(64) NOT NULL DEFAULT ''")
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS alerts (
+address BINARY(16) PRIMARY KEY,
+muted INT NOT NULL,
+alerted INT NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS tickets (
+address BINARY(16) PRIMARY KEY,
+ticket VARCHAR(255) NOT NULL,
+status VARCHAR(255) NOT NULL,
+closed BOOL NOT NULL,
+opened INT NOT NULL,
+updated INT NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS snmp_targets (
+address BINARY(16) PRIMARY KEY,
+version VARCHAR(2) NOT NULL,
+community VARCHAR(255),
+username VARCHAR(255),
+auth_protocol VARCHAR(3),
+auth_pass VARCHAR(255),
+priv_protocol VARCHAR(3),
+priv_pass VARCHAR(255),
+interface INT NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS metrics (
+address BINARY(16) NOT NULL,
+time INT NOT NULL,
+in_octets BIGINT NOT NULL,
+out_octets BIGINT NOT NULL,
+clients INT);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS links (
+source BINARY(16) NOT NULL,
+target BINARY(16) NOT NULL,
+origin VARCHAR(16) NOT NULL,
+metric FLOAT NOT NULL,
+distance FLOAT NOT NULL DEFAULT 0,
+updated INT NOT NULL);`)
+	if err != nil {
+		return
+	}
+	err = db.ensureColumn("links", "distance", "FLOAT NOT NULL DEFAULT 0")
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS node_elevations (
+address BINARY(16) PRIMARY KEY,
+meters FLOAT NOT NULL,
+updated INT NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS leases (
+name VARCHAR(32) PRIMARY KEY,
+holder VARCHAR(255) NOT NULL,
+expires INT NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS node_generation (
+id INT PRIMARY KEY,
+generation BIGINT NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS task_queue (
+id BIGINT PRIMARY KEY,
+kind VARCHAR(32) NOT NULL,
+payload TEXT NOT NULL,
+state VARCHAR(8) NOT NULL,
+attempts INT NOT NULL,
+error TEXT,
+created INT NOT NULL,
+run_at INT NOT NULL,
+claimed_by VARCHAR(255) NOT NULL DEFAULT '',
+claimed_at INT NOT NULL DEFAULT 0);`)
+	if err != nil {
+		return
+	}
+	err = db.ensureColumn("task_queue", "claimed_by",
+		"VARCHAR(255) NOT NULL DEFAULT ''")
+	if err != nil {
+		return
+	}
+	err = db.ensureColumn("task_queue", "claimed_at",
+		"INT NOT NULL DEFAULT 0")
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS map_fetches (
+hostname VARCHAR(255) PRIMARY KEY,
+attempted INT NOT NULL,
+succeeded INT NOT NULL,
+latency INT NOT NULL,
+nodes INT NOT NULL,
+error VARCHAR(255) NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS address_reservations (
+address BINARY(16) PRIMARY KEY,
+holder VARCHAR(255) NOT NULL,
+expires INT NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS adoptions (
+address BINARY(16) PRIMARY KEY,
+source INT NOT NULL,
+adopted INT NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS source_rules (
+pattern VARCHAR(255) PRIMARY KEY,
+allow BOOL NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS owner_logins (
+id VARCHAR(64) PRIMARY KEY,
+email VARCHAR(255) NOT NULL,
+expiration INT NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS owner_sessions (
+id VARCHAR(64) PRIMARY KEY,
+email VARCHAR(255) NOT NULL,
+expiration INT NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS owner_preferences (
+email VARCHAR(255) PRIMARY KEY,
+alerts BOOL NOT NULL,
+comments BOOL NOT NULL,
+connections BOOL NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS captcha (
 id BINARY(32) NOT NULL,
 solution BINARY(6) NOT NULL,
 expiration INT NOT NULL);`)
@@ -95,75 +630,190 @@ expiration INT NOT NULL);`)
 	return
 }
 
+// ensureColumn adds a column with the given definition to the table,
+// unless it already exists, so that databases created by older
+// versions can be upgraded in place.
+func (db DB) ensureColumn(table, column, definition string) (err error) {
+	rows, err := db.Query("SELECT " + column + " FROM " + table + " LIMIT 0;")
+	if err == nil {
+		return rows.Close()
+	}
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " +
+		column + " " + definition + ";")
+	return
+}
+
+// ensureUniqueIndex creates a unique index with the given name on the
+// given columns of the table, if it does not already exist.
+func (db DB) ensureUniqueIndex(name, table, columns string) (err error) {
+	if db.DriverName != "mysql" {
+		_, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS " + name +
+			" ON " + table + " (" + columns + ");")
+		return
+	}
+
+	// MySQL does not support IF NOT EXISTS for indexes.
+	rows, err := db.Query("SHOW INDEX FROM "+table+" WHERE Key_name = ?;",
+		name)
+	if err != nil {
+		return
+	}
+	exists := rows.Next()
+	if err = rows.Close(); err != nil || exists {
+		return
+	}
+	_, err = db.Exec("CREATE UNIQUE INDEX " + name +
+		" ON " + table + " (" + columns + ");")
+	return
+}
+
 // LenNodes returns the number of nodes in the database. If there is
 // an error, it returns -1 and logs the incident.
 func (db DB) LenNodes(useCached bool) (n int) {
 	// Count the number of rows in the 'nodes' table.
 	var row *sql.Row
 	if useCached {
-		row = db.QueryRow("SELECT COUNT(*) FROM (SELECT address FROM nodes UNION SELECT address FROM nodes_cached) AS cachedNodes;")
+		row = db.reader().QueryRow("SELECT COUNT(*) FROM (SELECT address FROM nodes UNION SELECT address FROM nodes_cached) AS cachedNodes;")
 	} else {
-		row = db.QueryRow("SELECT COUNT(*) FROM nodes;")
+		row = db.reader().QueryRow("SELECT COUNT(*) FROM nodes;")
 	}
 	// Write that number to n, and return if there is no
 	// error. Otherwise, log it and return zero.
 	if err := row.Scan(&n); err != nil {
-		l.Errf("Error counting the number of nodes: %s", err)
+		dbLog.Errf("Error counting the number of nodes: %s", err)
 		n = -1
 	}
 	return
 }
 
 // DumpNodes returns an array containing all nodes in the database,
-// including both local and cached nodes.
+// including both local and cached nodes. If several nodes have the
+// same address, only one is included, as by Conf.DuplicatePolicy.
 func (db DB) DumpNodes() (nodes []*Node, err error) {
-	// Begin by getting the required length of the array. If we get
+	return db.DumpNodesMatching(nil)
+}
+
+// DumpNodesMatching returns the nodes of DumpNodes which are selected
+// by the filter. Duplicates are collapsed among the selected nodes
+// only.
+func (db DB) DumpNodesMatching(f *NodeFilter) (nodes []*Node, err error) {
+	// Begin by getting the required capacity of the array. If we get
 	// -1, then there has been an error.
-	if n := db.LenNodes(true); n != -1 {
-		// If successful, initialize the array with the length.
-		nodes = make([]*Node, n)
+	if f != nil {
+		nodes = make([]*Node, 0)
+	} else if n := db.LenNodes(true); n != -1 {
+		// If successful, initialize the array with the capacity.
+		nodes = make([]*Node, 0, n)
 	} else {
 		// Otherwise, error out.
-		l.Errf("Could not count number of nodes in database\n")
+		dbLog.Errf("Could not count number of nodes in database\n")
 		return nil, errors.New("Could not count number of nodes")
 	}
 
 	// Perform the query.
-	rows, err := db.Query(`
-SELECT address,owner,contact,details,pgp,lat,lon,status,0
-FROM nodes
-UNION SELECT address,owner,"",details,"",lat,lon,status,source
-FROM nodes_cached;`)
+	local, args := f.where(false)
+	cached, cachedArgs := f.where(true)
+	rows, err := db.reader().Query(`
+SELECT address,owner,contact,details,pgp,lat,lon,status,0,"",neighborhood,
+map_id,created_at,updated_at
+FROM nodes `+local+`
+UNION SELECT address,owner,"",details,"",lat,lon,status,source,via,"",map_id,
+created_at,updated_at
+FROM nodes_cached `+cached+`;`, append(args, cachedArgs...)...)
 	if err != nil {
-		l.Errf("Error dumping database: %s", err)
+		dbLog.Errf("Error dumping database: %s", err)
 		return
 	}
 	defer rows.Close()
 
 	// Now, loop through, initialize the nodes, and fill them out
 	// using only the selected columns.
-	for i := 0; rows.Next(); i++ {
+	for rows.Next() {
 		// Initialize the node and put it in the table.
 		node := new(Node)
-		nodes[i] = node
+		nodes = append(nodes, node)
 
 		// Create temporary values to simplify scanning.
 		contact := sql.NullString{}
 		details := sql.NullString{}
+		neighborhood := sql.NullString{}
 
 		// Scan all of the values into it.
 		err = rows.Scan(&node.Addr, &node.OwnerName,
 			&contact, &details, &node.PGP,
-			&node.Latitude, &node.Longitude, &node.Status, &node.SourceID)
+			&node.Latitude, &node.Longitude, &node.Status, &node.SourceID,
+			&node.Via, &neighborhood, &node.MapID,
+			&node.CreateTime, &node.UpdateTime)
 		if err != nil {
-			l.Errf("Error dumping database: %s", err)
+			dbLog.Errf("Error dumping database: %s", err)
 			return
 		}
 
 		node.Contact = contact.String
 		node.Details = details.String
+		node.Neighborhood = neighborhood.String
 	}
-	return
+	return collapseDuplicates(nodes), nil
+}
+
+// EachNode calls fn with each of the nodes of DumpNodesMatching in
+// turn, as they are read, so that they need not all be held at once.
+// Nodes with the same address are collapsed by the database rather
+// than in memory. If fn returns an error, EachNode stops and returns
+// it.
+func (db DB) EachNode(f *NodeFilter, fn func(*Node) error) (err error) {
+	// Leave out whichever of the selected local and cached nodes with
+	// the same address the policy does not prefer, as
+	// collapseDuplicates does.
+	local, localArgs := f.where(false)
+	cached, cachedArgs := f.where(true)
+	args := make([]interface{}, 0, 2*len(localArgs)+2*len(cachedArgs))
+	if Conf.DuplicatePolicy == DuplicatesNewest {
+		args = append(append(append(args, cachedArgs...),
+			localArgs...), cachedArgs...)
+		local, _ = f.where(false,
+			"address NOT IN (SELECT address FROM nodes_cached "+cached+")")
+	} else {
+		args = append(append(append(args, localArgs...),
+			localArgs...), cachedArgs...)
+		cached, _ = f.where(true,
+			"address NOT IN (SELECT address FROM nodes "+local+")")
+	}
+
+	rows, err := db.reader().Query(`
+SELECT address,owner,contact,details,pgp,lat,lon,status,0,"",neighborhood,
+map_id,created_at,updated_at
+FROM nodes `+local+`
+UNION ALL SELECT address,owner,"",details,"",lat,lon,status,source,via,"",
+map_id,created_at,updated_at
+FROM nodes_cached `+cached+`;`, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		node := new(Node)
+		contact := sql.NullString{}
+		details := sql.NullString{}
+		neighborhood := sql.NullString{}
+		err = rows.Scan(&node.Addr, &node.OwnerName,
+			&contact, &details, &node.PGP,
+			&node.Latitude, &node.Longitude, &node.Status, &node.SourceID,
+			&node.Via, &neighborhood, &node.MapID,
+			&node.CreateTime, &node.UpdateTime)
+		if err != nil {
+			return
+		}
+		node.Contact = contact.String
+		node.Details = details.String
+		node.Neighborhood = neighborhood.String
+
+		if err = fn(node); err != nil {
+			return
+		}
+	}
+	return rows.Err()
 }
 
 // DumpLocal returns a slice containing all of the local nodes in the
@@ -176,16 +826,17 @@ func (db DB) DumpLocal() (nodes []*Node, err error) {
 		nodes = make([]*Node, n)
 	} else {
 		// Otherwise, error out.
-		l.Errf("Could not count number of nodes in database\n")
+		dbLog.Errf("Could not count number of nodes in database\n")
 		return nil, errors.New("Could not count number of nodes")
 	}
 
 	// Perform the query.
-	rows, err := db.Query(`
-SELECT address,owner,contact,details,pgp,lat,lon,status
+	rows, err := db.reader().Query(`
+SELECT address,owner,contact,details,pgp,lat,lon,status,neighborhood,map_id,
+created_at,updated_at
 FROM nodes;`)
 	if err != nil {
-		l.Errf("Error dumping database: %s", err)
+		dbLog.Errf("Error dumping database: %s", err)
 		return
 	}
 	defer rows.Close()
@@ -200,31 +851,42 @@ FROM nodes;`)
 		// Create temporary values to simplify scanning.
 		contact := sql.NullString{}
 		details := sql.NullString{}
+		neighborhood := sql.NullString{}
 
 		// Scan all of the values into it.
 		err = rows.Scan(&node.Addr, &node.OwnerName,
 			&contact, &details, &node.PGP,
-			&node.Latitude, &node.Longitude, &node.Status)
+			&node.Latitude, &node.Longitude, &node.Status,
+			&neighborhood, &node.MapID, &node.CreateTime, &node.UpdateTime)
 		if err != nil {
-			l.Errf("Error dumping database: %s", err)
+			dbLog.Errf("Error dumping database: %s", err)
 			return
 		}
 
 		node.Contact = contact.String
 		node.Details = details.String
+		node.Neighborhood = neighborhood.String
 	}
 	return
 }
 
 // DumpChanges returns all nodes, both local and cached, which have
-// been updated or retrieved more recently than the given time.
-func (db DB) DumpChanges(time time.Time) (nodes []*Node, err error) {
-	rows, err := db.Query(`
-SELECT address,owner,contact,details,pgp,lat,lon,status
-FROM nodes WHERE updated >= ?
+// been updated or retrieved more recently than the given time, and
+// which are selected by the filter, if it is not nil.
+func (db DB) DumpChanges(time time.Time, f *NodeFilter) (nodes []*Node,
+	err error) {
+	local, localArgs := f.where(false, "updated_at >= ?")
+	cached, cachedArgs := f.where(true, "retrieved >= ?")
+	args := append(append([]interface{}{time.Unix()}, localArgs...),
+		time.Unix())
+	rows, err := db.reader().Query(`
+SELECT address,owner,contact,details,pgp,lat,lon,status,0,"",neighborhood,
+map_id,created_at,updated_at
+FROM nodes `+local+`
 UNION
-SELECT address,owner,"",details,"",lat,lon,status
-FROM nodes_cached WHERE retrieved >= ?;`, time, time)
+SELECT address,owner,"",details,"",lat,lon,status,source,via,"",map_id,
+created_at,updated_at
+FROM nodes_cached `+cached+`;`, append(args, cachedArgs...)...)
 	if err != nil {
 		return
 	}
@@ -235,16 +897,20 @@ FROM nodes_cached WHERE retrieved >= ?;`, time, time)
 
 		contact := sql.NullString{}
 		details := sql.NullString{}
+		neighborhood := sql.NullString{}
 
 		err = rows.Scan(&node.Addr, &node.OwnerName,
 			&contact, &details, &node.PGP,
-			&node.Latitude, &node.Longitude, &node.Status)
+			&node.Latitude, &node.Longitude, &node.Status,
+			&node.SourceID, &node.Via, &neighborhood, &node.MapID,
+			&node.CreateTime, &node.UpdateTime)
 		if err != nil {
 			return
 		}
 
 		node.Contact = contact.String
 		node.Details = details.String
+		node.Neighborhood = neighborhood.String
 
 		nodes = append(nodes, node)
 	}
@@ -254,87 +920,173 @@ FROM nodes_cached WHERE retrieved >= ?;`, time, time)
 // AddNode inserts a node into the 'nodes' table with the current
 // timestamp.
 func (db DB) AddNode(node *Node) (err error) {
-	// Inserts a new node into the database
-	stmt, err := db.Prepare(`INSERT INTO nodes
-(address, owner, email, contact, details, pgp, lat, lon, status, updated)
-VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	email, err := SealEmail(node.OwnerEmail)
 	if err != nil {
 		return
 	}
-	_, err = stmt.Exec([]byte(node.Addr), node.OwnerName, node.OwnerEmail,
+
+	// Inserts a new node into the database
+	now := time.Now()
+	_, err = db.Exec(`INSERT INTO nodes
+(address, owner, email, contact, details, pgp, lat, lon, status, updated,
+map_id, created_at, updated_at)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		[]byte(node.Addr), node.OwnerName, email,
 		node.Contact, node.Details, []byte(node.PGP),
 		node.Latitude, node.Longitude, node.Status,
-		time.Now())
-	stmt.Close()
+		now, node.MapID, now.Unix(), now.Unix())
+	if err != nil {
+		return
+	}
+	node.CreateTime, node.UpdateTime = now.Unix(), now.Unix()
+	InvalidateIndexes()
+	db.recordStatus(node)
+	LocateNode(node)
+	PublishNodeEvent(node.Addr, "added", publicNode(node))
+	RunHooks(HookNodeCreated, publicNode(node))
 	return
 }
 
-func (db DB) AddNodes(nodes []*Node) (err error) {
-	stmt, err := db.Prepare(`INSERT INTO nodes
-(address, owner, email, contact, details, pgp, lat, lon, status, updated)
-VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`)
-	if err != nil {
-		return
+// recordStatus records the status of the given node in its history,
+// and logs any errors rather than returning them, because the node
+// itself has already been stored.
+func (db DB) recordStatus(node *Node) {
+	if err := db.RecordStatus(node.Addr, node.Status); err != nil {
+		dbLog.Errf("Error recording status of %q: %s", node.Addr, err)
 	}
+}
 
+func (db DB) AddNodes(nodes []*Node) (err error) {
 	for _, node := range nodes {
-		_, err = stmt.Exec([]byte(node.Addr),
-			node.OwnerName, node.OwnerEmail,
+		var email string
+		if email, err = SealEmail(node.OwnerEmail); err != nil {
+			return
+		}
+		now := time.Now()
+		_, err = db.Exec(`INSERT INTO nodes
+(address, owner, email, contact, details, pgp, lat, lon, status, updated,
+map_id, created_at, updated_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`, []byte(node.Addr),
+			node.OwnerName, email,
 			node.Contact, node.Details, []byte(node.PGP),
 			node.Latitude, node.Longitude, node.Status,
-			time.Now())
+			now, node.MapID, now.Unix(), now.Unix())
 		if err != nil {
 			return
 		}
+		db.recordStatus(node)
 	}
-	stmt.Close()
+	InvalidateIndexes()
 	return
 }
 
 // UpdateNode replaces the node in the database with the IP matching
-// the given node.
-func (db DB) UpdateNode(node *Node) (err error) {
+// the given node, and sets the node's Version to its new version. If
+// version is not zero, the node is only replaced if it is still at
+// that version, and otherwise VersionConflictError is returned, so
+// that changes made since it was retrieved are not lost.
+func (db DB) UpdateNode(node *Node, version int64) (err error) {
 	// Updates an existing node in the database
-	stmt, err := db.Prepare(`UPDATE nodes SET
-owner = ?, contact = ?, details = ?, pgp = ?, lat = ?, lon = ?, status = ?
-WHERE address = ?`)
+	now := time.Now().Unix()
+	res, err := db.Exec(`UPDATE nodes SET
+owner = ?, contact = ?, details = ?, pgp = ?, lat = ?, lon = ?, status = ?,
+version = version + 1, updated_at = ?
+WHERE address = ? AND (? = 0 OR version = ?)`, node.OwnerName, node.Contact,
+		node.Details, []byte(node.PGP),
+		node.Latitude, node.Longitude, node.Status, now, []byte(node.Addr),
+		version, version)
 	if err != nil {
 		return
 	}
-	_, err = stmt.Exec(node.OwnerName, node.Contact,
-		node.Details, []byte(node.PGP),
-		node.Latitude, node.Longitude, node.Status, []byte(node.Addr))
-	stmt.Close()
+	// The version always changes, so a matching node is always
+	// counted as affected, even by MySQL.
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 && version != 0 {
+		return VersionConflictError
+	} else if n == 0 {
+		return LocalNodeNotFoundError
+	}
+	err = db.QueryRow(`SELECT version FROM nodes WHERE address = ?;`,
+		[]byte(node.Addr)).Scan(&node.Version)
+	if err != nil {
+		return
+	}
+	node.UpdateTime = now
+	InvalidateIndexes()
+	db.recordStatus(node)
+	LocateNode(node)
+	PublishNodeEvent(node.Addr, "updated", publicNode(node))
+	RunHooks(HookNodeUpdated, publicNode(node))
 	return
 }
 
+// SetNeighborhood sets the name of the neighborhood of the local node
+// with the given address.
+func (db DB) SetNeighborhood(addr IP, neighborhood string) (err error) {
+	_, err = db.Exec(`UPDATE nodes SET neighborhood = ?,
+version = version + 1
+WHERE address = ?;`, neighborhood, []byte(addr))
+	if err != nil {
+		return
+	}
+	InvalidateIndexes()
+	return
+}
+
+// SetStatus sets the status of the local node with the given address,
+// and records it in the node's status history.
+func (db DB) SetStatus(addr IP, status uint32) (err error) {
+	_, err = db.Exec(`UPDATE nodes SET status = ?, version = version + 1
+WHERE address = ?;`, status, []byte(addr))
+	if err != nil {
+		return
+	}
+	InvalidateIndexes()
+	return db.RecordStatus(addr, status)
+}
+
 // DeleteNode removes the node with the matching IP from the 'nodes'
-// table in the database.
+// table in the database. If there is none, it returns
+// LocalNodeNotFoundError.
 func (db DB) DeleteNode(addr IP) (err error) {
 	// Deletes the given node from the database
-	stmt, err := db.Prepare("DELETE FROM nodes WHERE address = ?")
+	res, err := db.Exec("DELETE FROM nodes WHERE address = ?", []byte(addr))
 	if err != nil {
 		return
 	}
-	_, err = stmt.Exec([]byte(addr))
-
-	stmt.Close()
+	InvalidateIndexes()
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return LocalNodeNotFoundError
+	}
 	return
 }
 
 // GetNode retrieves a single node from the database using the given
 // address. If there is a database error, it will be returned. If no
-// node matches, however, both return values will be nil.
+// node matches, it returns NodeNotFoundError.
 func (db DB) GetNode(addr IP) (node *Node, err error) {
+	// If there are several nodes with the address, prefer the local
+	// one, as in DumpNodes(), unless the policy is otherwise.
+	order := "ASC"
+	if Conf.DuplicatePolicy == DuplicatesNewest {
+		order = "DESC"
+	}
+
 	// Retrieves the node with the given address from the database
-	stmt, err := db.Prepare(`
-SELECT owner, email, contact, details, pgp, lat, lon, status
+	stmt, err := db.reader().Prepare(`
+SELECT owner, email, contact, details, pgp, lat, lon, status, 0, "", 0,
+neighborhood, map_id, version, created_at, updated_at
 FROM nodes
 WHERE address = ?
 UNION
-SELECT owner, "", "", details, "", lat, lon, status
+SELECT owner, "", "", details, "", lat, lon, status, source, via, retrieved,
+"", map_id, 0, created_at, updated_at
 FROM nodes_cached
 WHERE address = ?
+ORDER BY 9 ` + order + `
 LIMIT 1`)
 	if err != nil {
 		return
@@ -345,23 +1097,37 @@ LIMIT 1`)
 	baddr := []byte(addr)
 	contact := sql.NullString{}
 	details := sql.NullString{}
+	neighborhood := sql.NullString{}
 
 	// Perform the actual query.
 	row := stmt.QueryRow(baddr, baddr)
 	err = row.Scan(&node.OwnerName, &node.OwnerEmail,
 		&contact, &details, &node.PGP,
-		&node.Latitude, &node.Longitude, &node.Status)
+		&node.Latitude, &node.Longitude, &node.Status,
+		&node.SourceID, &node.Via, &node.RetrieveTime, &neighborhood,
+		&node.MapID, &node.Version, &node.CreateTime, &node.UpdateTime)
 	stmt.Close()
 
 	node.Contact = contact.String
 	node.Details = details.String
+	node.Neighborhood = neighborhood.String
 
 	// If the error is of the particular type sql.ErrNoRows, it simply
-	// means that the node does not exist. In that case, return (nil,
-	// nil).
+	// means that the node does not exist.
 	if err == sql.ErrNoRows {
-		return nil, nil
+		return nil, NodeNotFoundError
 	}
 
 	return
 }
+
+// GetLocalNode retrieves the local node with the given address, as
+// with GetNode. If there is none, even if there is a cached node with
+// the address, it returns LocalNodeNotFoundError.
+func (db DB) GetLocalNode(addr IP) (*Node, error) {
+	node, err := db.GetNode(addr)
+	if err == NodeNotFoundError || err == nil && len(node.OwnerEmail) == 0 {
+		return nil, LocalNodeNotFoundError
+	}
+	return node, err
+}
@@ -0,0 +1,312 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"errors"
+	"fmt"
+	"github.com/inhies/go-log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// doctorTimeout is the length of time for which the doctor waits for
+// each remote server.
+const doctorTimeout = 10 * time.Second
+
+// schemaTables are the tables which InitializeTables creates, in the
+// same order.
+var schemaTables = []string{
+	"nodes", "nodes_cached", "nodes_verify_queue", "cached_maps",
+	"status_history", "short_links", "photos", "comments",
+	"connection_requests", "volunteer_availability", "installs",
+	"install_invitees", "equipment", "surveys", "survey_photos",
+	"interest_points", "interfaces", "coverage", "edit_tokens",
+	"transfers",
+	"audit_log", "node_heartbeats", "alerts", "tickets", "snmp_targets",
+	"metrics", "links", "node_elevations", "leases", "node_generation",
+	"task_queue",
+	"map_fetches",
+	"address_reservations",
+	"adoptions", "source_rules",
+	"owner_logins", "owner_sessions", "owner_preferences",
+	"captcha",
+}
+
+// doctor prints the results of the checks made by RunDoctor, and
+// remembers whether any failed.
+type doctor struct {
+	failed bool
+}
+
+// pass, fail, and skip print the result of the named check, with the
+// given details.
+func (d *doctor) pass(name, format string, a ...interface{}) {
+	fmt.Printf("PASS  %-12s %s\n", name, fmt.Sprintf(format, a...))
+}
+
+func (d *doctor) fail(name, format string, a ...interface{}) {
+	d.failed = true
+	fmt.Printf("FAIL  %-12s %s\n", name, fmt.Sprintf(format, a...))
+}
+
+func (d *doctor) skip(name, format string, a ...interface{}) {
+	fmt.Printf("SKIP  %-12s %s\n", name, fmt.Sprintf(format, a...))
+}
+
+// RunDoctor checks the configuration, the database, the templates, the
+// SMTP server, the child maps, and the addresses to listen on, and
+// prints whether each works, so that it is clear which is broken. It
+// returns the status with which to exit, which is 1 if any check
+// failed.
+func RunDoctor() int {
+	d := new(doctor)
+
+	// Anything logged by the functions which are checked would only
+	// obscure the report, except for errors.
+	var err error
+	if l, err = NewLogger(log.ERR, *fLogFormat, os.Stderr,
+		LogFlags); err != nil {
+		fmt.Printf("Could not start logger: %s\n", err)
+		return 1
+	}
+	apiLog = l.Component("api")
+	dbLog = l.Component("db")
+	fedLog = l.Component("federation")
+	mailLog = l.Component("mail")
+
+	if !d.checkConfig() {
+		// Nothing else can be checked without a configuration.
+		return 1
+	}
+	d.checkDatabase()
+	d.checkTemplates()
+	d.checkSMTP()
+	d.checkChildMaps()
+	d.checkListeners()
+
+	if d.failed {
+		return 1
+	}
+	return 0
+}
+
+// checkConfig reads the configuration into Conf, and checks the
+// settings which are not otherwise checked until they are used. It
+// returns false if it could not be read.
+func (d *doctor) checkConfig() bool {
+	var err error
+	if Conf, err = ReadConfig(*fConf); err != nil {
+		d.fail("config", "%s: %s", *fConf, err)
+		return false
+	}
+
+	var problems []string
+	if Conf.HeartbeatRate <= 0 {
+		problems = append(problems, "HeartbeatRate must be positive")
+	}
+	if len(Conf.Web.Addr) == 0 {
+		problems = append(problems, "Web.Addr is empty")
+	}
+	if err = LoadEmailKey(); err != nil {
+		problems = append(problems, "EmailStorage: "+err.Error())
+	}
+	if err = CheckValidationRules(); err != nil {
+		problems = append(problems, "Validation: "+err.Error())
+	}
+	if Conf.Database.DriverName == "sqlite3" {
+		if _, err = sqlitePragmas(); err != nil {
+			problems = append(problems, "Database.SQLite: "+err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		d.fail("config", "%s: %s", *fConf, strings.Join(problems, "; "))
+	} else {
+		d.pass("config", "%s", *fConf)
+	}
+	return true
+}
+
+// checkDatabase connects to the database, and checks that every table
+// exists. If it succeeds, Db is set, so that registered child maps
+// can be checked.
+func (d *doctor) checkDatabase() {
+	db, err := OpenDatabase()
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		d.fail("database", "%s %q: %s", Conf.Database.DriverName,
+			Conf.Database.Resource, err)
+		return
+	}
+	Db = DB{DB: db, DriverName: Conf.Database.DriverName, ReadOnly: true}
+	d.pass("database", "connected to %s %q", Conf.Database.DriverName,
+		Conf.Database.Resource)
+
+	if len(Conf.Database.ReplicaResource) > 0 {
+		replica, err := OpenReplica()
+		if err == nil {
+			err = replica.Ping()
+		}
+		if err != nil {
+			d.fail("replica", "%s %q: %s", Conf.Database.DriverName,
+				Conf.Database.ReplicaResource, err)
+		} else {
+			Db.Replica = replica
+			d.pass("replica", "connected to %s %q",
+				Conf.Database.DriverName, Conf.Database.ReplicaResource)
+		}
+	}
+
+	var missing []string
+	for _, table := range schemaTables {
+		var n int
+		if err = Db.QueryRow(`SELECT COUNT(*) FROM ` +
+			table + `;`).Scan(&n); err != nil {
+			missing = append(missing, table)
+		}
+	}
+	if len(missing) > 0 {
+		d.fail("schema", "missing or unreadable tables: %s; starting "+
+			"NodeAtlas normally creates them", strings.Join(missing, ", "))
+	} else {
+		d.pass("schema", "all %d tables present", len(schemaTables))
+	}
+}
+
+// checkTemplates compiles the resource directory, and parses the email
+// and page templates in it.
+func (d *doctor) checkTemplates() {
+	var err error
+	StaticDir, err = CompileStatic(*fRes, Conf)
+	if len(StaticDir) > 0 {
+		defer os.RemoveAll(StaticDir)
+	}
+	if err != nil {
+		d.fail("templates", "compiling %q: %s", *fRes, err)
+		return
+	}
+
+	emails, _ := filepath.Glob(filepath.Join(StaticDir, "email", "*.txt"))
+	if len(emails) == 0 {
+		err = errors.New("no email templates")
+	} else {
+		err = RegisterEmailTemplates()
+	}
+	if err == nil && !Conf.Web.Headless {
+		pages, _ := filepath.Glob(filepath.Join(StaticDir, "webpages",
+			"*.html"))
+		if len(pages) == 0 {
+			err = errors.New("no page templates")
+		} else {
+			err = RegisterTemplates()
+		}
+	}
+	if err != nil {
+		d.fail("templates", "%q: %s", *fRes, err)
+		return
+	}
+	d.pass("templates", "%q", *fRes)
+}
+
+// checkSMTP connects to the SMTP server, and authenticates if it is
+// configured to.
+func (d *doctor) checkSMTP() {
+	if Conf.SMTP == nil {
+		d.skip("smtp", "not configured")
+		return
+	}
+	addr := Conf.SMTP.ServerAddress
+	conn, err := net.DialTimeout("tcp", addr, doctorTimeout)
+	if err != nil {
+		d.fail("smtp", "%s: %s", addr, err)
+		return
+	}
+	conn.Close()
+
+	c, err := ConnectSMTP()
+	if err != nil {
+		d.fail("smtp", "%s: %s", addr, err)
+		return
+	}
+	c.Quit()
+	d.pass("smtp", "%s", addr)
+}
+
+// checkChildMaps requests the status of every child map, including
+// those which registered themselves if the database is available.
+func (d *doctor) checkChildMaps() {
+	addresses := append([]string{}, Conf.ChildMaps...)
+	for _, m := range Conf.Maps {
+		addresses = append(addresses, m.ChildMaps...)
+	}
+	if Db.DB != nil {
+		if registered, err := Db.ApprovedChildMaps(); err == nil {
+			addresses = append(addresses, registered...)
+		}
+	}
+	if len(addresses) == 0 {
+		d.skip("child maps", "none configured")
+		return
+	}
+
+	client := &http.Client{Timeout: doctorTimeout}
+	for _, address := range addresses {
+		u := strings.TrimRight(strings.TrimPrefix(address, "grpc+"), "/") +
+			"/api/status"
+		resp, err := client.Get(u)
+		if err != nil {
+			d.fail("child map", "%s: %s", address, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			d.fail("child map", "%s: %s", address, resp.Status)
+			continue
+		}
+		d.pass("child map", "%s", address)
+	}
+}
+
+// checkListeners checks that every address to listen on is free. A
+// UNIX socket is in use if it can be connected to.
+func (d *doctor) checkListeners() {
+	for _, addr := range Conf.Web.Addr {
+		var network, address string
+		if parts := strings.SplitN(addr.Addr, "://", 2); len(parts) == 2 {
+			network, address = parts[0], parts[1]
+		} else if strings.HasPrefix(addr.Addr, "unix:") {
+			network, address = "unix", addr.Addr[len("unix:"):]
+		} else {
+			d.fail("listen", "%s: %s", addr.Addr, InvalidBindAddress)
+			continue
+		}
+
+		if network == "unix" {
+			if conn, err := net.DialTimeout(network, address,
+				doctorTimeout); err == nil {
+				conn.Close()
+				d.fail("listen", "%s: in use", addr.Addr)
+			} else if _, err := os.Stat(filepath.Dir(address)); err != nil {
+				d.fail("listen", "%s: %s", addr.Addr, err)
+			} else {
+				d.pass("listen", "%s", addr.Addr)
+			}
+			continue
+		}
+
+		listener, err := net.Listen(network, address)
+		if err != nil {
+			d.fail("listen", "%s: %s", addr.Addr, err)
+			continue
+		}
+		listener.Close()
+		d.pass("listen", "%s", addr.Addr)
+	}
+}
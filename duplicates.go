@@ -0,0 +1,267 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"github.com/coocood/jas"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Policies by which one of several nodes with the same address, from
+// different sources, is chosen, as in Config.DuplicatePolicy.
+const (
+	// DuplicatesLocal prefers local nodes to cached ones, and
+	// otherwise the most recently retrieved node. It is the default.
+	DuplicatesLocal = "local"
+
+	// DuplicatesNewest prefers the most recently changed node,
+	// whether it is local or cached. Local nodes are considered
+	// changed when they were last updated, and cached ones when they
+	// were retrieved.
+	DuplicatesNewest = "newest"
+)
+
+// Duplicate is an address which is used by nodes from several
+// sources, of which only one is shown.
+type Duplicate struct {
+	Addr IP
+
+	// MapID is the ID of the SubMap which the cached nodes were
+	// retrieved for, or empty for the main map.
+	MapID string `json:",omitempty"`
+
+	// Sources is the list of the sources of the nodes, including
+	// "local" if one is local.
+	Sources []string
+
+	// Chosen is the source of the node which is shown.
+	Chosen string
+}
+
+var (
+	// duplicates holds the Duplicates found since the most recent
+	// full update of the cache, by map ID and address.
+	duplicates      = make(map[string]map[string]*Duplicate)
+	duplicatesMutex sync.RWMutex
+)
+
+// Duplicates returns every Duplicate found since the most recent full
+// update of the cache, sorted by address.
+func Duplicates() (dups []*Duplicate) {
+	duplicatesMutex.RLock()
+	dups = make([]*Duplicate, 0)
+	for _, mapDups := range duplicates {
+		for _, dup := range mapDups {
+			dups = append(dups, dup)
+		}
+	}
+	duplicatesMutex.RUnlock()
+	sort.Sort(duplicatesByAddr(dups))
+	return
+}
+
+// ClearDuplicates forgets every Duplicate, before the cache is updated
+// entirely.
+func ClearDuplicates() {
+	duplicatesMutex.Lock()
+	duplicates = make(map[string]map[string]*Duplicate)
+	duplicatesMutex.Unlock()
+}
+
+// duplicatesByAddr sorts Duplicates by address.
+type duplicatesByAddr []*Duplicate
+
+func (d duplicatesByAddr) Len() int      { return len(d) }
+func (d duplicatesByAddr) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d duplicatesByAddr) Less(i, j int) bool {
+	return d[i].Addr.String() < d[j].Addr.String()
+}
+
+// nodeSources returns the source ID of every node in the database, by
+// address, which is 0 for local nodes.
+func (db DB) nodeSources() (sources map[string]int, err error) {
+	rows, err := db.Query(`SELECT address,0 FROM nodes
+UNION ALL SELECT address,source FROM nodes_cached;`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	sources = make(map[string]int)
+	for rows.Next() {
+		var addr []byte
+		var source int
+		if err = rows.Scan(&addr, &source); err != nil {
+			return
+		}
+		if _, ok := sources[string(addr)]; !ok || source == 0 {
+			sources[string(addr)] = source
+		}
+	}
+	return sources, rows.Err()
+}
+
+// updatedSince returns true if the local node with the given address
+// has been updated at or after the given Unix time.
+func (db DB) updatedSince(addr IP, t int64) (bool, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*)
+FROM nodes
+WHERE address = ? AND updated_at >= ?;`,
+		[]byte(addr), t).Scan(&n)
+	return n > 0, err
+}
+
+// ResolveDuplicates removes every node from the given list of nodes
+// about to be cached for the given map whose address is also used by
+// another node, according to Conf.DuplicatePolicy, and returns those
+// which remain. Nodes which are already cached from other sources,
+// such as for another map, are kept in preference to new ones. Every
+// such address is recorded, so that admins can see them with
+// Duplicates().
+func (db DB) ResolveDuplicates(nodes []*Node, mapID string) (resolved []*Node, err error) {
+	idSources, err := db.GetMapIDToSource()
+	if err != nil {
+		return
+	}
+	existingSources, err := db.nodeSources()
+	if err != nil {
+		return
+	}
+	adopted, err := db.Adopted()
+	if err != nil {
+		return
+	}
+
+	// Group the nodes by address, keeping their order.
+	groups := make(map[string][]*Node)
+	order := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		key := string(n.Addr)
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], n)
+	}
+
+	now := time.Now().Unix()
+	retrieved := func(n *Node) int64 {
+		if n.RetrieveTime == 0 {
+			return now
+		}
+		return n.RetrieveTime
+	}
+
+	resolved = make([]*Node, 0, len(nodes))
+	dups := make([]*Duplicate, 0)
+	for _, key := range order {
+		group := groups[key]
+		addr := group[0].Addr
+
+		// Find any node which is already in the database, unless it
+		// is from the same source, in which case it is replaced.
+		var existing *Node
+		if source, ok := existingSources[key]; ok {
+			existing = &Node{Addr: addr, SourceID: source}
+			for _, n := range group {
+				if source != 0 && n.SourceID == source {
+					existing = nil
+					break
+				}
+			}
+		}
+		if existing == nil && len(group) == 1 {
+			resolved = append(resolved, group[0])
+			continue
+		}
+
+		// Choose the most recently retrieved of the new nodes.
+		chosen := group[0]
+		for _, n := range group[1:] {
+			if retrieved(n) > retrieved(chosen) {
+				chosen = n
+			}
+		}
+
+		dup := &Duplicate{Addr: addr, MapID: mapID}
+		for _, n := range group {
+			dup.Sources = append(dup.Sources, idSources[n.SourceID])
+		}
+		if existing != nil {
+			dup.Sources = append(dup.Sources, idSources[existing.SourceID])
+
+			// Existing cached nodes and adopted ones are always
+			// kept, and other local ones only if the policy and their
+			// age permit.
+			keep := true
+			if existing.SourceID == 0 && !adopted[key] &&
+				Conf.DuplicatePolicy == DuplicatesNewest {
+				keep, err = db.updatedSince(addr, retrieved(chosen))
+				if err != nil {
+					return
+				}
+			}
+			if keep {
+				chosen = existing
+			}
+		}
+		dup.Chosen = idSources[chosen.SourceID]
+		dups = append(dups, dup)
+
+		if chosen != existing {
+			resolved = append(resolved, chosen)
+		}
+	}
+
+	if len(dups) > 0 {
+		dbLog.Noticef("%d nodes duplicate others for map %q\n",
+			len(dups), mapID)
+	}
+	duplicatesMutex.Lock()
+	if duplicates[mapID] == nil {
+		duplicates[mapID] = make(map[string]*Duplicate)
+	}
+	for _, dup := range dups {
+		duplicates[mapID][string(dup.Addr)] = dup
+	}
+	duplicatesMutex.Unlock()
+	return
+}
+
+// collapseDuplicates removes nodes from the given list, as from
+// DumpNodes(), which have the same address as another, so that a
+// single marker is shown for each. Nodes are only stored in the
+// cache after ResolveDuplicates(), so if both a local and a cached
+// node remain, the cached one must have been preferred, unless the
+// local one was added since.
+func collapseDuplicates(nodes []*Node) []*Node {
+	preferCached := Conf.DuplicatePolicy == DuplicatesNewest
+	index := make(map[string]int, len(nodes))
+	collapsed := nodes[:0]
+	for _, n := range nodes {
+		key := string(n.Addr)
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(collapsed)
+			collapsed = append(collapsed, n)
+			continue
+		}
+		if (n.SourceID != 0) == preferCached &&
+			(collapsed[i].SourceID != 0) != preferCached {
+			collapsed[i] = n
+		}
+	}
+	return collapsed
+}
+
+// GetDuplicates returns every address used by nodes from several
+// sources, as of the most recent update of the cache, and the source
+// of the node which is shown for each. It is only available to
+// admins.
+func (*Federation) GetDuplicates(ctx *jas.Context) {
+	RequireAdmin(ctx)
+	ctx.Data = Duplicates()
+}
@@ -0,0 +1,126 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/coocood/jas"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ElevationDisabledError = errors.New("elevation lookups are not configured")
+)
+
+// Elevation is the ground elevation at a local node, which is used to
+// judge whether nodes can see each other.
+type Elevation struct {
+	Addr IP `json:"Address"`
+
+	// Meters is the elevation of the ground above sea level.
+	Meters  float64
+	Updated time.Time
+}
+
+// LookupElevations finds the ground elevation in meters at each of the
+// given [latitude, longitude] points, using the Open-Elevation
+// compatible service at Conf.Elevation.URL. Results are in the same
+// order as the points.
+func LookupElevations(points [][2]float64) (elevations []float64, err error) {
+	if Conf.Elevation == nil || len(Conf.Elevation.URL) == 0 {
+		return nil, ElevationDisabledError
+	}
+	locations := make([]string, len(points))
+	for i, p := range points {
+		locations[i] = fmt.Sprintf("%f,%f", p[0], p[1])
+	}
+	u := strings.TrimRight(Conf.Elevation.URL, "/") +
+		"/api/v1/lookup?" + url.Values{
+		"locations": {strings.Join(locations, "|")},
+	}.Encode()
+
+	resp, err := geocoderClient.Get(u)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("elevation service responded %s",
+			resp.Status)
+	}
+
+	var result struct {
+		Results []struct {
+			Elevation float64
+		}
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return
+	}
+	if len(result.Results) != len(points) {
+		return nil, fmt.Errorf("elevation service gave %d results for %d points",
+			len(result.Results), len(points))
+	}
+	elevations = make([]float64, len(points))
+	for i, r := range result.Results {
+		elevations[i] = r.Elevation
+	}
+	return
+}
+
+// SetElevation stores the elevation of a local node.
+func (db DB) SetElevation(e *Elevation) (err error) {
+	_, err = db.Exec(`DELETE FROM node_elevations
+WHERE address = ?;`, []byte(e.Addr))
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`INSERT INTO node_elevations
+(address, meters, updated)
+VALUES(?, ?, ?);`, []byte(e.Addr), e.Meters, e.Updated.Unix())
+	return
+}
+
+// GetElevation returns the stored elevation of the local node with the
+// given address, or nil if it has none.
+func (db DB) GetElevation(addr IP) (e *Elevation, err error) {
+	e = &Elevation{Addr: addr}
+	var updated int64
+	err = db.QueryRow(`SELECT meters,updated
+FROM node_elevations
+WHERE address = ?;`, []byte(addr)).Scan(&e.Meters, &updated)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	e.Updated = time.Unix(updated, 0)
+	return
+}
+
+// GetElevation responds with the ground elevation at the local node
+// with the given `address`, as last refreshed by the "elevation"
+// maintenance job. If it is not known, the error is "no known
+// elevation".
+func (*Api) GetElevation(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	node := RequireLocalNode(ctx)
+	e, err := db.GetElevation(node.Addr)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error getting elevation of %q: %s",
+			node.Addr, err)
+		return
+	} else if e == nil {
+		ctx.Error = jas.NewRequestError("no known elevation")
+		return
+	}
+	ctx.Data = e
+}
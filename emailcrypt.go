@@ -0,0 +1,281 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	// EmailStoragePlain, EmailStorageEncrypted, and EmailStorageHashed
+	// are the modes in which the email addresses of node owners can be
+	// stored. See Conf.EmailStorage.
+	EmailStoragePlain     = "plain"
+	EmailStorageEncrypted = "encrypted"
+	EmailStorageHashed    = "hashed"
+
+	// encryptedEmailPrefix and hashedEmailPrefix mark stored email
+	// addresses which are encrypted or hashed, so that those stored
+	// before the mode was changed can still be read.
+	encryptedEmailPrefix = "enc:"
+	hashedEmailPrefix    = "hmac:"
+
+	// maxStoredEmail is the length of the email columns.
+	maxStoredEmail = 255
+)
+
+var (
+	EmailStorageInvalidError = errors.New("invalid email storage mode")
+	EmailKeyMissingError     = errors.New("no email storage key configured")
+	EmailKeyInvalidError     = errors.New("could not decrypt email address")
+	EmailHashedError         = errors.New("email address is stored only as a hash")
+	EmailTooLongError        = errors.New("emailTooLong")
+)
+
+// emailKey is the key with which email addresses are encrypted, and
+// emailMACKey the one with which they are hashed, as derived by
+// LoadEmailKey from the configured key. If emailKey is nil, they are
+// stored in plain text.
+var emailKey, emailMACKey []byte
+
+// legacyEmailKey is the key with which email addresses were both
+// encrypted and hashed before separate keys were derived, so that those
+// stored then can still be read and matched.
+var legacyEmailKey []byte
+
+// LoadEmailKey checks Conf.EmailStorage, and loads the key which it
+// names. The key is kept even if the mode is "plain", so that email
+// addresses which were encrypted before can still be read.
+func LoadEmailKey() (err error) {
+	conf := Conf.EmailStorage
+	switch conf.Mode {
+	case "", EmailStoragePlain, EmailStorageEncrypted, EmailStorageHashed:
+	default:
+		return EmailStorageInvalidError
+	}
+
+	key := conf.Key
+	if len(conf.KeyFile) > 0 {
+		b, err := ioutil.ReadFile(conf.KeyFile)
+		if err != nil {
+			return err
+		}
+		key = strings.TrimSpace(string(b))
+	}
+	if len(key) == 0 {
+		emailKey, emailMACKey, legacyEmailKey = nil, nil, nil
+		if conf.Mode == EmailStorageEncrypted ||
+			conf.Mode == EmailStorageHashed {
+			return EmailKeyMissingError
+		}
+		return nil
+	}
+
+	// Derive separate keys of the length which AES-256 requires from
+	// whatever was configured, so that neither use weakens the other.
+	emailKey = deriveEmailKey(key, "enc")
+	emailMACKey = deriveEmailKey(key, "mac")
+	sum := sha256.Sum256([]byte(key))
+	legacyEmailKey = sum[:]
+	return nil
+}
+
+// deriveEmailKey returns the key for the given purpose, which is the
+// HMAC of the purpose under the configured key.
+func deriveEmailKey(key, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// EncryptEmail encrypts the given email address with the configured
+// key, so that it can be decrypted with OpenEmail when it is needed.
+// If there is no key, it is returned unchanged.
+func EncryptEmail(email string) (string, error) {
+	if emailKey == nil || len(email) == 0 {
+		return email, nil
+	}
+	block, err := aes.NewCipher(emailKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(email), nil)
+	return encryptedEmailPrefix +
+		base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// OpenEmail returns the plain text of the given stored email address
+// if it was encrypted, with either the current or the legacy key.
+// Otherwise, it is returned unchanged, including if it is hashed.
+func OpenEmail(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedEmailPrefix) {
+		return stored, nil
+	} else if emailKey == nil {
+		return "", EmailKeyMissingError
+	}
+	sealed, err := base64.StdEncoding.DecodeString(
+		stored[len(encryptedEmailPrefix):])
+	if err != nil {
+		return "", EmailKeyInvalidError
+	}
+	email, err := openEmail(emailKey, sealed)
+	if err == EmailKeyInvalidError {
+		email, err = openEmail(legacyEmailKey, sealed)
+	}
+	return email, err
+}
+
+// openEmail decrypts the sealed form of an email address, without its
+// prefix or base64 encoding, with the given key.
+func openEmail(key, sealed []byte) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", EmailKeyInvalidError
+	}
+	email, err := gcm.Open(nil, sealed[:gcm.NonceSize()],
+		sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", EmailKeyInvalidError
+	}
+	return string(email), nil
+}
+
+// HashEmail returns the keyed hash of the given email address, which
+// is the same for any capitalization of it.
+func HashEmail(email string) string {
+	return hashEmail(emailMACKey, email)
+}
+
+// legacyHashEmail returns the hash of the given email address as it
+// was stored before separate keys were derived, or "" if there is no
+// key.
+func legacyHashEmail(email string) string {
+	if legacyEmailKey == nil {
+		return ""
+	}
+	return hashEmail(legacyEmailKey, email)
+}
+
+// hashEmail returns the hash of the given email address with the given
+// key, as HashEmail does.
+func hashEmail(key []byte, email string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hashedEmailPrefix +
+		base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SealEmail returns the form in which the given owner email address
+// should be stored, according to Conf.EmailStorage.Mode. It may be
+// given an address which is already stored in any form. Hashed
+// addresses are never changed, because they cannot be recovered.
+func SealEmail(email string) (stored string, err error) {
+	if len(email) == 0 || strings.HasPrefix(email, hashedEmailPrefix) {
+		return email, nil
+	}
+	if email, err = OpenEmail(email); err != nil {
+		return
+	}
+
+	switch Conf.EmailStorage.Mode {
+	case EmailStorageEncrypted:
+		if stored, err = EncryptEmail(email); err != nil {
+			return
+		}
+	case EmailStorageHashed:
+		stored = HashEmail(email)
+	default:
+		stored = email
+	}
+	if len(stored) > maxStoredEmail {
+		return "", EmailTooLongError
+	}
+	return
+}
+
+// EmailMatches returns true if the given stored email address, in any
+// form, is the same as the given plain one. This is the only use of
+// hashed addresses.
+func EmailMatches(stored, email string) bool {
+	if strings.HasPrefix(stored, hashedEmailPrefix) {
+		return hmac.Equal([]byte(stored), []byte(HashEmail(email))) ||
+			hmac.Equal([]byte(stored), []byte(legacyHashEmail(email)))
+	}
+	plain, err := OpenEmail(stored)
+	return err == nil && len(plain) > 0 && strings.EqualFold(plain, email)
+}
+
+// EmailRecipient returns the address to which mail for the given
+// stored email address should be sent, decrypting it if necessary. If
+// it is only stored as a hash, it returns EmailHashedError.
+func EmailRecipient(stored string) (string, error) {
+	if strings.HasPrefix(stored, hashedEmailPrefix) {
+		return "", EmailHashedError
+	}
+	return OpenEmail(stored)
+}
+
+// SealOwnerEmails rewrites the email address of every local node which
+// is not stored as Conf.EmailStorage.Mode requires, such as those
+// added before it was changed, and returns the number rewritten.
+func (db DB) SealOwnerEmails() (n int, err error) {
+	rows, err := db.Query(`SELECT address,email FROM nodes;`)
+	if err != nil {
+		return
+	}
+	sealed := make(map[string]string)
+	for rows.Next() {
+		var addr []byte
+		var email, stored string
+		if err = rows.Scan(&addr, &email); err != nil {
+			rows.Close()
+			return
+		}
+		if stored, err = SealEmail(email); err != nil {
+			dbLog.Errf("Could not seal email of %q: %s", IP(addr), err)
+			continue
+		}
+		if stored != email {
+			sealed[string(addr)] = stored
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	for addr, stored := range sealed {
+		_, err = db.Exec(`UPDATE nodes SET email = ?, version = version + 1
+WHERE address = ?;`, stored, []byte(addr))
+		if err != nil {
+			return
+		}
+		n++
+	}
+	return n, nil
+}
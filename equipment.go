@@ -0,0 +1,317 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"github.com/coocood/jas"
+	"html"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// equipmentDateFormat is the format of equipment purchase dates.
+const equipmentDateFormat = "2006-01-02"
+
+// Equipment is a piece of hardware, such as a radio or router, which
+// is either deployed at a node or on the shelf.
+type Equipment struct {
+	ID     int64
+	Model  string
+	MAC    string `json:",omitempty"`
+	Serial string `json:",omitempty"`
+
+	// Purchased is the date on which the equipment was bought, in
+	// the form "2006-01-02", or empty if it is not known.
+	Purchased string `json:",omitempty"`
+
+	// Org is the organization which owns the equipment, such as the
+	// community itself or a member who lent it.
+	Org string `json:",omitempty"`
+
+	// Addr is the address of the node at which the equipment is
+	// deployed, or nil if it is on the shelf.
+	Addr IP `json:"Address,omitempty"`
+
+	Notes string `json:",omitempty"`
+}
+
+// InventoryCount is the number of pieces of equipment of one model
+// and organization which are deployed and on the shelf.
+type InventoryCount struct {
+	Model, Org      string
+	Deployed, Shelf int
+}
+
+// SaveEquipment inserts the equipment, or replaces the equipment with
+// the same ID.
+func (db DB) SaveEquipment(e *Equipment) (err error) {
+	var addr interface{}
+	if e.Addr != nil {
+		addr = []byte(e.Addr)
+	}
+	var purchased interface{}
+	if len(e.Purchased) > 0 {
+		t, err := time.Parse(equipmentDateFormat, e.Purchased)
+		if err != nil {
+			return err
+		}
+		purchased = t.Unix()
+	}
+
+	_, err = db.Exec(`DELETE FROM equipment
+WHERE id = ?;`, e.ID)
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`INSERT INTO equipment
+(id, model, mac, serial, purchased, org, address, notes)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?);`, e.ID, e.Model, e.MAC, e.Serial,
+		purchased, e.Org, addr, e.Notes)
+	return
+}
+
+// DeleteEquipment removes the equipment with the given ID.
+func (db DB) DeleteEquipment(id int64) (err error) {
+	_, err = db.Exec(`DELETE FROM equipment
+WHERE id = ?;`, id)
+	return
+}
+
+// GetEquipment returns the equipment with the given ID, or nil if there
+// is none.
+func (db DB) GetEquipment(id int64) (e *Equipment, err error) {
+	rows, err := db.Query(`SELECT id,model,mac,serial,purchased,org,address,notes
+FROM equipment
+WHERE id = ?;`, id)
+	if err != nil {
+		return
+	}
+	equipment, err := scanEquipment(rows)
+	if err != nil || len(equipment) == 0 {
+		return nil, err
+	}
+	return equipment[0], nil
+}
+
+// ListEquipment returns every piece of equipment, ordered by model.
+// If addr is not nil, only the equipment deployed at that node is
+// given.
+func (db DB) ListEquipment(addr IP) (equipment []*Equipment, err error) {
+	var rows *sql.Rows
+	if addr == nil {
+		rows, err = db.Query(`SELECT id,model,mac,serial,purchased,org,address,notes
+FROM equipment
+ORDER BY model;`)
+	} else {
+		rows, err = db.Query(`SELECT id,model,mac,serial,purchased,org,address,notes
+FROM equipment
+WHERE address = ?
+ORDER BY model;`, []byte(addr))
+	}
+	if err != nil {
+		return
+	}
+	return scanEquipment(rows)
+}
+
+// scanEquipment reads equipment from the rows, and closes them.
+func scanEquipment(rows *sql.Rows) (equipment []*Equipment, err error) {
+	defer rows.Close()
+	equipment = make([]*Equipment, 0)
+	for rows.Next() {
+		e := new(Equipment)
+		var mac, serial, org, notes sql.NullString
+		var purchased sql.NullInt64
+		var addr []byte
+		err = rows.Scan(&e.ID, &e.Model, &mac, &serial, &purchased, &org,
+			&addr, &notes)
+		if err != nil {
+			return
+		}
+		e.MAC, e.Serial = mac.String, serial.String
+		e.Org, e.Notes = org.String, notes.String
+		if purchased.Valid {
+			e.Purchased = time.Unix(purchased.Int64, 0).UTC().Format(
+				equipmentDateFormat)
+		}
+		if len(addr) > 0 {
+			e.Addr = IP(addr)
+		}
+		equipment = append(equipment, e)
+	}
+	return equipment, rows.Err()
+}
+
+// ShelveEquipment moves all of the equipment deployed at the given
+// node to the shelf, such as when the node is deleted.
+func (db DB) ShelveEquipment(addr IP) (err error) {
+	_, err = db.Exec(`UPDATE equipment
+SET address = NULL
+WHERE address = ?;`, []byte(addr))
+	return
+}
+
+// InventoryReport counts the deployed and shelved equipment of each
+// model and organization.
+func (db DB) InventoryReport() (counts []*InventoryCount, err error) {
+	rows, err := db.Query(`SELECT model,org,
+SUM(CASE WHEN address IS NULL THEN 0 ELSE 1 END),
+SUM(CASE WHEN address IS NULL THEN 1 ELSE 0 END)
+FROM equipment
+GROUP BY model,org
+ORDER BY model,org;`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	counts = make([]*InventoryCount, 0)
+	for rows.Next() {
+		c := new(InventoryCount)
+		var org sql.NullString
+		err = rows.Scan(&c.Model, &org, &c.Deployed, &c.Shelf)
+		if err != nil {
+			return
+		}
+		c.Org = org.String
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// GetEquipment lists every piece of equipment, or, if `address` is
+// given, the equipment deployed at that node. Only admins may see
+// the inventory.
+func (*Api) GetEquipment(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	var addr IP
+	if s, _ := ctx.FindString("address"); len(s) > 0 {
+		if addr = ParseIP(s); addr == nil {
+			ctx.Error = jas.NewRequestError("addressInvalid")
+			return
+		}
+	}
+	var err error
+	ctx.Data, err = db.ListEquipment(addr)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error listing equipment: %s", err)
+	}
+}
+
+// PostEquipment adds a piece of equipment to the inventory, or, if
+// an `id` is given, replaces it. It requires a `model`, and takes an
+// optional `mac`, `serial`, `purchased` date of the form
+// "2006-01-02", `org`, `notes`, and the `address` of the node at
+// which it is deployed. If no address is given, the equipment is on
+// the shelf. Only admins may change the inventory.
+func (*Api) PostEquipment(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+
+	e := &Equipment{
+		Model: html.EscapeString(ctx.RequireStringLen(1, 255, "model")),
+	}
+	if id, err := ctx.FindInt("id"); err == nil {
+		if old, err := db.GetEquipment(id); err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			apiLog.Request(ctx.Request).Errf("Error getting equipment: %s", err)
+			return
+		} else if old == nil {
+			ctx.Error = jas.NewRequestError("invalid id")
+			return
+		}
+		e.ID = id
+	} else {
+		e.ID = rand.Int63()
+	}
+
+	if s, _ := ctx.FindString("mac"); len(s) > 0 {
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			ctx.Error = jas.NewRequestError("macInvalid")
+			return
+		}
+		e.MAC = mac.String()
+	}
+	if s, _ := ctx.FindString("purchased"); len(s) > 0 {
+		if _, err := time.Parse(equipmentDateFormat, s); err != nil {
+			ctx.Error = jas.NewRequestError("purchasedInvalid")
+			return
+		}
+		e.Purchased = s
+	}
+	e.Serial, _ = ctx.FindStringLen(0, 255, "serial")
+	e.Serial = html.EscapeString(e.Serial)
+	e.Org, _ = ctx.FindStringLen(0, 255, "org")
+	e.Org = html.EscapeString(e.Org)
+	e.Notes, _ = ctx.FindStringLen(0, 1000, "notes")
+	e.Notes = html.EscapeString(e.Notes)
+
+	if s, _ := ctx.FindString("address"); len(s) > 0 {
+		if e.Addr = ParseIP(s); e.Addr == nil {
+			ctx.Error = jas.NewRequestError("addressInvalid")
+			return
+		}
+		if _, err := db.GetLocalNode(e.Addr); err != nil {
+			ctx.Error = apiError(ctx.Request, err)
+			return
+		}
+	}
+
+	if err := db.SaveEquipment(e); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error saving equipment: %s", err)
+		return
+	}
+	ctx.Data = e
+}
+
+// PostDeleteEquipment removes the equipment with the given `id` from
+// the inventory. Only admins may change the inventory.
+func (*Api) PostDeleteEquipment(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	if err := db.DeleteEquipment(ctx.RequireInt("id")); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Err(err)
+		return
+	}
+	ctx.Data = "deleted"
+}
+
+// GetEquipmentReport counts the deployed and shelved equipment of
+// each model and organization, along with the totals. Only admins may
+// see the inventory.
+func (*Api) GetEquipmentReport(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	counts, err := db.InventoryReport()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error reporting inventory: %s", err)
+		return
+	}
+	var deployed, shelf int
+	for _, c := range counts {
+		deployed += c.Deployed
+		shelf += c.Shelf
+	}
+	ctx.Data = map[string]interface{}{
+		"Models":   counts,
+		"Deployed": deployed,
+		"Shelf":    shelf,
+	}
+}
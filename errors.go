@@ -0,0 +1,85 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"encoding/json"
+	"github.com/coocood/jas"
+	"net/http"
+)
+
+// These errors are returned by the database and reported to clients
+// with the statuses they carry, so that handlers compare them, rather
+// than their messages, and every endpoint reports them in the same
+// way. See apiError.
+var (
+	NodeNotFoundError = newAPIError("No matching node",
+		http.StatusNotFound)
+	LocalNodeNotFoundError = newAPIError("no matching local node",
+		http.StatusNotFound)
+	DuplicateNodeError = newAPIError("addressExists",
+		http.StatusConflict)
+	ReadOnlyError = newAPIError("database in readonly mode",
+		http.StatusServiceUnavailable)
+	UnknownSourceError = newAPIError("unknownSource",
+		http.StatusNotFound)
+	VersionConflictError = newAPIError("versionConflict",
+		http.StatusConflict)
+)
+
+// newAPIError returns an error which is reported to clients with the
+// given message and status, rather than the 400 of
+// jas.NewRequestError.
+func newAPIError(message string, status int) jas.RequestError {
+	err := jas.NewRequestError(message)
+	err.StatusCode = status
+	return err
+}
+
+// apiError returns the error to report to the client which made the
+// request. Errors which carry their own statuses, such as
+// NodeNotFoundError, are reported as they are. Any others are logged,
+// and reported as internal errors.
+func apiError(r *http.Request, err error) jas.AppError {
+	if e, ok := err.(jas.AppError); ok {
+		return e
+	}
+	apiLog.Request(r).Err(err)
+	return jas.NewInternalError(err)
+}
+
+// errorResponse returns the status and message with which handlers
+// outside of the JSON API, such as HandleAdminJobs, report the error,
+// in the same way as apiError. Errors without their own statuses are
+// reported only as "InternalError", and should be logged by the
+// caller.
+func errorResponse(err error) (status int, message string) {
+	if e, ok := err.(jas.AppError); ok {
+		return e.Status(), e.Error()
+	}
+	return http.StatusInternalServerError, "InternalError"
+}
+
+// apiResponse is the form of the responses of handlers outside of the
+// JSON API which respond in the same way as the rest of the API, such
+// as HandleAdminJobs.
+type apiResponse struct {
+	Data  interface{} `json:"data"`
+	Error interface{} `json:"error"`
+}
+
+// writeAPIResponse replies to a request outside of the JSON API with
+// the response, as JSON, and the given status.
+func writeAPIResponse(w http.ResponseWriter, status int, resp *apiResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// httpError replies to a request outside of the JSON API with the
+// status and message of the error, as errorResponse gives them.
+func httpError(w http.ResponseWriter, err error) {
+	status, message := errorResponse(err)
+	http.Error(w, message, status)
+}
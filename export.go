@@ -0,0 +1,295 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/coocood/jas"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// domainRegexp matches a lowercase DNS domain name, with an optional
+// trailing dot.
+var domainRegexp = regexp.MustCompile(
+	`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]*[a-z0-9])?\.?$`)
+
+// hostnameInvalidRegexp matches runs of characters which can't appear
+// in a DNS label.
+var hostnameInvalidRegexp = regexp.MustCompile(`[^a-z0-9]+`)
+
+// NamedNode is a local node with a unique hostname derived from its
+// owner's name.
+type NamedNode struct {
+	*Node
+	Hostname string
+}
+
+// Hostname returns a DNS label derived from the given name, such as
+// "alice-s-node" for "Alice's Node", or "node" if none can be.
+func Hostname(name string) string {
+	name = hostnameInvalidRegexp.ReplaceAllString(strings.ToLower(name), "-")
+	name = strings.Trim(name, "-")
+	if len(name) > 59 {
+		// Leave room for a suffix, if one is needed.
+		name = strings.TrimRight(name[:59], "-")
+	}
+	if len(name) == 0 {
+		return "node"
+	}
+	return name
+}
+
+// NameNodes returns every local node with a hostname derived from its
+// owner's name. Nodes are ordered by address, and, if several have the
+// same name, each after the first has a number appended, as in
+// "alice-2".
+func NameNodes() (named []*NamedNode, err error) {
+	nodes, err := Db.DumpLocal()
+	if err != nil {
+		return
+	}
+	named = make([]*NamedNode, 0, len(nodes))
+	for _, node := range nodes {
+		if node != nil {
+			named = append(named, &NamedNode{Node: node})
+		}
+	}
+	sort.Sort(namedByAddr(named))
+
+	seen := make(map[string]int, len(named))
+	for _, n := range named {
+		base := Hostname(n.OwnerName)
+		n.Hostname = base
+		for seen[n.Hostname] > 0 {
+			seen[base]++
+			n.Hostname = base + "-" + strconv.Itoa(seen[base])
+		}
+		seen[n.Hostname]++
+	}
+	return
+}
+
+// namedByAddr sorts nodes by their addresses.
+type namedByAddr []*NamedNode
+
+func (n namedByAddr) Len() int      { return len(n) }
+func (n namedByAddr) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+func (n namedByAddr) Less(i, j int) bool {
+	return bytes.Compare(n[i].Addr, n[j].Addr) < 0
+}
+
+// HandleZoneExport serves a zone fragment mapping the hostnames of
+// local nodes beneath the given `domain` to their addresses. The
+// `format` is either "bind" (the default), which can be included in a
+// BIND zone file, or "unbound", which gives local-data for an unbound
+// server.
+func HandleZoneExport(w http.ResponseWriter, r *http.Request) {
+	domain := strings.ToLower(r.FormValue("domain"))
+	if !domainRegexp.MatchString(domain) {
+		http.Error(w, "domainInvalid", http.StatusBadRequest)
+		return
+	}
+	domain = strings.TrimSuffix(domain, ".") + "."
+
+	format := r.FormValue("format")
+	switch format {
+	case "":
+		format = "bind"
+	case "bind", "unbound":
+	default:
+		http.Error(w, "formatInvalid", http.StatusBadRequest)
+		return
+	}
+
+	nodes, err := NameNodes()
+	if err != nil {
+		dbLog.Request(r).Errf("Error listing nodes for zone: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "; %s nodes, generated by NodeAtlas at %s\n",
+		Conf.Name, time.Now().UTC().Format(time.RFC3339))
+	if format == "bind" {
+		fmt.Fprintf(buf, "$ORIGIN %s\n", domain)
+	}
+	for _, n := range nodes {
+		rr := "AAAA"
+		if net.IP(n.Addr).To4() != nil {
+			rr = "A"
+		}
+		if format == "bind" {
+			fmt.Fprintf(buf, "%s\tIN\t%s\t%s\n", n.Hostname, rr, n.Addr)
+		} else {
+			fmt.Fprintf(buf, "local-data: \"%s.%s %s %s\"\n",
+				n.Hostname, domain, rr, n.Addr)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// groupName returns an Ansible group name derived from the given
+// name, such as "wireless_access" for "wireless access".
+func groupName(name string) string {
+	return strings.Replace(Hostname(name), "-", "_", -1)
+}
+
+// NodeGroups returns the names of the inventory groups to which the
+// node belongs: one for each of its status names, as in StatusNames,
+// "down" if it is active but not pingable, and
+// "neighborhood_<name>" and "map_<id>" if it has a neighborhood or
+// belongs to a submap.
+func NodeGroups(node *Node) (groups []string) {
+	for _, name := range StatusNames(node.Status) {
+		groups = append(groups, groupName(name))
+	}
+	if node.Status&StatusActive != 0 && node.Status&StatusPingable == 0 {
+		groups = append(groups, "down")
+	}
+	if len(node.Neighborhood) > 0 {
+		groups = append(groups, "neighborhood_"+groupName(node.Neighborhood))
+	}
+	if len(node.MapID) > 0 {
+		groups = append(groups, "map_"+groupName(node.MapID))
+	}
+	return
+}
+
+// HandleInventoryExport serves an inventory of the local nodes. By
+// default, it is an Ansible YAML inventory, in which every node is a
+// host whose ansible_host is its address, in the groups given by
+// NodeGroups. If `format` is "hosts", it is an /etc/hosts fragment
+// instead, whose names are qualified by `domain`, if it is given.
+func HandleInventoryExport(w http.ResponseWriter, r *http.Request) {
+	format := r.FormValue("format")
+	switch format {
+	case "":
+		format = "ansible"
+	case "ansible", "hosts":
+	default:
+		http.Error(w, "formatInvalid", http.StatusBadRequest)
+		return
+	}
+	domain := strings.ToLower(r.FormValue("domain"))
+	if len(domain) > 0 && !domainRegexp.MatchString(domain) {
+		http.Error(w, "domainInvalid", http.StatusBadRequest)
+		return
+	}
+	domain = strings.TrimSuffix(domain, ".")
+
+	nodes, err := NameNodes()
+	if err != nil {
+		dbLog.Request(r).Errf("Error listing nodes for inventory: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "# %s nodes, generated by NodeAtlas at %s\n",
+		Conf.Name, time.Now().UTC().Format(time.RFC3339))
+	if format == "hosts" {
+		for _, n := range nodes {
+			if len(domain) > 0 {
+				fmt.Fprintf(buf, "%s\t%s.%s %s\n", n.Addr, n.Hostname,
+					domain, n.Hostname)
+			} else {
+				fmt.Fprintf(buf, "%s\t%s\n", n.Addr, n.Hostname)
+			}
+		}
+	} else {
+		groups := make(map[string][]string)
+		buf.WriteString("all:\n  hosts:\n")
+		for _, n := range nodes {
+			fmt.Fprintf(buf, "    %s:\n      ansible_host: %q\n",
+				n.Hostname, n.Addr.String())
+			for _, g := range NodeGroups(n.Node) {
+				groups[g] = append(groups[g], n.Hostname)
+			}
+		}
+		names := make([]string, 0, len(groups))
+		for g := range groups {
+			names = append(names, g)
+		}
+		sort.Strings(names)
+		if len(names) > 0 {
+			buf.WriteString("  children:\n")
+		}
+		for _, g := range names {
+			fmt.Fprintf(buf, "    %s:\n      hosts:\n", g)
+			for _, host := range groups[g] {
+				fmt.Fprintf(buf, "        %s:\n", host)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// HandleNDJSONExport serves every node, both local and cached, as in
+// /api/all, but as JSON Lines, one node per line. The nodes are
+// written as they are read from the database, so that even the export
+// of a very large federation needs little memory, and can be piped into
+// other tools as it arrives. As with /api/all, `map` limits it to the
+// nodes of a single map, the filters of ParseNodeFilter to those it
+// selects, and `fields` limits each node to those fields.
+func HandleNDJSONExport(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	var fields NodeFields
+	if _, ok := r.Form["fields"]; ok {
+		if fields, ok = ParseNodeFields(r.Form.Get("fields")); !ok {
+			http.Error(w, "fieldsInvalid", http.StatusBadRequest)
+			return
+		}
+	}
+	mapID, filterMap := r.Form["map"]
+	filter, err := ParseNodeFilter(r)
+	if err != nil {
+		if _, ok := err.(jas.AppError); !ok {
+			dbLog.Request(r).Errf("Error exporting nodes: %s", err)
+		}
+		httpError(w, err)
+		return
+	}
+
+	// Once the first node is written, the status can no longer be
+	// changed, so later errors only end the export early.
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	written := false
+	enc := json.NewEncoder(w)
+	db := Db.WithContext(r.Context())
+	err = db.EachNode(filter, func(node *Node) error {
+		if filterMap && node.MapID != mapID[0] {
+			return nil
+		}
+		written = true
+		if fields == nil {
+			return enc.Encode(node)
+		}
+		sparse, err := fields.Node(node)
+		if err != nil {
+			return err
+		}
+		return enc.Encode(sparse)
+	})
+	if err != nil {
+		dbLog.Request(r).Errf("Error exporting nodes: %s", err)
+		if !written {
+			httpError(w, err)
+		}
+	}
+}
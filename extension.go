@@ -0,0 +1,115 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+// Extensions let forks add validation rules, endpoints, and notifiers
+// without changing the files of NodeAtlas itself. Because NodeAtlas
+// is a single main package, an extension is a file of its own, such
+// as "extension_local.go", which registers everything it adds from an
+// init function:
+//
+//     func init() {
+//         RegisterNodeValidator(func(node *Node) error {
+//             if node.Latitude < 40 {
+//                 return errors.New("outsideCity")
+//             }
+//             return nil
+//         })
+//         RegisterHandler("/api/local/", localHandler)
+//         RegisterNotifier(NotifierFunc(func(event string,
+//             data interface{}) {
+//             // ...
+//         }))
+//     }
+//
+// Registrations must be made before NodeAtlas starts, such as from
+// init functions, as they are not synchronized.
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// NodeValidator checks a local node before it is registered or
+// updated. If it returns an error, the node is refused, and the text
+// of the error is given to the client, so it should be a short code
+// in the style of the API's errors, such as "outsideCity".
+type NodeValidator func(node *Node) error
+
+// Notifier is told of every event for which hooks are run, such as
+// "node.created", with the same data, as in RunHooks. It is called
+// synchronously, so it must not block.
+type Notifier interface {
+	Notify(event string, data interface{})
+}
+
+// NotifierFunc is a function which is a Notifier.
+type NotifierFunc func(event string, data interface{})
+
+// Notify calls f.
+func (f NotifierFunc) Notify(event string, data interface{}) {
+	f(event, data)
+}
+
+var (
+	// nodeValidators are the validators added by
+	// RegisterNodeValidator.
+	nodeValidators []NodeValidator
+
+	// extensionHandlers maps patterns to the handlers added by
+	// RegisterHandler.
+	extensionHandlers = make(map[string]http.Handler)
+
+	// notifiers are the notifiers added by RegisterNotifier.
+	notifiers []Notifier
+)
+
+// RegisterNodeValidator adds a validator, which is checked after the
+// built-in checks, in the order of registration.
+func RegisterNodeValidator(v NodeValidator) {
+	nodeValidators = append(nodeValidators, v)
+}
+
+// RegisterHandler adds a handler for the given pattern, as with
+// http.Handle, which is served beneath Conf.Web.Prefix, such as
+// "/api/local/". It is served even in headless mode.
+func RegisterHandler(pattern string, handler http.Handler) {
+	extensionHandlers[pattern] = handler
+}
+
+// RegisterNotifier adds a notifier.
+func RegisterNotifier(n Notifier) {
+	notifiers = append(notifiers, n)
+}
+
+// ValidateNode checks the node with every registered validator, and
+// returns the first error.
+func ValidateNode(node *Node) error {
+	for _, v := range nodeValidators {
+		if err := v(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegisterExtensionHandlers invokes http.Handle() for every handler
+// added by RegisterHandler, beneath the given prefix.
+func RegisterExtensionHandlers(prefix string) {
+	for pattern, handler := range extensionHandlers {
+		p := path.Join("/", prefix, pattern)
+		if strings.HasSuffix(pattern, "/") {
+			p += "/"
+		}
+		http.Handle(p, handler)
+	}
+}
+
+// notify tells every registered notifier of the event.
+func notify(event string, data interface{}) {
+	for _, n := range notifiers {
+		n.Notify(event, data)
+	}
+}
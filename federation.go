@@ -0,0 +1,755 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/coocood/jas"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// pushDelay is the length of time for which changes are
+	// collected before parent maps are notified of them.
+	pushDelay = 10 * time.Second
+
+	// pushMaxSkew is the greatest difference between the time of a
+	// change notification and the time at which it is received.
+	pushMaxSkew = 5 * time.Minute
+
+	// cacheUpdateInterval is the shortest length of time between
+	// updates of the cache which are requested by child maps.
+	cacheUpdateInterval = 30 * time.Second
+)
+
+// Federation is the JAS resource which serves the federation API, at
+// "/api/federation/<name>".
+type Federation struct{}
+
+// ParentMap is a map which pulls nodes from this one, as one of its
+// ChildMaps, and which is notified when they change.
+type ParentMap struct {
+	// Address is the address of the parent map, such as
+	// "https://atlas.example.org".
+	Address string
+
+	// Secret is shared with the parent map, which has it in its
+	// PushSecrets, and is used to sign notifications.
+	Secret string
+}
+
+// pushClient is the HTTP client used to notify parent maps.
+var pushClient = &http.Client{Timeout: 30 * time.Second}
+
+// PushSignature returns the signature of a change notification from
+// the map at the given address at the given Unix time, which is the
+// hex-encoded HMAC-SHA256 of "<address>\n<time>" with the secret.
+func PushSignature(secret, address string, t int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(address + "\n" + strconv.FormatInt(t, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// StartPushNotifications notifies every map in Conf.ParentMaps,
+// shortly after the local nodes change, in a new goroutine, so that
+// they can pull the changes immediately rather than at their next
+// heartbeat.
+func StartPushNotifications() {
+	if len(Conf.ParentMaps) == 0 {
+		return
+	}
+	go func() {
+		last := localNodesDigest()
+		changed := NodeChanges.Wait()
+		for {
+			<-changed
+			// Collect any further changes before notifying, and
+			// ignore changes which only affected cached nodes.
+			time.Sleep(pushDelay)
+			changed = NodeChanges.Wait()
+			digest := localNodesDigest()
+			if digest == last {
+				continue
+			}
+			last = digest
+
+			// Notifications are queued, so that they are retried if
+			// the parent can't be reached. Only the address is
+			// stored, not the secret.
+			for _, p := range Conf.ParentMaps {
+				if err := Enqueue("federation.notify", p.Address); err != nil {
+					fedLog.With("parent", p.Address).Errf(
+						"Queueing notification of %q produced: %s",
+						p.Address, err)
+				}
+			}
+		}
+	}()
+}
+
+// localNodesDigest returns a digest of every local node, so that
+// changes to them can be noticed. If there is an error, it is logged,
+// and an empty string is returned.
+func localNodesDigest() string {
+	nodes, err := Db.DumpLocal()
+	if err != nil {
+		dbLog.Errf("Error dumping local nodes: %s", err)
+		return ""
+	}
+	b, err := json.Marshal(nodes)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// NotifyParent sends a signed change notification to the parent map,
+// within ctx.
+func NotifyParent(ctx context.Context, p ParentMap) error {
+	address := BaseURL(nil)
+	now := time.Now().Unix()
+	form := url.Values{
+		"address":   {address},
+		"time":      {strconv.FormatInt(now, 10)},
+		"signature": {PushSignature(p.Secret, address, now)},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		strings.TrimRight(p.Address, "/")+"/api/federation/changed",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// notifyQueuedParent notifies the parent map whose address is the
+// payload of changes, as by NotifyParent. If the parent is no longer
+// configured, there is nothing to do.
+func notifyQueuedParent(payload []byte) error {
+	var address string
+	if err := json.Unmarshal(payload, &address); err != nil {
+		return err
+	}
+	for _, p := range Conf.ParentMaps {
+		if p.Address == address {
+			return NotifyParent(serverContext, p)
+		}
+	}
+	return nil
+}
+
+// isChildMap returns true if the address is one of the configured
+// ChildMaps of the main map or of any SubMap, or an approved
+// registered child map.
+func isChildMap(address string) bool {
+	_, ok := childMapOf(address)
+	return ok
+}
+
+// childMapOf returns the ID of the map of which the map at the given
+// address is a child map, which is empty for the main map, and true
+// if it is one.
+func childMapOf(address string) (mapID string, ok bool) {
+	registered, err := Db.ApprovedChildMaps()
+	if err != nil {
+		dbLog.Errf("Error listing registered child maps: %s", err)
+	}
+	for _, a := range append(registered, Conf.ChildMaps...) {
+		if a == address {
+			return "", true
+		}
+	}
+	for _, m := range Conf.Maps {
+		for _, a := range m.ChildMaps {
+			if a == address {
+				return m.ID, true
+			}
+		}
+	}
+	return "", false
+}
+
+// PostChanged accepts a change notification from the child map at
+// `address`, which is signed with its secret in Conf.PushSecrets as
+// `signature`, at the Unix `time`. The cache is then updated shortly.
+func (*Federation) PostChanged(ctx *jas.Context) {
+	address := ctx.RequireString("address")
+	t := ctx.RequireInt("time")
+	signature := ctx.RequireString("signature")
+
+	secret, ok := Conf.PushSecrets[address]
+	if !ok || len(secret) == 0 || !isChildMap(address) {
+		ctx.Error = jas.NewRequestError("unknownChildMap")
+		return
+	}
+	if skew := time.Since(time.Unix(t, 0)); skew > pushMaxSkew ||
+		skew < -pushMaxSkew {
+		ctx.Error = jas.NewRequestError("timeInvalid")
+		return
+	}
+	if !hmac.Equal([]byte(signature),
+		[]byte(PushSignature(secret, address, t))) {
+		ctx.Error = jas.NewRequestError("signatureInvalid")
+		return
+	}
+
+	fedLog.Request(ctx.Request).With("source",
+		address).Debugf("Notified of changes by %q\n",
+		address)
+	RequestChildMapUpdate(address)
+	ctx.Data = "successful"
+}
+
+// changeLimiter limits how often the changes of each child map are
+// retrieved on its notification.
+var changeLimiter = NewSharedRateLimiter("changes",
+	1/cacheUpdateInterval.Seconds(), 1)
+
+// RequestChildMapUpdate retrieves the changes of the child map at the
+// given address in the background, as with UpdateChildMapChanges. If
+// that has been done too recently, or fails, the whole cache is
+// updated instead, as with RequestCacheUpdate.
+func RequestChildMapUpdate(address string) {
+	if !changeLimiter.Allow(address) {
+		RequestCacheUpdate()
+		return
+	}
+	go func() {
+		if _, err := UpdateChildMapChanges(serverContext,
+			address); err != nil {
+			fedLog.With("source", address).Errf(
+				"Error updating changes of %q: %s", address, err)
+			RequestCacheUpdate()
+		}
+	}()
+}
+
+var (
+	cacheUpdates    = make(chan struct{}, 1)
+	cacheUpdateOnce sync.Once
+)
+
+// RequestCacheUpdate updates the cache in the background, as
+// UpdateMapCache does at every heartbeat. Requests which are made
+// while an update is waiting are combined with it, and updates are
+// made at most once every cacheUpdateInterval.
+func RequestCacheUpdate() {
+	cacheUpdateOnce.Do(func() {
+		go func() {
+			for range cacheUpdates {
+				UpdateMapCache(serverContext)
+				time.Sleep(cacheUpdateInterval)
+			}
+		}()
+	})
+	select {
+	case cacheUpdates <- struct{}{}:
+	default:
+	}
+}
+
+// Registration states of maps in cached_maps. Maps which were
+// discovered through ChildMaps have no registration.
+const (
+	RegistrationNone = iota
+	RegistrationPending
+	RegistrationApproved
+)
+
+// Registration is a child map which has registered itself.
+type Registration struct {
+	ID             int
+	Hostname, Name string
+	Approved       bool
+}
+
+// registrationLimiter limits how often each address may register a
+// child map, since each registration makes the map fetch another.
+var registrationLimiter = NewSharedRateLimiter("registrations", 1.0/60, 3)
+
+// NonPublicAddressError is returned by registrationClient when it is
+// asked to connect to an address which isPublicAddress rejects.
+var NonPublicAddressError = errors.New("address is not public")
+
+// nonPublicNetworks are the networks to which registrationClient won't
+// connect: those of the host itself, private networks, and those which
+// are not unicast. fc00::/8 is left out, because it is used by cjdns
+// meshes, whose maps are reachable only there.
+var nonPublicNetworks = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+	"169.254.0.0/16", "172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16",
+	"198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fd00::/8", "fe80::/10", "ff00::/8")
+
+// parseCIDRs parses the given networks, and panics if any is invalid.
+func parseCIDRs(cidrs ...string) (networks []*net.IPNet) {
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return
+}
+
+// isPublicAddress returns true if the address is not in any of the
+// nonPublicNetworks.
+func isPublicAddress(ip net.IP) bool {
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// registrationClient is the client with which maps which register
+// themselves are verified. Since anyone may register a map, it only
+// connects to public addresses, so that it can't be used to reach
+// hosts on the server's own network. The address is checked as it is
+// dialed, so that neither redirects nor names which resolve to other
+// addresses get around it, and no proxy is used.
+var registrationClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string,
+				_ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil ||
+					!isPublicAddress(ip) {
+					return NonPublicAddressError
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+}
+
+// RegisterChildMap records the map at the given address as pending
+// approval.
+func (db DB) RegisterChildMap(hostname, name string) (err error) {
+	res, err := db.Exec(`UPDATE cached_maps
+SET name = ?, registration = ?
+WHERE hostname = ?;`, name, RegistrationPending, hostname)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return
+	}
+	_, err = db.Exec(`INSERT INTO cached_maps
+(hostname, name, registration) VALUES(?, ?, ?);`,
+		hostname, name, RegistrationPending)
+	return
+}
+
+// SetRegistration sets the registration state of the registered child
+// map with the given address. If there is no such map, it returns
+// sql.ErrNoRows.
+func (db DB) SetRegistration(hostname string, state int) (err error) {
+	res, err := db.Exec(`UPDATE cached_maps
+SET registration = ?
+WHERE hostname = ? AND registration != ?;`,
+		state, hostname, RegistrationNone)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return
+}
+
+// RemoveRegistration removes the registered child map with the given
+// address, and every node which was cached from it, so that it can be
+// registered again. If there is no such map, it returns sql.ErrNoRows.
+func (db DB) RemoveRegistration(hostname string) (err error) {
+	if err = db.UncacheChildMap(hostname); err != nil {
+		return
+	}
+	res, err := db.Exec(`DELETE FROM cached_maps
+WHERE hostname = ? AND registration != ?;`, hostname, RegistrationNone)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return
+}
+
+// Registrations returns every child map which has registered itself,
+// whether or not it has been approved.
+func (db DB) Registrations() (registrations []*Registration, err error) {
+	rows, err := db.Query(`SELECT id,hostname,name,registration
+FROM cached_maps
+WHERE registration != ?;`, RegistrationNone)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	registrations = make([]*Registration, 0)
+	for rows.Next() {
+		r := new(Registration)
+		var state int
+		if err = rows.Scan(&r.ID, &r.Hostname, &r.Name, &state); err != nil {
+			return
+		}
+		r.Approved = state == RegistrationApproved
+		registrations = append(registrations, r)
+	}
+	return registrations, rows.Err()
+}
+
+// ApprovedChildMaps returns the addresses of every registered child
+// map which has been approved.
+func (db DB) ApprovedChildMaps() (addresses []string, err error) {
+	rows, err := db.Query(`SELECT hostname
+FROM cached_maps
+WHERE registration = ?;`, RegistrationApproved)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var address string
+		if err = rows.Scan(&address); err != nil {
+			return
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, rows.Err()
+}
+
+// PostRegister registers the map at the given `hostname`, such as
+// "https://atlas.example.org", as a child map, pending approval by an
+// admin. The map must serve /api/all, which is fetched once to verify
+// it. Once approved, it is cached as one of the ChildMaps of the main
+// map.
+func (*Federation) PostRegister(ctx *jas.Context) {
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	db := Db.WithContext(ctx.Request.Context())
+	hostname := strings.TrimRight(ctx.RequireStringLen(1, 255, "hostname"),
+		"/")
+	u, err := url.Parse(hostname)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		len(u.Host) == 0 {
+		ctx.Error = jas.NewRequestError("hostnameInvalid")
+		return
+	}
+	if isChildMap(hostname) {
+		ctx.Error = jas.NewRequestError("alreadyRegistered")
+		return
+	}
+	filter, err := db.SourceFilter()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error loading source filter: %s", err)
+		return
+	}
+	if !filter.IsAllowed(hostname) {
+		ctx.Error = jas.NewRequestError("hostnameBlocked")
+		return
+	}
+	registrations, err := db.Registrations()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error listing registrations: %s", err)
+		return
+	}
+	for _, r := range registrations {
+		if r.Hostname == hostname {
+			ctx.Error = jas.NewRequestError("alreadyRegistered")
+			return
+		}
+	}
+	if !registrationLimiter.Allow(ctx.RemoteAddr) {
+		ctx.Error = jas.NewRequestError("tooManyRequests")
+		return
+	}
+
+	// Verify that the map is reachable and serves nodes. The reason it
+	// isn't is only logged, so that registrations can't be used to
+	// probe other hosts.
+	_, _, err = fetchJSONNodes(ctx.Request.Context(), registrationClient,
+		hostname, time.Time{})
+	if err != nil {
+		ctx.Error = jas.NewRequestError("mapUnreachable")
+		fedLog.Request(ctx.Request).With("source", hostname).Infof(
+			"Registration of %q failed: %s\n", hostname, err)
+		return
+	}
+	name, _ := getMapStatus(ctx.Request.Context(), registrationClient,
+		hostname)["Name"].(string)
+
+	if err = db.RegisterChildMap(hostname, name); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error registering child map %q: %s",
+			hostname, err)
+		return
+	}
+	fedLog.Request(ctx.Request).With("source", hostname).Noticef(
+		"Child map %q registered, pending approval\n", hostname)
+	ctx.Data = "pending"
+}
+
+// GetRegistrations returns every child map which has registered
+// itself, and whether it has been approved. It is only available to
+// admins.
+func (*Federation) GetRegistrations(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	var err error
+	if ctx.Data, err = db.Registrations(); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error listing registrations: %s", err)
+	}
+}
+
+// PostApprove approves the registered child map with the given
+// `hostname`, so that it is cached from the next heartbeat. If
+// `reject` is set, the registration is removed instead, as by
+// RemoveRegistration. It is only available to admins.
+func (*Federation) PostApprove(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	hostname := ctx.RequireString("hostname")
+	reject, _ := ctx.FindBool("reject")
+
+	var err error
+	if reject {
+		err = db.RemoveRegistration(hostname)
+	} else {
+		err = db.SetRegistration(hostname, RegistrationApproved)
+	}
+	if err == sql.ErrNoRows {
+		ctx.Error = jas.NewRequestError("no matching registration")
+		return
+	} else if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error approving child map %q: %s",
+			hostname, err)
+		return
+	}
+	if !reject {
+		RequestCacheUpdate()
+	}
+	ctx.Data = "successful"
+}
+
+// ChildMapStatus is the state of a child map, as of the most recent
+// attempt to cache it.
+type ChildMapStatus struct {
+	Hostname string
+
+	// MapID is the ID of the SubMap to which the child map belongs,
+	// or empty for the main map.
+	MapID string `json:",omitempty"`
+
+	// Registered is true if the child map registered itself, rather
+	// than being configured.
+	Registered bool `json:",omitempty"`
+
+	// OK is true if the most recent attempt succeeded.
+	OK bool
+
+	// LastAttempt and LastSuccess are the times of the most recent
+	// attempt and success, which are nil if there have been none.
+	LastAttempt *time.Time `json:",omitempty"`
+	LastSuccess *time.Time `json:",omitempty"`
+
+	// Nodes is the number of nodes retrieved by the most recent
+	// success, including those from the map's own child maps.
+	Nodes int
+
+	// LatencyMs is the length of time which the most recent attempt
+	// took, in milliseconds.
+	LatencyMs int64
+
+	// LastError is the error of the most recent attempt, if it
+	// failed.
+	LastError string `json:",omitempty"`
+}
+
+// RecordFetch records an attempt to cache the child map at the given
+// address, which took the given length of time and retrieved the
+// given number of nodes, or failed with the given error. The number
+// of nodes and time of the last success are kept after a failure, and
+// the number of nodes is kept if it is negative. Errors are logged.
+func (db DB) RecordFetch(hostname string, latency time.Duration, nodes int, fetchErr error) {
+	now := time.Now().Unix()
+	ms := int64(latency / time.Millisecond)
+	var res sql.Result
+	var err error
+	if fetchErr == nil && nodes < 0 {
+		nodes = 0
+		res, err = db.Exec(`UPDATE map_fetches
+SET attempted = ?, succeeded = ?, latency = ?, error = ''
+WHERE hostname = ?;`, now, now, ms, hostname)
+	} else if fetchErr == nil {
+		res, err = db.Exec(`UPDATE map_fetches
+SET attempted = ?, succeeded = ?, latency = ?, nodes = ?, error = ''
+WHERE hostname = ?;`, now, now, ms, nodes, hostname)
+	} else {
+		res, err = db.Exec(`UPDATE map_fetches
+SET attempted = ?, latency = ?, error = ?
+WHERE hostname = ?;`, now, ms, truncate(fetchErr.Error(), 255), hostname)
+	}
+	if err == nil {
+		if n, _ := res.RowsAffected(); n == 0 {
+			var succeeded int64
+			errString := ""
+			if fetchErr == nil {
+				succeeded = now
+			} else {
+				errString = truncate(fetchErr.Error(), 255)
+			}
+			_, err = db.Exec(`INSERT INTO map_fetches
+(hostname, attempted, succeeded, latency, nodes, error)
+VALUES(?, ?, ?, ?, ?, ?);`, hostname, now, succeeded, ms, nodes,
+				errString)
+		}
+	}
+	if err != nil {
+		dbLog.Errf("Error recording fetch of %q: %s", hostname, err)
+	}
+}
+
+// truncate returns at most the first n bytes of s.
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// ChildMapStatuses returns the state of every child map of the main
+// map and of every SubMap, and of every approved registered child
+// map, in that order.
+func (db DB) ChildMapStatuses() (statuses []*ChildMapStatus, err error) {
+	statuses = make([]*ChildMapStatus, 0)
+	for _, a := range Conf.ChildMaps {
+		statuses = append(statuses, &ChildMapStatus{Hostname: a})
+	}
+	for _, m := range Conf.Maps {
+		for _, a := range m.ChildMaps {
+			statuses = append(statuses,
+				&ChildMapStatus{Hostname: a, MapID: m.ID})
+		}
+	}
+	registered, err := db.ApprovedChildMaps()
+	if err != nil {
+		return
+	}
+	for _, a := range registered {
+		statuses = append(statuses,
+			&ChildMapStatus{Hostname: a, Registered: true})
+	}
+
+	for _, s := range statuses {
+		var attempted, succeeded int64
+		err = db.QueryRow(`SELECT attempted,succeeded,latency,nodes,error
+FROM map_fetches
+WHERE hostname = ?;`, s.Hostname).Scan(&attempted, &succeeded,
+			&s.LatencyMs, &s.Nodes, &s.LastError)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return
+		}
+		t := time.Unix(attempted, 0)
+		s.LastAttempt = &t
+		if succeeded > 0 {
+			t := time.Unix(succeeded, 0)
+			s.LastSuccess = &t
+		}
+		s.OK = len(s.LastError) == 0
+	}
+	return statuses, nil
+}
+
+// GetStatus returns the state of every child map, as of the most
+// recent attempt to cache it, so that broken peers can be found. It
+// is only available to admins.
+func (*Federation) GetStatus(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	var err error
+	if ctx.Data, err = db.ChildMapStatuses(); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error getting federation status: %s",
+			err)
+	}
+}
+
+// HandleFederationPage serves a page showing the state of every child
+// map, using the "federation.html" template. It is only available to
+// admins.
+func HandleFederationPage(w http.ResponseWriter, req *http.Request) {
+	db := Db.WithContext(req.Context())
+	if !IsAdmin(req) {
+		http.Error(w, http.StatusText(http.StatusForbidden),
+			http.StatusForbidden)
+		return
+	}
+	statuses, err := db.ChildMapStatuses()
+	if err != nil {
+		dbLog.Request(req).Errf("Error getting federation status: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+
+	lang := NegotiateLocale(req)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", lang)
+	err = ExecuteLocalized(pages, w, "federation.html", lang,
+		map[string]interface{}{
+			"Conf":       Conf,
+			"ChildMaps":  statuses,
+			"Duplicates": Duplicates(),
+		})
+	if err != nil {
+		l.Errf("Error executing federation page template: %s", err)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"html"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultFeedMaxAge is the length of time for which nodes appear
+	// in the activity feed after they are added or activated, if
+	// Conf.Web.RSS.MaxAge is not set.
+	DefaultFeedMaxAge = 30 * 24 * time.Hour
+
+	// FeedMaxEntries is the greatest number of entries in the
+	// activity feed.
+	FeedMaxEntries = 100
+)
+
+// FeedEvent is something which happened to a local node, and which
+// appears in the activity feed.
+type FeedEvent struct {
+	Addr      IP
+	OwnerName string
+
+	// Kind is "added" or "activated".
+	Kind string
+	Time time.Time
+}
+
+// feedEvents sorts FeedEvents by time, most recent first.
+type feedEvents []*FeedEvent
+
+func (e feedEvents) Len() int           { return len(e) }
+func (e feedEvents) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e feedEvents) Less(i, j int) bool { return e[i].Time.After(e[j].Time) }
+
+// FeedEvents returns the local nodes which were added or activated
+// since the given time, as recorded in their status history, most
+// recent first. A node is added when its first status is recorded,
+// and activated when its status gains StatusActive. If a node's
+// earlier history was removed, as by Retention.StatusHistory, it
+// appears to have been added at its earliest remaining change.
+func (db DB) FeedEvents(since time.Time) (events []*FeedEvent, err error) {
+	rows, err := db.Query(`SELECT
+status_history.address,nodes.owner,status_history.status,
+status_history.changed
+FROM status_history
+INNER JOIN nodes ON status_history.address = nodes.address
+WHERE status_history.address IN (SELECT address FROM status_history
+WHERE changed >= ?)
+ORDER BY status_history.address, status_history.changed;`, since.Unix())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	events = make([]*FeedEvent, 0)
+	var last IP
+	var lastStatus uint32
+	for rows.Next() {
+		var addr IP
+		var owner string
+		var status uint32
+		var changed int64
+		if err = rows.Scan(&addr, &owner, &status, &changed); err != nil {
+			return
+		}
+		first := last == nil || addr.String() != last.String()
+		t := time.Unix(changed, 0)
+
+		var kind string
+		if first {
+			kind = "added"
+		} else if lastStatus&StatusActive == 0 && status&StatusActive != 0 {
+			kind = "activated"
+		}
+		if len(kind) > 0 && !t.Before(since) {
+			events = append(events, &FeedEvent{addr, owner, kind, t})
+		}
+		last, lastStatus = addr, status
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	sort.Sort(feedEvents(events))
+	return
+}
+
+// atomFeed, atomEntry, and atomLink are the parts of an Atom feed, as
+// in RFC 4287.
+type atomFeed struct {
+	XMLName xml.Name     `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string       `xml:"title"`
+	ID      string       `xml:"id"`
+	Updated string       `xml:"updated"`
+	Links   []*atomLink  `xml:"link"`
+	Author  string       `xml:"author>name"`
+	Entries []*atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	Title   string    `xml:"title"`
+	ID      string    `xml:"id"`
+	Updated string    `xml:"updated"`
+	Link    *atomLink `xml:"link"`
+	Summary string    `xml:"summary"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+// HandleFeed serves an Atom feed of the local nodes which were
+// recently added or activated, with links to their pages, so that the
+// growth of the map can be followed in a feed reader. Nodes appear in
+// it for Conf.Web.RSS.MaxAge, or DefaultFeedMaxAge.
+func HandleFeed(w http.ResponseWriter, r *http.Request) {
+	db := Db.WithContext(r.Context())
+	maxAge := time.Duration(Conf.Web.RSS.MaxAge)
+	if maxAge <= 0 {
+		maxAge = DefaultFeedMaxAge
+	}
+	events, err := db.FeedEvents(time.Now().Add(-maxAge))
+	if err != nil {
+		dbLog.Request(r).Errf("Error getting feed events: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	if len(events) > FeedMaxEntries {
+		events = events[:FeedMaxEntries]
+	}
+
+	base := strings.TrimRight(BaseURL(r), "/")
+	feed := &atomFeed{
+		Title:   Conf.Name + " NodeAtlas",
+		ID:      base + "/feed.atom",
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Links: []*atomLink{
+			{Rel: "self", Href: base + "/feed.atom"},
+			{Href: PageURL(r) + "/"},
+		},
+		Author:  Conf.Name,
+		Entries: make([]*atomEntry, 0, len(events)),
+	}
+	if len(events) > 0 {
+		feed.Updated = events[0].Time.UTC().Format(time.RFC3339)
+	}
+	for _, e := range events {
+		owner := html.UnescapeString(e.OwnerName)
+		link := NodePageURL(r, e.Addr)
+		entry := &atomEntry{
+			ID: link + "#" + e.Kind + "-" +
+				e.Time.UTC().Format(icalTimeFormat),
+			Updated: e.Time.UTC().Format(time.RFC3339),
+			Link:    &atomLink{Href: link},
+		}
+		if e.Kind == "added" {
+			entry.Title = "New node: " + owner
+			entry.Summary = owner + " added the node " +
+				e.Addr.String() + " to the map."
+		} else {
+			entry.Title = "Node activated: " + owner
+			entry.Summary = "The node " + e.Addr.String() + " of " +
+				owner + " is now active."
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	writeAtom(w, feed)
+}
+
+// writeAtom writes the feed as an XML document, and logs any errors.
+func writeAtom(w http.ResponseWriter, feed *atomFeed) {
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		l.Errf("Error writing feed: %s", err)
+	}
+}
+
+// nodeFeedItem is an entry in the feed of a single node, which is
+// either a change of its status or a comment on it.
+type nodeFeedItem struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Title     string    `json:"title"`
+	Text      string    `json:"content_text"`
+	Time      time.Time `json:"-"`
+	Published string    `json:"date_published"`
+}
+
+// nodeFeedItems sorts nodeFeedItems by time, most recent first.
+type nodeFeedItems []*nodeFeedItem
+
+func (f nodeFeedItems) Len() int           { return len(f) }
+func (f nodeFeedItems) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f nodeFeedItems) Less(i, j int) bool { return f[i].Time.After(f[j].Time) }
+
+// HandleNodeFeed serves a feed of the status changes of, and visible
+// comments on, the local node with the given address, most recent
+// first, so that its owner can follow it without email. It is an Atom
+// feed, unless `format` is "json", in which case it is a JSON Feed.
+// Status names are translated into the negotiated locale.
+func HandleNodeFeed(w http.ResponseWriter, r *http.Request, addr IP) {
+	db := Db.WithContext(r.Context())
+	node, err := db.GetLocalNode(addr)
+	if err == LocalNodeNotFoundError {
+		// Only local nodes have histories and comments.
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		l.Errf("Error getting node %q: %s", addr, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	history, err := db.StatusHistory(addr)
+	var comments []*Comment
+	if err == nil {
+		comments, err = db.Comments(addr, false)
+	}
+	if err != nil {
+		dbLog.Request(r).Errf("Error getting feed of %q: %s", addr, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+
+	base := strings.TrimRight(BaseURL(r), "/")
+	page := NodePageURL(r, addr)
+	owner := html.UnescapeString(node.OwnerName)
+	lang := NegotiateLocale(r)
+	items := make([]*nodeFeedItem, 0, len(history)+len(comments))
+	for _, change := range history {
+		status := strings.Join(StatusText(Translations, lang,
+			change.Status), ", ")
+		items = append(items, &nodeFeedItem{
+			ID: page + "#status-" +
+				change.Time.UTC().Format(icalTimeFormat),
+			URL:   page,
+			Title: status,
+			Text:  owner + "'s node is now " + status + ".",
+			Time:  change.Time,
+		})
+	}
+	for _, c := range comments {
+		items = append(items, &nodeFeedItem{
+			ID:    page + "#comment-" + strconv.FormatInt(c.ID, 10),
+			URL:   page,
+			Title: "Comment from " + html.UnescapeString(c.Author),
+			Text:  html.UnescapeString(c.Body),
+			Time:  c.Created,
+		})
+	}
+	sort.Sort(nodeFeedItems(items))
+	if len(items) > FeedMaxEntries {
+		items = items[:FeedMaxEntries]
+	}
+	for _, item := range items {
+		item.Published = item.Time.UTC().Format(time.RFC3339)
+	}
+
+	title := Conf.Name + " NodeAtlas: " + owner + " (" + addr.String() + ")"
+	self := base + "/node/" + addr.String() + "/feed"
+	if r.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/feed+json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"version":       "https://jsonfeed.org/version/1.1",
+			"title":         title,
+			"home_page_url": page,
+			"feed_url":      self + "?format=json",
+			"items":         items,
+		})
+		return
+	}
+
+	feed := &atomFeed{
+		Title:   title,
+		ID:      self,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Links: []*atomLink{
+			{Rel: "self", Href: self},
+			{Href: page},
+		},
+		Author:  Conf.Name,
+		Entries: make([]*atomEntry, 0, len(items)),
+	}
+	if len(items) > 0 {
+		feed.Updated = items[0].Published
+	}
+	for _, item := range items {
+		feed.Entries = append(feed.Entries, &atomEntry{
+			Title:   item.Title,
+			ID:      item.ID,
+			Updated: item.Published,
+			Link:    &atomLink{Href: item.URL},
+			Summary: item.Text,
+		})
+	}
+	writeAtom(w, feed)
+}
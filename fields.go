@@ -0,0 +1,150 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"encoding/json"
+	"github.com/coocood/jas"
+	"github.com/kpawlik/geojson"
+	"strings"
+)
+
+// nodeFieldNames maps the names which may be given as `fields` to the
+// names of the fields of Node as they are marshalled. Each field may
+// be given by its own name, in any case, or by a shorter one.
+var nodeFieldNames = map[string]string{
+	"addr":         "Addr",
+	"address":      "Addr",
+	"lat":          "Latitude",
+	"latitude":     "Latitude",
+	"lon":          "Longitude",
+	"lng":          "Longitude",
+	"longitude":    "Longitude",
+	"status":       "Status",
+	"name":         "OwnerName",
+	"ownername":    "OwnerName",
+	"contact":      "Contact",
+	"details":      "Details",
+	"pgp":          "PGP",
+	"map":          "MapID",
+	"mapid":        "MapID",
+	"neighborhood": "Neighborhood",
+	"via":          "Via",
+	"retrievetime": "RetrieveTime",
+	"version":      "Version",
+	"created":      "CreateTime",
+	"createtime":   "CreateTime",
+	"updated":      "UpdateTime",
+	"updatetime":   "UpdateTime",
+}
+
+// NodeFields is a set of the fields of Node, by their marshalled names,
+// to which a response is limited.
+type NodeFields map[string]bool
+
+// ParseNodeFields parses a comma-separated list of the names in
+// nodeFieldNames, such as "addr,lat,lon,status". If any name is not
+// known, it returns false.
+func ParseNodeFields(s string) (fields NodeFields, ok bool) {
+	fields = make(NodeFields)
+	for _, name := range strings.Split(s, ",") {
+		field, ok := nodeFieldNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, false
+		}
+		fields[field] = true
+	}
+	return fields, true
+}
+
+// FindNodeFields returns the fields given by the form value `fields`,
+// or nil if it is not given, in which case responses should not be
+// limited. It panics with "fieldsInvalid" if any field is not known.
+func FindNodeFields(ctx *jas.Context) NodeFields {
+	ctx.ParseForm()
+	if _, ok := ctx.Form["fields"]; !ok {
+		return nil
+	}
+	fields, ok := ParseNodeFields(ctx.Form.Get("fields"))
+	if !ok {
+		panic(jas.NewRequestError("fieldsInvalid"))
+	}
+	return fields
+}
+
+// Node returns the node as it is marshalled, but with only the given
+// fields. Fields which are omitted when empty are still left out.
+func (fields NodeFields) Node(node *Node) (map[string]json.RawMessage,
+	error) {
+	b, err := json.Marshal(node)
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	sparse := make(map[string]json.RawMessage, len(fields))
+	for name, value := range all {
+		if fields[name] {
+			sparse[name] = value
+		}
+	}
+	return sparse, nil
+}
+
+// Nodes returns each of the nodes with only the given fields, as with
+// Node.
+func (fields NodeFields) Nodes(nodes []*Node) (
+	sparse []map[string]json.RawMessage, err error) {
+	sparse = make([]map[string]json.RawMessage, len(nodes))
+	for i, node := range nodes {
+		if sparse[i], err = fields.Node(node); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// NearNodes returns each of the nodes found by SpatialIndex.Near with
+// only the given fields and its distance.
+func (fields NodeFields) NearNodes(near []NearNode) (
+	sparse []map[string]json.RawMessage, err error) {
+	sparse = make([]map[string]json.RawMessage, len(near))
+	for i, n := range near {
+		if sparse[i], err = fields.Node(n.Node); err != nil {
+			return nil, err
+		}
+		if sparse[i]["Distance"], err = json.Marshal(n.Distance); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// SourceMaps returns the nodes of each source, as given by
+// CacheFormatNodes, with only the given fields.
+func (fields NodeFields) SourceMaps(sourceMaps map[string][]*Node) (
+	sparse map[string][]map[string]json.RawMessage, err error) {
+	sparse = make(map[string][]map[string]json.RawMessage, len(sourceMaps))
+	for source, nodes := range sourceMaps {
+		if sparse[source], err = fields.Nodes(nodes); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// FeatureCollection removes the properties of each feature which are
+// not among the given fields. The geometry and ID of each are kept, so
+// that it can still be placed.
+func (fields NodeFields) FeatureCollection(fc *geojson.FeatureCollection) {
+	for _, f := range fc.Features {
+		for name := range f.Properties {
+			if !fields[name] {
+				delete(f.Properties, name)
+			}
+		}
+	}
+}
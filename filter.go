@@ -0,0 +1,331 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"github.com/coocood/jas"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// NodeFilter selects the local and cached nodes which are given by the
+// node list endpoints, such as /api/all. Every condition which is set
+// must be met. A nil filter selects every node.
+type NodeFilter struct {
+	// Sources, if not empty, are the IDs of the only sources whose
+	// nodes are selected, as in Node.SourceID. Local nodes are 0.
+	Sources []int
+
+	// ExcludeSources are the IDs of sources whose nodes are never
+	// selected.
+	ExcludeSources []int
+
+	// Statuses, if not empty, are the names of statuses, as in
+	// StatusFilters, of which every selected node has at least one.
+	Statuses []string
+
+	// CreatedAfter and UpdatedAfter, if not zero, are the times at or
+	// after which selected nodes were created or last updated, as in
+	// Node.CreateTime and Node.UpdateTime. Nodes whose times are not
+	// known are never selected by them.
+	CreatedAfter, UpdatedAfter time.Time
+}
+
+// StatusFilter is a status which nodes have if their status flags,
+// masked by Mask, are Value.
+type StatusFilter struct {
+	Mask, Value uint32
+}
+
+// Has returns true if the status flags have the status.
+func (s StatusFilter) Has(status uint32) bool {
+	return status&s.Mask == s.Value
+}
+
+// StatusFilters are the statuses by which nodes can be selected and
+// counted, by name, as in StatusNames.
+var StatusFilters = map[string]StatusFilter{
+	"active":   {StatusActive, StatusActive},
+	"planned":  {StatusActive, 0},
+	"physical": {StatusPhysical, StatusPhysical},
+	"virtual":  {StatusPhysical, 0},
+	"internet": {StatusInternet, StatusInternet},
+	"wireless": {StatusWireless, StatusWireless},
+	"wired":    {StatusWired, StatusWired},
+	"pingable": {StatusPingable, StatusPingable},
+	"down":     {StatusActive | StatusPingable, StatusActive},
+}
+
+// StatusCounts returns the number of the given nodes which have each of
+// the statuses in StatusFilters, by name. Every name is included.
+func StatusCounts(nodes []*Node) map[string]int {
+	counts := make(map[string]int, len(StatusFilters))
+	for name, s := range StatusFilters {
+		counts[name] = 0
+		for _, n := range nodes {
+			if n != nil && s.Has(n.Status) {
+				counts[name]++
+			}
+		}
+	}
+	return counts
+}
+
+// WithoutStatuses returns a copy of the filter which does not select
+// nodes by their statuses, so that the statuses of the nodes it selects
+// can be counted, even those which the filter leaves out. If nodes
+// would not be selected by anything else, it returns nil.
+func (f *NodeFilter) WithoutStatuses() *NodeFilter {
+	if f == nil || len(f.Sources) == 0 && len(f.ExcludeSources) == 0 &&
+		!f.dated() {
+		return nil
+	}
+	copied := *f
+	copied.Statuses = nil
+	return &copied
+}
+
+// dated returns true if the filter selects nodes by when they were
+// created or updated.
+func (f *NodeFilter) dated() bool {
+	return !f.CreatedAfter.IsZero() || !f.UpdatedAfter.IsZero()
+}
+
+// hasSource returns true if the ID is among the given IDs.
+func hasSource(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns true if the node is selected by the filter. It is used
+// for nodes which are not read through the filter, such as those of
+// Index.
+func (f *NodeFilter) Match(node *Node) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Sources) > 0 && !hasSource(f.Sources, node.SourceID) ||
+		hasSource(f.ExcludeSources, node.SourceID) {
+		return false
+	}
+	if !f.CreatedAfter.IsZero() && node.CreateTime < f.CreatedAfter.Unix() ||
+		!f.UpdatedAfter.IsZero() && node.UpdateTime < f.UpdatedAfter.Unix() {
+		return false
+	}
+	if len(f.Statuses) == 0 {
+		return true
+	}
+	for _, name := range f.Statuses {
+		if StatusFilters[name].Has(node.Status) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter returns the given nodes which are selected by the filter.
+func (f *NodeFilter) Filter(nodes []*Node) []*Node {
+	if f == nil {
+		return nodes
+	}
+	filtered := make([]*Node, 0, len(nodes))
+	for _, n := range nodes {
+		if n != nil && f.Match(n) {
+			filtered = append(filtered, n)
+		}
+	}
+	return filtered
+}
+
+// conditions returns the conditions of the filter on the nodes table,
+// or the nodes_cached table if cached is true, as SQL, and their
+// arguments.
+func (f *NodeFilter) conditions(cached bool) (conditions []string,
+	args []interface{}) {
+	if f == nil {
+		return
+	}
+	if len(f.Statuses) > 0 {
+		statuses := make([]string, len(f.Statuses))
+		for i, name := range f.Statuses {
+			s := StatusFilters[name]
+			statuses[i] = "(status & ?) = ?"
+			args = append(args, s.Mask, s.Value)
+		}
+		conditions = append(conditions,
+			"("+strings.Join(statuses, " OR ")+")")
+	}
+	if !f.CreatedAfter.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, f.CreatedAfter.Unix())
+	}
+	if !f.UpdatedAfter.IsZero() {
+		conditions = append(conditions, "updated_at >= ?")
+		args = append(args, f.UpdatedAfter.Unix())
+	}
+	if !cached {
+		// Local nodes are either all selected by their source, or
+		// none are.
+		if len(f.Sources) > 0 && !hasSource(f.Sources, 0) ||
+			hasSource(f.ExcludeSources, 0) {
+			conditions = append(conditions, "1 = 0")
+		}
+		return
+	}
+
+	if len(f.Sources) > 0 {
+		conditions = append(conditions,
+			"source IN ("+placeholders(len(f.Sources))+")")
+		for _, id := range f.Sources {
+			args = append(args, id)
+		}
+	}
+	if len(f.ExcludeSources) > 0 {
+		conditions = append(conditions,
+			"source NOT IN ("+placeholders(len(f.ExcludeSources))+")")
+		for _, id := range f.ExcludeSources {
+			args = append(args, id)
+		}
+	}
+	return
+}
+
+// where returns the given conditions, followed by those of the filter
+// on the nodes table, or the nodes_cached table if cached is true, as
+// an SQL WHERE clause, and the arguments of the filter's conditions. If
+// there are no conditions, the clause is empty.
+func (f *NodeFilter) where(cached bool, conditions ...string) (
+	clause string, args []interface{}) {
+	own, args := f.conditions(cached)
+	conditions = append(conditions, own...)
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// placeholders returns n comma-separated SQL placeholders.
+func placeholders(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strings.Repeat("?,", n-1) + "?"
+}
+
+// parseSources returns the IDs of the comma-separated hostnames of
+// sources, as in the keys of /api/all, where "local" is 0. If any is
+// not known, it returns UnknownSourceError.
+func parseSources(values []string,
+	sourceToID map[string]int) (ids []int, err error) {
+	for _, value := range values {
+		for _, hostname := range strings.Split(value, ",") {
+			id, ok := sourceToID[strings.TrimSpace(hostname)]
+			if !ok {
+				return nil, UnknownSourceError
+			}
+			ids = append(ids, id)
+		}
+	}
+	return
+}
+
+// parseStatuses returns the comma-separated names of statuses in
+// StatusFilters. If any is not known, it returns "statusInvalid".
+func parseStatuses(values []string) (names []string, err error) {
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if _, ok := StatusFilters[name]; !ok {
+				return nil, jas.NewRequestError("statusInvalid")
+			}
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+// parseTime parses a time given as in RFC 3339, such as
+// "2014-03-01T12:00:00Z", or as a date, such as "2014-03-01", which is
+// taken to be midnight UTC. If it can't be parsed, it returns the
+// request error "<name>Invalid".
+func parseTime(name, value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, jas.NewRequestError(name + "Invalid")
+}
+
+// ParseNodeFilter returns the filter given by the form values of the
+// request, or nil if none is given. `source` selects only the nodes of
+// the given sources, and `exclude_source` leaves out those of the given
+// sources. Each is a comma-separated list of the hostnames of sources,
+// as in the keys of /api/all, and may be given more than once. If any
+// source is not known, it returns UnknownSourceError. `status` selects
+// only the nodes with any of the given statuses, such as
+// "active,planned", as named in StatusFilters, or else it returns
+// "statusInvalid". `created_after` and `updated_after` select only the
+// nodes created or updated at or after the given time, as parsed
+// by parseTime, or else it returns "created_afterInvalid" or
+// "updated_afterInvalid".
+func ParseNodeFilter(r *http.Request) (f *NodeFilter, err error) {
+	r.ParseForm()
+	include, exclude := r.Form["source"], r.Form["exclude_source"]
+	statuses := r.Form["status"]
+	created, updated := r.Form.Get("created_after"),
+		r.Form.Get("updated_after")
+	if len(include) == 0 && len(exclude) == 0 && len(statuses) == 0 &&
+		len(created) == 0 && len(updated) == 0 {
+		return nil, nil
+	}
+
+	f = new(NodeFilter)
+	if f.Statuses, err = parseStatuses(statuses); err != nil {
+		return nil, err
+	}
+	if len(created) > 0 {
+		if f.CreatedAfter, err = parseTime("created_after",
+			created); err != nil {
+			return nil, err
+		}
+	}
+	if len(updated) > 0 {
+		if f.UpdatedAfter, err = parseTime("updated_after",
+			updated); err != nil {
+			return nil, err
+		}
+	}
+	if len(include) == 0 && len(exclude) == 0 {
+		return
+	}
+	sourceToID, err := Db.WithContext(r.Context()).GetMapSourceToID()
+	if err != nil {
+		return nil, err
+	}
+	if f.Sources, err = parseSources(include, sourceToID); err != nil {
+		return nil, err
+	}
+	if f.ExcludeSources, err = parseSources(exclude,
+		sourceToID); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// FindNodeFilter returns the filter given by the form values of the
+// request, as with ParseNodeFilter, and panics with its error, if any.
+func FindNodeFilter(ctx *jas.Context) *NodeFilter {
+	f, err := ParseNodeFilter(ctx.Request)
+	if err != nil {
+		panic(apiError(ctx.Request, err))
+	}
+	return f
+}
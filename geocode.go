@@ -0,0 +1,162 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultGeocoderRate is the default maximum number of requests
+	// per second made to the geocoder. It is the limit set by the
+	// usage policy of the public Nominatim servers.
+	DefaultGeocoderRate = 1
+
+	// maxGeocoderWait is the longest that a request will wait for
+	// the geocoder rate limit before giving up.
+	maxGeocoderWait = time.Minute
+)
+
+var (
+	GeocoderDisabledError  = errors.New("geocoding is not configured")
+	GeocoderRateLimitError = errors.New("geocoder rate limit exceeded")
+	AddressNotFoundError   = errors.New("address not found")
+)
+
+var (
+	// geocoderClient is used to make requests to the geocoder.
+	geocoderClient = &http.Client{Timeout: 10 * time.Second}
+
+	// geocoderLimiter limits the rate of requests to the geocoder. It
+	// is created by initGeocoderLimiter.
+	geocoderLimiter     *RateLimiter
+	geocoderLimiterOnce sync.Once
+)
+
+// neighborhoodFields are the fields of a Nominatim address which are
+// used as the neighborhood name, in order of preference.
+var neighborhoodFields = []string{
+	"neighbourhood", "suburb", "quarter", "city_district",
+	"hamlet", "village", "town", "city",
+}
+
+// geocoderRequest makes a request to the given endpoint of the
+// configured geocoder and decodes the JSON response into v. It waits
+// for the rate limit if necessary.
+func geocoderRequest(endpoint string, query url.Values, v interface{}) (err error) {
+	if Conf.Geocoder == nil || len(Conf.Geocoder.URL) == 0 {
+		return GeocoderDisabledError
+	}
+	geocoderLimiterOnce.Do(func() {
+		rate := Conf.Geocoder.Rate
+		if rate <= 0 {
+			rate = DefaultGeocoderRate
+		}
+		geocoderLimiter = NewSharedRateLimiter("geocoder", rate, 1)
+	})
+	wait, ok := geocoderLimiter.Reserve("", maxGeocoderWait)
+	if !ok {
+		return GeocoderRateLimitError
+	}
+	time.Sleep(wait)
+
+	query.Set("format", "json")
+	if len(Conf.Geocoder.Email) > 0 {
+		query.Set("email", Conf.Geocoder.Email)
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(Conf.Geocoder.URL,
+		"/")+"/"+endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("User-Agent", "NodeAtlas/"+Version)
+
+	resp, err := geocoderClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("geocoder responded %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Geocode returns the coordinates of the given street address. If it
+// can't be found, AddressNotFoundError is returned.
+func Geocode(address string) (lat, lon float64, err error) {
+	var results []struct {
+		Lat, Lon string
+	}
+	err = geocoderRequest("search", url.Values{
+		"q":     {address},
+		"limit": {"1"},
+	}, &results)
+	if err != nil {
+		return
+	}
+	if len(results) == 0 {
+		return 0, 0, AddressNotFoundError
+	}
+
+	// Nominatim gives coordinates as strings.
+	if lat, err = strconv.ParseFloat(results[0].Lat, 64); err != nil {
+		return
+	}
+	lon, err = strconv.ParseFloat(results[0].Lon, 64)
+	return
+}
+
+// ReverseGeocode returns the name of the neighborhood containing the
+// given coordinates, or the nearest equivalent, such as the suburb or
+// village. If none is known, it returns an empty string.
+func ReverseGeocode(lat, lon float64) (neighborhood string, err error) {
+	var result struct {
+		Address map[string]string
+	}
+	err = geocoderRequest("reverse", url.Values{
+		"lat":            {strconv.FormatFloat(lat, 'f', -1, 64)},
+		"lon":            {strconv.FormatFloat(lon, 'f', -1, 64)},
+		"zoom":           {"16"},
+		"addressdetails": {"1"},
+	}, &result)
+	if err != nil {
+		return
+	}
+	for _, field := range neighborhoodFields {
+		if name := result.Address[field]; len(name) > 0 {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+// LocateNode reverse geocodes the node's coordinates in the
+// background, and stores the resulting neighborhood name in the
+// database. It does nothing if geocoding is disabled. Errors are
+// logged.
+func LocateNode(node *Node) {
+	if Conf.Geocoder == nil || len(Conf.Geocoder.URL) == 0 {
+		return
+	}
+	addr, lat, lon := node.Addr, node.Latitude, node.Longitude
+	go func() {
+		neighborhood, err := ReverseGeocode(lat, lon)
+		if err != nil {
+			l.Warningf("Error finding neighborhood of %q: %s", addr, err)
+			return
+		}
+		if err = Db.SetNeighborhood(addr, neighborhood); err != nil {
+			dbLog.Errf("Error storing neighborhood of %q: %s", addr, err)
+		}
+	}()
+}
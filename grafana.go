@@ -0,0 +1,222 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// defaultGrafanaDataPoints is the maximum number of points returned
+// for node counts if Grafana doesn't give one.
+const defaultGrafanaDataPoints = 1000
+
+// grafanaCounts are the names of the node count series, and the
+// statuses which a node must have to be counted in each.
+var grafanaCounts = []struct {
+	Name   string
+	Status uint32
+}{
+	{"nodes", 0},
+	{"nodes.active", StatusActive},
+	{"nodes.pingable", StatusPingable},
+}
+
+// grafanaMetrics are the suffixes of the per-node metric series, as
+// in "<address>/in_rate".
+var grafanaMetrics = []string{"in_rate", "out_rate", "clients"}
+
+// grafanaQuery is the body of a query from Grafana's JSON datasource.
+type grafanaQuery struct {
+	Range struct {
+		From, To time.Time
+	}
+	IntervalMs    int64
+	MaxDataPoints int
+	Targets       []struct {
+		Target string
+	}
+}
+
+// grafanaSeries is a time series in the form Grafana expects, in which
+// each point is a value and a time in milliseconds.
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// HandleGrafana serves the endpoints of Grafana's JSON datasource,
+// beneath "<prefix>/api/grafana/". The root responds to Grafana's
+// connection test, "search" lists the available series, and "query"
+// returns them. Series are the counts of local nodes over time, as in
+// grafanaCounts, and the metrics collected by SNMP from each node, as
+// in grafanaMetrics. "annotations" always returns an empty list.
+func HandleGrafana(w http.ResponseWriter, r *http.Request) {
+	var v interface{}
+	switch path.Base(r.URL.Path) {
+	case "grafana":
+		w.Write([]byte("OK"))
+		return
+	case "search":
+		v = grafanaSearch(r)
+	case "query":
+		q := new(grafanaQuery)
+		if err := json.NewDecoder(r.Body).Decode(q); err != nil {
+			http.Error(w, "queryInvalid", http.StatusBadRequest)
+			return
+		}
+		series, err := grafanaQueryResult(q)
+		if err != nil {
+			dbLog.Request(r).Errf("Error answering Grafana query: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
+		v = series
+	case "annotations":
+		v = []struct{}{}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// grafanaSearch returns the names of every series which contain the
+// requested target, or every series if there is none.
+func grafanaSearch(r *http.Request) (names []string) {
+	db := Db.WithContext(r.Context())
+	var search struct{ Target string }
+	json.NewDecoder(r.Body).Decode(&search)
+
+	all := make([]string, 0, len(grafanaCounts))
+	for _, c := range grafanaCounts {
+		all = append(all, c.Name)
+	}
+	targets, err := db.SNMPTargets()
+	if err != nil {
+		dbLog.Request(r).Errf("Error listing SNMP targets: %s", err)
+	}
+	for _, t := range targets {
+		for _, m := range grafanaMetrics {
+			all = append(all, t.Addr.String()+"/"+m)
+		}
+	}
+
+	names = make([]string, 0, len(all))
+	for _, name := range all {
+		if strings.Contains(name, search.Target) {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+// grafanaQueryResult returns the requested series. Unknown targets are
+// returned with no points.
+func grafanaQueryResult(q *grafanaQuery) (series []*grafanaSeries, err error) {
+	series = make([]*grafanaSeries, 0, len(q.Targets))
+	var counts map[string][][2]float64
+	for _, t := range q.Targets {
+		s := &grafanaSeries{Target: t.Target, Datapoints: [][2]float64{}}
+		series = append(series, s)
+
+		if strings.HasPrefix(t.Target, "nodes") {
+			if counts == nil {
+				if counts, err = grafanaNodeCounts(q); err != nil {
+					return
+				}
+			}
+			if points, ok := counts[t.Target]; ok {
+				s.Datapoints = points
+			}
+			continue
+		}
+
+		i := strings.LastIndex(t.Target, "/")
+		if i < 0 {
+			continue
+		}
+		addr := ParseIP(t.Target[:i])
+		if addr == nil {
+			continue
+		}
+		var metrics []*Metric
+		if metrics, err = Db.Metrics(addr, q.Range.From); err != nil {
+			return
+		}
+		for _, m := range metrics {
+			if m.Time.After(q.Range.To) {
+				break
+			}
+			var value float64
+			switch t.Target[i+1:] {
+			case "in_rate":
+				value = m.InRate
+			case "out_rate":
+				value = m.OutRate
+			case "clients":
+				value = float64(m.Clients)
+			default:
+				continue
+			}
+			s.Datapoints = append(s.Datapoints,
+				[2]float64{value, grafanaTime(m.Time)})
+		}
+	}
+	return
+}
+
+// grafanaNodeCounts reconstructs the count series of grafanaCounts
+// over the query's range from the status history of the nodes, at
+// the query's interval, but with no more than its maximum number of
+// points.
+func grafanaNodeCounts(q *grafanaQuery) (counts map[string][][2]float64, err error) {
+	changes, err := Db.StatusChangesUntil(q.Range.To)
+	if err != nil {
+		return
+	}
+
+	maxPoints := q.MaxDataPoints
+	if maxPoints <= 0 {
+		maxPoints = defaultGrafanaDataPoints
+	}
+	span := q.Range.To.Sub(q.Range.From)
+	step := time.Duration(q.IntervalMs) * time.Millisecond
+	if min := span / time.Duration(maxPoints); step < min {
+		step = min
+	}
+	if step <= 0 {
+		step = time.Minute
+	}
+
+	counts = make(map[string][][2]float64, len(grafanaCounts))
+	statuses := make(map[string]uint32)
+	next := 0
+	for t := q.Range.From; !t.After(q.Range.To); t = t.Add(step) {
+		for ; next < len(changes) && !changes[next].Time.After(t); next++ {
+			statuses[changes[next].Addr.String()] = changes[next].Status
+		}
+		for _, c := range grafanaCounts {
+			n := 0
+			for _, status := range statuses {
+				if status&c.Status == c.Status {
+					n++
+				}
+			}
+			counts[c.Name] = append(counts[c.Name],
+				[2]float64{float64(n), grafanaTime(t)})
+		}
+	}
+	return
+}
+
+// grafanaTime returns the time in milliseconds since the epoch.
+func grafanaTime(t time.Time) float64 {
+	return float64(t.UnixNano() / int64(time.Millisecond))
+}
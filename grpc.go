@@ -0,0 +1,531 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GRPCService is the name of the federation service, as in
+// federation.proto. Its methods are served at
+// "<prefix>/nodeatlas.Federation/<method>".
+const GRPCService = "nodeatlas.Federation"
+
+// grpcMaxMessage is the largest message which is accepted, whether in
+// a request or in a response from another map.
+const grpcMaxMessage = 1 << 20
+
+// Status codes of gRPC which are used.
+const (
+	grpcOK              = 0
+	grpcInvalidArgument = 3
+	grpcUnimplemented   = 12
+	grpcInternal        = 13
+)
+
+// grpcTrailerFlag marks a gRPC-Web frame which contains trailers,
+// rather than a message.
+const grpcTrailerFlag = 0x80
+
+var GRPCFrameInvalidError = errors.New("grpc: invalid frame")
+
+// grpcError is an error with a gRPC status code, which is reported to
+// the client as it is.
+type grpcError struct {
+	Code    int
+	Message string
+}
+
+func (err *grpcError) Error() string {
+	return fmt.Sprintf("grpc: status %d: %s", err.Code, err.Message)
+}
+
+// grpcMethod handles a call, given the encoded request message. Every
+// response message is sent on the stream.
+type grpcMethod func(s *grpcStream, r *http.Request, req []byte) error
+
+// grpcMethods are the methods of the federation service, keyed by
+// name.
+var grpcMethods = map[string]grpcMethod{
+	"GetStatus":   grpcGetStatus,
+	"ListNodes":   grpcListNodes,
+	"ListLinks":   grpcListLinks,
+	"ListSources": grpcListSources,
+	"Watch":       grpcWatch,
+}
+
+// changeBroadcaster wakes everything waiting for a change at once, by
+// closing a channel and replacing it.
+type changeBroadcaster struct {
+	sync.Mutex
+	c chan struct{}
+}
+
+// NodeChanges is broadcast whenever any node, local or cached, is
+// changed.
+var NodeChanges = &changeBroadcaster{c: make(chan struct{})}
+
+// Wait returns a channel which is closed at the next change.
+func (b *changeBroadcaster) Wait() <-chan struct{} {
+	b.Lock()
+	defer b.Unlock()
+	return b.c
+}
+
+// Broadcast wakes everything waiting for a change.
+func (b *changeBroadcaster) Broadcast() {
+	b.Lock()
+	close(b.c)
+	b.c = make(chan struct{})
+	b.Unlock()
+}
+
+// RegisterGRPC invokes http.HandleFunc() for the federation service,
+// so that it is served alongside the API.
+func RegisterGRPC(prefix string) {
+	http.HandleFunc(path.Join("/", prefix, GRPCService)+"/", HandleGRPC)
+}
+
+// HandleGRPC serves calls to the federation service. Binary gRPC-Web
+// ("application/grpc-web+proto") is served over any connection, so
+// that it works behind ordinary proxies, and plain gRPC is served
+// over HTTP/2. Cross-origin requests are allowed, so that browsers can
+// make calls.
+func HandleGRPC(w http.ResponseWriter, r *http.Request) {
+	header := w.Header()
+	header.Set("Access-Control-Allow-Origin", "*")
+	if r.Method == "OPTIONS" {
+		header.Set("Access-Control-Allow-Methods", "POST")
+		header.Set("Access-Control-Allow-Headers",
+			"Content-Type, X-Grpc-Web, X-User-Agent, Grpc-Timeout")
+		return
+	}
+	header.Set("Access-Control-Expose-Headers", "Grpc-Status, Grpc-Message")
+
+	contentType := r.Header.Get("Content-Type")
+	web := strings.HasPrefix(contentType, "application/grpc-web")
+	if r.Method != "POST" ||
+		strings.HasPrefix(contentType, "application/grpc-web-text") ||
+		!strings.HasPrefix(contentType, "application/grpc") ||
+		(!web && r.ProtoMajor < 2) {
+		http.Error(w, "gRPC-Web required", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	s := &grpcStream{w: w, web: web}
+	if web {
+		header.Set("Content-Type", "application/grpc-web+proto")
+	} else {
+		header.Set("Content-Type", "application/grpc")
+		header.Set("Trailer", "Grpc-Status, Grpc-Message")
+	}
+
+	method, ok := grpcMethods[path.Base(r.URL.Path)]
+	if !ok {
+		s.Finish(&grpcError{grpcUnimplemented, "unknown method"})
+		return
+	}
+	_, req, err := readGRPCFrame(io.LimitReader(r.Body, grpcMaxMessage+5))
+	if err != nil && err != io.EOF {
+		s.Finish(&grpcError{grpcInvalidArgument, err.Error()})
+		return
+	}
+	s.Finish(method(s, r, req))
+}
+
+// grpcStream writes the response of a call.
+type grpcStream struct {
+	w   http.ResponseWriter
+	web bool
+}
+
+// Send writes a message, and flushes it to the client.
+func (s *grpcStream) Send(msg []byte) error {
+	if _, err := s.w.Write(grpcFrame(0, msg)); err != nil {
+		return err
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// Finish ends the call with the status of the given error, which is
+// OK if it is nil. Errors other than grpcErrors are logged, and
+// reported as internal errors.
+func (s *grpcStream) Finish(err error) {
+	status := &grpcError{Code: grpcOK}
+	if e, ok := err.(*grpcError); ok {
+		status = e
+	} else if err != nil {
+		fedLog.Errf("Error serving gRPC call: %s", err)
+		status = &grpcError{grpcInternal, "internal error"}
+	}
+
+	message := url.QueryEscape(status.Message)
+	if s.web {
+		trailers := fmt.Sprintf("grpc-status:%d\r\ngrpc-message:%s\r\n",
+			status.Code, message)
+		s.w.Write(grpcFrame(grpcTrailerFlag, []byte(trailers)))
+	} else {
+		s.w.Header().Set("Grpc-Status", strconv.Itoa(status.Code))
+		s.w.Header().Set("Grpc-Message", message)
+	}
+}
+
+// grpcFrame returns a message with its frame header, which is a byte
+// of flags and its length.
+func grpcFrame(flags byte, msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	frame[0] = flags
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// readGRPCFrame reads a single frame. If there are no more frames, it
+// returns io.EOF, and if the frame is larger than grpcMaxMessage, it
+// returns GRPCFrameInvalidError.
+func readGRPCFrame(r io.Reader) (flags byte, msg []byte, err error) {
+	header := make([]byte, 5)
+	if _, err = io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = GRPCFrameInvalidError
+		}
+		return
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > grpcMaxMessage {
+		return 0, nil, GRPCFrameInvalidError
+	}
+	msg = make([]byte, length)
+	if _, err = io.ReadFull(r, msg); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = GRPCFrameInvalidError
+		}
+		return 0, nil, err
+	}
+	return header[0], msg, nil
+}
+
+// encodeProtoNode encodes the node as a Node message from the given
+// source, without its owner's email address.
+func encodeProtoNode(node *Node, source string) []byte {
+	w := new(ProtoWriter)
+	w.RawBytes(1, []byte(node.Addr))
+	w.String(2, node.OwnerName)
+	w.String(3, node.Contact)
+	w.String(4, node.Details)
+	w.RawBytes(5, []byte(node.PGP))
+	w.Double(6, node.Latitude)
+	w.Double(7, node.Longitude)
+	w.Uint(8, uint64(node.Status))
+	w.String(9, source)
+	w.String(10, node.MapID)
+	w.String(11, node.Neighborhood)
+	w.String(12, node.Via)
+	w.Int(13, node.CreateTime)
+	w.Int(14, node.UpdateTime)
+	return w.Bytes()
+}
+
+// decodeProtoNode decodes a Node message, and returns the node and its
+// source.
+func decodeProtoNode(msg []byte) (node *Node, source string, err error) {
+	node = new(Node)
+	err = ProtoDecode(msg, func(f *ProtoField) error {
+		switch f.Number {
+		case 1:
+			node.Addr = IP(f.Data)
+		case 2:
+			node.OwnerName = string(f.Data)
+		case 3:
+			node.Contact = string(f.Data)
+		case 4:
+			node.Details = string(f.Data)
+		case 5:
+			node.PGP = PGPID(f.Data)
+		case 6:
+			node.Latitude = f.Double()
+		case 7:
+			node.Longitude = f.Double()
+		case 8:
+			node.Status = uint32(f.Value)
+		case 9:
+			source = string(f.Data)
+		case 10:
+			node.MapID = string(f.Data)
+		case 11:
+			node.Neighborhood = string(f.Data)
+		case 12:
+			node.Via = string(f.Data)
+		case 13:
+			node.CreateTime = int64(f.Value)
+		case 14:
+			node.UpdateTime = int64(f.Value)
+		}
+		return nil
+	})
+	if err == nil && len(node.Addr) != 16 {
+		err = GRPCFrameInvalidError
+	}
+	return
+}
+
+func grpcGetStatus(s *grpcStream, r *http.Request, req []byte) error {
+	db := Db.WithContext(r.Context())
+	localNodes := db.LenNodes(false)
+	w := new(ProtoWriter)
+	w.String(1, Conf.Name)
+	w.String(2, Version)
+	w.Int(3, int64(localNodes))
+	w.Int(4, int64(db.LenNodes(true)-localNodes))
+	w.Int(5, int64(len(Conf.ChildMaps)))
+	return s.Send(w.Bytes())
+}
+
+func grpcListNodes(s *grpcStream, r *http.Request, req []byte) error {
+	db := Db.WithContext(r.Context())
+	var localOnly bool
+	err := ProtoDecode(req, func(f *ProtoField) error {
+		if f.Number == 1 {
+			localOnly = f.Value != 0
+		}
+		return nil
+	})
+	if err != nil {
+		return &grpcError{grpcInvalidArgument, err.Error()}
+	}
+
+	var nodes []*Node
+	if localOnly {
+		nodes, err = db.DumpLocal()
+	} else {
+		nodes, err = db.DumpNodes()
+	}
+	if err != nil {
+		return err
+	}
+	sources, err := db.GetMapIDToSource()
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if node == nil {
+			continue
+		}
+		if err = s.Send(encodeProtoNode(node, sources[node.SourceID])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func grpcListLinks(s *grpcStream, r *http.Request, req []byte) error {
+	db := Db.WithContext(r.Context())
+	links, err := db.Links()
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		w := new(ProtoWriter)
+		w.RawBytes(1, []byte(link.Source))
+		w.RawBytes(2, []byte(link.Target))
+		w.String(3, link.Origin)
+		w.Double(4, link.Metric)
+		w.Int(5, link.Updated.Unix())
+		if err = s.Send(w.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func grpcListSources(s *grpcStream, r *http.Request, req []byte) error {
+	db := Db.WithContext(r.Context())
+	maps, err := db.DumpChildMaps()
+	if err != nil {
+		return err
+	}
+	for _, m := range maps {
+		w := new(ProtoWriter)
+		w.Int(1, int64(m.ID))
+		w.String(2, m.Hostname)
+		w.String(3, m.Name)
+		if err = s.Send(w.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeProtoDeletion encodes a Node message for the local node with
+// the given address, which was deleted at the given time.
+func encodeProtoDeletion(addr IP, deleted time.Time) []byte {
+	w := new(ProtoWriter)
+	w.RawBytes(1, []byte(addr))
+	w.String(9, "local")
+	w.Int(14, deleted.Unix())
+	w.Bool(15, true)
+	return w.Bytes()
+}
+
+// watchKey returns the key of the node with the given address and
+// source among the nodes sent by grpcWatch.
+func watchKey(addr IP, source int) string {
+	return addr.String() + " " + strconv.Itoa(source)
+}
+
+// grpcWatch sends the nodes which have changed or been deleted since
+// the requested time, then waits for further changes and sends those,
+// until the client goes away. Each node is only sent again if it has
+// changed since it was last sent.
+func grpcWatch(s *grpcStream, r *http.Request, req []byte) error {
+	db := Db.WithContext(r.Context())
+	since := time.Now()
+	err := ProtoDecode(req, func(f *ProtoField) error {
+		if f.Number == 1 && f.Value != 0 {
+			since = time.Unix(int64(f.Value), 0)
+		}
+		return nil
+	})
+	if err != nil {
+		return &grpcError{grpcInvalidArgument, err.Error()}
+	}
+
+	// The call stays open for as long as the client wants, so it
+	// must not be cut off by the server's ReadTimeout or WriteTimeout
+	// once the request has been read.
+	rc := http.NewResponseController(s.w)
+	for _, set := range []func(time.Time) error{
+		rc.SetReadDeadline, rc.SetWriteDeadline} {
+		if err = set(time.Time{}); err != nil &&
+			!errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+	}
+
+	// sent holds the last message sent for each node, keyed by its
+	// address and source, and deleted the time at which each deleted
+	// node was sent as deleted, so that nothing is sent twice.
+	sent := make(map[string]string)
+	deleted := make(map[string]int64)
+
+	// Send any earlier changes immediately.
+	ready := make(chan struct{})
+	close(ready)
+	var changed <-chan struct{} = ready
+	for {
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return nil
+		}
+		changed = NodeChanges.Wait()
+
+		// Changes made during the dump are found again next time,
+		// rather than missed, but only sent if they were not sent
+		// this time.
+		now := time.Now()
+		deletions, err := db.DeletionsSince(since)
+		if err != nil {
+			return err
+		}
+		for _, e := range deletions {
+			key := e.Addr.String()
+			if deleted[key] == e.Time.Unix() {
+				continue
+			}
+			if err = s.Send(encodeProtoDeletion(e.Addr, e.Time)); err != nil {
+				return err
+			}
+			deleted[key] = e.Time.Unix()
+			delete(sent, watchKey(e.Addr, 0))
+		}
+		nodes, err := db.DumpChanges(since, nil)
+		if err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			key := watchKey(node.Addr, node.SourceID)
+			msg := encodeProtoNode(node, "")
+			if sent[key] == string(msg) {
+				continue
+			}
+			if err = s.Send(msg); err != nil {
+				return err
+			}
+			sent[key] = string(msg)
+		}
+
+		// Deletions before the next dump are never found again.
+		for key, t := range deleted {
+			if t < now.Unix() {
+				delete(deleted, key)
+			}
+		}
+		since = now
+	}
+}
+
+// FetchGRPCNodes retrieves every node from the federation service of
+// the map at the given address, grouped by source, as /api/all gives
+// them. The request is made within ctx.
+func FetchGRPCNodes(ctx context.Context,
+	address string) (nodes map[string][]*Node, err error) {
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		strings.TrimRight(address, "/")+"/"+GRPCService+"/ListNodes",
+		bytes.NewReader(grpcFrame(0, nil)))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/grpc-web+proto")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("grpc: %s", resp.Status)
+	}
+
+	body := childMapBody(resp.Body)
+	nodes = make(map[string][]*Node)
+	for {
+		flags, msg, err := readGRPCFrame(body)
+		if err == io.EOF {
+			// The trailers must be sent last.
+			return nil, GRPCFrameInvalidError
+		} else if err != nil {
+			return nil, err
+		}
+
+		if flags&grpcTrailerFlag != 0 {
+			for _, line := range strings.Split(string(msg), "\r\n") {
+				if strings.HasPrefix(line, "grpc-status:") &&
+					strings.TrimSpace(line[12:]) != "0" {
+					return nil, fmt.Errorf("grpc: %s", string(msg))
+				}
+			}
+			return nodes, nil
+		}
+
+		node, source, err := decodeProtoNode(msg)
+		if err != nil {
+			return nil, err
+		}
+		nodes[source] = append(nodes[source], node)
+	}
+}
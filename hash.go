@@ -0,0 +1,122 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/coocood/jas"
+	"sort"
+	"sync"
+)
+
+// Hash is the content hash of all local and cached nodes. Like Index,
+// it is computed from the database the first time it is used after
+// being invalidated.
+var Hash = &ContentHash{}
+
+// ContentHash is a hash of the nodes given by /api/all, which changes
+// only when they do, so that clients can tell whether to fetch them
+// again without doing so.
+type ContentHash struct {
+	mutex      sync.RWMutex
+	hash       string
+	count      int
+	generation uint64 // incremented by Invalidate
+	computed   uint64 // generation at which hash was computed
+}
+
+// Invalidate marks the hash as outdated.
+func (h *ContentHash) Invalidate() {
+	h.mutex.Lock()
+	h.generation++
+	h.mutex.Unlock()
+}
+
+// Current returns the hex-encoded hash of every node, and the number of
+// nodes, computing them from the database if necessary.
+func (h *ContentHash) Current() (hash string, count int, err error) {
+	h.mutex.RLock()
+	hash, count, generation := h.hash, h.count, h.generation
+	if len(hash) > 0 && h.computed == generation {
+		h.mutex.RUnlock()
+		return
+	}
+	h.mutex.RUnlock()
+
+	nodes, err := Db.DumpNodes()
+	if err != nil {
+		return
+	}
+	sourceMaps, err := Db.CacheFormatNodes(nodes)
+	if err != nil {
+		return
+	}
+	if hash, err = HashSourceMaps(sourceMaps); err != nil {
+		return
+	}
+	count = len(nodes)
+
+	// Only keep the hash if nothing changed while it was being
+	// computed, as with SpatialIndex.
+	h.mutex.Lock()
+	if h.generation == generation {
+		h.hash, h.count, h.computed = hash, count, generation
+	}
+	h.mutex.Unlock()
+	return
+}
+
+// HashSourceMaps returns the hex-encoded SHA-256 hash of the nodes of
+// each source, as given by CacheFormatNodes. It does not depend on the
+// order of the sources or of their nodes, and so is the same wherever
+// the same nodes are given.
+func HashSourceMaps(sourceMaps map[string][]*Node) (string, error) {
+	sources := make([]string, 0, len(sourceMaps))
+	for source := range sourceMaps {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	sum := sha256.New()
+	for _, source := range sources {
+		nodes := make([]*Node, len(sourceMaps[source]))
+		copy(nodes, sourceMaps[source])
+		sort.Sort(nodesByAddr(nodes))
+
+		sum.Write([]byte(source + "\n"))
+		for _, node := range nodes {
+			b, err := json.Marshal(node)
+			if err != nil {
+				return "", err
+			}
+			sum.Write(append(b, '\n'))
+		}
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// GetHash responds with the content hash of every node, as given in
+// `hash` beside the response of GetAll, and the number of nodes, so
+// that clients can check whether the nodes have changed much more
+// cheaply than by fetching them. If `hash` is given, `changed` is
+// whether it differs.
+func (*Api) GetHash(ctx *jas.Context) {
+	hash, count, err := Hash.Current()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Err(err)
+		return
+	}
+	data := map[string]interface{}{
+		"hash":  hash,
+		"count": count,
+	}
+	ctx.ParseForm()
+	if given, ok := ctx.Form["hash"]; ok {
+		data["changed"] = given[0] != hash
+	}
+	ctx.Data = data
+}
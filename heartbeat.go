@@ -0,0 +1,251 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"github.com/coocood/jas"
+	"html"
+	"time"
+)
+
+// DefaultHeartbeatTimeout is the length of time after its last
+// heartbeat that a node is considered down, if
+// Conf.Heartbeats.Timeout is not set.
+const DefaultHeartbeatTimeout = 6 * time.Hour
+
+// NodeHeartbeat is the most recent check-in of a local node, such as
+// from a cron script on its router, along with any metrics it
+// reported.
+type NodeHeartbeat struct {
+	Addr IP `json:"Address"`
+
+	// Last is the time of the most recent heartbeat. It is zero if
+	// the node has never sent one.
+	Last time.Time
+
+	// Uptime is the uptime of the node, in seconds.
+	Uptime   int64  `json:",omitempty"`
+	Firmware string `json:",omitempty"`
+
+	// Clients is the number of clients connected to the node.
+	Clients int `json:",omitempty"`
+}
+
+// heartbeatTimeout returns Conf.Heartbeats.Timeout, or
+// DefaultHeartbeatTimeout if it is not set.
+func heartbeatTimeout() time.Duration {
+	if Conf.Heartbeats.Timeout > 0 {
+		return time.Duration(Conf.Heartbeats.Timeout)
+	}
+	return DefaultHeartbeatTimeout
+}
+
+// SetHeartbeatKey replaces the key with which the node of the given
+// address authenticates its heartbeats with a new random one, as by
+// newSecret, and returns it. Only its hash is stored.
+func (db DB) SetHeartbeatKey(addr IP) (key string, err error) {
+	if key, err = newSecret(); err != nil {
+		return
+	}
+	hash := secretHash(key)
+	res, err := db.Exec(`UPDATE node_heartbeats
+SET secret = 0, key_hash = ?
+WHERE address = ?;`, hash, []byte(addr))
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		return key, nil
+	}
+	_, err = db.Exec(`INSERT INTO node_heartbeats
+(address, secret, last, key_hash)
+VALUES(?, 0, 0, ?);`, []byte(addr), hash)
+	return
+}
+
+// RecordHeartbeat stores the heartbeat, if the key is that of its
+// node. If it is not, it returns sql.ErrNoRows. Keys issued before
+// only their hashes were stored, which were numbers that could be
+// guessed, have no hash, and so are no longer valid.
+func (db DB) RecordHeartbeat(h *NodeHeartbeat, key string) (err error) {
+	res, err := db.Exec(`UPDATE node_heartbeats
+SET last = ?, uptime = ?, firmware = ?, clients = ?
+WHERE address = ? AND key_hash = ?;`, h.Last.Unix(), h.Uptime,
+		h.Firmware, h.Clients, []byte(h.Addr), secretHash(key))
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return
+}
+
+// GetHeartbeat returns the most recent heartbeat of the node with the
+// given address, or nil if it has no heartbeat key.
+func (db DB) GetHeartbeat(addr IP) (h *NodeHeartbeat, err error) {
+	h = &NodeHeartbeat{Addr: addr}
+	var last int64
+	var uptime sql.NullInt64
+	var firmware sql.NullString
+	var clients sql.NullInt64
+	err = db.QueryRow(`SELECT last,uptime,firmware,clients
+FROM node_heartbeats
+WHERE address = ?;`, []byte(addr)).Scan(&last, &uptime, &firmware,
+		&clients)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if last > 0 {
+		h.Last = time.Unix(last, 0)
+	}
+	h.Uptime = uptime.Int64
+	h.Firmware = firmware.String
+	h.Clients = int(clients.Int64)
+	return
+}
+
+// RemoveHeartbeats removes the heartbeat key and most recent heartbeat
+// of the node with the given address.
+func (db DB) RemoveHeartbeats(addr IP) (err error) {
+	_, err = db.Exec(`DELETE FROM node_heartbeats
+WHERE address = ?;`, []byte(addr))
+	return
+}
+
+// CheckHeartbeats clears the StatusPingable flag of every local node
+// which has sent heartbeats before, but not within the heartbeat
+// timeout. Errors are logged.
+func CheckHeartbeats() {
+	cutoff := time.Now().Add(-heartbeatTimeout()).Unix()
+	rows, err := Db.Query(`SELECT nodes.address,nodes.status
+FROM nodes
+INNER JOIN node_heartbeats ON nodes.address = node_heartbeats.address
+WHERE node_heartbeats.last > 0 AND node_heartbeats.last < ?;`, cutoff)
+	if err != nil {
+		dbLog.Errf("Error checking heartbeats: %s", err)
+		return
+	}
+
+	var down []*Node
+	for rows.Next() {
+		node := new(Node)
+		if err = rows.Scan(&node.Addr, &node.Status); err != nil {
+			dbLog.Errf("Error checking heartbeats: %s", err)
+			break
+		}
+		if node.Status&StatusPingable != 0 {
+			down = append(down, node)
+		}
+	}
+	rows.Close()
+
+	for _, node := range down {
+		node.Status &^= StatusPingable
+		if err = Db.SetStatus(node.Addr, node.Status); err != nil {
+			dbLog.Errf("Error setting status of %q: %s", node.Addr, err)
+			continue
+		}
+		l.Noticef("Node %q missed its heartbeat\n", node.Addr)
+		RunHooks(HookNodeDown, map[string]IP{"Address": node.Addr})
+	}
+}
+
+// PostHeartbeatKey gives the local node with the given `address` a new
+// key with which to authenticate its heartbeats, replacing any
+// previous one. It requires a token, and must come from the node's
+// owner (see IsNodeOwner).
+func (*Api) PostHeartbeatKey(ctx *jas.Context) {
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	db := Db.WithContext(ctx.Request.Context())
+	RequireToken(ctx)
+	node := RequireLocalNode(ctx)
+	if !IsNodeOwner(ctx.Request, node.Addr) {
+		ctx.Error = jas.NewRequestError(
+			RemoteAddressDoesNotMatchError.Error())
+		return
+	}
+	key, err := db.SetHeartbeatKey(node.Addr)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf(
+			"Error setting heartbeat key of %q: %s", node.Addr, err)
+		return
+	}
+	ctx.Data = key
+}
+
+// PostHeartbeat records a heartbeat from the local node with the given
+// `address`, authenticated by its heartbeat `key`. It optionally takes
+// the node's `uptime` in seconds, `firmware` version, and number of
+// `clients`. If the node was marked as down, it is marked as pingable
+// again.
+func (*Api) PostHeartbeat(ctx *jas.Context) {
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	db := Db.WithContext(ctx.Request.Context())
+	node := RequireLocalNode(ctx)
+	key := ctx.RequireStringLen(1, 64, "key")
+
+	h := &NodeHeartbeat{
+		Addr: node.Addr,
+		Last: time.Now(),
+	}
+	h.Uptime, _ = ctx.FindPositiveInt("uptime")
+	h.Firmware, _ = ctx.FindStringLen(0, 255, "firmware")
+	h.Firmware = html.EscapeString(h.Firmware)
+	clients, _ := ctx.FindPositiveInt("clients")
+	h.Clients = int(clients)
+
+	err := db.RecordHeartbeat(h, key)
+	if err == sql.ErrNoRows {
+		ctx.Error = jas.NewRequestError("keyInvalid")
+		return
+	} else if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error recording heartbeat of %q: %s",
+			node.Addr, err)
+		return
+	}
+
+	if node.Status&StatusPingable == 0 {
+		node.Status |= StatusPingable
+		if err = db.SetStatus(node.Addr, node.Status); err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			apiLog.Request(ctx.Request).Errf("Error setting status of %q: %s",
+				node.Addr, err)
+			return
+		}
+		l.Noticef("Node %q is back up\n", node.Addr)
+		RunHooks(HookNodeUp, map[string]IP{"Address": node.Addr})
+	}
+	PublishNodeEvent(node.Addr, "heartbeat", h)
+	ctx.Data = "successful"
+}
+
+// GetHeartbeat returns the most recent heartbeat of the local node
+// with the given `address`, without its key.
+func (*Api) GetHeartbeat(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	node := RequireLocalNode(ctx)
+	h, err := db.GetHeartbeat(node.Addr)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error getting heartbeat of %q: %s",
+			node.Addr, err)
+		return
+	} else if h == nil {
+		ctx.Error = jas.NewRequestError("no heartbeats")
+		return
+	}
+	ctx.Data = h
+}
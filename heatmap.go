@@ -0,0 +1,149 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"github.com/coocood/jas"
+	"math"
+)
+
+// HeatmapCellPixels is the width in pixels of each cell of a heatmap,
+// at the zoom level for which it is made.
+const HeatmapCellPixels = 16
+
+// Heatmap is the density of points on a grid of square cells, for
+// rendering as a heat layer without sending every point to the client.
+type Heatmap struct {
+	// CellSize is the width of each cell in degrees.
+	CellSize float64
+
+	// Max is the largest value of any cell, by which the values can be
+	// normalized.
+	Max float64
+
+	// Cells are the cells which have any points in them, each as
+	// [latitude, longitude, value], where the latitude and longitude
+	// are those of the center of the cell. This is the form which
+	// Leaflet.heat expects.
+	Cells [][3]float64
+
+	cells map[[2]int64]int
+}
+
+// NewHeatmap returns an empty Heatmap whose cells are
+// HeatmapCellPixels wide at the given zoom level.
+func NewHeatmap(zoom int) *Heatmap {
+	return &Heatmap{
+		CellSize: gridCellSize(zoom, HeatmapCellPixels),
+		Cells:    make([][3]float64, 0),
+		cells:    make(map[[2]int64]int),
+	}
+}
+
+// Add adds the given weight to the cell which contains the point.
+func (h *Heatmap) Add(lat, lon, weight float64) {
+	if weight == 0 {
+		return
+	}
+	key := [2]int64{
+		int64(math.Floor(lat / h.CellSize)),
+		int64(math.Floor(lon / h.CellSize)),
+	}
+	i, ok := h.cells[key]
+	if !ok {
+		i = len(h.Cells)
+		h.cells[key] = i
+		h.Cells = append(h.Cells, [3]float64{
+			(float64(key[0]) + 0.5) * h.CellSize,
+			(float64(key[1]) + 0.5) * h.CellSize,
+			0,
+		})
+	}
+	h.Cells[i][2] += weight
+	h.Max = math.Max(h.Max, h.Cells[i][2])
+}
+
+// GetHeatmap responds with the density of nodes, both local and cached,
+// within the bounding box given by `bbox`, on a grid suited to the
+// Leaflet zoom level given by `zoom`. If `layer` is "requests" or
+// "interest", the density of open connection requests or of interest
+// points is given instead, which only admins may see.
+//
+// Every node weighs one, unless a `status` is given, in which case only
+// nodes which have all of its bits weigh one, and the rest weigh
+// `other`, from 0 to 1, or nothing, so that, for example, active nodes
+// can be made to outweigh planned ones.
+func (*Api) GetHeatmap(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	b, err := ParseBounds(ctx.RequireString("bbox"))
+	if err != nil {
+		ctx.Error = jas.NewRequestError("bboxInvalid")
+		return
+	}
+	zoom := ctx.RequireInt("zoom")
+	if zoom < 0 || zoom > 30 {
+		ctx.Error = jas.NewRequestError("zoomInvalid")
+		return
+	}
+	h := NewHeatmap(int(zoom))
+
+	layer, _ := ctx.FindString("layer")
+	switch layer {
+	case "", "nodes":
+		status, statusErr := ctx.FindInt("status")
+		other, err := ctx.FindFloat("other")
+		if err != nil {
+			other = 0
+		} else if other < 0 || other > 1 {
+			ctx.Error = jas.NewRequestError("otherInvalid")
+			return
+		}
+
+		nodes, err := Index.Within(b)
+		if err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			apiLog.Request(ctx.Request).Err(err)
+			return
+		}
+		for _, n := range nodes {
+			weight := 1.0
+			if statusErr == nil && n.Status&uint32(status) != uint32(status) {
+				weight = other
+			}
+			h.Add(n.Latitude, n.Longitude, weight)
+		}
+	case "requests":
+		RequireAdmin(ctx)
+		requests, err := db.OpenConnectionRequests()
+		if err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			apiLog.Request(ctx.Request).Errf(
+				"Error getting connection requests: %s", err)
+			return
+		}
+		for _, r := range requests {
+			if b.Contains(r.Latitude, r.Longitude) {
+				h.Add(r.Latitude, r.Longitude, 1)
+			}
+		}
+	case "interest":
+		RequireAdmin(ctx)
+		points, err := db.InterestPoints(false)
+		if err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			apiLog.Request(ctx.Request).Errf(
+				"Error listing interest points: %s", err)
+			return
+		}
+		for _, p := range points {
+			if b.Contains(p.Latitude, p.Longitude) {
+				h.Add(p.Latitude, p.Longitude, 1)
+			}
+		}
+	default:
+		ctx.Error = jas.NewRequestError("layerInvalid")
+		return
+	}
+	ctx.Data = h
+}
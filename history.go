@@ -0,0 +1,246 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// StatusChange is a single entry in a local node's status history.
+type StatusChange struct {
+	// Addr is the address of the node, if the change is not part of
+	// a single node's history.
+	Addr IP `json:"Address,omitempty"`
+
+	// Status is the node's status as of Time.
+	Status uint32
+
+	// Time is the time at which the node was given the status.
+	Time time.Time
+}
+
+// RecordStatus adds an entry to the status history of the node with
+// the given address, unless its most recently recorded status is the
+// same. If the node has become active, the interest points near it are
+// matched in the background.
+func (db DB) RecordStatus(addr IP, status uint32) (err error) {
+	var last uint32
+	err = db.QueryRow(`SELECT status
+FROM status_history
+WHERE address = ?
+ORDER BY changed DESC
+LIMIT 1;`, []byte(addr)).Scan(&last)
+	if err == nil && last == status {
+		// If the status hasn't changed, there is nothing to record.
+		return nil
+	} else if err != nil && err != sql.ErrNoRows {
+		return
+	}
+
+	now := time.Now()
+	_, err = db.Exec(`INSERT INTO status_history
+(address, status, changed)
+VALUES(?, ?, ?);`, []byte(addr), status, now.Unix())
+	if err != nil {
+		return
+	}
+	PublishNodeEvent(addr, "status", StatusChange{Status: status, Time: now})
+	if status&StatusActive != 0 && last&StatusActive == 0 {
+		go MatchInterest(addr)
+	}
+	return
+}
+
+// StatusHistory returns the recorded status changes of the node with
+// the given address, oldest first.
+func (db DB) StatusHistory(addr IP) (history []StatusChange, err error) {
+	rows, err := db.Query(`SELECT status,changed
+FROM status_history
+WHERE address = ?
+ORDER BY changed;`, []byte(addr))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	history = make([]StatusChange, 0)
+	for rows.Next() {
+		var change StatusChange
+		var changed int64
+		if err = rows.Scan(&change.Status, &changed); err != nil {
+			return
+		}
+		change.Time = time.Unix(changed, 0)
+		history = append(history, change)
+	}
+	return history, rows.Err()
+}
+
+// StatusChangesUntil returns every status change recorded up to the
+// given time for nodes which are still in the database, oldest first,
+// with their addresses.
+func (db DB) StatusChangesUntil(until time.Time) (changes []StatusChange, err error) {
+	rows, err := db.Query(`SELECT address,status,changed
+FROM status_history
+WHERE changed <= ?
+AND address IN (SELECT address FROM nodes)
+ORDER BY changed;`, until.Unix())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	changes = make([]StatusChange, 0)
+	for rows.Next() {
+		var change StatusChange
+		var changed int64
+		err = rows.Scan(&change.Addr, &change.Status, &changed)
+		if err != nil {
+			return
+		}
+		change.Time = time.Unix(changed, 0)
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+// FirstRecorded returns the time at which the status of each local
+// node was first recorded, which is approximately when it was added,
+// keyed by the string form of its address.
+func (db DB) FirstRecorded() (first map[string]time.Time, err error) {
+	rows, err := db.Query(`SELECT address,MIN(changed)
+FROM status_history
+GROUP BY address;`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	first = make(map[string]time.Time)
+	for rows.Next() {
+		var addr IP
+		var changed int64
+		if err = rows.Scan(&addr, &changed); err != nil {
+			return
+		}
+		first[addr.String()] = time.Unix(changed, 0)
+	}
+	return first, rows.Err()
+}
+
+// NodesAsOf returns the nodes, both local and cached, as nearly as they
+// can be reconstructed as they were at the given time, and which are
+// selected by the filter, if it is not nil. Nodes which were created
+// after then are left out. If withDeleted is true, nodes which were
+// deleted since then are given as they were when they were deleted,
+// as recorded by AuditDeletion; because those records are kept in the
+// audit log, which includes private fields, it should only be true
+// for administrators. Otherwise, deleted nodes are left out. Each
+// local node has the last status recorded for it
+// by then, but its other fields are as they are now, or were when it
+// was deleted, because their history is not kept. Nodes whose creation
+// times are not known are always included. Nothing can be
+// reconstructed from history which has been removed, as by
+// DeleteOldStatusHistory and DeleteOldAuditLog.
+func (db DB) NodesAsOf(t time.Time, f *NodeFilter,
+	withDeleted bool) (nodes []*Node, err error) {
+	current, err := db.DumpNodes()
+	if err != nil {
+		return
+	}
+	deleted := make(map[string]*Node)
+	if withDeleted {
+		if deleted, err = db.deletedSince(t); err != nil {
+			return
+		}
+	}
+	statuses, err := db.statusesAsOf(t)
+	if err != nil {
+		return
+	}
+
+	nodes = make([]*Node, 0, len(current)+len(deleted))
+	for _, node := range current {
+		if node == nil || node.CreateTime > t.Unix() {
+			continue
+		}
+		// A node which existed then and exists now was not deleted
+		// in between, or was re-added, so it is given as it is now.
+		delete(deleted, node.Addr.String())
+		nodes = append(nodes, node)
+	}
+	for _, node := range deleted {
+		if node.CreateTime <= t.Unix() {
+			nodes = append(nodes, node)
+		}
+	}
+	for _, node := range nodes {
+		if node.SourceID != 0 {
+			continue
+		}
+		if status, ok := statuses[node.Addr.String()]; ok {
+			node.Status = status
+		}
+	}
+	return f.Filter(nodes), nil
+}
+
+// deletedSince returns the local nodes which were deleted after the
+// given time, as they were when they were first deleted since then,
+// keyed by the string form of their addresses.
+func (db DB) deletedSince(t time.Time) (deleted map[string]*Node,
+	err error) {
+	rows, err := db.reader().Query(`SELECT details
+FROM audit_log
+WHERE action = 'deleted' AND time > ?
+ORDER BY time DESC;`, t.Unix())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	deleted = make(map[string]*Node)
+	for rows.Next() {
+		var details sql.NullString
+		if err = rows.Scan(&details); err != nil {
+			return
+		}
+		node := new(Node)
+		if err = json.Unmarshal([]byte(details.String), node); err != nil {
+			return
+		}
+		// Entries are newest first, so the earliest deletion is the
+		// one which is kept.
+		deleted[node.Addr.String()] = node
+	}
+	return deleted, rows.Err()
+}
+
+// statusesAsOf returns the last status recorded up to the given time
+// for every local node, including those which have since been deleted,
+// keyed by the string form of its address.
+func (db DB) statusesAsOf(t time.Time) (statuses map[string]uint32,
+	err error) {
+	rows, err := db.reader().Query(`SELECT address,status
+FROM status_history
+WHERE changed <= ?
+ORDER BY changed;`, t.Unix())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	statuses = make(map[string]uint32)
+	for rows.Next() {
+		var addr IP
+		var status uint32
+		if err = rows.Scan(&addr, &status); err != nil {
+			return
+		}
+		statuses[addr.String()] = status
+	}
+	return statuses, rows.Err()
+}
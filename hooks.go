@@ -0,0 +1,160 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultHookTimeout is the length of time for which a hook may
+	// run before it is killed, if Conf.Hooks.Timeout is not set.
+	DefaultHookTimeout = 30 * time.Second
+
+	// hookWaitDelay is how long a hook's output is waited for after it
+	// exits or is killed, in case a process it started still holds it.
+	hookWaitDelay = 5 * time.Second
+
+	// DefaultHookConcurrency is the number of hooks which may run at
+	// once, if Conf.Hooks.Concurrency is not set.
+	DefaultHookConcurrency = 4
+
+	// hookQueueLength is the number of hooks which may wait to be
+	// run. Further hooks are dropped.
+	hookQueueLength = 256
+)
+
+var HookTimeoutError = errors.New("timed out")
+
+// Hook events. Each is run with a JSON payload whose "data" is as
+// described.
+const (
+	HookNodeCreated      = "node.created"      // the node
+	HookNodeUpdated      = "node.updated"      // the node
+	HookNodeDeleted      = "node.deleted"      // {"Address": ...}
+	HookNodeVerified     = "node.verified"     // the node
+	HookNodeDown         = "node.down"         // {"Address": ...}
+	HookNodeUp           = "node.up"           // {"Address": ...}
+	HookFederationSynced = "federation.synced" // {"ChildMaps": ...}
+)
+
+// HookPayload is written as JSON to the standard input of every hook.
+type HookPayload struct {
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+}
+
+// hookRun is a command waiting to be run with its payload.
+type hookRun struct {
+	command []string
+	payload []byte
+	event   string
+}
+
+// hookQueue holds hooks waiting to be run. It is nil if no hooks are
+// configured.
+var hookQueue chan hookRun
+
+// StartHooks starts the goroutines which run the commands of
+// Conf.Hooks, if any are configured. At most Conf.Hooks.Concurrency
+// run at once.
+func StartHooks() {
+	if len(Conf.Hooks.Commands) == 0 || hookQueue != nil {
+		return
+	}
+	concurrency := Conf.Hooks.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultHookConcurrency
+	}
+	hookQueue = make(chan hookRun, hookQueueLength)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for h := range hookQueue {
+				if err := runHook(h); err != nil {
+					l.Errf("Hook %q for %s failed: %s",
+						strings.Join(h.command, " "), h.event, err)
+				}
+			}
+		}()
+	}
+}
+
+// RunHooks tells every registered Notifier of the event, and queues
+// the commands configured for the event, and for every event ("*"),
+// to be run with a JSON HookPayload of the data on their standard
+// input. If the queue is full, they are dropped.
+func RunHooks(event string, data interface{}) {
+	notify(event, data)
+	if hookQueue == nil {
+		return
+	}
+	var commands [][]string
+	commands = append(commands, Conf.Hooks.Commands[event]...)
+	commands = append(commands, Conf.Hooks.Commands["*"]...)
+	if len(commands) == 0 {
+		return
+	}
+	payload, err := json.Marshal(&HookPayload{
+		Event: event,
+		Time:  time.Now(),
+		Data:  data,
+	})
+	if err != nil {
+		l.Errf("Error encoding hook payload: %s", err)
+		return
+	}
+	for _, command := range commands {
+		if len(command) == 0 {
+			continue
+		}
+		select {
+		case hookQueue <- hookRun{command, payload, event}:
+		default:
+			l.Warningf("Hook queue full; dropped %q for %s\n",
+				strings.Join(command, " "), event)
+		}
+	}
+}
+
+// runHook runs the command with the payload on its standard input,
+// and the event in the environment variable NODEATLAS_EVENT. It is
+// killed if it runs for longer than Conf.Hooks.Timeout. Anything it
+// writes is logged. Processes which it leaves running are not waited
+// for beyond hookWaitDelay, even if they hold its output open.
+func runHook(h hookRun) error {
+	timeout := time.Duration(Conf.Hooks.Timeout)
+	if timeout <= 0 {
+		timeout = DefaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	output := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, h.command[0], h.command[1:]...)
+	cmd.Stdin = bytes.NewReader(h.payload)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.Env = append(os.Environ(), "NODEATLAS_EVENT="+h.event)
+	cmd.WaitDelay = hookWaitDelay
+	err := cmd.Run()
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// The hook itself succeeded, but left a process running.
+		err = nil
+	} else if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = HookTimeoutError
+	}
+	if output.Len() > 0 {
+		l.Debugf("Hook %q for %s: %s\n", h.command[0], h.event,
+			strings.TrimSpace(output.String()))
+	}
+	return err
+}
@@ -0,0 +1,215 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultLocale is the locale used if Conf.Locale is not set.
+const DefaultLocale = "en"
+
+// Translations are the translated strings of every available locale,
+// loaded from the res directory and theme by
+// RegisterEmailTemplates.
+var Translations Locales
+
+// Locales maps lowercase language tags, such as "en" or "pt-br", to
+// translated strings, keyed by identifiers such as "node.status".
+type Locales map[string]map[string]string
+
+// LoadLocales reads every "<tag>.json" file in the given directory,
+// each of which is a JSON object mapping identifiers to translated
+// strings. If the directory does not exist, there are no locales.
+func LoadLocales(dir string) (locales Locales, err error) {
+	locales = make(Locales)
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return locales, nil
+	} else if err != nil {
+		return
+	}
+
+	for _, fi := range fis {
+		if fi.IsDir() || path.Ext(fi.Name()) != ".json" {
+			continue
+		}
+		f, err := os.Open(path.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		strs := make(map[string]string)
+		err = json.NewDecoder(f).Decode(&strs)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("locale %q: %s", fi.Name(), err)
+		}
+		tag := strings.ToLower(strings.TrimSuffix(fi.Name(), ".json"))
+		locales[tag] = strs
+	}
+	return
+}
+
+// LoadThemeLocales loads the locales in "<res>/locales", and merges
+// those in "<theme>/locales" into them if theme is not empty, so that
+// a theme can replace individual strings.
+func LoadThemeLocales(res, theme string) (locales Locales, err error) {
+	locales, err = LoadLocales(path.Join(res, "locales"))
+	if err != nil || len(theme) == 0 {
+		return
+	}
+	themeLocales, err := LoadLocales(path.Join(theme, "locales"))
+	if err != nil {
+		return nil, err
+	}
+	for tag, strs := range themeLocales {
+		if locales[tag] == nil {
+			locales[tag] = strs
+			continue
+		}
+		for key, s := range strs {
+			locales[tag][key] = s
+		}
+	}
+	return
+}
+
+// Translate returns the string identified by key in the given locale,
+// formatted with any args using fmt.Sprintf. If the locale doesn't
+// have it, the default locale is used, and if that doesn't either,
+// the key itself is used.
+func (ls Locales) Translate(lang, key string, args ...interface{}) string {
+	s, ok := ls[lang][key]
+	if !ok {
+		if s, ok = ls[Conf.DefaultLocale()][key]; !ok {
+			s = key
+		}
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(s, args...)
+	}
+	return s
+}
+
+// DefaultLocale returns the configured default locale, or
+// DefaultLocale if it is not set.
+func (c *Config) DefaultLocale() string {
+	if len(c.Locale) > 0 {
+		return strings.ToLower(c.Locale)
+	}
+	return DefaultLocale
+}
+
+// NegotiateLocale returns the available locale which best matches the
+// Accept-Language header of the request, or the default locale if
+// none match or the request is nil.
+func NegotiateLocale(r *http.Request) string {
+	if r == nil {
+		return Conf.DefaultLocale()
+	}
+
+	var accepted []weightedTag
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if len(tag) == 0 || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			accepted = append(accepted, weightedTag{tag, q})
+		}
+	}
+	sort.Stable(byQuality(accepted))
+
+	// Prefer an exact match, but fall back on the base language, so
+	// that "es-mx" matches "es".
+	for _, a := range accepted {
+		if _, ok := Translations[a.tag]; ok {
+			return a.tag
+		}
+		if i := strings.Index(a.tag, "-"); i > 0 {
+			if _, ok := Translations[a.tag[:i]]; ok {
+				return a.tag[:i]
+			}
+		}
+	}
+	return Conf.DefaultLocale()
+}
+
+// weightedTag is a language tag from an Accept-Language header, and
+// its quality value.
+type weightedTag struct {
+	tag string
+	q   float64
+}
+
+type byQuality []weightedTag
+
+func (s byQuality) Len() int           { return len(s) }
+func (s byQuality) Less(i, j int) bool { return s[i].q > s[j].q }
+func (s byQuality) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// localeFuncs returns the template functions which produce text in the
+// given locale. "T" translates a string by its identifier, and
+// "statusText" describes a node status.
+func localeFuncs(locales Locales, lang string) template.FuncMap {
+	return template.FuncMap{
+		"T": func(key string, args ...interface{}) string {
+			return locales.Translate(lang, key, args...)
+		},
+		"statusText": func(status uint32) string {
+			return strings.Join(StatusText(locales, lang, status), ", ")
+		},
+	}
+}
+
+// StatusText returns the translated names of the given status flags,
+// as given by StatusNames.
+func StatusText(locales Locales, lang string, status uint32) []string {
+	names := StatusNames(status)
+	for i, name := range names {
+		names[i] = locales.Translate(lang,
+			"status."+strings.Replace(name, " ", "_", -1))
+	}
+	return names
+}
+
+// ExecuteLocalized executes the named template in the given locale. If
+// a localized version of the template exists, such as
+// "verification.es.txt" for "verification.txt", it is used instead.
+// The given templates are cloned, rather than executed, so they can
+// be used again with a different locale.
+func ExecuteLocalized(tmpl *template.Template, w io.Writer, name, lang string,
+	data interface{}) error {
+	ext := path.Ext(name)
+	if localized := strings.TrimSuffix(name, ext) + "." + lang + ext; tmpl.Lookup(localized) != nil {
+		name = localized
+	}
+
+	clone, err := tmpl.Clone()
+	if err != nil {
+		return err
+	}
+	clone.Funcs(localeFuncs(Translations, lang))
+	return clone.ExecuteTemplate(w, name, data)
+}
@@ -0,0 +1,123 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// icalTimeFormat is the format of UTC date-times in iCalendar.
+const icalTimeFormat = "20060102T150405Z"
+
+// icalEscaper escapes text values, as required by RFC 5545.
+var icalEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\;`,
+	",", `\,`,
+	"\r\n", `\n`,
+	"\n", `\n`,
+)
+
+// ICalEvent is a single VEVENT in an iCalendar feed.
+type ICalEvent struct {
+	// UID uniquely and permanently identifies the event, such as
+	// "install-1234@example.com".
+	UID string
+
+	Start, End time.Time
+
+	Summary, Description, Location string
+
+	// URL is a link to more information, such as a node's page.
+	URL string
+
+	// Latitude and Longitude are the event's location. They are only
+	// included if Geo is true.
+	Geo                 bool
+	Latitude, Longitude float64
+}
+
+// ICalWriter writes an iCalendar feed. The calendar is begun by
+// NewICalWriter, and must be ended with Close.
+type ICalWriter struct {
+	w   io.Writer
+	err error
+}
+
+// NewICalWriter begins a VCALENDAR with the given name on w.
+func NewICalWriter(w io.Writer, name string) *ICalWriter {
+	c := &ICalWriter{w: w}
+	c.line("BEGIN", "VCALENDAR")
+	c.line("VERSION", "2.0")
+	c.line("PRODID", "-//NodeAtlas//NodeAtlas "+Version+"//EN")
+	c.line("CALSCALE", "GREGORIAN")
+	c.line("X-WR-CALNAME", icalEscaper.Replace(name))
+	return c
+}
+
+// WriteEvent writes a VEVENT. The timestamp of the event is the
+// current time.
+func (c *ICalWriter) WriteEvent(e *ICalEvent) error {
+	c.line("BEGIN", "VEVENT")
+	c.line("UID", icalEscaper.Replace(e.UID))
+	c.line("DTSTAMP", time.Now().UTC().Format(icalTimeFormat))
+	c.line("DTSTART", e.Start.UTC().Format(icalTimeFormat))
+	if !e.End.IsZero() {
+		c.line("DTEND", e.End.UTC().Format(icalTimeFormat))
+	}
+	c.line("SUMMARY", icalEscaper.Replace(e.Summary))
+	if len(e.Description) > 0 {
+		c.line("DESCRIPTION", icalEscaper.Replace(e.Description))
+	}
+	if len(e.Location) > 0 {
+		c.line("LOCATION", icalEscaper.Replace(e.Location))
+	}
+	if e.Geo {
+		c.line("GEO", strconv.FormatFloat(e.Latitude, 'f', -1, 64)+";"+
+			strconv.FormatFloat(e.Longitude, 'f', -1, 64))
+	}
+	if len(e.URL) > 0 {
+		c.line("URL", e.URL)
+	}
+	c.line("END", "VEVENT")
+	return c.err
+}
+
+// Close ends the VCALENDAR, and returns the first error encountered
+// while writing.
+func (c *ICalWriter) Close() error {
+	c.line("END", "VCALENDAR")
+	return c.err
+}
+
+// line writes a content line, folding it so that no line is longer
+// than 75 octets, as required by RFC 5545. Folds are never made
+// within a UTF-8 sequence.
+func (c *ICalWriter) line(name, value string) {
+	if c.err != nil {
+		return
+	}
+	s := name + ":" + value
+	buf := new(bytes.Buffer)
+	limit := 75
+	for len(s) > limit {
+		i := limit
+		for i > 0 && s[i]&0xC0 == 0x80 {
+			i--
+		}
+		buf.WriteString(s[:i])
+		buf.WriteString("\r\n ")
+		s = s[i:]
+		// Continuation lines begin with a space, which counts
+		// toward their length.
+		limit = 74
+	}
+	buf.WriteString(s)
+	buf.WriteString("\r\n")
+	_, c.err = c.w.Write(buf.Bytes())
+}
@@ -5,8 +5,27 @@ package main
 
 import (
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/coocood/jas"
+	"html"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultImportMaxBytes is the largest file which can be uploaded
+	// to be imported.
+	DefaultImportMaxBytes = 16 << 20 // 16 MiB
+)
+
+var (
+	ImportFormatInvalidError = errors.New("formatInvalid")
 )
 
 // Import reads a slice of JSON-encoded Nodes from the given io.Reader
@@ -39,3 +58,521 @@ func ImportFile(path string) (err error) {
 	// Pass it along to Import.
 	return Import(f)
 }
+
+// FieldMapping names the fields of imported placemarks or features
+// from which the fields of nodes are taken. For KML, "name" and
+// "description" are the placemark's own, and any other field is
+// looked up in its ExtendedData. For GeoJSON, every field is looked up
+// in the feature's properties.
+type FieldMapping struct {
+	Address, Owner, Email, Contact, Details, Status string
+}
+
+// DefaultFieldMapping is used for any field which is not mapped.
+var DefaultFieldMapping = FieldMapping{
+	Address: "address",
+	Owner:   "name",
+	Email:   "email",
+	Contact: "contact",
+	Details: "description",
+	Status:  "status",
+}
+
+// ParseFieldMapping parses a mapping of the form
+// "address=ip,owner=name,details=notes" on top of DefaultFieldMapping.
+func ParseFieldMapping(s string) (m FieldMapping, err error) {
+	m = DefaultFieldMapping
+	for _, pair := range strings.Split(s, ",") {
+		if len(strings.TrimSpace(pair)) == 0 {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || len(parts[1]) == 0 {
+			return m, fmt.Errorf("invalid field mapping %q", pair)
+		}
+		field := strings.TrimSpace(parts[1])
+		switch strings.ToLower(strings.TrimSpace(parts[0])) {
+		case "address":
+			m.Address = field
+		case "owner":
+			m.Owner = field
+		case "email":
+			m.Email = field
+		case "contact":
+			m.Contact = field
+		case "details":
+			m.Details = field
+		case "status":
+			m.Status = field
+		default:
+			return m, fmt.Errorf("unknown node field %q", parts[0])
+		}
+	}
+	return
+}
+
+// placemark is a single point read from a KML or GeoJSON file, before
+// it is converted to a Node.
+type placemark struct {
+	Name      string
+	Fields    map[string]string
+	Latitude  float64
+	Longitude float64
+	HasPoint  bool
+}
+
+// kmlPlacemark is the part of a KML Placemark which is imported.
+type kmlPlacemark struct {
+	Name        string `xml:"name"`
+	Description string `xml:"description"`
+	Data        []struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:"value"`
+	} `xml:"ExtendedData>Data"`
+	Coordinates string `xml:"Point>coordinates"`
+}
+
+// readKML reads every Placemark in the given KML document, however
+// deeply it is nested in Documents and Folders.
+func readKML(r io.Reader) (placemarks []*placemark, err error) {
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return placemarks, nil
+		} else if err != nil {
+			return nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "Placemark" {
+			continue
+		}
+
+		var k kmlPlacemark
+		if err = d.DecodeElement(&k, &start); err != nil {
+			return nil, err
+		}
+		p := &placemark{
+			Name: strings.TrimSpace(k.Name),
+			Fields: map[string]string{
+				"name":        strings.TrimSpace(k.Name),
+				"description": strings.TrimSpace(k.Description),
+			},
+		}
+		for _, data := range k.Data {
+			p.Fields[data.Name] = strings.TrimSpace(data.Value)
+		}
+
+		// Coordinates are "lon,lat[,alt]".
+		coords := strings.Split(strings.TrimSpace(k.Coordinates), ",")
+		if len(coords) >= 2 {
+			lon, errLon := strconv.ParseFloat(strings.TrimSpace(coords[0]), 64)
+			lat, errLat := strconv.ParseFloat(strings.TrimSpace(coords[1]), 64)
+			if errLon == nil && errLat == nil {
+				p.Latitude, p.Longitude, p.HasPoint = lat, lon, true
+			}
+		}
+		placemarks = append(placemarks, p)
+	}
+}
+
+// geoJSONFeatures is the part of a GeoJSON FeatureCollection which is
+// imported.
+type geoJSONFeatures struct {
+	Features []struct {
+		Geometry *struct {
+			Type        string
+			Coordinates json.RawMessage
+		}
+		Properties map[string]interface{}
+	}
+}
+
+// readGeoJSON reads every Feature in the given GeoJSON
+// FeatureCollection.
+func readGeoJSON(r io.Reader) (placemarks []*placemark, err error) {
+	var fc geoJSONFeatures
+	if err = json.NewDecoder(r).Decode(&fc); err != nil {
+		return
+	}
+	for _, f := range fc.Features {
+		p := &placemark{Fields: make(map[string]string)}
+		for k, v := range f.Properties {
+			switch v := v.(type) {
+			case nil:
+			case string:
+				p.Fields[k] = strings.TrimSpace(v)
+			default:
+				p.Fields[k] = fmt.Sprint(v)
+			}
+		}
+		p.Name = p.Fields["name"]
+
+		// Coordinates are [lon, lat(, alt)].
+		var coords []float64
+		if f.Geometry != nil && f.Geometry.Type == "Point" &&
+			json.Unmarshal(f.Geometry.Coordinates, &coords) == nil &&
+			len(coords) >= 2 {
+			p.Latitude, p.Longitude, p.HasPoint = coords[1], coords[0], true
+		}
+		placemarks = append(placemarks, p)
+	}
+	return
+}
+
+// ImportConflict describes a placemark or feature which cannot be
+// imported, by its position in the file, starting from 1.
+type ImportConflict struct {
+	Index   int
+	Name    string
+	Address string `json:",omitempty"`
+	Reason  string
+}
+
+// ImportReport is the result of previewing or committing an import.
+type ImportReport struct {
+	// Nodes are the nodes which are, or would be, added.
+	Nodes []*Node
+
+	// Conflicts are the placemarks or features which are not added.
+	Conflicts []*ImportConflict
+
+	// Links is the number of links which are, or would be, imported
+	// with the nodes, if any are.
+	Links int
+
+	// Committed is true if the nodes were added.
+	Committed bool
+}
+
+// parseImportStatus parses a status which is either a number of
+// status flags, or "active" or "planned".
+func parseImportStatus(s string) (status uint32, ok bool) {
+	switch strings.ToLower(s) {
+	case "", "planned":
+		return 0, true
+	case "active":
+		return StatusActive, true
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	return uint32(n), err == nil
+}
+
+// importCandidate is a node read from a file or another database to
+// be imported, before it is checked.
+type importCandidate struct {
+	// Name and Address identify the node in the source, and Address
+	// is the address before it was parsed.
+	Name, Address string
+
+	Node *Node
+
+	// HasPoint is true if the node had a location, and StatusOK is
+	// true if it had a valid status, or none.
+	HasPoint, StatusOK bool
+}
+
+// checkImport checks each of the given candidates for conflicts with
+// local nodes, with those before it, and for invalid fields, and
+// returns a report of those which can be added and those which
+// cannot.
+func checkImport(candidates []*importCandidate) (report *ImportReport, err error) {
+	local := make(map[string]bool)
+	rows, err := Db.Query(`SELECT address FROM nodes;`)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var addr []byte
+		if err = rows.Scan(&addr); err != nil {
+			rows.Close()
+			return
+		}
+		local[string(addr)] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	report = &ImportReport{
+		Nodes:     make([]*Node, 0),
+		Conflicts: make([]*ImportConflict, 0),
+	}
+	seen := make(map[string]bool)
+	for i, cand := range candidates {
+		node := cand.Node
+		c := &ImportConflict{
+			Index:   i + 1,
+			Name:    cand.Name,
+			Address: cand.Address,
+		}
+		switch {
+		case len(node.Addr) == 0:
+			c.Reason = "addressInvalid"
+		case local[string(node.Addr)]:
+			c.Reason = "addressExists"
+		case seen[string(node.Addr)]:
+			c.Reason = "addressDuplicated"
+		case !cand.HasPoint ||
+			!validCoordinates(node.Latitude, node.Longitude):
+			c.Reason = "locationInvalid"
+		case len(node.OwnerName) == 0 || len(node.OwnerName) > 255:
+			c.Reason = "ownerInvalid"
+		case !EmailRegexp.MatchString(node.OwnerEmail):
+			c.Reason = "emailInvalid"
+		case len(node.Contact) > 255:
+			c.Reason = "contactTooLong"
+		case len(node.Details) > 255:
+			c.Reason = "detailsTooLong"
+		case !cand.StatusOK:
+			c.Reason = "statusInvalid"
+		default:
+			if err := ValidateNode(node); err != nil {
+				c.Reason = err.Error()
+			}
+		}
+		if len(c.Reason) > 0 {
+			report.Conflicts = append(report.Conflicts, c)
+			continue
+		}
+		seen[string(node.Addr)] = true
+		report.Nodes = append(report.Nodes, node)
+	}
+	return
+}
+
+// ImportPlacemarks reads nodes from the given KML ("kml") or GeoJSON
+// ("geojson") file, with fields named by the given mapping, and checks
+// each for conflicts with local nodes and with the rest of the file.
+// Nodes which have no email address are given the defaultEmail. If
+// commit is true, the nodes which have no conflicts are added, and
+// otherwise nothing is changed, so that the report can be previewed.
+func ImportPlacemarks(r io.Reader, format string, m FieldMapping, defaultEmail string, commit bool) (report *ImportReport, err error) {
+	var placemarks []*placemark
+	switch format {
+	case "kml":
+		placemarks, err = readKML(r)
+	case "geojson":
+		placemarks, err = readGeoJSON(r)
+	default:
+		return nil, ImportFormatInvalidError
+	}
+	if err != nil {
+		return
+	}
+
+	candidates := make([]*importCandidate, len(placemarks))
+	for i, p := range placemarks {
+		c := &importCandidate{
+			Name:    p.Name,
+			Address: p.Fields[m.Address],
+			Node: &Node{
+				OwnerName:  html.EscapeString(p.Fields[m.Owner]),
+				OwnerEmail: p.Fields[m.Email],
+				Contact:    html.EscapeString(p.Fields[m.Contact]),
+				Details:    html.EscapeString(p.Fields[m.Details]),
+				Latitude:   p.Latitude,
+				Longitude:  p.Longitude,
+			},
+			HasPoint: p.HasPoint,
+		}
+		c.Node.Addr = ParseIP(c.Address)
+		if len(c.Node.OwnerEmail) == 0 {
+			c.Node.OwnerEmail = defaultEmail
+		}
+		c.Node.Status, c.StatusOK = parseImportStatus(p.Fields[m.Status])
+		candidates[i] = c
+	}
+	if report, err = checkImport(candidates); err != nil {
+		return
+	}
+
+	if commit && len(report.Nodes) > 0 {
+		if err = Db.AddNodes(report.Nodes); err != nil {
+			return
+		}
+		for _, node := range report.Nodes {
+			LocateNode(node)
+		}
+	}
+	report.Committed = commit
+	return
+}
+
+// importFormat returns the format of the named file, from its
+// extension.
+func importFormat(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".kml":
+		return "kml"
+	case ".json", ".geojson":
+		return "geojson"
+	}
+	return ""
+}
+
+// RunImportCommand runs "nodeatlas import", which imports nodes from
+// the KML file given by --kml, or the GeoJSON file given by --geojson.
+// It prints the nodes which would be added and the conflicts, and only
+// adds them if --commit is given.
+func RunImportCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	kml := fs.String("kml", "", "import placemarks from a KML file")
+	geojson := fs.String("geojson", "", "import features from a GeoJSON file")
+	wind := fs.String("wind", "",
+		"import nodes and links from the WiND MySQL database with this DSN")
+	nodewatcher := fs.String("nodewatcher", "",
+		"import nodes and links from a nodewatcher node API export")
+	fields := fs.String("fields", "",
+		"map node fields to placemark fields, such as \"address=ip,owner=name\"")
+	email := fs.String("email", Conf.AdminContact.Email,
+		"owner email of nodes which have none")
+	commit := fs.Bool("commit", false,
+		"add the nodes, rather than only previewing them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	path, format := *kml, "kml"
+	switch {
+	case len(*geojson) > 0:
+		path, format = *geojson, "geojson"
+	case len(*wind) > 0:
+		path, format = *wind, "wind"
+	case len(*nodewatcher) > 0:
+		path, format = *nodewatcher, "nodewatcher"
+	}
+	if len(path) == 0 {
+		return errors.New("--kml, --geojson, --wind, or --nodewatcher " +
+			"is required")
+	} else if *commit && Db.ReadOnly {
+		return ReadOnlyError
+	}
+
+	var report *ImportReport
+	switch format {
+	case "wind":
+		nodes, links, err := ReadWiND(path)
+		if err != nil {
+			return err
+		}
+		report, err = ImportLegacy(format, nodes, links, *email, *commit)
+		if err != nil {
+			return err
+		}
+	case "nodewatcher":
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		nodes, links, err := ReadNodewatcher(f)
+		if err != nil {
+			return err
+		}
+		report, err = ImportLegacy(format, nodes, links, *email, *commit)
+		if err != nil {
+			return err
+		}
+	default:
+		m, err := ParseFieldMapping(*fields)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if report, err = ImportPlacemarks(f, format, m, *email,
+			*commit); err != nil {
+			return err
+		}
+	}
+
+	for _, node := range report.Nodes {
+		fmt.Printf("add\t%s\t%s\t%f,%f\n", node.Addr, node.OwnerName,
+			node.Latitude, node.Longitude)
+	}
+	for _, c := range report.Conflicts {
+		fmt.Printf("skip\t#%d %q\t%s\t%s\n", c.Index, c.Name, c.Address,
+			c.Reason)
+	}
+	if report.Committed {
+		fmt.Printf("Added %d nodes and %d links, skipped %d\n",
+			len(report.Nodes), report.Links, len(report.Conflicts))
+	} else {
+		fmt.Printf("Would add %d nodes and %d links, skip %d; run "+
+			"again with --commit to add them\n", len(report.Nodes),
+			report.Links, len(report.Conflicts))
+	}
+	return nil
+}
+
+// PostImport imports nodes from an uploaded KML or GeoJSON `file`, as
+// with ImportPlacemarks, in the given `format`, or that of the file's
+// extension. The node fields are mapped to placemark fields by
+// `fields`, such as "address=ip,owner=name", and nodes without an
+// email address are given the `email`, or that of the admin. Nothing
+// is added unless `commit` is true. Only admins may import nodes.
+func (*Api) PostImport(ctx *jas.Context) {
+	RequireAdmin(ctx)
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+
+	f, header, err := ctx.Request.FormFile("file")
+	if err != nil {
+		ctx.Error = jas.NewRequestError("fileMissing")
+		return
+	}
+	defer f.Close()
+
+	format, _ := ctx.FindString("format")
+	if len(format) == 0 {
+		format = importFormat(header.Filename)
+	}
+	fields, _ := ctx.FindString("fields")
+	m, err := ParseFieldMapping(fields)
+	if err != nil {
+		ctx.Error = jas.NewRequestError("fieldsInvalid")
+		return
+	}
+	email, _ := ctx.FindStringMatch(EmailRegexp, "email")
+	if len(email) == 0 {
+		email = Conf.AdminContact.Email
+	}
+	commit, _ := ctx.FindBool("commit")
+
+	report, err := ImportPlacemarks(&limitedBody{R: f,
+		N: DefaultImportMaxBytes + 1}, format, m, email, commit)
+	switch err {
+	case nil:
+	case ImportFormatInvalidError:
+		ctx.Error = jas.NewRequestError(err.Error())
+		return
+	case ResponseTooLargeError:
+		ctx.Error = jas.NewRequestError("fileTooLarge")
+		return
+	default:
+		if _, ok := err.(*json.SyntaxError); ok {
+			ctx.Error = jas.NewRequestError("fileInvalid")
+			return
+		} else if _, ok := err.(*xml.SyntaxError); ok {
+			ctx.Error = jas.NewRequestError("fileInvalid")
+			return
+		}
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error importing %q: %s",
+			header.Filename, err)
+		return
+	}
+	if report.Committed {
+		apiLog.Request(ctx.Request).Noticef("%q imported %d nodes from %q",
+			ctx.RemoteAddr,
+			len(report.Nodes), header.Filename)
+	}
+	ctx.Data = report
+}
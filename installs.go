@@ -0,0 +1,618 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/coocood/jas"
+	"html"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxAvailabilityPeriod is the longest period of time which a
+	// volunteer may mark as available at once.
+	MaxAvailabilityPeriod = 14 * 24 * time.Hour
+
+	// MaxInvitees is the largest number of people who may be invited
+	// to a single install.
+	MaxInvitees = 20
+
+	// installFeedHistory is how long installs remain in the iCal feed
+	// after they end.
+	installFeedHistory = 30 * 24 * time.Hour
+)
+
+// Availability is a period of time during which a volunteer is
+// available to help with installs.
+type Availability struct {
+	ID         int64
+	Name       string
+	Email      string
+	Start, End time.Time
+}
+
+// Install is a scheduled installation at a local node, to which
+// volunteers and the node's owner can be invited.
+type Install struct {
+	ID   int64
+	Addr IP `json:"Address"`
+
+	// OwnerName, Latitude, and Longitude are those of the node.
+	OwnerName           string
+	Latitude, Longitude float64
+
+	Start, End time.Time
+	Notes      string `json:",omitempty"`
+	Invitees   []*Invitee
+}
+
+// Invitee is a person invited to an install, who confirms by
+// following the link in their invitation email.
+type Invitee struct {
+	Email     string
+	Confirmed bool
+
+	// confirmID is the random ID in the confirmation link.
+	confirmID int64
+}
+
+// AddAvailability records a volunteer's availability.
+func (db DB) AddAvailability(a *Availability) (err error) {
+	_, err = db.Exec(`INSERT INTO volunteer_availability
+(id, name, email, starts, ends)
+VALUES(?, ?, ?, ?, ?);`, a.ID, a.Name, a.Email, a.Start.Unix(),
+		a.End.Unix())
+	return
+}
+
+// UpcomingAvailability returns every period of availability which has
+// not yet ended, ordered by when it starts.
+func (db DB) UpcomingAvailability() (periods []*Availability, err error) {
+	rows, err := db.Query(`SELECT id,name,email,starts,ends
+FROM volunteer_availability
+WHERE ends > ?
+ORDER BY starts;`, time.Now().Unix())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	periods = make([]*Availability, 0)
+	for rows.Next() {
+		a := new(Availability)
+		var start, end int64
+		if err = rows.Scan(&a.ID, &a.Name, &a.Email, &start, &end); err != nil {
+			return
+		}
+		a.Start, a.End = time.Unix(start, 0), time.Unix(end, 0)
+		periods = append(periods, a)
+	}
+	return periods, rows.Err()
+}
+
+// AddInstall records an install and its invitees.
+func (db DB) AddInstall(i *Install) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(`INSERT INTO installs
+(id, address, starts, ends, notes, created)
+VALUES(?, ?, ?, ?, ?, ?);`, i.ID, []byte(i.Addr), i.Start.Unix(),
+		i.End.Unix(), i.Notes, time.Now().Unix())
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	for _, invitee := range i.Invitees {
+		_, err = tx.Exec(`INSERT INTO install_invitees
+(id, install, email, confirmed)
+VALUES(?, ?, ?, ?);`, invitee.confirmID, i.ID, invitee.Email,
+			invitee.Confirmed)
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+	return tx.Commit()
+}
+
+// InstallsEndingAfter returns every install which ends after the
+// given time, and whose node still exists, with its invitees, ordered
+// by when it starts.
+func (db DB) InstallsEndingAfter(t time.Time) (installs []*Install, err error) {
+	rows, err := db.Query(`SELECT
+installs.id,installs.address,nodes.owner,nodes.lat,nodes.lon,
+installs.starts,installs.ends,installs.notes
+FROM installs
+INNER JOIN nodes ON installs.address = nodes.address
+WHERE installs.ends > ?
+ORDER BY installs.starts;`, t.Unix())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	installs = make([]*Install, 0)
+	byID := make(map[int64]*Install)
+	for rows.Next() {
+		i := &Install{Invitees: make([]*Invitee, 0)}
+		var notes sql.NullString
+		var start, end int64
+		err = rows.Scan(&i.ID, &i.Addr, &i.OwnerName, &i.Latitude,
+			&i.Longitude, &start, &end, &notes)
+		if err != nil {
+			return
+		}
+		i.Start, i.End = time.Unix(start, 0), time.Unix(end, 0)
+		i.Notes = notes.String
+		installs = append(installs, i)
+		byID[i.ID] = i
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	// Attach the invitees of each install.
+	rows, err = db.Query(`SELECT install_invitees.install,
+install_invitees.email,install_invitees.confirmed
+FROM install_invitees
+INNER JOIN installs ON install_invitees.install = installs.id
+WHERE installs.ends > ?;`, t.Unix())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		invitee := new(Invitee)
+		if err = rows.Scan(&id, &invitee.Email, &invitee.Confirmed); err != nil {
+			return
+		}
+		if i, ok := byID[id]; ok {
+			i.Invitees = append(i.Invitees, invitee)
+		}
+	}
+	return installs, rows.Err()
+}
+
+// ConfirmInvitee marks the invitee with the given confirmation ID as
+// confirmed. If there is no such invitee, it returns sql.ErrNoRows.
+func (db DB) ConfirmInvitee(id int64) (err error) {
+	res, err := db.Exec(`UPDATE install_invitees
+SET confirmed = 1
+WHERE id = ?;`, id)
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return
+}
+
+// DeleteInstall removes the install with the given ID and its
+// invitees.
+func (db DB) DeleteInstall(id int64) (err error) {
+	_, err = db.Exec(`DELETE FROM install_invitees
+WHERE install = ?;`, id)
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`DELETE FROM installs
+WHERE id = ?;`, id)
+	return
+}
+
+// requireTimeRange retrieves the RFC3339 times `start` and `end` from
+// the request, and ensures that the end is after the start. If there
+// is an error, it is set as ctx.Error and ok is false.
+func requireTimeRange(ctx *jas.Context) (start, end time.Time, ok bool) {
+	var err error
+	start, err = time.Parse(time.RFC3339, ctx.RequireString("start"))
+	if err != nil {
+		ctx.Error = jas.NewRequestError("startInvalid")
+		return
+	}
+	end, err = time.Parse(time.RFC3339, ctx.RequireString("end"))
+	if err != nil || !end.After(start) {
+		ctx.Error = jas.NewRequestError("endInvalid")
+		return
+	}
+	return start, end, true
+}
+
+// PostAvailability marks a volunteer as available for installs
+// between the RFC3339 times `start` and `end`, which may be up to two
+// weeks apart. It requires a `name` and `email`, a token, and a
+// correct CAPTCHA pair.
+func (*Api) PostAvailability(ctx *jas.Context) {
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	db := Db.WithContext(ctx.Request.Context())
+	RequireToken(ctx)
+	if !IsAdmin(ctx.Request) {
+		if err := VerifyCAPTCHA(ctx.Request); err != nil {
+			ctx.Error = jas.NewRequestError(err.Error())
+			return
+		}
+	}
+
+	a := &Availability{
+		ID:    rand.Int63(),
+		Name:  html.EscapeString(ctx.RequireStringLen(1, 255, "name")),
+		Email: ctx.RequireStringMatch(EmailRegexp, "email"),
+	}
+	var ok bool
+	if a.Start, a.End, ok = requireTimeRange(ctx); !ok {
+		return
+	}
+	if a.End.Sub(a.Start) > MaxAvailabilityPeriod || a.End.Before(time.Now()) {
+		ctx.Error = jas.NewRequestError("endInvalid")
+		return
+	}
+
+	if err := db.AddAvailability(a); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error adding availability: %s", err)
+		return
+	}
+	ctx.Data = "successful"
+}
+
+// GetAvailability returns every period of volunteer availability
+// which has not yet ended. Only admins may see it.
+func (*Api) GetAvailability(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	var err error
+	ctx.Data, err = db.UpcomingAvailability()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error getting availability: %s", err)
+	}
+}
+
+// PostInstall schedules an install at the local node with the given
+// `address`, between the RFC3339 times `start` and `end`, with
+// optional `notes`. Each of the comma-separated email addresses in
+// `invitees` is emailed a link with which to confirm. Only admins may
+// schedule installs.
+func (*Api) PostInstall(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+
+	ip := ParseIP(ctx.RequireStringLen(0, 40, "address"))
+	if ip == nil {
+		ctx.Error = jas.NewRequestError("addressInvalid")
+		return
+	}
+	node, err := db.GetLocalNode(ip)
+	if err != nil {
+		ctx.Error = apiError(ctx.Request, err)
+		return
+	}
+
+	i := &Install{
+		ID:        rand.Int63(),
+		Addr:      ip,
+		OwnerName: node.OwnerName,
+		Latitude:  node.Latitude,
+		Longitude: node.Longitude,
+		Invitees:  make([]*Invitee, 0),
+	}
+	var ok bool
+	if i.Start, i.End, ok = requireTimeRange(ctx); !ok {
+		return
+	}
+	i.Notes, _ = ctx.FindStringLen(0, 1000, "notes")
+	i.Notes = html.EscapeString(i.Notes)
+
+	invitees, _ := ctx.FindString("invitees")
+	for _, email := range strings.Split(invitees, ",") {
+		email = strings.TrimSpace(email)
+		if len(email) == 0 {
+			continue
+		} else if !EmailRegexp.MatchString(email) {
+			ctx.Error = jas.NewRequestError("inviteesInvalid")
+			return
+		}
+		// The ID confirms the invitation, and so must not be
+		// guessable.
+		confirmID, err := newRandomID()
+		if err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			apiLog.Request(ctx.Request).Err(err)
+			return
+		}
+		i.Invitees = append(i.Invitees, &Invitee{
+			Email:     email,
+			confirmID: confirmID,
+		})
+	}
+	if len(i.Invitees) > MaxInvitees {
+		ctx.Error = jas.NewRequestError("inviteesInvalid")
+		return
+	}
+	if len(i.Invitees) > 0 && Conf.SMTP == nil {
+		ctx.Error = jas.NewInternalError(SMTPDisabledError)
+		apiLog.Request(ctx.Request).Err(SMTPDisabledError)
+		return
+	}
+
+	if err = db.AddInstall(i); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error adding install: %s", err)
+		return
+	}
+	apiLog.Request(ctx.Request).Infof("Admin %q scheduled install %d at %q",
+		ctx.RemoteAddr, i.ID, ip)
+
+	// The install is scheduled even if some invitations can't be
+	// sent, so just report how many were.
+	sent := 0
+	for _, invitee := range i.Invitees {
+		if err := SendInstallInvitation(i, invitee, ctx.Request); err != nil {
+			mailLog.Request(ctx.Request).Errf(
+				"Error inviting %q to install %d: %s",
+				invitee.Email, i.ID, err)
+			continue
+		}
+		sent++
+	}
+	ctx.Data = map[string]interface{}{
+		"ID":          i.ID,
+		"Invitations": sent,
+	}
+}
+
+// GetInstalls returns every install which has not yet ended, with its
+// invitees. Only admins may see them.
+func (*Api) GetInstalls(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	var err error
+	ctx.Data, err = db.InstallsEndingAfter(time.Now())
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error getting installs: %s", err)
+	}
+}
+
+// GetConfirmInstall confirms an invitation to an install, as
+// identified by the `id` in the emailed link.
+func (*Api) GetConfirmInstall(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	err := db.ConfirmInvitee(ctx.RequireInt("id"))
+	if err == sql.ErrNoRows {
+		ctx.Error = jas.NewRequestError("invalid id")
+	} else if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Err(err)
+	} else {
+		ctx.Data = "confirmed"
+	}
+}
+
+// PostCancelInstall removes the install with the given `id`. Only
+// admins may cancel installs.
+func (*Api) PostCancelInstall(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	id := ctx.RequireInt("id")
+	if err := db.DeleteInstall(id); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Err(err)
+		return
+	}
+	ctx.Data = "cancelled"
+	apiLog.Request(ctx.Request).Infof("Admin %q cancelled install %d",
+		ctx.RemoteAddr, id)
+}
+
+// SendInstallInvitation emails the invitee a description of the
+// install and a link with which to confirm.
+func SendInstallInvitation(i *Install, invitee *Invitee, r *http.Request) error {
+	e := &Email{
+		To:   invitee.Email,
+		From: Conf.SMTP.EmailAddress,
+		Subject: Translations.Translate(Conf.DefaultLocale(),
+			"email.install.subject", Conf.Name),
+	}
+	e.Data = map[string]interface{}{
+		"Install":   i,
+		"Link":      BaseURL(r),
+		"NodeLink":  NodePageURL(r, i.Addr),
+		"ConfirmID": invitee.confirmID,
+		"Name":      Conf.Name,
+		"Boundary":  rand.Int31(),
+	}
+	return e.Send("install.txt")
+}
+
+// checkInstallsFeedKey returns true if the request may see the
+// iCalendar feeds of installs. If Conf.Installs.FeedKey is set, it
+// must be given as the form value `key`, unless the request comes from
+// an admin. If it is not, the error is written.
+func checkInstallsFeedKey(w http.ResponseWriter, r *http.Request) bool {
+	if key := Conf.Installs.FeedKey; len(key) > 0 && !IsAdmin(r) &&
+		subtle.ConstantTimeCompare([]byte(r.FormValue("key")),
+			[]byte(key)) != 1 {
+		http.Error(w, "keyInvalid", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// HandleInstallsICS serves an iCalendar feed of installs which have
+// not ended, or ended recently, so that volunteers can subscribe to
+// them. If Conf.Installs.FeedKey is set, it must be given as the form
+// value `key`, unless the request comes from an admin.
+func HandleInstallsICS(w http.ResponseWriter, r *http.Request) {
+	db := Db.WithContext(r.Context())
+	if !checkInstallsFeedKey(w, r) {
+		return
+	}
+
+	installs, err := db.InstallsEndingAfter(
+		time.Now().Add(-installFeedHistory))
+	if err != nil {
+		dbLog.Request(r).Errf("Error getting installs: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	cal := NewICalWriter(w, Conf.Name+" installs")
+	writeInstallEvents(cal, installs, PageURL(r), r.Host)
+	if err = cal.Close(); err != nil {
+		l.Warningf("Error writing installs feed: %s", err)
+	}
+}
+
+// writeInstallEvents writes a VEVENT for each of the installs, whose
+// UIDs are qualified by host, and whose URLs are beneath base.
+func writeInstallEvents(cal *ICalWriter, installs []*Install, base, host string) {
+	for _, i := range installs {
+		confirmed := 0
+		for _, invitee := range i.Invitees {
+			if invitee.Confirmed {
+				confirmed++
+			}
+		}
+		description := fmt.Sprintf("%d of %d invitees confirmed.",
+			confirmed, len(i.Invitees))
+		if len(i.Notes) > 0 {
+			description = html.UnescapeString(i.Notes) + "\n\n" +
+				description
+		}
+		cal.WriteEvent(&ICalEvent{
+			UID:   "install-" + strconv.FormatInt(i.ID, 10) + "@" + host,
+			Start: i.Start,
+			End:   i.End,
+			Summary: "Install: " + html.UnescapeString(i.OwnerName) +
+				" (" + i.Addr.String() + ")",
+			Description: description,
+			URL:         base + "/node/" + i.Addr.String(),
+			Geo:         true,
+			Latitude:    i.Latitude,
+			Longitude:   i.Longitude,
+		})
+	}
+}
+
+// PlannedNode is a local node which is planned, and so is an
+// opportunity for volunteers to help build.
+type PlannedNode struct {
+	Addr                IP
+	OwnerName           string
+	Latitude, Longitude float64
+
+	// Since is the time at which its status last changed, which is
+	// when it was added or became planned.
+	Since time.Time
+}
+
+// PlannedNodesSince returns the local nodes which are planned, and
+// whose status last changed at or after the given time, most recent
+// first.
+func (db DB) PlannedNodesSince(t time.Time) (nodes []*PlannedNode, err error) {
+	rows, err := db.Query(`SELECT
+nodes.address,nodes.owner,nodes.lat,nodes.lon,MAX(status_history.changed)
+FROM nodes
+INNER JOIN status_history ON nodes.address = status_history.address
+WHERE (nodes.status & ?) = 0
+GROUP BY nodes.address,nodes.owner,nodes.lat,nodes.lon
+HAVING MAX(status_history.changed) >= ?
+ORDER BY MAX(status_history.changed) DESC;`, StatusActive, t.Unix())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	nodes = make([]*PlannedNode, 0)
+	for rows.Next() {
+		n := new(PlannedNode)
+		var since int64
+		if err = rows.Scan(&n.Addr, &n.OwnerName, &n.Latitude,
+			&n.Longitude, &since); err != nil {
+			return
+		}
+		n.Since = time.Unix(since, 0)
+		nodes = append(nodes, n)
+	}
+	return nodes, rows.Err()
+}
+
+// HandlePlannedICS serves an iCalendar feed of upcoming build
+// opportunities, so that they appear in volunteers' calendars. It has
+// the installs of HandleInstallsICS, and an event for each node which
+// became planned recently, at the time it did. It is protected by
+// Conf.Installs.FeedKey in the same way.
+func HandlePlannedICS(w http.ResponseWriter, r *http.Request) {
+	db := Db.WithContext(r.Context())
+	if !checkInstallsFeedKey(w, r) {
+		return
+	}
+
+	since := time.Now().Add(-installFeedHistory)
+	installs, err := db.InstallsEndingAfter(since)
+	if err != nil {
+		dbLog.Request(r).Errf("Error getting installs: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	planned, err := db.PlannedNodesSince(since)
+	if err != nil {
+		dbLog.Request(r).Errf("Error getting planned nodes: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	base := PageURL(r)
+	host := r.Host
+	cal := NewICalWriter(w, Conf.Name+" planned nodes and installs")
+	writeInstallEvents(cal, installs, base, host)
+	for _, n := range planned {
+		owner := html.UnescapeString(n.OwnerName)
+		cal.WriteEvent(&ICalEvent{
+			UID: "planned-" + hex.EncodeToString(n.Addr) + "-" +
+				strconv.FormatInt(n.Since.Unix(), 10) + "@" + host,
+			Start: n.Since,
+			Summary: "Planned node: " + owner + " (" + n.Addr.String() +
+				")",
+			Description: owner + " is planning a node, and may need " +
+				"help to build it.",
+			URL:       base + "/node/" + n.Addr.String(),
+			Geo:       true,
+			Latitude:  n.Latitude,
+			Longitude: n.Longitude,
+		})
+	}
+	if err = cal.Close(); err != nil {
+		l.Warningf("Error writing planned nodes feed: %s", err)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"github.com/coocood/jas"
+	"html"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DefaultInterestDistance is the distance in meters within which the
+// requesters of interest points are notified of a new active node, if
+// Conf.Interest.NotifyDistance is not set.
+const DefaultInterestDistance = 500
+
+// InterestPoint is a place at which a visitor would like a node, so
+// that they can be told when one appears nearby. Unlike connection
+// requests, they are not addressed to any node.
+type InterestPoint struct {
+	ID    int64
+	Name  string `json:",omitempty"`
+	Email string
+
+	Latitude, Longitude float64
+	Created             time.Time
+
+	// Notified is the address of the node of which the requester was
+	// notified, if they have been.
+	Notified IP `json:",omitempty"`
+}
+
+// AddInterestPoint records an interest point.
+func (db DB) AddInterestPoint(p *InterestPoint) (err error) {
+	_, err = db.Exec(`INSERT INTO interest_points
+(id, name, email, lat, lon, created)
+VALUES(?, ?, ?, ?, ?, ?);`, p.ID, p.Name, p.Email, p.Latitude,
+		p.Longitude, p.Created.Unix())
+	return
+}
+
+// InterestPoints returns the interest points whose requesters have not
+// been notified, oldest first. If all is true, those who have been are
+// given as well.
+func (db DB) InterestPoints(all bool) (points []*InterestPoint, err error) {
+	rows, err := db.Query(`SELECT id,name,email,lat,lon,created,notified
+FROM interest_points
+WHERE ? OR notified IS NULL
+ORDER BY created;`, all)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	points = make([]*InterestPoint, 0)
+	for rows.Next() {
+		p := new(InterestPoint)
+		var name sql.NullString
+		var created int64
+		var notified []byte
+		err = rows.Scan(&p.ID, &name, &p.Email, &p.Latitude, &p.Longitude,
+			&created, &notified)
+		if err != nil {
+			return
+		}
+		p.Name = name.String
+		p.Created = time.Unix(created, 0)
+		if len(notified) > 0 {
+			p.Notified = IP(notified)
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// SetInterestNotified records that the requester of the interest point
+// with the given ID was notified of the node with the given address.
+func (db DB) SetInterestNotified(id int64, addr IP) (err error) {
+	_, err = db.Exec(`UPDATE interest_points SET notified = ?
+WHERE id = ?;`, []byte(addr), id)
+	return
+}
+
+// RemoveInterestPoint removes the interest point with the given ID. If
+// there is none, it returns sql.ErrNoRows.
+func (db DB) RemoveInterestPoint(id int64) (err error) {
+	res, err := db.Exec(`DELETE FROM interest_points
+WHERE id = ?;`, id)
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return
+}
+
+// interestLock is held while interest points are matched, so that a
+// requester is not notified twice by nodes which become active at the
+// same time.
+var interestLock sync.Mutex
+
+// MatchInterest notifies the requesters of the interest points near
+// the local node with the given address, as by NotifyInterest. It is
+// run whenever a node becomes active. Errors are logged.
+func MatchInterest(addr IP) {
+	node, err := Db.GetLocalNode(addr)
+	if err == LocalNodeNotFoundError {
+		return
+	} else if err != nil {
+		dbLog.Errf("Error getting node %q: %s", addr, err)
+		return
+	}
+	NotifyInterest(node)
+}
+
+// NotifyInterest emails the requester of every interest point within
+// Conf.Interest.NotifyDistance of the given node, if it is active and
+// they have not already been notified, and records that they have
+// been. It returns the number of requesters notified. Errors are
+// logged.
+func NotifyInterest(node *Node) (notified int) {
+	if Conf.SMTP == nil || node.Status&StatusActive == 0 {
+		return
+	}
+	distance := Conf.Interest.NotifyDistance
+	if distance <= 0 {
+		distance = DefaultInterestDistance
+	}
+	near := BoundsAround(node.Latitude, node.Longitude, distance)
+
+	interestLock.Lock()
+	defer interestLock.Unlock()
+	points, err := Db.InterestPoints(false)
+	if err != nil {
+		dbLog.Errf("Error listing interest points: %s", err)
+		return
+	}
+	for _, p := range points {
+		if !near.Contains(p.Latitude, p.Longitude) {
+			continue
+		}
+		d := Distance(p.Latitude, p.Longitude, node.Latitude,
+			node.Longitude)
+		if d > distance {
+			continue
+		}
+		e := &Email{
+			To:   p.Email,
+			From: Conf.SMTP.EmailAddress,
+			Subject: Translations.Translate(Conf.DefaultLocale(),
+				"email.interest.subject", Conf.Name),
+		}
+		e.Data = map[string]interface{}{
+			"Distance":     d,
+			"Name":         Conf.Name,
+			"Link":         NodePageURL(nil, node.Addr),
+			"AdminContact": Conf.AdminContact,
+			"Boundary":     rand.Int31(),
+		}
+		if err := e.Queue("interest.txt"); err != nil {
+			mailLog.Errf("Error notifying %q of %q: %s", p.Email,
+				node.Addr, err)
+			continue
+		}
+		if err := Db.SetInterestNotified(p.ID, node.Addr); err != nil {
+			dbLog.Errf("Error recording notification of %d: %s", p.ID,
+				err)
+		}
+		notified++
+	}
+	if notified > 0 {
+		mailLog.Infof("Notified %d requesters of interest points near %q\n",
+			notified, node.Addr)
+	}
+	return
+}
+
+// PostInterest records that a visitor would like a node at their
+// location, given by `latitude` and `longitude` or `street_address`,
+// so that they can be emailed at `email` when an active node appears
+// within Conf.Interest.NotifyDistance. It takes an optional `name`, and
+// requires a token and a correct CAPTCHA pair.
+func (*Api) PostInterest(ctx *jas.Context) {
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	db := Db.WithContext(ctx.Request.Context())
+	RequireToken(ctx)
+	if !IsAdmin(ctx.Request) {
+		if err := VerifyCAPTCHA(ctx.Request); err != nil {
+			ctx.Error = jas.NewRequestError(err.Error())
+			return
+		}
+	}
+
+	id, err := newRandomID()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Err(err)
+		return
+	}
+	p := &InterestPoint{
+		ID:      id,
+		Email:   ctx.RequireStringMatch(EmailRegexp, "email"),
+		Created: time.Now(),
+	}
+	if p.Latitude, p.Longitude, err = RequireLocation(ctx); err != nil {
+		return
+	}
+	p.Name, _ = ctx.FindStringLen(0, 255, "name")
+	p.Name = html.EscapeString(p.Name)
+
+	if err = db.AddInterestPoint(p); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error adding interest point: %s", err)
+		return
+	}
+	ctx.Data = "successful"
+	apiLog.Request(ctx.Request).Infof("%q requested a node near %f, %f\n",
+		ctx.RemoteAddr,
+		p.Latitude, p.Longitude)
+}
+
+// GetInterestPoints lists the interest points whose requesters have not
+// yet been notified, or every one if `all` is given. Only admins may
+// see them.
+func (*Api) GetInterestPoints(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	ctx.ParseForm()
+	_, all := ctx.Form["all"]
+	var err error
+	ctx.Data, err = db.InterestPoints(all)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error listing interest points: %s",
+			err)
+	}
+}
+
+// PostDeleteInterest removes the interest point with the given `id`,
+// such as at the requester's request. Only admins may remove them.
+func (*Api) PostDeleteInterest(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	err := db.RemoveInterestPoint(ctx.RequireInt("id"))
+	if err == sql.ErrNoRows {
+		ctx.Error = jas.NewRequestError("invalid id")
+		return
+	} else if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error removing interest point: %s",
+			err)
+		return
+	}
+	ctx.Data = "deleted"
+}
+
+// PostMatchInterest matches the interest points against the active
+// local node with the given `address`, or against every active local
+// node if none is given, and notifies the requesters of those which are
+// near, as is done whenever a node becomes active. This catches up
+// interest points which were added after the nodes near them became
+// active. It responds with the number of requesters notified. Only
+// admins may match interest points.
+func (*Api) PostMatchInterest(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	if Conf.SMTP == nil {
+		ctx.Error = jas.NewInternalError(SMTPDisabledError)
+		apiLog.Request(ctx.Request).Err(SMTPDisabledError)
+		return
+	}
+
+	var nodes []*Node
+	if a, _ := ctx.FindString("address"); len(a) > 0 {
+		nodes = []*Node{RequireLocalNode(ctx)}
+	} else {
+		var err error
+		if nodes, err = db.DumpLocal(); err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			apiLog.Request(ctx.Request).Errf("Error listing local nodes: %s",
+				err)
+			return
+		}
+	}
+
+	notified := 0
+	for _, node := range nodes {
+		if node != nil {
+			notified += NotifyInterest(node)
+		}
+	}
+	ctx.Data = notified
+}
@@ -0,0 +1,275 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"github.com/coocood/jas"
+	"html"
+	"net"
+)
+
+// Interface is a radio or ethernet interface of a local node, by which
+// the node can be recognized in the topology reported by its routing
+// daemon.
+type Interface struct {
+	// MAC is the hardware address of the interface, which is unique
+	// among all nodes.
+	MAC string
+
+	// Addr is the address of the node to which the interface
+	// belongs.
+	Addr IP `json:"Address"`
+
+	// Kind is either "radio" or "ethernet".
+	Kind string
+
+	// Name is the name of the interface on the node, such as
+	// "wlan0".
+	Name string `json:",omitempty"`
+
+	// IP is the address of the interface itself, if it differs from
+	// that of the node, such as the address on which OLSR runs.
+	IP IP `json:",omitempty"`
+
+	// Band, SSID, and Mode describe radio interfaces, such as "5GHz",
+	// "nycmesh-1234", and "ap".
+	Band string `json:",omitempty"`
+	SSID string `json:",omitempty"`
+	Mode string `json:",omitempty"`
+
+	// Channel is the channel number on which a radio transmits, or
+	// zero if it is not known.
+	Channel int `json:",omitempty"`
+
+	// Azimuth is the compass direction in degrees in which a
+	// directional radio points, or nil if it is omnidirectional or
+	// not known, and Beamwidth is the width of its beam in degrees,
+	// or zero if it is not known.
+	Azimuth   *float64 `json:",omitempty"`
+	Beamwidth float64  `json:",omitempty"`
+}
+
+// SaveInterface inserts the interface, or replaces the interface with
+// the same MAC address, even if it belonged to another node.
+func (db DB) SaveInterface(i *Interface) (err error) {
+	var ip interface{}
+	if i.IP != nil {
+		ip = []byte(i.IP)
+	}
+	_, err = db.Exec(`DELETE FROM interfaces
+WHERE mac = ?;`, i.MAC)
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`INSERT INTO interfaces
+(mac, address, kind, name, ip, band, ssid, mode, channel, azimuth,
+beamwidth)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`, i.MAC, []byte(i.Addr), i.Kind,
+		i.Name, ip, i.Band, i.SSID, i.Mode, i.Channel, i.Azimuth, i.Beamwidth)
+	return
+}
+
+// DeleteInterface removes the interface with the given MAC address
+// from the node with the given address. If there is no such interface,
+// it returns sql.ErrNoRows.
+func (db DB) DeleteInterface(addr IP, mac string) (err error) {
+	res, err := db.Exec(`DELETE FROM interfaces
+WHERE address = ? AND mac = ?;`, []byte(addr), mac)
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return
+}
+
+// RemoveInterfaces removes every interface of the node with the given
+// address, such as when it is deleted.
+func (db DB) RemoveInterfaces(addr IP) (err error) {
+	_, err = db.Exec(`DELETE FROM interfaces
+WHERE address = ?;`, []byte(addr))
+	return
+}
+
+// ListInterfaces returns every interface, ordered by node and name. If
+// addr is not nil, only the interfaces of that node are given.
+func (db DB) ListInterfaces(addr IP) (interfaces []*Interface, err error) {
+	var rows *sql.Rows
+	if addr == nil {
+		rows, err = db.Query(`SELECT mac,address,kind,name,ip,band,ssid,mode,
+channel,azimuth,beamwidth
+FROM interfaces
+ORDER BY address,name;`)
+	} else {
+		rows, err = db.Query(`SELECT mac,address,kind,name,ip,band,ssid,mode,
+channel,azimuth,beamwidth
+FROM interfaces
+WHERE address = ?
+ORDER BY name;`, []byte(addr))
+	}
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	interfaces = make([]*Interface, 0)
+	for rows.Next() {
+		i := new(Interface)
+		var name, band, ssid, mode sql.NullString
+		var ip []byte
+		var azimuth sql.NullFloat64
+		err = rows.Scan(&i.MAC, &i.Addr, &i.Kind, &name, &ip, &band,
+			&ssid, &mode, &i.Channel, &azimuth, &i.Beamwidth)
+		if err != nil {
+			return
+		}
+		if azimuth.Valid {
+			i.Azimuth = &azimuth.Float64
+		}
+		i.Name, i.Band = name.String, band.String
+		i.SSID, i.Mode = ssid.String, mode.String
+		if len(ip) > 0 {
+			i.IP = IP(ip)
+		}
+		interfaces = append(interfaces, i)
+	}
+	return interfaces, rows.Err()
+}
+
+// GetInterfaces lists the interfaces of the local node with the given
+// `address`, or, for admins, of every node if no address is given.
+func (*Api) GetInterfaces(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	var addr IP
+	if s, _ := ctx.FindString("address"); len(s) > 0 {
+		if addr = ParseIP(s); addr == nil {
+			ctx.Error = jas.NewRequestError("addressInvalid")
+			return
+		}
+	} else {
+		RequireAdmin(ctx)
+	}
+	var err error
+	ctx.Data, err = db.ListInterfaces(addr)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error listing interfaces: %s", err)
+	}
+}
+
+// PostInterface adds an interface with the given `mac` and `kind`,
+// which is "radio" or "ethernet", to the local node with the given
+// `address`, or replaces the interface with that MAC address. It takes
+// an optional `name`, `ip`, `band`, `ssid`, `mode`, `channel`, and
+// the `azimuth` and `beamwidth` of a directional radio. It requires
+// that the request be sent from the node's address, an admin address,
+// or with the node's `edit_token`.
+func (*Api) PostInterface(ctx *jas.Context) {
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	db := Db.WithContext(ctx.Request.Context())
+	RequireToken(ctx)
+	node := RequireLocalNode(ctx)
+	if !IsNodeOwner(ctx.Request, node.Addr) {
+		ctx.Error = jas.NewRequestError(
+			RemoteAddressDoesNotMatchError.Error())
+		return
+	}
+
+	mac, err := net.ParseMAC(ctx.RequireString("mac"))
+	if err != nil {
+		ctx.Error = jas.NewRequestError("macInvalid")
+		return
+	}
+	i := &Interface{
+		MAC:  mac.String(),
+		Addr: node.Addr,
+		Kind: ctx.RequireString("kind"),
+	}
+	if i.Kind != "radio" && i.Kind != "ethernet" {
+		ctx.Error = jas.NewRequestError("kindInvalid")
+		return
+	}
+	if s, _ := ctx.FindString("ip"); len(s) > 0 {
+		if i.IP = ParseIP(s); i.IP == nil {
+			ctx.Error = jas.NewRequestError("ipInvalid")
+			return
+		}
+	}
+	i.Name, _ = ctx.FindStringLen(0, 32, "name")
+	i.Name = html.EscapeString(i.Name)
+	i.Band, _ = ctx.FindStringLen(0, 32, "band")
+	i.Band = html.EscapeString(i.Band)
+	i.SSID, _ = ctx.FindStringLen(0, 32, "ssid")
+	i.SSID = html.EscapeString(i.SSID)
+	i.Mode, _ = ctx.FindStringLen(0, 32, "mode")
+	i.Mode = html.EscapeString(i.Mode)
+
+	if channel, err := ctx.FindPositiveInt("channel"); err == nil {
+		i.Channel = int(channel)
+	}
+	if azimuth, err := ctx.FindFloat("azimuth"); err == nil {
+		if azimuth < 0 || azimuth >= 360 {
+			ctx.Error = jas.NewRequestError("azimuthInvalid")
+			return
+		}
+		i.Azimuth = &azimuth
+	}
+	if beamwidth, err := ctx.FindFloat("beamwidth"); err == nil {
+		if beamwidth < 0 || beamwidth > 360 {
+			ctx.Error = jas.NewRequestError("beamwidthInvalid")
+			return
+		}
+		i.Beamwidth = beamwidth
+	}
+
+	if err = db.SaveInterface(i); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error saving interface of %q: %s",
+			node.Addr, err)
+		return
+	}
+	ctx.Data = i
+}
+
+// PostDeleteInterface removes the interface with the given `mac` from
+// the local node with the given `address`. It has the same
+// requirements as PostInterface.
+func (*Api) PostDeleteInterface(ctx *jas.Context) {
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	db := Db.WithContext(ctx.Request.Context())
+	RequireToken(ctx)
+	node := RequireLocalNode(ctx)
+	if !IsNodeOwner(ctx.Request, node.Addr) {
+		ctx.Error = jas.NewRequestError(
+			RemoteAddressDoesNotMatchError.Error())
+		return
+	}
+	mac, err := net.ParseMAC(ctx.RequireString("mac"))
+	if err != nil {
+		ctx.Error = jas.NewRequestError("macInvalid")
+		return
+	}
+
+	err = db.DeleteInterface(node.Addr, mac.String())
+	if err == sql.ErrNoRows {
+		ctx.Error = jas.NewRequestError("no matching interface")
+		return
+	} else if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error deleting interface of %q: %s",
+			node.Addr, err)
+		return
+	}
+	ctx.Data = "deleted"
+}
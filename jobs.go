@@ -0,0 +1,379 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// maxJobRuns is the number of runs of maintenance jobs which are
+	// remembered, so that their progress and results can be seen.
+	maxJobRuns = 50
+
+	// elevationBatch is the number of nodes whose elevations are
+	// looked up in a single request.
+	elevationBatch = 100
+)
+
+var (
+	UnknownJobError = newAPIError("unknown job", http.StatusNotFound)
+	JobRunningError = newAPIError("job already running",
+		http.StatusConflict)
+)
+
+// Job is a maintenance task which an admin can run on demand, such as
+// to fill in data which was missed or has become stale.
+type Job struct {
+	Name        string
+	Description string
+
+	// run performs the job, reporting its progress to the run.
+	run func(run *JobRun) error
+}
+
+// JobRun is a single run of a Job, and its progress.
+type JobRun struct {
+	ID  int64
+	Job string
+
+	// State is "queued", "running", "done", or "failed". If it
+	// failed, Error describes why, and it is queued to be retried
+	// until it has failed Conf.Queue.Attempts times.
+	State string
+	Error string `json:",omitempty"`
+
+	// Done and Total are the number of items processed, and the
+	// number to be processed, if it is known.
+	Done, Total int
+
+	Started  time.Time
+	Finished *time.Time `json:",omitempty"`
+
+	mutex sync.Mutex
+}
+
+// Progress records that done of total items have been processed.
+func (r *JobRun) Progress(done, total int) {
+	r.mutex.Lock()
+	r.Done, r.Total = done, total
+	r.mutex.Unlock()
+}
+
+// snapshot returns a copy of the run, which can be encoded while the
+// run continues.
+func (r *JobRun) snapshot() *JobRun {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return &JobRun{
+		ID: r.ID, Job: r.Job, State: r.State, Error: r.Error,
+		Done: r.Done, Total: r.Total,
+		Started: r.Started, Finished: r.Finished,
+	}
+}
+
+// Jobs are the built-in maintenance jobs, by name.
+var Jobs = map[string]*Job{
+	"geocode": {
+		Name:        "geocode",
+		Description: "Find the neighborhoods of local nodes which have none",
+		run:         geocodeJob,
+	},
+	"links": {
+		Name:        "links",
+		Description: "Remove stale links and recompute their distances",
+		run: func(run *JobRun) error {
+			_, err := Db.RecomputeLinks(run.Progress)
+			return err
+		},
+	},
+	"elevation": {
+		Name:        "elevation",
+		Description: "Refresh the ground elevations of local nodes",
+		run:         elevationJob,
+	},
+	"search": {
+		Name:        "search",
+		Description: "Rebuild the search and spatial indexes",
+		run:         searchJob,
+	},
+	"open_data": {
+		Name:        "open_data",
+		Description: "Export the anonymized open dataset of the nodes",
+		run: func(run *JobRun) error {
+			if err := ExportOpenData(); err != nil {
+				return err
+			}
+			run.Progress(1, 1)
+			return nil
+		},
+	},
+}
+
+// jobRuns are the most recent runs of jobs, oldest first.
+var jobRuns struct {
+	sync.Mutex
+	runs []*JobRun
+}
+
+// StartJob queues the job with the given name to be run in the
+// background, and returns its run. If there is no such job, it returns
+// UnknownJobError, and if it is already queued or running, it returns
+// JobRunningError.
+func StartJob(name string) (*JobRun, error) {
+	if _, ok := Jobs[name]; !ok {
+		return nil, UnknownJobError
+	}
+
+	jobRuns.Lock()
+	defer jobRuns.Unlock()
+	for _, r := range jobRuns.runs {
+		if state := r.snapshot().State; r.Job == name &&
+			(state == "queued" || state == "running") {
+			return nil, JobRunningError
+		}
+	}
+	run := &JobRun{
+		ID:      rand.Int63(),
+		Job:     name,
+		State:   "queued",
+		Started: time.Now(),
+	}
+	if err := Enqueue("job", queuedJob{Job: name, Run: run.ID}); err != nil {
+		return nil, err
+	}
+	addJobRun(run)
+	return run.snapshot(), nil
+}
+
+// addJobRun remembers the run, forgetting the oldest if there are more
+// than maxJobRuns. The caller must hold jobRuns.
+func addJobRun(run *JobRun) {
+	jobRuns.runs = append(jobRuns.runs, run)
+	if len(jobRuns.runs) > maxJobRuns {
+		jobRuns.runs = jobRuns.runs[len(jobRuns.runs)-maxJobRuns:]
+	}
+}
+
+// queuedJob is the payload of a queued "job" task.
+type queuedJob struct {
+	Job string
+	Run int64
+}
+
+// runQueuedJob runs a job which was queued by StartJob, recording its
+// progress in its run. If the run has been forgotten, such as because
+// the server restarted, a new one is recorded. If the job fails, the
+// error is returned so that it is retried.
+func runQueuedJob(payload []byte) error {
+	var q queuedJob
+	if err := json.Unmarshal(payload, &q); err != nil {
+		return err
+	}
+	job, ok := Jobs[q.Job]
+	if !ok {
+		return UnknownJobError
+	}
+
+	jobRuns.Lock()
+	var run *JobRun
+	for _, r := range jobRuns.runs {
+		if r.ID == q.Run {
+			run = r
+			break
+		}
+	}
+	if run == nil {
+		run = &JobRun{ID: q.Run, Job: q.Job}
+		addJobRun(run)
+	}
+	run.mutex.Lock()
+	run.State, run.Error = "running", ""
+	run.Started, run.Finished = time.Now(), nil
+	run.mutex.Unlock()
+	jobRuns.Unlock()
+
+	l.Noticef("Starting job %q\n", q.Job)
+	err := job.run(run)
+	finished := time.Now()
+
+	run.mutex.Lock()
+	run.Finished = &finished
+	if err != nil {
+		run.State, run.Error = "failed", err.Error()
+	} else {
+		run.State = "done"
+	}
+	run.mutex.Unlock()
+	if err != nil {
+		l.Errf("Job %q failed: %s", q.Job, err)
+	} else {
+		l.Noticef("Job %q finished\n", q.Job)
+	}
+	return err
+}
+
+// JobRuns returns snapshots of the most recent runs of jobs, most
+// recent first.
+func JobRuns() []*JobRun {
+	jobRuns.Lock()
+	defer jobRuns.Unlock()
+	runs := make([]*JobRun, len(jobRuns.runs))
+	for i, r := range jobRuns.runs {
+		runs[len(runs)-1-i] = r.snapshot()
+	}
+	return runs
+}
+
+// geocodeJob reverse geocodes every local node which has no
+// neighborhood name, such as those added while geocoding was disabled
+// or failing.
+func geocodeJob(run *JobRun) error {
+	if Conf.Geocoder == nil || len(Conf.Geocoder.URL) == 0 {
+		return GeocoderDisabledError
+	}
+	nodes, err := Db.DumpLocal()
+	if err != nil {
+		return err
+	}
+	missing := make([]*Node, 0)
+	for _, n := range nodes {
+		if n != nil && len(n.Neighborhood) == 0 {
+			missing = append(missing, n)
+		}
+	}
+	for i, n := range missing {
+		// ReverseGeocode waits for the geocoder's rate limit, so this
+		// is as fast as is allowed.
+		neighborhood, err := ReverseGeocode(n.Latitude, n.Longitude)
+		if err != nil {
+			return err
+		}
+		if err = Db.SetNeighborhood(n.Addr, neighborhood); err != nil {
+			return err
+		}
+		run.Progress(i+1, len(missing))
+	}
+	return nil
+}
+
+// elevationJob looks up the ground elevation of every local node, in
+// batches.
+func elevationJob(run *JobRun) error {
+	nodes, err := Db.DumpLocal()
+	if err != nil {
+		return err
+	}
+	located := make([]*Node, 0, len(nodes))
+	for _, n := range nodes {
+		if n != nil {
+			located = append(located, n)
+		}
+	}
+
+	for start := 0; start < len(located); start += elevationBatch {
+		end := start + elevationBatch
+		if end > len(located) {
+			end = len(located)
+		}
+		batch := located[start:end]
+		points := make([][2]float64, len(batch))
+		for i, n := range batch {
+			points[i] = [2]float64{n.Latitude, n.Longitude}
+		}
+		elevations, err := LookupElevations(points)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for i, n := range batch {
+			err = Db.SetElevation(&Elevation{
+				Addr:    n.Addr,
+				Meters:  elevations[i],
+				Updated: now,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		run.Progress(end, len(located))
+	}
+	return nil
+}
+
+// searchJob rebuilds the in-memory indexes of the nodes immediately,
+// rather than when they are next used.
+func searchJob(run *JobRun) error {
+	InvalidateIndexes()
+	if _, _, err := Searcher.current(); err != nil {
+		return err
+	}
+	run.Progress(1, 2)
+	if _, err := Index.current(); err != nil {
+		return err
+	}
+	run.Progress(2, 2)
+	return nil
+}
+
+// HandleAdminJobs serves "<prefix>/api/admin/jobs", which lists the
+// maintenance jobs and their recent runs, with their progress, and
+// "<prefix>/api/admin/jobs/<name>", to which a POST queues the job to
+// be run in the background. Only admins may use either.
+func HandleAdminJobs(w http.ResponseWriter, req *http.Request) {
+	resp := new(apiResponse)
+	status := http.StatusOK
+	name := path.Base(req.URL.Path)
+
+	switch {
+	case !IsAdmin(req):
+		status, resp.Error = http.StatusForbidden, "notAdmin"
+	case name == "jobs" && (req.Method == "GET" || req.Method == "HEAD"):
+		jobs := make([]*Job, 0, len(Jobs))
+		for _, job := range Jobs {
+			jobs = append(jobs, job)
+		}
+		sort.Sort(jobsByName(jobs))
+		resp.Data = map[string]interface{}{
+			"Jobs": jobs,
+			"Runs": JobRuns(),
+		}
+	case name == "jobs":
+		status, resp.Error = http.StatusMethodNotAllowed,
+			http.StatusText(http.StatusMethodNotAllowed)
+	case req.Method != "POST":
+		status, resp.Error = http.StatusMethodNotAllowed,
+			http.StatusText(http.StatusMethodNotAllowed)
+	case Db.ReadOnly:
+		status, resp.Error = errorResponse(ReadOnlyError)
+	default:
+		run, err := StartJob(name)
+		switch err {
+		case nil:
+			status, resp.Data = http.StatusAccepted, run
+			l.Noticef("Job %q (%d) queued by %q\n", name, run.ID,
+				req.RemoteAddr)
+		case UnknownJobError, JobRunningError:
+			status, resp.Error = errorResponse(err)
+		default:
+			dbLog.Request(req).Errf("Error queueing job %q: %s", name, err)
+			status, resp.Error = errorResponse(err)
+		}
+	}
+
+	writeAPIResponse(w, status, resp)
+}
+
+// jobsByName sorts jobs by their names.
+type jobsByName []*Job
+
+func (j jobsByName) Len() int           { return len(j) }
+func (j jobsByName) Less(a, b int) bool { return j[a].Name < j[b].Name }
+func (j jobsByName) Swap(a, b int)      { j[a], j[b] = j[b], j[a] }
@@ -0,0 +1,250 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultLeaderLease is the length of time for which the leader holds
+// its lease, if Conf.Cluster.Lease is not set. It is renewed three
+// times as often.
+const DefaultLeaderLease = 60 * time.Second
+
+// leader records whether this instance holds the lease, and its ID.
+var leader struct {
+	sync.RWMutex
+	id       string
+	holding  bool
+	resigned bool
+	once     sync.Once
+}
+
+// InstanceID returns the ID by which this instance holds the lease,
+// which is Conf.Cluster.InstanceID if it is set, or the hostname and a
+// random number.
+func InstanceID() string {
+	leader.RLock()
+	defer leader.RUnlock()
+	return leader.id
+}
+
+// IsLeader reports whether this instance is the one which runs the
+// background work which must only be done once for every instance
+// sharing the database, such as polling child maps, probing nodes, and
+// removing expired rows. If the database is read-only, every instance
+// is the leader, as before there was an election.
+func IsLeader() bool {
+	if Db.ReadOnly {
+		return true
+	}
+	leader.RLock()
+	defer leader.RUnlock()
+	return leader.holding
+}
+
+// leaderLease returns Conf.Cluster.Lease, or DefaultLeaderLease if it
+// is not set.
+func leaderLease() time.Duration {
+	if Conf.Cluster.Lease > 0 {
+		return time.Duration(Conf.Cluster.Lease)
+	}
+	return DefaultLeaderLease
+}
+
+// StartLeaderElection tries to take the lease once, so that a single
+// instance is the leader from its first heartbeat, then renews or
+// retries it in a new goroutine for as long as the server runs.
+func StartLeaderElection() {
+	if Db.ReadOnly {
+		return
+	}
+	leader.once.Do(func() {
+		id := Conf.Cluster.InstanceID
+		if len(id) == 0 {
+			hostname, _ := os.Hostname()
+			id = fmt.Sprintf("%s-%08x", hostname, rand.Uint32())
+		}
+		leader.Lock()
+		leader.id = id
+		leader.Unlock()
+
+		elect()
+		go func() {
+			for {
+				time.Sleep(leaderLease() / 3)
+				elect()
+			}
+		}()
+	})
+}
+
+// elect takes or renews the lease, and records whether this instance
+// holds it. Changes of leadership are logged.
+func elect() {
+	leader.RLock()
+	resigned := leader.resigned
+	leader.RUnlock()
+	if resigned {
+		return
+	}
+
+	id := InstanceID()
+	holding, err := Db.TakeLease("leader", id, leaderLease())
+	if err != nil {
+		dbLog.Errf("Error taking leader lease: %s", err)
+	}
+
+	leader.Lock()
+	was := leader.holding
+	leader.holding = holding
+	leader.Unlock()
+	if holding && !was {
+		l.Noticef("Instance %q is now the leader\n", id)
+	} else if was && !holding {
+		l.Warningf("Instance %q is no longer the leader\n", id)
+	}
+}
+
+// TakeLease takes the named lease for the holder for the given length
+// of time, if it is free, expired, or already held by the holder, and
+// reports whether the holder now holds it.
+func (db DB) TakeLease(name, holder string, length time.Duration) (bool, error) {
+	now := time.Now()
+	expires := now.Add(length).Unix()
+	res, err := db.Exec(`UPDATE leases
+SET holder = ?, expires = ?
+WHERE name = ? AND (holder = ? OR expires < ?);`, holder, expires, name,
+		holder, now.Unix())
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return false, err
+	} else if n > 0 {
+		return true, nil
+	}
+
+	// If there is no lease yet, create it. If another instance does
+	// so first, the primary key prevents both from holding it.
+	_, err = db.Exec(`INSERT INTO leases
+(name, holder, expires)
+VALUES(?, ?, ?);`, name, holder, expires)
+	return err == nil, nil
+}
+
+// ReleaseLease gives up the named lease, if the holder holds it, so
+// that another instance can take it immediately.
+func (db DB) ReleaseLease(name, holder string) (err error) {
+	_, err = db.Exec(`DELETE FROM leases
+WHERE name = ? AND holder = ?;`, name, holder)
+	return
+}
+
+// ResignLeadership gives up the leader lease, if this instance holds
+// it, and stops trying to take it, such as when shutting down. Errors
+// are logged.
+func ResignLeadership() {
+	if Db.ReadOnly || len(InstanceID()) == 0 {
+		return
+	}
+	leader.Lock()
+	leader.holding, leader.resigned = false, true
+	leader.Unlock()
+	if err := Db.ReleaseLease("leader", InstanceID()); err != nil {
+		dbLog.Errf("Error releasing leader lease: %s", err)
+	}
+}
+
+// NodeGenerationInterval is how often each instance checks whether
+// another instance sharing the database has changed the nodes, and so
+// the longest for which its in-memory indexes may be outdated.
+const NodeGenerationInterval = 5 * time.Second
+
+// nodeGeneration is the generation of the nodes which was last seen by
+// WatchNodeGeneration.
+var nodeGeneration struct {
+	sync.Mutex
+	seen int64
+	once sync.Once
+}
+
+// BumpNodeGeneration advances the generation of the nodes in the
+// database, which is shared by every instance using it, to show that
+// they have changed.
+func (db DB) BumpNodeGeneration() error {
+	res, err := db.Exec(`UPDATE node_generation
+SET generation = generation + 1
+WHERE id = 0;`)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n > 0 {
+		return nil
+	}
+
+	// If there is no generation yet, create it. If another instance
+	// does so first, the primary key prevents a second row, and the
+	// generation has been advanced anyway.
+	db.Exec(`INSERT INTO node_generation
+(id, generation)
+VALUES(0, 1);`)
+	return nil
+}
+
+// NodeGeneration returns the generation of the nodes in the database,
+// or 0 if they have not changed since it was created.
+func (db DB) NodeGeneration() (generation int64, err error) {
+	err = db.QueryRow(`SELECT generation
+FROM node_generation
+WHERE id = 0;`).Scan(&generation)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return
+}
+
+// WatchNodeGeneration checks the generation of the nodes in the
+// database every NodeGenerationInterval in a new goroutine, for as long
+// as the server runs. When another instance has changed the nodes, the
+// in-memory indexes, hash, and search of this one are invalidated, so
+// that they are rebuilt from the database, even on instances which are
+// not the leader and so don't run the tasks of each heartbeat.
+func WatchNodeGeneration() {
+	nodeGeneration.once.Do(func() {
+		checkNodeGeneration()
+		go func() {
+			for {
+				time.Sleep(NodeGenerationInterval)
+				checkNodeGeneration()
+			}
+		}()
+	})
+}
+
+// checkNodeGeneration invalidates the in-memory indexes if the
+// generation of the nodes has changed since it was last checked.
+// Changes made by this instance are seen too, which only causes the
+// indexes to be rebuilt once more. Errors are logged.
+func checkNodeGeneration() {
+	generation, err := Db.NodeGeneration()
+	if err != nil {
+		dbLog.Errf("Error getting node generation: %s", err)
+		return
+	}
+	nodeGeneration.Lock()
+	changed := generation != nodeGeneration.seen
+	nodeGeneration.seen = generation
+	nodeGeneration.Unlock()
+	if changed {
+		invalidateLocalIndexes()
+	}
+}
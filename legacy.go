@@ -0,0 +1,346 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// legacyNode is a node read from the database of another node mapping
+// system, such as WiND or nodewatcher.
+type legacyNode struct {
+	importCandidate
+
+	// ID identifies the node in the other system.
+	ID string
+
+	// Created is the time at which the node was added to the other
+	// system, or zero if it is not known.
+	Created time.Time
+}
+
+// legacyLink is a link between two nodes, by their IDs in the other
+// system.
+type legacyLink struct {
+	A, B string
+}
+
+// windTime is the format of DATETIME columns in WiND's database.
+const windTime = "2006-01-02 15:04:05"
+
+// ReadWiND reads the nodes and links from a WiND database, which is
+// connected to with the given MySQL DSN, such as
+// "user:password@tcp(localhost:3306)/wind". The address of each node
+// is the start of its first active IP range, its owner is the user
+// who is marked as its owner, and it is active if it has any active
+// links. Only active point-to-point and client links are read.
+func ReadWiND(dsn string) (nodes []*legacyNode, links []legacyLink, err error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT n.id, n.name, n.latitude, n.longitude,
+n.info, n.date_in, u.username, u.email,
+(SELECT MIN(r.ip_start) FROM ip_ranges r
+WHERE r.node_id = n.id AND r.status = 'active'),
+(SELECT COUNT(*) FROM links l
+WHERE l.node_id = n.id AND l.status = 'active')
+FROM nodes n
+LEFT JOIN users_nodes un ON un.node_id = n.id AND un.owner = 'Y'
+LEFT JOIN users u ON u.id = un.user_id
+ORDER BY n.id;`)
+	if err != nil {
+		return
+	}
+	seen := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		var name, info, created, owner, email sql.NullString
+		var lat, lon sql.NullFloat64
+		var ipStart sql.NullInt64
+		var activeLinks int
+		err = rows.Scan(&id, &name, &lat, &lon, &info, &created, &owner,
+			&email, &ipStart, &activeLinks)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		// Nodes with more than one owner are only read once.
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		n := &legacyNode{ID: fmt.Sprint(id)}
+		n.Name = name.String
+		n.Node = &Node{
+			OwnerName:  html.EscapeString(owner.String),
+			OwnerEmail: email.String,
+			Details:    html.EscapeString(info.String),
+			Latitude:   lat.Float64,
+			Longitude:  lon.Float64,
+		}
+		if len(n.Node.OwnerName) == 0 {
+			n.Node.OwnerName = html.EscapeString(name.String)
+		}
+		if ipStart.Valid {
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, uint32(ipStart.Int64))
+			n.Address = ip.String()
+			n.Node.Addr = IP(ip.To16())
+		}
+		if activeLinks > 0 {
+			n.Node.Status = StatusActive
+		}
+		n.HasPoint = lat.Valid && lon.Valid
+		n.StatusOK = true
+		if t, err := time.ParseInLocation(windTime, created.String,
+			time.Local); err == nil {
+			n.Created = t
+		}
+		nodes = append(nodes, n)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	// Client links are to the link of an access point, rather than
+	// to its node.
+	rows, err = db.Query(`SELECT l.node_id,
+COALESCE(l.peer_node_id, ap.node_id)
+FROM links l
+LEFT JOIN links ap ON ap.id = l.peer_ap_id
+WHERE l.status = 'active' AND l.type IN ('p2p', 'client');`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a int64
+		var b sql.NullInt64
+		if err = rows.Scan(&a, &b); err != nil {
+			return
+		}
+		if b.Valid {
+			links = append(links, legacyLink{fmt.Sprint(a),
+				fmt.Sprint(b.Int64)})
+		}
+	}
+	return nodes, links, rows.Err()
+}
+
+// nodewatcherNode is the part of a node in nodewatcher's node API which
+// is imported. The configuration and monitoring data are keyed by the
+// names of nodewatcher's registry items, such as "core.general".
+type nodewatcherNode struct {
+	ID     string `json:"@id"`
+	Config struct {
+		General struct {
+			Name string `json:"name"`
+		} `json:"core.general"`
+		Location struct {
+			Address     string `json:"address"`
+			Geolocation *struct {
+				Coordinates []float64 `json:"coordinates"`
+			} `json:"geolocation"`
+		} `json:"core.location"`
+		RouterIDs []struct {
+			RouterID string `json:"router_id"`
+		} `json:"core.routerid"`
+	} `json:"config"`
+	Monitoring struct {
+		General struct {
+			FirstSeen string `json:"first_seen"`
+		} `json:"core.general"`
+		Status struct {
+			Status string `json:"status"`
+		} `json:"core.status"`
+		Topology struct {
+			Links []struct {
+				Peer string `json:"peer"`
+			} `json:"links"`
+		} `json:"network.routing.topology"`
+	} `json:"monitoring"`
+}
+
+// ReadNodewatcher reads the nodes and links from an export of
+// nodewatcher's node API, such as "/api/v2/node/?format=json&limit=0".
+// It may be the paginated response, or only its array of results. The
+// address of each node is its first router ID, and its owner is its
+// name, since nodewatcher does not export owners. A node is active if
+// its monitored status is "up".
+func ReadNodewatcher(r io.Reader) (nodes []*legacyNode, links []legacyLink, err error) {
+	var raw json.RawMessage
+	if err = json.NewDecoder(r).Decode(&raw); err != nil {
+		return
+	}
+	var results []nodewatcherNode
+	if err = json.Unmarshal(raw, &results); err != nil {
+		var page struct {
+			Results []nodewatcherNode `json:"results"`
+		}
+		if err = json.Unmarshal(raw, &page); err != nil {
+			return
+		}
+		results = page.Results
+	}
+
+	for _, nw := range results {
+		n := &legacyNode{ID: nw.ID}
+		n.Name = nw.Config.General.Name
+		n.Node = &Node{
+			OwnerName: html.EscapeString(nw.Config.General.Name),
+			Details:   html.EscapeString(nw.Config.Location.Address),
+		}
+		if len(nw.Config.RouterIDs) > 0 {
+			n.Address = nw.Config.RouterIDs[0].RouterID
+			n.Node.Addr = ParseIP(n.Address)
+		}
+		if g := nw.Config.Location.Geolocation; g != nil &&
+			len(g.Coordinates) >= 2 {
+			n.Node.Longitude, n.Node.Latitude = g.Coordinates[0],
+				g.Coordinates[1]
+			n.HasPoint = true
+		}
+		if strings.EqualFold(nw.Monitoring.Status.Status, "up") {
+			n.Node.Status = StatusActive
+		}
+		n.StatusOK = true
+		if t, err := time.Parse(time.RFC3339,
+			nw.Monitoring.General.FirstSeen); err == nil {
+			n.Created = t
+		}
+		nodes = append(nodes, n)
+
+		for _, link := range nw.Monitoring.Topology.Links {
+			if len(link.Peer) > 0 {
+				links = append(links, legacyLink{nw.ID, link.Peer})
+			}
+		}
+	}
+	return nodes, links, nil
+}
+
+// AddLegacyNodes adds the given nodes in a single transaction, as with
+// AddNodes, but records each as having been added at the time given
+// for it in created, if there is one, so that its history begins
+// then.
+func (db DB) AddLegacyNodes(nodes []*Node, created map[string]time.Time) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, node := range nodes {
+		t, ok := created[string(node.Addr)]
+		if !ok || t.IsZero() || t.After(now) {
+			t = now
+		}
+		var email string
+		if email, err = SealEmail(node.OwnerEmail); err == nil {
+			_, err = tx.Exec(`INSERT INTO nodes
+(address, owner, email, contact, details, pgp, lat, lon, status, updated,
+map_id, created_at, updated_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`, []byte(node.Addr),
+				node.OwnerName, email,
+				node.Contact, node.Details, []byte(node.PGP),
+				node.Latitude, node.Longitude, node.Status,
+				t, node.MapID, t.Unix(), t.Unix())
+		}
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO status_history
+(address, status, changed)
+VALUES(?, ?, ?);`, []byte(node.Addr), node.Status, t.Unix())
+		}
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	InvalidateIndexes()
+	return
+}
+
+// ImportLegacy checks the nodes and links read from a WiND ("wind") or
+// nodewatcher ("nodewatcher") database, as with ImportPlacemarks, and
+// adds them if commit is true. Nodes which have no email address are
+// given the defaultEmail. The links are those between nodes which are
+// added, or which were added before, and replace any which were
+// imported from the same system before.
+func ImportLegacy(format string, nodes []*legacyNode, links []legacyLink, defaultEmail string, commit bool) (report *ImportReport, err error) {
+	candidates := make([]*importCandidate, len(nodes))
+	for i, n := range nodes {
+		if len(n.Node.OwnerEmail) == 0 {
+			n.Node.OwnerEmail = defaultEmail
+		}
+		candidates[i] = &n.importCandidate
+	}
+	if report, err = checkImport(candidates); err != nil {
+		return
+	}
+
+	// Links are kept between the nodes which were imported before,
+	// so that they are not lost when links are replaced.
+	conflicts := make(map[int]string)
+	for _, c := range report.Conflicts {
+		conflicts[c.Index-1] = c.Reason
+	}
+	addrs := make(map[string]IP)
+	created := make(map[string]time.Time)
+	for i, n := range nodes {
+		if reason, ok := conflicts[i]; !ok || reason == "addressExists" {
+			addrs[n.ID] = n.Node.Addr
+			created[string(n.Node.Addr)] = n.Created
+		}
+	}
+	now := time.Now()
+	imported := make([]*Link, 0)
+	seen := make(map[string]bool)
+	for _, l := range links {
+		a, okA := addrs[l.A]
+		b, okB := addrs[l.B]
+		if !okA || !okB || a.String() == b.String() {
+			continue
+		}
+		// Links are reported by both of their nodes.
+		key := a.String() + " " + b.String()
+		if seen[key] || seen[b.String()+" "+a.String()] {
+			continue
+		}
+		seen[key] = true
+		imported = append(imported, &Link{Source: a, Target: b,
+			Origin: format, Updated: now})
+	}
+	report.Links = len(imported)
+
+	if commit {
+		if len(report.Nodes) > 0 {
+			if err = Db.AddLegacyNodes(report.Nodes, created); err != nil {
+				return
+			}
+			for _, node := range report.Nodes {
+				LocateNode(node)
+			}
+		}
+		if err = Db.ReplaceLinks(format, nil, imported); err != nil {
+			return
+		}
+	}
+	report.Committed = commit
+	return
+}
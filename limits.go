@@ -0,0 +1,88 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"errors"
+	"io"
+	"math"
+)
+
+const (
+	// DefaultChildMapMaxBytes is the default largest response which
+	// is read from a child map. See Conf.ChildMapLimits.
+	DefaultChildMapMaxBytes = 32 << 20 // 32 MiB
+
+	// DefaultChildMapMaxNodes is the default largest number of nodes
+	// which are cached from any one source. See Conf.ChildMapLimits.
+	DefaultChildMapMaxNodes = 10000
+)
+
+var (
+	ResponseTooLargeError = errors.New("response is too large")
+)
+
+// limitedBody reads from R until more than N bytes have been read, and
+// then returns ResponseTooLargeError, so that a response which is
+// too large is rejected rather than silently truncated.
+type limitedBody struct {
+	R io.Reader
+	N int64
+}
+
+func (l *limitedBody) Read(p []byte) (n int, err error) {
+	if l.N <= 0 {
+		return 0, ResponseTooLargeError
+	}
+	if int64(len(p)) > l.N {
+		p = p[:l.N]
+	}
+	n, err = l.R.Read(p)
+	l.N -= int64(n)
+	return
+}
+
+// childMapBody limits the given response body from a child map to
+// Conf.ChildMapLimits.MaxBytes.
+func childMapBody(r io.Reader) io.Reader {
+	maxBytes := Conf.ChildMapLimits.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultChildMapMaxBytes
+	}
+	return &limitedBody{R: r, N: maxBytes + 1}
+}
+
+// validCoordinates returns true if the given latitude and longitude
+// are on earth.
+func validCoordinates(lat, lon float64) bool {
+	return !math.IsNaN(lat) && !math.IsNaN(lon) &&
+		lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+// LimitChildMapNodes returns the nodes from the given source, as
+// retrieved from a child map, which pass the checks of
+// Conf.ChildMapLimits, and the number which were discarded. Nodes
+// with invalid addresses or coordinates, or outside of the configured
+// Bounds, are discarded, and if there are more than MaxNodesPerSource,
+// the rest are discarded as well.
+func LimitChildMapNodes(nodes []*Node) (kept []*Node, discarded int) {
+	limits := Conf.ChildMapLimits
+	maxNodes := limits.MaxNodesPerSource
+	if maxNodes <= 0 {
+		maxNodes = DefaultChildMapMaxNodes
+	}
+
+	kept = nodes[:0]
+	for _, n := range nodes {
+		if len(kept) >= maxNodes || n == nil || len(n.Addr) != 16 ||
+			!validCoordinates(n.Latitude, n.Longitude) ||
+			(limits.Bounds != nil &&
+				!limits.Bounds.Contains(n.Latitude, n.Longitude)) {
+			discarded++
+			continue
+		}
+		kept = append(kept, n)
+	}
+	return
+}
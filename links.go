@@ -0,0 +1,193 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"github.com/coocood/jas"
+	"time"
+)
+
+// Link is a connection between two nodes, as reported by a routing
+// protocol or other source of topology.
+type Link struct {
+	Source, Target IP
+
+	// SourceLatitude, SourceLongitude, TargetLatitude, and
+	// TargetLongitude are the locations of the nodes, so that the
+	// link can be drawn.
+	SourceLatitude, SourceLongitude float64
+	TargetLatitude, TargetLongitude float64
+
+	// Origin is the source of the link, such as "cjdns".
+	Origin string
+
+	// Metric is the routing metric reported by the origin, such as
+	// OLSR's ETX, or zero if it is not known.
+	Metric float64 `json:",omitempty"`
+
+	// Distance is the distance in meters between the nodes, as of
+	// when the link was stored or last recomputed.
+	Distance float64
+
+	Updated time.Time
+}
+
+// nodeLocations returns the [latitude, longitude] of every local node,
+// by the string of its address.
+func (db DB) nodeLocations() (locations map[string][2]float64, err error) {
+	rows, err := db.Query(`SELECT address,lat,lon
+FROM nodes;`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	locations = make(map[string][2]float64)
+	for rows.Next() {
+		var addr IP
+		var loc [2]float64
+		if err = rows.Scan(&addr, &loc[0], &loc[1]); err != nil {
+			return
+		}
+		locations[addr.String()] = loc
+	}
+	return locations, rows.Err()
+}
+
+// linkDistance returns the distance in meters between the nodes of the
+// link, using the given locations, or zero if either is not known.
+func linkDistance(locations map[string][2]float64, source, target IP) float64 {
+	s, ok := locations[source.String()]
+	if !ok {
+		return 0
+	}
+	t, ok := locations[target.String()]
+	if !ok {
+		return 0
+	}
+	return Distance(s[0], s[1], t[0], t[1])
+}
+
+// ReplaceLinks replaces the links of the given origin from the given
+// source node with the given links. If source is nil, every link of
+// the origin is replaced.
+func (db DB) ReplaceLinks(origin string, source IP, links []*Link) (err error) {
+	locations, err := db.nodeLocations()
+	if err != nil {
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	if source == nil {
+		_, err = tx.Exec(`DELETE FROM links
+WHERE origin = ?;`, origin)
+	} else {
+		_, err = tx.Exec(`DELETE FROM links
+WHERE origin = ? AND source = ?;`, origin, []byte(source))
+	}
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO links
+(source, target, origin, metric, distance, updated)
+VALUES(?, ?, ?, ?, ?, ?);`)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	for _, link := range links {
+		link.Distance = linkDistance(locations, link.Source, link.Target)
+		_, err = stmt.Exec([]byte(link.Source), []byte(link.Target),
+			origin, link.Metric, link.Distance, link.Updated.Unix())
+		if err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return
+		}
+	}
+	stmt.Close()
+	return tx.Commit()
+}
+
+// Links returns every link whose nodes are both local, with their
+// locations.
+func (db DB) Links() (links []*Link, err error) {
+	rows, err := db.Query(`SELECT
+links.source,s.lat,s.lon,links.target,t.lat,t.lon,
+links.origin,links.metric,links.distance,links.updated
+FROM links
+INNER JOIN nodes AS s ON links.source = s.address
+INNER JOIN nodes AS t ON links.target = t.address;`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	links = make([]*Link, 0)
+	for rows.Next() {
+		link := new(Link)
+		var updated int64
+		err = rows.Scan(&link.Source, &link.SourceLatitude,
+			&link.SourceLongitude, &link.Target, &link.TargetLatitude,
+			&link.TargetLongitude, &link.Origin, &link.Metric,
+			&link.Distance, &updated)
+		if err != nil {
+			return
+		}
+		link.Updated = time.Unix(updated, 0)
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// GetLinks returns every link between local nodes, with the locations
+// of the nodes, so that they can be drawn on the map.
+func (*Api) GetLinks(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	var err error
+	ctx.Data, err = db.Links()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error getting links: %s", err)
+	}
+}
+
+// RecomputeLinks removes the links to or from nodes which are no longer
+// local, and recomputes the distances of the rest from the current
+// locations of their nodes, such as after nodes have been moved. The
+// given function, if any, is called with the number of links done and
+// the total as it goes. It returns the number of links kept.
+func (db DB) RecomputeLinks(progress func(done, total int)) (n int, err error) {
+	_, err = db.Exec(`DELETE FROM links
+WHERE source NOT IN (SELECT address FROM nodes)
+OR target NOT IN (SELECT address FROM nodes);`)
+	if err != nil {
+		return
+	}
+	locations, err := db.nodeLocations()
+	if err != nil {
+		return
+	}
+	links, err := db.Links()
+	if err != nil {
+		return
+	}
+	for i, link := range links {
+		_, err = db.Exec(`UPDATE links SET distance = ?
+WHERE source = ? AND target = ? AND origin = ?;`,
+			linkDistance(locations, link.Source, link.Target),
+			[]byte(link.Source), []byte(link.Target), link.Origin)
+		if err != nil {
+			return
+		}
+		if progress != nil {
+			progress(i+1, len(links))
+		}
+	}
+	return len(links), nil
+}
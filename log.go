@@ -0,0 +1,284 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/inhies/go-log"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	InvalidLogFormatError = errors.New("log format must be text or json")
+)
+
+// levelNames maps go-log levels to the names used in JSON output.
+var levelNames = map[log.LogLevel]string{
+	log.EMERG:   "emerg",
+	log.ALERT:   "alert",
+	log.CRIT:    "crit",
+	log.ERR:     "err",
+	log.WARNING: "warning",
+	log.NOTICE:  "notice",
+	log.INFO:    "info",
+	log.DEBUG:   "debug",
+}
+
+// Logger is the logger used throughout NodeAtlas. In text mode, it
+// passes messages on to a go-log *log.Logger. In JSON mode, it writes
+// one JSON object per line, containing the timestamp, level,
+// component, message, and any structured fields, so that logs can be
+// shipped elsewhere without having to be parsed by regular
+// expressions.
+//
+// Loggers for particular components, such as "api" or "federation",
+// can be derived with Component(), and structured fields can be
+// attached with With(). Derived loggers share their output with their
+// parent.
+type Logger struct {
+	*logOutput
+
+	component string
+	fields    map[string]interface{}
+}
+
+// logOutput is the part of a Logger which is shared by all loggers
+// derived from it.
+type logOutput struct {
+	level     log.LogLevel
+	shortfile bool
+
+	// text is used in text mode. If it is nil, JSON mode is in use,
+	// and messages are written to out.
+	text *log.Logger
+
+	out   io.Writer
+	mutex sync.Mutex
+}
+
+// jsonLogLine is the form in which JSON-mode log lines are written.
+type jsonLogLine struct {
+	Time      string                 `json:"time"`
+	Level     string                 `json:"level"`
+	Component string                 `json:"component,omitempty"`
+	Caller    string                 `json:"caller,omitempty"`
+	Message   string                 `json:"msg"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+// NewLogger creates a *Logger which writes messages at or below the
+// given level to out in the given format, which must be either "text"
+// or "json." The flags are those used by go-log. If log.Lshortfile is
+// included, the file and line of the caller are added to each
+// message.
+func NewLogger(level log.LogLevel, format string, out io.Writer,
+	flags int) (lg *Logger, err error) {
+	lg = &Logger{logOutput: &logOutput{
+		level:     level,
+		shortfile: flags&log.Lshortfile != 0,
+		out:       out,
+	}}
+
+	switch format {
+	case "", "text":
+		// go-log would report the file and line of this file, rather
+		// than the caller, so we add it ourselves.
+		lg.text, err = log.NewLevel(level, true, out, "",
+			flags&^log.Lshortfile)
+	case "json":
+	default:
+		return nil, InvalidLogFormatError
+	}
+	return
+}
+
+// Component returns a *Logger which shares its output with lg, but
+// which labels every message with the given component name, such as
+// "api", "federation", "db", or "mail".
+func (lg *Logger) Component(name string) *Logger {
+	return &Logger{
+		logOutput: lg.logOutput,
+		component: name,
+		fields:    lg.fields,
+	}
+}
+
+// With returns a *Logger which shares its output with lg, but which
+// attaches the given key and value to every message, in addition to
+// any fields lg attaches already.
+func (lg *Logger) With(key string, value interface{}) *Logger {
+	fields := make(map[string]interface{}, len(lg.fields)+1)
+	for k, v := range lg.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+
+	return &Logger{
+		logOutput: lg.logOutput,
+		component: lg.component,
+		fields:    fields,
+	}
+}
+
+// Request returns a *Logger which attaches the ID of the given request,
+// as given by RequestTracer, to every message, if it has one, so that
+// every message about the request can be found by it.
+func (lg *Logger) Request(r *http.Request) *Logger {
+	if id := RequestID(r); len(id) > 0 {
+		return lg.With("request", id)
+	}
+	return lg
+}
+
+// output writes a single message at the given level, if it is not
+// filtered out. The depth is the number of stack frames between the
+// original caller and output.
+func (lg *Logger) output(depth int, level log.LogLevel, msg string) {
+	if level > lg.level {
+		return
+	}
+
+	var caller string
+	if lg.shortfile {
+		if _, file, line, ok := runtime.Caller(depth + 1); ok {
+			caller = fmt.Sprintf("%s:%d", path.Base(file), line)
+		}
+	}
+
+	if lg.text != nil {
+		lg.outputText(level, caller, msg)
+		return
+	}
+
+	lg.mutex.Lock()
+	defer lg.mutex.Unlock()
+	json.NewEncoder(lg.out).Encode(jsonLogLine{
+		Time:      time.Now().Format(time.RFC3339Nano),
+		Level:     levelNames[level],
+		Component: lg.component,
+		Caller:    caller,
+		Message:   strings.TrimRight(msg, "\n"),
+		Fields:    lg.fields,
+	})
+}
+
+// outputText passes a message on to the underlying go-log logger,
+// with the caller, component, and fields written into it.
+func (lg *Logger) outputText(level log.LogLevel, caller, msg string) {
+	// Strip the newline so that the fields can be appended, and so
+	// that go-log can add it back.
+	msg = strings.TrimRight(msg, "\n")
+	if len(lg.component) > 0 {
+		msg = lg.component + ": " + msg
+	}
+	if len(caller) > 0 {
+		msg = caller + ": " + msg
+	}
+	for k, v := range lg.fields {
+		msg += fmt.Sprintf(" %s=%v", k, v)
+	}
+
+	switch level {
+	case log.EMERG:
+		lg.text.Emerg(msg)
+	case log.ALERT:
+		lg.text.Alert(msg)
+	case log.CRIT:
+		lg.text.Crit(msg)
+	case log.ERR:
+		lg.text.Err(msg)
+	case log.WARNING:
+		lg.text.Warning(msg)
+	case log.NOTICE:
+		lg.text.Notice(msg)
+	case log.INFO:
+		lg.text.Info(msg)
+	default:
+		lg.text.Debug(msg)
+	}
+}
+
+func (lg *Logger) Emerg(v ...interface{}) {
+	lg.output(1, log.EMERG, fmt.Sprint(v...))
+}
+
+func (lg *Logger) Emergf(format string, v ...interface{}) {
+	lg.output(1, log.EMERG, fmt.Sprintf(format, v...))
+}
+
+func (lg *Logger) Alert(v ...interface{}) {
+	lg.output(1, log.ALERT, fmt.Sprint(v...))
+}
+
+func (lg *Logger) Alertf(format string, v ...interface{}) {
+	lg.output(1, log.ALERT, fmt.Sprintf(format, v...))
+}
+
+func (lg *Logger) Crit(v ...interface{}) {
+	lg.output(1, log.CRIT, fmt.Sprint(v...))
+}
+
+func (lg *Logger) Critf(format string, v ...interface{}) {
+	lg.output(1, log.CRIT, fmt.Sprintf(format, v...))
+}
+
+func (lg *Logger) Err(v ...interface{}) {
+	lg.output(1, log.ERR, fmt.Sprint(v...))
+}
+
+func (lg *Logger) Errf(format string, v ...interface{}) {
+	lg.output(1, log.ERR, fmt.Sprintf(format, v...))
+}
+
+func (lg *Logger) Warning(v ...interface{}) {
+	lg.output(1, log.WARNING, fmt.Sprint(v...))
+}
+
+func (lg *Logger) Warningf(format string, v ...interface{}) {
+	lg.output(1, log.WARNING, fmt.Sprintf(format, v...))
+}
+
+func (lg *Logger) Notice(v ...interface{}) {
+	lg.output(1, log.NOTICE, fmt.Sprint(v...))
+}
+
+func (lg *Logger) Noticef(format string, v ...interface{}) {
+	lg.output(1, log.NOTICE, fmt.Sprintf(format, v...))
+}
+
+func (lg *Logger) Info(v ...interface{}) {
+	lg.output(1, log.INFO, fmt.Sprint(v...))
+}
+
+func (lg *Logger) Infof(format string, v ...interface{}) {
+	lg.output(1, log.INFO, fmt.Sprintf(format, v...))
+}
+
+func (lg *Logger) Debug(v ...interface{}) {
+	lg.output(1, log.DEBUG, fmt.Sprint(v...))
+}
+
+func (lg *Logger) Debugf(format string, v ...interface{}) {
+	lg.output(1, log.DEBUG, fmt.Sprintf(format, v...))
+}
+
+// Printf logs a message at the INFO level.
+func (lg *Logger) Printf(format string, v ...interface{}) {
+	lg.output(1, log.INFO, fmt.Sprintf(format, v...))
+}
+
+// Fatalf logs a message at the EMERG level, then exits with status 1.
+func (lg *Logger) Fatalf(format string, v ...interface{}) {
+	lg.output(1, log.EMERG, fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
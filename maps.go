@@ -0,0 +1,157 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// SubMapIDRegexp matches valid SubMap IDs.
+var SubMapIDRegexp = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+
+var (
+	// MapStaticDirs are the compiled static directories of each of
+	// Conf.Maps, keyed by ID. They are compiled by CompileMapStatic.
+	MapStaticDirs = make(map[string]string)
+
+	mapStaticMutex sync.RWMutex
+)
+
+// FindMap returns the configured SubMap with the given ID, or nil if
+// there is none.
+func (c *Config) FindMap(id string) *SubMap {
+	for i := range c.Maps {
+		if c.Maps[i].ID == id {
+			return &c.Maps[i]
+		}
+	}
+	return nil
+}
+
+// ForMap returns a copy of the configuration in which the settings of
+// the SubMap with the given ID replace those of the main map. If
+// there is no such map, it returns nil.
+func (c *Config) ForMap(id string) *Config {
+	m := c.FindMap(id)
+	if m == nil {
+		return nil
+	}
+	conf := *c
+	conf.MapID = m.ID
+	if len(m.Name) > 0 {
+		conf.Name = m.Name
+	}
+	conf.Map.Center = m.Center
+	if m.Zoom != 0 {
+		conf.Map.Zoom = m.Zoom
+	}
+	conf.ChildMaps = m.ChildMaps
+	return &conf
+}
+
+// MapPath returns the URL path at which the map is served, without a
+// trailing slash. It is empty for the main map.
+func (c *Config) MapPath() string {
+	if len(c.MapID) == 0 {
+		return ""
+	}
+	return "/" + c.MapID
+}
+
+// NodesInMap returns the nodes which belong to the map with the given
+// ID. The main map's ID is empty.
+func NodesInMap(nodes []*Node, id string) []*Node {
+	filtered := make([]*Node, 0, len(nodes))
+	for _, n := range nodes {
+		if n != nil && n.MapID == id {
+			filtered = append(filtered, n)
+		}
+	}
+	return filtered
+}
+
+// CompileMapStatic compiles the static directory of each of
+// Conf.Maps, using its own configuration, and replaces and removes
+// any which were compiled before. If there is an error, the previous
+// directories are kept.
+func CompileMapStatic(res string) (err error) {
+	dirs := make(map[string]string, len(Conf.Maps))
+	for _, m := range Conf.Maps {
+		if !SubMapIDRegexp.MatchString(m.ID) {
+			err = fmt.Errorf("invalid map ID %q", m.ID)
+			break
+		} else if _, ok := dirs[m.ID]; ok {
+			err = fmt.Errorf("duplicate map ID %q", m.ID)
+			break
+		}
+
+		var dir string
+		dir, err = CompileStatic(res, Conf.ForMap(m.ID))
+		if len(dir) > 0 {
+			dirs[m.ID] = dir
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		removeStaticDirs(dirs)
+		return
+	}
+
+	mapStaticMutex.Lock()
+	old := MapStaticDirs
+	MapStaticDirs = dirs
+	mapStaticMutex.Unlock()
+
+	removeStaticDirs(old)
+	return
+}
+
+// RemoveMapStatic removes the compiled static directories of every
+// SubMap.
+func RemoveMapStatic() {
+	mapStaticMutex.Lock()
+	old := MapStaticDirs
+	MapStaticDirs = make(map[string]string)
+	mapStaticMutex.Unlock()
+
+	removeStaticDirs(old)
+}
+
+// removeStaticDirs removes the given directories, and logs any
+// errors.
+func removeStaticDirs(dirs map[string]string) {
+	for id, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			l.Errf("Error removing static directory of map %q: %s",
+				id, err)
+		}
+	}
+}
+
+// mapStaticFile returns the path of the compiled static file which
+// should be served for the given URL path, if it is within a SubMap,
+// such as "/nyc/js/config.js".
+func mapStaticFile(urlPath string) (file string, ok bool) {
+	parts := strings.SplitN(strings.TrimPrefix(urlPath, "/"), "/", 2)
+
+	mapStaticMutex.RLock()
+	dir, ok := MapStaticDirs[parts[0]]
+	mapStaticMutex.RUnlock()
+	if !ok {
+		return
+	}
+
+	rest := "/"
+	if len(parts) == 2 {
+		rest += parts[1]
+	}
+	return path.Join(dir, "web", rest), true
+}
@@ -0,0 +1,359 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/coocood/jas"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// DefaultDuplicateRadius is the default distance in meters within
+	// which two local nodes with similar owners are reported as
+	// likely duplicates.
+	DefaultDuplicateRadius = 50
+)
+
+var (
+	MergeSameNodeError = jas.NewRequestError("sameNode")
+)
+
+// mergedTables are the tables which can have any number of rows for
+// each node, by its address. Those of the secondary node are all given
+// to the primary one when they are merged.
+var mergedTables = []string{
+	"status_history", "audit_log", "photos", "comments",
+	"connection_requests", "installs", "equipment", "interfaces",
+	"metrics", "short_links",
+}
+
+// mergedSingletons are the tables which have at most one row for each
+// node. The row of the secondary node is only kept if the primary node
+// has none.
+var mergedSingletons = []string{
+	"edit_tokens", "node_heartbeats", "alerts", "tickets", "snmp_targets",
+	"adoptions", "coverage", "node_elevations",
+}
+
+// MergeNodes merges the local node with the secondary address into the
+// one with the primary address, in a single transaction. The primary
+// node keeps its own details, but takes the contact, details, and PGP
+// ID of the secondary one where its own are empty. The history,
+// links, photos, comments, equipment, and everything else recorded
+// about the secondary node are given to the primary one, and then the
+// secondary node is removed, and its deletion recorded in the audit log
+// as made by an admin, as by AuditDeletion. If either node is not
+// local, it returns LocalNodeNotFoundError.
+func (db DB) MergeNodes(primary, secondary IP) (err error) {
+	if primary.String() == secondary.String() {
+		return MergeSameNodeError
+	}
+	removed, err := db.GetLocalNode(secondary)
+	if err != nil {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var contact, details [2]sql.NullString
+	var pgp [2][]byte
+	for i, addr := range []IP{primary, secondary} {
+		err = tx.QueryRow(`SELECT contact,details,pgp
+FROM nodes
+WHERE address = ?;`, []byte(addr)).Scan(&contact[i], &details[i], &pgp[i])
+		if err == sql.ErrNoRows {
+			return LocalNodeNotFoundError
+		} else if err != nil {
+			return
+		}
+	}
+	if len(contact[0].String) == 0 {
+		contact[0] = contact[1]
+	}
+	if len(details[0].String) == 0 {
+		details[0] = details[1]
+	}
+	if len(pgp[0]) == 0 {
+		pgp[0] = pgp[1]
+	}
+	_, err = tx.Exec(`UPDATE nodes SET contact = ?, details = ?, pgp = ?,
+version = version + 1, updated_at = ?
+WHERE address = ?;`, contact[0], details[0], pgp[0], time.Now().Unix(),
+		[]byte(primary))
+	if err != nil {
+		return
+	}
+
+	for _, table := range mergedTables {
+		_, err = tx.Exec(`UPDATE `+table+` SET address = ?
+WHERE address = ?;`, []byte(primary), []byte(secondary))
+		if err != nil {
+			return
+		}
+	}
+	for _, table := range mergedSingletons {
+		var n int
+		err = tx.QueryRow(`SELECT COUNT(*) FROM `+table+`
+WHERE address = ?;`, []byte(primary)).Scan(&n)
+		if err != nil {
+			return
+		}
+		if n == 0 {
+			_, err = tx.Exec(`UPDATE `+table+` SET address = ?
+WHERE address = ?;`, []byte(primary), []byte(secondary))
+		} else {
+			_, err = tx.Exec(`DELETE FROM `+table+`
+WHERE address = ?;`, []byte(secondary))
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	// Links between the two nodes would link the primary one to
+	// itself, so they are removed.
+	for _, column := range []string{"source", "target"} {
+		_, err = tx.Exec(`UPDATE links SET `+column+` = ?
+WHERE `+column+` = ?;`, []byte(primary), []byte(secondary))
+		if err != nil {
+			return
+		}
+	}
+	if _, err = tx.Exec(`DELETE FROM links
+WHERE source = target;`); err != nil {
+		return
+	}
+
+	if _, err = tx.Exec(`DELETE FROM transfers
+WHERE address = ?;`, []byte(secondary)); err != nil {
+		return
+	}
+	if _, err = tx.Exec(`DELETE FROM nodes
+WHERE address = ?;`, []byte(secondary)); err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	// The deletion is recorded after the audit log of the secondary
+	// node is given to the primary one, so that it is kept with the
+	// secondary node's address.
+	db.AuditDeletion(removed, "admin")
+	InvalidateIndexes()
+	return
+}
+
+// LikelyDuplicate is a pair of local nodes which are near each other,
+// and have similar owners, and so may be the same node.
+type LikelyDuplicate struct {
+	A, B IP
+
+	// Distance is the distance between the nodes in meters.
+	Distance float64
+
+	// SameOwner and SameEmail are true if the nodes have similar
+	// owner names, or the same owner email address.
+	SameOwner, SameEmail bool
+}
+
+// likelyDuplicates sorts LikelyDuplicates by distance.
+type likelyDuplicates []*LikelyDuplicate
+
+func (d likelyDuplicates) Len() int           { return len(d) }
+func (d likelyDuplicates) Less(i, j int) bool { return d[i].Distance < d[j].Distance }
+func (d likelyDuplicates) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// ownerKey reduces the name of an owner to its lowercase letters and
+// digits, so that differences of spacing and punctuation are ignored.
+func ownerKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+}
+
+// sameEmail returns true if the two stored owner email addresses are
+// the same, in whatever form they are stored.
+func sameEmail(a, b string) bool {
+	if a == b {
+		return len(a) > 0
+	}
+	if plain, err := EmailRecipient(b); err == nil {
+		return EmailMatches(a, plain)
+	}
+	if plain, err := EmailRecipient(a); err == nil {
+		return EmailMatches(b, plain)
+	}
+	return false
+}
+
+// LikelyDuplicates returns every pair of local nodes which are within
+// the given distance in meters of each other, and have similar owner
+// names or the same owner email address, nearest first.
+func (db DB) LikelyDuplicates(radius float64) (dups []*LikelyDuplicate, err error) {
+	rows, err := db.Query(`SELECT address,owner,email,lat,lon
+FROM nodes
+ORDER BY lat;`)
+	if err != nil {
+		return
+	}
+	type owned struct {
+		*Node
+		key string
+	}
+	var nodes []owned
+	for rows.Next() {
+		n := new(Node)
+		if err = rows.Scan(&n.Addr, &n.OwnerName, &n.OwnerEmail,
+			&n.Latitude, &n.Longitude); err != nil {
+			rows.Close()
+			return
+		}
+		nodes = append(nodes, owned{n, ownerKey(n.OwnerName)})
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	// Since the nodes are ordered by latitude, only those up to the
+	// radius further north of each need to be compared with it.
+	maxLat := radius / 111320 // meters per degree of latitude
+	dups = make([]*LikelyDuplicate, 0)
+	for i, a := range nodes {
+		for _, b := range nodes[i+1:] {
+			if b.Latitude-a.Latitude > maxLat {
+				break
+			}
+			d := Distance(a.Latitude, a.Longitude, b.Latitude, b.Longitude)
+			if d > radius {
+				continue
+			}
+			dup := &LikelyDuplicate{
+				A:         a.Addr,
+				B:         b.Addr,
+				Distance:  d,
+				SameOwner: len(a.key) > 0 && a.key == b.key,
+				SameEmail: sameEmail(a.OwnerEmail, b.OwnerEmail),
+			}
+			if dup.SameOwner || dup.SameEmail {
+				dups = append(dups, dup)
+			}
+		}
+	}
+	sort.Sort(likelyDuplicates(dups))
+	return
+}
+
+// adminMerge runs "nodeatlas admin merge <primary> <secondary>".
+func adminMerge(args []string) (err error) {
+	if len(args) != 2 {
+		return errors.New("two addresses are required")
+	} else if Db.ReadOnly {
+		return ReadOnlyError
+	}
+	primary := ParseIP(args[0])
+	secondary := ParseIP(args[1])
+	if primary == nil || secondary == nil {
+		return errors.New("addressInvalid")
+	}
+	if err = Db.MergeNodes(primary, secondary); err != nil {
+		return
+	}
+	Db.Audit(primary, "merged", "admin", "from "+secondary.String())
+	fmt.Printf("Merged %s into %s\n", secondary, primary)
+	return nil
+}
+
+// adminDuplicates runs "nodeatlas admin duplicates [radius]".
+func adminDuplicates(args []string) (err error) {
+	radius := float64(DefaultDuplicateRadius)
+	if len(args) > 0 {
+		if radius, err = strconv.ParseFloat(args[0], 64); err != nil {
+			return errors.New("radiusInvalid")
+		}
+	}
+	dups, err := Db.LikelyDuplicates(radius)
+	if err != nil {
+		return
+	}
+	for _, dup := range dups {
+		var why []string
+		if dup.SameOwner {
+			why = append(why, "same owner")
+		}
+		if dup.SameEmail {
+			why = append(why, "same email")
+		}
+		fmt.Printf("%s\t%s\t%.0fm\t%s\n", dup.A, dup.B, dup.Distance,
+			strings.Join(why, ", "))
+	}
+	fmt.Printf("%d likely duplicates within %gm\n", len(dups), radius)
+	return nil
+}
+
+// PostMerge merges the local node with the `secondary` address into
+// the one with the `primary` address, as with MergeNodes. Only admins
+// may merge nodes.
+func (*Api) PostMerge(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	primary := ParseIP(ctx.RequireStringLen(0, 40, "primary"))
+	secondary := ParseIP(ctx.RequireStringLen(0, 40, "secondary"))
+	if primary == nil || secondary == nil {
+		ctx.Error = jas.NewRequestError("addressInvalid")
+		return
+	}
+
+	if err := db.MergeNodes(primary, secondary); err != nil {
+		ctx.Error = apiError(ctx.Request, err)
+		return
+	}
+	db.Audit(primary, "merged", "admin", "from "+secondary.String())
+	apiLog.Request(ctx.Request).Noticef("Node %q merged into %q\n",
+		secondary, primary)
+	ctx.Data = "merged"
+}
+
+// GetLikelyDuplicates returns the pairs of local nodes which are likely
+// to be duplicates, as with LikelyDuplicates, within the given
+// `radius` in meters, or DefaultDuplicateRadius. Only admins may see
+// them.
+func (*Api) GetLikelyDuplicates(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	radius := float64(DefaultDuplicateRadius)
+	if r, err := ctx.FindPositiveInt("radius"); err == nil && r > 0 {
+		radius = float64(r)
+	}
+	dups, err := db.LikelyDuplicates(radius)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error finding likely duplicates: %s",
+			err)
+		return
+	}
+	ctx.Data = dups
+}
@@ -0,0 +1,277 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"html"
+	"net/http"
+	"time"
+)
+
+// meshviewerTime is the format of times in meshviewer's data.
+const meshviewerTime = time.RFC3339
+
+// MeshviewerNode is a node in the nodes.json format read by the
+// Freifunk meshviewer, as written by ffmap-backend.
+type MeshviewerNode struct {
+	FirstSeen string `json:"firstseen"`
+	LastSeen  string `json:"lastseen"`
+
+	Flags struct {
+		Online  bool `json:"online"`
+		Gateway bool `json:"gateway"`
+	} `json:"flags"`
+
+	Statistics struct {
+		Clients int     `json:"clients"`
+		Uptime  float64 `json:"uptime,omitempty"`
+	} `json:"statistics"`
+
+	NodeInfo struct {
+		NodeID   string `json:"node_id"`
+		Hostname string `json:"hostname"`
+		Network  struct {
+			Addresses []string `json:"addresses"`
+		} `json:"network"`
+		Location *meshviewerLocation `json:"location,omitempty"`
+		Owner    *meshviewerOwner    `json:"owner,omitempty"`
+		Software *meshviewerSoftware `json:"software,omitempty"`
+		System   struct {
+			SiteCode string `json:"site_code,omitempty"`
+		} `json:"system"`
+	} `json:"nodeinfo"`
+}
+
+// meshviewerLocation, meshviewerOwner, and meshviewerSoftware are the
+// parts of a MeshviewerNode which are omitted if they are not known.
+type meshviewerLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type meshviewerOwner struct {
+	Contact string `json:"contact"`
+}
+
+type meshviewerSoftware struct {
+	Firmware struct {
+		Release string `json:"release"`
+	} `json:"firmware"`
+}
+
+// meshviewerNodeID returns the ID by which meshviewer knows the node
+// with the given address, which is its address in hexadecimal, so
+// that it is safe to use in URLs.
+func meshviewerNodeID(addr IP) string {
+	return hex.EncodeToString(addr)
+}
+
+// MeshviewerNodes returns every node, local and cached, in meshviewer's
+// format. A node is online if it is active and pingable. Its first
+// seen time is that of its earliest recorded status, and its last
+// seen time that of its most recent heartbeat, if it sends them, or
+// now if it is online.
+func (db DB) MeshviewerNodes() (nodes []*MeshviewerNode, err error) {
+	all, err := db.DumpNodes()
+	if err != nil {
+		return
+	}
+
+	firstSeen := make(map[string]time.Time)
+	rows, err := db.Query(`SELECT address,MIN(changed)
+FROM status_history
+GROUP BY address;`)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var addr IP
+		var changed int64
+		if err = rows.Scan(&addr, &changed); err != nil {
+			rows.Close()
+			return
+		}
+		firstSeen[string(addr)] = time.Unix(changed, 0)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	heartbeats := make(map[string]*NodeHeartbeat)
+	rows, err = db.Query(`SELECT address,last,uptime,firmware,clients
+FROM node_heartbeats
+WHERE last > 0;`)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		h := new(NodeHeartbeat)
+		var last int64
+		var uptime, clients sql.NullInt64
+		var firmware sql.NullString
+		if err = rows.Scan(&h.Addr, &last, &uptime, &firmware,
+			&clients); err != nil {
+			rows.Close()
+			return
+		}
+		h.Last = time.Unix(last, 0)
+		h.Uptime = uptime.Int64
+		h.Firmware = firmware.String
+		h.Clients = int(clients.Int64)
+		heartbeats[string(h.Addr)] = h
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	now := time.Now()
+	nodes = make([]*MeshviewerNode, 0, len(all))
+	for _, node := range all {
+		m := new(MeshviewerNode)
+		m.Flags.Online = node.Status&StatusActive != 0 &&
+			node.Status&StatusPingable != 0
+
+		first, ok := firstSeen[string(node.Addr)]
+		if !ok {
+			first = now
+		}
+		last := first
+		if h := heartbeats[string(node.Addr)]; h != nil {
+			last = h.Last
+			m.Statistics.Clients = h.Clients
+			m.Statistics.Uptime = float64(h.Uptime)
+			if len(h.Firmware) > 0 {
+				m.NodeInfo.Software = new(meshviewerSoftware)
+				m.NodeInfo.Software.Firmware.Release = h.Firmware
+			}
+		} else if m.Flags.Online {
+			last = now
+		}
+		m.FirstSeen = first.UTC().Format(meshviewerTime)
+		m.LastSeen = last.UTC().Format(meshviewerTime)
+
+		m.NodeInfo.NodeID = meshviewerNodeID(node.Addr)
+		m.NodeInfo.Hostname = html.UnescapeString(node.OwnerName)
+		m.NodeInfo.Network.Addresses = []string{node.Addr.String()}
+		m.NodeInfo.Location = &meshviewerLocation{node.Latitude,
+			node.Longitude}
+		if len(node.Contact) > 0 {
+			m.NodeInfo.Owner = &meshviewerOwner{
+				html.UnescapeString(node.Contact)}
+		}
+		m.NodeInfo.System.SiteCode = node.MapID
+		nodes = append(nodes, m)
+	}
+	return
+}
+
+// HandleMeshviewerNodes serves every node in the nodes.json format read
+// by the Freifunk meshviewer, so that it can be used as a frontend. By
+// default, it is version 2, in which the nodes are an array, but if
+// `version` is "1", they are an object keyed by node ID.
+func HandleMeshviewerNodes(w http.ResponseWriter, r *http.Request) {
+	db := Db.WithContext(r.Context())
+	nodes, err := db.MeshviewerNodes()
+	if err != nil {
+		dbLog.Request(r).Errf("Error getting meshviewer nodes: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"version":   2,
+		"timestamp": time.Now().UTC().Format(meshviewerTime),
+		"nodes":     nodes,
+	}
+	if r.FormValue("version") == "1" {
+		byID := make(map[string]*MeshviewerNode, len(nodes))
+		for _, node := range nodes {
+			byID[node.NodeInfo.NodeID] = node
+		}
+		data["version"] = 1
+		data["nodes"] = byID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(data)
+}
+
+// meshviewerGraphNode and meshviewerGraphLink are the nodes and links
+// of the graph.json format read by the Freifunk meshviewer. Links
+// refer to nodes by their index.
+type meshviewerGraphNode struct {
+	ID     string `json:"id"`
+	NodeID string `json:"node_id"`
+}
+
+type meshviewerGraphLink struct {
+	Source   int     `json:"source"`
+	Target   int     `json:"target"`
+	TQ       float64 `json:"tq"`
+	Bidirect bool    `json:"bidirect"`
+	VPN      bool    `json:"vpn"`
+}
+
+// HandleMeshviewerGraph serves the links between local nodes in the
+// graph.json format read by the Freifunk meshviewer, which draws them
+// between the nodes served by HandleMeshviewerNodes. The "tq" of each
+// link is its metric, as meshviewer expects an ETX, or 1 if it has
+// none.
+func HandleMeshviewerGraph(w http.ResponseWriter, r *http.Request) {
+	db := Db.WithContext(r.Context())
+	links, err := db.Links()
+	if err != nil {
+		dbLog.Request(r).Errf("Error getting meshviewer graph: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+
+	nodes := make([]*meshviewerGraphNode, 0)
+	index := make(map[string]int)
+	indexOf := func(addr IP) int {
+		id := meshviewerNodeID(addr)
+		i, ok := index[id]
+		if !ok {
+			i = len(nodes)
+			index[id] = i
+			nodes = append(nodes, &meshviewerGraphNode{id, id})
+		}
+		return i
+	}
+
+	graphLinks := make([]*meshviewerGraphLink, 0, len(links))
+	for _, link := range links {
+		tq := link.Metric
+		if tq < 1 {
+			tq = 1
+		}
+		graphLinks = append(graphLinks, &meshviewerGraphLink{
+			Source:   indexOf(link.Source),
+			Target:   indexOf(link.Target),
+			TQ:       tq,
+			Bidirect: true,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version": 1,
+		"batadv": map[string]interface{}{
+			"directed":   false,
+			"multigraph": false,
+			"graph":      []interface{}{},
+			"nodes":      nodes,
+			"links":      graphLinks,
+		},
+	})
+}
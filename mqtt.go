@@ -0,0 +1,225 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+const (
+	// DefaultMQTTClientID and DefaultMQTTTopicPrefix are used if
+	// Conf.MQTT.ClientID or Conf.MQTT.TopicPrefix is not set.
+	DefaultMQTTClientID    = "nodeatlas"
+	DefaultMQTTTopicPrefix = "nodeatlas"
+
+	// mqttKeepAlive is the keep alive interval given to the broker.
+	// Pings are sent twice as often.
+	mqttKeepAlive = 60 * time.Second
+
+	// mqttRetryDelay is the length of time to wait before
+	// reconnecting to the broker.
+	mqttRetryDelay = 30 * time.Second
+
+	// mqttQueueLength is the number of messages which may wait to be
+	// published, such as while the broker is unreachable. Further
+	// messages are dropped.
+	mqttQueueLength = 256
+)
+
+var MQTTConnectionRefusedError = errors.New("mqtt: connection refused")
+
+// mqttMessage is a message waiting to be published.
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// mqttQueue holds messages waiting to be published. It is nil if MQTT
+// is not enabled.
+var mqttQueue chan mqttMessage
+
+// StartMQTT begins publishing to the broker given by Conf.MQTT.Broker,
+// if it is set, in a new goroutine. Messages are published at most
+// once, and the connection is retried if it is lost.
+func StartMQTT() {
+	if len(Conf.MQTT.Broker) == 0 || mqttQueue != nil {
+		return
+	}
+	mqttQueue = make(chan mqttMessage, mqttQueueLength)
+	go func() {
+		for {
+			conn, err := dialMQTT()
+			if err == nil {
+				l.Infof("Connected to MQTT broker %q\n", Conf.MQTT.Broker)
+				err = serveMQTT(conn)
+				conn.Close()
+			}
+			l.Errf("MQTT connection to %q lost: %s", Conf.MQTT.Broker, err)
+			time.Sleep(mqttRetryDelay)
+		}
+	}()
+}
+
+// PublishNodeEvent publishes the JSON encoding of v to the topic
+// "<prefix>/nodes/<address>/<event>", if MQTT is enabled. Events are
+// "added", "updated", "status", "heartbeat", and "metrics". If the
+// queue is full, the message is dropped.
+func PublishNodeEvent(addr IP, event string, v interface{}) {
+	if mqttQueue == nil {
+		return
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		l.Errf("Error encoding MQTT message: %s", err)
+		return
+	}
+	prefix := Conf.MQTT.TopicPrefix
+	if len(prefix) == 0 {
+		prefix = DefaultMQTTTopicPrefix
+	}
+	m := mqttMessage{
+		topic:   prefix + "/nodes/" + addr.String() + "/" + event,
+		payload: payload,
+	}
+	select {
+	case mqttQueue <- m:
+	default:
+		l.Warningf("MQTT queue full; dropped %q\n", m.topic)
+	}
+}
+
+// publicNode returns a copy of the node without its owner's email
+// address or photos, so that it can be published.
+func publicNode(node *Node) *Node {
+	n := *node
+	n.OwnerEmail = ""
+	n.Photos = nil
+	return &n
+}
+
+// dialMQTT connects to the broker and sends CONNECT, as in MQTT 3.1.1.
+func dialMQTT() (conn net.Conn, err error) {
+	if Conf.MQTT.TLS {
+		dialer := &net.Dialer{Timeout: 10 * time.Second}
+		conn, err = tls.DialWithDialer(dialer, "tcp", Conf.MQTT.Broker, nil)
+	} else {
+		conn, err = net.DialTimeout("tcp", Conf.MQTT.Broker,
+			10*time.Second)
+	}
+	if err != nil {
+		return
+	}
+
+	clientID := Conf.MQTT.ClientID
+	if len(clientID) == 0 {
+		clientID = DefaultMQTTClientID
+	}
+	flags := byte(0x02) // clean session
+	body := new(bytes.Buffer)
+	writeMQTTString(body, "MQTT")
+	body.WriteByte(4) // protocol level
+	if len(Conf.MQTT.Username) > 0 {
+		flags |= 0x80
+		if len(Conf.MQTT.Password) > 0 {
+			flags |= 0x40
+		}
+	}
+	body.WriteByte(flags)
+	keepAlive := uint16(mqttKeepAlive / time.Second)
+	body.Write([]byte{byte(keepAlive >> 8), byte(keepAlive)})
+	writeMQTTString(body, clientID)
+	if flags&0x80 != 0 {
+		writeMQTTString(body, Conf.MQTT.Username)
+	}
+	if flags&0x40 != 0 {
+		writeMQTTString(body, Conf.MQTT.Password)
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err = writeMQTTPacket(conn, 0x10, body.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// CONNACK is four bytes, the last of which is the return code.
+	connack := make([]byte, 4)
+	if _, err = io.ReadFull(conn, connack); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if connack[0] != 0x20 || connack[3] != 0 {
+		conn.Close()
+		return nil, MQTTConnectionRefusedError
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// serveMQTT publishes queued messages on the connection, and pings the
+// broker to keep it alive, until there is an error.
+func serveMQTT(conn net.Conn) error {
+	// Nothing but PINGRESP is expected from the broker, so discard
+	// what it sends, but notice when the connection is closed.
+	closed := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, conn)
+		if err == nil {
+			err = io.EOF
+		}
+		closed <- err
+	}()
+
+	ping := time.NewTicker(mqttKeepAlive / 2)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case m := <-mqttQueue:
+			body := new(bytes.Buffer)
+			writeMQTTString(body, m.topic)
+			body.Write(m.payload)
+			err = writeMQTTPacket(conn, 0x30, body.Bytes())
+		case <-ping.C:
+			err = writeMQTTPacket(conn, 0xC0, nil)
+		case err = <-closed:
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeMQTTPacket writes a packet with the given first byte, which is
+// the packet type and flags, and body.
+func writeMQTTPacket(w io.Writer, header byte, body []byte) error {
+	packet := []byte{header}
+	// The remaining length is encoded seven bits at a time, least
+	// significant first.
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+// writeMQTTString writes a length-prefixed UTF-8 string.
+func writeMQTTString(buf *bytes.Buffer, s string) {
+	buf.Write([]byte{byte(len(s) >> 8), byte(len(s))})
+	buf.WriteString(s)
+}
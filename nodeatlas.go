@@ -4,7 +4,6 @@ package main
 // Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
 
 import (
-	"database/sql"
 	"flag"
 	"fmt"
 	"github.com/inhies/go-log"
@@ -29,8 +28,13 @@ var (
 	StaticDir string // Directory for compiled files.
 	Pulse     *time.Ticker
 
-	t *template.Template
-	l *log.Logger
+	t     *template.Template // email templates
+	pages *template.Template // server-rendered web pages
+	l     *Logger
+
+	// apiLog, dbLog, fedLog, and mailLog are derived from l, and label
+	// messages with the component they come from.
+	apiLog, dbLog, fedLog, mailLog *Logger
 
 	shutdown = sync.NewCond(&sync.Mutex{})
 )
@@ -50,18 +54,34 @@ var (
 	fRes = flag.String("res", defaultResLocation,
 		"path to resource directory")
 
-	fLog   = flag.String("file", "", "Logfile (defaults to stdout)")
+	fLog       = flag.String("file", "", "Logfile (defaults to stdout)")
+	fLogFormat = flag.String("logformat", "text",
+		"log format (\"text\" or \"json\")")
 	fDebug = flag.Bool("debug", false, "maximize verbosity")
 	fQuiet = flag.Bool("q", false, "only output errors")
 
 	fReadOnly = flag.Bool("readonly", false, "disallow database changes")
 
 	fImport = flag.String("import", "", "import a JSON array of nodes")
+	fCheck  = flag.String("check", "",
+		"check a node at the given /api/check URL, as a Nagios plugin")
 )
 
 func main() {
 	flag.Parse()
 
+	// Act as a monitoring plugin, which needs no configuration, if
+	// asked to.
+	if len(*fCheck) > 0 {
+		RunCheck(*fCheck)
+	}
+
+	// Diagnose the configuration and its surroundings, rather than
+	// starting, if asked to.
+	if flag.Arg(0) == "doctor" {
+		os.Exit(RunDoctor())
+	}
+
 	// Load the configuration.
 	var err error
 	Conf, err = ReadConfig(*fConf)
@@ -92,11 +112,15 @@ func main() {
 		defer LogFile.Close()
 	} // Otherwise, default to os.Stdout.
 
-	l, err = log.NewLevel(LogLevel, true, LogFile, "", LogFlags)
+	l, err = NewLogger(LogLevel, *fLogFormat, LogFile, LogFlags)
 	if err != nil {
 		fmt.Printf("Could start logger: %s", err)
 		os.Exit(1)
 	}
+	apiLog = l.Component("api")
+	dbLog = l.Component("db")
+	fedLog = l.Component("federation")
+	mailLog = l.Component("mail")
 
 	l.Infof("Starting NodeAtlas %s\n", Version)
 
@@ -115,17 +139,36 @@ func main() {
 	}
 	l.Debugf("Compiled static files to %q\n", StaticDir)
 
+	// Compile the static directories of any additional maps.
+	if err = CompileMapStatic(*fRes); err != nil {
+		os.RemoveAll(StaticDir)
+		l.Fatalf("Could not compile static files of maps: %s", err)
+	}
+
+	// Load the regions used for statistics, if any.
+	ReloadRegions(*fRes)
+
+	// Load the key for owner email addresses, if there is one.
+	if err = LoadEmailKey(); err != nil {
+		l.Fatalf("Could not load email storage key: %s", err)
+	}
+
 	// Connect to the database with configured parameters.
-	db, err := sql.Open(Conf.Database.DriverName,
-		Conf.Database.Resource)
+	db, err := OpenDatabase()
 	if err != nil {
 		l.Fatalf("Could not connect to database: %s", err)
 	}
+	// Connect to the read replica, if there is one.
+	replica, err := OpenReplica()
+	if err != nil {
+		l.Fatalf("Could not connect to database replica: %s", err)
+	}
 	// Wrap the *sql.DB type.
 	Db = DB{
 		DB:         db,
 		DriverName: Conf.Database.DriverName,
 		ReadOnly:   (*fReadOnly || Conf.Database.ReadOnly),
+		Replica:    replica,
 	}
 	l.Debug("Connected to database\n")
 	if Db.ReadOnly {
@@ -138,6 +181,13 @@ func main() {
 		l.Fatalf("Could not initialize database: %s", err)
 	}
 	l.Debug("Initialized database\n")
+	if !Db.ReadOnly {
+		if n, err := Db.SealOwnerEmails(); err != nil {
+			l.Errf("Could not convert stored email addresses: %s", err)
+		} else if n > 0 {
+			l.Infof("Converted %d stored email addresses\n", n)
+		}
+	}
 	l.Infof("Nodes: %d (%d local)\n", Db.LenNodes(true), Db.LenNodes(false))
 
 	// Check action flags and abandon normal startup if any are set.
@@ -151,6 +201,23 @@ func main() {
 		return
 	}
 
+	// Run a command, such as "admin merge <a> <b>" or "import --kml
+	// <file>", instead of starting normally, if one is given.
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "admin":
+			err = RunAdminCommand(flag.Args()[1:])
+		case "import":
+			err = RunImportCommand(flag.Args()[1:])
+		default:
+			err = fmt.Errorf("unknown command %q", flag.Arg(0))
+		}
+		if err != nil {
+			l.Fatalf("%s", err)
+		}
+		return
+	}
+
 	// Listen for OS signals.
 	go ListenSignal()
 
@@ -159,10 +226,29 @@ func main() {
 	// prevent startup.
 	CleanNodeRSS()
 
+	// Take the leader lease, if no other instance sharing the
+	// database holds it, before the first heartbeat.
+	StartLeaderElection()
+
+	// Keep the in-memory indexes up to date with changes made by
+	// other instances sharing the database.
+	WatchNodeGeneration()
+
 	// Start the Heartbeat.
 	Heartbeat()
 	l.Debug("Heartbeat started\n")
 
+	// Start publishing to the MQTT broker, if there is one, and
+	// running hooks, if there are any.
+	StartMQTT()
+	StartHooks()
+
+	// Work through the queue of background tasks, such as emails.
+	StartQueue()
+
+	// Notify parent maps of changes, if there are any.
+	StartPushNotifications()
+
 	go func() {
 		// Start the HTTP server. This will block until the server
 		// encounters an error.
@@ -184,7 +270,17 @@ func main() {
 //
 // Tasks:
 // - Db.DeleteExpiredFromQueue()
+// - Db.DeleteExpiredComments()
+// - Db.DeleteExpiredTransfers()
+// - Db.DeleteExpiredOwnerSessions()
+// - CheckHeartbeats()
+// - CheckAlerts()
+// - CheckTickets()
+// - PollSNMP()
+// - CollectCjdns()
+// - ImportTopology()
 // - UpdateMapCache()
+// - EnforceRetention()
 func Heartbeat() {
 	// If the timer was not nil, then the timer must restart.
 	if Pulse != nil {
@@ -214,8 +310,29 @@ func Heartbeat() {
 // perform the tasks that are usually performed regularly.
 func doHeartbeatTasks() {
 	l.Debug("Heartbeat\n")
+
+	// Only the leader polls, probes, and cleans up, so that instances
+	// which share the database don't all do so. The RSS feed is kept
+	// in the memory of each, and their indexes are invalidated by
+	// WatchNodeGeneration when the leader changes the nodes.
+	if !IsLeader() {
+		l.Debug("Not the leader; skipping shared heartbeat tasks\n")
+		CleanNodeRSS()
+		return
+	}
 	Db.DeleteExpiredFromQueue()
-	UpdateMapCache()
+	Db.DeleteExpiredComments()
+	Db.DeleteExpiredTransfers()
+	Db.DeleteExpiredOwnerSessions()
+	CheckHeartbeats()
+	CheckAlerts()
+	CheckTickets()
+	PollSNMP()
+	CollectCjdns()
+	ImportTopology()
+	UpdateMapCache(serverContext)
+	EnforceRetention()
+	ExportOpenDataIfDue()
 	ClearExpiredCAPTCHA()
 	ResendVerificationEmails()
 	CleanNodeRSS()
@@ -223,13 +340,15 @@ func doHeartbeatTasks() {
 
 // ListenSignal uses os/signal to wait for OS signals, such as SIGHUP
 // and SIGINT, and perform the appropriate actions as listed below.
-//     SIGHUP: reload configuration file
+//     SIGUSR1: perform the heartbeat tasks immediately
+//     SIGUSR2: reload configuration file
+//     SIGHUP: restart without refusing connections (see Restart)
 //     SIGINT, SIGKILL, SIGTERM: gracefully shut down
 func ListenSignal() {
 	// Create the channel and use signal.Notify to listen for any
 	// specified signals.
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2,
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP,
 		os.Interrupt, os.Kill, syscall.SIGTERM)
 	for sig := range c {
 		switch sig {
@@ -248,6 +367,12 @@ func ListenSignal() {
 			}
 			Conf = conf
 
+			// Reload the email storage key. Addresses are only
+			// converted to a new mode on startup.
+			if err = LoadEmailKey(); err != nil {
+				l.Errf("Could not load email storage key: %s", err)
+			}
+
 			// Recompile the static directory, but be able to restore
 			// the previous one if there's an error.
 			oldStaticDir := StaticDir
@@ -264,46 +389,86 @@ func ListenSignal() {
 				l.Errf("Error removing old static directory: %s", err)
 			}
 
-			// Reload the email templates.
-			err = RegisterTemplates()
+			err = CompileMapStatic(*fRes)
 			if err != nil {
-				l.Errf("Error reloading email templates: %s", err)
+				l.Errf("Error recompiling static files of maps: %s", err)
 			}
 
-			// Restart the heartbeat ticker.
-			Heartbeat()
-		case os.Interrupt, os.Kill, syscall.SIGTERM:
-			l.Infof("Caught %s; NodeAtlas over and out\n", sig)
-			var err error
-
-			// Close the HTTP Listener. If a UNIX socket is in use, it
-			// will automatically be removed. We need to tell the
-			// server to ignore errors, because closing the listener
-			// will cause http.Server.Serve() to return one.
-			ignoreServerCrash = true
-			listener.Close()
+			// Reload the regions.
+			ReloadRegions(*fRes)
 
-			// Close the database connection.
-			err = Db.Close()
+			// Reload the email and page templates.
+			err = RegisterEmailTemplates()
+			if err == nil && !Conf.Web.Headless {
+				err = RegisterTemplates()
+			}
 			if err != nil {
-				// If closing the database gave an error, report it
-				// and set the exit code.
-				l.Errf("Database could not be closed: %s", err)
+				l.Errf("Error reloading templates: %s", err)
 			}
 
-			// Delete the directory of static files.
-			err = os.RemoveAll(StaticDir)
-			if err != nil {
-				// If the static directory coldn't be removed, report
-				// it, give the location of the directory, and set the
-				// exit code.
-				l.Errf("Static directory %q could not be removed: %s",
-					StaticDir, err)
+			// Restart the heartbeat ticker.
+			Heartbeat()
+		case syscall.SIGHUP:
+			l.Info("Restarting\n")
+
+			// Start a new process, which serves on the same
+			// listeners, and shut down once it is serving. If it
+			// fails, continue serving.
+			if err := Restart(); err != nil {
+				l.Errf("Could not restart: %s", err)
+				continue
 			}
+			Shutdown()
+		case os.Interrupt, os.Kill, syscall.SIGTERM:
+			l.Infof("Caught %s; NodeAtlas over and out\n", sig)
+			Shutdown()
+		}
+	}
+}
+
+// Shutdown stops serving, waiting for in-flight requests to finish,
+// closes the database, removes the static directories, and tells the
+// main routine to exit.
+func Shutdown() {
+	var err error
 
-			// Finally, tell the main routine to stop waiting and
-			// exit.
-			shutdown.Broadcast()
+	// Stop the HTTP servers, once their in-flight requests have
+	// finished. If a UNIX socket is in use, it will automatically
+	// be removed, unless it was passed on by Restart. We need to
+	// tell the server to ignore errors, because closing the
+	// listeners will cause http.Server.Serve() to return one.
+	ignoreServerCrash = true
+	ShutdownServers()
+
+	// Let another instance become the leader immediately, cancel
+	// any work which is still running, and close the database
+	// connection.
+	ResignLeadership()
+	cancelServerContext()
+	err = Db.Close()
+	if err != nil {
+		// If closing the database gave an error, report it
+		// and set the exit code.
+		l.Errf("Database could not be closed: %s", err)
+	}
+	if Db.Replica != nil {
+		if err = Db.Replica.Close(); err != nil {
+			l.Errf("Database replica could not be closed: %s", err)
 		}
 	}
+
+	// Delete the directory of static files.
+	err = os.RemoveAll(StaticDir)
+	if err != nil {
+		// If the static directory coldn't be removed, report
+		// it, give the location of the directory, and set the
+		// exit code.
+		l.Errf("Static directory %q could not be removed: %s",
+			StaticDir, err)
+	}
+	RemoveMapStatic()
+
+	// Finally, tell the main routine to stop waiting and
+	// exit.
+	shutdown.Broadcast()
 }
@@ -50,6 +50,35 @@ const (
 	_
 )
 
+// StatusNames returns short descriptions of the given status flags,
+// such as "active" or "planned," and "wireless access," in the
+// order in which the flags are defined.
+func StatusNames(status uint32) (names []string) {
+	if status&StatusActive != 0 {
+		names = append(names, "active")
+	} else {
+		names = append(names, "planned")
+	}
+	if status&StatusPhysical != 0 {
+		names = append(names, "physical server")
+	} else {
+		names = append(names, "virtual server")
+	}
+	if status&StatusInternet != 0 {
+		names = append(names, "internet access")
+	}
+	if status&StatusWireless != 0 {
+		names = append(names, "wireless access")
+	}
+	if status&StatusWired != 0 {
+		names = append(names, "wired access")
+	}
+	if status&StatusPingable != 0 {
+		names = append(names, "pingable")
+	}
+	return
+}
+
 // Node is the basic type for a computer, radio, transmitter, or any
 // other sort of node in a mesh network.
 type Node struct {
@@ -58,6 +87,12 @@ type Node struct {
 	// SourceID is 0, the node is considered to be local.
 	SourceID int `json:"-"`
 
+	// Via is the address of the map from which a cached node was
+	// retrieved, if that map is not its source but only cached it
+	// in turn. It is empty for local nodes and nodes retrieved from
+	// their source directly.
+	Via string `json:",omitempty"`
+
 	// Status is a list of bit flags representing the node's status,
 	// such as whether it is active or planned, has wireless access,
 	// is a physical server, etc.
@@ -94,6 +129,31 @@ type Node struct {
 
 	// PGP is the key ID of the owner's public key.
 	PGP PGPID `json:",omitempty"`
+
+	// MapID is the ID of the SubMap to which the node belongs, or
+	// empty if it belongs to the main map.
+	MapID string `json:",omitempty"`
+
+	// Neighborhood is the name of the neighborhood in which the node
+	// is located, as found by the geocoder. It is not set by users.
+	Neighborhood string `json:",omitempty"`
+
+	// CreateTime and UpdateTime are the Unix times (in seconds) at
+	// which the node was added and last changed by its owner or an
+	// admin, on its home instance if it is cached. They are zero if
+	// they are not known, such as for nodes which were added before
+	// they were recorded and have no history.
+	CreateTime int64 `json:",omitempty"`
+	UpdateTime int64 `json:",omitempty"`
+
+	// Version is incremented every time a local node is updated, so
+	// that updates can be made only if it has not changed since it
+	// was retrieved. It is zero for cached nodes.
+	Version int64 `json:",omitempty"`
+
+	// Photos are the photos attached to the node by its owner. They
+	// are only loaded for single local nodes.
+	Photos []*Photo `json:",omitempty"`
 }
 
 // Feature returns the Node as a *geojson.Feature.
@@ -115,6 +175,18 @@ func (n *Node) Feature() (f *geojson.Feature) {
 	if n.SourceID != 0 {
 		properties["SourceID"] = n.SourceID
 	}
+	if len(n.Via) != 0 {
+		properties["Via"] = n.Via
+	}
+	if len(n.Neighborhood) != 0 {
+		properties["Neighborhood"] = n.Neighborhood
+	}
+	if n.CreateTime != 0 {
+		properties["CreateTime"] = n.CreateTime
+	}
+	if n.UpdateTime != 0 {
+		properties["UpdateTime"] = n.UpdateTime
+	}
 
 	// Create and return the feature.
 	return geojson.NewFeature(
@@ -129,7 +201,7 @@ func (n *Node) Feature() (f *geojson.Feature) {
 // timestamp.
 func (n *Node) Item() (i *moverss.Item) {
 	return &moverss.Item{
-		Link:    Conf.Web.Hostname + "/node/" + n.Addr.String(),
+		Link:    NodePageURL(nil, n.Addr),
 		Title:   n.OwnerName,
 		XMLName: NodeXMLName,
 	}
@@ -151,12 +223,11 @@ func (ip *IP) UnmarshalJSON(b []byte) error {
 		// segfault, so we should return an error.
 		return IncorrectlyFormattedIP
 	}
-	tip := net.ParseIP(string(b[1 : len(b)-1]))
+	tip := ParseIP(string(b[1 : len(b)-1]))
 	if tip == nil {
 		return IncorrectlyFormattedIP
 	}
-	// Don't think too hard about this part.
-	*ip = *(*IP)(&tip)
+	*ip = tip
 	return nil
 }
 
@@ -0,0 +1,180 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultOpenDataName is the name under which the open dataset is
+	// stored if none is configured.
+	DefaultOpenDataName = "nodes.json"
+
+	// DefaultOpenDataPrecision is the number of decimal places to
+	// which the coordinates of the open dataset are rounded if none
+	// is configured, which is about 100 meters.
+	DefaultOpenDataPrecision = 3
+)
+
+// OpenDataset is an anonymized dataset of the local nodes, which can
+// be published for researchers and open data portals. It has no
+// personal information: no owners, contacts, addresses, or details,
+// and coordinates are rounded so that nodes can't be placed at a
+// particular home.
+type OpenDataset struct {
+	// Name is the name of the map, as in Conf.Name, and Generated is
+	// when the dataset was made.
+	Name      string
+	Generated time.Time
+
+	// License and Attribution are as in Conf.OpenData.
+	License     string `json:",omitempty"`
+	Attribution string `json:",omitempty"`
+
+	// Precision is the number of decimal places to which coordinates
+	// are rounded.
+	Precision int
+
+	// Statuses are the number of nodes with each status, as by
+	// StatusCounts.
+	Statuses map[string]int
+
+	// Nodes are the nodes, in order of their coordinates, so that
+	// their order reveals nothing else.
+	Nodes []*OpenDataNode
+}
+
+// OpenDataNode is a single node of an OpenDataset.
+type OpenDataNode struct {
+	Latitude, Longitude float64
+	Status              uint32
+	Neighborhood        string `json:",omitempty"`
+	MapID               string `json:",omitempty"`
+
+	// Created is the date on which the node was added, as
+	// "2006-01-02" in UTC, if it is known.
+	Created string `json:",omitempty"`
+}
+
+// openData is when the open dataset was last exported.
+var openData struct {
+	sync.Mutex
+	exported time.Time
+}
+
+// roundCoordinate rounds the coordinate to the given number of decimal
+// places.
+func roundCoordinate(x float64, precision int) float64 {
+	scale := math.Pow(10, float64(precision))
+	return math.Round(x*scale) / scale
+}
+
+// NewOpenDataset returns the anonymized dataset of the given nodes,
+// with coordinates rounded to the given number of decimal places.
+func NewOpenDataset(nodes []*Node, precision int) *OpenDataset {
+	d := &OpenDataset{
+		Name:        Conf.Name,
+		Generated:   time.Now().UTC(),
+		License:     Conf.OpenData.License,
+		Attribution: Conf.OpenData.Attribution,
+		Precision:   precision,
+		Statuses:    StatusCounts(nodes),
+		Nodes:       make([]*OpenDataNode, 0, len(nodes)),
+	}
+	for _, node := range nodes {
+		if node == nil {
+			continue
+		}
+		n := &OpenDataNode{
+			Latitude:     roundCoordinate(node.Latitude, precision),
+			Longitude:    roundCoordinate(node.Longitude, precision),
+			Status:       node.Status,
+			Neighborhood: node.Neighborhood,
+			MapID:        node.MapID,
+		}
+		if node.CreateTime != 0 {
+			n.Created = time.Unix(node.CreateTime, 0).UTC().Format(
+				"2006-01-02")
+		}
+		d.Nodes = append(d.Nodes, n)
+	}
+	sort.Sort(openDataByLocation(d.Nodes))
+	return d
+}
+
+// openDataByLocation sorts nodes by latitude, and then longitude.
+type openDataByLocation []*OpenDataNode
+
+func (n openDataByLocation) Len() int      { return len(n) }
+func (n openDataByLocation) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+func (n openDataByLocation) Less(i, j int) bool {
+	if n[i].Latitude != n[j].Latitude {
+		return n[i].Latitude < n[j].Latitude
+	}
+	return n[i].Longitude < n[j].Longitude
+}
+
+// ExportOpenData writes the open dataset of the local nodes to the
+// storage configured by Conf.OpenData, as JSON. If no storage is
+// configured, it returns StorageDisabledError.
+func ExportOpenData() error {
+	conf := Conf.OpenData
+	storage, err := NewStorage(conf.Storage)
+	if err != nil {
+		return err
+	}
+	name := conf.Name
+	if len(name) == 0 {
+		name = DefaultOpenDataName
+	}
+	precision := conf.Precision
+	if precision <= 0 {
+		precision = DefaultOpenDataPrecision
+	}
+
+	nodes, err := Db.DumpLocal()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(NewOpenDataset(nodes, precision), "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = storage.Put(name, "application/json",
+		bytes.NewReader(b)); err != nil {
+		return err
+	}
+
+	openData.Lock()
+	openData.exported = time.Now()
+	openData.Unlock()
+	l.Infof("Exported open dataset of %d nodes to %q\n", len(nodes), name)
+	return nil
+}
+
+// ExportOpenDataIfDue exports the open dataset, as with ExportOpenData,
+// if Conf.OpenData.Interval is set and has passed since it was last
+// exported, or it has not been exported since starting. Errors are
+// logged.
+func ExportOpenDataIfDue() {
+	interval := time.Duration(Conf.OpenData.Interval)
+	if interval <= 0 {
+		return
+	}
+	openData.Lock()
+	last := openData.exported
+	openData.Unlock()
+	if !last.IsZero() && time.Since(last) < interval {
+		return
+	}
+	if err := ExportOpenData(); err != nil {
+		l.Errf("Error exporting open dataset: %s", err)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// OwnerSessionCookie is the name of the cookie which holds the
+	// session of an owner who has signed in to /my.
+	OwnerSessionCookie = "nodeatlas_owner"
+
+	// OwnerSessionLifetime is how long an owner stays signed in to
+	// /my after following a login link.
+	OwnerSessionLifetime = 30 * 24 * time.Hour
+)
+
+// OwnerPreferences are the emails which an owner would like to receive
+// about all of their nodes, as set at /my. Each is only sent if it is
+// also enabled in the configuration.
+type OwnerPreferences struct {
+	// Alerts are sent when a node appears to be down.
+	Alerts bool
+
+	// Comments are sent when a comment is shown on a node.
+	Comments bool
+
+	// Connections are the requests of prospective members to connect
+	// to a node. They are shown at /my even if they are not emailed.
+	Connections bool
+}
+
+// DefaultOwnerPreferences are the preferences of owners who have not
+// set any, which is to receive every email.
+var DefaultOwnerPreferences = OwnerPreferences{
+	Alerts:      true,
+	Comments:    true,
+	Connections: true,
+}
+
+// preferenceKey returns the key by which the preferences of the owner of
+// the given email address, stored in any form, are known, which is
+// its keyed hash, as given by HashEmail.
+func preferenceKey(stored string) (string, error) {
+	if strings.HasPrefix(stored, hashedEmailPrefix) {
+		return stored, nil
+	}
+	email, err := OpenEmail(stored)
+	if err != nil {
+		return "", err
+	}
+	return HashEmail(email), nil
+}
+
+// AddOwnerLogin records a login link for the owner with the given
+// email address, which expires after Conf.VerificationExpiration, and
+// returns its token.
+func (db DB) AddOwnerLogin(email string) (token string, err error) {
+	if token, err = newSecret(); err != nil {
+		return
+	}
+	stored, err := EncryptEmail(email)
+	if err != nil {
+		return
+	}
+	expiration := time.Now().Add(time.Duration(Conf.VerificationExpiration))
+	_, err = db.Exec(`INSERT INTO owner_logins
+(id, email, expiration)
+VALUES(?, ?, ?);`, secretHash(token), stored, expiration.Unix())
+	return
+}
+
+// StartOwnerSession uses up the login link with the given token, and
+// starts a session for its owner, which lasts for OwnerSessionLifetime.
+// It returns the session's token and the owner's email address. If
+// there is no such link, or it has expired, it returns sql.ErrNoRows.
+func (db DB) StartOwnerSession(login string) (session, email string,
+	err error) {
+	id := secretHash(login)
+	var stored string
+	if err = db.QueryRow(`SELECT email
+FROM owner_logins
+WHERE id = ? AND expiration > ?;`, id, time.Now().Unix()).Scan(
+		&stored); err != nil {
+		return
+	}
+	// Links can only be used once.
+	if _, err = db.Exec(`DELETE FROM owner_logins
+WHERE id = ?;`, id); err != nil {
+		return
+	}
+	if email, err = OpenEmail(stored); err != nil {
+		return
+	}
+
+	if session, err = newSecret(); err != nil {
+		return
+	}
+	expiration := time.Now().Add(OwnerSessionLifetime)
+	_, err = db.Exec(`INSERT INTO owner_sessions
+(id, email, expiration)
+VALUES(?, ?, ?);`, secretHash(session), stored, expiration.Unix())
+	return
+}
+
+// OwnerSession returns the email address of the owner of the session
+// with the given token. If there is no such session, or it has expired,
+// it returns sql.ErrNoRows.
+func (db DB) OwnerSession(session string) (email string, err error) {
+	var stored string
+	if err = db.QueryRow(`SELECT email
+FROM owner_sessions
+WHERE id = ? AND expiration > ?;`, secretHash(session),
+		time.Now().Unix()).Scan(&stored); err != nil {
+		return
+	}
+	return OpenEmail(stored)
+}
+
+// EndOwnerSession ends the session with the given token, if there is
+// one.
+func (db DB) EndOwnerSession(session string) (err error) {
+	_, err = db.Exec(`DELETE FROM owner_sessions
+WHERE id = ?;`, secretHash(session))
+	return
+}
+
+// DeleteExpiredOwnerSessions removes login links and sessions which
+// have expired.
+func (db DB) DeleteExpiredOwnerSessions() (err error) {
+	now := time.Now().Unix()
+	if _, err = db.Exec(`DELETE FROM owner_logins
+WHERE expiration <= ?;`, now); err != nil {
+		return
+	}
+	_, err = db.Exec(`DELETE FROM owner_sessions
+WHERE expiration <= ?;`, now)
+	return
+}
+
+// SignedInOwner returns the email address of the owner who is signed
+// in to /my by the request's session cookie, or "" if there is none.
+func SignedInOwner(r *http.Request) string {
+	cookie, err := r.Cookie(OwnerSessionCookie)
+	if err != nil || len(cookie.Value) == 0 {
+		return ""
+	}
+	email, err := Db.WithContext(r.Context()).OwnerSession(cookie.Value)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			dbLog.Request(r).Errf("Error checking owner session: %s", err)
+		}
+		return ""
+	}
+	return email
+}
+
+// OwnsNode returns true if the local node with the given address
+// belongs to the owner with the given email address.
+func (db DB) OwnsNode(addr IP, email string) (ok bool, err error) {
+	var stored string
+	err = db.QueryRow(`SELECT email
+FROM nodes
+WHERE address = ?;`, []byte(addr)).Scan(&stored)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return
+	}
+	return EmailMatches(stored, email), nil
+}
+
+// OwnerNodes returns every local node, of any status, which belongs to
+// the owner with the given email address, in order of their addresses.
+func (db DB) OwnerNodes(email string) (nodes []*Node, err error) {
+	rows, err := db.Query(`SELECT address,email FROM nodes;`)
+	if err != nil {
+		return
+	}
+	var addrs []IP
+	for rows.Next() {
+		var addr IP
+		var stored string
+		if err = rows.Scan(&addr, &stored); err != nil {
+			rows.Close()
+			return
+		}
+		if EmailMatches(stored, email) {
+			addrs = append(addrs, addr)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	nodes = make([]*Node, 0, len(addrs))
+	for _, addr := range addrs {
+		node, err := db.GetLocalNode(addr)
+		if err == LocalNodeNotFoundError {
+			// It was deleted in the meantime.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	sort.Sort(nodesByAddr(nodes))
+	return
+}
+
+// OwnerPreferences returns the preferences of the owner with the given
+// email address, or DefaultOwnerPreferences if they have set none.
+func (db DB) OwnerPreferences(email string) (p OwnerPreferences, err error) {
+	return db.ownerPreferences(HashEmail(email))
+}
+
+// ownerPreferences returns the preferences stored under the given key,
+// as given by preferenceKey.
+func (db DB) ownerPreferences(key string) (p OwnerPreferences, err error) {
+	err = db.QueryRow(`SELECT alerts,comments,connections
+FROM owner_preferences
+WHERE email = ?;`, key).Scan(&p.Alerts, &p.Comments, &p.Connections)
+	if err == sql.ErrNoRows {
+		return DefaultOwnerPreferences, nil
+	}
+	return
+}
+
+// SetOwnerPreferences replaces the preferences of the owner with the
+// given email address. They are also stored under its legacy hash, if
+// there is one, so that they apply to nodes whose addresses were
+// hashed before separate keys were derived.
+func (db DB) SetOwnerPreferences(email string, p OwnerPreferences) (err error) {
+	keys := []string{HashEmail(email)}
+	if legacy := legacyHashEmail(email); len(legacy) > 0 {
+		keys = append(keys, legacy)
+	}
+	for _, key := range keys {
+		if _, err = db.Exec(`DELETE FROM owner_preferences
+WHERE email = ?;`, key); err != nil {
+			return
+		}
+		_, err = db.Exec(`INSERT INTO owner_preferences
+(email, alerts, comments, connections)
+VALUES(?, ?, ?, ?);`, key, p.Alerts, p.Comments, p.Connections)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// NodeOwnerPreferences returns the preferences of the owner of the
+// given node, whose email address may be stored in any form. Errors
+// are logged, and DefaultOwnerPreferences are returned instead, so that
+// owners are not left uninformed by them.
+func (db DB) NodeOwnerPreferences(node *Node) OwnerPreferences {
+	key, err := preferenceKey(node.OwnerEmail)
+	if err == nil {
+		var p OwnerPreferences
+		if p, err = db.ownerPreferences(key); err == nil {
+			return p
+		}
+	}
+	dbLog.Errf("Error getting owner preferences of %q: %s", node.Addr, err)
+	return DefaultOwnerPreferences
+}
@@ -0,0 +1,344 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// perfMaxEndpoints is the number of distinct endpoints for which
+	// latencies are recorded. Requests to any others are recorded
+	// under perfOtherEndpoint, so that scanning for random paths
+	// can't use up memory.
+	perfMaxEndpoints  = 256
+	perfOtherEndpoint = "other"
+
+	// perfSlowest is the number of the slowest requests which are
+	// kept, so that they can be found in the logs by their IDs.
+	perfSlowest = 20
+)
+
+// perfBuckets are the upper bounds of the buckets of the latency
+// histograms. Requests slower than the last are counted in one more
+// bucket. Percentiles are reported as the upper bound of the bucket
+// in which they fall, so they are accurate to within a bucket.
+var perfBuckets = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+}
+
+// perfHistogram counts the requests to an endpoint, their latencies,
+// and their errors.
+type perfHistogram struct {
+	Counts       []uint64
+	Count        uint64
+	Errors       uint64
+	ClientErrors uint64
+	Total        time.Duration
+	Max          time.Duration
+}
+
+// SlowRequest is one of the slowest requests since the statistics
+// were reset.
+type SlowRequest struct {
+	Time     time.Time
+	Endpoint string
+	Path     string
+	Status   int
+	Duration float64
+	Request  string
+}
+
+// EndpointPerf summarizes the latencies, in milliseconds, and errors
+// of the requests to an endpoint. Errors are responses with 5xx
+// statuses, which count against the error budget, and ClientErrors
+// are those with 4xx statuses.
+type EndpointPerf struct {
+	Endpoint     string
+	Count        uint64
+	Errors       uint64
+	ClientErrors uint64
+	ErrorRate    float64
+	Mean         float64
+	P50          float64
+	P95          float64
+	P99          float64
+	Max          float64
+}
+
+// PerfSummary is the summary of request latencies, and of the
+// statements which have taken the longest, served at /api/admin/perf.
+type PerfSummary struct {
+	Since     time.Time
+	Count     uint64
+	Errors    uint64
+	ErrorRate float64
+	Endpoints []*EndpointPerf
+	Slowest   []*SlowRequest
+	Queries   []*QueryPerf
+}
+
+// perf holds the latency histograms of every endpoint, and the
+// durations of every statement, since the server started, or since
+// they were reset.
+var perf = struct {
+	sync.Mutex
+	since     time.Time
+	endpoints map[string]*perfHistogram
+	slowest   []*SlowRequest
+	queries   map[string]*queryStats
+}{
+	since:     time.Now(),
+	endpoints: make(map[string]*perfHistogram),
+	queries:   make(map[string]*queryStats),
+}
+
+// perfEndpoint returns the endpoint under which a request is recorded,
+// which is its method and path, with segments which identify a
+// resource, such as addresses and IDs, replaced by "*", as in
+// "GET /api/nodes/*/metrics".
+func perfEndpoint(r *http.Request) string {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) > 4 {
+		segments = append(segments[:4], "...")
+	}
+	for i, segment := range segments {
+		if strings.IndexFunc(segment, func(c rune) bool {
+			return !(c >= 'a' && c <= 'z' || c == '_' || c == '-')
+		}) >= 0 {
+			segments[i] = "*"
+		}
+	}
+	return r.Method + " /" + strings.Join(segments, "/")
+}
+
+// RecordRequest adds a request to the statistics of its endpoint.
+func RecordRequest(r *http.Request, status int, duration time.Duration) {
+	endpoint := perfEndpoint(r)
+
+	perf.Lock()
+	defer perf.Unlock()
+
+	h, ok := perf.endpoints[endpoint]
+	if !ok {
+		if len(perf.endpoints) >= perfMaxEndpoints {
+			endpoint = perfOtherEndpoint
+			h = perf.endpoints[endpoint]
+		}
+		if h == nil {
+			h = &perfHistogram{Counts: make([]uint64, len(perfBuckets)+1)}
+			perf.endpoints[endpoint] = h
+		}
+	}
+
+	i := sort.Search(len(perfBuckets), func(i int) bool {
+		return duration <= perfBuckets[i]
+	})
+	h.Counts[i]++
+	h.Count++
+	h.Total += duration
+	if duration > h.Max {
+		h.Max = duration
+	}
+	if status >= 500 {
+		h.Errors++
+	} else if status >= 400 {
+		h.ClientErrors++
+	}
+
+	// Keep the slowest requests in descending order of duration.
+	ms := milliseconds(duration)
+	if len(perf.slowest) == perfSlowest &&
+		ms <= perf.slowest[perfSlowest-1].Duration {
+		return
+	}
+	i = sort.Search(len(perf.slowest), func(i int) bool {
+		return perf.slowest[i].Duration < ms
+	})
+	perf.slowest = append(perf.slowest, nil)
+	copy(perf.slowest[i+1:], perf.slowest[i:])
+	perf.slowest[i] = &SlowRequest{
+		Time:     time.Now(),
+		Endpoint: endpoint,
+		Path:     r.URL.Path,
+		Status:   status,
+		Duration: ms,
+		Request:  RequestID(r),
+	}
+	if len(perf.slowest) > perfSlowest {
+		perf.slowest = perf.slowest[:perfSlowest]
+	}
+}
+
+// Perf returns a summary of the requests to every endpoint since the
+// server started, or since ResetPerf, ordered by their 95th percentile
+// latencies, slowest first.
+func Perf() *PerfSummary {
+	perf.Lock()
+	defer perf.Unlock()
+
+	summary := &PerfSummary{
+		Since:     perf.since,
+		Endpoints: make([]*EndpointPerf, 0, len(perf.endpoints)),
+		Slowest:   make([]*SlowRequest, len(perf.slowest)),
+	}
+	for endpoint, h := range perf.endpoints {
+		summary.Count += h.Count
+		summary.Errors += h.Errors
+		summary.Endpoints = append(summary.Endpoints, &EndpointPerf{
+			Endpoint:     endpoint,
+			Count:        h.Count,
+			Errors:       h.Errors,
+			ClientErrors: h.ClientErrors,
+			ErrorRate:    rate(h.Errors, h.Count),
+			Mean:         milliseconds(h.Total) / float64(h.Count),
+			P50:          h.percentile(0.50),
+			P95:          h.percentile(0.95),
+			P99:          h.percentile(0.99),
+			Max:          milliseconds(h.Max),
+		})
+	}
+	summary.ErrorRate = rate(summary.Errors, summary.Count)
+	sort.Sort(endpointsBySlowest(summary.Endpoints))
+	copy(summary.Slowest, perf.slowest)
+	summary.Queries = slowestQueries(perfSlowest)
+	return summary
+}
+
+// ResetPerf discards the statistics of every endpoint, such as after
+// an upgrade, so that they only reflect the new version.
+func ResetPerf() {
+	perf.Lock()
+	defer perf.Unlock()
+	perf.since = time.Now()
+	perf.endpoints = make(map[string]*perfHistogram)
+	perf.slowest = nil
+	perf.queries = make(map[string]*queryStats)
+}
+
+// percentile returns the upper bound, in milliseconds, of the bucket
+// in which the given fraction of requests fall. If it is the last
+// bucket, which has no upper bound, the slowest request is given.
+func (h *perfHistogram) percentile(q float64) float64 {
+	target := uint64(q*float64(h.Count) + 0.5)
+	if target == 0 {
+		target = 1
+	}
+	var n uint64
+	for i, count := range h.Counts {
+		n += count
+		if n >= target {
+			if i < len(perfBuckets) && perfBuckets[i] < h.Max {
+				return milliseconds(perfBuckets[i])
+			}
+			break
+		}
+	}
+	return milliseconds(h.Max)
+}
+
+// milliseconds returns the duration as a number of milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// rate returns n as a fraction of total, or zero if total is zero.
+func rate(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// endpointsBySlowest sorts endpoints by their 95th percentile
+// latencies, slowest first, then by name.
+type endpointsBySlowest []*EndpointPerf
+
+func (e endpointsBySlowest) Len() int      { return len(e) }
+func (e endpointsBySlowest) Swap(a, b int) { e[a], e[b] = e[b], e[a] }
+func (e endpointsBySlowest) Less(a, b int) bool {
+	if e[a].P95 != e[b].P95 {
+		return e[a].P95 > e[b].P95
+	}
+	return e[a].Endpoint < e[b].Endpoint
+}
+
+// PerfRecorder wraps a handler and records the latency and status of
+// every request it serves. See RecordRequest.
+type PerfRecorder struct {
+	Handler http.Handler
+}
+
+func (p *PerfRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	p.Handler.ServeHTTP(sw, r)
+	RecordRequest(r, sw.status, time.Since(start))
+}
+
+// statusWriter records the status written to a http.ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap returns the underlying http.ResponseWriter, so that
+// http.ResponseController can reach it.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush passes flushes on, so that streamed responses, such as gRPC,
+// are not held back.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// HandleAdminPerf serves "<prefix>/api/admin/perf", which summarizes
+// the latencies and error rates of every endpoint, and the slowest
+// requests, and to which a DELETE resets them. Only admins may use it.
+func HandleAdminPerf(w http.ResponseWriter, req *http.Request) {
+	resp := new(apiResponse)
+	status := http.StatusOK
+
+	switch {
+	case !IsAdmin(req):
+		status, resp.Error = http.StatusForbidden, "notAdmin"
+	case req.Method == "GET" || req.Method == "HEAD":
+		resp.Data = Perf()
+	case req.Method == "DELETE":
+		ResetPerf()
+		resp.Data = "successful"
+		l.Noticef("Performance statistics reset by %q\n", req.RemoteAddr)
+	default:
+		status, resp.Error = http.StatusMethodNotAllowed,
+			http.StatusText(http.StatusMethodNotAllowed)
+	}
+
+	writeAPIResponse(w, status, resp)
+}
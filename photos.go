@@ -0,0 +1,559 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"html"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultPhotoMaxBytes is the default maximum size of an uploaded
+	// photo. See Conf.Photos.MaxBytes.
+	DefaultPhotoMaxBytes = 5 << 20 // 5 MiB
+
+	// DefaultThumbnailSize is the default maximum width and height of
+	// photo thumbnails, in pixels.
+	DefaultThumbnailSize = 256
+
+	// MaxPhotoPixels is the largest number of pixels that an uploaded
+	// photo may have, so that small files which decode to enormous
+	// images are rejected before they are decoded.
+	MaxPhotoPixels = 50000000
+
+	// MaxPhotosPerNode is the largest number of photos which may be
+	// attached to a single node.
+	MaxPhotosPerNode = 20
+)
+
+// PhotoIDRegexp matches valid photo IDs.
+var PhotoIDRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// photoTypes maps the accepted content types of photos to the file
+// extensions with which they are stored.
+var photoTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// Photo is an image attached to a local node by its owner, such as
+// the view from its roof or its mounted hardware.
+type Photo struct {
+	ID      string
+	Caption string `json:",omitempty"`
+
+	// Type is the content type of the original image.
+	Type string `json:"-"`
+
+	Uploaded time.Time
+
+	// URL and ThumbnailURL are the paths at which the photo and its
+	// thumbnail are served. They are set by SetURLs.
+	URL, ThumbnailURL string
+}
+
+// objectName returns the name under which the original photo is
+// stored.
+func (p *Photo) objectName() string {
+	return "photos/" + p.ID + photoTypes[p.Type]
+}
+
+// thumbnailName returns the name under which the photo's thumbnail is
+// stored.
+func (p *Photo) thumbnailName() string {
+	return "photos/" + p.ID + ".thumb.jpg"
+}
+
+// SetURLs sets the URL and ThumbnailURL of the photo, which belongs
+// to the node with the given address.
+func (p *Photo) SetURLs(addr IP) {
+	base := path.Join("/", Conf.Web.Prefix, "api", "nodes", addr.String(),
+		"photos")
+	p.URL = base + "/" + path.Base(p.objectName())
+	p.ThumbnailURL = base + "/" + path.Base(p.thumbnailName())
+}
+
+// PhotoStorage returns the Storage in which photos are kept, as
+// configured by Conf.Photos.Storage.
+func PhotoStorage() (Storage, error) {
+	return NewStorage(Conf.Photos.Storage)
+}
+
+// AddPhoto records a photo of the node with the given address.
+func (db DB) AddPhoto(addr IP, p *Photo) (err error) {
+	_, err = db.Exec(`INSERT INTO photos
+(id, address, type, caption, uploaded)
+VALUES(?, ?, ?, ?, ?);`, p.ID, []byte(addr), p.Type, p.Caption,
+		p.Uploaded.Unix())
+	return
+}
+
+// Photos returns the photos of the node with the given address,
+// oldest first, with their URLs set.
+func (db DB) Photos(addr IP) (photos []*Photo, err error) {
+	rows, err := db.Query(`SELECT id,type,caption,uploaded
+FROM photos
+WHERE address = ?
+ORDER BY uploaded;`, []byte(addr))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	photos = make([]*Photo, 0)
+	for rows.Next() {
+		p := new(Photo)
+		var caption sql.NullString
+		var uploaded int64
+		if err = rows.Scan(&p.ID, &p.Type, &caption, &uploaded); err != nil {
+			return
+		}
+		p.Caption = caption.String
+		p.Uploaded = time.Unix(uploaded, 0)
+		p.SetURLs(addr)
+		photos = append(photos, p)
+	}
+	return photos, rows.Err()
+}
+
+// GetPhoto returns the photo of the node with the given address which
+// has the given ID. If there is none, both return values are nil.
+func (db DB) GetPhoto(addr IP, id string) (p *Photo, err error) {
+	p = &Photo{ID: id}
+	var caption sql.NullString
+	var uploaded int64
+	err = db.QueryRow(`SELECT type,caption,uploaded
+FROM photos
+WHERE address = ? AND id = ?;`, []byte(addr), id).Scan(
+		&p.Type, &caption, &uploaded)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	p.Caption = caption.String
+	p.Uploaded = time.Unix(uploaded, 0)
+	p.SetURLs(addr)
+	return
+}
+
+// DeletePhoto removes the record of the given photo.
+func (db DB) DeletePhoto(id string) (err error) {
+	_, err = db.Exec(`DELETE FROM photos
+WHERE id = ?;`, id)
+	return
+}
+
+// RemovePhoto deletes the photo and its thumbnail from storage, and
+// then removes its record.
+func RemovePhoto(p *Photo) (err error) {
+	storage, err := PhotoStorage()
+	if err != nil {
+		return
+	}
+	if err = storage.Delete(p.objectName()); err != nil {
+		return
+	}
+	if err = storage.Delete(p.thumbnailName()); err != nil {
+		return
+	}
+	return Db.DeletePhoto(p.ID)
+}
+
+// RemoveNodePhotos removes every photo of the node with the given
+// address, such as when it is deleted. Errors are logged.
+func RemoveNodePhotos(addr IP) {
+	photos, err := Db.Photos(addr)
+	if err != nil {
+		dbLog.Errf("Error listing photos of %q: %s", addr, err)
+		return
+	}
+	for _, p := range photos {
+		if err = RemovePhoto(p); err != nil {
+			l.Errf("Error removing photo %q of %q: %s", p.ID, addr, err)
+		}
+	}
+}
+
+// Thumbnail returns a copy of the image scaled down, preserving its
+// aspect ratio, so that neither its width nor height exceed size.
+// Each pixel is the average of the pixels it covers, composited onto
+// white, so that transparent images can be encoded as JPEG.
+func Thumbnail(src image.Image, size int) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, h*size/w
+		} else {
+			w, h = w*size/h, size
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg),
+						bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			// The colors are premultiplied by alpha, so adding the
+			// remaining coverage composites them onto white.
+			bg := 0xffff - a/n
+			dst.Set(x, y, color.RGBA64{
+				uint16(r/n + bg), uint16(g/n + bg), uint16(bl/n + bg),
+				0xffff,
+			})
+		}
+	}
+	return dst
+}
+
+// newPhotoID returns a random photo ID.
+func newPhotoID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// checkPhotoAuth reports whether the request may change the photos of
+// the given node, which it may if it comes from the node's owner (see
+// IsNodeOwner) and has a valid token. Otherwise, it writes an error.
+func checkPhotoAuth(w http.ResponseWriter, r *http.Request, node *Node) bool {
+	if Db.ReadOnly {
+		httpError(w, ReadOnlyError)
+		return false
+	}
+	token, err := strconv.ParseUint(r.FormValue("token"), 10, 32)
+	if err != nil || !CheckToken(r.RemoteAddr, uint32(token)) {
+		http.Error(w, "tokenInvalid", http.StatusBadRequest)
+		return false
+	}
+	if !IsNodeOwner(r, node.Addr) {
+		http.Error(w, RemoteAddressDoesNotMatchError.Error(),
+			http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// HandleNodePhotos serves "<prefix>/api/nodes/<addr>/photos". A GET
+// request lists the node's photos as JSON, and a POST request uploads
+// a new one from the multipart form file "photo", with an optional
+// "caption". Uploads require a token, and must come from the node
+// itself or an admin.
+func HandleNodePhotos(w http.ResponseWriter, r *http.Request, addr IP) {
+	db := Db.WithContext(r.Context())
+	node, err := db.GetLocalNode(addr)
+	if err == LocalNodeNotFoundError {
+		// Photos can only be attached to local nodes.
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		l.Errf("Error getting node %q: %s", addr, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	node.Addr = addr
+
+	switch r.Method {
+	case "GET", "HEAD":
+		photos, err := db.Photos(addr)
+		if err != nil {
+			dbLog.Request(r).Errf("Error listing photos of %q: %s", addr, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(photos)
+	case "POST":
+		uploadPhoto(w, r, node)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+	}
+}
+
+// uploadPhoto validates the photo uploaded in the request, stores it
+// and its thumbnail, and responds with the new Photo as JSON.
+func uploadPhoto(w http.ResponseWriter, r *http.Request, node *Node) {
+	db := Db.WithContext(r.Context())
+	if _, err := PhotoStorage(); err != nil {
+		http.Error(w, "photosDisabled", http.StatusNotImplemented)
+		return
+	}
+	if !parsePhotoForm(w, r, 1) || !checkPhotoAuth(w, r, node) {
+		return
+	}
+	caption := r.FormValue("caption")
+	if len(caption) > 255 {
+		http.Error(w, "captionTooLong", http.StatusBadRequest)
+		return
+	}
+
+	f, _, err := r.FormFile("photo")
+	if err != nil {
+		http.Error(w, "photoMissing", http.StatusBadRequest)
+		return
+	}
+	p, data, img, ok := readPhoto(w, f, caption)
+	if !ok {
+		return
+	}
+
+	photos, err := db.Photos(node.Addr)
+	if err != nil {
+		dbLog.Request(r).Errf("Error listing photos of %q: %s", node.Addr, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	} else if len(photos) >= MaxPhotosPerNode {
+		http.Error(w, "tooManyPhotos", http.StatusBadRequest)
+		return
+	}
+
+	err = storePhoto(p, data, img)
+	if err == nil {
+		if err = db.AddPhoto(node.Addr, p); err != nil {
+			deleteStoredPhoto(p)
+		}
+	}
+	if err != nil {
+		l.Errf("Error storing photo of %q: %s", node.Addr, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	p.SetURLs(node.Addr)
+	l.Infof("%q added photo %q to %q\n", r.RemoteAddr, p.ID, node.Addr)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
+
+// photoBodyLimit returns the largest size of the body of a request
+// which uploads up to the given number of photos, allowing some room
+// for the rest of the form.
+func photoBodyLimit(photos int) int64 {
+	maxBytes := Conf.Photos.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultPhotoMaxBytes
+	}
+	return int64(photos)*maxBytes + 1<<16
+}
+
+// parsePhotoForm parses the multipart form of a request which uploads
+// up to the given number of photos. If the request is too large, it
+// writes an error and returns false.
+func parsePhotoForm(w http.ResponseWriter, r *http.Request, photos int) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, photoBodyLimit(photos))
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		http.Error(w, "photoTooLarge", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	return true
+}
+
+// readPhoto reads and validates an uploaded photo, and returns a new
+// Photo with the given caption, its data, and the decoded image. If it
+// is not a valid photo, it writes an error and returns false.
+func readPhoto(w http.ResponseWriter, f multipart.File, caption string) (p *Photo, data []byte, img image.Image, ok bool) {
+	defer f.Close()
+	maxBytes := Conf.Photos.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultPhotoMaxBytes
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxBytes+1))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest),
+			http.StatusBadRequest)
+		return
+	} else if int64(len(data)) > maxBytes {
+		http.Error(w, "photoTooLarge", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Check the type from the data itself, rather than trusting the
+	// client, and check the dimensions before decoding the image.
+	p = &Photo{
+		Type:     http.DetectContentType(data),
+		Caption:  html.EscapeString(caption),
+		Uploaded: time.Now(),
+	}
+	if _, ok := photoTypes[p.Type]; !ok {
+		http.Error(w, "photoTypeInvalid", http.StatusUnsupportedMediaType)
+		return nil, nil, nil, false
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, "photoInvalid", http.StatusUnsupportedMediaType)
+		return nil, nil, nil, false
+	} else if config.Width*config.Height > MaxPhotoPixels {
+		http.Error(w, "photoTooLarge", http.StatusRequestEntityTooLarge)
+		return nil, nil, nil, false
+	}
+	if img, _, err = image.Decode(bytes.NewReader(data)); err != nil {
+		http.Error(w, "photoInvalid", http.StatusUnsupportedMediaType)
+		return nil, nil, nil, false
+	}
+	return p, data, img, true
+}
+
+// storePhoto gives the photo an ID, and stores its data and a
+// thumbnail of the image. If either can't be stored, neither is kept.
+func storePhoto(p *Photo, data []byte, img image.Image) (err error) {
+	storage, err := PhotoStorage()
+	if err != nil {
+		return
+	}
+	size := Conf.Photos.ThumbnailSize
+	if size <= 0 {
+		size = DefaultThumbnailSize
+	}
+	thumb := new(bytes.Buffer)
+	err = jpeg.Encode(thumb, Thumbnail(img, size), &jpeg.Options{Quality: 85})
+	if err == nil {
+		p.ID, err = newPhotoID()
+	}
+	if err == nil {
+		err = storage.Put(p.objectName(), p.Type, bytes.NewReader(data))
+	}
+	if err == nil {
+		err = storage.Put(p.thumbnailName(), "image/jpeg", thumb)
+	}
+	if err != nil && len(p.ID) > 0 {
+		deleteStoredPhoto(p)
+	}
+	return
+}
+
+// deleteStoredPhoto deletes the photo and its thumbnail from storage,
+// ignoring errors, such as when its record could not be added.
+func deleteStoredPhoto(p *Photo) {
+	if storage, err := PhotoStorage(); err == nil {
+		storage.Delete(p.objectName())
+		storage.Delete(p.thumbnailName())
+	}
+}
+
+// HandleNodePhoto serves "<prefix>/api/nodes/<addr>/photos/<file>",
+// where the file is "<id>.<ext>" for the original photo, or
+// "<id>.thumb.jpg" for its thumbnail. A DELETE request removes the
+// photo, and has the same requirements as uploading one.
+func HandleNodePhoto(w http.ResponseWriter, r *http.Request, addr IP) {
+	db := Db.WithContext(r.Context())
+	file := path.Base(r.URL.Path)
+	id := file
+	if i := strings.Index(file, "."); i >= 0 {
+		id = file[:i]
+	}
+	if !PhotoIDRegexp.MatchString(id) {
+		http.NotFound(w, r)
+		return
+	}
+	p, err := db.GetPhoto(addr, id)
+	if err != nil {
+		dbLog.Request(r).Errf("Error getting photo %q: %s", id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	} else if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		if !checkPhotoAuth(w, r, &Node{Addr: addr}) {
+			return
+		}
+		if err = RemovePhoto(p); err != nil {
+			l.Errf("Error removing photo %q of %q: %s", id, addr, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
+		l.Infof("%q removed photo %q from %q\n", r.RemoteAddr, id, addr)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	servePhoto(w, r, p, file)
+}
+
+// servePhoto serves the stored file of the photo with the given name,
+// which is that of either the original photo or its thumbnail.
+func servePhoto(w http.ResponseWriter, r *http.Request, p *Photo, file string) {
+	var name string
+	switch file {
+	case path.Base(p.objectName()):
+		name = p.objectName()
+	case path.Base(p.thumbnailName()):
+		name = p.thumbnailName()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	storage, err := PhotoStorage()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	obj, err := storage.Get(name)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		l.Errf("Error reading photo %q: %s", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	defer obj.Close()
+
+	// Photos never change once uploaded, so they can be cached for a
+	// long time.
+	w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(name)))
+	w.Header().Set("Cache-Control", "max-age=604800")
+	io.Copy(w, obj)
+}
@@ -0,0 +1,153 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultSQLiteBusyTimeout is the default length of time for
+	// which sqlite3 waits for a locked database. See
+	// Conf.Database.SQLite.BusyTimeout.
+	DefaultSQLiteBusyTimeout = 5 * time.Second
+
+	// sqlitePragmaDriver is the name under which pragmaDriver is
+	// registered.
+	sqlitePragmaDriver = "sqlite3+pragmas"
+)
+
+// sqliteJournalModes are the valid values of
+// Conf.Database.SQLite.JournalMode.
+var sqliteJournalModes = []string{
+	"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF",
+}
+
+// pragmaDriver wraps a driver, and executes the given pragmas on each
+// new connection, because settings such as busy_timeout apply only
+// to the connection on which they are made, and database/sql makes
+// connections as it needs them.
+type pragmaDriver struct {
+	driver.Driver
+	pragmas []string
+}
+
+func (d *pragmaDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, pragma := range d.pragmas {
+		stmt, err := c.Prepare(pragma)
+		if err == nil {
+			_, err = stmt.Exec(nil)
+			stmt.Close()
+		}
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("%s: %s", pragma, err)
+		}
+	}
+	return c, nil
+}
+
+// sqlitePragmas returns the pragmas to execute on every connection to
+// a sqlite3 database, as configured in Conf.Database.SQLite.
+func sqlitePragmas() (pragmas []string, err error) {
+	conf := Conf.Database.SQLite
+	if len(conf.JournalMode) > 0 {
+		mode := strings.ToUpper(conf.JournalMode)
+		valid := false
+		for _, m := range sqliteJournalModes {
+			valid = valid || m == mode
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid journal mode %q",
+				conf.JournalMode)
+		}
+		pragmas = append(pragmas, "PRAGMA journal_mode = "+mode+";")
+	}
+
+	timeout := time.Duration(conf.BusyTimeout)
+	if timeout <= 0 {
+		timeout = DefaultSQLiteBusyTimeout
+	}
+	pragmas = append(pragmas, fmt.Sprintf("PRAGMA busy_timeout = %d;",
+		timeout/time.Millisecond))
+
+	if conf.ForeignKeys {
+		pragmas = append(pragmas, "PRAGMA foreign_keys = ON;")
+	}
+	return
+}
+
+// OpenDatabase opens the database described by Conf.Database. For
+// sqlite3, the configured pragmas are executed on every connection.
+// Every query is timed by an instrumentedDriver. The connection pool
+// is then limited as configured.
+func OpenDatabase() (db *sql.DB, err error) {
+	return openDatabase(Conf.Database.Resource)
+}
+
+// OpenReplica opens the read replica at Conf.Database.ReplicaResource,
+// as OpenDatabase does. If it is not set, it returns nil.
+func OpenReplica() (db *sql.DB, err error) {
+	if len(Conf.Database.ReplicaResource) == 0 {
+		return nil, nil
+	}
+	return openDatabase(Conf.Database.ReplicaResource)
+}
+
+// pragmaDriverRegistered is set once pragmaDriver is registered, since
+// it can only be registered once.
+var pragmaDriverRegistered bool
+
+// openDatabase opens the given resource with Conf.Database.DriverName,
+// as OpenDatabase describes.
+func openDatabase(resource string) (db *sql.DB, err error) {
+	conf := Conf.Database
+	driverName := conf.DriverName
+	if driverName == "sqlite3" {
+		var pragmas []string
+		if pragmas, err = sqlitePragmas(); err != nil {
+			return
+		}
+
+		// sql.Open does not connect, so this only retrieves the
+		// driver to be wrapped.
+		if !pragmaDriverRegistered {
+			if db, err = sql.Open(driverName, resource); err != nil {
+				return
+			}
+			sql.Register(sqlitePragmaDriver,
+				&pragmaDriver{Driver: db.Driver(), pragmas: pragmas})
+			db.Close()
+			pragmaDriverRegistered = true
+		}
+		driverName = sqlitePragmaDriver
+	}
+
+	// Time every query, so that slow ones are logged.
+	if driverName, err = instrumentDriver(driverName); err != nil {
+		return
+	}
+
+	if db, err = sql.Open(driverName, resource); err != nil {
+		return
+	}
+	if conf.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(conf.MaxOpenConns)
+	}
+	if conf.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(conf.MaxIdleConns)
+	}
+	if conf.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(time.Duration(conf.ConnMaxLifetime))
+	}
+	return
+}
@@ -0,0 +1,145 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var ProtobufInvalidError = errors.New("protobuf: invalid data")
+
+// Wire types of protocol buffer fields which are used.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// ProtoWriter encodes a protocol buffer message, one field at a time,
+// as described in federation.proto. Fields with zero values are
+// omitted, as in proto3.
+type ProtoWriter struct {
+	buf []byte
+}
+
+// Bytes returns the encoded message.
+func (w *ProtoWriter) Bytes() []byte {
+	return w.buf
+}
+
+func (w *ProtoWriter) varint(v uint64) {
+	for v >= 0x80 {
+		w.buf = append(w.buf, byte(v)|0x80)
+		v >>= 7
+	}
+	w.buf = append(w.buf, byte(v))
+}
+
+func (w *ProtoWriter) tag(field, wire int) {
+	w.varint(uint64(field)<<3 | uint64(wire))
+}
+
+// Uint writes a uint32 or uint64 field.
+func (w *ProtoWriter) Uint(field int, v uint64) {
+	if v != 0 {
+		w.tag(field, protoVarint)
+		w.varint(v)
+	}
+}
+
+// Int writes an int32 or int64 field.
+func (w *ProtoWriter) Int(field int, v int64) {
+	w.Uint(field, uint64(v))
+}
+
+// Bool writes a bool field.
+func (w *ProtoWriter) Bool(field int, v bool) {
+	if v {
+		w.Uint(field, 1)
+	}
+}
+
+// Double writes a double field.
+func (w *ProtoWriter) Double(field int, v float64) {
+	if v != 0 {
+		w.tag(field, protoFixed64)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+		w.buf = append(w.buf, b[:]...)
+	}
+}
+
+// RawBytes writes a bytes field, or an embedded message.
+func (w *ProtoWriter) RawBytes(field int, v []byte) {
+	if len(v) > 0 {
+		w.tag(field, protoBytes)
+		w.varint(uint64(len(v)))
+		w.buf = append(w.buf, v...)
+	}
+}
+
+// String writes a string field.
+func (w *ProtoWriter) String(field int, v string) {
+	w.RawBytes(field, []byte(v))
+}
+
+// ProtoField is a single decoded field. For varint and fixed fields,
+// Value is set, and for length-delimited fields, Data is.
+type ProtoField struct {
+	Number int
+	Wire   int
+	Value  uint64
+	Data   []byte
+}
+
+// Double returns the value of a double field.
+func (f *ProtoField) Double() float64 {
+	return math.Float64frombits(f.Value)
+}
+
+// ProtoDecode decodes every field of the message, in order, and calls
+// fn with each. Unknown fields can be ignored by fn. If fn returns an
+// error, decoding stops and it is returned.
+func ProtoDecode(b []byte, fn func(f *ProtoField) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return ProtobufInvalidError
+		}
+		b = b[n:]
+		f := &ProtoField{Number: int(key >> 3), Wire: int(key & 7)}
+		switch f.Wire {
+		case protoVarint:
+			if f.Value, n = binary.Uvarint(b); n <= 0 {
+				return ProtobufInvalidError
+			}
+			b = b[n:]
+		case protoFixed64:
+			if len(b) < 8 {
+				return ProtobufInvalidError
+			}
+			f.Value, b = binary.LittleEndian.Uint64(b), b[8:]
+		case protoFixed32:
+			if len(b) < 4 {
+				return ProtobufInvalidError
+			}
+			f.Value, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case protoBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return ProtobufInvalidError
+			}
+			f.Data, b = b[n:n+int(length)], b[n+int(length):]
+		default:
+			return ProtobufInvalidError
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
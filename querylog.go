@@ -0,0 +1,375 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultSlowQuery is the length of time after which a query is
+	// logged as slow, if Conf.Database.SlowQuery is not set.
+	DefaultSlowQuery = 500 * time.Millisecond
+
+	// instrumentedDriverSuffix is appended to the name of a driver to
+	// name the instrumentedDriver which wraps it.
+	instrumentedDriverSuffix = "+instrumented"
+
+	// queryLogMax and queryArgMax are the numbers of characters of a
+	// statement, and of a string parameter, which are logged.
+	queryLogMax = 300
+	queryArgMax = 32
+)
+
+var TxOptionsUnsupportedError = errors.New(
+	"driver does not support transaction options")
+
+// queryStats are the number of times a statement has been executed,
+// and how long it took.
+type queryStats struct {
+	Count uint64
+	Total time.Duration
+	Max   time.Duration
+}
+
+// QueryPerf summarizes the durations, in milliseconds, of the
+// executions of a statement.
+type QueryPerf struct {
+	Statement string
+	Count     uint64
+	Total     float64
+	Mean      float64
+	Max       float64
+}
+
+// instrumentedDrivers are the names of the drivers which have been
+// wrapped with an instrumentedDriver, since each can only be
+// registered once.
+var instrumentedDrivers = make(map[string]bool)
+
+// instrumentDriver registers an instrumentedDriver which wraps the
+// named driver, if there is not one already, and returns its name.
+func instrumentDriver(driverName string) (string, error) {
+	name := driverName + instrumentedDriverSuffix
+	if instrumentedDrivers[name] {
+		return name, nil
+	}
+	// sql.Open does not connect, so this only retrieves the driver
+	// to be wrapped.
+	db, err := sql.Open(driverName, "")
+	if err != nil {
+		return "", err
+	}
+	sql.Register(name, &instrumentedDriver{db.Driver()})
+	db.Close()
+	instrumentedDrivers[name] = true
+	return name, nil
+}
+
+// recordQuery adds an execution of the query to its statistics, and
+// logs it, with its parameters, if it took at least
+// Conf.Database.SlowQuery, or DefaultSlowQuery. The ID of the request
+// which made it is logged, if the context has one.
+func recordQuery(ctx context.Context, query string, args []driver.NamedValue, duration time.Duration) {
+	statement := strings.Join(strings.Fields(query), " ")
+
+	perf.Lock()
+	q, ok := perf.queries[statement]
+	if !ok {
+		if len(perf.queries) >= perfMaxEndpoints {
+			statement = perfOtherEndpoint
+			q = perf.queries[statement]
+		}
+		if q == nil {
+			q = new(queryStats)
+			perf.queries[statement] = q
+		}
+	}
+	q.Count++
+	q.Total += duration
+	if duration > q.Max {
+		q.Max = duration
+	}
+	perf.Unlock()
+
+	threshold := time.Duration(Conf.Database.SlowQuery)
+	if threshold == 0 {
+		threshold = DefaultSlowQuery
+	}
+	if threshold < 0 || duration < threshold {
+		return
+	}
+	logger := dbLog.With("duration", milliseconds(duration))
+	if id := requestIDFromContext(ctx); len(id) > 0 {
+		logger = logger.With("request", id)
+	}
+	if len(statement) > queryLogMax {
+		statement = statement[:queryLogMax] + "..."
+	}
+	logger.Warningf("Slow query took %s: %s %s\n",
+		duration.Round(time.Millisecond), statement, formatQueryArgs(args))
+}
+
+// formatQueryArgs returns the parameters of a query as they are
+// logged. Numbers are rounded, so that coordinates are only given to
+// within about a hundred meters, and long strings are shortened, so
+// that the log does not hold more of the database than it needs to.
+func formatQueryArgs(args []driver.NamedValue) string {
+	values := make([]string, len(args))
+	for i, arg := range args {
+		switch v := arg.Value.(type) {
+		case float64:
+			values[i] = strconv.FormatFloat(v, 'f', 3, 64)
+		case string:
+			if len(v) > queryArgMax {
+				v = v[:queryArgMax] + "..."
+			}
+			values[i] = strconv.Quote(v)
+		case []byte:
+			values[i] = fmt.Sprintf("<%d bytes>", len(v))
+		case time.Time:
+			values[i] = v.Format(time.RFC3339)
+		case nil:
+			values[i] = "NULL"
+		default:
+			values[i] = fmt.Sprint(v)
+		}
+	}
+	return "[" + strings.Join(values, ", ") + "]"
+}
+
+// namedValues converts the parameters of a query for drivers which
+// don't accept driver.NamedValues.
+func namedValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if len(arg.Name) > 0 {
+			return nil, fmt.Errorf("driver does not support named "+
+				"parameter %q", arg.Name)
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
+
+// instrumentedDriver wraps a driver, and times every query made on its
+// connections, whether through sql.DB, a transaction, or a prepared
+// statement. Queries which return rows are timed until the rows are
+// closed, since drivers such as sqlite3 do most of their work while
+// the rows are read. See recordQuery.
+type instrumentedDriver struct {
+	driver.Driver
+}
+
+func (d *instrumentedDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{c}, nil
+}
+
+// instrumentedConn is a connection of an instrumentedDriver. It
+// passes on the optional interfaces of the connection it wraps, or
+// reports that they are not supported, so that database/sql uses the
+// same fallbacks it would otherwise.
+type instrumentedConn struct {
+	driver.Conn
+}
+
+func (c *instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *instrumentedConn) PrepareContext(ctx context.Context, query string) (stmt driver.Stmt, err error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedStmt{stmt, query}, nil
+}
+
+func (c *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	if opts.Isolation != 0 || opts.ReadOnly {
+		return nil, TxOptionsUnsupportedError
+	}
+	return c.Conn.Begin()
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (res driver.Result, err error) {
+	start := time.Now()
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		res, err = e.ExecContext(ctx, query, args)
+	} else if e, ok := c.Conn.(driver.Execer); ok {
+		var values []driver.Value
+		if values, err = namedValues(args); err != nil {
+			return nil, err
+		}
+		res, err = e.Exec(query, values)
+	} else {
+		return nil, driver.ErrSkip
+	}
+	// If the driver skips, the query is prepared instead, and timed
+	// by instrumentedStmt.
+	if err != driver.ErrSkip {
+		recordQuery(ctx, query, args, time.Since(start))
+	}
+	return
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (rows driver.Rows, err error) {
+	start := time.Now()
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		rows, err = q.QueryContext(ctx, query, args)
+	} else if q, ok := c.Conn.(driver.Queryer); ok {
+		var values []driver.Value
+		if values, err = namedValues(args); err != nil {
+			return nil, err
+		}
+		rows, err = q.Query(query, values)
+	} else {
+		return nil, driver.ErrSkip
+	}
+	if err == driver.ErrSkip {
+		return
+	} else if err != nil {
+		recordQuery(ctx, query, args, time.Since(start))
+		return
+	}
+	return &instrumentedRows{rows, ctx, query, args, start}, nil
+}
+
+func (c *instrumentedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *instrumentedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+// instrumentedStmt is a prepared statement of an instrumentedConn.
+type instrumentedStmt struct {
+	driver.Stmt
+	query string
+}
+
+func (s *instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (res driver.Result, err error) {
+	start := time.Now()
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		res, err = e.ExecContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValues(args); err != nil {
+			return nil, err
+		}
+		res, err = s.Stmt.Exec(values)
+	}
+	recordQuery(ctx, s.query, args, time.Since(start))
+	return
+}
+
+func (s *instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (rows driver.Rows, err error) {
+	start := time.Now()
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = q.QueryContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValues(args); err != nil {
+			return nil, err
+		}
+		rows, err = s.Stmt.Query(values)
+	}
+	if err != nil {
+		recordQuery(ctx, s.query, args, time.Since(start))
+		return nil, err
+	}
+	return &instrumentedRows{rows, ctx, s.query, args, start}, nil
+}
+
+func (s *instrumentedStmt) ColumnConverter(idx int) driver.ValueConverter {
+	if c, ok := s.Stmt.(driver.ColumnConverter); ok {
+		return c.ColumnConverter(idx)
+	}
+	return driver.DefaultParameterConverter
+}
+
+// instrumentedRows are the rows returned by a query, which is recorded
+// once they are closed.
+type instrumentedRows struct {
+	driver.Rows
+	ctx   context.Context
+	query string
+	args  []driver.NamedValue
+	start time.Time
+}
+
+func (r *instrumentedRows) Close() error {
+	err := r.Rows.Close()
+	recordQuery(r.ctx, r.query, r.args, time.Since(r.start))
+	return err
+}
+
+// slowestQueries returns a summary of the statements which have taken
+// the longest in total since the server started, or since ResetPerf,
+// up to the given number, longest first. perf must be locked.
+func slowestQueries(n int) []*QueryPerf {
+	queries := make([]*QueryPerf, 0, len(perf.queries))
+	for statement, q := range perf.queries {
+		queries = append(queries, &QueryPerf{
+			Statement: statement,
+			Count:     q.Count,
+			Total:     milliseconds(q.Total),
+			Mean:      milliseconds(q.Total) / float64(q.Count),
+			Max:       milliseconds(q.Max),
+		})
+	}
+	sort.Sort(queriesByTotal(queries))
+	if len(queries) > n {
+		queries = queries[:n]
+	}
+	return queries
+}
+
+// queriesByTotal sorts statements by the total time they have taken,
+// longest first.
+type queriesByTotal []*QueryPerf
+
+func (q queriesByTotal) Len() int           { return len(q) }
+func (q queriesByTotal) Less(a, b int) bool { return q[a].Total > q[b].Total }
+func (q queriesByTotal) Swap(a, b int)      { q[a], q[b] = q[b], q[a] }
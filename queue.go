@@ -0,0 +1,490 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultQueueAttempts is the default number of times a task is
+	// attempted before it is moved to the dead-letter list. See
+	// Conf.Queue.Attempts.
+	DefaultQueueAttempts = 8
+
+	// DefaultQueueBackoff is the default length of time to wait
+	// before a failed task is first retried. See Conf.Queue.Backoff.
+	DefaultQueueBackoff = 30 * time.Second
+
+	// maxQueueBackoff is the longest that a failed task waits before
+	// it is retried.
+	maxQueueBackoff = 6 * time.Hour
+
+	// queuePollInterval is how often the queue is checked for tasks
+	// which have become due, such as retries.
+	queuePollInterval = 10 * time.Second
+
+	// queueConcurrency is the number of tasks which are run at once.
+	queueConcurrency = 4
+
+	// queueClaimRefresh is how often the claims of running tasks are
+	// renewed, and stale claims of other instances are reclaimed.
+	queueClaimRefresh = time.Minute
+
+	// queueClaimTimeout is how long a claim lasts without being
+	// renewed. Tasks whose claims are older, such as because the
+	// instance running them crashed, are run again.
+	queueClaimTimeout = 5 * queueClaimRefresh
+)
+
+var (
+	UnknownTaskError = errors.New("unknown task")
+)
+
+// Task is a piece of background work, such as sending an email, which
+// is stored in the database until it succeeds, so that it is not lost
+// if it fails or the server restarts. Tasks which fail are retried
+// with exponential backoff, and after Conf.Queue.Attempts, they are
+// moved to the dead-letter list, where an admin can retry or discard
+// them.
+type Task struct {
+	ID int64
+
+	// Kind names the function which performs the task, such as
+	// "email".
+	Kind string
+
+	// State is "pending", "running", or "dead".
+	State    string
+	Attempts int
+
+	// ClaimedBy is the ID of the instance running the task, as given
+	// by InstanceID, if it is running.
+	ClaimedBy string `json:",omitempty"`
+
+	// Error is the error from the last attempt, if any.
+	Error string `json:",omitempty"`
+
+	Created time.Time
+	RunAt   time.Time
+
+	payload []byte
+}
+
+// taskHandlers are the functions which perform tasks, by their kinds.
+// They are given the task's payload as JSON. They are filled in by
+// init, so that the handlers can queue further tasks.
+var taskHandlers map[string]func(payload []byte) error
+
+func init() {
+	taskHandlers = map[string]func(payload []byte) error{
+		"email":             deliverQueuedEmail,
+		"federation.notify": notifyQueuedParent,
+		"job":               runQueuedJob,
+	}
+}
+
+var (
+	// queueWake is signalled when a task is queued, so that it is run
+	// immediately rather than at the next poll.
+	queueWake = make(chan struct{}, 1)
+
+	queueOnce sync.Once
+
+	// queueRunning holds the IDs of the tasks which this instance is
+	// running, whose claims it renews.
+	queueRunning = struct {
+		sync.Mutex
+		ids map[int64]bool
+	}{ids: make(map[int64]bool)}
+)
+
+// Enqueue stores a task of the given kind with the payload, encoded as
+// JSON, and wakes the queue so that it is run as soon as possible. If
+// the database is read-only, the task is run in the background
+// instead, and is not retried.
+func Enqueue(kind string, payload interface{}) (err error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	if Db.ReadOnly {
+		handler, ok := taskHandlers[kind]
+		if !ok {
+			return UnknownTaskError
+		}
+		go func() {
+			if err := handler(data); err != nil {
+				l.Errf("Task %q failed: %s", kind, err)
+			}
+		}()
+		return nil
+	}
+
+	now := time.Now().Unix()
+	_, err = Db.Exec(`INSERT INTO task_queue
+(id, kind, payload, state, attempts, created, run_at)
+VALUES(?, ?, ?, 'pending', 0, ?, ?);`, rand.Int63(), kind, string(data),
+		now, now)
+	if err != nil {
+		return
+	}
+	select {
+	case queueWake <- struct{}{}:
+	default:
+	}
+	return
+}
+
+// StartQueue starts working on the task queue in the background. Tasks
+// which were running on an instance which stopped without finishing
+// them, and so stopped renewing their claims, are run again once their
+// claims are older than queueClaimTimeout. Tasks which are still being
+// run by another instance, or by a previous process during a restart,
+// are left to it.
+func StartQueue() {
+	if Db.ReadOnly {
+		return
+	}
+	queueOnce.Do(func() {
+		go func() {
+			for {
+				Db.renewClaims()
+				Db.reclaimStaleTasks()
+				time.Sleep(queueClaimRefresh)
+			}
+		}()
+		go workQueue()
+	})
+}
+
+// renewClaims renews the claims of the tasks which this instance is
+// running. Errors are logged.
+func (db DB) renewClaims() {
+	queueRunning.Lock()
+	ids := make([]int64, 0, len(queueRunning.ids))
+	for id := range queueRunning.ids {
+		ids = append(ids, id)
+	}
+	queueRunning.Unlock()
+
+	now := time.Now().Unix()
+	for _, id := range ids {
+		_, err := db.Exec(`UPDATE task_queue SET claimed_at = ?
+WHERE id = ? AND state = 'running';`, now, id)
+		if err != nil {
+			dbLog.Errf("Error renewing claim of task %d: %s", id, err)
+		}
+	}
+}
+
+// reclaimStaleTasks returns running tasks whose claims have not been
+// renewed within queueClaimTimeout to the queue, so that they are run
+// again. Errors are logged.
+func (db DB) reclaimStaleTasks() {
+	res, err := db.Exec(`UPDATE task_queue
+SET state = 'pending', claimed_by = '', claimed_at = 0
+WHERE state = 'running' AND claimed_at < ?;`,
+		time.Now().Add(-queueClaimTimeout).Unix())
+	if err != nil {
+		dbLog.Errf("Error reclaiming stale tasks: %s", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		l.Warningf("Reclaimed %d stale tasks\n", n)
+	}
+}
+
+// workQueue runs due tasks until the server stops, waiting between
+// batches until a task is queued or queuePollInterval passes.
+func workQueue() {
+	slots := make(chan struct{}, queueConcurrency)
+	ticker := time.NewTicker(queuePollInterval)
+	for {
+		tasks, err := Db.dueTasks(queueConcurrency)
+		if err != nil {
+			dbLog.Errf("Error reading task queue: %s", err)
+		}
+		for _, task := range tasks {
+			if !Db.claimTask(task.ID) {
+				continue
+			}
+			slots <- struct{}{}
+			go func(task *Task) {
+				runTask(task)
+				<-slots
+				select {
+				case queueWake <- struct{}{}:
+				default:
+				}
+			}(task)
+		}
+		if len(tasks) == queueConcurrency {
+			// There may be more which are due.
+			continue
+		}
+		select {
+		case <-queueWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// dueTasks returns up to limit pending tasks which are due, oldest
+// first.
+func (db DB) dueTasks(limit int) (tasks []*Task, err error) {
+	rows, err := db.Query(`SELECT id,kind,payload,attempts
+FROM task_queue
+WHERE state = 'pending' AND run_at <= ?
+ORDER BY run_at
+LIMIT ?;`, time.Now().Unix(), limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		task := new(Task)
+		var payload string
+		err = rows.Scan(&task.ID, &task.Kind, &payload, &task.Attempts)
+		if err != nil {
+			return
+		}
+		task.payload = []byte(payload)
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+// claimTask marks the pending task as running by this instance, and
+// reports whether it was still pending, so that it is not run twice.
+// The claim is renewed by renewClaims until the task is finished.
+func (db DB) claimTask(id int64) bool {
+	res, err := db.Exec(`UPDATE task_queue
+SET state = 'running', claimed_by = ?, claimed_at = ?
+WHERE id = ? AND state = 'pending';`, InstanceID(), time.Now().Unix(), id)
+	if err != nil {
+		dbLog.Errf("Error claiming task %d: %s", id, err)
+		return false
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return false
+	}
+	queueRunning.Lock()
+	queueRunning.ids[id] = true
+	queueRunning.Unlock()
+	return true
+}
+
+// runTask performs the claimed task. If it succeeds, it is removed
+// from the queue. Otherwise, it is scheduled to be retried after a
+// backoff which doubles with each attempt, or moved to the dead-letter
+// list if it has been attempted Conf.Queue.Attempts times.
+func runTask(task *Task) {
+	defer func() {
+		queueRunning.Lock()
+		delete(queueRunning.ids, task.ID)
+		queueRunning.Unlock()
+	}()
+
+	err := UnknownTaskError
+	if handler, ok := taskHandlers[task.Kind]; ok {
+		err = handler(task.payload)
+	}
+	if err == nil {
+		if _, err = Db.Exec(`DELETE FROM task_queue
+WHERE id = ?;`, task.ID); err != nil {
+			dbLog.Errf("Error removing task %d: %s", task.ID, err)
+		}
+		return
+	} else if serverContext.Err() != nil {
+		// The task was interrupted by shutting down, so it is
+		// released to be run again, without counting this attempt.
+		_, err = Db.Exec(`UPDATE task_queue
+SET state = 'pending', claimed_by = '', claimed_at = 0
+WHERE id = ? AND state = 'running';`, task.ID)
+		if err != nil {
+			dbLog.Errf("Error releasing task %d: %s", task.ID, err)
+		}
+		return
+	}
+
+	attempts := Conf.Queue.Attempts
+	if attempts <= 0 {
+		attempts = DefaultQueueAttempts
+	}
+	backoff := time.Duration(Conf.Queue.Backoff)
+	if backoff <= 0 {
+		backoff = DefaultQueueBackoff
+	}
+
+	task.Attempts++
+	state, runAt := "pending", time.Now()
+	if task.Attempts >= attempts || err == UnknownTaskError {
+		state = "dead"
+		l.Errf("Task %d (%s) failed for the last time: %s", task.ID,
+			task.Kind, err)
+	} else {
+		for i := 1; i < task.Attempts && backoff < maxQueueBackoff; i++ {
+			backoff *= 2
+		}
+		if backoff > maxQueueBackoff {
+			backoff = maxQueueBackoff
+		}
+		// Vary the backoff, so that tasks which failed together are
+		// not all retried together.
+		backoff += time.Duration(rand.Int63n(int64(backoff)/4 + 1))
+		runAt = runAt.Add(backoff)
+		l.Warningf("Task %d (%s) failed, retrying in %s: %s\n", task.ID,
+			task.Kind, backoff, err)
+	}
+	_, dbErr := Db.Exec(`UPDATE task_queue
+SET state = ?, attempts = ?, run_at = ?, error = ?, claimed_by = '',
+claimed_at = 0
+WHERE id = ?;`, state, task.Attempts, runAt.Unix(), err.Error(), task.ID)
+	if dbErr != nil {
+		dbLog.Errf("Error rescheduling task %d: %s", task.ID, dbErr)
+	}
+}
+
+// Tasks returns the tasks in the queue with the given state, or every
+// task if state is empty, oldest first, without their payloads.
+func (db DB) Tasks(state string) (tasks []*Task, err error) {
+	rows, err := db.Query(`SELECT id,kind,state,attempts,error,created,run_at,
+claimed_by
+FROM task_queue
+WHERE ? = '' OR state = ?
+ORDER BY created;`, state, state)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	tasks = make([]*Task, 0)
+	for rows.Next() {
+		task := new(Task)
+		var taskErr sql.NullString
+		var created, runAt int64
+		err = rows.Scan(&task.ID, &task.Kind, &task.State, &task.Attempts,
+			&taskErr, &created, &runAt, &task.ClaimedBy)
+		if err != nil {
+			return
+		}
+		task.Error = taskErr.String
+		task.Created = time.Unix(created, 0)
+		task.RunAt = time.Unix(runAt, 0)
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+// RetryTask moves the dead task with the given ID back into the queue,
+// with its attempts reset. If there is no such dead task, it returns
+// sql.ErrNoRows.
+func (db DB) RetryTask(id int64) (err error) {
+	res, err := db.Exec(`UPDATE task_queue
+SET state = 'pending', attempts = 0, run_at = ?
+WHERE id = ? AND state = 'dead';`, time.Now().Unix(), id)
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	select {
+	case queueWake <- struct{}{}:
+	default:
+	}
+	return
+}
+
+// DiscardTask removes the task with the given ID from the queue, unless
+// it is running. If there is no such task, it returns sql.ErrNoRows.
+func (db DB) DiscardTask(id int64) (err error) {
+	res, err := db.Exec(`DELETE FROM task_queue
+WHERE id = ? AND state <> 'running';`, id)
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return
+}
+
+// HandleAdminQueue serves "<prefix>/api/admin/queue", which lists the
+// tasks in the queue, or only those in the `state` given, and
+// "<prefix>/api/admin/queue/<id>/retry", to which a POST moves a dead
+// task back into the queue. A DELETE request to
+// "<prefix>/api/admin/queue/<id>" discards a task. Only admins may use
+// any of them.
+func HandleAdminQueue(w http.ResponseWriter, req *http.Request) {
+	db := Db.WithContext(req.Context())
+	resp := new(apiResponse)
+	status := http.StatusOK
+
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	i := len(parts) - 1
+	for i >= 0 && parts[i] != "queue" {
+		i--
+	}
+	parts = parts[i+1:]
+
+	var id int64
+	var err error
+	if len(parts) > 0 {
+		id, err = strconv.ParseInt(parts[0], 10, 64)
+	}
+
+	switch {
+	case !IsAdmin(req):
+		status, resp.Error = http.StatusForbidden, "notAdmin"
+	case len(parts) == 0 && (req.Method == "GET" || req.Method == "HEAD"):
+		resp.Data, err = db.Tasks(req.FormValue("state"))
+	case err != nil || len(parts) > 2 ||
+		len(parts) == 2 && path.Base(req.URL.Path) != "retry":
+		status, resp.Error = http.StatusNotFound,
+			http.StatusText(http.StatusNotFound)
+		err = nil
+	case Db.ReadOnly:
+		status, resp.Error = errorResponse(ReadOnlyError)
+	case len(parts) == 2 && req.Method == "POST":
+		if err = db.RetryTask(id); err == nil {
+			resp.Data = "retrying"
+		}
+	case len(parts) == 1 && req.Method == "DELETE":
+		if err = db.DiscardTask(id); err == nil {
+			resp.Data = "discarded"
+		}
+	default:
+		status, resp.Error = http.StatusMethodNotAllowed,
+			http.StatusText(http.StatusMethodNotAllowed)
+	}
+
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		status, resp.Data, resp.Error = http.StatusNotFound, nil,
+			"no matching task"
+	default:
+		dbLog.Request(req).Errf("Error managing task queue: %s", err)
+		status, resp.Data, resp.Error = http.StatusInternalServerError,
+			nil, "InternalError"
+	}
+
+	writeAPIResponse(w, status, resp)
+}
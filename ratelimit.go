@@ -0,0 +1,184 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxIdleBuckets is the number of buckets a RateLimiter holds before
+// it discards those which have refilled completely.
+const maxIdleBuckets = 1024
+
+// RateLimiter is a set of token buckets, each identified by a key,
+// such as a client's address. Each bucket holds up to Burst tokens,
+// and is refilled at Rate tokens per second. It is safe for
+// concurrent use.
+//
+// If the RateLimiter has a Name and Redis is enabled, the buckets are
+// kept in Redis under that name, so that the limit is shared by every
+// instance which uses the same Redis. If Redis can't be reached, the
+// buckets in memory are used instead.
+type RateLimiter struct {
+	Name  string
+	Rate  float64
+	Burst float64
+
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter which allows rate events per
+// second with the given burst size.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		Rate:    rate,
+		Burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// NewSharedRateLimiter returns a RateLimiter as NewRateLimiter does,
+// whose buckets are kept in Redis under the given name, if it is
+// enabled.
+func NewSharedRateLimiter(name string, rate float64, burst int) *RateLimiter {
+	rl := NewRateLimiter(rate, burst)
+	rl.Name = name
+	return rl
+}
+
+// take refills the bucket with the given key and removes one token
+// from it, which may leave it with a negative balance. It must be
+// called with the mutex held.
+func (rl *RateLimiter) take(key string, now time.Time) *bucket {
+	b, ok := rl.buckets[key]
+	if !ok {
+		if len(rl.buckets) >= maxIdleBuckets {
+			rl.prune(now)
+		}
+		b = &bucket{tokens: rl.Burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rl.Rate
+	if b.tokens > rl.Burst {
+		b.tokens = rl.Burst
+	}
+	b.last = now
+	b.tokens--
+	return b
+}
+
+// prune removes buckets which would have refilled completely, as they
+// are equivalent to new ones. It must be called with the mutex held.
+func (rl *RateLimiter) prune(now time.Time) {
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.Rate >= rl.Burst {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// Allow reports whether an event identified by the given key may
+// happen now, and if so, counts it.
+func (rl *RateLimiter) Allow(key string) bool {
+	if wait, err := rl.reserveRedis(key, 0); err == nil {
+		return wait == 0
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	b := rl.take(key, time.Now())
+	if b.tokens < 0 {
+		// Refund the token, so that rejected events don't count.
+		b.tokens++
+		return false
+	}
+	return true
+}
+
+// Reserve counts an event identified by the given key, and returns
+// how long the caller must wait before it may happen. If that would
+// be longer than max, the event is not counted, and ok is false.
+func (rl *RateLimiter) Reserve(key string, max time.Duration) (wait time.Duration, ok bool) {
+	if wait, err := rl.reserveRedis(key, max); err == nil {
+		return wait, wait <= max
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	b := rl.take(key, time.Now())
+	if b.tokens >= 0 {
+		return 0, true
+	}
+	wait = time.Duration(-b.tokens / rl.Rate * float64(time.Second))
+	if wait > max {
+		b.tokens++
+		return wait, false
+	}
+	return wait, true
+}
+
+// redisBucketScript takes a token from the bucket at KEYS[1], as
+// RateLimiter.take does, given the rate, burst, current time in
+// seconds, and longest wait in seconds, and returns how long to wait
+// in seconds. If that is longer than the longest wait, the token is
+// refunded. Numbers are returned as strings, because Redis truncates
+// them to integers otherwise. Buckets expire once they would have
+// refilled completely.
+const redisBucketScript = `
+local rate, burst = tonumber(ARGV[1]), tonumber(ARGV[2])
+local now, max = tonumber(ARGV[3]), tonumber(ARGV[4])
+local b = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens = tonumber(b[1]) or burst
+local last = tonumber(b[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate) - 1
+local wait = 0
+if tokens < 0 then
+	wait = -tokens / rate
+end
+if wait > max then
+	tokens = tokens + 1
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "last", tostring(now))
+redis.call("EXPIRE", KEYS[1], math.ceil((burst - tokens) / rate) + 1)
+return tostring(wait)
+`
+
+// reserveRedis takes a token from the bucket with the given key in
+// Redis, as Reserve does, and returns how long the caller must wait.
+// If the RateLimiter has no Name, Redis is not enabled, or there is an
+// error, it returns an error, and the buckets in memory should be used
+// instead. Errors are logged.
+func (rl *RateLimiter) reserveRedis(key string, max time.Duration) (wait time.Duration, err error) {
+	if len(rl.Name) == 0 || !RedisEnabled() {
+		return 0, RedisDisabledError
+	}
+	now := float64(time.Now().UnixNano()) / float64(time.Second)
+	reply, err := RedisDo("EVAL", redisBucketScript, 1,
+		redisKey("ratelimit", rl.Name, key),
+		strconv.FormatFloat(rl.Rate, 'g', -1, 64),
+		strconv.FormatFloat(rl.Burst, 'g', -1, 64),
+		strconv.FormatFloat(now, 'f', 6, 64),
+		strconv.FormatFloat(max.Seconds(), 'g', -1, 64))
+	if err != nil {
+		l.Errf("Error checking rate limit %q in Redis: %s", rl.Name, err)
+		return
+	}
+	s, _ := reply.(string)
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		l.Errf("Error checking rate limit %q in Redis: %s", rl.Name, err)
+		return
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
@@ -0,0 +1,218 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRedisKeyPrefix is prepended to every key if
+	// Conf.Redis.KeyPrefix is not set.
+	DefaultRedisKeyPrefix = "nodeatlas"
+
+	// redisTimeout is the longest that connecting to Redis, or a
+	// single command, may take.
+	redisTimeout = 2 * time.Second
+
+	// redisIdleConns is the number of connections to Redis which are
+	// kept open while idle.
+	redisIdleConns = 8
+)
+
+var (
+	RedisDisabledError = errors.New("redis: not configured")
+	RedisProtocolError = errors.New("redis: malformed reply")
+)
+
+// RedisError is an error reply from Redis, such as "ERR unknown
+// command".
+type RedisError string
+
+func (e RedisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a connection to Redis, with a buffered reader for its
+// replies.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// redisIdle holds connections to Redis which are not in use.
+var redisIdle = make(chan *redisConn, redisIdleConns)
+
+// RedisEnabled reports whether Conf.Redis.Address is set, so that state
+// which must be consistent across several instances, such as rate
+// limits and tokens, is kept in Redis rather than in memory.
+func RedisEnabled() bool {
+	return len(Conf.Redis.Address) > 0
+}
+
+// redisKey returns the key made of the given parts, prefixed with
+// Conf.Redis.KeyPrefix, as in "nodeatlas:tokens:1234".
+func redisKey(parts ...string) string {
+	prefix := Conf.Redis.KeyPrefix
+	if len(prefix) == 0 {
+		prefix = DefaultRedisKeyPrefix
+	}
+	return prefix + ":" + strings.Join(parts, ":")
+}
+
+// RedisDo sends a command with the given arguments to Redis, and
+// returns its reply, which is a string, an int64, a []interface{} of
+// replies, or nil. If Redis replies with an error, it is returned as a
+// RedisError.
+func RedisDo(args ...interface{}) (reply interface{}, err error) {
+	c, err := getRedisConn()
+	if err != nil {
+		return
+	}
+	c.SetDeadline(time.Now().Add(redisTimeout))
+	if err = writeRedisCommand(c, args); err == nil {
+		reply, err = readRedisReply(c.r)
+	}
+	if _, ok := err.(RedisError); err != nil && !ok {
+		// The connection can't be trusted after a network or
+		// protocol error.
+		c.Close()
+		return nil, err
+	}
+	putRedisConn(c)
+	return
+}
+
+// getRedisConn returns an idle connection to Redis, or dials a new
+// one, authenticating and selecting Conf.Redis.DB as necessary.
+func getRedisConn() (c *redisConn, err error) {
+	select {
+	case c = <-redisIdle:
+		return c, nil
+	default:
+	}
+
+	var conn net.Conn
+	if Conf.Redis.TLS {
+		dialer := &net.Dialer{Timeout: redisTimeout}
+		conn, err = tls.DialWithDialer(dialer, "tcp", Conf.Redis.Address,
+			nil)
+	} else {
+		conn, err = net.DialTimeout("tcp", Conf.Redis.Address, redisTimeout)
+	}
+	if err != nil {
+		return
+	}
+	c = &redisConn{conn, bufio.NewReader(conn)}
+
+	setup := make([][]interface{}, 0, 2)
+	if len(Conf.Redis.Password) > 0 {
+		setup = append(setup, []interface{}{"AUTH", Conf.Redis.Password})
+	}
+	if Conf.Redis.DB != 0 {
+		setup = append(setup, []interface{}{"SELECT", Conf.Redis.DB})
+	}
+	c.SetDeadline(time.Now().Add(redisTimeout))
+	for _, args := range setup {
+		if err = writeRedisCommand(c, args); err == nil {
+			_, err = readRedisReply(c.r)
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// putRedisConn returns the connection to the idle pool, or closes it
+// if the pool is full.
+func putRedisConn(c *redisConn) {
+	c.SetDeadline(time.Time{})
+	select {
+	case redisIdle <- c:
+	default:
+		c.Close()
+	}
+}
+
+// writeRedisCommand writes the arguments as an array of bulk strings.
+// Arguments which are not strings or []byte are formatted with
+// fmt.Sprint.
+func writeRedisCommand(w io.Writer, args []interface{}) error {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var b []byte
+		switch arg := arg.(type) {
+		case string:
+			b = []byte(arg)
+		case []byte:
+			b = arg
+		default:
+			b = []byte(fmt.Sprint(arg))
+		}
+		fmt.Fprintf(buf, "$%d\r\n", len(b))
+		buf.Write(b)
+		buf.WriteString("\r\n")
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readRedisReply reads a single reply, as described by RedisDo.
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, RedisProtocolError
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, RedisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err = io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		replies := make([]interface{}, n)
+		for i := range replies {
+			if replies[i], err = readRedisReply(r); err != nil {
+				if _, ok := err.(RedisError); !ok {
+					return nil, err
+				}
+				replies[i] = err
+			}
+		}
+		return replies, nil
+	}
+	return nil, RedisProtocolError
+}
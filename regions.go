@@ -0,0 +1,192 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// RegionsFile is the name of the file in the res directory from which
+// regions are loaded, if it exists.
+const RegionsFile = "regions.geojson"
+
+// Regions are the named areas, such as boroughs or districts, into
+// which nodes are grouped for statistics. They are loaded from
+// RegionsFile by LoadRegions.
+var Regions []*Region
+
+// Region is a named area made up of one or more polygons.
+type Region struct {
+	Name string
+
+	// Polygons is a list of polygons, each of which is a list of
+	// rings of [longitude, latitude] points, as in GeoJSON. The first
+	// ring is the outer boundary, and any others are holes.
+	Polygons [][][][2]float64
+
+	bounds Bounds
+}
+
+// Contains reports whether the given point is within the region.
+func (r *Region) Contains(lat, lon float64) bool {
+	return r.bounds.Contains(lat, lon) &&
+		polygonsContain(r.Polygons, lat, lon)
+}
+
+// polygonsContain reports whether the given point is within any of the
+// polygons, and not within one of its holes.
+func polygonsContain(polygons [][][][2]float64, lat, lon float64) bool {
+	for _, polygon := range polygons {
+		if len(polygon) == 0 || !ringContains(polygon[0], lat, lon) {
+			continue
+		}
+		inHole := false
+		for _, hole := range polygon[1:] {
+			if ringContains(hole, lat, lon) {
+				inHole = true
+				break
+			}
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
+
+// ringContains reports whether the given point is within the ring,
+// using the even-odd rule.
+func ringContains(ring [][2]float64, lat, lon float64) (inside bool) {
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a[1] > lat) != (b[1] > lat) &&
+			lon < (b[0]-a[0])*(lat-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return
+}
+
+// RegionOf returns the first region which contains the given point,
+// or nil if there is none.
+func RegionOf(lat, lon float64) *Region {
+	for _, r := range Regions {
+		if r.Contains(lat, lon) {
+			return r
+		}
+	}
+	return nil
+}
+
+// LoadRegions reads regions from a GeoJSON FeatureCollection of
+// Polygon and MultiPolygon features, each of which must have a "name"
+// property. Features with other geometries are ignored.
+func LoadRegions(path string) (regions []*Region, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var collection struct {
+		Features []struct {
+			Properties map[string]interface{}
+			Geometry   struct {
+				Type        string
+				Coordinates json.RawMessage
+			}
+		}
+	}
+	if err = json.NewDecoder(f).Decode(&collection); err != nil {
+		return
+	}
+
+	regions = make([]*Region, 0, len(collection.Features))
+	for i, feature := range collection.Features {
+		name, _ := feature.Properties["name"].(string)
+		if len(name) == 0 {
+			return nil, fmt.Errorf("region %d has no name", i)
+		}
+		r := &Region{Name: name}
+		r.Polygons, err = parsePolygons(feature.Geometry.Type,
+			feature.Geometry.Coordinates)
+		if err == NotPolygonError {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("region %q: %s", name, err)
+		}
+
+		// Find the bounding box, so that most points can be ruled out
+		// without checking every edge.
+		r.bounds = polygonBounds(r.Polygons)
+		regions = append(regions, r)
+	}
+	return
+}
+
+// NotPolygonError is returned by parsePolygons for geometries which
+// are neither a Polygon nor a MultiPolygon.
+var NotPolygonError = errors.New("geometry is not a Polygon or MultiPolygon")
+
+// parsePolygons reads the coordinates of a GeoJSON geometry of the
+// given type, which must be "Polygon" or "MultiPolygon", as a list of
+// polygons.
+func parsePolygons(typ string, coordinates json.RawMessage) (polygons [][][][2]float64, err error) {
+	switch typ {
+	case "Polygon":
+		var polygon [][][2]float64
+		err = json.Unmarshal(coordinates, &polygon)
+		polygons = [][][][2]float64{polygon}
+	case "MultiPolygon":
+		err = json.Unmarshal(coordinates, &polygons)
+	default:
+		return nil, NotPolygonError
+	}
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// polygonBounds returns the smallest Bounds which contains the outer
+// rings of all of the polygons.
+func polygonBounds(polygons [][][][2]float64) Bounds {
+	b := Bounds{
+		MinLat: math.Inf(1), MinLon: math.Inf(1),
+		MaxLat: math.Inf(-1), MaxLon: math.Inf(-1),
+	}
+	for _, polygon := range polygons {
+		if len(polygon) == 0 {
+			continue
+		}
+		for _, p := range polygon[0] {
+			b.MinLon = math.Min(b.MinLon, p[0])
+			b.MaxLon = math.Max(b.MaxLon, p[0])
+			b.MinLat = math.Min(b.MinLat, p[1])
+			b.MaxLat = math.Max(b.MaxLat, p[1])
+		}
+	}
+	return b
+}
+
+// ReloadRegions loads Regions from RegionsFile in the given res
+// directory. If the file does not exist, there are no regions. Errors
+// are logged, and the previous regions are kept.
+func ReloadRegions(res string) {
+	regions, err := LoadRegions(filepath.Join(res, RegionsFile))
+	if os.IsNotExist(err) {
+		Regions = nil
+		return
+	} else if err != nil {
+		l.Errf("Could not load regions: %s", err)
+		return
+	}
+	Regions = regions
+	l.Debugf("Loaded %d regions\n", len(regions))
+}
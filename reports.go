@@ -0,0 +1,173 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"github.com/coocood/jas"
+	"math"
+	"sort"
+)
+
+const (
+	// DefaultInterferenceDistance is the distance in meters within
+	// which radios on overlapping channels are reported as likely to
+	// interfere, if no `distance` is given.
+	DefaultInterferenceDistance = 3000
+
+	// DefaultBeamwidth is the beamwidth in degrees assumed of
+	// directional radios whose beamwidth is not known.
+	DefaultBeamwidth = 60
+)
+
+// Reports is the JAS resource which serves reports for planning the
+// network, at "/api/reports/<name>".
+type Reports struct{}
+
+// ChannelRadio is a radio in a channel report, with the location of
+// its node.
+type ChannelRadio struct {
+	*Interface
+	Latitude, Longitude float64
+}
+
+// ChannelConflict is a pair of radios on nearby nodes which transmit on
+// overlapping channels, and each of which points toward the other.
+type ChannelConflict struct {
+	A, B *ChannelRadio
+
+	// Distance is the distance in meters between the nodes.
+	Distance float64
+
+	// Adjacent is true if the radios' channels overlap, but are not
+	// the same.
+	Adjacent bool
+}
+
+// channelsOverlap reports whether two radios in the same band transmit
+// on overlapping channels, and whether they differ. Channels in the
+// 2.4GHz band, numbered 1 through 14, are 5MHz apart but 20MHz wide, so
+// they overlap those fewer than five away. Other channels are assumed
+// not to overlap.
+func channelsOverlap(a, b int) (overlap, adjacent bool) {
+	if a == b {
+		return true, false
+	}
+	if a <= 14 && b <= 14 {
+		d := a - b
+		if d < 0 {
+			d = -d
+		}
+		return d < 5, true
+	}
+	return false, false
+}
+
+// facing reports whether the radio's beam covers the given bearing in
+// degrees. Omnidirectional radios face every way.
+func (r *ChannelRadio) facing(bearing float64) bool {
+	if r.Azimuth == nil {
+		return true
+	}
+	width := r.Beamwidth
+	if width <= 0 {
+		width = DefaultBeamwidth
+	}
+	diff := math.Abs(math.Mod(bearing-*r.Azimuth+540, 360) - 180)
+	return diff <= width/2
+}
+
+// ChannelConflicts returns every pair of radios on different local
+// nodes within the given distance in meters of each other which share
+// a band and transmit on overlapping channels, and which point toward
+// each other, closest first. Radios whose channel is not known are
+// ignored.
+func (db DB) ChannelConflicts(distance float64) (conflicts []*ChannelConflict, err error) {
+	interfaces, err := db.ListInterfaces(nil)
+	if err != nil {
+		return
+	}
+	nodes, err := db.DumpLocal()
+	if err != nil {
+		return
+	}
+	locations := make(map[string]*Node, len(nodes))
+	for _, n := range nodes {
+		if n != nil {
+			locations[n.Addr.String()] = n
+		}
+	}
+
+	radios := make([]*ChannelRadio, 0, len(interfaces))
+	for _, i := range interfaces {
+		node := locations[i.Addr.String()]
+		if i.Kind != "radio" || i.Channel == 0 || node == nil {
+			continue
+		}
+		radios = append(radios, &ChannelRadio{
+			Interface: i,
+			Latitude:  node.Latitude,
+			Longitude: node.Longitude,
+		})
+	}
+
+	conflicts = make([]*ChannelConflict, 0)
+	for x, a := range radios {
+		for _, b := range radios[x+1:] {
+			if a.Addr.String() == b.Addr.String() || a.Band != b.Band {
+				continue
+			}
+			overlap, adjacent := channelsOverlap(a.Channel, b.Channel)
+			if !overlap {
+				continue
+			}
+			d := Distance(a.Latitude, a.Longitude, b.Latitude, b.Longitude)
+			if d > distance ||
+				!a.facing(Bearing(a.Latitude, a.Longitude,
+					b.Latitude, b.Longitude)) ||
+				!b.facing(Bearing(b.Latitude, b.Longitude,
+					a.Latitude, a.Longitude)) {
+				continue
+			}
+			conflicts = append(conflicts, &ChannelConflict{
+				A:        a,
+				B:        b,
+				Distance: d,
+				Adjacent: adjacent,
+			})
+		}
+	}
+	sort.Sort(channelConflicts(conflicts))
+	return
+}
+
+// channelConflicts sorts ChannelConflicts by distance, closest first.
+type channelConflicts []*ChannelConflict
+
+func (c channelConflicts) Len() int           { return len(c) }
+func (c channelConflicts) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c channelConflicts) Less(i, j int) bool { return c[i].Distance < c[j].Distance }
+
+// GetChannels responds with the pairs of radios on local nodes which
+// are likely to interfere with each other, because they are within
+// `distance` meters, or DefaultInterferenceDistance, share a band,
+// transmit on overlapping channels, and point toward each other, so
+// that volunteers can pick channels for new sectors which avoid them.
+func (*Reports) GetChannels(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	distance := float64(DefaultInterferenceDistance)
+	if d, err := ctx.FindFloat("distance"); err == nil {
+		if d <= 0 {
+			ctx.Error = jas.NewRequestError("distanceInvalid")
+			return
+		}
+		distance = d
+	}
+	var err error
+	ctx.Data, err = db.ChannelConflicts(distance)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error finding channel conflicts: %s",
+			err)
+	}
+}
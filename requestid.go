@@ -0,0 +1,88 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+)
+
+// RequestIDHeader is the header field in which the ID of a request is
+// given in its response, and accepted from clients, such as other
+// maps and proxies, which have already given the request an ID.
+const RequestIDHeader = "X-Request-Id"
+
+// requestIDRegexp matches the request IDs which are accepted from
+// clients, so that they can't inject anything into the logs.
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestIDKey is the key of the request ID in the context of a
+// request.
+type requestIDKey struct{}
+
+// NewRequestID returns a new random request ID of 16 hexadecimal
+// digits.
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RequestID returns the ID of the request, as given by RequestTracer,
+// or an empty string if it has none.
+func RequestID(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	return requestIDFromContext(r.Context())
+}
+
+// requestIDFromContext returns the ID of the request to which the
+// context belongs, or an empty string if it has none.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestTracer wraps a handler and gives every request an ID, so that
+// every log line about the request, and the requests made to other
+// maps on its behalf, can be found by it. The ID is taken from the
+// RequestIDHeader of the request, if it has a valid one, or generated.
+// It is given in the same header of the response.
+type RequestTracer struct {
+	Handler http.Handler
+}
+
+func (t *RequestTracer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(RequestIDHeader)
+	if !requestIDRegexp.MatchString(id) {
+		id = NewRequestID()
+	}
+	w.Header().Set(RequestIDHeader, id)
+	t.Handler.ServeHTTP(w, r.WithContext(withRequestID(r.Context(), id)))
+}
+
+// withRequestID returns a copy of ctx which carries the given request
+// ID, such as for work done on behalf of a request in the background.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// newTracedRequest returns a GET request for the URL, made within ctx,
+// which carries the ID of the request to which ctx belongs, if any, so
+// that the map which serves it logs the same ID.
+func newTracedRequest(ctx context.Context,
+	url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if requestID := requestIDFromContext(ctx); len(requestID) > 0 {
+		req.Header.Set(RequestIDHeader, requestID)
+	}
+	return req, nil
+}
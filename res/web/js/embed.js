@@ -0,0 +1,114 @@
+// embed.js powers the lightweight, iframe-friendly map at /embed/. It
+// is configured by query parameters, any of which may be omitted:
+//
+//     lat, lon  the coordinates on which to center the map
+//     zoom      the initial zoom level
+//     status    a comma-separated list of statuses to show, from
+//               active, planned, physical, virtual, internet,
+//               wireless, and wired
+//     theme     "light" (the default) or "dark"
+//
+// For example, /embed/?lat=40.7&lon=-74&zoom=12&status=active&theme=dark
+
+var STATUS_FILTERS = {
+    "active": function(s) { return (s & STATUS_ACTIVE) != 0; },
+    "planned": function(s) { return (s & STATUS_ACTIVE) == 0; },
+    "physical": function(s) { return (s & STATUS_PHYSICAL) != 0; },
+    "virtual": function(s) { return (s & STATUS_PHYSICAL) == 0; },
+    "internet": function(s) { return (s & STATUS_INTERNET) != 0; },
+    "wireless": function(s) { return (s & STATUS_WIRELESS) != 0; },
+    "wired": function(s) { return (s & STATUS_WIRED) != 0; }
+};
+
+function getParams() {
+    var params = {};
+    var pairs = window.location.search.slice(1).split('&');
+    for (var i in pairs) {
+	var pair = pairs[i].split('=');
+	if (pair[0].length > 0) {
+	    params[decodeURIComponent(pair[0])] =
+		decodeURIComponent(pair.slice(1).join('=').replace(/\+/g, ' '));
+	}
+    }
+    return params;
+}
+
+// getStatusFilter returns a function which reports whether a node
+// with the given status should be shown. Every listed status must
+// match.
+function getStatusFilter(param) {
+    var filters = [];
+    if (param) {
+	var names = param.split(',');
+	for (var i in names) {
+	    if (STATUS_FILTERS[names[i]]) {
+		filters.push(STATUS_FILTERS[names[i]]);
+	    }
+	}
+    }
+    return function(status) {
+	for (var i in filters) {
+	    if (!filters[i](status)) return false;
+	}
+	return true;
+    };
+}
+
+function escapeHTML(s) {
+    return $('<div/>').text(s).html();
+}
+
+function embedMarker(feature, latlng) {
+    var icon;
+    if (feature.properties.Status & STATUS_ACTIVE) {
+	icon = (feature.properties.Status & STATUS_PHYSICAL) ?
+	    activeNodeIcon : VPSIcon;
+    } else {
+	icon = inactiveNodeIcon;
+    }
+
+    // Links open in a new window, rather than inside the iframe.
+    var html = '<b>' + feature.properties.OwnerName + '</b><br/>';
+    if (feature.properties.Details) {
+	html += feature.properties.Details + '<br/>';
+    }
+    html += '<a href="/node/' + escapeHTML(feature.id) +
+	'" target="_blank">' + escapeHTML(feature.id) + '</a>';
+
+    return L.marker(latlng, {icon: icon}).bindPopup(html);
+}
+
+$(document).ready(function() {
+    var params = getParams();
+    if (params.theme == 'dark') {
+	$('body').addClass('dark');
+    }
+
+    var lat = parseFloat(params.lat), lon = parseFloat(params.lon);
+    var zoom = parseInt(params.zoom, 10);
+    var map = new L.Map('map', {
+	center: new L.LatLng(isNaN(lat) ? options.latitude : lat,
+			     isNaN(lon) ? options.longitude : lon),
+	zoom: isNaN(zoom) ? options.zoom : zoom,
+	maxZoom: 16,
+	minZoom: 2,
+	layers: [L.tileLayer(options.tileserver,
+			     {attribution: options.attribution})]
+    });
+
+    var cluster = new L.MarkerClusterGroup({
+	showCoverageOnHover: false,
+	maxClusterRadius: options.clusterRadius
+    });
+    map.addLayer(cluster);
+
+    var show = getStatusFilter(params.status);
+    $.getJSON('/api/all?geojson', function(response) {
+	L.geoJson(response.data, {
+	    filter: function(feature) {
+		return show(feature.properties.Status);
+	    },
+	    pointToLayer: embedMarker
+	}).addTo(cluster);
+    });
+});
@@ -4,7 +4,8 @@ var statuses = [];
 function addNodes() {
     $.ajax({
 	type: "GET",
-	url: "/api/all?geojson",
+	// An empty map selects the main map, rather than every map.
+	url: "/api/all?geojson&map=" + encodeURIComponent(mapID),
 	dataType:"json",
 	success: addLayers
     });
@@ -204,8 +205,8 @@ function createMarker(feature, latlng) {
     var html = '<div class="node">';
     html +=  '<h4>'+feature.properties.OwnerName+'</h4><h4>';
     if (feature.properties.SourceID) {
-	html += '<a href="'+cachedMaps[feature.properties.SourceID].hostname+'/node/'+feature.id+'" class="btn btn-mini btn-info" id="sendMessage">Message</a>';
-	html += '&nbsp;<a href="'+cachedMaps[feature.properties.SourceID].hostname+'/node/'+feature.id+'" class="btn btn-mini btn-success" id="edit">Edit</a>';
+	html += '<a href="'+cachedMaps[feature.properties.SourceID].hostname+'/node/'+feature.id+'/map" class="btn btn-mini btn-info" id="sendMessage">Message</a>';
+	html += '&nbsp;<a href="'+cachedMaps[feature.properties.SourceID].hostname+'/node/'+feature.id+'/map" class="btn btn-mini btn-success" id="edit">Edit</a>';
     } else {
 	html += '<button class="btn btn-mini btn-info" id="sendMessage">Message</button>';
         html += '&nbsp;<button class="btn btn-mini btn-success" id="edit">Edit</button>';
@@ -256,4 +257,134 @@ function createMarker(feature, latlng) {
     }
 
     return m;
-}
\ No newline at end of file
+}
+// addConnectionRequests shows open connection requests on the map,
+// each as a dashed line from the prospective member to the node they
+// would like to connect to. Only admins are allowed to see them, so
+// for everyone else, the request fails and nothing is shown.
+function addConnectionRequests() {
+    $.getJSON("/api/connection_requests", function(response) {
+	if (response.error != null || response.data == null) return;
+	var requests = L.layerGroup();
+	for (var i = 0; i < response.data.length; i++) {
+	    var r = response.data[i];
+	    var from = new L.LatLng(r.Latitude, r.Longitude);
+	    var to = new L.LatLng(r.TargetLatitude, r.TargetLongitude);
+	    L.polyline([from, to], {
+		color: '#f0ad4e', dashArray: '5, 5', weight: 2
+	    }).addTo(requests);
+	    L.circleMarker(from, {color: '#f0ad4e', radius: 6})
+		.bindPopup('<strong>' + r.Name + '</strong><br>' +
+			   '<a href="mailto:' + r.Email + '">' + r.Email +
+			   '</a><br>' + (r.Contact || '') +
+			   '<p>' + (r.Message || '') + '</p>' +
+			   'Wants to connect to <a href="/node/' + r.Target +
+			   '">' + r.Target + '</a>')
+		.addTo(requests);
+	}
+	requests.addTo(map);
+    });
+}
+
+// addLinks draws the links between nodes, such as those reported by
+// cjdns or a routing protocol, as lines on the map.
+function addLinks() {
+    $.getJSON("/api/links", function(response) {
+	if (response.error != null || response.data == null) return;
+	var links = L.layerGroup();
+	for (var i = 0; i < response.data.length; i++) {
+	    var link = response.data[i];
+	    L.polyline([
+		new L.LatLng(link.SourceLatitude, link.SourceLongitude),
+		new L.LatLng(link.TargetLatitude, link.TargetLongitude)
+	    ], {
+		color: '#5bc0de', weight: 2, opacity: 0.7
+	    }).bindPopup('<a href="/node/' + link.Source + '">' + link.Source +
+			 '</a><br>to <a href="/node/' + link.Target + '">' +
+			 link.Target + '</a><br>' + link.Origin +
+			 (link.Metric ? ' (' + link.Metric + ')' : ''))
+		.addTo(links);
+	}
+	links.addTo(map);
+    });
+}
+
+// addSurveys shows the survey points which have not yet become nodes,
+// with their notes, photos, and the nodes which can be seen from them.
+function addSurveys() {
+    $.getJSON("/api/surveys", function(data) {
+	if (data == null) return;
+	var surveys = L.layerGroup();
+	for (var i = 0; i < data.length; i++) {
+	    var s = data[i];
+	    var html = '<strong>Site survey</strong>' +
+		(s.Name ? ' by ' + s.Name : '') +
+		'<p>' + (s.Notes || '') + '</p>';
+	    for (var j = 0; j < s.Photos.length; j++) {
+		var p = s.Photos[j];
+		html += '<a href="' + p.URL + '" target="_blank"><img src="' +
+		    p.ThumbnailURL + '" width="64"></a> ';
+	    }
+	    if (s.Visible.length > 0) {
+		html += '<br>Can see:';
+		for (var j = 0; j < s.Visible.length; j++) {
+		    html += ' <a href="/node/' + s.Visible[j] + '">' +
+			s.Visible[j] + '</a>';
+		}
+	    }
+	    L.circleMarker(new L.LatLng(s.Latitude, s.Longitude), {
+		color: '#9b59b6', radius: 6
+	    }).bindPopup(html).addTo(surveys);
+	}
+	surveys.addTo(map);
+    });
+}
+
+// addCoverage shades the areas which supernodes can plausibly reach,
+// so that prospective members can see whether their roof is covered.
+function addCoverage() {
+    $.getJSON("/api/coverage", function(response) {
+	if (response.error != null || response.data == null) return;
+	L.geoJson(response.data, {
+	    style: function(feature) {
+		return {
+		    color: '#5cb85c', weight: 1, fillOpacity: 0.15,
+		    dashArray: feature.properties.Source == 'estimated' ?
+			'4, 4' : null
+		};
+	    },
+	    onEachFeature: function(feature, layer) {
+		var addr = feature.properties.Address;
+		layer.bindPopup('Coverage of <a href="/node/' + addr + '">' +
+				addr + '</a> (' + feature.properties.Source +
+				')');
+	    }
+	}).addTo(map);
+    });
+}
+
+// addInterest shows admins where visitors have asked for a node, as
+// circles sized by the number of interest points in each area. For
+// everyone else, the request fails and nothing is shown.
+function addInterest() {
+    var interest = L.layerGroup().addTo(map);
+    var update = function() {
+	$.getJSON("/api/heatmap", {
+	    layer: "interest",
+	    bbox: map.getBounds().toBBoxString(),
+	    zoom: map.getZoom()
+	}, function(response) {
+	    if (response.error != null || response.data == null) return;
+	    interest.clearLayers();
+	    var cells = response.data.Cells;
+	    for (var i = 0; i < cells.length; i++) {
+		L.circleMarker(new L.LatLng(cells[i][0], cells[i][1]), {
+		    color: '#d9534f', weight: 1,
+		    radius: 4 + 12 * cells[i][2] / response.data.Max
+		}).bindPopup(cells[i][2] + ' interested').addTo(interest);
+	    }
+	});
+    };
+    map.on('moveend', update);
+    update();
+}
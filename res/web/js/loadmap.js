@@ -59,6 +59,11 @@ function loadChildMaps() {
 	    }
 	}
 	addNodes();
+	addLinks();
+	addConnectionRequests();
+	addSurveys();
+	addCoverage();
+	addInterest();
     });
 }
 
@@ -57,6 +57,7 @@ function insertUser() {
 		'contact': $("#contact").val(),
 		'details': $("#details").val(),
 		'pgp': $("#pgp").val(),
+		'map': mapID,
 		'token': token.data
 	    };
 	    $.ajax({
@@ -34,7 +34,7 @@ function matchNode(node, search) {
 function matchAddr(node, search) {
     var match = search.indexOf(node.id) > -1;
     if (match) {
-	window.location = '/node/' + node.id;
+	window.location = '/node/' + node.id + '/map';
     }
     return match ? 1.0 : 0.0;
 }
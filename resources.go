@@ -0,0 +1,88 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// NodeResourceHandler serves a resource belonging to a single node,
+// such as its QR code. The address has been parsed from the path, but
+// has not been checked against the database.
+type NodeResourceHandler func(w http.ResponseWriter, r *http.Request,
+	addr IP)
+
+// Resources maps the names of resources which are not JSON, and so
+// are not served through JAS, to their handlers. They are served at
+// "<prefix>/api/<name>". A name ending in a slash, such as
+// "grafana/", handles every path beneath it.
+var Resources = map[string]http.HandlerFunc{
+	"map.png":      HandleMapImage,
+	"installs.ics": HandleInstallsICS,
+	"planned.ics":  HandlePlannedICS,
+	"grafana/":     HandleGrafana,
+	"check":        HandleCheck,
+	"export/zone":  HandleZoneExport,
+
+	"export.ndjson":         HandleNDJSONExport,
+	"export/inventory":      HandleInventoryExport,
+	"export/contacts.vcf":   HandleContactsExport,
+	"meshviewer/nodes.json": HandleMeshviewerNodes,
+	"meshviewer/graph.json": HandleMeshviewerGraph,
+	"surveys":               HandleSurveys,
+	"surveys/":              HandleSurvey,
+}
+
+// NodeResources maps the names of per-node resources, which are
+// served at "<prefix>/api/nodes/<addr>/<name>", to their handlers. The
+// node itself is served at "<prefix>/api/nodes/<addr>" by the handler
+// named "".
+// Resources which are not JSON, such as images, are served this way,
+// rather than through JAS. A name ending in a slash, such as
+// "photos/", handles every path beneath it.
+var NodeResources = map[string]NodeResourceHandler{
+	"":        HandleNodeResource,
+	"qr.png":  HandleNodeQR,
+	"photos":  HandleNodePhotos,
+	"photos/": HandleNodePhoto,
+	"metrics": HandleNodeMetrics,
+	"feed":    HandleNodeFeed,
+}
+
+// RegisterResources invokes http.Handle() for every handler in
+// Resources, and with a handler which dispatches requests for
+// "<prefix>/api/nodes/<addr>/<name>" to the appropriate handler in
+// NodeResources.
+func RegisterResources(prefix string) {
+	for name, handler := range Resources {
+		pattern := path.Join("/", prefix, "api", name)
+		if strings.HasSuffix(name, "/") {
+			pattern += "/"
+		}
+		http.HandleFunc(pattern, handler)
+	}
+
+	base := path.Join("/", prefix, "api", "nodes") + "/"
+	http.HandleFunc(base, func(w http.ResponseWriter, r *http.Request) {
+		// The node itself is served as the resource named "".
+		parts := strings.SplitN(
+			strings.TrimPrefix(r.URL.Path, base), "/", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+
+		handler, ok := NodeResources[parts[1]]
+		if i := strings.Index(parts[1], "/"); !ok && i >= 0 {
+			handler, ok = NodeResources[parts[1][:i+1]]
+		}
+		ip := ParseIP(parts[0])
+		if !ok || ip == nil {
+			http.NotFound(w, r)
+			return
+		}
+		handler(w, r, ip)
+	})
+}
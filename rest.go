@@ -0,0 +1,78 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// nodeMethods maps the methods which HandleNodeResource accepts to
+// the endpoints of the API which serve them.
+var nodeMethods = map[string]string{
+	"GET":    "node",
+	"HEAD":   "node",
+	"PUT":    "update_node",
+	"PATCH":  "patch_node",
+	"DELETE": "delete_node",
+}
+
+// nodeMethodsAllowed is the Allow header of HandleNodeResource, which
+// lists the methods in nodeMethods.
+const nodeMethodsAllowed = "GET, HEAD, PUT, PATCH, DELETE"
+
+// HandleNodeResource serves "<prefix>/api/nodes/<addr>", at which a GET
+// retrieves the node, a PUT replaces it, a PATCH changes only the
+// fields which are given, and a DELETE removes it. Each is passed on
+// to the form-style endpoint which does the same, such as
+// "<prefix>/api/patch_node", with the address from the path, so that
+// they take the same fields, and respond in the same way and with the
+// same statuses. A version given by an If-Match header is used as the
+// `version` of PUTs and PATCHes.
+func HandleNodeResource(w http.ResponseWriter, r *http.Request,
+	addr IP) {
+	endpoint, ok := nodeMethods[r.Method]
+	if !ok {
+		w.Header().Set("Allow", nodeMethodsAllowed)
+		writeAPIResponse(w, http.StatusMethodNotAllowed, &apiResponse{
+			Error: http.StatusText(http.StatusMethodNotAllowed),
+		})
+		return
+	}
+
+	// Form values in the body are only parsed for POSTs, PUTs, and
+	// PATCHes, so those of a DELETE must be in the query.
+	r.ParseForm()
+	form := make(url.Values, len(r.Form)+2)
+	for name, values := range r.Form {
+		form[name] = values
+	}
+	form.Set("address", addr.String())
+	if match := r.Header.Get("If-Match"); len(match) > 0 {
+		version := strings.Trim(strings.TrimPrefix(match, "W/"), `"`)
+		if _, err := strconv.ParseInt(version, 10, 64); err == nil {
+			form.Set("version", version)
+		}
+	}
+
+	req := r.Clone(r.Context())
+	req.URL = &url.URL{
+		Path: path.Join("/", Conf.Web.Prefix, "api", endpoint),
+	}
+	req.Form, req.PostForm = nil, nil
+	if r.Method == "GET" || r.Method == "HEAD" {
+		req.URL.RawQuery = form.Encode()
+	} else {
+		body := form.Encode()
+		req.Method = "POST"
+		req.Body = ioutil.NopCloser(strings.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	apiRouter.ServeHTTP(w, req)
+}
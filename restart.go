@@ -0,0 +1,203 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultShutdownTimeout is the longest that in-flight requests
+	// are waited for when shutting down or restarting, if
+	// Conf.Web.ShutdownTimeout is not set.
+	DefaultShutdownTimeout = 30 * time.Second
+
+	// restartReadyTimeout is the longest that a new process is waited
+	// for to start serving, when restarting, before giving up and
+	// continuing to serve.
+	restartReadyTimeout = time.Minute
+
+	// listenFDsEnv and readyFDEnv name the environment variables
+	// which tell a new process the number of listeners it inherits,
+	// starting at file descriptor 3, and the descriptor to write to
+	// once it is serving.
+	listenFDsEnv = "NODEATLAS_LISTEN_FDS"
+	readyFDEnv   = "NODEATLAS_READY_FD"
+)
+
+var (
+	RestartFailedError  = errors.New("new process exited before serving")
+	RestartTimeoutError = errors.New("new process did not start serving in time")
+)
+
+// servers are the HTTP servers started by StartServer, so that they
+// can be shut down gracefully.
+var servers []*http.Server
+
+// serverContext is the context from which the contexts of requests
+// are derived, and in which background work, such as updating the
+// cache, is done. It is cancelled by Shutdown, so that work which is
+// still running stops rather than outliving the server.
+var serverContext, cancelServerContext = context.WithCancel(
+	context.Background())
+
+// inheritedListeners returns the listeners which were passed to this
+// process by Restart, in the order of Conf.Web.Addr, or nil if there
+// are none.
+func inheritedListeners() (inherited []net.Listener, err error) {
+	n, _ := strconv.Atoi(os.Getenv(listenFDsEnv))
+	os.Unsetenv(listenFDsEnv)
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(3+i), "listener")
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, listener := range inherited {
+				listener.Close()
+			}
+			return nil, err
+		}
+		inherited = append(inherited, listener)
+	}
+	return
+}
+
+// NotifyReady tells the process which started this one with Restart,
+// if any, that it is serving, so that it can shut down. If systemd
+// started this process with Type=notify, it is told the same, and
+// that this is now the main process of the service.
+func NotifyReady() {
+	if fd, err := strconv.Atoi(os.Getenv(readyFDEnv)); err == nil {
+		os.Unsetenv(readyFDEnv)
+		f := os.NewFile(uintptr(fd), "ready")
+		f.Write([]byte{1})
+		f.Close()
+	}
+
+	if socket := os.Getenv("NOTIFY_SOCKET"); len(socket) > 0 {
+		conn, err := net.Dial("unixgram", socket)
+		if err != nil {
+			l.Errf("Error notifying systemd: %s", err)
+			return
+		}
+		fmt.Fprintf(conn, "MAINPID=%d\nREADY=1\n", os.Getpid())
+		conn.Close()
+	}
+}
+
+// Restart starts a new process of the same executable, with the same
+// arguments and environment, which inherits the listeners of this one
+// and serves on them, so that no connections are refused. It returns
+// once the new process is serving, after which this one should shut
+// down with ShutdownServers, so that in-flight requests finish. If the
+// new process fails to start serving, it is killed, and this process
+// should continue.
+func Restart() (err error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return
+	}
+
+	files := make([]*os.File, 0, len(listeners)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, listener := range listeners {
+		filer, ok := listener.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return fmt.Errorf("can't pass listener on %s",
+				listener.Addr())
+		}
+		f, err := filer.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	defer ready.Close()
+	files = append(files, readyW)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		listenFDsEnv+"="+strconv.Itoa(len(listeners)),
+		readyFDEnv+"="+strconv.Itoa(3+len(listeners)))
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	// Only the new process should hold the write end, so that the
+	// read returns as soon as it writes to it, or exits.
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	// The new process writes to the pipe once it is serving. If it
+	// exits first, the pipe is closed without being written to.
+	done := make(chan int, 1)
+	go func() {
+		n, _ := ready.Read(make([]byte, 1))
+		done <- n
+	}()
+	select {
+	case n := <-done:
+		if n == 0 {
+			cmd.Wait()
+			return RestartFailedError
+		}
+	case <-time.After(restartReadyTimeout):
+		cmd.Process.Kill()
+		return RestartTimeoutError
+	}
+	go cmd.Wait()
+
+	// The new process serves on UNIX sockets now, so they must not
+	// be removed when this process closes its listeners.
+	for _, listener := range listeners {
+		if ul, ok := listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	l.Infof("Restarted as process %d\n", cmd.Process.Pid)
+	return nil
+}
+
+// ShutdownServers stops every HTTP server from accepting connections,
+// and waits up to Conf.Web.ShutdownTimeout, or DefaultShutdownTimeout,
+// for in-flight requests to finish before closing their connections.
+func ShutdownServers() {
+	timeout := time.Duration(Conf.Web.ShutdownTimeout)
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, s := range servers {
+		if err := s.Shutdown(ctx); err != nil {
+			l.Errf("Error shutting down HTTP server: %s", err)
+			s.Close()
+		}
+	}
+	// Close any listeners which were not yet being served.
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"context"
+	"database/sql"
+	"github.com/coocood/jas"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+var (
+	UnknownChildMapError = newAPIError("unknownChildMap",
+		http.StatusNotFound)
+	ChildMapFetchError = newAPIError("fetchFailed",
+		http.StatusBadGateway)
+)
+
+// UncacheChildMap removes every node which was cached from the child
+// map at the given address, whether it is the node's source or the
+// map it was retrieved via.
+func (db DB) UncacheChildMap(address string) (err error) {
+	_, err = db.Exec(`DELETE FROM nodes_cached
+WHERE via = ? OR (via = '' AND source IN
+(SELECT id FROM cached_maps WHERE hostname = ?));`, address, address)
+	InvalidateIndexes()
+	return
+}
+
+// UncacheSource removes every node from the source map at the given
+// address from the cache, and returns the addresses of the child maps
+// from which they were retrieved. If the source is not known, it
+// returns UnknownSourceError.
+func (db DB) UncacheSource(address string) (childMaps []string, err error) {
+	var id int
+	err = db.QueryRow(`SELECT id FROM cached_maps
+WHERE hostname = ?;`, address).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, UnknownSourceError
+	} else if err != nil {
+		return
+	}
+
+	rows, err := db.Query(`SELECT DISTINCT via FROM nodes_cached
+WHERE source = ?;`, id)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var via string
+		if err = rows.Scan(&via); err != nil {
+			rows.Close()
+			return
+		}
+		if len(via) == 0 {
+			via = address
+		}
+		childMaps = append(childMaps, via)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	_, err = db.Exec(`DELETE FROM nodes_cached
+WHERE source = ?;`, id)
+	InvalidateIndexes()
+	return
+}
+
+// RefreshChildMap immediately retrieves the nodes of the child map at
+// the given address, and replaces those which were cached from it
+// before. It returns the number of nodes which are now cached from
+// it. If the child map cannot be retrieved, the nodes cached before
+// are kept, and it returns ChildMapFetchError. The requests and
+// queries are made within ctx.
+func RefreshChildMap(ctx context.Context, address string) (n int, err error) {
+	mapID, ok := childMapOf(address)
+	if !ok {
+		return 0, UnknownChildMapError
+	}
+	db := Db.WithContext(ctx)
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	sourceToID, err := db.GetMapSourceToID()
+	if err != nil {
+		return
+	}
+	nodes := GetAllFromChildMap(ctx, address, &sourceToID,
+		new(sync.RWMutex))
+	if nodes == nil {
+		return 0, ChildMapFetchError
+	}
+	for _, node := range nodes {
+		node.MapID = mapID
+	}
+
+	if err = db.UncacheChildMap(address); err != nil {
+		return
+	}
+	if nodes, err = db.ResolveDuplicates(nodes, mapID); err != nil {
+		return
+	}
+	return len(nodes), db.CacheNodes(nodes)
+}
+
+// lastFetched returns the time of the most recent successful fetch of
+// the child map at the given address, or the zero time if there has
+// been none.
+func (db DB) lastFetched(address string) (t time.Time, err error) {
+	var succeeded int64
+	err = db.QueryRow(`SELECT succeeded FROM map_fetches
+WHERE hostname = ?;`, address).Scan(&succeeded)
+	if err == sql.ErrNoRows || (err == nil && succeeded == 0) {
+		return time.Time{}, nil
+	}
+	return time.Unix(succeeded, 0), err
+}
+
+// UpdateChildMapChanges retrieves only the nodes of the child map at
+// the given address which have changed since it was last retrieved,
+// and caches each with CacheNode, so that a change notification need
+// not cause the whole cache to be updated. Nodes which were removed
+// from the child map remain until the next full update. If the child
+// map has never been retrieved, it is refreshed entirely, as with
+// RefreshChildMap. The requests and queries are made within ctx.
+func UpdateChildMapChanges(ctx context.Context,
+	address string) (n int, err error) {
+	mapID, ok := childMapOf(address)
+	if !ok {
+		return 0, UnknownChildMapError
+	}
+	db := Db.WithContext(ctx)
+	since, err := db.lastFetched(address)
+	if err != nil {
+		return
+	} else if since.IsZero() {
+		return RefreshChildMap(ctx, address)
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	sourceToID, err := db.GetMapSourceToID()
+	if err != nil {
+		return
+	}
+
+	// Allow for the clocks of the two maps to differ.
+	nodes := GetChangesFromChildMap(ctx, address,
+		since.Add(-pushMaxSkew), &sourceToID, new(sync.RWMutex))
+	if nodes == nil {
+		return 0, ChildMapFetchError
+	}
+	for _, node := range nodes {
+		node.MapID = mapID
+	}
+	if nodes, err = db.ResolveDuplicates(nodes, mapID); err != nil {
+		return
+	}
+	for _, node := range nodes {
+		if err = db.CacheNode(node); err != nil {
+			return
+		}
+	}
+	return len(nodes), nil
+}
+
+// RebuildSource removes every node from the source map at the given
+// address from the cache, and then refreshes every child map from
+// which they were retrieved and which are still child maps, as with
+// RefreshChildMap. It returns the number of nodes which are cached
+// from those child maps afterward. The requests and queries are made
+// within ctx.
+func RebuildSource(ctx context.Context, address string) (n int, err error) {
+	cacheMutex.Lock()
+	childMaps, err := Db.WithContext(ctx).UncacheSource(address)
+	cacheMutex.Unlock()
+	if err != nil {
+		return
+	}
+	for _, childMap := range childMaps {
+		var cached int
+		cached, err = RefreshChildMap(ctx, childMap)
+		if err == UnknownChildMapError {
+			continue
+		} else if err != nil {
+			return
+		}
+		n += cached
+	}
+	return n, nil
+}
+
+// HandleAdminFederation serves "<prefix>/api/admin/federation/sync"
+// and ".../rebuild", with which admins can recover from bad updates of
+// the cache without restarting. A POST to sync refreshes the child map
+// at `hostname` immediately, or every child map in the background if
+// none is given, and a POST to rebuild removes the nodes of the source
+// at `hostname` from the cache, and then refreshes the child maps
+// which they came from.
+func HandleAdminFederation(w http.ResponseWriter, req *http.Request) {
+	resp := new(apiResponse)
+	status := http.StatusOK
+	hostname := req.FormValue("hostname")
+
+	var err error
+	switch action := path.Base(req.URL.Path); {
+	case !IsAdmin(req):
+		status, resp.Error = http.StatusForbidden, "notAdmin"
+	case action != "sync" && action != "rebuild":
+		status, resp.Error = http.StatusNotFound, http.StatusText(
+			http.StatusNotFound)
+	case req.Method != "POST":
+		status, resp.Error = http.StatusMethodNotAllowed, http.StatusText(
+			http.StatusMethodNotAllowed)
+	case Db.ReadOnly:
+		status, resp.Error = errorResponse(ReadOnlyError)
+	case action == "sync" && len(hostname) == 0:
+		// The update outlives the request, so it is only cancelled
+		// when the server shuts down.
+		go UpdateMapCache(withRequestID(serverContext, RequestID(req)))
+		resp.Data = "started"
+	case action == "sync":
+		resp.Data, err = RefreshChildMap(req.Context(), hostname)
+	case len(hostname) == 0:
+		status, resp.Error = http.StatusBadRequest, "hostnameInvalid"
+	default:
+		resp.Data, err = RebuildSource(req.Context(), hostname)
+	}
+
+	if err != nil {
+		if _, ok := err.(jas.AppError); !ok {
+			fedLog.Request(req).Errf("Error updating cache from %q: %s",
+				hostname, err)
+		}
+		resp.Data = nil
+		status, resp.Error = errorResponse(err)
+	}
+	if status == http.StatusOK {
+		fedLog.Request(req).Noticef(
+			"Cache update of %q requested by an admin\n",
+			hostname)
+	}
+
+	writeAPIResponse(w, status, resp)
+}
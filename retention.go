@@ -0,0 +1,104 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"time"
+)
+
+// retentionCutoff returns the time before which data kept for the
+// given length of time expires, and false if it is kept forever.
+func retentionCutoff(keep Duration) (time.Time, bool) {
+	if keep <= 0 {
+		return time.Time{}, false
+	}
+	return time.Now().Add(-time.Duration(keep)), true
+}
+
+// DeleteOldAuditLog removes entries in the audit log which are older
+// than the given time, and returns the number removed.
+func (db DB) DeleteOldAuditLog(before time.Time) (n int64, err error) {
+	res, err := db.Exec(`DELETE FROM audit_log
+WHERE time < ?;`, before.Unix())
+	if err != nil {
+		return
+	}
+	return res.RowsAffected()
+}
+
+// DeleteOldStatusHistory removes status changes which are older than
+// the given time, and returns the number removed. Statistics over
+// time only reach as far back as what remains.
+func (db DB) DeleteOldStatusHistory(before time.Time) (n int64, err error) {
+	res, err := db.Exec(`DELETE FROM status_history
+WHERE changed < ?;`, before.Unix())
+	if err != nil {
+		return
+	}
+	return res.RowsAffected()
+}
+
+// DeleteStaleCache removes cached nodes which were last retrieved from
+// their source map before the given time, such as those from sources
+// and child maps which were removed, along with the records of
+// fetches of child maps which have not been attempted since. It
+// returns the number of nodes removed.
+func (db DB) DeleteStaleCache(before time.Time) (n int64, err error) {
+	res, err := db.Exec(`DELETE FROM nodes_cached
+WHERE retrieved < ?;`, before.Unix())
+	if err != nil {
+		return
+	}
+	if n, err = res.RowsAffected(); err != nil {
+		return
+	}
+	if n > 0 {
+		InvalidateIndexes()
+	}
+	_, err = db.Exec(`DELETE FROM map_fetches
+WHERE attempted < ?;`, before.Unix())
+	return
+}
+
+// EnforceRetention removes the history and cached data which are
+// older than allowed by Conf.Retention, so that the database does not
+// grow without bound. If Retention.CachedNodes is not set,
+// CacheExpiration is used instead. Errors are logged.
+func EnforceRetention() {
+	if Db.ReadOnly {
+		return
+	}
+	conf := Conf.Retention
+
+	if before, ok := retentionCutoff(conf.AuditLog); ok {
+		if n, err := Db.DeleteOldAuditLog(before); err != nil {
+			dbLog.Errf("Error removing old audit log entries: %s", err)
+		} else if n > 0 {
+			dbLog.Infof("Removed %d old audit log entries\n", n)
+		}
+	}
+
+	if before, ok := retentionCutoff(conf.StatusHistory); ok {
+		if n, err := Db.DeleteOldStatusHistory(before); err != nil {
+			dbLog.Errf("Error removing old status history: %s", err)
+		} else if n > 0 {
+			dbLog.Infof("Removed %d old status changes\n", n)
+		}
+	}
+
+	keep := conf.CachedNodes
+	if keep <= 0 {
+		keep = Conf.CacheExpiration
+	}
+	if before, ok := retentionCutoff(keep); ok {
+		cacheMutex.Lock()
+		n, err := Db.DeleteStaleCache(before)
+		cacheMutex.Unlock()
+		if err != nil {
+			dbLog.Errf("Error removing stale cached nodes: %s", err)
+		} else if n > 0 {
+			dbLog.Infof("Removed %d stale cached nodes\n", n)
+		}
+	}
+}
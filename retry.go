@@ -0,0 +1,106 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultDatabaseRetries is the default number of times a
+	// modification of the database is retried. See
+	// Conf.Database.Retries.
+	DefaultDatabaseRetries = 5
+
+	// DefaultDatabaseRetryBackoff is the default length of time to
+	// wait before the first retry. See Conf.Database.RetryBackoff.
+	DefaultDatabaseRetryBackoff = 50 * time.Millisecond
+)
+
+// transientErrors are parts of the messages of errors which are caused
+// by contention or a lost connection, rather than by the query, and
+// so may not recur if it is retried.
+var transientErrors = []string{
+	"database is locked",         // SQLITE_BUSY
+	"database table is locked",   // SQLITE_LOCKED
+	"deadlock found",             // MySQL 1213
+	"lock wait timeout exceeded", // MySQL 1205
+	"connection reset",           // ECONNRESET
+	"broken pipe",                // EPIPE
+	"invalid connection",         // go-sql-driver/mysql
+	"server has gone away",       // MySQL 2006
+	"lost connection to mysql",   // MySQL 2013
+}
+
+// IsTransientError returns true if the given error from the database
+// is caused by contention or a lost connection, and the operation
+// which caused it may be retried.
+func IsTransientError(err error) bool {
+	if err == nil {
+		return false
+	} else if err == driver.ErrBadConn {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range transientErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Retry calls fn until it succeeds, it returns an error which is not
+// transient, or it has been retried Conf.Database.Retries times. The
+// wait before each retry is twice as long as the one before, starting
+// from Conf.Database.RetryBackoff, and varied randomly so that
+// contending writers do not retry in step. Errors which persist are
+// logged. fn must be safe to call more than once, such as by making
+// its changes in a single transaction.
+func (db DB) Retry(fn func() error) (err error) {
+	retries := Conf.Database.Retries
+	if retries == 0 {
+		retries = DefaultDatabaseRetries
+	} else if retries < 0 {
+		retries = 0
+	}
+	backoff := time.Duration(Conf.Database.RetryBackoff)
+	if backoff <= 0 {
+		backoff = DefaultDatabaseRetryBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err = fn(); !IsTransientError(err) {
+			return
+		} else if attempt >= retries {
+			break
+		}
+		// Wait between half of and one and a half times the backoff,
+		// unless the work is cancelled first.
+		select {
+		case <-time.After(backoff/2 +
+			time.Duration(rand.Int63n(int64(backoff)))):
+		case <-db.Context().Done():
+			return db.Context().Err()
+		}
+		backoff *= 2
+	}
+	dbLog.Errf("Database still failing after %d retries: %s", retries, err)
+	return
+}
+
+// Exec executes a query which modifies the database, as sql.DB.Exec
+// does, but within the database's Context, and retries it as with
+// Retry if it fails with a transient error.
+func (db DB) Exec(query string, args ...interface{}) (res sql.Result, err error) {
+	err = db.Retry(func() (err error) {
+		res, err = db.DB.ExecContext(db.Context(), query, args...)
+		return
+	})
+	return
+}
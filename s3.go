@@ -0,0 +1,185 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultS3Region is the region used to sign requests if none is
+// configured. MinIO and most other S3-compatible services accept it.
+const DefaultS3Region = "us-east-1"
+
+// s3Client is used to make requests to S3-compatible services.
+var s3Client = &http.Client{Timeout: 60 * time.Second}
+
+// S3Storage stores objects in a bucket of an S3-compatible service,
+// such as Amazon S3 or MinIO, so that they survive the loss of the
+// local disk. Requests are made path-style, as in
+// "<endpoint>/<bucket>/<name>", and signed with AWS Signature Version
+// 4.
+type S3Storage struct {
+	// Endpoint is the base URL of the service, such as
+	// "https://s3.amazonaws.com" or "http://localhost:9000".
+	Endpoint string
+
+	// Region is the region of the bucket. If it is not set,
+	// DefaultS3Region is used.
+	Region string
+
+	Bucket string
+
+	AccessKey, SecretKey string
+}
+
+func (s *S3Storage) Put(name, contentType string, r io.Reader) (err error) {
+	// The payload must be hashed to sign the request, so read it
+	// entirely.
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+	req, err := s.newRequest("PUT", name, data)
+	if err != nil {
+		return
+	}
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	return
+}
+
+func (s *S3Storage) Get(name string) (io.ReadCloser, error) {
+	req, err := s.newRequest("GET", name, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Storage) Delete(name string) (err error) {
+	req, err := s.newRequest("DELETE", name, nil)
+	if err != nil {
+		return
+	}
+	resp, err := s.do(req)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	resp.Body.Close()
+	return
+}
+
+// do performs the request. If the object does not exist, it returns
+// os.ErrNotExist, and for any other unsuccessful response, an error
+// including the response status.
+func (s *S3Storage) do(req *http.Request) (resp *http.Response, err error) {
+	resp, err = s3Client.Do(req)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	return nil, fmt.Errorf("s3 responded %s", resp.Status)
+}
+
+// newRequest creates a signed request for the named object, with the
+// given body, which may be nil.
+func (s *S3Storage) newRequest(method, name string, body []byte) (req *http.Request, err error) {
+	if len(name) == 0 || strings.Contains(name, "..") {
+		return nil, InvalidObjectError
+	}
+	u, err := url.Parse(strings.TrimRight(s.Endpoint, "/") + "/" +
+		s.Bucket + "/" + strings.TrimLeft(name, "/"))
+	if err != nil {
+		return
+	}
+	req, err = http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.ContentLength = int64(len(body))
+	s.sign(req, body, time.Now().UTC())
+	return
+}
+
+// sign adds the headers of AWS Signature Version 4 to the request.
+// Only the host and the x-amz-* headers are signed.
+func (s *S3Storage) sign(req *http.Request, body []byte, now time.Time) {
+	region := s.Region
+	if len(region) == 0 {
+		region = DefaultS3Region
+	}
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		sha256Hex([]byte(canonicalRequest))
+
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+
+		s.AccessKey+"/"+scope+", SignedHeaders="+signedHeaders+
+		", Signature="+signature)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
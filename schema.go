@@ -0,0 +1,276 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"github.com/coocood/jas"
+	"html"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// NodeInput is the kind of a request which creates or changes a node.
+type NodeInput int
+
+const (
+	// NodeCreate requests create nodes, as served by PostNode.
+	NodeCreate NodeInput = iota
+
+	// NodeUpdate requests replace every field of a node, as served
+	// by PostUpdateNode.
+	NodeUpdate
+
+	// NodePatch requests change only the fields which they give, as
+	// served by PostPatchNode. Required fields which are given must
+	// still not be empty.
+	NodePatch
+)
+
+// NodeField describes a field of the requests which create and change
+// nodes. Its errors are named after it, as "<name>Required",
+// "<name>Invalid", and "<name>TooLong".
+type NodeField struct {
+	// Name is the name of the form value.
+	Name string
+
+	// Type is the JSON Schema type of the value, which is "string",
+	// "number", or "integer".
+	Type string
+
+	// Required is true if the field must not be empty, unless the
+	// field named by Unless is given instead.
+	Required bool
+	Unless   string
+
+	// Minimum and Maximum are the bounds of numbers, if they are
+	// not equal.
+	Minimum, Maximum float64
+
+	// MaxLength is the maximum length of strings, if it is not zero.
+	// If Escaped is true, the length is that of the string once it is
+	// HTML-escaped, which is how it is stored.
+	MaxLength int
+	Escaped   bool
+
+	// Pattern, if set, is a regular expression which strings must
+	// match.
+	Pattern *regexp.Regexp
+
+	// valid, if set, reports whether the value can be parsed, beyond
+	// the other rules.
+	valid func(string) bool
+}
+
+// FieldError is the error of a single field of a request.
+type FieldError struct {
+	Field string
+	Error string
+}
+
+// pgpInputRegexp matches the same PGP IDs as PGPRegexp, in a form which
+// JSON Schema validators also understand.
+var pgpInputRegexp = regexp.MustCompile("^([0-9A-Fa-f]{8}){0,2}$")
+
+// nodeInputIgnored are the form values which any request may have,
+// and which are never unknown in strict mode.
+var nodeInputIgnored = map[string]bool{
+	"callback": true,
+}
+
+// NodeSchema returns the fields of the given kind of request. The
+// address is not required for new nodes if there is an address plan.
+func NodeSchema(input NodeInput) []*NodeField {
+	fields := []*NodeField{
+		{Name: "address", Type: "string", MaxLength: 40,
+			Required: input != NodeCreate ||
+				len(Conf.AddressPlan.Ranges) == 0,
+			valid: func(s string) bool { return ParseIP(s) != nil }},
+		{Name: "latitude", Type: "number", Minimum: -90, Maximum: 90,
+			Required: true, Unless: "street_address"},
+		{Name: "longitude", Type: "number", Minimum: -180, Maximum: 180,
+			Required: true, Unless: "street_address"},
+		{Name: "street_address", Type: "string", MaxLength: 255},
+		{Name: "name", Type: "string", Required: true, MaxLength: 255,
+			Escaped: true},
+	}
+	if input == NodeCreate {
+		fields = append(fields,
+			&NodeField{Name: "email", Type: "string", Required: true,
+				MaxLength: 255, Pattern: EmailRegexp},
+			&NodeField{Name: "map", Type: "string", MaxLength: 255})
+	}
+	fields = append(fields,
+		&NodeField{Name: "contact", Type: "string", MaxLength: 255,
+			Escaped: true},
+		&NodeField{Name: "details", Type: "string", MaxLength: 255,
+			Escaped: true},
+		&NodeField{Name: "pgp", Type: "string", Pattern: pgpInputRegexp},
+		&NodeField{Name: "status", Type: "integer",
+			Minimum: 0, Maximum: math.MaxUint32},
+		&NodeField{Name: "token", Type: "integer"})
+	if input != NodeCreate {
+		fields = append(fields,
+			&NodeField{Name: "edit_token", Type: "string"},
+			&NodeField{Name: "version", Type: "integer", Minimum: 1,
+				Maximum: math.MaxInt64})
+	}
+	return fields
+}
+
+// CheckNodeInput checks the form values of the given kind of request
+// against NodeSchema, and returns the error of every field which breaks
+// it, in the order of the schema. If Conf.Validation.Strict is true,
+// every form value which is not in the schema is also an error, as
+// "<name>Unknown".
+func CheckNodeInput(r *http.Request, input NodeInput) (errs []*FieldError) {
+	r.ParseForm()
+	fields := NodeSchema(input)
+	known := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		known[f.Name] = true
+		// Patches may leave out any field but the address.
+		if _, ok := r.Form[f.Name]; !ok && input == NodePatch &&
+			f.Name != "address" {
+			continue
+		}
+		if err := f.check(r.Form.Get(f.Name),
+			len(r.Form.Get(f.Unless)) > 0); len(err) > 0 {
+			errs = append(errs, &FieldError{f.Name, err})
+		}
+	}
+
+	if !Conf.Validation.Strict {
+		return
+	}
+	unknown := make([]string, 0)
+	for name := range r.Form {
+		if !known[name] && !nodeInputIgnored[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		errs = append(errs, &FieldError{name, name + "Unknown"})
+	}
+	return
+}
+
+// check returns the error of the field with the given value, if any.
+// If given is true, the field named by f.Unless was given.
+func (f *NodeField) check(value string, given bool) string {
+	if len(value) == 0 {
+		if f.Required && (len(f.Unless) == 0 || !given) {
+			return f.Name + "Required"
+		}
+		return ""
+	}
+
+	switch f.Type {
+	case "number", "integer":
+		var n float64
+		var err error
+		if f.Type == "integer" {
+			var i int64
+			i, err = strconv.ParseInt(value, 10, 64)
+			n = float64(i)
+		} else {
+			n, err = strconv.ParseFloat(value, 64)
+		}
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) ||
+			f.Minimum < f.Maximum && (n < f.Minimum || n > f.Maximum) {
+			return f.Name + "Invalid"
+		}
+	default:
+		length := len(value)
+		if f.Escaped {
+			length = len(html.EscapeString(value))
+		}
+		if f.MaxLength > 0 && length > f.MaxLength {
+			return f.Name + "TooLong"
+		}
+		if f.Pattern != nil && !f.Pattern.MatchString(value) {
+			return f.Name + "Invalid"
+		}
+	}
+	if f.valid != nil && !f.valid(value) {
+		return f.Name + "Invalid"
+	}
+	return ""
+}
+
+// RequireNodeInput checks the request as with CheckNodeInput. If there
+// are any errors, it panics with the first, and gives every one as
+// `fields` beside the response.
+func RequireNodeInput(ctx *jas.Context, input NodeInput) {
+	errs := CheckNodeInput(ctx.Request, input)
+	if len(errs) == 0 {
+		return
+	}
+	ctx.Extra = map[string]interface{}{"fields": errs}
+	panic(jas.NewRequestError(errs[0].Error))
+}
+
+// GetNodeSchema responds with the fields of the requests which create
+// nodes, or of those which update or patch them if `update` or `patch`
+// is given, as a JSON Schema. Conditions which a schema can't express,
+// such as patterns set in Conf.Validation, are still checked.
+func (*Api) GetNodeSchema(ctx *jas.Context) {
+	ctx.ParseForm()
+	input := NodeCreate
+	if _, ok := ctx.Form["update"]; ok {
+		input = NodeUpdate
+	} else if _, ok := ctx.Form["patch"]; ok {
+		input = NodePatch
+	}
+
+	properties := make(map[string]interface{})
+	required := make([]string, 0)
+	alternatives := make([]interface{}, 0)
+	for _, f := range NodeSchema(input) {
+		p := map[string]interface{}{"type": f.Type}
+		if f.Minimum < f.Maximum {
+			p["minimum"], p["maximum"] = f.Minimum, f.Maximum
+		}
+		if f.MaxLength > 0 {
+			p["maxLength"] = f.MaxLength
+		}
+		if f.Pattern != nil {
+			p["pattern"] = f.Pattern.String()
+		}
+		properties[f.Name] = p
+
+		if !f.Required {
+			continue
+		} else if input == NodePatch && f.Name != "address" {
+			// Fields which patches give must still not be empty.
+			if f.Type == "string" {
+				p["minLength"] = 1
+			}
+		} else if len(f.Unless) == 0 {
+			required = append(required, f.Name)
+		} else {
+			alternatives = append(alternatives, map[string]interface{}{
+				"anyOf": []interface{}{
+					map[string]interface{}{"required": []string{f.Name}},
+					map[string]interface{}{"required": []string{f.Unless}},
+				},
+			})
+		}
+	}
+
+	schema := map[string]interface{}{
+		"$schema":              "http://json-schema.org/draft-07/schema#",
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": !Conf.Validation.Strict,
+	}
+	if len(alternatives) > 0 {
+		schema["allOf"] = alternatives
+	}
+	ctx.Data = schema
+}
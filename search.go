@@ -0,0 +1,270 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Searcher is the full-text index of all local and cached nodes. Like
+// Index, it is rebuilt from the database the first time it is used
+// after being invalidated.
+var Searcher = &SearchIndex{}
+
+// searchFields are the names of the Node fields which are indexed for
+// searching, and the weight given to matches in each. They are
+// retrieved from nodes with searchFieldValue.
+var searchFields = []struct {
+	Name   string
+	Weight float64
+}{
+	{"OwnerName", 3},
+	{"Details", 2},
+	{"Contact", 1},
+	{"Addr", 1},
+}
+
+// searchFieldValue returns the text of the indexed field with the
+// given index in searchFields.
+func searchFieldValue(n *Node, field int) string {
+	switch field {
+	case 0:
+		return n.OwnerName
+	case 1:
+		return n.Details
+	case 2:
+		return n.Contact
+	default:
+		return n.Addr.String()
+	}
+}
+
+// InvalidateIndexes marks all in-memory indexes of the nodes as
+// outdated. It should be called after any change to the nodes in the
+// database. The generation of the nodes in the database is also
+// advanced, so that other instances sharing it invalidate theirs, as
+// by WatchNodeGeneration.
+func InvalidateIndexes() {
+	invalidateLocalIndexes()
+	if Db.DB == nil || Db.ReadOnly {
+		return
+	}
+	if err := Db.BumpNodeGeneration(); err != nil {
+		dbLog.Errf("Error advancing node generation: %s", err)
+	}
+}
+
+// invalidateLocalIndexes marks the in-memory indexes of this instance
+// as outdated, and wakes anything waiting for changes to the nodes.
+func invalidateLocalIndexes() {
+	Index.Invalidate()
+	Searcher.Invalidate()
+	Hash.Invalidate()
+	NodeChanges.Broadcast()
+}
+
+// searchToken is a single lowercased word in a piece of text, and its
+// byte offsets in that text.
+type searchToken struct {
+	Term       string
+	Start, End int
+}
+
+// tokenize splits text into lowercased words, made up of letters and
+// digits.
+func tokenize(text string) (tokens []searchToken) {
+	start := -1
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+		} else if start >= 0 {
+			tokens = append(tokens, searchToken{
+				strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, searchToken{
+			strings.ToLower(text[start:]), start, len(text)})
+	}
+	return
+}
+
+// posting records that a term occurs count times in a particular
+// field of a particular node.
+type posting struct {
+	doc, field, count int
+}
+
+// SearchIndex is an in-memory inverted index of the text fields of
+// all nodes in the database. Any change to the nodes should be
+// followed by a call to Invalidate(), which will cause the index to
+// be rebuilt on next use. It is safe for concurrent use.
+type SearchIndex struct {
+	mutex      sync.RWMutex
+	docs       []*Node
+	postings   map[string][]posting
+	generation uint64 // incremented by Invalidate
+	built      uint64 // generation at which the index was built
+}
+
+// Invalidate marks the index as outdated.
+func (si *SearchIndex) Invalidate() {
+	si.mutex.Lock()
+	si.generation++
+	si.mutex.Unlock()
+}
+
+// current returns up-to-date documents and postings, rebuilding them
+// from the database if necessary.
+func (si *SearchIndex) current() (docs []*Node,
+	postings map[string][]posting, err error) {
+	si.mutex.RLock()
+	docs, postings, generation := si.docs, si.postings, si.generation
+	if postings != nil && si.built == generation {
+		si.mutex.RUnlock()
+		return
+	}
+	si.mutex.RUnlock()
+
+	nodes, err := Db.DumpNodes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	docs = make([]*Node, 0, len(nodes))
+	postings = make(map[string][]posting)
+	for _, n := range nodes {
+		if n == nil {
+			continue
+		}
+		doc := len(docs)
+		docs = append(docs, n)
+		for field := range searchFields {
+			counts := make(map[string]int)
+			for _, token := range tokenize(searchFieldValue(n, field)) {
+				counts[token.Term]++
+			}
+			for term, count := range counts {
+				postings[term] = append(postings[term],
+					posting{doc, field, count})
+			}
+		}
+	}
+
+	// Only keep the index if nothing changed while it was being
+	// built. Otherwise, it will be rebuilt on the next use.
+	si.mutex.Lock()
+	if si.generation == generation {
+		si.docs, si.postings, si.built = docs, postings, generation
+	}
+	si.mutex.Unlock()
+	return
+}
+
+// SearchResult is a single node matched by a search, its relevance
+// score, and the byte ranges of the matching words in each of its
+// fields, which can be used for highlighting.
+type SearchResult struct {
+	Node       *Node
+	Score      float64
+	Highlights map[string][][2]int
+}
+
+// Search returns up to limit nodes matching the given query, most
+// relevant first. Each word in the query matches any word in a node
+// which it is a prefix of, so that partial words match as they are
+// typed. Matches in rarer words, in more heavily weighted fields, and
+// of more of the query's words, score higher. The nodes in the
+// results are shared with the index, and must not be modified.
+func (si *SearchIndex) Search(query string, limit int) (results []*SearchResult, err error) {
+	docs, postings, err := si.current()
+	if err != nil {
+		return
+	}
+
+	// Deduplicate the words in the query.
+	terms := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, token := range tokenize(query) {
+		if !seen[token.Term] {
+			seen[token.Term] = true
+			terms = append(terms, token.Term)
+		}
+	}
+	results = make([]*SearchResult, 0)
+	if len(terms) == 0 {
+		return
+	}
+
+	scores := make(map[int]float64)
+	matched := make(map[int]int)
+	for _, term := range terms {
+		// Gather the postings of every indexed word which begins
+		// with this term.
+		matchedDoc := make(map[int]bool)
+		for indexed, list := range postings {
+			if !strings.HasPrefix(indexed, term) {
+				continue
+			}
+			idf := math.Log(1 + float64(len(docs))/float64(len(list)))
+			for _, p := range list {
+				scores[p.doc] += idf * searchFields[p.field].Weight *
+					(1 + math.Log(float64(p.count)))
+				matchedDoc[p.doc] = true
+			}
+		}
+		for doc := range matchedDoc {
+			matched[doc]++
+		}
+	}
+
+	for doc, score := range scores {
+		// Scale the score by the fraction of query words which
+		// matched.
+		score *= float64(matched[doc]) / float64(len(terms))
+		results = append(results, &SearchResult{
+			Node:       docs[doc],
+			Score:      score,
+			Highlights: highlights(docs[doc], terms),
+		})
+	}
+
+	sort.Sort(byScore(results))
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return
+}
+
+// highlights returns the byte ranges in each indexed field of the
+// node which contain words beginning with any of the given terms.
+func highlights(n *Node, terms []string) (h map[string][][2]int) {
+	h = make(map[string][][2]int)
+	for field := range searchFields {
+		for _, token := range tokenize(searchFieldValue(n, field)) {
+			for _, term := range terms {
+				if strings.HasPrefix(token.Term, term) {
+					name := searchFields[field].Name
+					h[name] = append(h[name],
+						[2]int{token.Start, token.End})
+					break
+				}
+			}
+		}
+	}
+	return
+}
+
+type byScore []*SearchResult
+
+func (s byScore) Len() int           { return len(s) }
+func (s byScore) Less(i, j int) bool { return s[i].Score > s[j].Score }
+func (s byScore) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
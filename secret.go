@@ -0,0 +1,42 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// newSecret returns a random secret, such as an edit token, which can
+// be given to its holder as a credential. Unlike the values of
+// math/rand, which is seeded with the time at startup, it can't be
+// guessed. Only its hash, as given by secretHash, should be stored.
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// secretHash returns the hash of the secret by which it is stored, so
+// that secrets can't be used by anyone who reads the database.
+func secretHash(secret string) string {
+	return sha256Hex([]byte(secret))
+}
+
+// newRandomID returns a random positive ID which can't be guessed,
+// for IDs which are themselves credentials, such as those of transfers.
+func newRandomID() (int64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	id := int64(binary.BigEndian.Uint64(b[:]) >> 1)
+	if id == 0 {
+		id = 1
+	}
+	return id, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"math/rand"
+	"net/http"
+	"rsc.io/qr"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ShortIDAlphabet is the set of characters from which short IDs
+	// are made. Easily confused characters, such as 0 and o, are
+	// left out, because short links are meant to be printed.
+	ShortIDAlphabet = "23456789abcdefghjkmnpqrstuvwxyz"
+
+	// ShortIDLength is the length of newly generated short IDs.
+	ShortIDLength = 6
+)
+
+// ShortID returns the short ID of the node with the given address,
+// creating one if it does not yet exist. Short IDs can be resolved
+// with ResolveShortID.
+func (db DB) ShortID(addr IP) (id string, err error) {
+	err = db.QueryRow(`SELECT id
+FROM short_links
+WHERE address = ?;`, []byte(addr)).Scan(&id)
+	if err != sql.ErrNoRows {
+		return
+	}
+	if db.ReadOnly {
+		return "", ReadOnlyError
+	}
+
+	// Generate random IDs until one is not taken. Collisions should
+	// be rare, so only try a few times.
+	for i := 0; i < 5; i++ {
+		b := make([]byte, ShortIDLength)
+		for j := range b {
+			b[j] = ShortIDAlphabet[rand.Intn(len(ShortIDAlphabet))]
+		}
+		id = string(b)
+
+		_, err = db.Exec(`INSERT INTO short_links
+(id, address)
+VALUES(?, ?);`, id, []byte(addr))
+		if err == nil {
+			return
+		}
+	}
+	return "", err
+}
+
+// ResolveShortID returns the address of the node with the given short
+// ID. If there is no such ID, it returns sql.ErrNoRows.
+func (db DB) ResolveShortID(id string) (addr IP, err error) {
+	err = db.QueryRow(`SELECT address
+FROM short_links
+WHERE id = ?;`, strings.ToLower(id)).Scan(&addr)
+	return
+}
+
+// ShortURL returns the absolute short link of the node with the given
+// address, which redirects to the node's page, creating the short ID
+// if necessary. The request is used to determine the base URL. Short
+// links are not served in headless mode, so the node's page is given
+// instead.
+func ShortURL(r *http.Request, addr IP) (url string, err error) {
+	if Conf.Web.Headless {
+		return NodePageURL(r, addr), nil
+	}
+	db := Db.WithContext(r.Context())
+	id, err := db.ShortID(addr)
+	if err != nil {
+		return
+	}
+	return BaseURL(r) + "/n/" + id, nil
+}
+
+// HandleShortLink redirects requests for "/n/<short-id>" to the page
+// of the node with that short ID.
+func HandleShortLink(w http.ResponseWriter, r *http.Request) {
+	db := Db.WithContext(r.Context())
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/n/"), "/")
+	addr, err := db.ResolveShortID(id)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		l.Errf("Error resolving short ID %q: %s", id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, NodePageURL(r, addr),
+		http.StatusMovedPermanently)
+}
+
+// HandleNodeQR serves a PNG QR code which encodes the short link of
+// the node with the given address, or its full page URL if no short
+// link can be created. The form value `scale` sets the size of each
+// module of the code in pixels, from 1 to 32. The default is 8.
+func HandleNodeQR(w http.ResponseWriter, r *http.Request, addr IP) {
+	db := Db.WithContext(r.Context())
+	_, err := db.GetNode(addr)
+	if err == NodeNotFoundError {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		l.Errf("Error getting node %q: %s", addr, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+
+	url, err := ShortURL(r, addr)
+	if err != nil {
+		// If the short link can't be created, such as if the
+		// database is read only, use the full link instead.
+		url = NodePageURL(r, addr)
+	}
+
+	code, err := qr.Encode(url, qr.M)
+	if err != nil {
+		l.Errf("Error encoding QR code for %q: %s", addr, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	if scale, err := strconv.Atoi(r.FormValue("scale")); err == nil &&
+		scale >= 1 && scale <= 32 {
+		code.Scale = scale
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(code.PNG())
+}
@@ -4,6 +4,8 @@ package main
 // Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"net"
 	"net/smtp"
@@ -94,33 +96,100 @@ type Email struct {
 	// To, From, and Subject are standard pieces of an Email template.
 	To, From, Subject string
 
+	// Locale is the language tag of the locale in which the email is
+	// written. If it is empty, the default locale is used.
+	Locale string
+
 	// Data contains any additional, which should be referenced by
 	// name in the template, e.g. '{{.Data.FieldName}}'.
 	Data map[string]interface{}
 
-	// Header contains data which is generated at Send() time. It does
+	// Header contains data which is generated at Render() time. It does
 	// not need to need to be filled out.
 	Header struct {
 		Date string
 	}
 }
 
+// Send renders the named email template and sends it immediately,
+// returning any error. Emails which need not be sent before responding,
+// such as notifications, should be sent with Queue instead.
 func (e *Email) Send(templateName string) (err error) {
-	c, err := PrepareEmail(Conf.SMTP.EmailAddress, e.To)
+	msg, err := e.Render(templateName)
 	if err != nil {
 		return
 	}
-	defer c.Quit()
+	return deliverEmail(e.To, msg)
+}
+
+// Queue renders the named email template and queues it to be sent in
+// the background, so that it is retried if the SMTP server can't be
+// reached. The recipient is stored decrypted in the queue until the
+// email is sent.
+func (e *Email) Queue(templateName string) (err error) {
+	if Conf.SMTP == nil {
+		return SMTPDisabledError
+	}
+	msg, err := e.Render(templateName)
+	if err != nil {
+		return
+	}
+	return Enqueue("email", queuedEmail{To: e.To, Message: string(msg)})
+}
 
+// Render decrypts the recipient of the email, if necessary, and
+// executes the named template in the email's locale, returning the
+// whole message.
+func (e *Email) Render(templateName string) (msg []byte, err error) {
+	// The address may be stored encrypted, and is only decrypted now.
+	if e.To, err = EmailRecipient(e.To); err != nil {
+		return
+	}
 	e.Header.Date = time.Now().Format(time.RFC1123Z)
 
+	locale := e.Locale
+	if len(locale) == 0 {
+		locale = Conf.DefaultLocale()
+	}
+	buf := new(bytes.Buffer)
+	err = ExecuteLocalized(t, buf, templateName, locale, e)
+	return buf.Bytes(), err
+}
+
+// queuedEmail is the payload of a queued "email" task.
+type queuedEmail struct {
+	To, Message string
+}
+
+// deliverEmail sends the rendered message to the recipient via the
+// SMTP server configured in the Conf.
+func deliverEmail(to string, msg []byte) (err error) {
+	if Conf.SMTP == nil {
+		return SMTPDisabledError
+	}
+	c, err := PrepareEmail(Conf.SMTP.EmailAddress, to)
+	if err != nil {
+		return
+	}
+	defer c.Quit()
+
 	// Tell the server we're about to send it the data.
 	w, err := c.Data()
 	if err != nil {
 		return
 	}
+	if _, err = w.Write(msg); err != nil {
+		w.Close()
+		return
+	}
+	return w.Close()
+}
 
-	// Execute the template verification.txt and write directly to the
-	// connection.
-	return t.ExecuteTemplate(w, templateName, e)
+// deliverQueuedEmail sends an email which was queued by Queue.
+func deliverQueuedEmail(payload []byte) error {
+	var e queuedEmail
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return err
+	}
+	return deliverEmail(e.To, []byte(e.Message))
 }
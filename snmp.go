@@ -0,0 +1,407 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/coocood/jas"
+	"github.com/soniah/gosnmp"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMetricsRetention is the length of time for which
+	// metrics are kept, if Conf.SNMP.Retention is not set.
+	DefaultMetricsRetention = 30 * 24 * time.Hour
+
+	// DefaultSNMPInterface is the interface index which is polled if
+	// none is given for a target.
+	DefaultSNMPInterface = 1
+
+	// The IF-MIB 64-bit octet counters, to which the interface index
+	// is appended.
+	oidIfHCInOctets  = ".1.3.6.1.2.1.31.1.1.1.6."
+	oidIfHCOutOctets = ".1.3.6.1.2.1.31.1.1.1.10."
+)
+
+var (
+	snmpVersionRegexp = regexp.MustCompile(`^(2c|3)$`)
+	snmpAuthRegexp    = regexp.MustCompile(`^(MD5|SHA)$`)
+	snmpPrivRegexp    = regexp.MustCompile(`^(DES|AES)$`)
+)
+
+var (
+	SNMPVersionInvalidError = errors.New("version must be 2c or 3")
+	SNMPNoSuchObjectError   = errors.New("no such object")
+)
+
+// SNMPTarget is a local node, usually a supernode, which is polled by
+// SNMP for metrics. Its credentials are never given out.
+type SNMPTarget struct {
+	Addr IP `json:"Address"`
+
+	// Version is either "2c" or "3". For 2c, Community is used. For
+	// 3, User is used, with authentication if AuthProtocol ("MD5" or
+	// "SHA") is set, and privacy if PrivProtocol ("DES" or "AES") is
+	// also set.
+	Version      string
+	Community    string `json:"-"`
+	User         string `json:"-"`
+	AuthProtocol string `json:"-"`
+	AuthPass     string `json:"-"`
+	PrivProtocol string `json:"-"`
+	PrivPass     string `json:"-"`
+
+	// Interface is the IF-MIB index of the interface whose
+	// throughput is measured.
+	Interface int
+}
+
+// Metric is a single sample of a node's metrics. InOctets and
+// OutOctets are the raw interface counters. InRate and OutRate are the
+// throughput in bits per second since the previous sample, and are
+// omitted for the first sample or if the counters were reset.
+type Metric struct {
+	Time                time.Time
+	InOctets, OutOctets uint64
+	InRate, OutRate     float64 `json:",omitempty"`
+
+	// Clients is the number of connected clients, if
+	// Conf.SNMP.ClientsOID is set.
+	Clients int `json:",omitempty"`
+}
+
+// SaveSNMPTarget adds or replaces the SNMP target of the node.
+func (db DB) SaveSNMPTarget(t *SNMPTarget) (err error) {
+	if err = db.DeleteSNMPTarget(t.Addr); err != nil {
+		return
+	}
+	_, err = db.Exec(`INSERT INTO snmp_targets
+(address, version, community, username, auth_protocol, auth_pass,
+priv_protocol, priv_pass, interface)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?);`, []byte(t.Addr), t.Version,
+		t.Community, t.User, t.AuthProtocol, t.AuthPass, t.PrivProtocol,
+		t.PrivPass, t.Interface)
+	return
+}
+
+// DeleteSNMPTarget stops polling the node with the given address. Its
+// metrics are kept.
+func (db DB) DeleteSNMPTarget(addr IP) (err error) {
+	_, err = db.Exec(`DELETE FROM snmp_targets
+WHERE address = ?;`, []byte(addr))
+	return
+}
+
+// SNMPTargets returns every SNMP target, with its credentials.
+func (db DB) SNMPTargets() (targets []*SNMPTarget, err error) {
+	rows, err := db.Query(`SELECT address,version,community,username,
+auth_protocol,auth_pass,priv_protocol,priv_pass,interface
+FROM snmp_targets;`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	targets = make([]*SNMPTarget, 0)
+	for rows.Next() {
+		t := new(SNMPTarget)
+		var community, user, authProto, authPass, privProto,
+			privPass sql.NullString
+		err = rows.Scan(&t.Addr, &t.Version, &community, &user,
+			&authProto, &authPass, &privProto, &privPass, &t.Interface)
+		if err != nil {
+			return
+		}
+		t.Community, t.User = community.String, user.String
+		t.AuthProtocol, t.AuthPass = authProto.String, authPass.String
+		t.PrivProtocol, t.PrivPass = privProto.String, privPass.String
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
+
+// AddMetric records a sample of the node's metrics.
+func (db DB) AddMetric(addr IP, m *Metric) (err error) {
+	_, err = db.Exec(`INSERT INTO metrics
+(address, time, in_octets, out_octets, clients)
+VALUES(?, ?, ?, ?, ?);`, []byte(addr), m.Time.Unix(),
+		int64(m.InOctets), int64(m.OutOctets), m.Clients)
+	if err != nil {
+		return
+	}
+	PublishNodeEvent(addr, "metrics", m)
+	return
+}
+
+// Metrics returns the samples of the node's metrics taken since the
+// given time, oldest first, with their rates calculated.
+func (db DB) Metrics(addr IP, since time.Time) (metrics []*Metric, err error) {
+	rows, err := db.Query(`SELECT time,in_octets,out_octets,clients
+FROM metrics
+WHERE address = ? AND time >= ?
+ORDER BY time;`, []byte(addr), since.Unix())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	metrics = make([]*Metric, 0)
+	var prev *Metric
+	for rows.Next() {
+		m := new(Metric)
+		var t, in, out int64
+		var clients sql.NullInt64
+		if err = rows.Scan(&t, &in, &out, &clients); err != nil {
+			return
+		}
+		m.Time = time.Unix(t, 0)
+		m.InOctets, m.OutOctets = uint64(in), uint64(out)
+		m.Clients = int(clients.Int64)
+
+		// If the counters went backwards, the node was probably
+		// restarted, so no rate can be given.
+		if prev != nil && m.InOctets >= prev.InOctets &&
+			m.OutOctets >= prev.OutOctets {
+			secs := m.Time.Sub(prev.Time).Seconds()
+			if secs > 0 {
+				m.InRate = float64(m.InOctets-prev.InOctets) * 8 / secs
+				m.OutRate = float64(m.OutOctets-prev.OutOctets) * 8 / secs
+			}
+		}
+		metrics = append(metrics, m)
+		prev = m
+	}
+	return metrics, rows.Err()
+}
+
+// DeleteOldMetrics removes samples older than the metrics retention.
+func (db DB) DeleteOldMetrics() (err error) {
+	retention := time.Duration(Conf.SNMP.Retention)
+	if retention <= 0 {
+		retention = DefaultMetricsRetention
+	}
+	_, err = db.Exec(`DELETE FROM metrics
+WHERE time < ?;`, time.Now().Add(-retention).Unix())
+	return
+}
+
+// PollSNMP polls every SNMP target concurrently, if Conf.SNMP.Enabled
+// is set, records their metrics, and removes old ones. Errors are
+// logged.
+func PollSNMP() {
+	if !Conf.SNMP.Enabled {
+		return
+	}
+	targets, err := Db.SNMPTargets()
+	if err != nil {
+		dbLog.Errf("Error getting SNMP targets: %s", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t *SNMPTarget) {
+			defer wg.Done()
+			m, err := t.Poll()
+			if err != nil {
+				l.Warningf("Error polling %q by SNMP: %s", t.Addr, err)
+				return
+			}
+			if err = Db.AddMetric(t.Addr, m); err != nil {
+				dbLog.Errf("Error recording metrics of %q: %s", t.Addr, err)
+			}
+		}(t)
+	}
+	wg.Wait()
+
+	if err = Db.DeleteOldMetrics(); err != nil {
+		dbLog.Errf("Error deleting old metrics: %s", err)
+	}
+}
+
+// Poll connects to the target and retrieves its interface counters
+// and, if Conf.SNMP.ClientsOID is set, its number of clients.
+func (t *SNMPTarget) Poll() (m *Metric, err error) {
+	g := &gosnmp.GoSNMP{
+		Target:  t.Addr.String(),
+		Port:    161,
+		Timeout: 5 * time.Second,
+		Retries: 1,
+	}
+	switch t.Version {
+	case "2c":
+		g.Version = gosnmp.Version2c
+		g.Community = t.Community
+	case "3":
+		g.Version = gosnmp.Version3
+		g.SecurityModel = gosnmp.UserSecurityModel
+		params := &gosnmp.UsmSecurityParameters{
+			UserName:                 t.User,
+			AuthenticationProtocol:   gosnmp.NoAuth,
+			PrivacyProtocol:          gosnmp.NoPriv,
+			AuthenticationPassphrase: t.AuthPass,
+			PrivacyPassphrase:        t.PrivPass,
+		}
+		g.MsgFlags = gosnmp.NoAuthNoPriv
+		switch t.AuthProtocol {
+		case "MD5":
+			params.AuthenticationProtocol = gosnmp.MD5
+			g.MsgFlags = gosnmp.AuthNoPriv
+		case "SHA":
+			params.AuthenticationProtocol = gosnmp.SHA
+			g.MsgFlags = gosnmp.AuthNoPriv
+		}
+		if g.MsgFlags == gosnmp.AuthNoPriv {
+			switch t.PrivProtocol {
+			case "DES":
+				params.PrivacyProtocol = gosnmp.DES
+				g.MsgFlags = gosnmp.AuthPriv
+			case "AES":
+				params.PrivacyProtocol = gosnmp.AES
+				g.MsgFlags = gosnmp.AuthPriv
+			}
+		}
+		g.SecurityParameters = params
+	default:
+		return nil, SNMPVersionInvalidError
+	}
+
+	if err = g.Connect(); err != nil {
+		return
+	}
+	defer g.Conn.Close()
+
+	index := strconv.Itoa(t.Interface)
+	oids := []string{oidIfHCInOctets + index, oidIfHCOutOctets + index}
+	if len(Conf.SNMP.ClientsOID) > 0 {
+		oids = append(oids, Conf.SNMP.ClientsOID)
+	}
+	result, err := g.Get(oids)
+	if err != nil {
+		return
+	}
+	if len(result.Variables) != len(oids) {
+		return nil, SNMPNoSuchObjectError
+	}
+	for _, v := range result.Variables {
+		if v.Type == gosnmp.NoSuchObject || v.Type == gosnmp.NoSuchInstance {
+			return nil, SNMPNoSuchObjectError
+		}
+	}
+
+	m = &Metric{
+		Time:      time.Now(),
+		InOctets:  gosnmp.ToBigInt(result.Variables[0].Value).Uint64(),
+		OutOctets: gosnmp.ToBigInt(result.Variables[1].Value).Uint64(),
+	}
+	if len(oids) > 2 {
+		m.Clients = int(gosnmp.ToBigInt(result.Variables[2].Value).Int64())
+	}
+	return
+}
+
+// PostSnmpTarget sets the SNMP `version` ("2c" or "3") and
+// credentials with which the local node with the given `address` is
+// polled, and the `interface` index whose throughput is measured. For
+// version 2c, `community` is required. For version 3, `user` is
+// required, and `auth_protocol` ("MD5" or "SHA") with `auth_pass`,
+// and `priv_protocol` ("DES" or "AES") with `priv_pass`, are optional.
+// If `remove` is given, the node is no longer polled. Only admins may
+// set targets.
+func (*Api) PostSnmpTarget(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	node := RequireLocalNode(ctx)
+	if _, err := ctx.FindString("remove"); err == nil {
+		if err = db.DeleteSNMPTarget(node.Addr); err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			apiLog.Request(ctx.Request).Err(err)
+			return
+		}
+		ctx.Data = "removed"
+		return
+	}
+
+	t := &SNMPTarget{
+		Addr:      node.Addr,
+		Version:   ctx.RequireStringMatch(snmpVersionRegexp, "version"),
+		Interface: DefaultSNMPInterface,
+	}
+	if i, err := ctx.FindPositiveInt("interface"); err == nil && i > 0 {
+		t.Interface = int(i)
+	}
+	if t.Version == "2c" {
+		t.Community = ctx.RequireStringLen(1, 255, "community")
+	} else {
+		t.User = ctx.RequireStringLen(1, 255, "user")
+		t.AuthProtocol, _ = ctx.FindStringMatch(snmpAuthRegexp,
+			"auth_protocol")
+		if len(t.AuthProtocol) > 0 {
+			t.AuthPass = ctx.RequireStringLen(8, 255, "auth_pass")
+			t.PrivProtocol, _ = ctx.FindStringMatch(snmpPrivRegexp,
+				"priv_protocol")
+			if len(t.PrivProtocol) > 0 {
+				t.PrivPass = ctx.RequireStringLen(8, 255, "priv_pass")
+			}
+		}
+	}
+
+	if err := db.SaveSNMPTarget(t); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error saving SNMP target %q: %s",
+			t.Addr, err)
+		return
+	}
+	ctx.Data = t
+}
+
+// GetSnmpTargets lists every SNMP target, without its credentials.
+// Only admins may see them.
+func (*Api) GetSnmpTargets(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	var err error
+	ctx.Data, err = db.SNMPTargets()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error getting SNMP targets: %s", err)
+	}
+}
+
+// HandleNodeMetrics serves "<prefix>/api/nodes/<addr>/metrics", which
+// is the node's metrics as JSON, oldest first, for graphing. By
+// default, the last day of metrics is given, but an RFC3339 time may
+// be given as "since".
+func HandleNodeMetrics(w http.ResponseWriter, r *http.Request, addr IP) {
+	db := Db.WithContext(r.Context())
+	since := time.Now().Add(-24 * time.Hour)
+	if s := r.FormValue("since"); len(s) > 0 {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "sinceInvalid", http.StatusBadRequest)
+			return
+		}
+	}
+	metrics, err := db.Metrics(addr, since)
+	if err != nil {
+		dbLog.Request(r).Errf("Error getting metrics of %q: %s", addr, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metrics)
+}
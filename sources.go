@@ -0,0 +1,290 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"github.com/coocood/jas"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// SourceFilter decides which maps nodes may be cached from, so that a
+// compromised or misbehaving child map cannot introduce arbitrary
+// sources. Patterns are matched, as by path.Match, against either the
+// whole address of a map or its host alone, so "*.example.org"
+// matches "https://atlas.example.org".
+type SourceFilter struct {
+	// Blocked is a list of patterns of maps which are never cached.
+	Blocked []string
+
+	// Allowed is a list of patterns of maps which may be cached in
+	// strict mode.
+	Allowed []string
+
+	// Strict is true if only maps matching Allowed may be cached,
+	// except for the child maps themselves.
+	Strict bool
+}
+
+// matchSource returns true if the address matches any of the given
+// patterns. Invalid patterns never match.
+func matchSource(patterns []string, address string) bool {
+	address = strings.ToLower(strings.TrimPrefix(address, "grpc+"))
+	var host string
+	if u, err := url.Parse(address); err == nil {
+		host = u.Host
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if ok, _ := path.Match(pattern, address); ok {
+			return true
+		}
+		if len(host) == 0 {
+			continue
+		}
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// IsBlocked returns true if the map at the given address must never
+// be cached.
+func (f *SourceFilter) IsBlocked(address string) bool {
+	return matchSource(f.Blocked, address)
+}
+
+// IsAllowed returns true if nodes from the map at the given address
+// may be cached when they are listed by one of the child maps.
+func (f *SourceFilter) IsAllowed(address string) bool {
+	if f.IsBlocked(address) {
+		return false
+	}
+	return !f.Strict || matchSource(f.Allowed, address)
+}
+
+// SourceRule is a pattern which has been blocked or allowed by an
+// admin, in addition to those in the configuration.
+type SourceRule struct {
+	Pattern string
+	Allow   bool
+}
+
+// SourceRules returns every pattern which has been blocked or allowed
+// by an admin.
+func (db DB) SourceRules() (rules []*SourceRule, err error) {
+	rows, err := db.Query(`SELECT pattern,allow
+FROM source_rules;`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	rules = make([]*SourceRule, 0)
+	for rows.Next() {
+		r := new(SourceRule)
+		if err = rows.Scan(&r.Pattern, &r.Allow); err != nil {
+			return
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// SetSourceRule blocks or allows the given pattern, replacing any
+// rule for it.
+func (db DB) SetSourceRule(pattern string, allow bool) (err error) {
+	res, err := db.Exec(`UPDATE source_rules
+SET allow = ?
+WHERE pattern = ?;`, allow, pattern)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return
+	}
+	_, err = db.Exec(`INSERT INTO source_rules
+(pattern, allow) VALUES(?, ?);`, pattern, allow)
+	return
+}
+
+// DeleteSourceRule removes the rule for the given pattern. If there is
+// no such rule, it returns sql.ErrNoRows.
+func (db DB) DeleteSourceRule(pattern string) (err error) {
+	res, err := db.Exec(`DELETE FROM source_rules
+WHERE pattern = ?;`, pattern)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return
+}
+
+// SourceFilter returns the SourceFilter made up of the configured
+// BlockedSources, AllowedSources, and StrictSources, and every rule
+// set by an admin.
+func (db DB) SourceFilter() (f *SourceFilter, err error) {
+	f = &SourceFilter{
+		Blocked: append([]string{}, Conf.BlockedSources...),
+		Allowed: append([]string{}, Conf.AllowedSources...),
+		Strict:  Conf.StrictSources,
+	}
+	rules, err := db.SourceRules()
+	if err != nil {
+		return
+	}
+	for _, r := range rules {
+		if r.Allow {
+			f.Allowed = append(f.Allowed, r.Pattern)
+		} else {
+			f.Blocked = append(f.Blocked, r.Pattern)
+		}
+	}
+	return
+}
+
+// GetSourceRules returns the SourceFilter which is in effect, made up
+// of both the configuration and the rules set by admins, and the
+// latter alone as `rules`. It is only available to admins.
+func (*Federation) GetSourceRules(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	f, err := db.SourceFilter()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error listing source rules: %s", err)
+		return
+	}
+	rules, err := db.SourceRules()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error listing source rules: %s", err)
+		return
+	}
+	ctx.Data = f
+	ctx.Extra = map[string]interface{}{"rules": rules}
+}
+
+// PostSourceRule blocks the given `pattern`, or allows it if `allow`
+// is true. If `delete` is true, the rule for the pattern is removed
+// instead. Rules in the configuration cannot be changed. It is only
+// available to admins.
+func (*Federation) PostSourceRule(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	pattern := strings.ToLower(ctx.RequireStringLen(1, 255, "pattern"))
+	if _, err := path.Match(pattern, ""); err != nil {
+		ctx.Error = jas.NewRequestError("patternInvalid")
+		return
+	}
+	allow, _ := ctx.FindBool("allow")
+	remove, _ := ctx.FindBool("delete")
+
+	var err error
+	if remove {
+		err = db.DeleteSourceRule(pattern)
+	} else {
+		err = db.SetSourceRule(pattern, allow)
+	}
+	if err == sql.ErrNoRows {
+		ctx.Error = jas.NewRequestError("no matching rule")
+		return
+	} else if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error setting source rule %q: %s",
+			pattern, err)
+		return
+	}
+	ctx.Data = "successful"
+}
+
+// Source is a map from which nodes are shown, as listed by GetSources.
+type Source struct {
+	// ID is the local ID of the source, as in Node.SourceID. The
+	// local map is 0.
+	ID int
+
+	// Hostname is the address of the source, as used for the keys of
+	// /api/all, and Name is its name. The local map is "local", and
+	// is named by Conf.Name.
+	Hostname, Name string
+
+	// Nodes is the number of nodes which are cached from the source.
+	Nodes int
+
+	// Retrieved is the time at which its least recently retrieved
+	// node was retrieved, and Stale is true if that was long enough
+	// ago that the source is probably unreachable, as in
+	// SourceFreshness. Retrieved is nil for the local map and sources
+	// from which no nodes are cached.
+	Retrieved *time.Time `json:",omitempty"`
+	Stale     bool
+}
+
+// Sources returns the local map and every map from which nodes may be
+// cached, in order of ID. Maps which have registered themselves are
+// only included once they have been approved.
+func (db DB) Sources() (sources []*Source, err error) {
+	local := &Source{Hostname: "local", Name: Conf.Name}
+	err = db.reader().QueryRow(`SELECT COUNT(*)
+FROM nodes;`).Scan(&local.Nodes)
+	if err != nil {
+		return
+	}
+	sources = []*Source{local}
+
+	rows, err := db.reader().Query(`SELECT cached_maps.id,
+cached_maps.hostname, cached_maps.name,
+COUNT(nodes_cached.address), MIN(nodes_cached.retrieved)
+FROM cached_maps
+LEFT JOIN nodes_cached ON nodes_cached.source = cached_maps.id
+WHERE cached_maps.registration != ?
+GROUP BY cached_maps.id, cached_maps.hostname, cached_maps.name
+ORDER BY cached_maps.id;`, RegistrationPending)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	staleAfter := staleHeartbeats * time.Duration(Conf.HeartbeatRate)
+	for rows.Next() {
+		s := new(Source)
+		var retrieved sql.NullInt64
+		if err = rows.Scan(&s.ID, &s.Hostname, &s.Name, &s.Nodes,
+			&retrieved); err != nil {
+			return
+		}
+		if retrieved.Valid {
+			t := time.Unix(retrieved.Int64, 0)
+			s.Retrieved = &t
+			s.Stale = now.Sub(t) > staleAfter
+		}
+		sources = append(sources, s)
+	}
+	return sources, rows.Err()
+}
+
+// GetSources responds with every source of the nodes, as given by
+// DB.Sources, so that they can be credited and shown or hidden by
+// clients without being inferred from /api/all.
+func (*Api) GetSources(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	var err error
+	ctx.Data, err = db.Sources()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error listing sources: %s", err)
+	}
+}
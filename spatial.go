@@ -0,0 +1,356 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// EarthRadius is the mean radius of the Earth in meters, used
+	// for distance calculations.
+	EarthRadius = 6371000
+
+	// quadTreeCapacity is the number of nodes a quadtree leaf holds
+	// before it is subdivided, and quadTreeMaxDepth is the depth
+	// after which it will no longer be subdivided, so that many
+	// nodes at identical coordinates don't recurse forever.
+	quadTreeCapacity = 16
+	quadTreeMaxDepth = 20
+)
+
+var (
+	InvalidBoundsError = errors.New("bbox must be of the form minLon,minLat,maxLon,maxLat")
+)
+
+// Index is the spatial index of all local and cached nodes, which is
+// used for geographic queries. It is rebuilt from the database the
+// first time it is used after being invalidated.
+var Index = &SpatialIndex{}
+
+// Bounds is a rectangle of latitudes and longitudes.
+type Bounds struct {
+	MinLat, MinLon, MaxLat, MaxLon float64
+}
+
+// ParseBounds parses a bounding box of the form
+// "minLon,minLat,maxLon,maxLat", which is the order produced by
+// Leaflet's LatLngBounds.toBBoxString().
+func ParseBounds(s string) (b Bounds, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return b, InvalidBoundsError
+	}
+	var f [4]float64
+	for i, part := range parts {
+		f[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return b, InvalidBoundsError
+		}
+	}
+	b = Bounds{MinLon: f[0], MinLat: f[1], MaxLon: f[2], MaxLat: f[3]}
+	if b.MinLat > b.MaxLat || b.MinLon > b.MaxLon {
+		return b, InvalidBoundsError
+	}
+	return
+}
+
+// Contains reports whether the given point is within the bounds.
+func (b Bounds) Contains(lat, lon float64) bool {
+	return lat >= b.MinLat && lat <= b.MaxLat &&
+		lon >= b.MinLon && lon <= b.MaxLon
+}
+
+// Intersects reports whether the two bounds overlap.
+func (b Bounds) Intersects(o Bounds) bool {
+	return b.MinLat <= o.MaxLat && o.MinLat <= b.MaxLat &&
+		b.MinLon <= o.MaxLon && o.MinLon <= b.MaxLon
+}
+
+// BoundsAround returns the smallest Bounds which contains every point
+// within the given distance (in meters) of the given point.
+func BoundsAround(lat, lon, meters float64) Bounds {
+	dLat := meters / EarthRadius * 180 / math.Pi
+	dLon := 180.0
+	if cos := math.Cos(lat * math.Pi / 180); cos > 1e-9 {
+		dLon = math.Min(dLat/cos, 180)
+	}
+	return Bounds{
+		MinLat: lat - dLat, MaxLat: lat + dLat,
+		MinLon: lon - dLon, MaxLon: lon + dLon,
+	}
+}
+
+// Distance returns the great-circle distance in meters between two
+// points, using the haversine formula.
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	rlat1 := lat1 * math.Pi / 180
+	rlat2 := lat2 * math.Pi / 180
+	dLat := (lat2 - lat1) * math.Pi / 180
+	dLon := (lon2 - lon1) * math.Pi / 180
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rlat1)*math.Cos(rlat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return EarthRadius * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// Bearing returns the initial compass bearing in degrees, from 0 up to
+// 360, of the great-circle path from the first point to the second.
+func Bearing(lat1, lon1, lat2, lon2 float64) float64 {
+	rlat1 := lat1 * math.Pi / 180
+	rlat2 := lat2 * math.Pi / 180
+	dLon := (lon2 - lon1) * math.Pi / 180
+
+	y := math.Sin(dLon) * math.Cos(rlat2)
+	x := math.Cos(rlat1)*math.Sin(rlat2) -
+		math.Sin(rlat1)*math.Cos(rlat2)*math.Cos(dLon)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+// Destination returns the point which is the given distance in meters
+// from the given point, along the great-circle path which starts at
+// the given compass bearing in degrees.
+func Destination(lat, lon, bearing, meters float64) (float64, float64) {
+	rlat := lat * math.Pi / 180
+	rlon := lon * math.Pi / 180
+	rbearing := bearing * math.Pi / 180
+	d := meters / EarthRadius
+
+	lat2 := math.Asin(math.Sin(rlat)*math.Cos(d) +
+		math.Cos(rlat)*math.Sin(d)*math.Cos(rbearing))
+	lon2 := rlon + math.Atan2(math.Sin(rbearing)*math.Sin(d)*math.Cos(rlat),
+		math.Cos(d)-math.Sin(rlat)*math.Sin(lat2))
+	return lat2 * 180 / math.Pi,
+		math.Mod(lon2*180/math.Pi+540, 360) - 180
+}
+
+// quadTree is a simple point quadtree of nodes. Leaves hold up to
+// quadTreeCapacity nodes before being split into four children.
+type quadTree struct {
+	bounds   Bounds
+	nodes    []*Node
+	children []*quadTree
+}
+
+func newQuadTree(b Bounds) *quadTree {
+	return &quadTree{bounds: b}
+}
+
+// insert adds the node to the tree, subdividing if necessary. Nodes
+// outside of the tree's bounds are ignored.
+func (q *quadTree) insert(n *Node, depth int) {
+	if !q.bounds.Contains(n.Latitude, n.Longitude) {
+		return
+	}
+	if q.children == nil {
+		if len(q.nodes) < quadTreeCapacity || depth >= quadTreeMaxDepth {
+			q.nodes = append(q.nodes, n)
+			return
+		}
+		q.subdivide(depth)
+	}
+	for _, child := range q.children {
+		if child.bounds.Contains(n.Latitude, n.Longitude) {
+			child.insert(n, depth+1)
+			return
+		}
+	}
+}
+
+// subdivide splits a leaf into four children and moves its nodes
+// into them.
+func (q *quadTree) subdivide(depth int) {
+	b := q.bounds
+	midLat := (b.MinLat + b.MaxLat) / 2
+	midLon := (b.MinLon + b.MaxLon) / 2
+	q.children = []*quadTree{
+		newQuadTree(Bounds{b.MinLat, b.MinLon, midLat, midLon}),
+		newQuadTree(Bounds{b.MinLat, midLon, midLat, b.MaxLon}),
+		newQuadTree(Bounds{midLat, b.MinLon, b.MaxLat, midLon}),
+		newQuadTree(Bounds{midLat, midLon, b.MaxLat, b.MaxLon}),
+	}
+	nodes := q.nodes
+	q.nodes = nil
+	for _, n := range nodes {
+		q.insert(n, depth)
+	}
+}
+
+// search calls fn for every node in the tree which is within the
+// given bounds.
+func (q *quadTree) search(b Bounds, fn func(*Node)) {
+	if !q.bounds.Intersects(b) {
+		return
+	}
+	for _, n := range q.nodes {
+		if b.Contains(n.Latitude, n.Longitude) {
+			fn(n)
+		}
+	}
+	for _, child := range q.children {
+		child.search(b, fn)
+	}
+}
+
+// SpatialIndex is an in-memory quadtree of all nodes in the
+// database. Any change to the nodes should be followed by a call to
+// Invalidate(), which will cause the index to be rebuilt on next
+// use. It is safe for concurrent use.
+type SpatialIndex struct {
+	mutex      sync.RWMutex
+	tree       *quadTree
+	generation uint64 // incremented by Invalidate
+	built      uint64 // generation at which tree was built
+}
+
+// Invalidate marks the index as outdated.
+func (idx *SpatialIndex) Invalidate() {
+	idx.mutex.Lock()
+	idx.generation++
+	idx.mutex.Unlock()
+}
+
+// current returns an up-to-date tree, rebuilding it from the database
+// if necessary.
+func (idx *SpatialIndex) current() (tree *quadTree, err error) {
+	idx.mutex.RLock()
+	tree, generation := idx.tree, idx.generation
+	if tree != nil && idx.built == generation {
+		idx.mutex.RUnlock()
+		return tree, nil
+	}
+	idx.mutex.RUnlock()
+
+	nodes, err := Db.DumpNodes()
+	if err != nil {
+		return nil, err
+	}
+	tree = newQuadTree(Bounds{-90, -180, 90, 180})
+	for _, n := range nodes {
+		if n != nil {
+			tree.insert(n, 0)
+		}
+	}
+
+	// Only keep the tree if nothing changed while it was being
+	// built. Otherwise, it will be rebuilt on the next use.
+	idx.mutex.Lock()
+	if idx.generation == generation {
+		idx.tree, idx.built = tree, generation
+	}
+	idx.mutex.Unlock()
+	return tree, nil
+}
+
+// Within returns all nodes within the given bounds. The returned
+// nodes are shared with the index, and must not be modified.
+func (idx *SpatialIndex) Within(b Bounds) (nodes []*Node, err error) {
+	tree, err := idx.current()
+	if err != nil {
+		return
+	}
+	nodes = make([]*Node, 0)
+	tree.search(b, func(n *Node) {
+		nodes = append(nodes, n)
+	})
+	return
+}
+
+// NearNode is a node and its distance from a point.
+type NearNode struct {
+	*Node
+	Distance float64
+}
+
+// Near returns up to limit nodes within the given distance (in
+// meters) of the given point, closest first, which are selected by the
+// filter, if it is not nil. If limit is zero, all such nodes are
+// returned.
+func (idx *SpatialIndex) Near(lat, lon, meters float64, limit int,
+	f *NodeFilter) (near []NearNode, err error) {
+	nodes, err := idx.Within(BoundsAround(lat, lon, meters))
+	if err != nil {
+		return
+	}
+	near = make([]NearNode, 0, len(nodes))
+	for _, n := range nodes {
+		d := Distance(lat, lon, n.Latitude, n.Longitude)
+		if d <= meters && f.Match(n) {
+			near = append(near, NearNode{n, d})
+		}
+	}
+	sort.Sort(byDistance(near))
+	if limit > 0 && len(near) > limit {
+		near = near[:limit]
+	}
+	return
+}
+
+type byDistance []NearNode
+
+func (s byDistance) Len() int           { return len(s) }
+func (s byDistance) Less(i, j int) bool { return s[i].Distance < s[j].Distance }
+func (s byDistance) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Cluster is a group of nodes which are close together at a
+// particular zoom level. If it contains only one node, Node is set.
+type Cluster struct {
+	Latitude, Longitude float64
+	Count               int
+	Node                *Node `json:",omitempty"`
+}
+
+// gridCellSize returns the size in degrees of a square cell which is
+// the given number of pixels wide at the given Leaflet zoom level.
+func gridCellSize(zoom, pixels int) float64 {
+	// A 256 pixel tile spans 360 degrees of longitude at zoom 0, and
+	// half as much at every subsequent level.
+	return float64(pixels) * 360 / (256 * math.Pow(2, float64(zoom)))
+}
+
+// Clusters groups the nodes within the given bounds into square cells
+// whose size is the given radius (in pixels) at the given Leaflet
+// zoom level, and returns one Cluster per non-empty cell, positioned
+// at the average of its nodes' coordinates.
+func (idx *SpatialIndex) Clusters(b Bounds, zoom, radius int) (clusters []*Cluster, err error) {
+	nodes, err := idx.Within(b)
+	if err != nil {
+		return
+	}
+
+	cellSize := gridCellSize(zoom, radius)
+
+	type cell struct{ x, y int64 }
+	cells := make(map[cell]*Cluster)
+	clusters = make([]*Cluster, 0)
+	for _, n := range nodes {
+		c := cell{
+			int64(math.Floor(n.Longitude / cellSize)),
+			int64(math.Floor(n.Latitude / cellSize)),
+		}
+		cluster, ok := cells[c]
+		if !ok {
+			cluster = &Cluster{}
+			cells[c] = cluster
+			clusters = append(clusters, cluster)
+		}
+		cluster.Latitude += n.Latitude
+		cluster.Longitude += n.Longitude
+		cluster.Count++
+		cluster.Node = n
+	}
+	for _, cluster := range clusters {
+		cluster.Latitude /= float64(cluster.Count)
+		cluster.Longitude /= float64(cluster.Count)
+		if cluster.Count > 1 {
+			cluster.Node = nil
+		}
+	}
+	return
+}
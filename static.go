@@ -43,23 +43,48 @@ func CompileStatic(dir string, conf *Config) (tmpdir string, err error) {
 		return
 	}
 
+	// Load the locales, so that templates can be translated into
+	// the default locale.
+	locales, err := LoadThemeLocales(dir, conf.Theme)
+	if err != nil {
+		return
+	}
+	funcs := localeFuncs(locales, conf.DefaultLocale())
+
 	// Now, process the files one at a time, writing the result to
 	// `<tmpdir>/path/to/file`. The path is the path to the file
 	// within the given dir.
-	err = processFiles(files, metaData{conf, Version}, tmpdir, dir)
+	err = processFiles(files, metaData{conf, Version}, funcs, tmpdir, dir)
 	if err != nil {
 		return
 	}
 
+	// If there is a theme, process its files in the same way, so that
+	// each replaces the default file of the same name, and any files
+	// it doesn't contain fall back to the defaults.
+	if len(conf.Theme) > 0 {
+		theme := path.Clean(conf.Theme)
+		themeFiles := make([]string, 0)
+		err = crawlDirectories(&themeFiles, tmpdir, theme)
+		if err != nil {
+			return
+		}
+		err = processFiles(themeFiles, metaData{conf, Version}, funcs,
+			tmpdir, theme)
+		if err != nil {
+			return
+		}
+	}
+
 	return
 }
 
 // processFiles uses the file extension(s) to transform each file,
 // placing the result in the outdir with the same path, with the
 // prefix sliced off from the filename. Templates are executed with
-// conf as data.It will panic if any of the files are shorter than
-// len(prefix).
-func processFiles(files []string, data metaData,
+// conf as data, and may use the given funcs. It will panic if any of
+// the files are shorter than len(prefix).
+func processFiles(files []string, data metaData, funcs template.FuncMap,
 	outdir, prefix string) error {
 	for _, filename := range files {
 		// Now, process based on file extension.
@@ -75,7 +100,8 @@ func processFiles(files []string, data metaData,
 			defer out.Close()
 
 			// Next, parse the template from the file.
-			t, err := template.ParseFiles(filename)
+			t, err := template.New(path.Base(filename)).Funcs(funcs).
+				ParseFiles(filename)
 			if err != nil {
 				return err
 			}
@@ -150,8 +176,10 @@ func crawlDirectories(files *[]string, tmpdir, dir string) (err error) {
 			newFiles = append(newFiles, path.Join(dir, fi.Name()))
 		} else {
 			// If a directory...
+			// It may already exist, if a theme is being
+			// compiled over the default files.
 			newdir := path.Join(tmpdir, fi.Name())
-			err = os.Mkdir(newdir, 0777)
+			err = os.MkdirAll(newdir, 0777)
 			if err != nil {
 				return
 			}
@@ -0,0 +1,264 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+const (
+	// DefaultMapImageWidth and DefaultMapImageHeight are the size in
+	// pixels of static map images if none is given.
+	DefaultMapImageWidth  = 600
+	DefaultMapImageHeight = 400
+
+	// MaxMapImageSize is the largest allowed width or height of a
+	// static map image, in pixels.
+	MaxMapImageSize = 2048
+
+	// maxMercatorLatitude is the latitude beyond which the Web
+	// Mercator projection used by tileservers is cut off.
+	maxMercatorLatitude = 85.0511287798
+)
+
+// markerAnchorX and markerAnchorY are the pixel offsets of the point
+// of the marker icons, matching the iconAnchor of NodeIcon in
+// icon.js.
+const (
+	markerAnchorX = 15
+	markerAnchorY = 35
+)
+
+// worldSize returns the width and height of the whole world in pixels
+// at the given zoom level.
+func worldSize(zoom int) float64 {
+	return TileSize * math.Pow(2, float64(zoom))
+}
+
+// project converts coordinates to Web Mercator pixel coordinates at
+// the given zoom level.
+func project(lat, lon float64, zoom int) (x, y float64) {
+	lat = math.Max(-maxMercatorLatitude, math.Min(maxMercatorLatitude, lat))
+	rlat := lat * math.Pi / 180
+	size := worldSize(zoom)
+	x = (lon + 180) / 360 * size
+	y = (1 - math.Log(math.Tan(rlat)+1/math.Cos(rlat))/math.Pi) / 2 * size
+	return
+}
+
+// unproject converts Web Mercator pixel coordinates at the given zoom
+// level to coordinates.
+func unproject(x, y float64, zoom int) (lat, lon float64) {
+	size := worldSize(zoom)
+	lon = x/size*360 - 180
+	lat = math.Atan(math.Sinh(math.Pi*(1-2*y/size))) * 180 / math.Pi
+	return
+}
+
+// FitBounds returns the center and the highest zoom level at which
+// the given bounds fit within an image of the given size.
+func FitBounds(b Bounds, width, height int) (lat, lon float64, zoom int) {
+	for zoom = MaxTileZoom; zoom > 0; zoom-- {
+		minX, minY := project(b.MaxLat, b.MinLon, zoom)
+		maxX, maxY := project(b.MinLat, b.MaxLon, zoom)
+		if maxX-minX <= float64(width) && maxY-minY <= float64(height) {
+			break
+		}
+	}
+	minX, minY := project(b.MaxLat, b.MinLon, zoom)
+	maxX, maxY := project(b.MinLat, b.MaxLon, zoom)
+	lat, lon = unproject((minX+maxX)/2, (minY+maxY)/2, zoom)
+	return
+}
+
+// RenderMap draws the map tiles and node markers of the area centered
+// on the given coordinates at the given zoom level. Tiles which can't
+// be retrieved are left blank.
+func RenderMap(lat, lon float64, zoom, width, height int) (*image.RGBA, error) {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.Gray{0xDD}},
+		image.ZP, draw.Src)
+
+	// Find the pixel coordinates of the top left corner of the
+	// image, then draw every tile which overlaps it.
+	cx, cy := project(lat, lon, zoom)
+	originX := int(math.Floor(cx)) - width/2
+	originY := int(math.Floor(cy)) - height/2
+
+	tiles := 1 << uint(zoom)
+	minTX, maxTX := floorDiv(originX, TileSize), floorDiv(originX+width-1, TileSize)
+	minTY, maxTY := floorDiv(originY, TileSize), floorDiv(originY+height-1, TileSize)
+	for ty := minTY; ty <= maxTY; ty++ {
+		if ty < 0 || ty >= tiles {
+			continue
+		}
+		for tx := minTX; tx <= maxTX; tx++ {
+			// Wrap around the antimeridian.
+			x := ((tx % tiles) + tiles) % tiles
+			tile, err := loadTile(zoom, x, ty)
+			if err != nil {
+				l.Warningf("Error loading tile %d/%d/%d: %s",
+					zoom, x, ty, err)
+				continue
+			}
+			p := image.Pt(tx*TileSize-originX, ty*TileSize-originY)
+			draw.Draw(img, tile.Bounds().Add(p), tile, tile.Bounds().Min,
+				draw.Src)
+		}
+	}
+
+	// Find the nodes in view, including some just outside of it,
+	// whose markers may overlap the edges.
+	minLat, minLon := unproject(float64(originX-TileSize/4),
+		float64(originY+height+TileSize/4), zoom)
+	maxLat, maxLon := unproject(float64(originX+width+TileSize/4),
+		float64(originY-TileSize/4), zoom)
+	nodes, err := Index.Within(Bounds{minLat, minLon, maxLat, maxLon})
+	if err != nil {
+		return nil, err
+	}
+
+	// Draw northern nodes first, so that southern ones overlap them,
+	// as on the interactive map.
+	sort.Sort(byLatitude(nodes))
+	icons := loadMarkerIcons()
+	for _, n := range nodes {
+		icon := icons[markerIconName(n)]
+		if icon == nil {
+			continue
+		}
+		x, y := project(n.Latitude, n.Longitude, zoom)
+		p := image.Pt(int(x)-originX-markerAnchorX,
+			int(y)-originY-markerAnchorY)
+		if shadow := icons["shadow.png"]; shadow != nil {
+			draw.Draw(img, shadow.Bounds().Add(p), shadow,
+				shadow.Bounds().Min, draw.Over)
+		}
+		draw.Draw(img, icon.Bounds().Add(p), icon, icon.Bounds().Min,
+			draw.Over)
+	}
+	return img, nil
+}
+
+// floorDiv returns a/b, rounded toward negative infinity.
+func floorDiv(a, b int) int {
+	if a < 0 {
+		return (a - b + 1) / b
+	}
+	return a / b
+}
+
+// loadTile retrieves and decodes a tile.
+func loadTile(z, x, y int) (image.Image, error) {
+	data, err := GetTile(z, x, y)
+	if err != nil {
+		return nil, err
+	}
+	tile, _, err := image.Decode(bytes.NewReader(data))
+	return tile, err
+}
+
+// markerIconName returns the filename of the icon used for the node
+// on the map, following createMarker in layers.js.
+func markerIconName(n *Node) string {
+	if n.Status&StatusActive == 0 {
+		return "inactive.png"
+	} else if n.Status&StatusPhysical == 0 {
+		return "vps.png"
+	}
+	return "node.png"
+}
+
+// loadMarkerIcons reads the marker icons from the compiled static
+// directory. Icons which can't be read are left out.
+func loadMarkerIcons() map[string]image.Image {
+	icons := make(map[string]image.Image)
+	for _, name := range []string{
+		"node.png", "inactive.png", "vps.png", "shadow.png"} {
+		f, err := os.Open(filepath.Join(StaticDir, "web", "img", name))
+		if err != nil {
+			l.Warningf("Error loading marker icon: %s", err)
+			continue
+		}
+		icon, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			l.Warningf("Error decoding marker icon %q: %s", name, err)
+			continue
+		}
+		icons[name] = icon
+	}
+	return icons
+}
+
+type byLatitude []*Node
+
+func (s byLatitude) Len() int           { return len(s) }
+func (s byLatitude) Less(i, j int) bool { return s[i].Latitude > s[j].Latitude }
+func (s byLatitude) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// HandleMapImage serves a PNG static map of the nodes, for use where
+// an interactive map isn't possible. The form value `bbox`, of the
+// form "minLon,minLat,maxLon,maxLat", sets the area to be shown. If
+// it is not given, the map's default center and zoom are used.
+// `width` and `height` set the size of the image in pixels.
+func HandleMapImage(w http.ResponseWriter, r *http.Request) {
+	width, height := DefaultMapImageWidth, DefaultMapImageHeight
+	for _, dim := range []struct {
+		name string
+		v    *int
+	}{{"width", &width}, {"height", &height}} {
+		s := r.FormValue(dim.name)
+		if len(s) == 0 {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > MaxMapImageSize {
+			http.Error(w, dim.name+"Invalid", http.StatusBadRequest)
+			return
+		}
+		*dim.v = n
+	}
+
+	lat, lon := Conf.Map.Center.Latitude, Conf.Map.Center.Longitude
+	zoom := Conf.Map.Zoom
+	if s := r.FormValue("bbox"); len(s) > 0 {
+		b, err := ParseBounds(s)
+		if err != nil {
+			http.Error(w, "bboxInvalid", http.StatusBadRequest)
+			return
+		}
+		lat, lon, zoom = FitBounds(b, width, height)
+	}
+
+	img, err := RenderMap(lat, lon, zoom, width, height)
+	if err != nil {
+		l.Errf("Error rendering static map: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	if err = png.Encode(buf, img); err != nil {
+		l.Errf("Error encoding static map: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "max-age=300")
+	w.Write(buf.Bytes())
+}
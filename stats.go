@@ -0,0 +1,154 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"github.com/coocood/jas"
+	"time"
+)
+
+// Stats is the JAS resource which serves aggregate statistics about
+// the nodes, at "/api/stats/<name>".
+type Stats struct{}
+
+// GroupStats are the counts of nodes in a group, such as a region.
+type GroupStats struct {
+	// Name is the name of the group.
+	Name string
+
+	// Total is the number of nodes in the group.
+	Total int
+
+	// New is the number of local nodes in the group which were added
+	// after the requested time.
+	New int
+
+	// Statuses are the number of nodes with each status flag, keyed
+	// by the names given by StatusNames.
+	Statuses map[string]int
+}
+
+// groupNodes counts all nodes into groups, as named by the given
+// function, in the order in which the groups are first seen. Nodes
+// for which it returns an empty name are counted in ungrouped. If
+// since is not zero, nodes first recorded after it are counted as
+// New.
+func groupNodes(group func(*Node) string, since time.Time) (groups []*GroupStats, ungrouped *GroupStats, err error) {
+	nodes, err := Db.DumpNodes()
+	if err != nil {
+		return
+	}
+	var first map[string]time.Time
+	if !since.IsZero() {
+		if first, err = Db.FirstRecorded(); err != nil {
+			return
+		}
+	}
+
+	ungrouped = &GroupStats{Statuses: make(map[string]int)}
+	byName := make(map[string]*GroupStats)
+	groups = make([]*GroupStats, 0)
+	for _, n := range nodes {
+		if n == nil {
+			continue
+		}
+		stats := ungrouped
+		if name := group(n); len(name) > 0 {
+			stats = byName[name]
+			if stats == nil {
+				stats = &GroupStats{
+					Name:     name,
+					Statuses: make(map[string]int),
+				}
+				byName[name] = stats
+				groups = append(groups, stats)
+			}
+		}
+
+		stats.Total++
+		for _, status := range StatusNames(n.Status) {
+			stats.Statuses[status]++
+		}
+		if t, ok := first[n.Addr.String()]; ok && t.After(since) {
+			stats.New++
+		}
+	}
+	return
+}
+
+// findSince retrieves the optional `since` form value, a Unix time in
+// seconds. If it is not given, the zero time is returned.
+func findSince(ctx *jas.Context) time.Time {
+	if since, err := ctx.FindPositiveInt("since"); err == nil && since > 0 {
+		return time.Unix(since, 0)
+	}
+	return time.Time{}
+}
+
+// GetRegions responds with the number of nodes in each configured
+// region, and of each status. Nodes outside of every region are
+// counted in "Unassigned". If `since` is given, the number of local
+// nodes added after that Unix time is also counted, for tracking
+// growth.
+func (*Stats) GetRegions(ctx *jas.Context) {
+	regions := Regions
+	groups, unassigned, err := groupNodes(func(n *Node) string {
+		for _, r := range regions {
+			if r.Contains(n.Latitude, n.Longitude) {
+				return r.Name
+			}
+		}
+		return ""
+	}, findSince(ctx))
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf(
+			"Error computing region statistics: %s", err)
+		return
+	}
+
+	// List the regions in the order in which they're configured, and
+	// include empty ones.
+	byName := make(map[string]*GroupStats, len(groups))
+	for _, g := range groups {
+		byName[g.Name] = g
+	}
+	ordered := make([]*GroupStats, 0, len(regions))
+	for _, r := range regions {
+		g, ok := byName[r.Name]
+		if ok && g == nil {
+			// Several regions may share a name, such as the
+			// islands of a borough, but each is only listed once.
+			continue
+		} else if g == nil {
+			g = &GroupStats{Name: r.Name, Statuses: make(map[string]int)}
+		}
+		ordered = append(ordered, g)
+		byName[r.Name] = nil
+	}
+
+	ctx.Data = map[string]interface{}{
+		"Regions":    ordered,
+		"Unassigned": unassigned,
+	}
+}
+
+// GetNeighborhoods responds with the number of local nodes in each
+// neighborhood found by the geocoder, and of each status, in the same
+// form as GetRegions.
+func (*Stats) GetNeighborhoods(ctx *jas.Context) {
+	groups, unknown, err := groupNodes(func(n *Node) string {
+		return n.Neighborhood
+	}, findSince(ctx))
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf(
+			"Error computing neighborhood statistics: %s", err)
+		return
+	}
+	ctx.Data = map[string]interface{}{
+		"Neighborhoods": groups,
+		"Unknown":       unknown,
+	}
+}
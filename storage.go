@@ -0,0 +1,107 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	StorageDisabledError = errors.New("storage is not configured")
+	InvalidObjectError   = errors.New("invalid object name")
+)
+
+// Storage stores uploaded files, such as photos, by name. Names are
+// slash-separated paths, such as "photos/1a2b3c.jpg".
+type Storage interface {
+	// Put stores the data read from r under the given name,
+	// replacing any existing object.
+	Put(name, contentType string, r io.Reader) error
+
+	// Get opens the object with the given name. If there is no such
+	// object, the error satisfies os.IsNotExist.
+	Get(name string) (io.ReadCloser, error)
+
+	// Delete removes the object with the given name. It is not an
+	// error if it does not exist.
+	Delete(name string) error
+}
+
+// NewStorage returns the Storage described by the configuration, or
+// StorageDisabledError if there is none. If both an S3 bucket and a
+// directory are configured, the bucket is used.
+func NewStorage(c StorageConfig) (Storage, error) {
+	if c.S3 != nil {
+		if len(c.S3.Endpoint) == 0 || len(c.S3.Bucket) == 0 {
+			return nil, errors.New("s3 storage needs an endpoint and bucket")
+		}
+		return c.S3, nil
+	}
+	if len(c.Dir) > 0 {
+		return DiskStorage(c.Dir), nil
+	}
+	return nil, StorageDisabledError
+}
+
+// DiskStorage stores objects as files beneath a local directory.
+type DiskStorage string
+
+// path returns the path of the file in which the named object is
+// stored. Names which would escape the directory are rejected.
+func (d DiskStorage) path(name string) (string, error) {
+	clean := filepath.Clean("/" + name)
+	if clean == "/" || strings.Contains(name, "..") {
+		return "", InvalidObjectError
+	}
+	return filepath.Join(string(d), filepath.FromSlash(clean)), nil
+}
+
+// Put writes the object to a temporary file, and then renames it, so
+// that partially written objects are never read.
+func (d DiskStorage) Put(name, contentType string, r io.Reader) (err error) {
+	p, err := d.path(name)
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), ".upload")
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (d DiskStorage) Get(name string) (io.ReadCloser, error) {
+	p, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (d DiskStorage) Delete(name string) error {
+	p, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(p); os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,524 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/coocood/jas"
+	"html"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxPhotosPerSurvey is the largest number of photos which may be
+// submitted with a survey point.
+const MaxPhotosPerSurvey = 5
+
+// Survey is a point surveyed by a volunteer, such as a rooftop which
+// might host a node, with notes on what can be seen from it. Survey
+// points are shown as their own layer on the map, and an admin can
+// convert one into a planned node.
+type Survey struct {
+	ID                  int64
+	Latitude, Longitude float64
+
+	// Name is the name of the volunteer who surveyed the point, if
+	// they gave one.
+	Name  string `json:",omitempty"`
+	Notes string `json:",omitempty"`
+
+	// Visible are the addresses of the nodes which can be seen from
+	// the point.
+	Visible []IP
+
+	Photos  []*Photo
+	Created time.Time
+
+	// Converted is the address of the planned node which the survey
+	// point became, if it has been converted.
+	Converted IP `json:",omitempty"`
+}
+
+// SetSurveyURLs sets the URL and ThumbnailURL of the photo, which
+// belongs to the survey point with the given ID.
+func (p *Photo) SetSurveyURLs(id int64) {
+	base := path.Join("/", Conf.Web.Prefix, "api", "surveys",
+		strconv.FormatInt(id, 10), "photos")
+	p.URL = base + "/" + path.Base(p.objectName())
+	p.ThumbnailURL = base + "/" + path.Base(p.thumbnailName())
+}
+
+// AddSurvey records the survey point, without its photos.
+func (db DB) AddSurvey(s *Survey) (err error) {
+	visible := make([]string, len(s.Visible))
+	for i, addr := range s.Visible {
+		visible[i] = addr.String()
+	}
+	_, err = db.Exec(`INSERT INTO surveys
+(id, lat, lon, name, notes, visible, created)
+VALUES(?, ?, ?, ?, ?, ?, ?);`, s.ID, s.Latitude, s.Longitude, s.Name,
+		s.Notes, strings.Join(visible, ","), s.Created.Unix())
+	return
+}
+
+// AddSurveyPhoto records a photo of the survey point with the given
+// ID.
+func (db DB) AddSurveyPhoto(id int64, p *Photo) (err error) {
+	_, err = db.Exec(`INSERT INTO survey_photos
+(id, survey, type, caption, uploaded)
+VALUES(?, ?, ?, ?, ?);`, p.ID, id, p.Type, p.Caption, p.Uploaded.Unix())
+	return
+}
+
+// Surveys returns the survey points which have not been converted into
+// nodes, oldest first, with their photos. If all is true, converted
+// ones are given as well.
+func (db DB) Surveys(all bool) (surveys []*Survey, err error) {
+	rows, err := db.Query(`SELECT id,lat,lon,name,notes,visible,created,
+converted
+FROM surveys
+WHERE ? OR converted IS NULL
+ORDER BY created;`, all)
+	if err != nil {
+		return
+	}
+	surveys, err = scanSurveys(rows)
+	if err != nil {
+		return
+	}
+	for _, s := range surveys {
+		if s.Photos, err = db.SurveyPhotos(s.ID); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// GetSurvey returns the survey point with the given ID, with its
+// photos. If there is none, both return values are nil.
+func (db DB) GetSurvey(id int64) (s *Survey, err error) {
+	rows, err := db.Query(`SELECT id,lat,lon,name,notes,visible,created,
+converted
+FROM surveys
+WHERE id = ?;`, id)
+	if err != nil {
+		return
+	}
+	surveys, err := scanSurveys(rows)
+	if err != nil || len(surveys) == 0 {
+		return nil, err
+	}
+	s = surveys[0]
+	s.Photos, err = db.SurveyPhotos(id)
+	return
+}
+
+// scanSurveys reads survey points from the rows, and closes them.
+func scanSurveys(rows *sql.Rows) (surveys []*Survey, err error) {
+	defer rows.Close()
+	surveys = make([]*Survey, 0)
+	for rows.Next() {
+		s := new(Survey)
+		var name, notes, visible sql.NullString
+		var created int64
+		var converted []byte
+		err = rows.Scan(&s.ID, &s.Latitude, &s.Longitude, &name, &notes,
+			&visible, &created, &converted)
+		if err != nil {
+			return
+		}
+		s.Name, s.Notes = name.String, notes.String
+		s.Created = time.Unix(created, 0)
+		s.Visible = make([]IP, 0)
+		for _, v := range strings.Split(visible.String, ",") {
+			if addr := ParseIP(v); addr != nil {
+				s.Visible = append(s.Visible, addr)
+			}
+		}
+		if len(converted) > 0 {
+			s.Converted = IP(converted)
+		}
+		surveys = append(surveys, s)
+	}
+	return surveys, rows.Err()
+}
+
+// SurveyPhotos returns the photos of the survey point with the given
+// ID, oldest first, with their URLs set.
+func (db DB) SurveyPhotos(id int64) (photos []*Photo, err error) {
+	rows, err := db.Query(`SELECT id,type,caption,uploaded
+FROM survey_photos
+WHERE survey = ?
+ORDER BY uploaded;`, id)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	photos = make([]*Photo, 0)
+	for rows.Next() {
+		p := new(Photo)
+		var caption sql.NullString
+		var uploaded int64
+		if err = rows.Scan(&p.ID, &p.Type, &caption, &uploaded); err != nil {
+			return
+		}
+		p.Caption = caption.String
+		p.Uploaded = time.Unix(uploaded, 0)
+		p.SetSurveyURLs(id)
+		photos = append(photos, p)
+	}
+	return photos, rows.Err()
+}
+
+// ConvertSurvey records that the survey point with the given ID has
+// become the local node with the given address, and gives its photos
+// to the node, in a single transaction.
+func (db DB) ConvertSurvey(id int64, addr IP) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.Exec(`INSERT INTO photos
+(id, address, type, caption, uploaded)
+SELECT id, ?, type, caption, uploaded
+FROM survey_photos
+WHERE survey = ?;`, []byte(addr), id)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(`DELETE FROM survey_photos
+WHERE survey = ?;`, id)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(`UPDATE surveys SET converted = ?
+WHERE id = ?;`, []byte(addr), id)
+	if err != nil {
+		return
+	}
+	return tx.Commit()
+}
+
+// RemoveSurvey deletes the photos of the survey point with the given ID
+// from storage, and then removes it and their records.
+func (db DB) RemoveSurvey(id int64) (err error) {
+	photos, err := db.SurveyPhotos(id)
+	if err != nil {
+		return
+	}
+	for _, p := range photos {
+		deleteStoredPhoto(p)
+	}
+	_, err = db.Exec(`DELETE FROM survey_photos
+WHERE survey = ?;`, id)
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`DELETE FROM surveys
+WHERE id = ?;`, id)
+	return
+}
+
+// HandleSurveys serves "<prefix>/api/surveys". A GET request lists the
+// survey points which have not been converted into nodes as JSON, or
+// every one if `all` is given by an admin. A POST request submits a new
+// survey point from a multipart form, with its `latitude` and
+// `longitude`, and an optional `name`, `notes`, comma-separated
+// addresses of `visible` nodes, and up to MaxPhotosPerSurvey files
+// named "photo". Submissions require a token.
+func HandleSurveys(w http.ResponseWriter, r *http.Request) {
+	db := Db.WithContext(r.Context())
+	switch r.Method {
+	case "GET", "HEAD":
+		_, all := r.URL.Query()["all"]
+		surveys, err := db.Surveys(all && IsAdmin(r))
+		if err != nil {
+			dbLog.Request(r).Errf("Error listing surveys: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(surveys)
+	case "POST":
+		submitSurvey(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+	}
+}
+
+// submitSurvey validates the survey point submitted in the request,
+// stores it and its photos, and responds with it as JSON.
+func submitSurvey(w http.ResponseWriter, r *http.Request) {
+	if Db.ReadOnly {
+		httpError(w, ReadOnlyError)
+		return
+	}
+	db := Db.WithContext(r.Context())
+	// Photos are optional, so the form may be multipart or not.
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") &&
+		!parsePhotoForm(w, r, MaxPhotosPerSurvey) {
+		return
+	}
+	token, err := strconv.ParseUint(r.FormValue("token"), 10, 32)
+	if err != nil || !CheckToken(r.RemoteAddr, uint32(token)) {
+		http.Error(w, "tokenInvalid", http.StatusBadRequest)
+		return
+	}
+
+	id, err := newRandomID()
+	if err != nil {
+		l.Errf("Error generating survey ID: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	s := &Survey{
+		ID:      id,
+		Visible: make([]IP, 0),
+		Created: time.Now(),
+	}
+	s.Latitude, err = strconv.ParseFloat(r.FormValue("latitude"), 64)
+	if err != nil || s.Latitude < -90 || s.Latitude > 90 {
+		http.Error(w, "latitudeInvalid", http.StatusBadRequest)
+		return
+	}
+	s.Longitude, err = strconv.ParseFloat(r.FormValue("longitude"), 64)
+	if err != nil || s.Longitude < -180 || s.Longitude > 180 {
+		http.Error(w, "longitudeInvalid", http.StatusBadRequest)
+		return
+	}
+	if s.Name = r.FormValue("name"); len(s.Name) > 255 {
+		http.Error(w, "nameTooLong", http.StatusBadRequest)
+		return
+	}
+	if s.Notes = r.FormValue("notes"); len(s.Notes) > 1000 {
+		http.Error(w, "notesTooLong", http.StatusBadRequest)
+		return
+	}
+	s.Name, s.Notes = html.EscapeString(s.Name), html.EscapeString(s.Notes)
+	for _, v := range strings.Split(r.FormValue("visible"), ",") {
+		if len(strings.TrimSpace(v)) == 0 {
+			continue
+		}
+		addr := ParseIP(v)
+		if addr == nil {
+			http.Error(w, "visibleInvalid", http.StatusBadRequest)
+			return
+		}
+		s.Visible = append(s.Visible, addr)
+	}
+
+	var files []*Photo
+	if r.MultipartForm != nil {
+		headers := r.MultipartForm.File["photo"]
+		if len(headers) > MaxPhotosPerSurvey {
+			http.Error(w, "tooManyPhotos", http.StatusBadRequest)
+			return
+		} else if _, err := PhotoStorage(); err != nil && len(headers) > 0 {
+			http.Error(w, "photosDisabled", http.StatusNotImplemented)
+			return
+		}
+		for _, header := range headers {
+			f, err := header.Open()
+			if err != nil {
+				http.Error(w, "photoInvalid", http.StatusBadRequest)
+				return
+			}
+			p, data, img, ok := readPhoto(w, f, "")
+			if !ok {
+				for _, stored := range files {
+					deleteStoredPhoto(stored)
+				}
+				return
+			}
+			if err = storePhoto(p, data, img); err != nil {
+				l.Errf("Error storing survey photo: %s", err)
+				for _, stored := range files {
+					deleteStoredPhoto(stored)
+				}
+				http.Error(w,
+					http.StatusText(http.StatusInternalServerError),
+					http.StatusInternalServerError)
+				return
+			}
+			files = append(files, p)
+		}
+	}
+
+	err = db.AddSurvey(s)
+	for i := 0; err == nil && i < len(files); i++ {
+		err = db.AddSurveyPhoto(s.ID, files[i])
+	}
+	if err != nil {
+		dbLog.Request(r).Errf("Error adding survey: %s", err)
+		db.RemoveSurvey(s.ID)
+		for _, p := range files {
+			deleteStoredPhoto(p)
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	for _, p := range files {
+		p.SetSurveyURLs(s.ID)
+	}
+	s.Photos = files
+	if s.Photos == nil {
+		s.Photos = make([]*Photo, 0)
+	}
+	l.Infof("%q submitted survey %d\n", r.RemoteAddr, s.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+// HandleSurvey serves "<prefix>/api/surveys/<id>/photos/<file>", where
+// the file is as for HandleNodePhoto, and "<prefix>/api/surveys/<id>",
+// which is the survey point as JSON. A DELETE request to the latter
+// from an admin removes the survey point and its photos.
+func HandleSurvey(w http.ResponseWriter, r *http.Request) {
+	db := Db.WithContext(r.Context())
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	i := len(parts) - 1
+	for i >= 0 && parts[i] != "surveys" {
+		i--
+	}
+	parts = parts[i+1:]
+	if len(parts) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	s, err := db.GetSurvey(id)
+	if err != nil {
+		dbLog.Request(r).Errf("Error getting survey %d: %s", id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	} else if s == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && (r.Method == "GET" || r.Method == "HEAD"):
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	case len(parts) == 1 && r.Method == "DELETE":
+		if !IsAdmin(r) {
+			http.Error(w, "notAdmin", http.StatusForbidden)
+			return
+		} else if Db.ReadOnly {
+			httpError(w, ReadOnlyError)
+			return
+		}
+		if err = db.RemoveSurvey(id); err != nil {
+			dbLog.Request(r).Errf("Error removing survey %d: %s", id, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3 && parts[1] == "photos":
+		file := parts[2]
+		for _, p := range s.Photos {
+			if strings.HasPrefix(file, p.ID+".") {
+				servePhoto(w, r, p, file)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// PostConvertSurvey converts the survey point with the given `id` into
+// a planned local node, owned by the given `name` and `email`, and
+// gives the node the survey point's photos. If no `address` is given,
+// the next free one is reserved from the address plan. The notes of the
+// survey point become the node's details. Only admins may convert
+// survey points.
+func (*Api) PostConvertSurvey(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	s, err := db.GetSurvey(ctx.RequireInt("id"))
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error getting survey: %s", err)
+		return
+	} else if s == nil {
+		ctx.Error = jas.NewRequestError("invalid id")
+		return
+	} else if s.Converted != nil {
+		ctx.Error = jas.NewRequestError("alreadyConverted")
+		return
+	}
+
+	node := &Node{
+		OwnerName:  html.EscapeString(ctx.RequireStringLen(1, 255, "name")),
+		OwnerEmail: ctx.RequireStringMatch(EmailRegexp, "email"),
+		Latitude:   s.Latitude,
+		Longitude:  s.Longitude,
+		Details:    s.Notes,
+	}
+	if len(node.Details) > 255 {
+		node.Details = node.Details[:255]
+	}
+	if a, _ := ctx.FindString("address"); len(a) > 0 {
+		if node.Addr = ParseIP(a); node.Addr == nil {
+			ctx.Error = jas.NewRequestError("addressInvalid")
+			return
+		}
+	} else {
+		r, err := db.ReserveAddress(node.OwnerEmail)
+		if err != nil {
+			ctx.Error = apiError(ctx.Request, err)
+			return
+		}
+		node.Addr = r.Addr
+	}
+	if err = db.VerifyRegistrant(node); err != nil {
+		ctx.Error = apiError(ctx.Request, err)
+		return
+	}
+
+	if err = db.AddNode(node); err == nil {
+		err = db.ConvertSurvey(s.ID, node.Addr)
+	}
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error converting survey %d: %s",
+			s.ID, err)
+		return
+	}
+	db.Audit(node.Addr, "converted_survey", "admin",
+		strconv.FormatInt(s.ID, 10))
+	apiLog.Request(ctx.Request).Infof("Survey %d converted into node %q\n",
+		s.ID, node.Addr)
+	ctx.Data = publicNode(node)
+}
@@ -0,0 +1,367 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/coocood/jas"
+	"html"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// DefaultTicketBody is the template of the body with which
+	// tickets are filed, if Conf.Tickets.Body is not set. It is the
+	// form of an Open311 GeoReport v2 service request, to which a
+	// service_code and api_key are usually added.
+	DefaultTicketBody = `lat={{.Node.Latitude}}&long={{.Node.Longitude}}` +
+		`&description={{.Description | urlquery}}`
+
+	// DefaultTicketIDField and DefaultTicketStatusField are the
+	// paths to the ID and status of a ticket in the responses of the
+	// ticket system, if Conf.Tickets.IDField or StatusField are not
+	// set. They are those of Open311, which responds with an array
+	// of service requests.
+	DefaultTicketIDField     = "0.service_request_id"
+	DefaultTicketStatusField = "0.status"
+
+	// TicketOpen is the status of a ticket which has been filed, but
+	// whose status has not yet been retrieved.
+	TicketOpen = "open"
+)
+
+var (
+	// ticketClient is the HTTP client used to file and track
+	// tickets.
+	ticketClient = &http.Client{Timeout: 10 * time.Second}
+
+	TicketFieldMissingError = errors.New("field missing from response")
+)
+
+// Ticket is a service request filed with an external ticket system
+// about a local node, such as when it has gone down.
+type Ticket struct {
+	Addr IP `json:"Address"`
+
+	// ID is the reference to the ticket in the external system.
+	ID string
+
+	// Status is the status of the ticket in the external system, or
+	// TicketOpen if it has not been retrieved.
+	Status string
+
+	// Closed is true if the status is one of
+	// Conf.Tickets.ClosedStatuses.
+	Closed bool
+
+	Opened, Updated time.Time
+}
+
+// ticketData is given to the templates of Conf.Tickets.
+type ticketData struct {
+	Node  *Node
+	Since time.Time
+
+	// Name is the name of the instance, Link is the address of the
+	// node's page, and Description is a sentence describing the
+	// problem.
+	Name, Link, Description string
+
+	// ID is the ID of the ticket, when its status is retrieved.
+	ID string
+}
+
+// GetTicket returns the most recent ticket filed about the node with
+// the given address. If there is none, both return values are nil.
+func (db DB) GetTicket(addr IP) (t *Ticket, err error) {
+	t = &Ticket{Addr: addr}
+	var opened, updated int64
+	err = db.QueryRow(`SELECT ticket,status,closed,opened,updated
+FROM tickets
+WHERE address = ?;`, []byte(addr)).Scan(&t.ID, &t.Status, &t.Closed,
+		&opened, &updated)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	t.Opened = time.Unix(opened, 0)
+	t.Updated = time.Unix(updated, 0)
+	return
+}
+
+// SetTicket replaces the ticket of its node.
+func (db DB) SetTicket(t *Ticket) (err error) {
+	_, err = db.Exec(`DELETE FROM tickets
+WHERE address = ?;`, []byte(t.Addr))
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`INSERT INTO tickets
+(address, ticket, status, closed, opened, updated)
+VALUES(?, ?, ?, ?, ?, ?);`, []byte(t.Addr), t.ID, t.Status, t.Closed,
+		t.Opened.Unix(), t.Updated.Unix())
+	return
+}
+
+// OpenTickets returns every ticket which is not closed.
+func (db DB) OpenTickets() (tickets []*Ticket, err error) {
+	rows, err := db.Query(`SELECT address,ticket,status,opened,updated
+FROM tickets
+WHERE closed = ?;`, false)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	tickets = make([]*Ticket, 0)
+	for rows.Next() {
+		t := new(Ticket)
+		var opened, updated int64
+		if err = rows.Scan(&t.Addr, &t.ID, &t.Status, &opened,
+			&updated); err != nil {
+			return
+		}
+		t.Opened = time.Unix(opened, 0)
+		t.Updated = time.Unix(updated, 0)
+		tickets = append(tickets, t)
+	}
+	return tickets, rows.Err()
+}
+
+// ticketRequest sends a request to the ticket system, with the
+// configured headers, and returns the decoded JSON response.
+func ticketRequest(method, url, contentType string, body io.Reader) (v interface{}, err error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return
+	}
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	for name, value := range Conf.Tickets.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := ticketClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, errors.New(resp.Status)
+	}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	err = dec.Decode(&v)
+	return
+}
+
+// ticketField returns the value in the decoded JSON at the given path
+// of object keys and array indexes, separated by dots, such as
+// "0.service_request_id".
+func ticketField(v interface{}, path string) (string, error) {
+	for _, key := range strings.Split(path, ".") {
+		switch value := v.(type) {
+		case map[string]interface{}:
+			v = value[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(value) {
+				return "", TicketFieldMissingError
+			}
+			v = value[i]
+		default:
+			return "", TicketFieldMissingError
+		}
+	}
+	if v == nil {
+		return "", TicketFieldMissingError
+	}
+	return fmt.Sprint(v), nil
+}
+
+// executeTicketTemplate executes the text template with the given
+// data.
+func executeTicketTemplate(text string, data *ticketData) (string, error) {
+	t, err := template.New("ticket").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	buf := new(bytes.Buffer)
+	if err = t.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// isClosedTicketStatus returns true if the status is one of
+// Conf.Tickets.ClosedStatuses, or "closed" if none are set.
+func isClosedTicketStatus(status string) bool {
+	closed := Conf.Tickets.ClosedStatuses
+	if len(closed) == 0 {
+		closed = []string{"closed"}
+	}
+	for _, s := range closed {
+		if strings.EqualFold(s, status) {
+			return true
+		}
+	}
+	return false
+}
+
+// FileTicket files a ticket about the node, which has been down since
+// the given time, with the ticket system at Conf.Tickets.URL, if it is
+// set, and stores its ID with the node. If a ticket about the node is
+// still open, no other is filed. Errors are logged.
+func FileTicket(node *Node, since time.Time) {
+	if len(Conf.Tickets.URL) == 0 {
+		return
+	}
+	if t, err := Db.GetTicket(node.Addr); err != nil {
+		dbLog.Errf("Error getting ticket of %q: %s", node.Addr, err)
+		return
+	} else if t != nil && !t.Closed {
+		return
+	}
+
+	link := NodePageURL(nil, node.Addr)
+	data := &ticketData{
+		Node:  node,
+		Since: since,
+		Name:  Conf.Name,
+		Link:  link,
+		Description: fmt.Sprintf("Node %s (%s) of %s has been down "+
+			"since %s: %s", node.Addr, html.UnescapeString(node.OwnerName),
+			Conf.Name, since.Format(time.RFC1123), link),
+	}
+	text := Conf.Tickets.Body
+	if len(text) == 0 {
+		text = DefaultTicketBody
+	}
+	body, err := executeTicketTemplate(text, data)
+	if err != nil {
+		l.Errf("Error filing ticket of %q: %s", node.Addr, err)
+		return
+	}
+
+	method := Conf.Tickets.Method
+	if len(method) == 0 {
+		method = "POST"
+	}
+	contentType := Conf.Tickets.ContentType
+	if len(contentType) == 0 {
+		contentType = "application/x-www-form-urlencoded"
+	}
+	v, err := ticketRequest(method, Conf.Tickets.URL, contentType,
+		strings.NewReader(body))
+	var id string
+	if err == nil {
+		idField := Conf.Tickets.IDField
+		if len(idField) == 0 {
+			idField = DefaultTicketIDField
+		}
+		id, err = ticketField(v, idField)
+	}
+	if err != nil {
+		l.Errf("Error filing ticket of %q: %s", node.Addr, err)
+		return
+	}
+
+	now := time.Now()
+	t := &Ticket{
+		Addr:    node.Addr,
+		ID:      id,
+		Status:  TicketOpen,
+		Opened:  now,
+		Updated: now,
+	}
+	if err = Db.SetTicket(t); err != nil {
+		dbLog.Errf("Error storing ticket of %q: %s", node.Addr, err)
+		return
+	}
+	Db.Audit(node.Addr, "ticket_filed", "system", id)
+	l.Noticef("Filed ticket %q about node %q\n", id, node.Addr)
+}
+
+// CheckTickets retrieves the status of every open ticket from
+// Conf.Tickets.StatusURL, if it is set, and records it, so that
+// tickets which are closed in the external system are closed here,
+// and another can be filed about the next problem. Errors are logged.
+func CheckTickets() {
+	if len(Conf.Tickets.URL) == 0 || len(Conf.Tickets.StatusURL) == 0 {
+		return
+	}
+	tickets, err := Db.OpenTickets()
+	if err != nil {
+		dbLog.Errf("Error getting open tickets: %s", err)
+		return
+	}
+
+	statusField := Conf.Tickets.StatusField
+	if len(statusField) == 0 {
+		statusField = DefaultTicketStatusField
+	}
+	for _, t := range tickets {
+		url, err := executeTicketTemplate(Conf.Tickets.StatusURL,
+			&ticketData{Name: Conf.Name, ID: t.ID})
+		if err != nil {
+			l.Errf("Error checking ticket %q: %s", t.ID, err)
+			return
+		}
+		v, err := ticketRequest("GET", url, "", nil)
+		var status string
+		if err == nil {
+			status, err = ticketField(v, statusField)
+		}
+		if err != nil {
+			l.Errf("Error checking ticket %q: %s", t.ID, err)
+			continue
+		}
+		if status == t.Status {
+			continue
+		}
+
+		t.Status = status
+		t.Closed = isClosedTicketStatus(status)
+		t.Updated = time.Now()
+		if err = Db.SetTicket(t); err != nil {
+			dbLog.Errf("Error storing ticket of %q: %s", t.Addr, err)
+			continue
+		}
+		if t.Closed {
+			Db.Audit(t.Addr, "ticket_closed", "system", t.ID)
+		}
+	}
+}
+
+// GetTicket returns the most recent ticket filed about the local node
+// with the given `address`, or null if there is none. Only admins may
+// see tickets.
+func (*Api) GetTicket(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	RequireAdmin(ctx)
+	addr := ParseIP(ctx.RequireStringLen(0, 40, "address"))
+	if addr == nil {
+		ctx.Error = jas.NewRequestError("addressInvalid")
+		return
+	}
+	t, err := db.GetTicket(addr)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error getting ticket of %q: %s",
+			addr, err)
+		return
+	}
+	ctx.Data = t
+}
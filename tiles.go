@@ -0,0 +1,239 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TileSize is the width and height in pixels of a map tile.
+	TileSize = 256
+
+	// MaxTileZoom is the highest zoom level for which tiles will be
+	// fetched.
+	MaxTileZoom = 18
+
+	// DefaultTileFetchRate and DefaultTileClientRate are the
+	// default rate limits of the tile proxy, in tiles per second.
+	// See Conf.Map.TileProxy.
+	DefaultTileFetchRate  = 2
+	DefaultTileClientRate = 20
+
+	// maxTileFetchWait is the longest that a tile fetch will wait
+	// for the Tileserver rate limit before giving up.
+	maxTileFetchWait = 10 * time.Second
+
+	// tileSubdomains are substituted in turn for "{s}" in the
+	// Tileserver URL, as Leaflet.js does.
+	tileSubdomains = "abc"
+)
+
+var (
+	InvalidTileError   = errors.New("tile coordinates out of range")
+	TileRateLimitError = errors.New("tileserver rate limit exceeded")
+)
+
+var (
+	// tileClient is used to fetch tiles from the Tileserver.
+	tileClient = &http.Client{Timeout: 30 * time.Second}
+
+	// tileFetchLimiter limits the rate at which tiles are fetched
+	// from the Tileserver, and tileClientLimiter limits the rate at
+	// which the proxy serves tiles to each client. They are created
+	// by initTileLimiters.
+	tileFetchLimiter, tileClientLimiter *RateLimiter
+	tileLimitersOnce                    sync.Once
+)
+
+// initTileLimiters creates the tile rate limiters from the
+// configuration, if they have not already been created.
+func initTileLimiters() {
+	tileLimitersOnce.Do(func() {
+		fetchRate := Conf.Map.TileProxy.FetchRate
+		if fetchRate <= 0 {
+			fetchRate = DefaultTileFetchRate
+		}
+		clientRate := Conf.Map.TileProxy.ClientRate
+		if clientRate <= 0 {
+			clientRate = DefaultTileClientRate
+		}
+		// Allow bursts large enough to load a full screen of tiles.
+		tileFetchLimiter = NewSharedRateLimiter("tiles.fetch", fetchRate, 8)
+		tileClientLimiter = NewSharedRateLimiter("tiles.client", clientRate,
+			100)
+	})
+}
+
+// PublicTileserver returns the tile URL to be used by clients, in the
+// same form as Tileserver. It is the tile proxy if it is enabled, or
+// the Tileserver itself otherwise.
+func (c *Config) PublicTileserver() string {
+	if c.Map.TileProxy.Enabled {
+		return path.Join("/", c.Web.Prefix, "tiles") + "/{z}/{x}/{y}.png"
+	}
+	return c.Map.Tileserver
+}
+
+// TileURL returns the URL of the tile with the given coordinates on
+// the configured Tileserver.
+func TileURL(z, x, y int) string {
+	s := string(tileSubdomains[(x+y)%len(tileSubdomains)])
+	return strings.NewReplacer(
+		"{s}", s,
+		"{z}", strconv.Itoa(z),
+		"{x}", strconv.Itoa(x),
+		"{y}", strconv.Itoa(y),
+	).Replace(Conf.Map.Tileserver)
+}
+
+// tilePath returns the path at which the tile with the given
+// coordinates is cached.
+func tilePath(z, x, y int) string {
+	return filepath.Join(Conf.Map.TileCacheDir,
+		strconv.Itoa(z), strconv.Itoa(x), strconv.Itoa(y)+".png")
+}
+
+// GetTile returns the image data of the tile with the given
+// coordinates. If Conf.Map.TileCacheDir is set, it is read from there
+// if possible, and otherwise fetched from the Tileserver and stored
+// there.
+func GetTile(z, x, y int) (data []byte, err error) {
+	if z < 0 || z > MaxTileZoom || x < 0 || y < 0 ||
+		x >= 1<<uint(z) || y >= 1<<uint(z) {
+		return nil, InvalidTileError
+	}
+
+	if len(Conf.Map.TileCacheDir) > 0 {
+		data, err = ioutil.ReadFile(tilePath(z, x, y))
+		if err == nil {
+			return
+		}
+	}
+
+	data, err = fetchTile(z, x, y)
+	if err != nil || len(Conf.Map.TileCacheDir) == 0 {
+		return
+	}
+
+	// Failing to cache the tile isn't fatal, so just log it.
+	if err := cacheTile(z, x, y, data); err != nil {
+		l.Warningf("Error caching tile %d/%d/%d: %s", z, x, y, err)
+	}
+	return data, nil
+}
+
+// fetchTile retrieves a tile from the Tileserver, waiting for the
+// rate limit if necessary.
+func fetchTile(z, x, y int) (data []byte, err error) {
+	initTileLimiters()
+	wait, ok := tileFetchLimiter.Reserve("", maxTileFetchWait)
+	if !ok {
+		return nil, TileRateLimitError
+	}
+	time.Sleep(wait)
+
+	req, err := http.NewRequest("GET", TileURL(z, x, y), nil)
+	if err != nil {
+		return
+	}
+	// Tile usage policies, such as OpenStreetMap's, require a
+	// User-Agent which identifies the application.
+	req.Header.Set("User-Agent", "NodeAtlas/"+Version)
+
+	resp, err := tileClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tileserver responded %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// cacheTile writes the tile data to Conf.Map.TileCacheDir. It writes
+// to a temporary file first, so that partially written tiles are
+// never read.
+func cacheTile(z, x, y int, data []byte) (err error) {
+	name := tilePath(z, x, y)
+	if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), ".tile")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// RegisterTileProxy invokes http.Handle() with a handler which serves
+// tiles at "<prefix>/tiles/{z}/{x}/{y}.png" through GetTile.
+func RegisterTileProxy(prefix string) {
+	initTileLimiters()
+	base := path.Join("/", prefix, "tiles") + "/"
+	http.HandleFunc(base, func(w http.ResponseWriter, r *http.Request) {
+		if !tileClientLimiter.Allow(r.RemoteAddr) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, http.StatusText(http.StatusTooManyRequests),
+				http.StatusTooManyRequests)
+			return
+		}
+
+		var z, x, y int
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, base), "/")
+		if len(parts) != 3 || !strings.HasSuffix(parts[2], ".png") {
+			http.NotFound(w, r)
+			return
+		}
+		parts[2] = strings.TrimSuffix(parts[2], ".png")
+		for i, v := range []*int{&z, &x, &y} {
+			n, err := strconv.Atoi(parts[i])
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			*v = n
+		}
+
+		data, err := GetTile(z, x, y)
+		switch err {
+		case nil:
+		case InvalidTileError:
+			http.NotFound(w, r)
+			return
+		case TileRateLimitError:
+			w.Header().Set("Retry-After", "10")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		default:
+			l.Warningf("Error fetching tile %d/%d/%d: %s", z, x, y, err)
+			http.Error(w, http.StatusText(http.StatusBadGateway),
+				http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", http.DetectContentType(data))
+		w.Header().Set("Cache-Control", "max-age=86400")
+		w.Write(data)
+	})
+}
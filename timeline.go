@@ -0,0 +1,180 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"github.com/coocood/jas"
+	"time"
+)
+
+const (
+	// DefaultTimelineInterval is the interval of GetTimeline if none
+	// is given.
+	DefaultTimelineInterval = "week"
+
+	// maxTimelineBuckets is the greatest number of buckets which
+	// GetTimeline will give, so that a long range at a short interval
+	// can't produce an enormous response.
+	maxTimelineBuckets = 5000
+)
+
+// TimelineIntervals are the intervals by which GetTimeline can divide
+// time, as the years, months, and days from the start of each bucket
+// to the start of the next.
+var TimelineIntervals = map[string][3]int{
+	"day":   {0, 0, 1},
+	"week":  {0, 0, 7},
+	"month": {0, 1, 0},
+	"year":  {1, 0, 0},
+}
+
+// TimelineBucket is the growth of the local nodes over a span of
+// time, as given by Timeline.
+type TimelineBucket struct {
+	// Start is the time at which the bucket begins. It lasts until
+	// the Start of the next.
+	Start time.Time
+
+	// Total is the number of nodes which had been added by the end of
+	// the bucket, and Active is the number of those which were active
+	// then.
+	Total, Active int
+
+	// Added is the number of nodes which were added during the
+	// bucket, and Activated is the number which became active.
+	Added, Activated int
+
+	// ActivatedNodes are the addresses of the nodes which became
+	// active during the bucket, in order, if they were requested.
+	ActivatedNodes []IP `json:",omitempty"`
+}
+
+// timelineStart returns the start of the bucket of the given interval
+// which contains the time, in UTC. Weeks begin on Monday.
+func timelineStart(t time.Time, interval string) time.Time {
+	y, m, d := t.UTC().Date()
+	switch interval {
+	case "week":
+		day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	case "year":
+		return time.Date(y, time.January, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// Timeline divides the time from one time to another into buckets of
+// the given interval, one of TimelineIntervals, and counts the nodes
+// which were added and activated during each, by replaying the given
+// status changes, oldest first, as from StatusChangesUntil. A node is
+// taken to be added when its status is first recorded. Changes before
+// the first bucket are counted in its totals, but not as added or
+// activated. If withNodes is true, the addresses of the nodes which
+// were activated are given, too. If there would be more than
+// maxTimelineBuckets, it returns false.
+func Timeline(changes []StatusChange, from, to time.Time, interval string,
+	withNodes bool) (buckets []*TimelineBucket, ok bool) {
+	step := TimelineIntervals[interval]
+	statuses := make(map[string]uint32)
+	var total, active int
+	next := 0
+
+	buckets = make([]*TimelineBucket, 0)
+	for start := timelineStart(from, interval); !start.After(to); {
+		if len(buckets) == maxTimelineBuckets {
+			return nil, false
+		}
+		end := start.AddDate(step[0], step[1], step[2])
+		b := &TimelineBucket{Start: start}
+		for ; next < len(changes) && changes[next].Time.Before(end); next++ {
+			c := changes[next]
+			counted := !c.Time.Before(start)
+			last, seen := statuses[c.Addr.String()]
+			statuses[c.Addr.String()] = c.Status
+			if !seen {
+				total++
+				if counted {
+					b.Added++
+				}
+			}
+
+			wasActive := seen && last&StatusActive != 0
+			isActive := c.Status&StatusActive != 0
+			if wasActive && !isActive {
+				active--
+			} else if isActive && !wasActive {
+				active++
+				if counted {
+					b.Activated++
+					if withNodes {
+						b.ActivatedNodes = append(b.ActivatedNodes, c.Addr)
+					}
+				}
+			}
+		}
+		b.Total, b.Active = total, active
+		buckets = append(buckets, b)
+		start = end
+	}
+	return buckets, true
+}
+
+// GetTimeline responds with the growth of the local nodes over time,
+// as given by Timeline, for driving animations of the mesh's growth.
+// `interval` is one of TimelineIntervals, and is DefaultTimelineInterval
+// if it is not given. `from` and `to` limit the range, and default to
+// the first recorded status change and the present. If `nodes` is
+// given, the addresses of the nodes which were activated during each
+// bucket are given as well.
+func (*Api) GetTimeline(ctx *jas.Context) {
+	db := Db.WithContext(ctx.Request.Context())
+	ctx.ParseForm()
+	interval := ctx.FormValue("interval")
+	if len(interval) == 0 {
+		interval = DefaultTimelineInterval
+	} else if _, ok := TimelineIntervals[interval]; !ok {
+		ctx.Error = jas.NewRequestError("intervalInvalid")
+		return
+	}
+
+	var from, to time.Time
+	var err error
+	if s := ctx.FormValue("from"); len(s) > 0 {
+		if from, err = parseTime("from", s); err != nil {
+			ctx.Error = apiError(ctx.Request, err)
+			return
+		}
+	}
+	to = time.Now()
+	if s := ctx.FormValue("to"); len(s) > 0 {
+		if to, err = parseTime("to", s); err != nil {
+			ctx.Error = apiError(ctx.Request, err)
+			return
+		}
+	}
+
+	changes, err := db.StatusChangesUntil(to)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error computing timeline: %s", err)
+		return
+	}
+	if len(changes) == 0 {
+		ctx.Data = []*TimelineBucket{}
+		return
+	}
+	if from.IsZero() {
+		from = changes[0].Time
+	}
+
+	_, withNodes := ctx.Form["nodes"]
+	buckets, ok := Timeline(changes, from, to, interval, withNodes)
+	if !ok {
+		ctx.Error = jas.NewRequestError("intervalInvalid")
+		return
+	}
+	ctx.Data = buckets
+}
@@ -0,0 +1,260 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TopologySource is a source of links between nodes, such as the
+// jsoninfo plugin of an OLSR router.
+type TopologySource struct {
+	// Format is either "olsr", for the output of the OLSR jsoninfo
+	// plugin's /links or /topology, or "batman", for the "jsondoc"
+	// output of batadv-vis.
+	Format string
+
+	// Location is either an HTTP(S) URL or the path of a file, which
+	// is read at every heartbeat.
+	Location string
+}
+
+// topologyClient is the HTTP client used to retrieve topology.
+var topologyClient = &http.Client{Timeout: 30 * time.Second}
+
+var TopologyFormatInvalidError = errors.New("format must be olsr or batman")
+
+// olsrInfo is the subset of the output of the OLSR jsoninfo plugin
+// which is used. Either of Links or Topology may be present.
+type olsrInfo struct {
+	Links []struct {
+		LocalIP             string  `json:"localIP"`
+		RemoteIP            string  `json:"remoteIP"`
+		LinkQuality         float64 `json:"linkQuality"`
+		NeighborLinkQuality float64 `json:"neighborLinkQuality"`
+	} `json:"links"`
+	Topology []struct {
+		LastHopIP           string  `json:"lastHopIP"`
+		DestinationIP       string  `json:"destinationIP"`
+		LinkQuality         float64 `json:"linkQuality"`
+		NeighborLinkQuality float64 `json:"neighborLinkQuality"`
+	} `json:"topology"`
+}
+
+// batmanVis is the subset of the "jsondoc" output of batadv-vis which
+// is used.
+type batmanVis struct {
+	Vis []struct {
+		Primary   string `json:"primary"`
+		Neighbors []struct {
+			Router   string      `json:"router"`
+			Neighbor string      `json:"neighbor"`
+			Metric   json.Number `json:"metric"`
+		} `json:"neighbors"`
+	} `json:"vis"`
+}
+
+// topologyResolver maps router addresses, which may be IP or MAC
+// addresses, to the addresses of local nodes. MAC addresses are those
+// of the interfaces registered for the nodes, and of the equipment
+// deployed at them, and IP addresses may also be those of interfaces.
+type topologyResolver struct {
+	macs  map[string]IP
+	ips   map[string]IP
+	nodes map[string]bool
+}
+
+// newTopologyResolver creates a resolver from the equipment inventory
+// and the interfaces of the nodes. Registered interfaces take
+// precedence over equipment with the same MAC address.
+func newTopologyResolver() (r *topologyResolver, err error) {
+	r = &topologyResolver{
+		macs:  make(map[string]IP),
+		ips:   make(map[string]IP),
+		nodes: make(map[string]bool),
+	}
+	equipment, err := Db.ListEquipment(nil)
+	if err != nil {
+		return
+	}
+	for _, e := range equipment {
+		if len(e.MAC) > 0 && e.Addr != nil {
+			r.macs[e.MAC] = e.Addr
+		}
+	}
+	interfaces, err := Db.ListInterfaces(nil)
+	if err != nil {
+		return
+	}
+	for _, i := range interfaces {
+		r.macs[i.MAC] = i.Addr
+		if i.IP != nil {
+			r.ips[i.IP.String()] = i.Addr
+		}
+	}
+	return
+}
+
+// Resolve returns the address of the local node with the given IP or
+// MAC address, or nil if there is none.
+func (r *topologyResolver) Resolve(s string) IP {
+	var addr IP
+	if mac, err := net.ParseMAC(s); err == nil {
+		addr = r.macs[mac.String()]
+	} else if addr = ParseIP(s); addr != nil {
+		if node, ok := r.ips[addr.String()]; ok {
+			addr = node
+		}
+	}
+	if addr == nil {
+		return nil
+	}
+
+	key := addr.String()
+	local, ok := r.nodes[key]
+	if !ok {
+		_, err := Db.GetLocalNode(addr)
+		if err != nil && err != LocalNodeNotFoundError {
+			dbLog.Errf("Error getting node %q: %s", addr, err)
+		}
+		local = err == nil
+		r.nodes[key] = local
+	}
+	if !local {
+		return nil
+	}
+	return addr
+}
+
+// Read retrieves the source's topology, and returns the links between
+// local nodes which it contains.
+func (s *TopologySource) Read(r *topologyResolver) (links []*Link, err error) {
+	var body io.ReadCloser
+	if strings.HasPrefix(s.Location, "http://") ||
+		strings.HasPrefix(s.Location, "https://") {
+		resp, err := topologyClient.Get(s.Location)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s: %s", s.Location, resp.Status)
+		}
+		body = resp.Body
+	} else {
+		if body, err = os.Open(s.Location); err != nil {
+			return
+		}
+	}
+	defer body.Close()
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	add := func(from, to string, metric float64) {
+		source, target := r.Resolve(from), r.Resolve(to)
+		if source == nil || target == nil ||
+			net.IP(source).Equal(net.IP(target)) {
+			return
+		}
+		// Links are usually reported in both directions, but only
+		// need to be drawn once.
+		if seen[target.String()+" "+source.String()] {
+			return
+		}
+		seen[source.String()+" "+target.String()] = true
+		links = append(links, &Link{
+			Source:  source,
+			Target:  target,
+			Metric:  metric,
+			Updated: now,
+		})
+	}
+
+	switch s.Format {
+	case "olsr":
+		info := new(olsrInfo)
+		if err = json.NewDecoder(body).Decode(info); err != nil {
+			return
+		}
+		for _, link := range info.Links {
+			add(link.LocalIP, link.RemoteIP,
+				etx(link.LinkQuality, link.NeighborLinkQuality))
+		}
+		for _, link := range info.Topology {
+			add(link.LastHopIP, link.DestinationIP,
+				etx(link.LinkQuality, link.NeighborLinkQuality))
+		}
+	case "batman":
+		vis := new(batmanVis)
+		if err = json.NewDecoder(body).Decode(vis); err != nil {
+			return
+		}
+		for _, v := range vis.Vis {
+			for _, n := range v.Neighbors {
+				metric, _ := strconv.ParseFloat(n.Metric.String(), 64)
+				add(v.Primary, n.Neighbor, metric)
+			}
+		}
+	default:
+		return nil, TopologyFormatInvalidError
+	}
+	return
+}
+
+// etx returns the expected transmission count of a link, given its
+// link quality and neighbor link quality, or zero if either is zero.
+func etx(lq, nlq float64) float64 {
+	if lq <= 0 || nlq <= 0 {
+		return 0
+	}
+	return 1 / (lq * nlq)
+}
+
+// ImportTopology reads every source in Conf.Topology, and replaces
+// the links of each format with those which were read. Routers are
+// matched to local nodes by their addresses or those of their
+// interfaces, or, for MAC addresses, by their interfaces and the
+// equipment deployed at them. If any source of a format
+// can't be read, that format's links are left as they are. Errors are
+// logged.
+func ImportTopology() {
+	if len(Conf.Topology) == 0 || Db.ReadOnly {
+		return
+	}
+	r, err := newTopologyResolver()
+	if err != nil {
+		dbLog.Errf("Error listing equipment and interfaces: %s", err)
+		return
+	}
+
+	links := make(map[string][]*Link)
+	failed := make(map[string]bool)
+	for _, s := range Conf.Topology {
+		read, err := s.Read(r)
+		if err != nil {
+			failed[s.Format] = true
+			l.Errf("Error reading %s topology from %q: %s", s.Format,
+				s.Location, err)
+			continue
+		}
+		links[s.Format] = append(links[s.Format], read...)
+	}
+	for format, read := range links {
+		if failed[format] {
+			continue
+		}
+		if err = Db.ReplaceLinks(format, nil, read); err != nil {
+			dbLog.Errf("Error replacing %s links: %s", format, err)
+		}
+	}
+}
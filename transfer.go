@@ -0,0 +1,299 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"github.com/coocood/jas"
+	"html"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Transfer is a pending transfer of a local node to a new owner. It
+// is completed when the new owner confirms it, and expires after
+// Conf.VerificationExpiration.
+type Transfer struct {
+	ID   int64
+	Addr IP
+
+	// Email and Name are those of the new owner. If Name is empty,
+	// the node's owner name is left as is.
+	Email, Name string
+
+	Expiration time.Time
+}
+
+// IsNodeOwner returns true if the request comes from the node with
+// the given address or from an admin, if it carries the node's
+// current `edit_token`, or if its owner is signed in to /my.
+func IsNodeOwner(r *http.Request, addr IP) bool {
+	db := Db.WithContext(r.Context())
+	if net.IP(addr).Equal(net.ParseIP(r.RemoteAddr)) || IsAdmin(r) {
+		return true
+	}
+	if email := SignedInOwner(r); len(email) > 0 {
+		ok, err := db.OwnsNode(addr, email)
+		if err != nil {
+			dbLog.Request(r).Errf("Error checking owner of %q: %s", addr, err)
+		} else if ok {
+			return true
+		}
+	}
+	token := r.FormValue("edit_token")
+	if len(token) == 0 {
+		return false
+	}
+	ok, err := db.CheckEditToken(addr, token)
+	if err != nil {
+		dbLog.Request(r).Errf("Error checking edit token of %q: %s", addr, err)
+		return false
+	}
+	return ok
+}
+
+// CheckEditToken returns true if the given token is the current edit
+// token of the node with the given address. Only the hashes of tokens
+// are stored, and those issued before they were, which were numbers
+// that could be guessed, have none, and so are no longer valid.
+func (db DB) CheckEditToken(addr IP, token string) (ok bool, err error) {
+	var n int
+	err = db.QueryRow(`SELECT COUNT(*)
+FROM edit_tokens
+WHERE address = ? AND hash = ?;`, []byte(addr), secretHash(token)).Scan(&n)
+	return n > 0, err
+}
+
+// RotateEditToken replaces the edit token of the node with the given
+// address with a new random one, as by newSecret, and returns it. The
+// previous token is no longer valid.
+func (db DB) RotateEditToken(addr IP) (token string, err error) {
+	if token, err = newSecret(); err != nil {
+		return
+	}
+	if err = db.RemoveEditToken(addr); err != nil {
+		return
+	}
+	_, err = db.Exec(`INSERT INTO edit_tokens
+(address, token, hash)
+VALUES(?, 0, ?);`, []byte(addr), secretHash(token))
+	return
+}
+
+// RemoveEditToken removes the edit token of the node with the given
+// address, if it has one.
+func (db DB) RemoveEditToken(addr IP) (err error) {
+	_, err = db.Exec(`DELETE FROM edit_tokens
+WHERE address = ?;`, []byte(addr))
+	return
+}
+
+// AddTransfer records a pending transfer, replacing any previous one
+// for the same node.
+func (db DB) AddTransfer(t *Transfer) (err error) {
+	email, err := EncryptEmail(t.Email)
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`DELETE FROM transfers
+WHERE address = ?;`, []byte(t.Addr))
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`INSERT INTO transfers
+(id, address, email, owner, expiration)
+VALUES(?, ?, ?, ?, ?);`, t.ID, []byte(t.Addr), email, t.Name,
+		t.Expiration.Unix())
+	return
+}
+
+// CompleteTransfer gives the node of the pending transfer with the
+// given ID to its new owner, and rotates the node's edit token. It
+// returns the transfer and the new token. If there is no such
+// transfer, or it has expired, it returns sql.ErrNoRows.
+func (db DB) CompleteTransfer(id int64) (t *Transfer, token string,
+	err error) {
+	t = &Transfer{ID: id}
+	var name sql.NullString
+	var expiration int64
+	err = db.QueryRow(`SELECT address,email,owner,expiration
+FROM transfers
+WHERE id = ? AND expiration > ?;`, id, time.Now().Unix()).Scan(
+		&t.Addr, &t.Email, &name, &expiration)
+	if err != nil {
+		return
+	}
+	t.Name = name.String
+	t.Expiration = time.Unix(expiration, 0)
+	if t.Email, err = OpenEmail(t.Email); err != nil {
+		return
+	}
+	email, err := SealEmail(t.Email)
+	if err != nil {
+		return
+	}
+
+	if len(t.Name) > 0 {
+		_, err = db.Exec(`UPDATE nodes SET email = ?, owner = ?,
+version = version + 1, updated_at = ?
+WHERE address = ?;`, email, t.Name, time.Now().Unix(), []byte(t.Addr))
+	} else {
+		_, err = db.Exec(`UPDATE nodes SET email = ?,
+version = version + 1, updated_at = ?
+WHERE address = ?;`, email, time.Now().Unix(), []byte(t.Addr))
+	}
+	if err != nil {
+		return
+	}
+	InvalidateIndexes()
+
+	if _, err = db.Exec(`DELETE FROM transfers
+WHERE id = ?;`, id); err != nil {
+		return
+	}
+	token, err = db.RotateEditToken(t.Addr)
+	return
+}
+
+// DeleteExpiredTransfers removes pending transfers which were not
+// confirmed in time.
+func (db DB) DeleteExpiredTransfers() (err error) {
+	_, err = db.Exec(`DELETE FROM transfers
+WHERE expiration <= ?;`, time.Now().Unix())
+	return
+}
+
+// PostTransferNode begins the transfer of the local node with the
+// given `address` to a new owner, whose `email` is sent a link to
+// confirm it. The new owner's `name` is optional. It requires a token,
+// and must come from the node's address, an admin, or carry the
+// node's `edit_token`.
+func (*Api) PostTransferNode(ctx *jas.Context) {
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	db := Db.WithContext(ctx.Request.Context())
+	RequireToken(ctx)
+	if Conf.SMTP == nil {
+		ctx.Error = jas.NewInternalError(SMTPDisabledError)
+		apiLog.Request(ctx.Request).Err(SMTPDisabledError)
+		return
+	}
+
+	ip := ParseIP(ctx.RequireStringLen(0, 40, "address"))
+	if ip == nil {
+		ctx.Error = jas.NewRequestError("addressInvalid")
+		return
+	}
+	node, err := db.GetLocalNode(ip)
+	if err != nil {
+		ctx.Error = apiError(ctx.Request, err)
+		return
+	}
+	if !IsNodeOwner(ctx.Request, ip) {
+		ctx.Error = jas.NewRequestError(
+			RemoteAddressDoesNotMatchError.Error())
+		return
+	}
+
+	// The ID confirms the transfer, and so must not be guessable.
+	id, err := newRandomID()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Err(err)
+		return
+	}
+	t := &Transfer{
+		ID:    id,
+		Addr:  ip,
+		Email: ctx.RequireStringMatch(EmailRegexp, "email"),
+		Expiration: time.Now().Add(
+			time.Duration(Conf.VerificationExpiration)),
+	}
+	t.Name, _ = ctx.FindStringLen(0, 255, "name")
+	t.Name = html.EscapeString(t.Name)
+	if err = db.AddTransfer(t); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error adding transfer of %q: %s",
+			ip, err)
+		return
+	}
+
+	locale := NegotiateLocale(ctx.Request)
+	e := &Email{
+		To:   t.Email,
+		From: Conf.SMTP.EmailAddress,
+		Subject: Translations.Translate(locale, "email.transfer.subject",
+			Conf.Name),
+		Locale: locale,
+	}
+	e.Data = map[string]interface{}{
+		"Address":    ip.String(),
+		"Name":       Conf.Name,
+		"Link":       BaseURL(ctx.Request),
+		"TransferID": t.ID,
+		"Boundary":   rand.Int31(),
+	}
+	if err = e.Send("transfer.txt"); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		mailLog.Request(ctx.Request).Errf(
+			"Error sending transfer of %q: %s", ip, err)
+		return
+	}
+
+	actor := auditEmail(node.OwnerEmail)
+	if IsAdmin(ctx.Request) {
+		actor = "admin"
+	}
+	db.Audit(ip, "transfer_started", actor, "to "+auditEmail(t.Email))
+	ctx.Data = "successful"
+	apiLog.Request(ctx.Request).Noticef("%q began transfer of %q",
+		ctx.RemoteAddr, ip)
+}
+
+// GetConfirmTransfer completes the transfer with the given `id`, as
+// linked in the email to the new owner. It returns the node's
+// `Address` and its new `EditToken`, which replaces the previous
+// owner's.
+func (*Api) GetConfirmTransfer(ctx *jas.Context) {
+	if Db.ReadOnly {
+		ctx.Error = ReadOnlyError
+		return
+	}
+	db := Db.WithContext(ctx.Request.Context())
+	id := ctx.RequireInt("id")
+
+	// Look up the previous owner first, for the audit log.
+	var previous string
+	err := db.QueryRow(`SELECT nodes.email
+FROM nodes
+INNER JOIN transfers ON nodes.address = transfers.address
+WHERE transfers.id = ?;`, id).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Err(err)
+		return
+	}
+
+	t, token, err := db.CompleteTransfer(id)
+	if err == sql.ErrNoRows {
+		ctx.Error = jas.NewRequestError("invalid id")
+		return
+	} else if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		apiLog.Request(ctx.Request).Errf("Error completing transfer %d: %s",
+			id, err)
+		return
+	}
+
+	db.Audit(t.Addr, "transfer", auditEmail(t.Email), "from "+auditEmail(previous))
+	ctx.Data = map[string]interface{}{
+		"Address":   t.Addr,
+		"EditToken": token,
+	}
+	apiLog.Request(ctx.Request).Noticef("Node %q transferred", t.Addr)
+}
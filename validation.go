@@ -0,0 +1,114 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Daniel Supernault,
+// Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"regexp"
+	"sort"
+)
+
+var (
+	LocationOutOfBoundsError   = errors.New("locationOutOfBounds")
+	AddressOutsideSubnetsError = errors.New("addressOutsideSubnets")
+)
+
+// validatedFields are the fields which can be named in
+// Conf.Validation.Required and Patterns, and return their values from
+// a node. Names and free text are unescaped, so that patterns match
+// what was submitted.
+var validatedFields = map[string]func(n *Node) string{
+	"name":    func(n *Node) string { return html.UnescapeString(n.OwnerName) },
+	"contact": func(n *Node) string { return html.UnescapeString(n.Contact) },
+	"details": func(n *Node) string { return html.UnescapeString(n.Details) },
+	"pgp":     func(n *Node) string { return n.PGP.String() },
+}
+
+func init() {
+	RegisterNodeValidator(ValidateConfigured)
+}
+
+// ValidateConfigured checks the node against the rules in
+// Conf.Validation. It returns an error naming the first field which
+// breaks a rule, such as "locationOutOfBounds",
+// "addressOutsideSubnets", "contactRequired", or "nameInvalid". Rules
+// which are invalid, such as patterns which cannot be compiled, are
+// logged and skipped.
+func ValidateConfigured(node *Node) error {
+	rules := &Conf.Validation
+	if b := rules.Bounds; b != nil &&
+		!b.Contains(node.Latitude, node.Longitude) {
+		return LocationOutOfBoundsError
+	}
+
+	if len(rules.Subnets) > 0 {
+		inside := false
+		for _, subnet := range rules.Subnets {
+			if (*net.IPNet)(subnet).Contains(net.IP(node.Addr)) {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			return AddressOutsideSubnetsError
+		}
+	}
+
+	for _, field := range rules.Required {
+		if get, ok := validatedFields[field]; !ok {
+			l.Warningf("Validation: unknown required field %q\n", field)
+		} else if len(get(node)) == 0 {
+			return errors.New(field + "Required")
+		}
+	}
+
+	// Patterns are checked in order of field name, so that the same
+	// error is always reported first.
+	fields := make([]string, 0, len(rules.Patterns))
+	for field := range rules.Patterns {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		get, ok := validatedFields[field]
+		if !ok {
+			l.Warningf("Validation: unknown pattern field %q\n", field)
+			continue
+		}
+		re, err := regexp.Compile(rules.Patterns[field])
+		if err != nil {
+			l.Warningf("Validation: pattern for %q is invalid: %s\n",
+				field, err)
+			continue
+		}
+		// Empty optional fields are only checked if they are
+		// required.
+		if value := get(node); len(value) > 0 && !re.MatchString(value) {
+			return errors.New(field + "Invalid")
+		}
+	}
+	return nil
+}
+
+// CheckValidationRules returns an error describing the first rule in
+// Conf.Validation which is invalid, if any.
+func CheckValidationRules() error {
+	for _, field := range Conf.Validation.Required {
+		if _, ok := validatedFields[field]; !ok {
+			return fmt.Errorf("unknown required field %q", field)
+		}
+	}
+	for field, pattern := range Conf.Validation.Patterns {
+		if _, ok := validatedFields[field]; !ok {
+			return fmt.Errorf("unknown pattern field %q", field)
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("pattern for %q: %s", field, err)
+		}
+	}
+	return nil
+}
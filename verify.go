@@ -8,25 +8,34 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"github.com/coocood/jas"
 	"math/rand"
 	"net"
 	"net/http"
+	"strconv"
 	"time"
 )
 
 // QueueNode inserts the given node into the verify queue with its
 // expiration time set to the current time plus the grace period, its
 // emailsent field set by the matching argument, and identified by the
-// given ID.
+// given ID. If the node is cached, it is adopted once verified.
 func (db DB) QueueNode(id int64, emailsent bool, grace Duration, node *Node) (err error) {
+	// The email address is needed to resend the verification email,
+	// so it is encrypted even if it will be stored as a hash.
+	email, err := EncryptEmail(node.OwnerEmail)
+	if err != nil {
+		return
+	}
 	_, err = db.Exec(`INSERT INTO nodes_verify_queue
 (id, address, owner, email, contact, details, pgp,
-lat, lon, status, verifysent, expiration)
-VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		id, []byte(node.Addr), node.OwnerName, node.OwnerEmail,
+lat, lon, status, verifysent, expiration, map_id, source)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, []byte(node.Addr), node.OwnerName, email,
 		node.Contact, node.Details, []byte(node.PGP),
 		node.Latitude, node.Longitude, node.Status,
-		emailsent, time.Now().Add(time.Duration(grace)))
+		emailsent, time.Now().Add(time.Duration(grace)), node.MapID,
+		node.SourceID)
 	return
 }
 
@@ -49,11 +58,12 @@ func (db DB) VerifyQueuedNode(id int64, r *http.Request) (addr IP, verifyerr err
 	details := sql.NullString{}
 
 	err = db.QueryRow(`
-SELECT address,owner,email,contact,details,pgp,lat,lon,status
+SELECT address,owner,email,contact,details,pgp,lat,lon,status,map_id,source
 FROM nodes_verify_queue WHERE id = ?;`, id).Scan(
 		&node.Addr, &node.OwnerName, &node.OwnerEmail,
 		&contact, &details, &node.PGP,
-		&node.Latitude, &node.Longitude, &node.Status)
+		&node.Latitude, &node.Longitude, &node.Status, &node.MapID,
+		&node.SourceID)
 	if err != nil {
 		return
 	}
@@ -66,7 +76,12 @@ FROM nodes_verify_queue WHERE id = ?;`, id).Scan(
 		return
 	}
 
-	err = db.AddNode(node)
+	// Nodes which were cached are adopted, rather than simply added.
+	if node.SourceID != 0 {
+		err = db.AdoptNode(node)
+	} else {
+		err = db.AddNode(node)
+	}
 	if err != nil {
 		return
 	}
@@ -74,12 +89,13 @@ FROM nodes_verify_queue WHERE id = ?;`, id).Scan(
 	_, err = db.Exec(`DELETE FROM nodes_verify_queue
 WHERE id = ?;`, id)
 	if err != nil {
-		l.Errf("Could not clear verified node %d: %s", id, err)
+		dbLog.Request(r).Errf("Could not clear verified node %d: %s", id, err)
 	}
 
 	// Add it to the RSS feed. The feed will be refreshed at the next
 	// heartbeat.
 	AddNodeToRSS(node, time.Now())
+	RunHooks(HookNodeVerified, publicNode(node))
 
 	return node.Addr, nil, nil
 }
@@ -91,13 +107,15 @@ var (
 // VerifyRegistrant performs appropriate registration-time checks to
 // ensure that a Node is fit to be placed in the verification
 // queue. If the given Node is acceptable, then no error will be
-// returned.
+// returned. If it is not, the error is a jas.RequestError, such as
+// DuplicateNodeError, which can be reported to the registrant, and
+// any other error is a database error.
 func (db DB) VerifyRegistrant(node *Node) error {
 	// Ensure that the node's address is contained by the netmask.
 	if Conf.Verify.Netmask != nil {
 		if !(*net.IPNet)(Conf.Verify.Netmask).Contains(net.IP(node.Addr)) {
-			return fmt.Errorf(NodeAddrNotContainedByNetmaskError,
-				Conf.Verify.Netmask)
+			return jas.NewRequestError(fmt.Sprintf(
+				NodeAddrNotContainedByNetmaskError, Conf.Verify.Netmask))
 		}
 	}
 
@@ -108,10 +126,20 @@ func (db DB) VerifyRegistrant(node *Node) error {
 	}
 	for _, n := range nodeList {
 		if bytes.Equal(n.Addr, node.Addr) {
-			return errors.New("Non-unique IP address")
+			return DuplicateNodeError
 		}
 	}
 
+	// Ensure that the address is not reserved for someone else.
+	if err = db.CheckReservation(node.Addr, node.OwnerEmail); err != nil {
+		return err
+	}
+
+	// Check the rules added by extensions, whose errors all describe
+	// the node.
+	if err = ValidateNode(node); err != nil {
+		return jas.NewRequestError(err.Error())
+	}
 	return nil
 }
 
@@ -141,18 +169,33 @@ func VerifyRequest(node *Node, r *http.Request) error {
 }
 
 // SendVerificationEmail uses the fields in Conf.SMTP to send a
-// templated email (verification.txt) to the given email address. If
-// the email could not be sent, it returns an error.
-func SendVerificationEmail(id int64, recipientEmail string) (err error) {
-	// Prepare an Email type.
+// templated email (verification.txt) to the given email address. The
+// request which caused the email to be sent, if not nil, is used to
+// generate the link. If the email could not be sent, it returns an
+// error.
+func SendVerificationEmail(id int64, recipientEmail string,
+	r *http.Request) (err error) {
+	// Prepare an Email type, in the language of the request.
+	locale := NegotiateLocale(r)
 	e := &Email{
-		To:      recipientEmail,
-		From:    Conf.SMTP.EmailAddress,
-		Subject: Conf.Name + " Node Registration",
+		To:   recipientEmail,
+		From: Conf.SMTP.EmailAddress,
+		Subject: Translations.Translate(locale,
+			"email.verification.subject", Conf.Name),
+		Locale: locale,
+	}
+
+	// Verification pages are not served in headless mode, so link to
+	// the frontend, if there is one, or to the API.
+	verifyLink := PageURL(r) + "/verify/" + strconv.FormatInt(id, 10)
+	if Conf.Web.Headless && len(Conf.Web.FrontendURL) == 0 {
+		verifyLink = BaseURL(r) + "/api/verify?id=" +
+			strconv.FormatInt(id, 10)
 	}
 
 	e.Data = map[string]interface{}{
-		"Link":           Conf.Web.Hostname + Conf.Web.Prefix,
+		"Link":           BaseURL(r),
+		"VerifyLink":     verifyLink,
 		"VerificationID": id,
 		"FromNode":       Conf.Verify.FromNode,
 		"Flags":          Conf.ExtraVerificationFlags,
@@ -163,7 +206,7 @@ func SendVerificationEmail(id int64, recipientEmail string) (err error) {
 	}
 
 	if err = e.Send("verification.txt"); err == nil {
-		l.Debugf("Sent verification email to %d", id)
+		mailLog.Request(r).Debugf("Sent verification email to %d", id)
 	}
 	return
 }
@@ -176,7 +219,7 @@ func ResendVerificationEmails() {
 FROM nodes_verify_queue
 WHERE verifysent = 0;`)
 	if err != nil {
-		l.Errf("Error resending verification emails: %s", err)
+		mailLog.Errf("Error resending verification emails: %s", err)
 		return
 	}
 
@@ -190,12 +233,12 @@ WHERE verifysent = 0;`)
 		)
 
 		if err = rows.Scan(&id, &email); err != nil {
-			l.Errf("Error resending verification email: %s", err)
+			mailLog.Errf("Error resending verification email: %s", err)
 			continue
 		}
 
-		if err = SendVerificationEmail(id, email); err != nil {
-			l.Warningf("Could not send verification email to %q: %s", email, err)
+		if err = SendVerificationEmail(id, email, nil); err != nil {
+			mailLog.Warningf("Could not send verification email to %q: %s", email, err)
 		} else {
 			verifysent = append(verifysent, id)
 		}
@@ -205,13 +248,13 @@ WHERE verifysent = 0;`)
 SET verifysent = 1
 WHERE id = ?;`)
 	if err != nil {
-		l.Errf("Error preparing verifysent statement: %s", err)
+		mailLog.Errf("Error preparing verifysent statement: %s", err)
 		return
 	}
 
 	for _, id := range verifysent {
 		if _, err = setVerifysent.Exec(id); err != nil {
-			l.Warningf("Could not set verifysent for %d: %s", id, err)
+			mailLog.Warningf("Could not set verifysent for %d: %s", id, err)
 		}
 	}
 }
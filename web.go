@@ -4,6 +4,7 @@ package main
 // Dylan Whichard, and contributors; (GPLv3) see LICENSE or doc.go
 
 import (
+	"context"
 	"encoding/xml"
 	"errors"
 	"github.com/baliw/moverss"
@@ -24,11 +25,21 @@ var (
 )
 
 var (
-	listener net.Listener
+	listeners []net.Listener
 
 	captchaServer = captcha.Server(captcha.StdWidth, captcha.StdHeight)
 )
 
+// Defaults for the HTTP server limits, used when the corresponding
+// fields in Conf.Web are not set.
+const (
+	DefaultReadTimeout    = 30 * time.Second
+	DefaultWriteTimeout   = 60 * time.Second
+	DefaultIdleTimeout    = 2 * time.Minute
+	DefaultMaxHeaderBytes = 64 << 10 // 64KiB
+	DefaultMaxBodyBytes   = 1 << 20  // 1MiB
+)
+
 var (
 	InvalidBindAddress   = errors.New("invalid address to bind to")
 	InvalidCAPTCHAFormat = errors.New("CAPTCHA format invalid")
@@ -36,73 +47,253 @@ var (
 )
 
 // StartServer is a simple helper function to register any handlers
-// (such as the API) and start the HTTP server on the configured
-// address (Conf.Web.Addr).
+// (such as the API) and start the HTTP server on each of the
+// configured addresses (Conf.Web.Addr).
 //
 // If Conf.Web.Prefix or Conf.Web.DeproxyHeaderFields has a length
 // greater than zero, it wraps its http.ServeMux with a Deproxier.
 //
-// On crash, it returns the error.
+// On crash of any listener, it returns the error.
 func StartServer() (err error) {
 	// Register any handlers.
 	RegisterAPI(Conf.Web.Prefix)
+	RegisterResources(Conf.Web.Prefix)
+	RegisterGRPC(Conf.Web.Prefix)
+	RegisterExtensionHandlers(Conf.Web.Prefix)
+	if Conf.Map.TileProxy.Enabled {
+		RegisterTileProxy(Conf.Web.Prefix)
+	}
 	l.Debug("Registered API handler\n")
 
-	err = RegisterTemplates()
+	err = RegisterEmailTemplates()
 	if err != nil {
 		return
 	}
+	if !Conf.Web.Headless {
+		err = RegisterTemplates()
+		if err != nil {
+			return
+		}
+	}
 
-	// Parse the address and create an appropriate net.Listener. The
-	// Web.Addr will be of the form "protocol://address:port".
-	parts := strings.Split(Conf.Web.Addr, "://")
-	if len(parts) != 2 {
+	if len(Conf.Web.Addr) == 0 {
 		return InvalidBindAddress
 	}
-	listener, err = net.Listen(parts[0], parts[1])
+
+	// If this process was started by Restart, serve on the
+	// listeners of the previous one, so that no connections are
+	// refused.
+	inherited, err := inheritedListeners()
 	if err != nil {
 		return
 	}
+	if len(inherited) > 0 && len(inherited) != len(Conf.Web.Addr) {
+		l.Warningf("Inherited %d listeners for %d addresses; "+
+			"listening anew\n", len(inherited), len(Conf.Web.Addr))
+		for _, listener := range inherited {
+			listener.Close()
+		}
+		inherited = nil
+	}
 
-	// Change permissions for unix socket to be 777, so that web servers can
-	// write to it
-	if parts[0] == "unix" {
-		l.Infof("Changing permissions for %q to 777\n", parts[1])
-		err = os.Chmod(parts[1], 0777)
+	// Create an appropriate net.Listener for every configured
+	// address before starting to serve on any of them, so that
+	// configuration errors are reported immediately.
+	listeners = make([]net.Listener, 0, len(Conf.Web.Addr))
+	for i, addr := range Conf.Web.Addr {
+		if inherited != nil {
+			listeners = append(listeners, inherited[i])
+			continue
+		}
+		var listener net.Listener
+		listener, err = Listen(addr)
 		if err != nil {
+			// Close any listeners which were already opened.
+			for _, listener := range listeners {
+				listener.Close()
+			}
 			return
 		}
+		listeners = append(listeners, listener)
 	}
 
-	// Create a custom http.Server, so that we can have better control
-	// over certain behaviors.
-	s := &http.Server{}
-
 	// If either the Prefix or DeproxyHeaderFields are set, then we
 	// need to wrap the default Handler with a Deproxier. Otherwise,
 	// we just use our Handler.
-	if len(Conf.Web.Prefix) > 0 || len(Conf.Web.DeproxyHeaderFields) > 0 {
-		s.Handler = &Deproxier{http.DefaultServeMux}
+	var handler http.Handler
+	if len(Conf.Web.Prefix) > 0 || len(Conf.Web.DeproxyHeaderFields) > 0 ||
+		len(Conf.Web.TrustedProxies) > 0 {
+		handler = &Deproxier{http.DefaultServeMux}
 	} else {
-		s.Handler = &Handler{http.DefaultServeMux}
+		handler = &Handler{http.DefaultServeMux}
+	}
+
+	// Limit the size of request bodies, so that small deployments
+	// can't be overwhelmed by oversized uploads.
+	maxBody := Conf.Web.MaxBodyBytes
+	if maxBody == 0 {
+		maxBody = DefaultMaxBodyBytes
 	}
+	handler = &BodyLimiter{handler, maxBody}
+
+	// Record the latency and status of every request, so that they
+	// can be summarized at /api/admin/perf.
+	handler = &PerfRecorder{handler}
+
+	// Give every request an ID, which is attached to its log lines
+	// and given in its response.
+	handler = &RequestTracer{handler}
 
 	// We need to set the database tile store.
 	captcha.SetCustomStore(CAPTCHAStore{})
 
-	http.HandleFunc("/", HandleStatic)
-	http.HandleFunc("/node/", HandleMap)
-	http.HandleFunc("/verify/", HandleMap)
+	// In headless mode, only the API and the resources it relies on
+	// are served, and the frontend is expected to be served
+	// elsewhere.
+	if !Conf.Web.Headless {
+		http.HandleFunc("/", HandleStatic)
+		http.HandleFunc("/node/", HandleNode)
+		http.HandleFunc("/verify/", HandleMap)
+		http.HandleFunc("/n/", HandleShortLink)
+		http.HandleFunc("/admin/federation", HandleFederationPage)
+		http.HandleFunc("/my", HandleMy)
+	} else {
+		l.Info("Running headless; serving only the API\n")
+	}
 	http.Handle("/captcha/", captchaServer)
+	http.HandleFunc("/feed.atom", HandleFeed)
+
+	// Start an HTTP server on every listener, and return the first
+	// error that any of them encounter.
+	errs := make(chan error, len(listeners))
+	for i, listener := range listeners {
+		// Create a custom http.Server, so that we can have better
+		// control over certain behaviors, such as timeouts.
+		s := newServer(handler)
+
+		// If the listener has its own prefix, strip it before
+		// passing the request on.
+		if prefix := Conf.Web.Addr[i].Prefix; len(prefix) > 0 {
+			s.Handler = http.StripPrefix(
+				strings.TrimRight(prefix, "/"), handler)
+		}
+
+		l.Infof("Starting HTTP server on %q\n", Conf.Web.Addr[i].Addr)
+		servers = append(servers, s)
+		go func(s *http.Server, listener net.Listener) {
+			errs <- s.Serve(listener)
+		}(s, listener)
+	}
+
+	// Let the previous process, if any, and systemd know that this one
+	// is serving.
+	NotifyReady()
+	return <-errs
+}
+
+// newServer creates an *http.Server with the given handler and with
+// timeouts and limits set from Conf.Web, or their defaults.
+func newServer(handler http.Handler) *http.Server {
+	s := &http.Server{
+		Handler:        handler,
+		ReadTimeout:    time.Duration(Conf.Web.ReadTimeout),
+		WriteTimeout:   time.Duration(Conf.Web.WriteTimeout),
+		IdleTimeout:    time.Duration(Conf.Web.IdleTimeout),
+		MaxHeaderBytes: Conf.Web.MaxHeaderBytes,
+	}
+	if s.ReadTimeout == 0 {
+		s.ReadTimeout = DefaultReadTimeout
+	}
+	if s.WriteTimeout == 0 {
+		s.WriteTimeout = DefaultWriteTimeout
+	}
+	if s.IdleTimeout == 0 {
+		s.IdleTimeout = DefaultIdleTimeout
+	}
+	if s.MaxHeaderBytes == 0 {
+		s.MaxHeaderBytes = DefaultMaxHeaderBytes
+	}
+	// Cancel the work of every request when the server shuts down,
+	// once it is no longer waiting for them to finish.
+	s.BaseContext = func(net.Listener) context.Context {
+		return serverContext
+	}
+	// Mark the requests of connections on UNIX sockets, whose peers
+	// have no addresses, so that they can be trusted as proxies.
+	s.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if c.LocalAddr().Network() == "unix" {
+			return context.WithValue(ctx, unixPeerKey{}, true)
+		}
+		return ctx
+	}
+	return s
+}
+
+// unixPeerKey is the context key under which requests received on UNIX
+// sockets are marked, as by newServer.
+type unixPeerKey struct{}
 
-	// Start the HTTP server and return any errors if it crashes.
-	l.Infof("Starting HTTP server on %q\n", Conf.Web.Addr)
-	return s.Serve(listener)
+// FromUnixSocket reports whether the request was received on a UNIX
+// socket, whose peer can only be a local process, such as a reverse
+// proxy, and has no address of its own.
+func FromUnixSocket(r *http.Request) bool {
+	unix, _ := r.Context().Value(unixPeerKey{}).(bool)
+	return unix
+}
+
+// Listen parses the address of the given ListenAddr and creates an
+// appropriate net.Listener. The address will be of the form
+// "protocol://address:port", or "unix:/path/to/socket". If a UNIX
+// socket is created, its permissions are set to addr.SocketMode, or
+// 0777 if it is not set, so that web servers can write to it.
+func Listen(addr ListenAddr) (listener net.Listener, err error) {
+	var network, address string
+	if parts := strings.SplitN(addr.Addr, "://", 2); len(parts) == 2 {
+		network, address = parts[0], parts[1]
+	} else if strings.HasPrefix(addr.Addr, "unix:") {
+		network, address = "unix", addr.Addr[len("unix:"):]
+	} else {
+		return nil, InvalidBindAddress
+	}
+
+	if network == "unix" {
+		// If a socket was left behind by a previous instance, remove
+		// it, or we will not be able to bind.
+		if fi, err := os.Stat(address); err == nil &&
+			fi.Mode()&os.ModeSocket != 0 {
+			l.Debugf("Removing stale socket %q\n", address)
+			os.Remove(address)
+		}
+	}
+
+	listener, err = net.Listen(network, address)
+	if err != nil {
+		return
+	}
+
+	if network == "unix" {
+		mode := os.FileMode(0777)
+		if addr.SocketMode != 0 {
+			mode = os.FileMode(addr.SocketMode)
+		}
+		l.Infof("Changing permissions for %q to %#o\n", address, mode)
+		if err = os.Chmod(address, mode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return
 }
 
 // HandleStatic serves files directly from <StaticDir>/web using
 // http.ServeFile().
 func HandleStatic(w http.ResponseWriter, req *http.Request) {
+	// Requests beneath "/<id>/" are served from the static directory
+	// of that SubMap.
+	if file, ok := mapStaticFile(req.URL.Path); ok {
+		http.ServeFile(w, req, file)
+		return
+	}
 	http.ServeFile(w, req, path.Join(StaticDir, "web", req.URL.Path))
 }
 
@@ -111,6 +302,99 @@ func HandleMap(w http.ResponseWriter, req *http.Request) {
 	http.ServeFile(w, req, path.Join(StaticDir, "web", "index.html"))
 }
 
+// nodePage is the data with which the node page template is
+// executed.
+type nodePage struct {
+	Conf *Config
+
+	// URL is the absolute URL of the page.
+	URL string
+
+	Node    *Node
+	Status  []string
+	History []StatusChange
+
+	// Comments are the visible comments on the node.
+	Comments []*Comment
+
+	// Source is the hostname of the map the node was retrieved from,
+	// or empty if it is local.
+	Source string
+}
+
+// HandleNode serves a page describing a single node, as given by the
+// address in the path "/node/<addr>", using the "node.html" template.
+// The map, focused on the node, is served at "/node/<addr>/map".
+func HandleNode(w http.ResponseWriter, req *http.Request) {
+	db := Db.WithContext(req.Context())
+	parts := strings.Split(strings.Trim(
+		strings.TrimPrefix(req.URL.Path, "/node/"), "/"), "/")
+	if len(parts) == 2 && parts[1] == "map" {
+		HandleMap(w, req)
+		return
+	} else if len(parts) == 2 && parts[1] == "feed" {
+		if ip := ParseIP(parts[0]); ip != nil {
+			HandleNodeFeed(w, req, ip)
+		} else {
+			http.NotFound(w, req)
+		}
+		return
+	} else if len(parts) != 1 {
+		http.NotFound(w, req)
+		return
+	}
+
+	ip := ParseIP(parts[0])
+	if ip == nil {
+		http.NotFound(w, req)
+		return
+	}
+	node, err := db.GetNode(ip)
+	if err == NodeNotFoundError {
+		http.NotFound(w, req)
+		return
+	} else if err != nil {
+		l.Errf("Error getting node %q: %s", ip, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	// Never display the owner's email address.
+	node.OwnerEmail = ""
+
+	lang := NegotiateLocale(req)
+	data := &nodePage{
+		Conf:   Conf,
+		URL:    NodePageURL(req, ip),
+		Node:   node,
+		Status: StatusText(Translations, lang, node.Status),
+	}
+
+	if node.SourceID != 0 {
+		data.Source, err = db.FindSourceMap(node.SourceID)
+	} else {
+		data.History, err = db.StatusHistory(ip)
+		if err == nil {
+			node.Photos, err = db.Photos(ip)
+		}
+		if err == nil {
+			data.Comments, err = db.Comments(ip, false)
+		}
+	}
+	if err != nil {
+		// The page is still useful without these, so just log the
+		// error.
+		l.Errf("Error getting details of node %q: %s", ip, err)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", lang)
+	err = ExecuteLocalized(pages, w, "node.html", lang, data)
+	if err != nil {
+		l.Errf("Error executing node page template: %s", err)
+	}
+}
+
 // Handler acts is a simple http.Handler which performs some cleanup
 // on the Request before passing it on to its underlying
 // http.ServeMux.
@@ -119,30 +403,101 @@ type Handler struct {
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	r.RemoteAddr, _, _ = net.SplitHostPort(r.RemoteAddr)
+	// Addresses without ports, such as those of peers on UNIX
+	// sockets, are kept as they are.
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		r.RemoteAddr = host
+	}
 	h.Mux.ServeHTTP(w, r)
 }
 
+// BodyLimiter is an http.Handler which limits the size of request
+// bodies to MaxBytes, or the limit of their route as given by
+// routeBodyLimit if it is larger, before passing requests on to its
+// underlying Handler. Reading past the limit produces an error.
+type BodyLimiter struct {
+	Handler  http.Handler
+	MaxBytes int64
+}
+
+func (b *BodyLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	maxBytes := b.MaxBytes
+	if n := routeBodyLimit(r.URL.Path); n > maxBytes {
+		maxBytes = n
+	}
+	if r.ContentLength > maxBytes {
+		// If the client has told us in advance that the body is too
+		// large, don't bother reading any of it.
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+	b.Handler.ServeHTTP(w, r)
+}
+
+// routeBodyLimit returns the limit on the size of request bodies to the
+// given path, if it is one of the routes which accept uploads of photos
+// and so may be larger than Conf.Web.MaxBodyBytes, or 0 otherwise. The
+// handlers of these routes enforce the same limit themselves.
+func routeBodyLimit(path string) int64 {
+	switch {
+	case strings.Contains(path, "/api/nodes/") &&
+		strings.HasSuffix(path, "/photos"):
+		return photoBodyLimit(1)
+	case strings.HasSuffix(path, "/api/surveys"):
+		return photoBodyLimit(MaxPhotosPerSurvey)
+	}
+	return 0
+}
+
 // Deproxier implements the http.Handler interface by setting the
 // http.Request.RemoteAddr to the appropriate header field, if
 // set, then passing the request on to its underlying http.ServeMux.
 //
-// It interprets the following header fields as a real remote address,
-// in this order.
-//     X-Proxied-For
+// It interprets the header fields in Conf.Web.DeproxyHeaderFields as
+// a real remote address, in order, such as the following.
+//     X-Forwarded-For
 //     X-Real-Ip
+//
+// If Conf.Web.TrustedProxies is set, the header fields are only used
+// if the request comes from a trusted proxy, and X-Forwarded-For is
+// used if no fields are configured. The protocol given in
+// X-Forwarded-Proto by a trusted proxy is stored as the request's
+// URL.Scheme, so that it can be used by BaseURL.
 type Deproxier struct {
 	Mux *http.ServeMux
 }
 
 func (d *Deproxier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Check the acceptable header fields in order, checking if each
-	// one is present. If so, set the r.RemoteAddr to its first value
-	// and break out of the loop.
-	for _, fieldname := range Conf.Web.DeproxyHeaderFields {
-		if realip, ok := r.Header[fieldname]; ok {
-			r.RemoteAddr = realip[0]
-			break
+	// Strip the port from the connecting address, so that it can be
+	// compared against the trusted proxies, and so that it is in the
+	// same form as a deproxied address.
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		r.RemoteAddr = host
+	}
+
+	// Peers on UNIX sockets have no addresses to compare, but can
+	// only be local processes, so they are trusted.
+	if FromUnixSocket(r) || IsTrustedProxy(r.RemoteAddr) {
+		fieldnames := Conf.Web.DeproxyHeaderFields
+		if len(fieldnames) == 0 && len(Conf.Web.TrustedProxies) > 0 {
+			fieldnames = []string{"X-Forwarded-For"}
+		}
+
+		// Check the acceptable header fields in order, checking if
+		// each one is present. If so, set the r.RemoteAddr to the
+		// client address it gives and break out of the loop.
+		for _, fieldname := range fieldnames {
+			if values, ok := r.Header[fieldname]; ok {
+				r.RemoteAddr = deproxyAddr(fieldname, values)
+				break
+			}
+		}
+
+		switch proto := r.Header.Get("X-Forwarded-Proto"); proto {
+		case "http", "https":
+			r.URL.Scheme = proto
 		}
 	}
 
@@ -150,9 +505,89 @@ func (d *Deproxier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	d.Mux.ServeHTTP(w, r)
 }
 
-// RegisterTemplates loads templates from <StaticDir>/email/*.txt into
-// the global variable t.
-func RegisterTemplates() (err error) {
+// deproxyAddr returns the client address given by the values of a
+// header field. For X-Forwarded-For, which is a comma-separated list
+// of addresses appended to by each proxy, it walks from the right and
+// returns the first address which is not a trusted proxy. For other
+// fields, it returns the first value.
+func deproxyAddr(fieldname string, values []string) string {
+	if fieldname != "X-Forwarded-For" {
+		return strings.TrimSpace(values[0])
+	}
+
+	addrs := strings.Split(strings.Join(values, ","), ",")
+	for i := len(addrs) - 1; i > 0; i-- {
+		addr := strings.TrimSpace(addrs[i])
+		if len(Conf.Web.TrustedProxies) == 0 || !IsTrustedProxy(addr) {
+			return addr
+		}
+	}
+	return strings.TrimSpace(addrs[0])
+}
+
+// IsTrustedProxy reports whether the given address is contained by
+// any of Conf.Web.TrustedProxies. If none are configured, every
+// address is trusted.
+func IsTrustedProxy(addr string) bool {
+	if len(Conf.Web.TrustedProxies) == 0 {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for i := range Conf.Web.TrustedProxies {
+		if Conf.Web.TrustedProxies[i].Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// BaseURL returns the absolute URL of this instance, which is
+// Conf.Web.Hostname followed by Conf.Web.Prefix. If r is not nil and
+// was received via a trusted proxy which gave the original protocol,
+// then the scheme of the URL is replaced to match it.
+func BaseURL(r *http.Request) string {
+	base := Conf.Web.Hostname + Conf.Web.Prefix
+	if r == nil || len(r.URL.Scheme) == 0 {
+		return base
+	}
+	if i := strings.Index(base, "://"); i >= 0 {
+		base = base[i+3:]
+	}
+	return r.URL.Scheme + "://" + base
+}
+
+// PageURL returns the base URL of the pages of the frontend, such as
+// those of nodes, which is Conf.Web.FrontendURL if it is set, or
+// BaseURL otherwise.
+func PageURL(r *http.Request) string {
+	if len(Conf.Web.FrontendURL) > 0 {
+		return strings.TrimRight(Conf.Web.FrontendURL, "/")
+	}
+	return BaseURL(r)
+}
+
+// NodePageURL returns the absolute URL of the page of the node with
+// the given address, as given by PageURL.
+func NodePageURL(r *http.Request, addr IP) string {
+	return PageURL(r) + "/node/" + addr.String()
+}
+
+// RegisterEmailTemplates loads the locales into Translations, and
+// templates from <StaticDir>/email/*.txt into the global variable t.
+func RegisterEmailTemplates() (err error) {
+	// Load the locales first, so that the templates can be
+	// translated.
+	Translations, err = LoadThemeLocales(*fRes, Conf.Theme)
+	if err != nil {
+		return
+	}
+	// The templates are parsed with functions for the default
+	// locale, which are replaced by ExecuteLocalized.
+	localized := localeFuncs(Translations, Conf.DefaultLocale())
+
 	t = template.New("")
 
 	t.Funcs(template.FuncMap{
@@ -160,12 +595,35 @@ func RegisterTemplates() (err error) {
 			return template.HTML(
 				string(blackfriday.MarkdownBasic([]byte(s))))
 		},
+		"date": formatDate,
 	})
+	t.Funcs(localized)
 
 	t, err = t.ParseGlob(path.Join(StaticDir, "email/*.txt"))
 	return
 }
 
+// formatDate formats a time for templates, such as
+// "2006-01-02 15:04".
+func formatDate(t time.Time) string {
+	return t.Format("2006-01-02 15:04")
+}
+
+// RegisterTemplates loads templates from <StaticDir>/webpages/*.html
+// into the global variable pages. It must be called after
+// RegisterEmailTemplates, which loads the locales.
+func RegisterTemplates() (err error) {
+	pages = template.New("")
+	pages.Funcs(template.FuncMap{
+		"date":        formatDate,
+		"statusNames": StatusNames,
+		"join":        strings.Join,
+	})
+	pages.Funcs(localeFuncs(Translations, Conf.DefaultLocale()))
+	pages, err = pages.ParseGlob(path.Join(StaticDir, "webpages/*.html"))
+	return
+}
+
 // VerifyCAPTCHA accepts a *http.Request and verifies that the given
 // 'captcha' form is valid. This is a string of the form
 // "id:solution". It will return IncorrectCAPTCHAError if the solution